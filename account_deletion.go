@@ -0,0 +1,106 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// DeleteAccount deletes the user with screenName and everything about them, leaving only
+// models.DeletedScreenName in the history of the users they talked to. A signed on user is sent a
+// channel 4 FLAP and disconnected first, and buddies watching them see them leave before the
+// buddy lists they're on are deleted. It returns nil if there is no such user.
+func DeleteAccount(ctx context.Context, db *bun.DB, sm *SessionManager, screenName string, logger *slog.Logger) (*models.User, error) {
+	user, err := models.UserByScreenName(ctx, db, screenName)
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	// Taking the session out of the registry first means the close handler doesn't sign the
+	// user off, which would look for buddies who are already gone
+	if session := sm.GetSession(user.ScreenName); session != nil {
+		sm.RemoveSession(user.ScreenName, session)
+		session.Send(oscar.NewFLAP(4))
+		session.Disconnect()
+	}
+
+	if user.Status.Connected() {
+		user.Status = models.UserStatusOffline
+		notifyBuddies(db, sm, logger, services.StatusChanged(user))
+	}
+
+	if err := models.DeleteAccount(ctx, db, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// deleteAccountHandler is the admin endpoint that deletes the account in the screen_name form
+// value for good
+func deleteAccountHandler(db *bun.DB, sm *SessionManager, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		screenName := r.FormValue("screen_name")
+		user, err := DeleteAccount(r.Context(), db, sm, screenName, logger)
+		if err != nil {
+			logger.Error("could not delete account", "screen_name", screenName, "err", err.Error())
+			http.Error(w, "could not delete account", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, fmt.Sprintf("unknown user %q", screenName), http.StatusNotFound)
+			return
+		}
+
+		logger.Info("deleted account", "screen_name", user.ScreenName, "uin", user.UIN)
+		fmt.Fprintf(w, "deleted %s\n", user.ScreenName)
+	}
+}
+
+// exportAccountHandler is the admin endpoint with everything about the user in the screen_name
+// form value as a JSON archive, for them to download
+func exportAccountHandler(db *bun.DB, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		screenName := r.FormValue("screen_name")
+		user, err := models.UserByScreenName(r.Context(), db, screenName)
+		if err != nil {
+			logger.Error("could not look up user", "screen_name", screenName, "err", err.Error())
+			http.Error(w, "could not export account", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, fmt.Sprintf("unknown user %q", screenName), http.StatusNotFound)
+			return
+		}
+
+		export, err := models.ExportUser(r.Context(), db, user)
+		if err != nil {
+			logger.Error("could not export account", "screen_name", user.ScreenName, "err", err.Error())
+			http.Error(w, "could not export account", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("exported account", "screen_name", user.ScreenName, "uin", user.UIN)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", user.NormalizedScreenName+".json"))
+		json.NewEncoder(w).Encode(export)
+	}
+}
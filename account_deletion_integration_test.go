@@ -0,0 +1,357 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"aim-oscar/oscar/client"
+	"aim-oscar/services"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// nextEvent waits for an event that matches, skipping the others. It returns false if the
+// client is disconnected first.
+func nextEvent(t *testing.T, c *client.Client, match func(client.Event) bool) bool {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-c.Events():
+			if !ok {
+				return false
+			}
+			if match(event) {
+				return true
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s to get an event", c.ScreenName)
+		}
+	}
+}
+
+// Deleting a signed on account disconnects it, tells its buddies it left and leaves nothing of
+// it behind
+func TestDeleteAccount(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	ctx := context.Background()
+
+	alice := loggedInClient(t, d, addr, "alice")
+	bob := loggedInClient(t, d, addr, "bob")
+	if err := alice.AddBuddy("bob"); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	if err := bob.AddBuddy("alice"); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	if !nextEvent(t, bob, func(e client.Event) bool {
+		arrived, ok := e.(*client.BuddyArrived)
+		return ok && arrived.ScreenName == "alice"
+	}) {
+		t.Fatalf("expected bob to see alice arrive")
+	}
+
+	user, err := models.UserByScreenName(ctx, d, "alice")
+	if err != nil || user == nil {
+		t.Fatalf("could not find alice: %v %v", user, err)
+	}
+	bobUser, err := models.UserByScreenName(ctx, d, "bob")
+	if err != nil || bobUser == nil {
+		t.Fatalf("could not find bob: %v %v", bobUser, err)
+	}
+
+	// Everything else there can be about alice
+	icon, err := models.StoreBuddyIcon(ctx, d, []byte("alice's icon"))
+	if err != nil {
+		t.Fatalf("could not store icon: %s", err)
+	}
+	user.BuddyIconHash = icon.Hash
+	if err := user.Update(ctx, d, "buddy_icon_hash"); err != nil {
+		t.Fatalf("could not set icon: %s", err)
+	}
+	inserts := []interface{}{
+		&models.Feedbag{UserUIN: user.UIN, Name: "bob"},
+		&models.EmailVerification{UserUIN: user.UIN, Token: "token"},
+		&models.Invitation{InviterUIN: user.UIN, Email: "friend@example.com", Message: "join me"},
+		&models.ChatRoom{Exchange: 4, Cookie: "4-0-alice's room", Name: "alice's room", CreatorUIN: user.UIN},
+	}
+	for _, model := range inserts {
+		if _, err := d.NewInsert().Model(model).Exec(ctx); err != nil {
+			t.Fatalf("could not insert %T: %s", model, err)
+		}
+	}
+	if _, err := models.CreateAuthCookie(ctx, d, user.UIN, "192.0.2.1"); err != nil {
+		t.Fatalf("could not create cookie: %s", err)
+	}
+	if _, err := models.InsertMessage(ctx, d, 1, "bob", "alice", "to alice"); err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+	if _, err := models.InsertMessage(ctx, d, 2, "alice", "bob", "from alice"); err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if deleted, err := DeleteAccount(ctx, d, server.Sessions, "alice", logger); err != nil || deleted == nil {
+		t.Fatalf("could not delete alice: %v %v", deleted, err)
+	}
+
+	if !nextEvent(t, bob, func(e client.Event) bool {
+		departed, ok := e.(*client.BuddyDeparted)
+		return ok && departed.ScreenName == "alice"
+	}) {
+		t.Errorf("expected bob to see alice leave")
+	}
+	if nextEvent(t, alice, func(client.Event) bool { return false }) {
+		t.Errorf("expected alice to be disconnected")
+	}
+
+	orphans := map[string]int{}
+	count := func(name string, model interface{}, where string, args ...interface{}) {
+		n, err := d.NewSelect().Model(model).Where(where, args...).Count(ctx)
+		if err != nil {
+			t.Fatalf("could not count %s: %s", name, err)
+		}
+		orphans[name] = n
+	}
+	count("users", (*models.User)(nil), "uin = ?", user.UIN)
+	count("buddies", (*models.Buddy)(nil), "source_uin = ? OR with_uin = ?", user.UIN, user.UIN)
+	count("feedbag", (*models.Feedbag)(nil), "user_uin = ?", user.UIN)
+	count("feedbag revisions", (*models.FeedbagRevision)(nil), "user_uin = ?", user.UIN)
+	count("auth cookies", (*models.AuthCookie)(nil), "uin = ?", user.UIN)
+	count("email verification", (*models.EmailVerification)(nil), "user_uin = ?", user.UIN)
+	count("invitations", (*models.Invitation)(nil), "inviter_uin = ?", user.UIN)
+	count("messages", (*models.Message)(nil), "\"to\" = ? OR \"from\" = ?", user.NormalizedScreenName, user.NormalizedScreenName)
+	count("buddy icons", (*models.BuddyIcon)(nil), "hash = ?", icon.Hash)
+	count("chat rooms", (*models.ChatRoom)(nil), "creator_uin = ?", user.UIN)
+	for name, n := range orphans {
+		if n != 0 {
+			t.Errorf("expected no %s left for alice, got %d", name, n)
+		}
+	}
+
+	// Bob's account is untouched
+	if n, err := d.NewSelect().Model((*models.User)(nil)).Where("uin = ?", bobUser.UIN).Count(ctx); err != nil || n != 1 {
+		t.Errorf("expected bob to be kept, got %d: %v", n, err)
+	}
+	if n, err := d.NewSelect().Model((*models.ChatRoom)(nil)).Where("name = ?", "alice's room").Count(ctx); err != nil || n != 1 {
+		t.Errorf("expected alice's chat room to stay open, got %d: %v", n, err)
+	}
+}
+
+// The export has every row about the user, counted against the tables they're in
+func TestExportAccount(t *testing.T) {
+	d := serverTestDB(t)
+	ctx := context.Background()
+
+	users := map[string]*models.User{}
+	for _, screenName := range []string{"alice", "bob", "carol"} {
+		user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+		if err != nil {
+			t.Fatalf("could not create %s: %s", screenName, err)
+		}
+		users[screenName] = user
+	}
+	alice := users["alice"]
+
+	icon, err := models.StoreBuddyIcon(ctx, d, []byte("alice's icon"))
+	if err != nil {
+		t.Fatalf("could not store icon: %s", err)
+	}
+	alice.BuddyIconHash = icon.Hash
+	alice.Profile = "I like turtles"
+	if err := alice.Update(ctx, d, "buddy_icon_hash", "profile"); err != nil {
+		t.Fatalf("could not update alice: %s", err)
+	}
+
+	for _, rel := range [][2]*models.User{{alice, users["bob"]}, {alice, users["carol"]}, {users["carol"], alice}} {
+		if _, err := models.AddBuddy(ctx, d, rel[0].UIN, rel[1].UIN); err != nil {
+			t.Fatalf("could not add buddy: %s", err)
+		}
+	}
+	inserts := []interface{}{
+		&models.Feedbag{UserUIN: alice.UIN, Name: "Buddies", ClassId: 1, GroupId: 1},
+		&models.Feedbag{UserUIN: alice.UIN, Name: "bob", GroupId: 1, ItemId: 1},
+		&models.EmailVerification{UserUIN: alice.UIN, Token: "token"},
+		&models.Invitation{InviterUIN: alice.UIN, Email: "friend@example.com", Message: "join me"},
+		&models.ChatRoom{Exchange: 4, Cookie: "4-0-turtles", Name: "turtles", CreatorUIN: alice.UIN},
+	}
+	for _, model := range inserts {
+		if _, err := d.NewInsert().Model(model).Exec(ctx); err != nil {
+			t.Fatalf("could not insert %T: %s", model, err)
+		}
+	}
+	if _, err := models.CreateAuthCookie(ctx, d, alice.UIN, "192.0.2.1"); err != nil {
+		t.Fatalf("could not create cookie: %s", err)
+	}
+	for _, m := range [][2]string{{"alice", "bob"}, {"alice", "carol"}, {"bob", "alice"}, {"carol", "bob"}} {
+		if _, err := models.InsertMessage(ctx, d, 1, m[0], m[1], "hello"); err != nil {
+			t.Fatalf("could not insert message: %s", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/export?screen_name=Alice", nil)
+	rec := httptest.NewRecorder()
+	exportAccountHandler(d, slog.New(slog.NewTextHandler(io.Discard, nil)))(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the export, got %d: %s", rec.Code, rec.Body)
+	}
+	var export models.UserExport
+	if err := json.NewDecoder(rec.Body).Decode(&export); err != nil {
+		t.Fatalf("could not decode export: %s", err)
+	}
+
+	count := func(model interface{}, where string, args ...interface{}) int {
+		n, err := d.NewSelect().Model(model).Where(where, args...).Count(ctx)
+		if err != nil {
+			t.Fatalf("could not count %T: %s", model, err)
+		}
+		return n
+	}
+	counts := []struct {
+		name     string
+		exported int
+		rows     int
+	}{
+		{"messages sent", len(export.MessagesSent), count((*models.Message)(nil), "\"from\" = ?", alice.NormalizedScreenName)},
+		{"messages received", len(export.MessagesReceived), count((*models.Message)(nil), "\"to\" = ?", alice.NormalizedScreenName)},
+		{"buddies", len(export.Buddies), count((*models.Buddy)(nil), "source_uin = ?", alice.UIN)},
+		{"on buddy lists of", len(export.OnBuddyListsOf), count((*models.Buddy)(nil), "with_uin = ?", alice.UIN)},
+		{"feedbag", len(export.Feedbag), count((*models.Feedbag)(nil), "user_uin = ?", alice.UIN)},
+		{"logins", len(export.Logins), count((*models.AuthCookie)(nil), "uin = ?", alice.UIN)},
+		{"invitations", len(export.Invitations), count((*models.Invitation)(nil), "inviter_uin = ?", alice.UIN)},
+		{"chat rooms", len(export.ChatRoomsCreated), count((*models.ChatRoom)(nil), "creator_uin = ?", alice.UIN)},
+	}
+	for _, c := range counts {
+		if c.rows == 0 || c.exported != c.rows {
+			t.Errorf("expected %d %s to be exported, got %d", c.rows, c.name, c.exported)
+		}
+	}
+
+	if export.Account.ScreenName != "alice" || export.Account.Email != "alice@example.com" || export.Account.Profile != "I like turtles" {
+		t.Errorf("expected alice's account, got %+v", export.Account)
+	}
+	if !bytes.Equal(export.BuddyIcon, []byte("alice's icon")) {
+		t.Errorf("expected alice's icon, got %q", export.BuddyIcon)
+	}
+	if export.EmailVerification == nil {
+		t.Errorf("expected the email verification")
+	}
+	if export.Logins[0].IP != "192.0.2.1" {
+		t.Errorf("expected the login's IP, got %s", export.Logins[0].IP)
+	}
+	if bytes.Contains(rec.Body.Bytes(), []byte("password")) {
+		t.Errorf("expected the password to be left out")
+	}
+}
+
+// Purging an account leaves nothing in any table that identifies the user, and the users they
+// talked to keep their side of the conversation
+func TestDeleteAccountLeavesNoPII(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	ctx := context.Background()
+
+	alice := loggedInClient(t, d, addr, "alice")
+	loggedInClient(t, d, addr, "bob")
+	user, err := models.UserByScreenName(ctx, d, "alice")
+	if err != nil || user == nil {
+		t.Fatalf("could not find alice: %v %v", user, err)
+	}
+	bobUser, err := models.UserByScreenName(ctx, d, "bob")
+	if err != nil || bobUser == nil {
+		t.Fatalf("could not find bob: %v %v", bobUser, err)
+	}
+
+	if _, err := models.AddBuddy(ctx, d, bobUser.UIN, user.UIN); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	if _, err := models.CreateAuthCookie(ctx, d, user.UIN, "192.0.2.1"); err != nil {
+		t.Fatalf("could not create cookie: %s", err)
+	}
+	// bob's SSI list has alice as a buddy and on his deny list, however he typed her name
+	feedbag := []*models.Feedbag{
+		{UserUIN: bobUser.UIN, ClassId: uint16(services.FeedbagItemTypeGroup), Attributes: []byte{0x00, 0xc8, 0x00, 0x02, 0x00, 0x01}},
+		{UserUIN: bobUser.UIN, GroupId: 1, ClassId: uint16(services.FeedbagItemTypeGroup), Name: "Friends", Attributes: []byte{0x00, 0xc8, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02}},
+		{UserUIN: bobUser.UIN, GroupId: 1, ItemId: 1, ClassId: uint16(services.FeedbagItemTypeUser), Name: "Alice"},
+		{UserUIN: bobUser.UIN, GroupId: 1, ItemId: 2, ClassId: uint16(services.FeedbagItemTypeUser), Name: "carol"},
+		{UserUIN: bobUser.UIN, ItemId: 3, ClassId: uint16(services.FeedbagItemTypeDeny), Name: "A Lice"},
+	}
+	if _, err := d.NewInsert().Model(&feedbag).Exec(ctx); err != nil {
+		t.Fatalf("could not add feedbag: %s", err)
+	}
+	delivered := [][2]string{{"alice", "bob"}, {"bob", "alice"}, {"alice", "alice"}}
+	waiting := [][2]string{{"alice", "bob"}, {"bob", "alice"}}
+	for i, m := range append(delivered, waiting...) {
+		message, err := models.InsertMessage(ctx, d, 1, m[0], m[1], "hi there")
+		if err != nil {
+			t.Fatalf("could not insert message: %s", err)
+		}
+		if i < len(delivered) {
+			if err := message.MarkDelivered(ctx, d); err != nil {
+				t.Fatalf("could not deliver message: %s", err)
+			}
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if deleted, err := DeleteAccount(ctx, d, server.Sessions, "alice", logger); err != nil || deleted == nil {
+		t.Fatalf("could not delete alice: %v %v", deleted, err)
+	}
+	if nextEvent(t, alice, func(client.Event) bool { return false }) {
+		t.Errorf("expected alice to be disconnected")
+	}
+
+	// Only the items naming alice are gone from bob's list, which is a new revision of it
+	items, err := models.FeedbagForUser(ctx, d, bobUser.UIN)
+	if err != nil {
+		t.Fatalf("could not fetch bob's feedbag: %s", err)
+	}
+	var names []string
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"", "Friends", "carol"}) {
+		t.Errorf("expected only alice's items to be taken off bob's feedbag, got %q", names)
+	}
+	if rev, _ := models.FeedbagRevisionFor(ctx, d, bobUser.UIN); rev == nil || rev.Revision != 1 {
+		t.Errorf("expected bob's feedbag revision to be bumped, got %+v", rev)
+	}
+
+	for _, model := range db.Models {
+		for _, pii := range []string{user.NormalizedScreenName, user.Email, "192.0.2.1"} {
+			n, err := d.NewSelect().Model(model).Where("?TableAlias::text ILIKE ?", "%"+pii+"%").Count(ctx)
+			if err != nil {
+				t.Fatalf("could not search %T: %s", model, err)
+			}
+			if n != 0 {
+				t.Errorf("expected nothing with %q left in %T, got %d rows", pii, model, n)
+			}
+		}
+	}
+
+	// bob keeps the delivered messages he sent alice and got from her
+	var history []*models.Message
+	if err := d.NewSelect().Model(&history).Where("\"from\" = ? OR \"to\" = ?", "bob", "bob").Order("id ASC").Scan(ctx); err != nil {
+		t.Fatalf("could not fetch bob's messages: %s", err)
+	}
+	if len(history) != 2 ||
+		history[0].From != models.DeletedScreenName || history[0].To != "bob" ||
+		history[1].From != "bob" || history[1].To != models.DeletedScreenName {
+		t.Errorf("expected bob's delivered messages with alice to be kept without her name, got %v", history)
+	}
+
+	if server.Sessions.GetSession("bob") == nil {
+		t.Errorf("expected bob to still be signed on")
+	}
+}
@@ -1,6 +1,26 @@
 package aimerror
 
-import "github.com/pkg/errors"
+import (
+	stderrors "errors"
+
+	"github.com/pkg/errors"
+)
+
+// SNAC error codes, sent to the client in the error subtype (0x01) of the family it made the
+// request to
+const (
+	CodeInvalidSNACHeader          = 0x01
+	CodeRecipientNotLoggedIn       = 0x04
+	CodeServiceNotDefined          = 0x06
+	CodeNotSupportedByHost         = 0x08
+	CodeMessageTooLarge            = 0x0a
+	CodeLimitExceeded              = 0x0c
+	CodeRequestDenied              = 0x0d
+	CodeIncorrectSNACFormat        = 0x0e
+	CodeInLocalPermitDeny          = 0x10
+	CodeUserTemporarilyUnavailable = 0x13
+	CodeNoMatch                    = 0x14
+)
 
 func FetchingUser(err error, screen_name string) error {
 	return errors.Wrapf(err, "could not fetch user with screen_name %s", screen_name)
@@ -11,3 +31,22 @@ func UserNotFound(screen_name string) error {
 }
 
 var NoUserInSession = errors.New("no user in session")
+
+// NotSupported is a request the server doesn't implement, like a subtype a service doesn't
+// handle
+var NotSupported = errors.New("not supported by host")
+
+// TLSRequired is a request that the server only accepts over TLS
+var TLSRequired = errors.New("request requires TLS")
+
+// Code is the SNAC error code that tells the client why its request failed. Most failures
+// come from requests the server couldn't make sense of.
+func Code(err error) uint16 {
+	if stderrors.Is(err, NotSupported) {
+		return CodeNotSupportedByHost
+	}
+	if stderrors.Is(err, NoUserInSession) || stderrors.Is(err, TLSRequired) {
+		return CodeRequestDenied
+	}
+	return CodeIncorrectSNACFormat
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// AuthCookieCleanup forgets cookies that expired without being used, so cookies handed to
+// clients that never signed on don't pile up. The routine stops once done is closed.
+func AuthCookieCleanup(interval time.Duration, parentLogger *slog.Logger) func(db *bun.DB, done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "auth_cookie_cleanup"))
+
+	return func(db *bun.DB, done <-chan struct{}) {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx := oscar.NewContextWithLogger(context.Background(), logger)
+			deleted, err := models.DeleteExpiredAuthCookies(ctx, db)
+			if err != nil {
+				logger.Error("could not delete expired cookies", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				logger.Debug("deleted expired cookies", slog.Int64("count", deleted))
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Package bot has the bots the server can run as users of its own, which answer IMs without a
+// client connection
+package bot
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Bot is what runs a virtual user. Its methods are called one at a time, in the order the
+// messages and buddy adds happened.
+type Bot interface {
+	// OnMessage is an IM from the screen name, which the returned replies are sent back to.
+	// Automatic replies, like away messages, aren't passed on.
+	OnMessage(from, text string) []string
+
+	// OnBuddyAdd is the screen name adding the bot to their buddy list
+	OnBuddyAdd(from string)
+}
+
+// kinds are the bots that can be registered from the config, by name
+var kinds = map[string]func() Bot{
+	"echo": func() Bot { return Echo{} },
+}
+
+// New makes a bot of the kind named in the config
+func New(kind string) (Bot, error) {
+	newBot, ok := kinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown bot %q, must be one of %v", kind, Kinds())
+	}
+	return newBot(), nil
+}
+
+// Kinds is the names of the bots that can be registered from the config
+func Kinds() []string {
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Echo sends back whatever it's sent
+type Echo struct{}
+
+func (Echo) OnMessage(from, text string) []string {
+	return []string{text}
+}
+
+func (Echo) OnBuddyAdd(from string) {}
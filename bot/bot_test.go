@@ -0,0 +1,18 @@
+package bot
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	b, err := New("echo")
+	if err != nil {
+		t.Fatalf("could not make echo bot: %s", err)
+	}
+	replies := b.OnMessage("alice", "hello")
+	if len(replies) != 1 || replies[0] != "hello" {
+		t.Errorf("expected the message back, got %v", replies)
+	}
+
+	if _, err := New("oracle"); err == nil {
+		t.Errorf("expected an unknown bot to be an error")
+	}
+}
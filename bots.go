@@ -0,0 +1,131 @@
+package main
+
+import (
+	"aim-oscar/bot"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// botRunner is a bot signed on as a virtual user. What's sent to the bot's internal session goes
+// to the bot, and its replies go through the BOS services like a client's IMs.
+type botRunner struct {
+	bot      bot.Bot
+	db       *bun.DB
+	services *ServiceManager
+	logger   *slog.Logger
+
+	// ctx is the bot's session and user, along with what the services keep for it, like its
+	// flood bucket. Only the session's handler uses it once the bot is signed on.
+	ctx context.Context
+}
+
+// startBot signs the bot on as screenName, registering the screen name the first time. The bot
+// stays signed on until ctx is done, and done is called once it has signed off.
+func startBot(ctx context.Context, db *bun.DB, sm *SessionManager, bosServices *ServiceManager, onlineCh chan *services.PresenceEvent, screenName string, b bot.Bot, parentLogger *slog.Logger, done func()) error {
+	user, err := models.BotUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+
+	logger := parentLogger.With(slog.String("bot", user.ScreenName))
+	runner := &botRunner{bot: b, db: db, services: bosServices, logger: logger}
+	sessionCtx := oscar.NewContextWithInternalSession(ctx, logger, runner.handle)
+	session, _ := oscar.SessionFromContext(sessionCtx)
+	session.SetScreenName(user.ScreenName)
+	session.SetSignonAt(time.Now())
+	session.Ready = true
+	runner.ctx = models.NewContextWithUser(sessionCtx, user)
+
+	user.Status = models.UserStatusOnline
+	if err := user.Update(ctx, db, "status"); err != nil {
+		session.Disconnect()
+		return errors.Wrap(err, "could not set bot as online")
+	}
+	previous, ok := sm.ClaimSession(user.ScreenName, session)
+	if !ok {
+		session.Disconnect()
+		return errors.New("bot is already signed on")
+	}
+	if previous != nil {
+		previous.Disconnect()
+	}
+	onlineCh <- services.StatusChanged(user)
+	logger.Info("Bot signed on")
+
+	go func() {
+		defer done()
+		<-session.Context().Done()
+
+		if !sm.RemoveSession(user.ScreenName, session) {
+			return
+		}
+		if err := user.SetOffline(context.Background(), db); err != nil {
+			logger.Error("Could not set bot as offline", slog.String("err", err.Error()))
+		}
+		onlineCh <- services.StatusChanged(user)
+		logger.Info("Bot signed off")
+	}()
+	return nil
+}
+
+// handle passes the IMs and buddy adds sent to the bot's session on to the bot. Everything else,
+// like buddy arrivals and acks, is ignored.
+func (r *botRunner) handle(flap *oscar.FLAP) {
+	if flap.Header.Channel != 2 {
+		return
+	}
+	snac := &oscar.SNAC{}
+	if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
+		r.logger.Error("Could not read SNAC sent to bot", slog.String("err", err.Error()))
+		return
+	}
+
+	switch {
+	case snac.Header.Family == 0x04 && snac.Header.Subtype == 0x07:
+		from, text, auto, ok, err := services.ReadIncomingMessage(snac)
+		if err != nil {
+			r.logger.Error("Could not read message sent to bot", slog.String("err", err.Error()))
+			return
+		}
+
+		// Answering automatic replies could have the bot and an away user answer each other
+		// forever
+		if !ok || auto {
+			return
+		}
+		for _, reply := range r.bot.OnMessage(from, text) {
+			r.send(from, reply)
+		}
+
+	// Someone added the bot to their buddy list
+	case snac.Header.Family == 0x13 && snac.Header.Subtype == 0x1c:
+		from, err := snac.Data.ReadLPString()
+		if err != nil || from == "" {
+			r.logger.Error("Could not read who added bot")
+			return
+		}
+		r.bot.OnBuddyAdd(from)
+	}
+}
+
+// send IMs the text to the screen name as the bot
+func (r *botRunner) send(to string, text string) {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	snac := oscar.NewSNAC(0x04, 0x06)
+	snac.Data.WriteUint64(binary.BigEndian.Uint64(cookie))
+	snac.Data.WriteUint16(1) // channel
+	snac.Data.WriteLPString(to)
+	snac.Data.WriteBinary(services.MessageFragments(text))
+	r.ctx = r.services.HandleSNAC(r.ctx, r.db, snac)
+}
@@ -0,0 +1,75 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/bot"
+	"aim-oscar/models"
+	"aim-oscar/oscar/client"
+	"aim-oscar/services"
+	"context"
+	"testing"
+	"time"
+)
+
+// recordingBot echoes IMs like the echo bot, and records who adds it
+type recordingBot struct {
+	bot.Echo
+	added chan string
+}
+
+func (b *recordingBot) OnBuddyAdd(from string) {
+	b.added <- from
+}
+
+// A bot is signed on as soon as the server starts, answers IMs through the normal delivery path
+// and hears who adds it
+func TestBot(t *testing.T) {
+	d := serverTestDB(t)
+	echo := &recordingBot{added: make(chan string, 1)}
+	server, addr := startServer(t, d, WithBot("EchoBot", echo))
+
+	ctx := context.Background()
+	user, err := models.UserByScreenName(ctx, d, "echobot")
+	if err != nil || user == nil {
+		t.Fatalf("expected the bot to be registered: %v %v", user, err)
+	}
+	if !user.Bot || user.Status != models.UserStatusOnline {
+		t.Errorf("expected an online bot, got bot %v status %s", user.Bot, user.Status)
+	}
+	if session := server.Sessions.GetSession("echobot"); session == nil || !session.Internal() {
+		t.Fatalf("expected the bot to have an internal session")
+	}
+
+	alice := loggedInClient(t, d, addr, "alice")
+	if err := alice.AddBuddy("EchoBot"); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	if !nextEvent(t, alice, func(e client.Event) bool {
+		arrived, ok := e.(*client.BuddyArrived)
+		return ok && arrived.ScreenName == "EchoBot" && arrived.Class&services.UserClassBot != 0
+	}) {
+		t.Fatalf("expected alice to see the bot arrive as a bot")
+	}
+	select {
+	case from := <-echo.added:
+		if from != "alice" {
+			t.Errorf("expected the bot to hear alice added it, got %s", from)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the bot to hear it was added")
+	}
+
+	if err := alice.SendIM("EchoBot", "hello bot"); err != nil {
+		t.Fatalf("could not send IM: %s", err)
+	}
+	im := nextIM(t, alice)
+	if im.From != "EchoBot" || im.Text != "hello bot" {
+		t.Errorf("expected the bot to echo hello bot, got %q from %s", im.Text, im.From)
+	}
+
+	// A screen name that belongs to someone can't be taken by a bot
+	if _, err := models.BotUser(ctx, d, "alice"); err == nil {
+		t.Errorf("expected alice not to be made a bot")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"aim-oscar/util"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// Broadcast sends the text to every signed on user, as an IM from the system screen name or as a
+// popup depending on the mode, and records it as sent by sender. A session the broadcast can't be
+// sent to is disconnected and the rest still get it. With offline, users who aren't signed on are
+// left it as an IM for when they next sign on.
+func Broadcast(ctx context.Context, db *bun.DB, sm *SessionManager, systemScreenName, sender, mode, text string, offline bool, logger *slog.Logger) (*models.Broadcast, error) {
+	if mode != models.BroadcastModeIM && mode != models.BroadcastModePopup {
+		return nil, errors.Errorf("unknown broadcast mode %q", mode)
+	}
+
+	system, err := models.BotUser(ctx, db, systemScreenName)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get system user")
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	message := &models.Message{Cookie: binary.BigEndian.Uint64(cookie), From: system.NormalizedScreenName, Contents: text, Channel: 1}
+
+	var snac *oscar.SNAC
+	if mode == models.BroadcastModePopup {
+		snac = services.MOTDSNAC(&models.MOTD{Type: models.MOTDTypeAnnouncement, Text: text})
+	} else {
+		snac = incomingMessageSNAC(system, liveSession(sm, system.ScreenName), message)
+	}
+
+	broadcast := &models.Broadcast{Sender: sender, Mode: mode, Text: text}
+	sent := make([]string, 0)
+	sm.Range(func(session *oscar.Session) bool {
+		// Bots have nobody to read it
+		if session.Internal() {
+			return true
+		}
+
+		flap := oscar.NewFLAP(2)
+		flap.Data.WriteBinary(snac)
+		if err := session.Send(flap); err != nil {
+			logger.Warn("Could not send broadcast", "session_id", session.ID, "screen_name", session.ScreenName(), slog.String("err", err.Error()))
+			session.Disconnect()
+			broadcast.Failed++
+			return true
+		}
+		broadcast.Recipients++
+		sent = append(sent, util.NormalizeScreenName(session.ScreenName()))
+		return true
+	})
+
+	// Users whose session couldn't be sent the broadcast get it the next time they sign on
+	if offline {
+		queued, err := models.QueueBroadcast(ctx, db, message.Cookie, system.ScreenName, text, sent)
+		if err != nil {
+			return nil, err
+		}
+		broadcast.Queued = queued
+	}
+
+	if err := models.InsertBroadcast(ctx, db, broadcast); err != nil {
+		return nil, err
+	}
+	return broadcast, nil
+}
+
+// BroadcastResult is how many a broadcast reached, as the admin API has it
+type BroadcastResult struct {
+	ID         int `json:"id"`
+	Recipients int `json:"recipients"`
+	Failed     int `json:"failed"`
+	Queued     int `json:"queued"`
+}
+
+// broadcastHandler is the admin endpoint that broadcasts the text form value to everyone signed
+// on. mode is im (the default) or popup, and offline=true also leaves it for everyone else. The
+// broadcast is recorded as sent by the sender form value, or whoever logged in to the admin API.
+func broadcastHandler(db *bun.DB, sm *SessionManager, systemScreenName string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		text := r.FormValue("text")
+		if text == "" {
+			http.Error(w, "text is required", http.StatusBadRequest)
+			return
+		}
+		mode := r.FormValue("mode")
+		if mode == "" {
+			mode = models.BroadcastModeIM
+		}
+		if mode != models.BroadcastModeIM && mode != models.BroadcastModePopup {
+			http.Error(w, fmt.Sprintf("invalid mode %q", mode), http.StatusBadRequest)
+			return
+		}
+		offline := false
+		if value := r.FormValue("offline"); value != "" {
+			var err error
+			if offline, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid offline %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		sender := r.FormValue("sender")
+		if sender == "" {
+			sender, _, _ = r.BasicAuth()
+		}
+
+		broadcast, err := Broadcast(r.Context(), db, sm, systemScreenName, sender, mode, text, offline, logger)
+		if err != nil {
+			logger.Error("could not broadcast", "sender", sender, "err", err.Error())
+			http.Error(w, "could not broadcast", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("broadcast", "sender", sender, "mode", mode, "recipients", broadcast.Recipients, "failed", broadcast.Failed, "queued", broadcast.Queued)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BroadcastResult{
+			ID:         broadcast.ID,
+			Recipients: broadcast.Recipients,
+			Failed:     broadcast.Failed,
+			Queued:     broadcast.Queued,
+		})
+	}
+}
@@ -0,0 +1,126 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/oscar/client"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// A broadcast IM reaches everyone signed on even when one of their sessions is dead, and is left
+// for those who aren't signed on
+func TestBroadcastIM(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	alice := loggedInClient(t, d, addr, "alice")
+	bob := loggedInClient(t, d, addr, "bob")
+	loggedInClient(t, d, addr, "carol").Close()
+
+	// dave's connection died without the server noticing yet
+	conn, other := net.Pipe()
+	defer other.Close()
+	dead := oscar.NewSession(conn, logger)
+	dead.SetScreenName("dave")
+	dead.Disconnect()
+	server.Sessions.ClaimSession("dave", dead)
+	defer server.Sessions.RemoveSession("dave", dead)
+
+	for deadline := time.Now().Add(5 * time.Second); server.Sessions.GetSession("carol") != nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected carol to be signed off")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	broadcast, err := Broadcast(ctx, d, server.Sessions, "AIMSystem", "ops", models.BroadcastModeIM, "going down at noon", true, logger)
+	if err != nil {
+		t.Fatalf("could not broadcast: %s", err)
+	}
+	for _, c := range []*client.Client{alice, bob} {
+		if im := nextIM(t, c); im.From != "AIMSystem" || im.Text != "going down at noon" {
+			t.Errorf("expected %s to get the broadcast from AIMSystem, got %q from %s", c.ScreenName, im.Text, im.From)
+		}
+	}
+	if broadcast.Recipients != 2 || broadcast.Failed != 1 || broadcast.Queued != 1 {
+		t.Errorf("expected 2 recipients, 1 failure and 1 queued, got %+v", broadcast)
+	}
+
+	recorded, err := models.RecentBroadcasts(ctx, d, 1)
+	if err != nil || len(recorded) != 1 {
+		t.Fatalf("expected the broadcast to be recorded, got %v %v", recorded, err)
+	}
+	if recorded[0].Sender != "ops" || recorded[0].Recipients != 2 || recorded[0].Mode != models.BroadcastModeIM {
+		t.Errorf("expected the broadcast from ops to 2 sessions, got %+v", recorded[0])
+	}
+
+	// The system screen name is reserved
+	if user, _ := models.UserByScreenName(ctx, d, "AIMSystem"); user == nil || !user.Bot {
+		t.Errorf("expected the system screen name to be reserved, got %v", user)
+	}
+
+	carol := loggedInClient(t, d, addr, "carol")
+	if im := nextIM(t, carol); im.From != "AIMSystem" || im.Text != "going down at noon" || im.SentAt.IsZero() {
+		t.Errorf("expected carol to get the broadcast from the offline queue, got %+v", im)
+	}
+}
+
+// A popup broadcast is sent as a message of the day, through the admin API
+func TestBroadcastPopup(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	alice := loggedInClient(t, d, addr, "alice")
+
+	form := url.Values{"text": {"maintenance tonight"}, "mode": {"popup"}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/broadcast", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	broadcastHandler(d, server.Sessions, "AIMSystem", logger)(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the broadcast to be sent, got %d %s", w.Code, w.Body)
+	}
+
+	if !nextEvent(t, alice, func(e client.Event) bool {
+		unknown, ok := e.(*client.UnknownSNAC)
+		if !ok || unknown.SNAC.Header.Family != 0x01 || unknown.SNAC.Header.Subtype != 0x13 {
+			return false
+		}
+		motdType, _ := unknown.SNAC.Data.ReadUint16()
+		tlvs, _ := oscar.UnmarshalTLVs(unknown.SNAC.Data.Bytes())
+		text := oscar.FindTLV(tlvs, 0x0b)
+		return motdType == models.MOTDTypeAnnouncement && text != nil && string(text.Data) == "maintenance tonight"
+	}) {
+		t.Fatalf("expected alice to get the broadcast as a popup")
+	}
+
+	recorded, err := models.RecentBroadcasts(context.Background(), d, 1)
+	if err != nil || len(recorded) != 1 || recorded[0].Sender != "admin" || recorded[0].Mode != models.BroadcastModePopup {
+		t.Errorf("expected the popup to be recorded as sent by the admin user, got %v %v", recorded, err)
+	}
+
+	// Broadcasts need text
+	req = httptest.NewRequest(http.MethodPost, "/admin/broadcast", strings.NewReader("mode=im"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	broadcastHandler(d, server.Sessions, "AIMSystem", logger)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a broadcast without text to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// BuddyGroup is a group of a buddy list, as it's exported and imported. Aliases and notes are
+// by the screen name of the buddy they're for.
+type BuddyGroup struct {
+	Name    string            `json:"name"`
+	Buddies []string          `json:"buddies"`
+	Aliases map[string]string `json:"aliases,omitempty"`
+	Notes   map[string]string `json:"notes,omitempty"`
+}
+
+// Buddy list formats for export and import
+const (
+	BuddyListBLT  = "blt"
+	BuddyListJSON = "json"
+)
+
+// WriteBuddyList writes the groups in the format, blt or json
+func WriteBuddyList(w io.Writer, format, screenName string, groups []BuddyGroup) error {
+	switch format {
+	case BuddyListJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			ScreenName string       `json:"screen_name"`
+			Groups     []BuddyGroup `json:"groups"`
+		}{screenName, groups})
+
+	case BuddyListBLT:
+		var b strings.Builder
+		b.WriteString("Config {\n version 1\n}\n")
+		fmt.Fprintf(&b, "User {\n screenname %s\n}\n", bltQuote(screenName))
+		b.WriteString("Buddy {\n list {\n")
+		for _, group := range groups {
+			fmt.Fprintf(&b, "  %s {\n", bltQuote(group.Name))
+			for _, buddy := range group.Buddies {
+				alias, note := group.Aliases[buddy], group.Notes[buddy]
+				if alias == "" && note == "" {
+					fmt.Fprintf(&b, "   %s\n", bltQuote(buddy))
+					continue
+				}
+
+				// A buddy with an alias or note is a block of them
+				fmt.Fprintf(&b, "   %s {\n", bltQuote(buddy))
+				if alias != "" {
+					fmt.Fprintf(&b, "    alias %s\n", bltQuote(alias))
+				}
+				if note != "" {
+					fmt.Fprintf(&b, "    note %s\n", bltQuote(note))
+				}
+				b.WriteString("   }\n")
+			}
+			b.WriteString("  }\n")
+		}
+		b.WriteString(" }\n}\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	return fmt.Errorf("unknown buddy list format %q", format)
+}
+
+// ReadBuddyList reads the groups of a buddy list in the format, blt or json
+func ReadBuddyList(r io.Reader, format string) ([]BuddyGroup, error) {
+	switch format {
+	case BuddyListJSON:
+		var list struct {
+			Groups []BuddyGroup `json:"groups"`
+		}
+		if err := json.NewDecoder(r).Decode(&list); err != nil {
+			return nil, errors.Wrap(err, "could not read JSON buddy list")
+		}
+		return list.Groups, nil
+
+	case BuddyListBLT:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read buddy list")
+		}
+		tokens, err := bltTokens(string(data))
+		if err != nil {
+			return nil, err
+		}
+		nodes, rest, err := bltParse(tokens)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) > 0 {
+			return nil, errors.New("unbalanced } in buddy list")
+		}
+
+		// Buddy { list { <group> { <buddy>... } } }
+		var groups []BuddyGroup
+		if list := bltFind(bltFind(nodes, "Buddy"), "list"); list != nil {
+			for _, group := range list {
+				if group.children == nil {
+					continue
+				}
+				g := BuddyGroup{Name: group.name}
+				for _, buddy := range group.children {
+					g.Buddies = append(g.Buddies, buddy.name)
+					if alias := bltValue(buddy.children, "alias"); alias != "" {
+						g.setAlias(buddy.name, alias)
+					}
+					if note := bltValue(buddy.children, "note"); note != "" {
+						g.setNote(buddy.name, note)
+					}
+				}
+				groups = append(groups, g)
+			}
+		}
+		return groups, nil
+	}
+
+	return nil, fmt.Errorf("unknown buddy list format %q", format)
+}
+
+func (g *BuddyGroup) setAlias(screenName, alias string) {
+	if g.Aliases == nil {
+		g.Aliases = make(map[string]string)
+	}
+	g.Aliases[screenName] = alias
+}
+
+func (g *BuddyGroup) setNote(screenName, note string) {
+	if g.Notes == nil {
+		g.Notes = make(map[string]string)
+	}
+	g.Notes[screenName] = note
+}
+
+// bltNode is a value in a .blt file, or a block of them when children isn't nil
+type bltNode struct {
+	name     string
+	children []*bltNode
+}
+
+// bltQuote quotes names with spaces or special characters
+func bltQuote(name string) string {
+	if name != "" && !strings.ContainsAny(name, " \t\n\"{}\\") {
+		return name
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// bltToken is a name or a brace in a .blt file. A quoted token is never a brace.
+type bltToken struct {
+	text   string
+	quoted bool
+}
+
+// bltTokens splits a .blt file into its tokens
+func bltTokens(data string) ([]bltToken, error) {
+	var tokens []bltToken
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '{' || c == '}':
+			tokens = append(tokens, bltToken{text: string(c)})
+			i++
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				b.WriteByte(data[i])
+			}
+			if i >= len(data) {
+				return nil, errors.New("unterminated quote in buddy list")
+			}
+			tokens = append(tokens, bltToken{text: b.String(), quoted: true})
+			i++
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n{}\"", rune(data[i])) {
+				i++
+			}
+			tokens = append(tokens, bltToken{text: data[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+// bltParse parses nodes until the end of the tokens or the } closing the block they're in,
+// returning the tokens after it
+func bltParse(tokens []bltToken) ([]*bltNode, []bltToken, error) {
+	var nodes []*bltNode
+	for len(tokens) > 0 {
+		token := tokens[0]
+		if !token.quoted && token.text == "}" {
+			return nodes, tokens, nil
+		}
+		if !token.quoted && token.text == "{" {
+			return nil, nil, errors.New("block without a name in buddy list")
+		}
+		tokens = tokens[1:]
+
+		node := &bltNode{name: token.text}
+		if len(tokens) > 0 && !tokens[0].quoted && tokens[0].text == "{" {
+			children, rest, err := bltParse(tokens[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(rest) == 0 {
+				return nil, nil, fmt.Errorf("unterminated block %q in buddy list", node.name)
+			}
+			node.children = append([]*bltNode{}, children...)
+			tokens = rest[1:]
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil, nil
+}
+
+// bltFind is the children of the first block with the name, nil if there isn't one
+func bltFind(nodes []*bltNode, name string) []*bltNode {
+	for _, node := range nodes {
+		if node.name == name && node.children != nil {
+			return node.children
+		}
+	}
+	return nil
+}
+
+// bltValue is the value after a name in a block, like the alias in a buddy's "alias Bobby"
+func bltValue(nodes []*bltNode, name string) string {
+	for i, node := range nodes {
+		if node.name == name && node.children == nil && i+1 < len(nodes) && nodes[i+1].children == nil {
+			return nodes[i+1].name
+		}
+	}
+	return ""
+}
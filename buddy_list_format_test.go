@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuddyListRoundTrip(t *testing.T) {
+	groups := []BuddyGroup{
+		{Name: "Buddies", Buddies: []string{"alice", "Bob Smith"}, Aliases: map[string]string{"Bob Smith": "Bobby"}},
+		{Name: "Co-Workers", Buddies: []string{`quote"d`, "dave"}, Notes: map[string]string{"dave": "the boss"}},
+		{Name: "Empty Group", Buddies: nil},
+	}
+
+	for _, format := range []string{BuddyListBLT, BuddyListJSON} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteBuddyList(&buf, format, "carol", groups); err != nil {
+				t.Fatalf("could not write: %s", err)
+			}
+			read, err := ReadBuddyList(&buf, format)
+			if err != nil {
+				t.Fatalf("could not read: %s", err)
+			}
+			if !reflect.DeepEqual(read, groups) {
+				t.Errorf("expected %v, got %v", groups, read)
+			}
+		})
+	}
+}
+
+func TestWriteBuddyListBLT(t *testing.T) {
+	var buf bytes.Buffer
+	WriteBuddyList(&buf, BuddyListBLT, "carol", []BuddyGroup{{Name: "Buddies", Buddies: []string{"alice", "Bob Smith"}}})
+	expected := `Config {
+ version 1
+}
+User {
+ screenname carol
+}
+Buddy {
+ list {
+  Buddies {
+   alice
+   "Bob Smith"
+  }
+ }
+}
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestWriteBuddyListBLTAliases(t *testing.T) {
+	var buf bytes.Buffer
+	WriteBuddyList(&buf, BuddyListBLT, "carol", []BuddyGroup{{
+		Name:    "Buddies",
+		Buddies: []string{"alice", "bob"},
+		Aliases: map[string]string{"bob": "Bobby B"},
+		Notes:   map[string]string{"bob": "met at camp"},
+	}})
+	expected := `Config {
+ version 1
+}
+User {
+ screenname carol
+}
+Buddy {
+ list {
+  Buddies {
+   alice
+   bob {
+    alias "Bobby B"
+    note "met at camp"
+   }
+  }
+ }
+}
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+// Lists saved by old clients have blocks the server doesn't care about
+func TestReadBuddyListBLTFromClient(t *testing.T) {
+	blt := `Config {
+  version 1
+}
+User {
+  screenname carol
+}
+Buddy {
+  list {
+    Buddies {
+      alice
+      "Bob Smith"
+    }
+    Family {
+      mom
+    }
+  }
+  permit {
+  }
+}
+Privacy {
+  level 1
+}`
+	groups, err := ReadBuddyList(strings.NewReader(blt), BuddyListBLT)
+	if err != nil {
+		t.Fatalf("could not read: %s", err)
+	}
+	expected := []BuddyGroup{
+		{Name: "Buddies", Buddies: []string{"alice", "Bob Smith"}},
+		{Name: "Family", Buddies: []string{"mom"}},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected %v, got %v", expected, groups)
+	}
+}
+
+func TestReadBuddyListInvalid(t *testing.T) {
+	for name, tc := range map[string]struct{ format, data string }{
+		"unterminated block": {BuddyListBLT, "Buddy { list { Buddies { alice"},
+		"extra brace":        {BuddyListBLT, "Buddy { } }"},
+		"unnamed block":      {BuddyListBLT, "{ alice }"},
+		"unterminated quote": {BuddyListBLT, `Buddy { list { Buddies { "alice } } }`},
+		"bad JSON":           {BuddyListJSON, `{"groups": [`},
+		"unknown format":     {"csv", "alice"},
+	} {
+		if _, err := ReadBuddyList(strings.NewReader(tc.data), tc.format); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/services"
+	"aim-oscar/util"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// ExportBuddyList is the user's buddy list with aliases and notes, by their SSI groups when they
+// have them and by their buddy list groups otherwise. Groups are sorted by name and buddies by
+// screen name, so the same list always exports the same way.
+func ExportBuddyList(ctx context.Context, db bun.IDB, user *models.User) ([]BuddyGroup, error) {
+	items, err := models.FeedbagForUser(ctx, db, user.UIN)
+	if err != nil {
+		return nil, err
+	}
+
+	groupNames := make(map[uint16]string)
+	for _, item := range items {
+		if services.FeedbagItemType(item.ClassId) == services.FeedbagItemTypeGroup && item.GroupId != 0 {
+			groupNames[item.GroupId] = item.Name
+		}
+	}
+
+	members := make(map[string]map[string]*models.Buddy)
+	grouped := make(map[string]bool)
+	add := func(group, screenName, alias, note string) {
+		if members[group] == nil {
+			members[group] = make(map[string]*models.Buddy)
+		}
+		members[group][util.NormalizeScreenName(screenName)] = &models.Buddy{Target: &models.User{ScreenName: screenName}, Alias: alias, Note: note}
+		grouped[util.NormalizeScreenName(screenName)] = true
+	}
+	for _, item := range items {
+		if services.FeedbagItemType(item.ClassId) != services.FeedbagItemTypeUser {
+			continue
+		}
+		group, ok := groupNames[item.GroupId]
+		if !ok {
+			group = models.DefaultBuddyGroup
+		}
+		alias, note := services.FeedbagBuddyDetails(item.Attributes)
+		add(group, item.Name, alias, note)
+	}
+
+	// Buddies added without SSI are in the group they were added to
+	buddyGroups, err := models.BuddyGroupsOf(ctx, db, user.UIN)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range buddyGroups {
+		for _, buddy := range group.Buddies {
+			if !grouped[util.NormalizeScreenName(buddy.Target.ScreenName)] {
+				add(group.Name, buddy.Target.ScreenName, buddy.Alias, buddy.Note)
+			}
+		}
+	}
+
+	groups := make([]BuddyGroup, 0, len(members))
+	for name, buddies := range members {
+		keys := make([]string, 0, len(buddies))
+		for key := range buddies {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		group := BuddyGroup{Name: name, Buddies: make([]string, 0, len(keys))}
+		for _, key := range keys {
+			buddy := buddies[key]
+			group.Buddies = append(group.Buddies, buddy.Target.ScreenName)
+			if buddy.Alias != "" {
+				group.setAlias(buddy.Target.ScreenName, buddy.Alias)
+			}
+			if buddy.Note != "" {
+				group.setNote(buddy.Target.ScreenName, buddy.Note)
+			}
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+// BuddyListImport is what importing a buddy list did with each screen name in it
+type BuddyListImport struct {
+	Added     []string `json:"added"`
+	Existing  []string `json:"existing"`
+	Unknown   []string `json:"unknown"`
+	OverLimit []string `json:"over_limit"`
+}
+
+// ImportBuddyList adds the buddies in groups to the user's buddy list in their groups, and to
+// their SSI list if they have one, skipping buddies who are already on it, screen names nobody
+// has and anyone past maxBuddies. Aliases and notes in the list are set on the buddies, even ones
+// already on it. Signed on users see the imported buddies who are online straight away.
+func ImportBuddyList(ctx context.Context, db *bun.DB, sm *SessionManager, user *models.User, groups []BuddyGroup, maxBuddies int, logger *slog.Logger) (*BuddyListImport, error) {
+	result := &BuddyListImport{}
+	var added []*models.User
+
+	// Users with an SSI list get the buddies on it too, as a new revision of it
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		count, err := models.CountBuddies(ctx, tx, user.UIN)
+		if err != nil {
+			return err
+		}
+
+		feedbagChanged := false
+		seen := map[string]bool{util.NormalizeScreenName(user.ScreenName): true}
+		for _, group := range groups {
+			for _, screenName := range group.Buddies {
+				normalized := util.NormalizeScreenName(screenName)
+				if normalized == "" || seen[normalized] {
+					continue
+				}
+				seen[normalized] = true
+
+				buddy, err := models.UserByScreenName(ctx, tx, screenName)
+				if err != nil {
+					return err
+				}
+				if buddy == nil {
+					result.Unknown = append(result.Unknown, screenName)
+					continue
+				}
+
+				if maxBuddies > 0 && count >= maxBuddies {
+					result.OverLimit = append(result.OverLimit, buddy.ScreenName)
+					continue
+				}
+				isNew, err := models.AddBuddyToGroup(ctx, tx, user.UIN, buddy.UIN, group.Name)
+				if err != nil {
+					return err
+				}
+				alias, note := group.Aliases[screenName], group.Notes[screenName]
+				if alias != "" || note != "" {
+					if err := models.SetBuddyDetails(ctx, tx, user.UIN, buddy.UIN, alias, note); err != nil {
+						return err
+					}
+				}
+				changed, err := services.AddFeedbagBuddy(ctx, tx, user.UIN, group.Name, buddy.ScreenName, alias, note)
+				if err != nil {
+					return err
+				}
+				feedbagChanged = feedbagChanged || changed
+
+				if !isNew {
+					result.Existing = append(result.Existing, buddy.ScreenName)
+					continue
+				}
+				count++
+				added = append(added, buddy)
+				result.Added = append(result.Added, buddy.ScreenName)
+			}
+		}
+
+		if feedbagChanged {
+			_, err = models.BumpFeedbagRevision(ctx, tx, user.UIN)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Telling everyone watching the buddies tells the user too
+	for _, buddy := range added {
+		if buddy.Status.Connected() {
+			notifyBuddies(db, sm, logger, services.StatusChanged(buddy))
+		}
+	}
+	return result, nil
+}
+
+// buddyListHandler is the admin endpoint for the buddy list of the user in the screen_name query
+// value. GET exports it and POST imports the request body into it, as blt or json in the
+// format query value (json by default). They're in the query so the body is only the list.
+func buddyListHandler(db *bun.DB, sm *SessionManager, maxBuddies int, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = BuddyListJSON
+		}
+		if format != BuddyListJSON && format != BuddyListBLT {
+			http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+			return
+		}
+
+		screenName := query.Get("screen_name")
+		user, err := models.UserByScreenName(r.Context(), db, screenName)
+		if err != nil {
+			logger.Error("could not find user", "screen_name", screenName, "err", err.Error())
+			http.Error(w, "could not find user", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, fmt.Sprintf("unknown user %q", screenName), http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			groups, err := ExportBuddyList(r.Context(), db, user)
+			if err != nil {
+				logger.Error("could not export buddy list", "screen_name", screenName, "err", err.Error())
+				http.Error(w, "could not export buddy list", http.StatusInternalServerError)
+				return
+			}
+			if format == BuddyListBLT {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", util.NormalizeScreenName(user.ScreenName)+".blt"))
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			WriteBuddyList(w, format, user.ScreenName, groups)
+			return
+		}
+
+		groups, err := ReadBuddyList(http.MaxBytesReader(w, r.Body, 1<<20), format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := ImportBuddyList(r.Context(), db, sm, user, groups, maxBuddies, logger)
+		if err != nil {
+			logger.Error("could not import buddy list", "screen_name", screenName, "err", err.Error())
+			http.Error(w, "could not import buddy list", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("imported buddy list", "screen_name", user.ScreenName, "added", len(result.Added), "over_limit", len(result.OverLimit))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,179 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar/client"
+	"aim-oscar/services"
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+// Importing a list adds the buddies it can, and exporting and importing it again changes nothing
+func TestImportExportBuddyList(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	alice := loggedInClient(t, d, addr, "alice")
+	loggedInClient(t, d, addr, "bob")
+	for _, screenName := range []string{"carol", "dave"} {
+		if _, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com"); err != nil {
+			t.Fatalf("could not create user: %s", err)
+		}
+	}
+	user, _ := models.UserByScreenName(ctx, d, "alice")
+
+	groups := []BuddyGroup{
+		{Name: "Friends", Buddies: []string{"carol", "Bob", "nobody", "alice"}, Aliases: map[string]string{"carol": "Caz"}, Notes: map[string]string{"Bob": "from work"}},
+		{Name: "Work", Buddies: []string{"bob", "dave"}},
+	}
+	result, err := ImportBuddyList(ctx, d, server.Sessions, user, groups, 2, logger)
+	if err != nil {
+		t.Fatalf("could not import: %s", err)
+	}
+	expected := &BuddyListImport{Added: []string{"carol", "bob"}, Unknown: []string{"nobody"}, OverLimit: []string{"dave"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	if !nextEvent(t, alice, func(event client.Event) bool {
+		arrived, ok := event.(*client.BuddyArrived)
+		return ok && arrived.ScreenName == "bob"
+	}) {
+		t.Fatalf("expected alice to see bob arrive")
+	}
+
+	exported, err := ExportBuddyList(ctx, d, user)
+	if err != nil {
+		t.Fatalf("could not export: %s", err)
+	}
+	// Buddies are in the group they were first imported to, with their aliases and notes
+	expectedGroups := []BuddyGroup{{Name: "Friends", Buddies: []string{"bob", "carol"}, Aliases: map[string]string{"carol": "Caz"}, Notes: map[string]string{"bob": "from work"}}}
+	if !reflect.DeepEqual(exported, expectedGroups) {
+		t.Errorf("expected %v, got %v", expectedGroups, exported)
+	}
+
+	var blt bytes.Buffer
+	if err := WriteBuddyList(&blt, BuddyListBLT, user.ScreenName, exported); err != nil {
+		t.Fatalf("could not write: %s", err)
+	}
+	read, err := ReadBuddyList(&blt, BuddyListBLT)
+	if err != nil {
+		t.Fatalf("could not read: %s", err)
+	}
+	result, err = ImportBuddyList(ctx, d, server.Sessions, user, read, 600, logger)
+	if err != nil {
+		t.Fatalf("could not import again: %s", err)
+	}
+	if len(result.Added) != 0 || !reflect.DeepEqual(result.Existing, []string{"bob", "carol"}) {
+		t.Errorf("expected importing the export to add nothing, got %+v", result)
+	}
+	if count, _ := models.CountBuddies(ctx, d, user.UIN); count != 2 {
+		t.Errorf("expected alice to have 2 buddies, got %d", count)
+	}
+
+	again, err := ExportBuddyList(ctx, d, user)
+	if err != nil || !reflect.DeepEqual(again, exported) {
+		t.Errorf("expected the same export, got %v %v", again, err)
+	}
+}
+
+// Users with an SSI list get imported buddies on it, in new groups where they need them, and
+// exporting and importing it again leaves the list as it was
+func TestImportExportBuddyListSSI(t *testing.T) {
+	d := serverTestDB(t)
+	server, _ := startServer(t, d)
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, screenName := range []string{"alice", "bob", "carol", "dave"} {
+		if _, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com"); err != nil {
+			t.Fatalf("could not create user: %s", err)
+		}
+	}
+	user, _ := models.UserByScreenName(ctx, d, "alice")
+	carol, _ := models.UserByScreenName(ctx, d, "carol")
+	if _, err := models.AddBuddyToGroup(ctx, d, user.UIN, carol.UIN, "Buddies"); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	feedbag := []*models.Feedbag{
+		{UserUIN: user.UIN, ClassId: uint16(services.FeedbagItemTypeGroup), Attributes: []byte{0x00, 0xc8, 0x00, 0x02, 0x00, 0x01}},
+		{UserUIN: user.UIN, GroupId: 1, ClassId: uint16(services.FeedbagItemTypeGroup), Name: "Buddies", Attributes: []byte{0x00, 0xc8, 0x00, 0x02, 0x00, 0x01}},
+		{UserUIN: user.UIN, GroupId: 1, ItemId: 1, ClassId: uint16(services.FeedbagItemTypeUser), Name: "carol"},
+	}
+	if _, err := d.NewInsert().Model(&feedbag).Exec(ctx); err != nil {
+		t.Fatalf("could not add feedbag: %s", err)
+	}
+
+	groups := []BuddyGroup{
+		{Name: "Friends", Buddies: []string{"bob"}, Aliases: map[string]string{"bob": "Bobby"}},
+		{Name: "Buddies", Buddies: []string{"carol", "dave"}, Notes: map[string]string{"carol": "neighbour"}},
+	}
+	result, err := ImportBuddyList(ctx, d, server.Sessions, user, groups, 600, logger)
+	if err != nil {
+		t.Fatalf("could not import: %s", err)
+	}
+	expected := &BuddyListImport{Added: []string{"bob", "dave"}, Existing: []string{"carol"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	items, err := models.FeedbagForUser(ctx, d, user.UIN)
+	if err != nil {
+		t.Fatalf("could not fetch feedbag: %s", err)
+	}
+	orders := make(map[string][]byte)
+	for _, item := range items {
+		if services.FeedbagItemType(item.ClassId) == services.FeedbagItemTypeGroup {
+			orders[item.Name] = item.Attributes
+		}
+	}
+	// The new group is listed in the master group, and each group lists its new buddies
+	expectedOrders := map[string][]byte{
+		"":        {0x00, 0xc8, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02},
+		"Buddies": {0x00, 0xc8, 0x00, 0x04, 0x00, 0x01, 0x00, 0x03},
+		"Friends": {0x00, 0xc8, 0x00, 0x02, 0x00, 0x02},
+	}
+	if !reflect.DeepEqual(orders, expectedOrders) {
+		t.Errorf("expected group orders %v, got %v", expectedOrders, orders)
+	}
+	rev, err := models.FeedbagRevisionFor(ctx, d, user.UIN)
+	if err != nil || rev == nil || rev.Revision != 1 {
+		t.Fatalf("expected the import to bump the revision, got %+v %v", rev, err)
+	}
+
+	exported, err := ExportBuddyList(ctx, d, user)
+	if err != nil {
+		t.Fatalf("could not export: %s", err)
+	}
+	expectedGroups := []BuddyGroup{
+		{Name: "Buddies", Buddies: []string{"carol", "dave"}, Notes: map[string]string{"carol": "neighbour"}},
+		{Name: "Friends", Buddies: []string{"bob"}, Aliases: map[string]string{"bob": "Bobby"}},
+	}
+	if !reflect.DeepEqual(exported, expectedGroups) {
+		t.Errorf("expected %v, got %v", expectedGroups, exported)
+	}
+
+	result, err = ImportBuddyList(ctx, d, server.Sessions, user, exported, 600, logger)
+	if err != nil {
+		t.Fatalf("could not import again: %s", err)
+	}
+	if len(result.Added) != 0 {
+		t.Errorf("expected importing the export to add nothing, got %+v", result)
+	}
+	again, err := models.FeedbagForUser(ctx, d, user.UIN)
+	if err != nil || len(again) != len(items) {
+		t.Errorf("expected the same %d feedbag items, got %d %v", len(items), len(again), err)
+	}
+	if rev, _ := models.FeedbagRevisionFor(ctx, d, user.UIN); rev == nil || rev.Revision != 1 {
+		t.Errorf("expected importing the export to leave the revision, got %+v", rev)
+	}
+}
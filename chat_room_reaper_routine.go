@@ -0,0 +1,56 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// ChatRoomReapInterval is how often rooms are checked for ones nobody has been in for too long
+var ChatRoomReapInterval = 5 * time.Minute
+
+// ChatRoomReaper deletes rooms that nobody is in and nobody joined or left for idleTimeout, so
+// rooms made for one conversation don't pile up in the directory. The routine stops once done is
+// closed.
+func ChatRoomReaper(registry *services.ChatRegistry, interval time.Duration, idleTimeout time.Duration, parentLogger *slog.Logger) func(db *bun.DB, done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "chat_room_reaper"))
+
+	return func(db *bun.DB, done <-chan struct{}) {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx := oscar.NewContextWithLogger(context.Background(), logger)
+			rooms, err := models.IdleChatRooms(ctx, db, time.Now().Add(-idleTimeout))
+			if err != nil {
+				logger.Error("could not find idle chat rooms", slog.String("err", err.Error()))
+				continue
+			}
+
+			for _, room := range rooms {
+				if len(registry.Participants(room.Cookie)) > 0 {
+					continue
+				}
+				if err := room.Delete(ctx, db); err != nil {
+					logger.Error("could not delete chat room", slog.String("name", room.Name), slog.String("err", err.Error()))
+					continue
+				}
+				logger.Info("deleted idle chat room", slog.String("name", room.Name), slog.Int("exchange", int(room.Exchange)))
+			}
+		}
+	}
+}
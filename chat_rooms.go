@@ -0,0 +1,123 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/services"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// ChatRoomInfo is a chat room as the admin endpoints list it
+type ChatRoomInfo struct {
+	Exchange     uint16    `json:"exchange"`
+	Cookie       string    `json:"cookie"`
+	Name         string    `json:"name"`
+	CreatorUIN   int64     `json:"creator_uin"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActiveAt time.Time `json:"last_active_at"`
+	Participants int       `json:"participants"`
+}
+
+// ListChatRooms is every chat room with how many are in it
+func ListChatRooms(ctx context.Context, db *bun.DB, chat *services.ChatService) ([]ChatRoomInfo, error) {
+	rooms, err := models.AllChatRooms(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]ChatRoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, ChatRoomInfo{
+			Exchange:     room.Exchange,
+			Cookie:       room.Cookie,
+			Name:         room.Name,
+			CreatorUIN:   room.CreatorUIN,
+			Public:       room.Public,
+			CreatedAt:    room.CreatedAt,
+			LastActiveAt: room.LastActiveAt,
+			Participants: len(chat.Registry.Participants(room.Cookie)),
+		})
+	}
+	return list, nil
+}
+
+// CloseChatRoom evicts everyone in the room in exchange with the cookie and deletes it. It
+// returns nil if there is no such room, and how many were evicted.
+func CloseChatRoom(ctx context.Context, db *bun.DB, chat *services.ChatService, exchange uint16, cookie string) (*models.ChatRoom, int, error) {
+	room, err := models.ChatRoomByCookie(ctx, db, exchange, cookie)
+	if err != nil || room == nil {
+		return nil, 0, err
+	}
+
+	// Deleting the room first keeps anyone from joining it again while they're evicted
+	if err := room.Delete(ctx, db); err != nil {
+		return nil, 0, err
+	}
+	return room, chat.Close(room), nil
+}
+
+// chatRoomsHandler is the admin endpoint that lists the chat rooms as JSON
+func chatRoomsHandler(db *bun.DB, chat *services.ChatService, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rooms, err := ListChatRooms(r.Context(), db, chat)
+		if err != nil {
+			logger.Error("could not list chat rooms", "err", err.Error())
+			http.Error(w, "could not list chat rooms", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms)
+	}
+}
+
+// closeChatRoomHandler is the admin endpoint that closes the room with the cookie form value, in
+// the exchange form value or the public exchange if there isn't one
+func closeChatRoomHandler(db *bun.DB, chat *services.ChatService, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		exchange := uint16(services.ChatExchangePublic)
+		if value := r.FormValue("exchange"); value != "" {
+			e, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid exchange %q", value), http.StatusBadRequest)
+				return
+			}
+			exchange = uint16(e)
+		}
+
+		cookie := r.FormValue("cookie")
+		room, evicted, err := CloseChatRoom(r.Context(), db, chat, exchange, cookie)
+		if err != nil {
+			logger.Error("could not close chat room", "cookie", cookie, "err", err.Error())
+			http.Error(w, "could not close chat room", http.StatusInternalServerError)
+			return
+		}
+		if room == nil {
+			http.Error(w, fmt.Sprintf("unknown chat room %q", cookie), http.StatusNotFound)
+			return
+		}
+
+		logger.Info("closed chat room", "name", room.Name, "exchange", room.Exchange, "evicted", evicted)
+		fmt.Fprintf(w, "closed %s, evicting %d\n", room.Name, evicted)
+	}
+}
@@ -0,0 +1,137 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/services"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// chatRoom creates a public room that was last active idle ago
+func chatRoom(t *testing.T, d *bun.DB, name string, idle time.Duration) *models.ChatRoom {
+	room := &models.ChatRoom{
+		Exchange:     services.ChatExchangePublic,
+		Cookie:       uuid.New().String(),
+		Name:         name,
+		CreatedAt:    time.Now().Add(-idle),
+		LastActiveAt: time.Now().Add(-idle),
+		Public:       true,
+	}
+	if _, err := d.NewInsert().Model(room).Exec(context.Background()); err != nil {
+		t.Fatalf("could not create room: %s", err)
+	}
+	return room
+}
+
+func chatRoomExists(t *testing.T, d *bun.DB, room *models.ChatRoom) bool {
+	exists, err := d.NewSelect().Model(room).WherePK().Exists(context.Background())
+	if err != nil {
+		t.Fatalf("could not look up room: %s", err)
+	}
+	return exists
+}
+
+// Rooms nobody has been in for too long are deleted, and rooms that are in use or were used
+// recently are kept
+func TestChatRoomReaper(t *testing.T) {
+	d := serverTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	registry := services.NewChatRegistry()
+
+	idle := chatRoom(t, d, "idle", 48*time.Hour)
+	occupied := chatRoom(t, d, "occupied", 48*time.Hour)
+	recent := chatRoom(t, d, "recent", time.Hour)
+	registry.Join(occupied, deadSession(t), &models.User{ScreenName: "alice"})
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		ChatRoomReaper(registry, 50*time.Millisecond, 24*time.Hour, logger)(d, done)
+		close(stopped)
+	}()
+
+	for deadline := time.Now().Add(time.Second); chatRoomExists(t, d, idle); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the idle room to be deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("expected the routine to stop")
+	}
+
+	for name, room := range map[string]*models.ChatRoom{"occupied": occupied, "recent": recent} {
+		if !chatRoomExists(t, d, room) {
+			t.Errorf("expected the %s room to be kept", name)
+		}
+	}
+}
+
+// The admin endpoints list the rooms with how many are in each, and close them
+func TestChatRoomsHandlers(t *testing.T) {
+	d := serverTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	chat := &services.ChatService{Registry: services.NewChatRegistry()}
+
+	lobby := chatRoom(t, d, "lobby", time.Hour)
+	empty := chatRoom(t, d, "empty", time.Hour)
+	chat.Registry.Join(lobby, deadSession(t), &models.User{ScreenName: "alice"})
+	chat.Registry.Join(lobby, deadSession(t), &models.User{ScreenName: "bob"})
+
+	rec := httptest.NewRecorder()
+	chatRoomsHandler(d, chat, logger)(rec, httptest.NewRequest(http.MethodGet, "/admin/chatrooms", nil))
+	var rooms []ChatRoomInfo
+	if err := json.NewDecoder(rec.Body).Decode(&rooms); err != nil {
+		t.Fatalf("could not read rooms: %s", err)
+	}
+	participants := map[string]int{}
+	for _, room := range rooms {
+		participants[room.Name] = room.Participants
+	}
+	if len(rooms) != 2 || participants["lobby"] != 2 || participants["empty"] != 0 {
+		t.Errorf("expected lobby with 2 in it and an empty room, got %+v", rooms)
+	}
+
+	closeRoom := func(cookie string) *httptest.ResponseRecorder {
+		form := url.Values{"cookie": {cookie}}
+		req := httptest.NewRequest(http.MethodPost, "/admin/chatrooms/close", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		closeChatRoomHandler(d, chat, logger)(rec, req)
+		return rec
+	}
+
+	if rec := closeRoom(lobby.Cookie); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "evicting 2") {
+		t.Errorf("expected lobby to be closed with 2 evicted, got %d %q", rec.Code, rec.Body.String())
+	}
+	if chatRoomExists(t, d, lobby) {
+		t.Errorf("expected the closed room to be deleted")
+	}
+	if len(chat.Registry.Participants(lobby.Cookie)) != 0 {
+		t.Errorf("expected nobody to be left in the closed room")
+	}
+	if !chatRoomExists(t, d, empty) {
+		t.Errorf("expected the other room to be kept")
+	}
+
+	if rec := closeRoom(lobby.Cookie); rec.Code != http.StatusNotFound {
+		t.Errorf("expected closing a room that's gone to be not found, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"aim-oscar/config"
+	"aim-oscar/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// broadcastRow is a broadcast an operator sent
+type broadcastRow struct {
+	ID         int       `json:"id"`
+	Sender     string    `json:"sender"`
+	Mode       string    `json:"mode"`
+	Text       string    `json:"text"`
+	Recipients int       `json:"recipients"`
+	Failed     int       `json:"failed"`
+	Queued     int       `json:"queued"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func broadcastCommand(ctx context.Context, db *bun.DB, metrics config.MetricsConfig, out *output, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listBroadcasts(ctx, db, out)
+	}
+
+	flags := flag.NewFlagSet("broadcast", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	popup := flags.Bool("popup", false, "")
+	offline := flags.Bool("offline", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		return errUsage
+	}
+	return broadcast(metrics, out, strings.Join(flags.Args(), " "), *popup, *offline)
+}
+
+// broadcast has the server send the text to everyone signed on, through the admin API since only
+// the server knows who that is
+func broadcast(metrics config.MetricsConfig, out *output, text string, popup, offline bool) error {
+	if !adminEnabled(metrics) {
+		return errAdminDisabled
+	}
+
+	mode := models.BroadcastModeIM
+	if popup {
+		mode = models.BroadcastModePopup
+	}
+	form := url.Values{
+		"text":    {text},
+		"mode":    {mode},
+		"offline": {strconv.FormatBool(offline)},
+		"sender":  {operator()},
+	}
+
+	resp, err := postAdmin(metrics, "/admin/broadcast", form)
+	if err != nil {
+		return fmt.Errorf("server refused broadcast: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID         int `json:"id"`
+		Recipients int `json:"recipients"`
+		Failed     int `json:"failed"`
+		Queued     int `json:"queued"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("could not read server's reply: %w", err)
+	}
+
+	message := fmt.Sprintf("Broadcast to %d sessions, %d failed", result.Recipients, result.Failed)
+	if offline {
+		message += fmt.Sprintf(", left for %d users who are signed off", result.Queued)
+	}
+	return out.result(message, result)
+}
+
+func listBroadcasts(ctx context.Context, db *bun.DB, out *output) error {
+	broadcasts, err := models.RecentBroadcasts(ctx, db, 50)
+	if err != nil {
+		return err
+	}
+
+	broadcastRows := make([]*broadcastRow, 0, len(broadcasts))
+	rows := make([][]string, 0, len(broadcasts))
+	for _, b := range broadcasts {
+		broadcastRows = append(broadcastRows, &broadcastRow{
+			ID:         b.ID,
+			Sender:     b.Sender,
+			Mode:       b.Mode,
+			Text:       b.Text,
+			Recipients: b.Recipients,
+			Failed:     b.Failed,
+			Queued:     b.Queued,
+			CreatedAt:  b.CreatedAt,
+		})
+		rows = append(rows, []string{strconv.Itoa(b.ID), formatTime(&b.CreatedAt), b.Sender, b.Mode, strconv.Itoa(b.Recipients), strconv.Itoa(b.Failed), strconv.Itoa(b.Queued), b.Text})
+	}
+	return out.table([]string{"ID", "SENT", "SENDER", "MODE", "RECIPIENTS", "FAILED", "QUEUED", "TEXT"}, rows, broadcastRows)
+}
+
+var errAdminDisabled = errors.New("the server's admin API isn't enabled, set app.metrics.addr, user and password")
+
+// adminEnabled is whether the server has an admin API aimctl can use
+func adminEnabled(metrics config.MetricsConfig) bool {
+	return metrics.Addr != "" && metrics.User != "" && metrics.Password != ""
+}
+
+// postAdmin posts the form to the admin API path. Replies other than 200 OK are errors with the
+// server's message.
+func postAdmin(metrics config.MetricsConfig, path string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, adminURL(metrics.Addr, path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(metrics.User, metrics.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the server: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// adminURL is the URL of the admin API path on the server listening on addr. A server listening
+// on every interface is reached on localhost.
+func adminURL(addr, path string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr + path
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + path
+}
+
+// operator is who's running aimctl, which broadcasts are recorded as sent by
+func operator() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "aimctl"
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/services"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// buddyRow is a buddy on a user's buddy list, from the buddy list service or from their
+// server-stored (feedbag) list
+type buddyRow struct {
+	Source     string `json:"source"`
+	Group      string `json:"group,omitempty"`
+	ScreenName string `json:"screen_name"`
+	UIN        int64  `json:"uin,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Alias      string `json:"alias,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// buddies dumps the user's buddy lists, with the buddies under their groups
+func buddies(ctx context.Context, db *bun.DB, out *output, screenName string) error {
+	user, err := findUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+
+	buddyRows := make([]*buddyRow, 0)
+	buddyGroups, err := models.BuddyGroupsOf(ctx, db, user.UIN)
+	if err != nil {
+		return err
+	}
+	for _, group := range buddyGroups {
+		for _, buddy := range group.Buddies {
+			buddyRows = append(buddyRows, &buddyRow{Source: "buddy list", Group: group.Name, ScreenName: buddy.Target.ScreenName, UIN: buddy.Target.UIN, Status: buddy.Target.Status.String(), Alias: buddy.Alias, Note: buddy.Note})
+		}
+	}
+
+	items, err := models.FeedbagForUser(ctx, db, user.UIN)
+	if err != nil {
+		return err
+	}
+	groups := make(map[uint16]string)
+	for _, item := range items {
+		if item.ClassId == uint16(services.FeedbagItemTypeGroup) {
+			groups[item.GroupId] = item.Name
+		}
+	}
+	for _, item := range items {
+		if item.ClassId != uint16(services.FeedbagItemTypeUser) {
+			continue
+		}
+		alias, note := services.FeedbagBuddyDetails(item.Attributes)
+		buddyRows = append(buddyRows, &buddyRow{Source: "feedbag", Group: groups[item.GroupId], ScreenName: item.Name, Alias: alias, Note: note})
+	}
+
+	rows := make([][]string, 0, len(buddyRows))
+	for _, row := range buddyRows {
+		uin, status, group, alias := "-", "-", "-", "-"
+		if row.UIN != 0 {
+			uin = strconv.FormatInt(row.UIN, 10)
+		}
+		if row.Status != "" {
+			status = row.Status
+		}
+		if row.Group != "" {
+			group = row.Group
+		}
+		if row.Alias != "" {
+			alias = row.Alias
+		}
+		rows = append(rows, []string{row.Source, group, row.ScreenName, alias, uin, status})
+	}
+	return out.table([]string{"SOURCE", "GROUP", "SCREEN NAME", "ALIAS", "UIN", "STATUS"}, rows, buddyRows)
+}
+
+// statsRow is how the message counts are printed
+type statsRow struct {
+	Total        int        `json:"total"`
+	Delivered    int        `json:"delivered"`
+	Undelivered  int        `json:"undelivered"`
+	OldestStored *time.Time `json:"oldest_stored,omitempty"`
+	SentLastDay  int        `json:"sent_last_day"`
+}
+
+// stats counts the messages the server has handled
+func stats(ctx context.Context, db *bun.DB, out *output) error {
+	counts, err := models.MessageStats(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	row := &statsRow{
+		Total:        counts.Total,
+		Delivered:    counts.Delivered,
+		Undelivered:  counts.Undelivered,
+		OldestStored: counts.OldestStored,
+		SentLastDay:  counts.SentLastDay,
+	}
+	return out.table(
+		[]string{"MESSAGES", "DELIVERED", "STORED", "OLDEST STORED", "LAST 24H"},
+		[][]string{{strconv.Itoa(row.Total), strconv.Itoa(row.Delivered), strconv.Itoa(row.Undelivered), formatTime(row.OldestStored), strconv.Itoa(row.SentLastDay)}},
+		row,
+	)
+}
+
+// clientRow is a version of a client that has sent usage reports
+type clientRow struct {
+	Client    string    `json:"client"`
+	Version   string    `json:"version"`
+	Reports   int       `json:"reports"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// clients lists the client versions in use, from their usage reports
+func clients(ctx context.Context, db *bun.DB, out *output) error {
+	versions, err := models.ClientVersions(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	clientRows := make([]*clientRow, 0, len(versions))
+	rows := make([][]string, 0, len(versions))
+	for _, version := range versions {
+		row := &clientRow{Client: version.Client, Version: version.Version, Reports: version.Reports, FirstSeen: version.FirstSeen, LastSeen: version.LastSeen}
+		clientRows = append(clientRows, row)
+
+		v := "-"
+		if row.Version != "" {
+			v = row.Version
+		}
+		rows = append(rows, []string{row.Client, v, strconv.Itoa(row.Reports), formatTime(&row.FirstSeen), formatTime(&row.LastSeen)})
+	}
+	return out.table([]string{"CLIENT", "VERSION", "REPORTS", "FIRST SEEN", "LAST SEEN"}, rows, clientRows)
+}
@@ -0,0 +1,87 @@
+// aimctl manages the accounts on a server straight from its database: creating, listing,
+// suspending, exporting and deleting users, resetting passwords, dumping buddy lists, counting
+// messages and listing the clients in use. Broadcasts to everyone signed on, and deleting users
+// who are signed on, go through the server's admin API. Output is a table, or JSON with -json.
+package main
+
+import (
+	"aim-oscar/config"
+	"aim-oscar/db"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: aimctl [flags] <command>\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), `
+commands:
+	user create <screen_name> <email>
+	user list
+	user delete <screen_name>
+	user purge <screen_name>
+	user export <screen_name>
+	user suspend <screen_name> [duration] [reason]
+	user unsuspend <screen_name>
+	user set-password <screen_name>
+	buddies <screen_name>
+	stats
+	clients
+	broadcast [-popup] [-offline] <text>
+	broadcast list
+`)
+}
+
+func main() {
+	configPath := flag.String("config", "", "Path to app config. If empty, the config is read from the environment")
+	jsonOutput := flag.Bool("json", false, "Print JSON instead of tables")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("could not parse config: %s", err)
+	}
+
+	d, err := db.Connect(&conf.DBConfig)
+	if err != nil {
+		log.Fatalf("could not connect to DB: %s", err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	out := &output{w: os.Stdout, json: *jsonOutput}
+	args := flag.Args()
+
+	switch {
+	case args[0] == "user" && len(args) >= 2:
+		err = userCommand(ctx, d, conf.AppConfig.Metrics, out, args[1], args[2:])
+	case args[0] == "buddies" && len(args) == 2:
+		err = buddies(ctx, d, out, args[1])
+	case args[0] == "stats" && len(args) == 1:
+		err = stats(ctx, d, out)
+	case args[0] == "clients" && len(args) == 1:
+		err = clients(ctx, d, out)
+	case args[0] == "broadcast" && len(args) >= 2:
+		err = broadcastCommand(ctx, d, conf.AppConfig.Metrics, out, args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err == errUsage {
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
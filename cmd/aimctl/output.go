@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// output prints results as tables or as JSON
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// table prints the rows under headers, or v as JSON
+func (o *output) table(headers []string, rows [][]string, v interface{}) error {
+	if o.json {
+		return o.encode(v)
+	}
+
+	tw := tabwriter.NewWriter(o.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// result prints message, or v as JSON, after a command changes something
+func (o *output) result(message string, v interface{}) error {
+	if o.json {
+		return o.encode(v)
+	}
+	_, err := fmt.Fprintln(o.w, message)
+	return err
+}
+
+func (o *output) encode(v interface{}) error {
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// formatTime is t for tables, or - if there isn't one
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// readPassword asks for a password on the terminal without echoing it, twice to catch typos.
+// When stdin isn't a terminal the password is read from its first line, so it can be piped in.
+func readPassword(prompt string) (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("could not read password from stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	if err := stty("-echo"); err == nil {
+		defer stty("echo")
+	}
+
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := reader.ReadString('\n')
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	password, err := read(prompt)
+	if err != nil {
+		return "", err
+	}
+	again, err := read("Again: ")
+	if err != nil {
+		return "", err
+	}
+	if password != again {
+		return "", errors.New("passwords don't match")
+	}
+	return password, nil
+}
+
+// stty changes how the terminal on stdin behaves
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"aim-oscar/config"
+	"aim-oscar/models"
+	"aim-oscar/services"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+var errUsage = errors.New("usage")
+
+// userRow is how a user is printed. Passwords and ciphers are left out.
+type userRow struct {
+	UIN              int64      `json:"uin"`
+	ScreenName       string     `json:"screen_name"`
+	Email            string     `json:"email"`
+	Status           string     `json:"status"`
+	Verified         bool       `json:"verified"`
+	Suspended        bool       `json:"suspended"`
+	SuspendedUntil   *time.Time `json:"suspended_until,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
+	Deleted          bool       `json:"deleted"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+func newUserRow(user *models.User) *userRow {
+	return &userRow{
+		UIN:              user.UIN,
+		ScreenName:       user.ScreenName,
+		Email:            user.Email,
+		Status:           user.Status.String(),
+		Verified:         user.Verified,
+		Suspended:        user.IsSuspended(time.Now()),
+		SuspendedUntil:   user.SuspendedUntil,
+		SuspensionReason: user.SuspensionReason,
+		Deleted:          user.DeletedAt != nil,
+		CreatedAt:        user.CreatedAt,
+	}
+}
+
+func userCommand(ctx context.Context, db *bun.DB, metrics config.MetricsConfig, out *output, cmd string, args []string) error {
+	switch {
+	case cmd == "create" && len(args) == 2:
+		return createUser(ctx, db, out, args[0], args[1])
+	case cmd == "list" && len(args) == 0:
+		return listUsers(ctx, db, out)
+	case cmd == "delete" && len(args) == 1:
+		return deleteUser(ctx, db, out, args[0])
+	case cmd == "purge" && len(args) == 1:
+		return purgeUser(ctx, db, metrics, out, args[0])
+	case cmd == "export" && len(args) == 1:
+		return exportUser(ctx, db, out, args[0])
+	case cmd == "suspend" && len(args) >= 1:
+		return suspendUser(ctx, db, out, args[0], args[1:])
+	case cmd == "unsuspend" && len(args) == 1:
+		return unsuspendUser(ctx, db, out, args[0])
+	case cmd == "set-password" && len(args) == 1:
+		return setPassword(ctx, db, out, args[0])
+	}
+	return errUsage
+}
+
+// findUser looks up the user with screenName, which has to exist
+func findUser(ctx context.Context, db *bun.DB, screenName string) (*models.User, error) {
+	user, err := models.UserByScreenName(ctx, db, screenName)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("no user %q", screenName)
+	}
+	return user, nil
+}
+
+// createUser creates a verified account that can sign on straight away
+func createUser(ctx context.Context, db *bun.DB, out *output, screenName, email string) error {
+	password, err := readPassword("Password: ")
+	if err != nil {
+		return err
+	}
+
+	switch services.ValidateRegistration(screenName, password, email) {
+	case services.RegistrationErrorInvalidScreenName:
+		return fmt.Errorf("invalid screen name %q: 3 to 16 letters, numbers and spaces, starting with a letter", screenName)
+	case services.RegistrationErrorInvalidPassword:
+		return errors.New("invalid password: 4 to 16 characters")
+	case services.RegistrationErrorInvalidEmail:
+		return fmt.Errorf("invalid email %q", email)
+	}
+
+	if taken, err := models.ScreenNameTaken(ctx, db, screenName); err != nil {
+		return err
+	} else if taken {
+		return fmt.Errorf("screen name %q is taken", screenName)
+	}
+	if taken, err := models.EmailTaken(ctx, db, email); err != nil {
+		return err
+	} else if taken {
+		return fmt.Errorf("email %q already has an account", email)
+	}
+
+	user, err := models.CreateUser(ctx, db, screenName, password, email)
+	if err != nil {
+		return err
+	}
+	user.Verified = true
+	if err := user.Update(ctx, db, "verified"); err != nil {
+		return err
+	}
+
+	return out.result(fmt.Sprintf("Created %s (UIN %d)", user.ScreenName, user.UIN), newUserRow(user))
+}
+
+func listUsers(ctx context.Context, db *bun.DB, out *output) error {
+	users, err := models.ListUsers(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	userRows := make([]*userRow, 0, len(users))
+	rows := make([][]string, 0, len(users))
+	for _, user := range users {
+		row := newUserRow(user)
+		userRows = append(userRows, row)
+
+		state := "active"
+		switch {
+		case row.Deleted:
+			state = "deleted"
+		case row.Suspended:
+			state = "suspended until " + formatTime(row.SuspendedUntil)
+		case !row.Verified:
+			state = "unverified"
+		}
+		rows = append(rows, []string{strconv.FormatInt(row.UIN, 10), row.ScreenName, row.Email, row.Status, state, formatTime(&row.CreatedAt)})
+	}
+
+	return out.table([]string{"UIN", "SCREEN NAME", "EMAIL", "STATUS", "STATE", "CREATED"}, rows, userRows)
+}
+
+// deleteUser keeps the user from logging in again. A signed on user stays on until they sign off.
+func deleteUser(ctx context.Context, db *bun.DB, out *output, screenName string) error {
+	user, err := findUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+	if err := user.Delete(ctx, db); err != nil {
+		return err
+	}
+	return out.result("Deleted "+user.ScreenName, newUserRow(user))
+}
+
+// purgeUser deletes the user and everything about them. Signed on users are deleted by the
+// server through its admin API, which can disconnect them and tell their buddies they left.
+func purgeUser(ctx context.Context, db *bun.DB, metrics config.MetricsConfig, out *output, screenName string) error {
+	user, err := findUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+
+	if user.Status.Connected() {
+		if !adminEnabled(metrics) {
+			return fmt.Errorf("%s is signed on and %w", user.ScreenName, errAdminDisabled)
+		}
+		resp, err := postAdmin(metrics, "/admin/delete", url.Values{"screen_name": {user.ScreenName}})
+		if err != nil {
+			return fmt.Errorf("server could not delete %s: %w", user.ScreenName, err)
+		}
+		resp.Body.Close()
+	} else if err := models.DeleteAccount(ctx, db, user); err != nil {
+		return err
+	}
+	return out.result("Purged "+user.ScreenName, newUserRow(user))
+}
+
+// exportUser prints everything about the user as JSON, whatever the output format
+func exportUser(ctx context.Context, db *bun.DB, out *output, screenName string) error {
+	user, err := findUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+
+	export, err := models.ExportUser(ctx, db, user)
+	if err != nil {
+		return err
+	}
+	return out.encode(export)
+}
+
+// suspendUser suspends the user, for the duration if the first argument is one, with the rest
+// of the arguments as the reason
+func suspendUser(ctx context.Context, db *bun.DB, out *output, screenName string, args []string) error {
+	user, err := findUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+
+	var until *time.Time
+	if len(args) > 0 {
+		if d, err := time.ParseDuration(args[0]); err == nil {
+			end := time.Now().Add(d)
+			until = &end
+			args = args[1:]
+		}
+	}
+
+	if err := user.Suspend(ctx, db, until, strings.Join(args, " ")); err != nil {
+		return err
+	}
+
+	message := "Suspended " + user.ScreenName
+	if until != nil {
+		message += " until " + formatTime(until)
+	}
+	if user.Status.Connected() {
+		message += ". They're still signed on, use /admin/suspend on the server to disconnect them."
+	}
+	return out.result(message, newUserRow(user))
+}
+
+func unsuspendUser(ctx context.Context, db *bun.DB, out *output, screenName string) error {
+	user, err := findUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+	if err := user.Unsuspend(ctx, db); err != nil {
+		return err
+	}
+	return out.result("Unsuspended "+user.ScreenName, newUserRow(user))
+}
+
+func setPassword(ctx context.Context, db *bun.DB, out *output, screenName string) error {
+	user, err := findUser(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	if services.ValidateRegistration(user.ScreenName, password, user.Email) == services.RegistrationErrorInvalidPassword {
+		return errors.New("invalid password: 4 to 16 characters")
+	}
+
+	if err := user.SetPassword(ctx, db, password); err != nil {
+		return err
+	}
+	return out.result("Set the password of "+user.ScreenName, newUserRow(user))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"aim-oscar/oscar/client"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// loadUser is one simulated user
+type loadUser struct {
+	ScreenName string
+	Password   string
+	Buddies    []string
+
+	stats   *stats
+	client  *client.Client
+	stopped atomic.Bool
+}
+
+func newLoadUser(screenName, password string, s *stats) *loadUser {
+	return &loadUser{ScreenName: screenName, Password: password, stats: s}
+}
+
+// email is the generated account's email address, which has to be unique
+func (u *loadUser) email() string {
+	return strings.ToLower(u.ScreenName) + "@loadtest.invalid"
+}
+
+// register creates the account over OSCAR, which needs the server to have open registration.
+// An account that already exists is left as it is.
+func (u *loadUser) register(addr string) error {
+	c, err := client.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.Register(u.ScreenName, u.Password, u.email())
+	if registrationErr, ok := err.(*client.RegistrationError); ok && registrationErr.Code == 0x03 { // screen name taken
+		return nil
+	}
+	return err
+}
+
+// login signs the user on and starts handling what the server sends them
+func (u *loadUser) login(addr string) error {
+	c, err := client.Dial(addr)
+	if err != nil {
+		return err
+	}
+	if err := c.Login(u.ScreenName, u.Password); err != nil {
+		c.Close()
+		return err
+	}
+
+	u.client = c
+	go u.run()
+	return c.AddBuddy(u.Buddies...)
+}
+
+// Stop signs the user off at the end of the run
+func (u *loadUser) Stop() {
+	u.stopped.Store(true)
+	u.client.Close()
+}
+
+// ping sends a message the recipient echoes back, to time the round trip
+func (u *loadUser) ping(to string) error {
+	return u.client.SendIM(to, "ping "+strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+func (u *loadUser) keepalive() error {
+	return u.client.Keepalive()
+}
+
+// run answers pings and times pongs until the user is disconnected
+func (u *loadUser) run() {
+	for event := range u.client.Events() {
+		switch event := event.(type) {
+		case *client.IMReceived:
+			if strings.HasPrefix(event.Text, "ping ") {
+				if err := u.client.SendIM(event.From, "pong "+strings.TrimPrefix(event.Text, "ping ")); err != nil {
+					u.stats.Error("send failed")
+				}
+			} else if strings.HasPrefix(event.Text, "pong ") {
+				sent, err := strconv.ParseInt(strings.TrimPrefix(event.Text, "pong "), 10, 64)
+				if err != nil {
+					u.stats.Error("bad message")
+					continue
+				}
+				u.stats.RoundTrip(time.Since(time.Unix(0, sent)))
+			}
+
+		case *client.SNACError:
+			u.stats.Error(fmt.Sprintf("SNAC error 0x%02x,0x%04x", event.Family, event.Code))
+
+		case *client.RateChanged:
+			u.stats.Error("rate limited")
+
+		case *client.Disconnected:
+			if !u.stopped.Load() {
+				u.stats.Error("disconnected")
+			}
+		}
+	}
+}
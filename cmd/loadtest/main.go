@@ -0,0 +1,200 @@
+// loadtest simulates many AIM users against a running server. Each one logs in, adds some of
+// the others as buddies and trades instant messages with them, and the run reports how long
+// logins and message round trips took and what went wrong.
+package main
+
+import (
+	"aim-oscar/config"
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"aim-oscar/oscar/client"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	authAddr := flag.String("addr", "localhost:5190", "Address of the authorization server")
+	userCount := flag.Int("users", 100, "Number of concurrent users")
+	prefix := flag.String("prefix", "load", "Screen name prefix of the generated accounts, which are numbered after it")
+	password := flag.String("password", "loadtest", "Password of the generated accounts")
+	buddies := flag.Int("buddies", 5, "Number of other users each user adds as buddies")
+	rate := flag.Float64("rate", 10, "Messages per second sent across all users")
+	duration := flag.Duration("duration", time.Minute, "How long to send messages for once everyone is logged in")
+	loginConcurrency := flag.Int("login-concurrency", 50, "Number of logins in progress at once")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout for connecting to the servers")
+	keepalive := flag.Duration("keepalive", time.Minute, "How often each user sends a keepalive")
+	report := flag.Duration("report", 10*time.Second, "How often to print the stats")
+	fixtureUsers := flag.Bool("fixture-users", false, "Create the accounts directly in the database instead of registering them over OSCAR")
+	configPath := flag.String("config", "", "Path to app config for -fixture-users. If empty, the config is read from the environment")
+	flag.Parse()
+	client.DialTimeout = *timeout
+
+	if *userCount < 2 {
+		log.Fatalf("need at least 2 users")
+	}
+	if *rate <= 0 {
+		log.Fatalf("rate must be positive")
+	}
+	if *buddies >= *userCount {
+		*buddies = *userCount - 1
+	}
+
+	s := newStats()
+	users := make([]*loadUser, *userCount)
+	for i := range users {
+		users[i] = newLoadUser(fmt.Sprintf("%s%d", *prefix, i), *password, s)
+		for j := 1; j <= *buddies; j++ {
+			users[i].Buddies = append(users[i].Buddies, fmt.Sprintf("%s%d", *prefix, (i+j)%*userCount))
+		}
+	}
+
+	if *fixtureUsers {
+		if err := createFixtureUsers(*configPath, users); err != nil {
+			log.Fatalf("could not create users: %s", err)
+		}
+	} else {
+		log.Printf("Registering %d users", len(users))
+		eachUser(users, *loginConcurrency, func(u *loadUser) {
+			if err := u.register(*authAddr); err != nil {
+				log.Printf("could not register %s: %s", u.ScreenName, err)
+				s.Error("registration failed")
+			}
+		})
+	}
+
+	log.Printf("Logging in %d users", len(users))
+	var onlineMutex sync.Mutex
+	var online []*loadUser
+	eachUser(users, *loginConcurrency, func(u *loadUser) {
+		start := time.Now()
+		if err := u.login(*authAddr); err != nil {
+			log.Printf("could not log in %s: %s", u.ScreenName, err)
+			s.Error("login failed")
+			return
+		}
+		s.Login(time.Since(start))
+
+		onlineMutex.Lock()
+		online = append(online, u)
+		onlineMutex.Unlock()
+	})
+	log.Printf("%d users online\n%s", len(online), s)
+	if len(online) == 0 {
+		os.Exit(1)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	done := time.After(*duration)
+
+	// One ticker drives every user's messages and another their keepalives, rather than a
+	// goroutine and timer per user
+	sendTicker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer sendTicker.Stop()
+	keepaliveTicker := time.NewTicker(*keepalive)
+	defer keepaliveTicker.Stop()
+	reportTicker := time.NewTicker(*report)
+	defer reportTicker.Stop()
+
+loop:
+	for {
+		select {
+		case <-sendTicker.C:
+			u := online[rand.Intn(len(online))]
+			if len(u.Buddies) == 0 {
+				continue
+			}
+			go func() {
+				if err := u.ping(u.Buddies[rand.Intn(len(u.Buddies))]); err != nil {
+					s.Error("send failed")
+					return
+				}
+				s.Sent()
+			}()
+		case <-keepaliveTicker.C:
+			for _, u := range online {
+				go u.keepalive()
+			}
+		case <-reportTicker.C:
+			log.Printf("\n%s", s)
+		case <-done:
+			break loop
+		case <-stop:
+			break loop
+		}
+	}
+
+	// Leave a moment for the last round trips to finish
+	time.Sleep(time.Second)
+	for _, u := range online {
+		u.Stop()
+	}
+	fmt.Println(s)
+}
+
+// eachUser runs fn for every user, with at most concurrency at a time
+func eachUser(users []*loadUser, concurrency int, fn func(*loadUser)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, u := range users {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(u *loadUser) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// createFixtureUsers makes verified accounts for the users that don't have one yet
+func createFixtureUsers(configPath string, users []*loadUser) error {
+	conf, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := db.Connect(&conf.DBConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	created := 0
+	for _, u := range users {
+		user, err := models.UserByScreenName(ctx, db, u.ScreenName)
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			continue
+		}
+
+		user, err = models.CreateUser(ctx, db, u.ScreenName, u.Password, u.email())
+		if err != nil {
+			return err
+		}
+		user.Verified = true
+		if err := user.Update(ctx, db, "verified"); err != nil {
+			return err
+		}
+		created++
+	}
+
+	log.Printf("Created %d users", created)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stats collects latencies and errors from every client
+type stats struct {
+	mutex      sync.Mutex
+	logins     []time.Duration
+	roundTrips []time.Duration
+	sent       int
+	errors     map[string]int
+}
+
+func newStats() *stats {
+	return &stats{errors: make(map[string]int)}
+}
+
+func (s *stats) Login(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.logins = append(s.logins, d)
+}
+
+func (s *stats) RoundTrip(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.roundTrips = append(s.roundTrips, d)
+}
+
+func (s *stats) Sent() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sent++
+}
+
+func (s *stats) Error(kind string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errors[kind]++
+}
+
+// String summarizes everything collected so far
+func (s *stats) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "logins: %s\n", summarize(s.logins))
+	fmt.Fprintf(&b, "messages: %d sent, round trips %s\n", s.sent, summarize(s.roundTrips))
+
+	kinds := make([]string, 0, len(s.errors))
+	for kind := range s.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Fprintf(&b, "errors:")
+	if len(kinds) == 0 {
+		fmt.Fprintf(&b, " none")
+	}
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, " %s=%d", kind, s.errors[kind])
+	}
+	return b.String()
+}
+
+// summarize gives the count and percentiles of the latencies
+func summarize(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "0"
+	}
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return fmt.Sprintf("%d (p50 %s, p95 %s, p99 %s, max %s)", len(sorted), percentile(0.5), percentile(0.95), percentile(0.99), sorted[len(sorted)-1])
+}
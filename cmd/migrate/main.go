@@ -18,14 +18,10 @@ func usage() {
 }
 
 func main() {
-	configPath := flag.String("config", "", "Path to app config")
+	configPath := flag.String("config", "", "Path to app config. If empty, the config is read from the environment")
 	flag.Parse()
 
-	if configPath == nil || *configPath == "" {
-		usage()
-	}
-
-	conf, err := config.FromFile(*configPath)
+	conf, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("could not parse config: %s", err)
 	}
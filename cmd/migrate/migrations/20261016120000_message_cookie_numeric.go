@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Message cookies are random 64-bit values, half of which don't fit in a signed bigint
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE messages ALTER COLUMN cookie TYPE numeric(20)`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE messages ALTER COLUMN cookie TYPE bigint`)
+		return err
+	})
+}
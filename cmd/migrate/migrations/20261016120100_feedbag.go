@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewDropTable().Model((*models.Feedbag)(nil)).IfExists().Exec(ctx); err != nil {
+			return err
+		}
+
+		if _, err := db.NewCreateTable().Model((*models.Feedbag)(nil)).Exec(ctx); err != nil {
+			return err
+		}
+
+		_, err := db.NewCreateIndex().Model((*models.Feedbag)(nil)).Index("feedbag_user_uin_idx").Column("user_uin", "group_id", "item_id").Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.Feedbag)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
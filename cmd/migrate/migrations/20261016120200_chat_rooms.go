@@ -0,0 +1,22 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*models.ChatRoom)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+
+		_, err := db.NewCreateIndex().Model((*models.ChatRoom)(nil)).Index("chat_rooms_exchange_name_idx").Column("exchange", "name").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.ChatRoom)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*models.BuddyIcon)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+
+		_, err := db.ExecContext(ctx, `ALTER TABLE users ADD COLUMN IF NOT EXISTS buddy_icon_hash bytea`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `ALTER TABLE users DROP COLUMN IF EXISTS buddy_icon_hash`); err != nil {
+			return err
+		}
+
+		_, err := db.NewDropTable().Model((*models.BuddyIcon)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
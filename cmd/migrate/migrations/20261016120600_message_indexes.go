@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Offline messages are looked up by recipient, and history by who sent them to who and when
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS messages_to_delivered_at_idx ON messages ("to", delivered_at)`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS messages_from_to_created_at_idx ON messages ("from", "to", created_at)`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS messages_from_to_created_at_idx`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS messages_to_delivered_at_idx`)
+		return err
+	})
+}
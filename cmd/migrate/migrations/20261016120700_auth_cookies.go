@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Cookies from the authorization server are kept until the client signs on to BOS with them
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*models.AuthCookie)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+
+		_, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS auth_cookies_uin_idx ON auth_cookies (uin)`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.AuthCookie)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Users are looked up by their screen name without case or spaces, and messages are stored
+// between normalized screen names, so the formatted screen name is only for display
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			statements := []string{
+				`ALTER TABLE users ADD COLUMN IF NOT EXISTS normalized_screen_name varchar`,
+				`UPDATE users SET normalized_screen_name = lower(replace(screen_name, ' ', ''))`,
+				`ALTER TABLE users ALTER COLUMN normalized_screen_name SET NOT NULL`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS users_normalized_screen_name_idx ON users (normalized_screen_name)`,
+				`UPDATE messages SET "from" = lower(replace("from", ' ', '')), "to" = lower(replace("to", ' ', ''))`,
+			}
+			for _, statement := range statements {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS users_normalized_screen_name_idx`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `ALTER TABLE users DROP COLUMN IF EXISTS normalized_screen_name`)
+		return err
+	})
+}
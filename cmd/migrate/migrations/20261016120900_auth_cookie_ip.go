@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Cookies remember the address of the client they were given to
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE auth_cookies ADD COLUMN IF NOT EXISTS ip varchar`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE auth_cookies DROP COLUMN IF EXISTS ip`)
+		return err
+	})
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Signed on users get cookies for connections to a single service, like a chat room
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		statements := []string{
+			`ALTER TABLE auth_cookies ADD COLUMN IF NOT EXISTS family integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE auth_cookies ADD COLUMN IF NOT EXISTS room_exchange integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE auth_cookies ADD COLUMN IF NOT EXISTS room_cookie varchar`,
+		}
+		for _, statement := range statements {
+			if _, err := db.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(ctx context.Context, db *bun.DB) error {
+		for _, column := range []string{"family", "room_exchange", "room_cookie"} {
+			if _, err := db.ExecContext(ctx, `ALTER TABLE auth_cookies DROP COLUMN IF EXISTS `+column); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,19 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// The message of the day clients are sent when they sign on
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewCreateTable().Model((*models.MOTD)(nil)).IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.MOTD)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
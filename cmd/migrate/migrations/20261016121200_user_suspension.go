@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE users
+			ADD COLUMN IF NOT EXISTS suspended boolean NOT NULL DEFAULT false,
+			ADD COLUMN IF NOT EXISTS suspended_until timestamptz,
+			ADD COLUMN IF NOT EXISTS suspension_reason varchar NOT NULL DEFAULT ''`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE users
+			DROP COLUMN IF EXISTS suspended,
+			DROP COLUMN IF EXISTS suspended_until,
+			DROP COLUMN IF EXISTS suspension_reason`)
+		return err
+	})
+}
@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// The friends users have invited to sign up
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*models.Invitation)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		// Invitations are counted by who sent them in the last day
+		_, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS invitations_inviter_uin_created_at_idx ON invitations (inviter_uin, created_at)`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.Invitation)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
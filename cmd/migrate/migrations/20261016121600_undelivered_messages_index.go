@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Stored messages nobody signed on to get are deleted once they're old enough
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS messages_undelivered_created_at_idx ON messages (created_at) WHERE store_offline AND delivered_at IS NULL`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS messages_undelivered_created_at_idx`)
+		return err
+	})
+}
@@ -0,0 +1,19 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Old ICQ messages like URLs are sent on channel 4 with a message type, which they keep until
+// they're delivered
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE messages ADD COLUMN IF NOT EXISTS channel integer NOT NULL DEFAULT 1, ADD COLUMN IF NOT EXISTS icq_type integer NOT NULL DEFAULT 0`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE messages DROP COLUMN IF EXISTS icq_type, DROP COLUMN IF EXISTS channel`)
+		return err
+	})
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Rooms remember when someone was last in them, so empty ones can be reaped, and whether they're
+// listed in the room directory. Existing rooms were last active when they were created.
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `ALTER TABLE chat_rooms ADD COLUMN IF NOT EXISTS last_active_at timestamptz NOT NULL DEFAULT current_timestamp, ADD COLUMN IF NOT EXISTS public boolean NOT NULL DEFAULT true`); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE chat_rooms SET last_active_at = created_at`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS chat_rooms_last_active_at_idx ON chat_rooms (last_active_at)`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS chat_rooms_last_active_at_idx`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `ALTER TABLE chat_rooms DROP COLUMN IF EXISTS public, DROP COLUMN IF EXISTS last_active_at`)
+		return err
+	})
+}
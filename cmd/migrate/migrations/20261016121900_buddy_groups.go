@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Buddies are kept in groups, in order. Everyone already on a buddy list goes in the default
+// group, in the order they were added.
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `ALTER TABLE buddies ADD COLUMN IF NOT EXISTS "group" varchar NOT NULL DEFAULT 'Buddies', ADD COLUMN IF NOT EXISTS position bigint NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE buddies SET position = ordered.position FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY source_uin ORDER BY id) - 1 AS position FROM buddies) AS ordered WHERE buddies.id = ordered.id`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS buddies_source_uin_group_idx ON buddies (source_uin, "group", position)`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.ExecContext(ctx, `DROP INDEX IF EXISTS buddies_source_uin_group_idx`); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `ALTER TABLE buddies DROP COLUMN IF EXISTS position, DROP COLUMN IF EXISTS "group"`)
+		return err
+	})
+}
@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// Users can give their buddies an alias and keep a note about them
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE buddies ADD COLUMN IF NOT EXISTS alias varchar NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS note varchar NOT NULL DEFAULT ''`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.ExecContext(ctx, `ALTER TABLE buddies DROP COLUMN IF EXISTS note, DROP COLUMN IF EXISTS alias`)
+		return err
+	})
+}
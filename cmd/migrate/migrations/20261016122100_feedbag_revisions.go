@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// SSI lists have a revision, so clients with an up to date copy aren't sent it again. Lists that
+// already exist start at their first revision, last modified when their newest item was.
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*models.FeedbagRevision)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.ExecContext(ctx, `INSERT INTO feedbag_revisions (user_uin, revision, last_modified) SELECT user_uin, 1, date_trunc('second', MAX(last_modified)) FROM feedbag GROUP BY user_uin ON CONFLICT (user_uin) DO NOTHING`)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.FeedbagRevision)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"fmt"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dbfixture"
+)
+
+//go:embed fixtures.yml
+var fixtures embed.FS
+
+// LoadFixtures empties the users, messages, buddies and feedbag tables and fills them with test
+// users for development. Never use it on a DB with real users.
+func LoadFixtures(ctx context.Context, db *bun.DB) error {
+	fixture := dbfixture.New(db, dbfixture.WithTruncateTables())
+	if err := fixture.Load(ctx, fixtures, "fixtures.yml"); err != nil {
+		return fmt.Errorf("could not load fixtures: %w", err)
+	}
+
+	// The fixtures pick their own UINs, so new users have to be numbered after them
+	if _, err := db.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence('users', 'uin'), (SELECT MAX(uin) FROM users))`); err != nil {
+		return fmt.Errorf("could not renumber users: %w", err)
+	}
+	return nil
+}
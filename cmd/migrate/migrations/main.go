@@ -1,18 +1,39 @@
 package migrations
 
 import (
-	"embed"
+	"context"
 
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/migrate"
 )
 
 var Migrations = migrate.NewMigrations()
 
-//go:embed *.yml
-var sqlMigrations embed.FS
+// Up brings the DB's schema up to date, running every migration that hasn't been run yet
+func Up(ctx context.Context, db *bun.DB) (*migrate.MigrationGroup, error) {
+	migrator := migrate.NewMigrator(db, Migrations)
+	if err := migrator.Init(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not create migration tables")
+	}
 
-func init() {
-	if err := Migrations.Discover(sqlMigrations); err != nil {
-		panic(err)
+	group, err := migrator.Migrate(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not migrate")
+	}
+	return group, nil
+}
+
+// Check makes sure every migration has been run, for servers that don't migrate the DB
+// themselves. The error says what's missing.
+func Check(ctx context.Context, db *bun.DB) error {
+	migrator := migrate.NewMigrator(db, Migrations)
+	ms, err := migrator.MigrationsWithStatus(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not tell which migrations have been run, the DB may never have been migrated")
+	}
+	if unapplied := ms.Unapplied(); len(unapplied) > 0 {
+		return errors.Errorf("%d migrations haven't been run, starting with %s", len(unapplied), unapplied[0].Name)
 	}
+	return nil
 }
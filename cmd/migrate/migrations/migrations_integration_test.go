@@ -0,0 +1,91 @@
+//go:build integration
+
+package migrations
+
+import (
+	"aim-oscar/db"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Migrating an empty DB gives it a table for every model, with every column
+func TestUpFromEmpty(t *testing.T) {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+	d, err := db.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer d.Close()
+
+	// The search path belongs to the connection, so the test sticks to one in its own schema
+	d.SetMaxOpenConns(1)
+	ctx := context.Background()
+	schema := fmt.Sprintf("migrations_test_%d", time.Now().UnixNano())
+	if _, err := d.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("could not create schema: %s", err)
+	}
+	defer d.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE")
+	if _, err := d.ExecContext(ctx, "SET search_path TO "+schema); err != nil {
+		t.Fatalf("could not use schema: %s", err)
+	}
+
+	if err := Check(ctx, d); err == nil {
+		t.Errorf("expected an empty DB to need migrating")
+	}
+
+	group, err := Up(ctx, d)
+	if err != nil {
+		t.Fatalf("could not migrate: %s", err)
+	}
+	if group.ID == 0 {
+		t.Fatalf("expected migrations to run")
+	}
+	if err := Check(ctx, d); err != nil {
+		t.Errorf("expected the DB to be up to date: %s", err)
+	}
+
+	for _, model := range db.Models {
+		table := d.Table(reflect.TypeOf(model).Elem())
+
+		var columns []string
+		err := d.NewSelect().
+			Table("information_schema.columns").
+			Column("column_name").
+			Where("table_schema = ?", schema).
+			Where("table_name = ?", table.Name).
+			Scan(ctx, &columns)
+		if err != nil {
+			t.Fatalf("could not fetch columns of %s: %s", table.Name, err)
+		}
+
+		existing := make(map[string]bool)
+		for _, column := range columns {
+			existing[column] = true
+		}
+		for _, field := range table.Fields {
+			if !existing[field.Name] {
+				t.Errorf("expected %s to have column %s", table.Name, field.Name)
+			}
+		}
+	}
+
+	// Everything has been run, so there's nothing left to do
+	group, err = Up(ctx, d)
+	if err != nil {
+		t.Fatalf("could not migrate again: %s", err)
+	}
+	if group.ID != 0 {
+		t.Errorf("expected no migrations to run again, ran %s", group)
+	}
+
+	if err := LoadFixtures(ctx, d); err != nil {
+		t.Fatalf("could not load fixtures: %s", err)
+	}
+}
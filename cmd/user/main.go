@@ -9,23 +9,20 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 func usage() {
 	flag.Usage()
-	fmt.Printf("commands:\n\tadd <screen_name> <password> <email>\n\tverify <screen_name>\n")
+	fmt.Printf("commands:\n\tadd <screen_name> <password> <email>\n\tverify <screen_name>\n\tmotd <text>\n\tmotd clear\n\tsuspend <screen_name> [duration] [reason]\n\tunsuspend <screen_name>\n")
 }
 
 func main() {
-	configPath := flag.String("config", "", "Path to app config")
+	configPath := flag.String("config", "", "Path to app config. If empty, the config is read from the environment")
 	flag.Parse()
 
-	if configPath == nil || *configPath == "" {
-		usage()
-		os.Exit(1)
-	}
-
-	conf, err := config.FromFile(*configPath)
+	conf, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("could not parse config: %s", err)
 	}
@@ -85,5 +82,77 @@ func main() {
 		}
 
 		log.Printf("Verified %s", screenName)
+	} else if cmd == "motd" {
+		if len(flag.Args()) < 2 {
+			log.Println("missing arguments")
+			usage()
+			os.Exit(1)
+		}
+
+		if flag.Arg(1) == "clear" {
+			if err := models.ClearMOTD(ctx, db); err != nil {
+				log.Fatalf("could not clear MOTD: %s", err)
+			}
+			log.Printf("Cleared MOTD")
+			return
+		}
+
+		text := strings.Join(flag.Args()[1:], " ")
+		if err := models.SetMOTD(ctx, db, models.MOTDTypeNews, text); err != nil {
+			log.Fatalf("could not set MOTD: %s", err)
+		}
+		log.Printf("Set MOTD")
+	} else if cmd == "suspend" {
+		if len(flag.Args()) < 2 {
+			log.Println("missing arguments")
+			usage()
+			os.Exit(1)
+		}
+
+		screenName := flag.Arg(1)
+		user, err := models.UserByScreenName(ctx, db, screenName)
+		if err != nil || user == nil {
+			log.Fatalf("could not get User by Screen Name: %v", err)
+		}
+
+		var until *time.Time
+		reason := flag.Args()[2:]
+		if len(reason) > 0 {
+			if d, err := time.ParseDuration(reason[0]); err == nil {
+				end := time.Now().Add(d)
+				until = &end
+				reason = reason[1:]
+			}
+		}
+
+		if err := user.Suspend(ctx, db, until, strings.Join(reason, " ")); err != nil {
+			log.Fatalf("could not suspend user: %s", err)
+		}
+
+		if until != nil {
+			log.Printf("Suspended %s until %s", screenName, until.Format(time.RFC3339))
+		} else {
+			log.Printf("Suspended %s", screenName)
+		}
+		if user.Status.Connected() {
+			log.Printf("%s is still signed on, use /admin/suspend on the server to disconnect them", screenName)
+		}
+	} else if cmd == "unsuspend" {
+		if len(flag.Args()) < 2 {
+			log.Println("missing arguments")
+			usage()
+			os.Exit(1)
+		}
+
+		screenName := flag.Arg(1)
+		user, err := models.UserByScreenName(ctx, db, screenName)
+		if err != nil || user == nil {
+			log.Fatalf("could not get User by Screen Name: %v", err)
+		}
+
+		if err := user.Unsuspend(ctx, db); err != nil {
+			log.Fatalf("could not unsuspend user: %s", err)
+		}
+		log.Printf("Unsuspended %s", screenName)
 	}
 }
@@ -2,8 +2,10 @@ package db
 
 import (
 	"aim-oscar/config"
+	"aim-oscar/models"
 	"database/sql"
 	"fmt"
+	"net/url"
 	"time"
 
 	"github.com/uptrace/bun"
@@ -11,7 +13,13 @@ import (
 	"github.com/uptrace/bun/driver/pgdriver"
 )
 
+// Connect opens a connection to the DB described by the config. If a DSN is set it takes
+// precedence over the individual connection settings.
 func Connect(c *config.DBConfig) (*bun.DB, error) {
+	if c.DSN != "" {
+		return NewDB(c.DSN)
+	}
+
 	dbaddr := fmt.Sprintf("%s:%d", c.Host, c.Port)
 
 	pgconn := pgdriver.NewConnector(
@@ -27,11 +35,58 @@ func Connect(c *config.DBConfig) (*bun.DB, error) {
 		pgdriver.WithWriteTimeout(5*time.Second),
 	)
 
-	// Set up the DB
-	sqldb := sql.OpenDB(pgconn)
-	db := bun.NewDB(sqldb, pgdialect.New())
+	return open(sql.OpenDB(pgconn), pgdialect.New())
+}
+
+// NewDB opens a connection to the Postgres DB at dsn, a postgres:// (or postgresql://) URL. The
+// queries and migrations are written for Postgres, so there's no other dialect to pick.
+func NewDB(dsn string) (*bun.DB, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse DSN: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return nil, fmt.Errorf("unsupported DSN scheme %q: only postgres:// DSNs are supported", u.Scheme)
+	}
+
+	pgconn := pgdriver.NewConnector(
+		pgdriver.WithDSN(dsn),
+		pgdriver.WithTimeout(5*time.Second),
+		pgdriver.WithDialTimeout(5*time.Second),
+		pgdriver.WithReadTimeout(5*time.Second),
+		pgdriver.WithWriteTimeout(5*time.Second),
+	)
+	return open(sql.OpenDB(pgconn), pgdialect.New())
+}
+
+// RegisterModels registers every model with the DB so relations between them resolve
+func RegisterModels(db *bun.DB) {
+	db.RegisterModel(Models...)
+}
+
+// Models is the list of all of the tables the server uses
+var Models = []interface{}{
+	(*models.User)(nil),
+	(*models.Message)(nil),
+	(*models.Buddy)(nil),
+	(*models.EmailVerification)(nil),
+	(*models.Feedbag)(nil),
+	(*models.FeedbagRevision)(nil),
+	(*models.ChatRoom)(nil),
+	(*models.BuddyIcon)(nil),
+	(*models.AuthCookie)(nil),
+	(*models.MOTD)(nil),
+	(*models.ClientVersion)(nil),
+	(*models.Invitation)(nil),
+	(*models.Broadcast)(nil),
+	(*models.ServerStats)(nil),
+}
+
+func open(sqldb *sql.DB, dialect *pgdialect.Dialect) (*bun.DB, error) {
+	db := bun.NewDB(sqldb, dialect)
 	db.SetConnMaxIdleTime(15 * time.Second)
 	db.SetConnMaxLifetime(1 * time.Minute)
+	RegisterModels(db)
 
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("could not ping db: %w", err)
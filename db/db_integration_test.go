@@ -0,0 +1,56 @@
+//go:build integration
+
+package db
+
+import (
+	"aim-oscar/models"
+	"context"
+	"os"
+	"testing"
+)
+
+// Run with: DB_DSN=postgres://... go test -tags integration ./db
+func testDB(t *testing.T) string {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+	return dsn
+}
+
+func TestNewDB(t *testing.T) {
+	db, err := NewDB(testDB(t))
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if _, err := db.NewCreateTable().Model((*models.Message)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create messages table: %s", err)
+	}
+
+	// Cookies are random and regularly overflow a signed 64-bit column
+	msg, err := models.InsertMessage(ctx, db, 0xfedcba9876543210, "alice", "bob", "hi")
+	if err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+	defer db.NewDelete().Model(msg).WherePK().Exec(ctx)
+
+	fetched := new(models.Message)
+	if err := db.NewSelect().Model(fetched).Where("id = ?", msg.ID).Scan(ctx); err != nil {
+		t.Fatalf("could not fetch message: %s", err)
+	}
+
+	if fetched.Cookie != msg.Cookie {
+		t.Errorf("expected cookie %x, got %x", msg.Cookie, fetched.Cookie)
+	}
+}
+
+func TestNewDBUnsupportedScheme(t *testing.T) {
+	for _, dsn := range []string{"sqlite://aim.db", "file:aim.db", "mysql://root@localhost/aim"} {
+		if _, err := NewDB(dsn); err == nil {
+			t.Errorf("expected %s to be refused", dsn)
+		}
+	}
+}
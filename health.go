@@ -0,0 +1,72 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// healthPingTimeout is how long /readyz waits for the DB
+const healthPingTimeout = 2 * time.Second
+
+// ServerStats is the /stats of the health listener
+type ServerStats struct {
+	Sessions            int     `json:"sessions"`
+	UptimeSeconds       float64 `json:"uptime_seconds"`
+	UndeliveredMessages int     `json:"undelivered_messages"`
+}
+
+// healthHandler serves the health listener, for supervisors and load balancers. /healthz is
+// whether the server is accepting clients, /readyz is whether it should be sent new ones, and
+// /stats is JSON about what the server is doing. Unlike the metrics server it has no auth.
+func healthHandler(db *bun.DB, server *Server, started time.Time, logger *slog.Logger) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !server.Serving() {
+			http.Error(w, "not accepting clients", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !server.Ready() {
+			http.Error(w, "not accepting clients or shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			logger.Warn("could not ping DB for readiness", "err", err.Error())
+			http.Error(w, "DB unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		undelivered, err := models.CountAllUndelivered(r.Context(), db)
+		if err != nil {
+			logger.Error("could not count undelivered messages", "err", err.Error())
+			http.Error(w, "could not count undelivered messages", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ServerStats{
+			Sessions:            server.Sessions.Count(),
+			UptimeSeconds:       time.Since(started).Seconds(),
+			UndeliveredMessages: undelivered,
+		})
+	})
+
+	return mux
+}
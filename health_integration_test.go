@@ -0,0 +1,67 @@
+//go:build integration
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// The server is healthy and ready while it's serving, and stops being ready once it's draining
+func TestHealth(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	health := httptest.NewServer(healthHandler(d, server, time.Now().Add(-time.Minute), slog.New(slog.NewTextHandler(io.Discard, nil))))
+	t.Cleanup(health.Close)
+
+	status := func(path string) int {
+		resp, err := http.Get(health.URL + path)
+		if err != nil {
+			t.Fatalf("could not get %s: %s", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); !server.Serving(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the server to be serving")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("expected /healthz to be OK, got %d", code)
+	}
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Errorf("expected /readyz to be OK, got %d", code)
+	}
+
+	loggedInClient(t, d, addr, "alice")
+	resp, err := http.Get(health.URL + "/stats")
+	if err != nil {
+		t.Fatalf("could not get stats: %s", err)
+	}
+	var stats ServerStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not read stats: %s", err)
+	}
+	if stats.Sessions != 1 || stats.UptimeSeconds < 60 || stats.UndeliveredMessages != 0 {
+		t.Errorf("expected one session, a minute up and no messages, got %+v", stats)
+	}
+
+	server.Drain()
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected a draining server not to be ready, got %d", code)
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("expected a draining server to still be healthy, got %d", code)
+	}
+}
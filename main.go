@@ -1,42 +1,46 @@
 package main
 
 import (
+	"aim-oscar/cmd/migrate/migrations"
 	"aim-oscar/config"
 	"aim-oscar/db"
+	"aim-oscar/metrics"
 	"aim-oscar/models"
-	"aim-oscar/oscar"
 	"aim-oscar/services"
-	"bytes"
+	"aim-oscar/stats"
+	"aim-oscar/webhook"
 	"context"
 	"flag"
-	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/uptrace/bun/extra/bundebug"
 	"golang.org/x/exp/slog"
 )
 
 func main() {
-	configPath := flag.String("config", "", "Path to app config")
+	started := time.Now()
+	configPath := flag.String("config", "", "Path to app config (YAML, JSON or TOML). If empty, the config is read from the environment")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error. Overrides app.log_level")
+	dev := flag.Bool("dev", os.Getenv("AIM_ENV") == "dev", "Development mode, which replaces the users in the DB with test users. It deletes every account, so never use it with real users. Also set by AIM_ENV=dev")
+	flag.Usage = config.Usage(flag.Usage)
 	flag.Parse()
 
-	if configPath == nil || *configPath == "" {
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	conf, err := config.FromFile(*configPath)
+	conf, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("could not parse config: %s", err)
 	}
 
+	if *logLevel != "" {
+		conf.AppConfig.LogLevel = *logLevel
+	}
+
 	var level slog.Level = slog.LevelDebug
 	if err := level.UnmarshalText([]byte(conf.AppConfig.LogLevel)); err != nil {
 		log.Fatalf("invalid app.log_level: %s", err)
@@ -57,200 +61,185 @@ func main() {
 	}
 
 	// Print all queries to stdout.
-	db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(conf.AppConfig.LogLevel == slog.LevelDebug.String())))
+	db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(level == slog.LevelDebug)))
 
-	// Register our DB models
-	db.RegisterModel((*models.User)(nil), (*models.Message)(nil), (*models.Buddy)(nil), (*models.EmailVerification)(nil))
+	ctx := context.Background()
+	if conf.DBConfig.SkipMigrations {
+		// Nothing else creates the tables, so a DB that hasn't been migrated can't be used
+		if err := migrations.Check(ctx, db); err != nil {
+			logger.Error("DB isn't migrated and db.skip_migrations is set, run cmd/migrate up first", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+	} else {
+		group, err := migrations.Up(ctx, db)
+		if err != nil {
+			logger.Error("could not migrate DB", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		if group.ID != 0 {
+			logger.Info("Migrated DB to " + group.String())
+		}
+	}
+
+	if *dev {
+		logger.Warn("Development mode, loading dev fixtures")
+		if err := migrations.LoadFixtures(ctx, db); err != nil {
+			logger.Error("could not load dev fixtures", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+	}
 
 	// On start, all users must be offline bc there are no connections (while this is a one-server operation)
-	ctx := context.Background()
-	if _, err := db.NewUpdate().Model(&models.User{}).Set("status = ?", models.UserStatusAway).Where("status != ?", models.UserStatusAway).Exec(ctx); err != nil {
+	if n, err := models.SetAllOffline(ctx, db); err != nil {
 		logger.Error("could not set all users as offline", "err", err.Error())
 		os.Exit(1)
+	} else if n > 0 {
+		logger.Info("Set users left signed on as offline", slog.Int("users", n))
 	}
 
-	listener, err := net.Listen("tcp", conf.OscarConfig.Addr)
+	// Clients log in on the authorization server and are then sent to the BOS server with a cookie
+	authListener, err := net.Listen("tcp", conf.OscarConfig.Addr)
 	if err != nil {
-		fmt.Println("Error listening: ", err.Error())
+		logger.Error("could not listen", slog.String("addr", conf.OscarConfig.Addr), slog.String("err", err.Error()))
 		os.Exit(1)
 	}
-	defer listener.Close()
-
-	sessionManager := NewSessionManager()
-
-	// Goroutine that listens for messages to deliver and tries to find a user socket to push them to
-	commCh, messageRoutine := MessageDelivery(sessionManager, logger)
-	go messageRoutine(db)
-
-	// Goroutine that listens for users who change their online status and notifies their buddies
-	onlineCh, onlineRoutine := OnlineNotification(sessionManager, logger)
-	go onlineRoutine(db)
+	authListeners := []net.Listener{authListener}
 
-	serviceManager := NewServiceManager()
-	serviceManager.RegisterService(0x01, &services.GenericServiceControls{OnlineCh: onlineCh, ServerHostname: conf.OscarConfig.Addr})
-	serviceManager.RegisterService(0x02, &services.LocationServices{OnlineCh: onlineCh})
-	serviceManager.RegisterService(0x03, &services.BuddyListManagement{OnlineCh: onlineCh})
-	serviceManager.RegisterService(0x04, &services.ICBM{CommCh: commCh})
-	// serviceManager.RegisterService(0x0f, &services.DirectorySearchService{})
-	// serviceManager.RegisterService(0x13, &services.FeedbagService{})
-	serviceManager.RegisterService(0x17, &services.AuthorizationRegistrationService{BOSAddress: conf.OscarConfig.BOS})
-	serviceManager.RegisterService(0x18, &services.AlertService{})
-
-	handleCloseFn := func(ctx context.Context, session *oscar.Session) {
-		session.Logger.Info("Disconnected")
-
-		user := models.UserFromContext(ctx)
-		if user != nil {
-			if err := user.SetAway(ctx, db); err != nil {
-				logger.Error("Could not set user as away", slog.String("err", err.Error()))
-			}
-
-			logger.Info("Disconnecting user", slog.String("screen_name", user.ScreenName))
-
-			onlineCh <- user
-			if session, err := oscar.SessionFromContext(ctx); err == nil {
-				session.Disconnect()
-				sessionManager.RemoveSession(user.ScreenName)
-			}
+	if conf.OscarConfig.TLSAddr != "" {
+		tlsListener, err := listenTLS(conf.OscarConfig.TLSAddr, conf.OscarConfig.TLSCert, conf.OscarConfig.TLSKey)
+		if err != nil {
+			logger.Error("could not listen", slog.String("addr", conf.OscarConfig.TLSAddr), slog.String("err", err.Error()))
+			os.Exit(1)
 		}
+		authListeners = append(authListeners, tlsListener)
+	}
+
+	bosListener, err := net.Listen("tcp", conf.OscarConfig.BOSAddr)
+	if err != nil {
+		logger.Error("could not listen", slog.String("addr", conf.OscarConfig.BOSAddr), slog.String("err", err.Error()))
+		os.Exit(1)
 	}
 
-	handleFn := func(ctx context.Context, flap *oscar.FLAP) context.Context {
-		session, err := oscar.SessionFromContext(ctx)
+	// TOC clients sign on and send their commands over a connection of their own
+	var tocListener net.Listener
+	if conf.OscarConfig.TOC {
+		tocListener, err = net.Listen("tcp", conf.OscarConfig.TOCAddr)
 		if err != nil {
-			// TODO
-			logger.Error("no session in context", slog.String("flap", flap.String()))
-			return ctx
+			logger.Error("could not listen", slog.String("addr", conf.OscarConfig.TOCAddr), slog.String("err", err.Error()))
+			os.Exit(1)
 		}
+	}
 
-		if user := models.UserFromContext(ctx); user != nil {
-			if conf.AppConfig.LogLevel == slog.LevelDebug.String() {
-				logger.Debug("RECV",
-					slog.String("screen_name", user.ScreenName),
-					slog.String("ip", session.RemoteAddr().String()),
-					"flap", flap,
-				)
-			}
-			user.LastActivityAt = time.Now()
-			ctx = models.NewContextWithUser(ctx, user)
-			session.ScreenName = user.ScreenName
-			sessionManager.SetSession(user.ScreenName, session)
-		} else {
-			if conf.AppConfig.LogLevel == slog.LevelDebug.String() {
-				logger.Debug("RECV",
-					slog.String("ip", session.RemoteAddr().String()),
-					"flap", flap,
-				)
-			}
+	// Clients behind firewalls that only allow HTTP tunnel their connections through it
+	var tunnelListener net.Listener
+	if conf.OscarConfig.HTTPTunnelAddr != "" {
+		tunnelListener, err = net.Listen("tcp", conf.OscarConfig.HTTPTunnelAddr)
+		if err != nil {
+			logger.Error("could not listen", slog.String("addr", conf.OscarConfig.HTTPTunnelAddr), slog.String("err", err.Error()))
+			os.Exit(1)
 		}
+	}
 
-		if flap.Header.Channel == 1 {
-			// Is this a hello?
-			if bytes.Equal(flap.Data.Bytes(), []byte{0, 0, 0, 1}) {
-				return ctx
-			}
-
-			user, screenName, err := services.AuthenticateFLAPCookie(ctx, db, flap)
-			if err != nil {
-				session.Logger.Error("Could not authenticate user cookie", "screen_name", screenName, slog.String("err", err.Error()))
-				return ctx
-			}
-
-			session.Logger.Info("Authenticated user", "screen_name", user.ScreenName)
-
-			session.ScreenName = user.ScreenName
-			ctx = models.NewContextWithUser(ctx, user)
-
-			// Send available services
-			servicesSnac := oscar.NewSNAC(0x1, 0x3)
-			for _, service := range services.ServiceVersions {
-				servicesSnac.Data.WriteUint16(service.Family)
-			}
-
-			servicesFlap := oscar.NewFLAP(2)
-			servicesFlap.Data.WriteBinary(servicesSnac)
-			session.Send(servicesFlap)
-
-			return ctx
-		} else if flap.Header.Channel == 2 {
-			snac := &oscar.SNAC{}
-			if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
-				session.Logger.Error("could not unmarshal FLAP data", "err", err)
-				session.Disconnect()
-				handleCloseFn(ctx, session)
-				return ctx
-			}
-
-			if service, ok := serviceManager.GetService(snac.Header.Family); ok {
-				newCtx, err := service.HandleSNAC(ctx, db, snac)
-				if err != nil {
-					session.Logger.Error("error handling SNAC", slog.String("err", err.Error()))
-					session.Disconnect()
-					handleCloseFn(ctx, session)
-				}
-
-				return newCtx
-			}
-		} else if flap.Header.Channel == 4 {
-			handleCloseFn(ctx, session)
-		} else if flap.Header.Channel == 5 {
-			// User is still connected
-			// TODO: handle when user stops sending these messages?
-			return ctx
-			// session.Logger.Debug(fmt.Sprintf("%s is still connected", session.ScreenName))
-		} else {
-			session.Logger.Info("unhandled channel message", "channel", flap.Header.Channel, "flap", flap)
+	var serverOpts []ServerOption
+	if conf.OscarConfig.MessageFilterFile != "" {
+		filter, err := services.LoadWordFilter(conf.OscarConfig.MessageFilterFile)
+		if err != nil {
+			logger.Error("could not load message filter", slog.String("file", conf.OscarConfig.MessageFilterFile), slog.String("err", err.Error()))
+			os.Exit(1)
 		}
+		serverOpts = append(serverOpts, WithMessageFilter(filter))
+	}
 
-		return ctx
+	var webhooks *webhook.Dispatcher
+	if conf.AppConfig.Webhook.URL != "" {
+		webhooks = webhook.NewDispatcher(conf.AppConfig.Webhook.URL, conf.AppConfig.Webhook.Secret, conf.AppConfig.Webhook.QueueSize, logger)
+		serverOpts = append(serverOpts, WithWebhooks(webhooks))
 	}
 
-	handler := oscar.NewHandler(handleFn, handleCloseFn)
+	server := NewServer(conf.OscarConfig, db, logger, serverOpts...)
 
 	var metricsServer *http.Server
 	if conf.AppConfig.Metrics.Addr != "" {
-		mux := http.NewServeMux()
-		metricsHandler := promhttp.Handler()
-
-		if conf.AppConfig.Metrics.User != "" && conf.AppConfig.Metrics.Password != "" {
-			metricsHandler = BasicAuth(promhttp.Handler().ServeHTTP, conf.AppConfig.Metrics.User, conf.AppConfig.Metrics.Password, "identify yourself")
-		}
+		admin := http.NewServeMux()
+		admin.Handle("/admin/migrate", migrateHandler(db, server.Sessions, logger))
+		admin.Handle("/admin/suspend", suspendHandler(db, server.Sessions, logger))
+		admin.Handle("/admin/unsuspend", unsuspendHandler(db, logger))
+		admin.Handle("/admin/delete", deleteAccountHandler(db, server.Sessions, logger))
+		admin.Handle("/admin/export", exportAccountHandler(db, logger))
+		admin.Handle("/admin/buddylist", buddyListHandler(db, server.Sessions, conf.OscarConfig.MaxBuddies, logger))
+		admin.Handle("/admin/sessions", sessionsHandler(server.Sessions))
+		admin.Handle("/admin/chatrooms", chatRoomsHandler(db, server.Chat, logger))
+		admin.Handle("/admin/chatrooms/close", closeChatRoomHandler(db, server.Chat, logger))
+		admin.Handle("/admin/stats", statsHandler(stats.Default))
+		admin.Handle("/admin/broadcast", broadcastHandler(db, server.Sessions, conf.OscarConfig.SystemScreenName, logger))
+		metricsServer = metrics.NewServer(conf.AppConfig.Metrics.Addr, conf.AppConfig.Metrics.User, conf.AppConfig.Metrics.Password, admin)
+		go func() {
+			logger.Info("Metrics handler started", "metrics_server_addr", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Metrics handler stopped", slog.String("err", err.Error()))
+			}
+		}()
+	}
 
-		mux.Handle("/metrics", metricsHandler)
-		metricsServer = &http.Server{
-			Addr:    conf.AppConfig.Metrics.Addr,
-			Handler: mux,
+	var healthServer *http.Server
+	if conf.AppConfig.Health.Addr != "" {
+		healthServer = &http.Server{
+			Addr:    conf.AppConfig.Health.Addr,
+			Handler: healthHandler(db, server, started, logger),
 		}
 		go func() {
-			logger.Info("Metrics handler started", "metrics_server_addr", metricsServer.Addr)
-			metricsServer.ListenAndServe()
+			logger.Info("Health handler started", "health_server_addr", healthServer.Addr)
+			if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Health handler stopped", slog.String("err", err.Error()))
+			}
 		}()
 	}
 
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			// Load balancers watching readiness stop sending clients before the listeners close
+			if healthServer != nil && server.Ready() {
+				server.Drain()
+				logger.Info("Draining before shutting down", "drain_delay", conf.AppConfig.Health.DrainDelay)
+				time.Sleep(conf.AppConfig.Health.DrainDelay)
+			}
+			server.Shutdown()
+			webhooks.Close()
+
+			if metricsServer != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := metricsServer.Shutdown(ctx); err != nil {
+					logger.Error("Could not shut down metrics handler", slog.String("err", err.Error()))
+				}
+				cancel()
+			}
+			if healthServer != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := healthServer.Shutdown(ctx); err != nil {
+					logger.Error("Could not shut down health handler", slog.String("err", err.Error()))
+				}
+				cancel()
+			}
+		})
+	}
+
 	exitChan := make(chan os.Signal, 1)
 	signal.Notify(exitChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
 	go func() {
 		<-exitChan
-		close(commCh)
-		close(onlineCh)
-
-		if metricsServer != nil {
-			metricsServer.Close()
-		}
-
-		logger.Info("Shutting down")
+		shutdown()
 		os.Exit(1)
 	}()
 
-	logger.Info("Listening on " + conf.OscarConfig.Addr)
-	logger.Info("BOS host " + conf.OscarConfig.BOS)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			logger.Error("error accepting connection: ", err.Error())
-			os.Exit(1)
-		}
-
-		go handler.Handle(conn, logger)
+	if err := server.Serve(Listeners{
+		Auth:   authListeners,
+		BOS:    bosListener,
+		TOC:    tocListener,
+		Tunnel: tunnelListener,
+	}); err != nil {
+		logger.Error("error accepting connection", slog.String("err", err.Error()))
 	}
+	shutdown()
+	os.Exit(1)
 }
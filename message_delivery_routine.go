@@ -1,8 +1,12 @@
 package main
 
 import (
+	"aim-oscar/aimerror"
+	"aim-oscar/metrics"
 	"aim-oscar/models"
 	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"aim-oscar/stats"
 	"aim-oscar/util"
 	"context"
 	"time"
@@ -13,6 +17,35 @@ import (
 
 type routineFn func(db *bun.DB)
 
+// DeliveryRetryDelay is how long to wait before trying again to deliver a message that
+// couldn't be sent to the recipient's session, which gives a client that's reconnecting time
+// to sign back on
+var DeliveryRetryDelay = 2 * time.Second
+
+// MaxDeliveryAttempts is how many times sending a message is tried before it's left for the
+// recipient's next sign on, or the sender is told it wasn't delivered
+const MaxDeliveryAttempts = 3
+
+// deliveryOutcome is what happened to a message, and the label it's counted under
+type deliveryOutcome string
+
+const (
+	// deliveryQueued is a stored message for a recipient who isn't signed on, which they get
+	// when they sign on
+	deliveryQueued deliveryOutcome = "queued"
+	// deliveryNotDelivered is a message for a recipient who isn't signed on that wasn't stored
+	deliveryNotDelivered deliveryOutcome = "not_delivered"
+	// deliveryFailed is a message that couldn't be sent to the recipient's session, like one
+	// whose connection just died
+	deliveryFailed    deliveryOutcome = "failed"
+	deliveryDelivered deliveryOutcome = "delivered"
+	// deliveryError is a message that couldn't be delivered because of the server, like the
+	// DB being unavailable
+	deliveryError deliveryOutcome = "error"
+	// deliveryDuplicate is a stored message that the offline queue already delivered
+	deliveryDuplicate deliveryOutcome = "duplicate"
+)
+
 func MessageDelivery(sm *SessionManager, parentLogger *slog.Logger) (chan *models.Message, routineFn) {
 	commCh := make(chan *models.Message, 1)
 	logger := parentLogger.With(slog.String("routine", "message_delivery"))
@@ -21,70 +54,170 @@ func MessageDelivery(sm *SessionManager, parentLogger *slog.Logger) (chan *model
 		logger.Info("starting up")
 		defer logger.Info("shutting down")
 
+		// Retries come back to this goroutine once their delay is up, unless it has stopped
+		retryCh := make(chan *models.Message)
+		stopped := make(chan struct{})
+		defer close(stopped)
+
 		for {
-			message, more := <-commCh
-			if !more {
-				return
+			var message *models.Message
+			select {
+			case m, more := <-commCh:
+				if !more {
+					return
+				}
+				message = m
+			case message = <-retryCh:
 			}
 
 			msgLogger := logger.
 				With(slog.Group("message", slog.String("from", message.From), slog.String("to", message.To), slog.Uint64("cookie", message.Cookie)))
 
-			// If the user isn't connected, don't send the message
-			session := sm.GetSession(message.To)
-			if session == nil {
-				continue
+			outcome := deliverMessage(db, sm, message, msgLogger)
+			metrics.Messages.WithLabelValues(string(outcome)).Inc()
+			switch outcome {
+			case deliveryDelivered:
+				stats.Default.MessageRelayed()
+			case deliveryQueued:
+				stats.Default.MessageStored()
 			}
-
-			messageSnac := oscar.NewSNAC(4, 7)
-			messageSnac.Data.WriteUint64(message.Cookie)
-			messageSnac.Data.WriteUint16(1)
-			messageSnac.Data.WriteLPString(message.From)
-			messageSnac.Data.WriteUint16(0) // TODO: sender's warning level
-
-			ctx := context.Background()
-			user, err := models.UserByScreenName(ctx, db, message.From)
-			if err != nil {
-				msgLogger.Error("could not get message author User, can't send message", "err", err.Error())
+			if outcome != deliveryFailed {
 				continue
 			}
 
-			tlvs := []*oscar.TLV{
-				oscar.NewTLV(1, util.Word(0)),                                                     // TODO: user class
-				oscar.NewTLV(6, util.Dword(uint32(user.Status))),                                  // TODO: user status
-				oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(user.LastActivityAt).Seconds()))), // idle time
-				oscar.NewTLV(0x03, util.Dword(uint32(user.LastActivityAt.Second()))),              // TODO: signon time
-				// oscar.NewTLV(4, []byte{}), // TODO: this TLV appears in automated responses like away messages
+			message.Attempts++
+			if message.Attempts < MaxDeliveryAttempts {
+				msgLogger.Info("Retrying message delivery", "attempts", message.Attempts)
+				time.AfterFunc(DeliveryRetryDelay, func() {
+					select {
+					case retryCh <- message:
+					case <-stopped:
+					}
+				})
+			} else if message.StoreOffline {
+				msgLogger.Info("Leaving message for the recipient's next sign on", "attempts", message.Attempts)
+			} else {
+				messageNotDelivered(sm, message, msgLogger)
 			}
+		}
+	}
 
-			messageSnac.AppendTLVs(tlvs)
+	return commCh, routine
+}
 
-			frag := oscar.Buffer{}
-			frag.Write([]byte{5, 1, 0, 4, 1, 1, 1, 2})          // TODO: first fragment [id, version, len, len, (cap * len)... ]
-			frag.Write([]byte{1, 1})                            // message text fragment start (this is a busted "TLV")
-			frag.WriteUint16(uint16(len(message.Contents) + 4)) // length of TLV
-			frag.Write([]byte{0, 0, 0, 0})                      // TODO: message charset number, message charset subset
-			frag.WriteString(message.Contents)
+// deliverMessage sends the message to the recipient's session. Stored messages are only marked
+// delivered once they're sent, so any that aren't are still there for the offline queue the
+// next time the recipient signs on.
+func deliverMessage(db *bun.DB, sm *SessionManager, message *models.Message, msgLogger *slog.Logger) deliveryOutcome {
+	session := sm.GetSession(message.To)
+	if session == nil {
+		if message.StoreOffline {
+			msgLogger.Info("Recipient is offline, message stored")
+			return deliveryQueued
+		}
+		msgLogger.Info("Recipient is offline")
+		messageNotDelivered(sm, message, msgLogger)
+		return deliveryNotDelivered
+	}
+	msgLogger = msgLogger.With("session_id", session.ID)
 
-			// Append the fragments
-			messageSnac.Data.WriteBinary(oscar.NewTLV(2, frag.Bytes()))
+	ctx := oscar.NewContextWithLogger(context.Background(), msgLogger)
+	user, err := models.UserByScreenName(ctx, db, message.From)
+	if err != nil {
+		msgLogger.Error("could not get message author User, can't send message", "err", err.Error())
+		return deliveryError
+	}
+	if user == nil {
+		msgLogger.Error("message author does not exist, can't send message")
+		return deliveryError
+	}
 
-			messageFlap := oscar.NewFLAP(2)
-			messageFlap.Data.WriteBinary(messageSnac)
-			if err := session.Send(messageFlap); err != nil {
-				msgLogger.Error("Could not deliver message", slog.String("err", err.Error()))
-				continue
-			} else {
-				msgLogger.Info("Delivered message")
-			}
+	messageSnac := incomingMessageSNAC(user, liveSession(sm, user.ScreenName), message)
 
-			if message.StoreOffline {
-				if err := message.MarkDelivered(context.Background(), db); err != nil {
-					msgLogger.Error("could not mark message as delivered", slog.String("err", err.Error()))
-				}
+	// Make sure that the offline queue isn't delivering this message at the same time
+	if message.StoreOffline {
+		claimed, err := message.ClaimDelivery(ctx, db)
+		if err != nil {
+			msgLogger.Error("could not claim message for delivery", slog.String("err", err.Error()))
+			return deliveryError
+		}
+		if !claimed {
+			msgLogger.Debug("message already delivered")
+			return deliveryDuplicate
+		}
+	}
+
+	messageFlap := oscar.NewFLAP(2)
+	messageFlap.Data.WriteBinary(messageSnac)
+	if err := session.Send(messageFlap); err != nil {
+		msgLogger.Warn("Could not deliver message", slog.String("err", err.Error()))
+
+		// The session is dead, and closing it runs its close handler, which takes it out of
+		// the session manager and tells buddies the user signed off
+		session.Disconnect()
+
+		if message.StoreOffline {
+			if err := message.ReleaseDelivery(ctx, db); err != nil {
+				msgLogger.Error("could not release message for later delivery", slog.String("err", err.Error()))
 			}
 		}
+		return deliveryFailed
 	}
 
-	return commCh, routine
+	if message.StoreOffline {
+		if err := message.MarkDelivered(ctx, db); err != nil {
+			msgLogger.Error("could not mark message as delivered", slog.String("err", err.Error()))
+		}
+	}
+
+	msgLogger.Info("Delivered message")
+	return deliveryDelivered
+}
+
+// messageNotDelivered tells the sender that a message that wasn't stored for later never made
+// it to the recipient. The sender may have already been told the server accepted it, so this is
+// the only way they find out.
+func messageNotDelivered(sm *SessionManager, message *models.Message, logger *slog.Logger) {
+	sender := liveSession(sm, message.From)
+	if sender == nil {
+		return
+	}
+
+	if err := sender.Send(services.ICBMRecipientError(0, aimerror.CodeRecipientNotLoggedIn, message.To)); err != nil {
+		logger.Error("could not tell sender the message wasn't delivered", "sender_session_id", sender.ID, slog.String("err", err.Error()))
+	}
+}
+
+// incomingMessageSNAC is the SNAC (0x04,0x07) that delivers the message from user, with the
+// user info block of their session if they're signed on
+func incomingMessageSNAC(user *models.User, session *oscar.Session, message *models.Message) *oscar.SNAC {
+	// Old ICQ messages go out on the channel they came in on, which is the only one ICQ clients
+	// expect them on
+	channel := uint16(1)
+	if message.Channel == 4 {
+		channel = 4
+	}
+
+	messageSnac := oscar.NewSNAC(4, 7)
+	messageSnac.Data.WriteUint64(message.Cookie)
+	messageSnac.Data.WriteUint16(channel)
+	services.WriteUserInfo(messageSnac, user, session)
+
+	if channel == 4 {
+		messageSnac.Data.WriteBinary(services.ICQMessage(uint32(user.UIN), message.ICQType, message.Contents))
+	} else {
+		messageSnac.Data.WriteBinary(services.MessageFragments(message.Contents))
+	}
+
+	// Automatic replies are flagged so the recipient's client shows them as one
+	if message.AutoResponse {
+		messageSnac.Data.WriteBinary(oscar.NewTLV(4, []byte{}))
+	}
+
+	// Messages from the offline queue carry the time they were originally sent
+	if message.Queued {
+		messageSnac.Data.WriteBinary(oscar.NewTLV(6, []byte{}))
+		messageSnac.Data.WriteBinary(oscar.NewTLV(0x16, util.Dword(uint32(message.CreatedAt.Unix()))))
+	}
+	return messageSnac
 }
@@ -0,0 +1,168 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// deadSession is a session whose connection has died without it being signed off yet, so
+// sending to it fails
+func deadSession(t *testing.T) *oscar.Session {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	session := oscar.NewSession(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	session.Disconnect()
+	return session
+}
+
+func startMessageDelivery(t *testing.T, d *bun.DB, sm *SessionManager) chan *models.Message {
+	retryDelay := DeliveryRetryDelay
+	DeliveryRetryDelay = 100 * time.Millisecond
+	t.Cleanup(func() { DeliveryRetryDelay = retryDelay })
+
+	commCh, routine := MessageDelivery(sm, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	go routine(d)
+	t.Cleanup(func() { close(commCh) })
+	return commCh
+}
+
+// A message sent just as the recipient's connection dies reaches them once they reconnect
+func TestDeliveryRetried(t *testing.T) {
+	d := serverTestDB(t)
+	ctx := context.Background()
+	sm := NewSessionManager(KickOldSession)
+	commCh := startMessageDelivery(t, d, sm)
+
+	_, alice, _ := signedOnUser(t, d, sm, "alice")
+	_, bob, snacs := signedOnUser(t, d, sm, "bob")
+	live := sm.GetSession(bob.ScreenName)
+	sm.ClaimSession(bob.ScreenName, deadSession(t))
+
+	message, err := models.InsertMessage(ctx, d, 1, alice.ScreenName, bob.ScreenName, "are you there")
+	if err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+	commCh <- message
+
+	// Sending to the dead session fails, and the retry finds bob signed back on
+	time.Sleep(50 * time.Millisecond)
+	sm.ClaimSession(bob.ScreenName, live)
+
+	select {
+	case snac := <-snacs:
+		if snac.Header.Family != 0x04 || snac.Header.Subtype != 0x07 {
+			t.Fatalf("expected the message, got %s", snac)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message to be delivered once bob reconnected")
+	}
+
+	undelivered, err := models.UndeliveredFor(ctx, d, bob.ScreenName, 0)
+	if err != nil {
+		t.Fatalf("could not get undelivered messages: %s", err)
+	}
+	if len(undelivered) != 0 {
+		t.Errorf("expected the message to be marked delivered, got %d undelivered", len(undelivered))
+	}
+}
+
+// A message that can't be sent to the recipient's dead session is left for their next sign on
+func TestDeliveryFailedStored(t *testing.T) {
+	d := serverTestDB(t)
+	ctx := context.Background()
+	sm := NewSessionManager(KickOldSession)
+	commCh := startMessageDelivery(t, d, sm)
+
+	for _, screenName := range []string{"alice", "bob"} {
+		user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+		if err != nil {
+			t.Fatalf("could not create user: %s", err)
+		}
+		user.Verified = true
+		if err := user.Update(ctx, d, "verified"); err != nil {
+			t.Fatalf("could not verify user: %s", err)
+		}
+	}
+
+	dead := deadSession(t)
+	sm.ClaimSession("bob", dead)
+	message, err := models.InsertMessage(ctx, d, 1, "alice", "bob", "while you were out")
+	if err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+	commCh <- message
+
+	// Every attempt fails until the dead session is signed off
+	time.Sleep(time.Duration(MaxDeliveryAttempts) * 2 * DeliveryRetryDelay)
+	sm.RemoveSession("bob", dead)
+
+	_, addr := startServer(t, d)
+	bobClient := loggedInClient(t, d, addr, "bob")
+	im := nextIM(t, bobClient)
+	if im.From != "alice" || im.Text != "while you were out" {
+		t.Errorf("expected the stored message from alice, got %q from %s", im.Text, im.From)
+	}
+	if im.SentAt.IsZero() {
+		t.Errorf("expected the message to come from the offline queue")
+	}
+}
+
+// Old ICQ messages that waited for the recipient are delivered on channel 4, keeping their type
+func TestDeliveryICQMessage(t *testing.T) {
+	d := serverTestDB(t)
+	ctx := context.Background()
+	sm := NewSessionManager(KickOldSession)
+	commCh := startMessageDelivery(t, d, sm)
+
+	_, alice, _ := signedOnUser(t, d, sm, "alice")
+	_, bob, snacs := signedOnUser(t, d, sm, "bob")
+
+	message, err := models.InsertICQMessage(ctx, d, 1, alice.ScreenName, bob.ScreenName, 0x04, "Homepage\u00fehttp://example.com")
+	if err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+	message.Queued = true
+	commCh <- message
+
+	var snac *oscar.SNAC
+	select {
+	case snac = <-snacs:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message to be delivered")
+	}
+	if snac.Header.Family != 0x04 || snac.Header.Subtype != 0x07 {
+		t.Fatalf("expected the message, got %s", snac)
+	}
+
+	snac.Data.ReadUint64() // cookie
+	if channel, _ := snac.Data.ReadUint16(); channel != 4 {
+		t.Errorf("expected the message on channel 4, got %d", channel)
+	}
+	snac.Data.ReadLPString()
+	snac.Data.ReadUint16() // warning level
+	count, _ := snac.Data.ReadUint16()
+	snac.Data.ReadTLVs(int(count))
+	tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read message TLVs: %s", err)
+	}
+	expected := services.ICQMessage(uint32(alice.UIN), 0x04, "Homepage\u00fehttp://example.com")
+	if icq := oscar.FindTLV(tlvs, 0x05); icq == nil || !bytes.Equal(icq.Data, expected.Data) {
+		t.Errorf("expected the URL message from alice, got %v", icq)
+	}
+	if oscar.FindTLV(tlvs, 0x16) == nil {
+		t.Errorf("expected the time the message was sent")
+	}
+}
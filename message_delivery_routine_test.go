@@ -0,0 +1,81 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"aim-oscar/util"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// The sender was already told their message was accepted when delivering it fails
+func TestMessageNotDelivered(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sm := NewSessionManager(KickOldSession)
+	sm.ClaimSession("alice", oscar.NewSession(server, logger))
+	defer sm.RemoveSession("alice", sm.GetSession("alice"))
+
+	go messageNotDelivered(sm, &models.Message{From: "alice", To: "bob"}, logger)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(client, header); err != nil {
+		t.Fatalf("expected alice to be told, got %s", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if _, err := io.ReadFull(client, data); err != nil {
+		t.Fatalf("could not read SNAC: %s", err)
+	}
+
+	snac := &oscar.SNAC{}
+	if err := snac.UnmarshalBinary(data); err != nil {
+		t.Fatalf("could not unmarshal SNAC: %s", err)
+	}
+	if snac.Header.Family != 0x4 || snac.Header.Subtype != 0x01 {
+		t.Fatalf("expected SNAC(0x04, 0x01), got %s", snac)
+	}
+	if code, _ := snac.Data.ReadUint16(); code != 0x04 {
+		t.Errorf("expected error 0x04, got 0x%02x", code)
+	}
+
+	// Nobody to tell if the sender has gone too
+	messageNotDelivered(sm, &models.Message{From: "carol", To: "bob"}, logger)
+}
+
+// Messages carry the same user info block for the sender as buddy arrivals do
+func TestIncomingMessageUserInfo(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	user := &models.User{ScreenName: "alice", Status: models.UserStatusAway}
+	session := oscar.NewSession(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	signonAt := time.Now().Add(-time.Hour)
+	session.SetSignonAt(signonAt)
+
+	snac := incomingMessageSNAC(user, session, &models.Message{Cookie: 1, Channel: 1, Contents: "hi"})
+	snac.Data.ReadUint64() // cookie
+	snac.Data.ReadUint16() // channel
+	tlvs := userInfoTLVs(t, snac)
+
+	if tlv := oscar.FindTLV(tlvs, 0x01); tlv == nil || !bytes.Equal(tlv.Data, util.Word(services.UserClass(user))) {
+		t.Errorf("expected alice's user class, got %v", tlv)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x03); tlv == nil || !bytes.Equal(tlv.Data, util.Dword(uint32(signonAt.Unix()))) {
+		t.Errorf("expected alice's signon time, got %v", tlv)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x0f); tlv == nil || binary.BigEndian.Uint32(tlv.Data) < 3600 {
+		t.Errorf("expected alice's online time, got %v", tlv)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"aim-oscar/metrics"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// MessageRetention is which delivered messages are kept. Messages still waiting for their
+// recipient are never deleted by it, only by the offline message expiry.
+type MessageRetention struct {
+	// MaxAge is how long delivered messages are kept after they're sent, or negative to keep
+	// them however old they are. 0 deletes every delivered message.
+	MaxAge time.Duration
+
+	// MaxPerConversation is the most messages kept between two users, the newest ones, or 0
+	// for no limit
+	MaxPerConversation int
+
+	// BatchSize is the most messages deleted at once, so deleting a backlog doesn't hold locks on
+	// the messages table for long
+	BatchSize int
+
+	// DryRun only counts and logs the messages that would be deleted
+	DryRun bool
+}
+
+// MessagePruning deletes the delivered messages the retention policy doesn't keep every
+// interval. The routine stops once done is closed.
+func MessagePruning(interval time.Duration, retention MessageRetention, parentLogger *slog.Logger) func(db *bun.DB, done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "message_pruning"))
+
+	return func(db *bun.DB, done <-chan struct{}) {
+		logger.Info("starting up", "max_age", retention.MaxAge, "max_per_conversation", retention.MaxPerConversation, "dry_run", retention.DryRun)
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx := oscar.NewContextWithLogger(context.Background(), logger)
+			if retention.MaxAge >= 0 {
+				cutoff := time.Now().Add(-retention.MaxAge)
+				pruneMessages(ctx, logger, "age", retention, done,
+					func() (int, error) { return models.CountDeliveredBefore(ctx, db, cutoff) },
+					func() (int64, error) { return models.DeleteDeliveredBefore(ctx, db, cutoff, retention.BatchSize) })
+			}
+			if retention.MaxPerConversation > 0 {
+				pruneMessages(ctx, logger, "conversation", retention, done,
+					func() (int, error) { return models.CountBeyondConversationLimit(ctx, db, retention.MaxPerConversation) },
+					func() (int64, error) {
+						return models.DeleteBeyondConversationLimit(ctx, db, retention.MaxPerConversation, retention.BatchSize)
+					})
+			}
+		}
+	}
+}
+
+// pruneMessages deletes batches until there are none left or done is closed, or just counts
+// them in a dry run
+func pruneMessages(ctx context.Context, logger *slog.Logger, policy string, retention MessageRetention, done <-chan struct{}, count func() (int, error), deleteBatch func() (int64, error)) {
+	if retention.DryRun {
+		n, err := count()
+		if err != nil {
+			logger.Error("could not count messages to prune", "policy", policy, slog.String("err", err.Error()))
+			return
+		}
+		if n > 0 {
+			logger.Info("would prune messages", "policy", policy, slog.Int("count", n))
+		}
+		return
+	}
+
+	var total int64
+	for {
+		deleted, err := deleteBatch()
+		if err != nil {
+			logger.Error("could not prune messages", "policy", policy, slog.String("err", err.Error()))
+			break
+		}
+		total += deleted
+		metrics.MessagesPruned.WithLabelValues(policy).Add(float64(deleted))
+		if deleted < int64(retention.BatchSize) {
+			break
+		}
+
+		select {
+		case <-done:
+			logger.Info("pruned messages", "policy", policy, slog.Int64("count", total))
+			return
+		default:
+		}
+	}
+	if total > 0 {
+		logger.Info("pruned messages", "policy", policy, slog.Int64("count", total))
+	}
+}
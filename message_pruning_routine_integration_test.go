@@ -0,0 +1,135 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// storeMessage stores a message from one user to another sent age ago, delivered or still
+// waiting for the recipient
+func storeMessage(t *testing.T, d *bun.DB, from, to string, age time.Duration, delivered bool) *models.Message {
+	t.Helper()
+	ctx := context.Background()
+	message, err := models.InsertMessage(ctx, d, 1, from, to, "hello")
+	if err != nil {
+		t.Fatalf("could not store message: %s", err)
+	}
+	message.CreatedAt = time.Now().Add(-age)
+	if _, err := d.NewUpdate().Model(message).Column("created_at").WherePK().Exec(ctx); err != nil {
+		t.Fatalf("could not age message: %s", err)
+	}
+	if delivered {
+		if err := message.MarkDelivered(ctx, d); err != nil {
+			t.Fatalf("could not deliver message: %s", err)
+		}
+	}
+	return message
+}
+
+// runPruning runs the pruning routine until the messages are gone, then checks the others were
+// kept
+func runPruning(t *testing.T, d *bun.DB, retention MessageRetention, pruned []*models.Message, kept []*models.Message) {
+	t.Helper()
+	ctx := context.Background()
+	exists := func(message *models.Message) bool {
+		exists, err := d.NewSelect().Model((*models.Message)(nil)).Where("id = ?", message.ID).Exists(ctx)
+		if err != nil {
+			t.Fatalf("could not look up message: %s", err)
+		}
+		return exists
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		MessagePruning(20*time.Millisecond, retention, slog.New(slog.NewTextHandler(io.Discard, nil)))(d, done)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for _, message := range pruned {
+		for exists(message) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the message from %s sent at %s to be pruned", message.From, message.CreatedAt)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Give a dry run the chance to delete something it shouldn't
+	time.Sleep(100 * time.Millisecond)
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("expected the routine to stop")
+	}
+
+	for _, message := range kept {
+		if !exists(message) {
+			t.Errorf("expected the message from %s to %s sent at %s to be kept", message.From, message.To, message.CreatedAt)
+		}
+	}
+}
+
+// Delivered messages are deleted once they're too old, a batch at a time, and messages waiting
+// for their recipient are kept however old they are
+func TestMessagePruningByAge(t *testing.T) {
+	d := serverTestDB(t)
+
+	old := []*models.Message{
+		storeMessage(t, d, "alice", "bob", 48*time.Hour, true),
+		storeMessage(t, d, "bob", "alice", 72*time.Hour, true),
+		storeMessage(t, d, "carol", "alice", 96*time.Hour, true),
+	}
+	recent := storeMessage(t, d, "alice", "bob", time.Hour, true)
+	waiting := storeMessage(t, d, "alice", "dave", 96*time.Hour, false)
+
+	runPruning(t, d, MessageRetention{MaxAge: 24 * time.Hour, BatchSize: 2}, old, []*models.Message{recent, waiting})
+}
+
+// Only the newest messages between two users are kept, and messages waiting for their
+// recipient count towards them but are never deleted
+func TestMessagePruningPerConversation(t *testing.T) {
+	d := serverTestDB(t)
+
+	waiting := storeMessage(t, d, "alice", "bob", 10*time.Hour, false)
+	var conversation []*models.Message
+	for i := 9; i > 0; i-- {
+		from, to := "alice", "bob"
+		if i%2 == 0 {
+			from, to = to, from
+		}
+		conversation = append(conversation, storeMessage(t, d, from, to, time.Duration(i)*time.Hour, true))
+	}
+	other := []*models.Message{
+		storeMessage(t, d, "alice", "carol", 20*time.Hour, true),
+		storeMessage(t, d, "carol", "alice", 30*time.Hour, true),
+	}
+
+	// The 3 newest of the 10 between alice and bob are kept
+	kept := append([]*models.Message{waiting}, conversation[6:]...)
+	kept = append(kept, other...)
+	runPruning(t, d, MessageRetention{MaxAge: -1, MaxPerConversation: 3, BatchSize: 4}, conversation[:6], kept)
+}
+
+// A dry run deletes nothing
+func TestMessagePruningDryRun(t *testing.T) {
+	d := serverTestDB(t)
+
+	old := storeMessage(t, d, "alice", "bob", 48*time.Hour, true)
+	runPruning(t, d, MessageRetention{MaxAge: 0, MaxPerConversation: 1, BatchSize: 10, DryRun: true}, nil, []*models.Message{old})
+
+	n, err := models.CountDeliveredBefore(context.Background(), d, time.Now())
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 message to prune, got %d %v", n, err)
+	}
+}
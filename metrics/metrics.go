@@ -0,0 +1,106 @@
+// Package metrics has the Prometheus metrics for the server and the HTTP listener that
+// exposes them
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ConnectionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aim_connections_accepted_total",
+		Help: "Number of client connections accepted",
+	})
+
+	ConnectionsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aim_connections_rejected_total",
+		Help: "Number of client connections closed straight away because their IP had too many open",
+	})
+
+	ActiveSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "aim_sessions_active",
+		Help: "Number of signed on users",
+	})
+
+	FLAPsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_flaps_received_total",
+		Help: "Number of FLAPs received from clients, by channel",
+	}, []string{"channel"})
+
+	FLAPsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_flaps_sent_total",
+		Help: "Number of FLAPs sent to clients, by channel",
+	}, []string{"channel"})
+
+	SNACsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_snacs_handled_total",
+		Help: "Number of SNACs handled by a service, by family and subtype",
+	}, []string{"family", "subtype"})
+
+	SNACDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aim_snac_duration_seconds",
+		Help:    "Time taken to handle SNACs, by family and subtype",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"family", "subtype"})
+
+	AuthAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_auth_attempts_total",
+		Help: "Number of sign on attempts, by method and result",
+	}, []string{"method", "result"})
+
+	Messages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_messages_total",
+		Help: "Number of instant messages, by whether they were delivered, queued for an offline user or failed to send",
+	}, []string{"outcome"})
+
+	MessagesPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_messages_pruned_total",
+		Help: "Number of delivered messages deleted by the retention policy, by whether they were too old or beyond the conversation limit",
+	}, []string{"policy"})
+
+	PresenceNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_presence_notifications_total",
+		Help: "Number of buddy arrival and departure notifications sent",
+	}, []string{"type"})
+
+	WebhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_webhook_events_total",
+		Help: "Number of webhook events, by whether they were sent, failed to send or dropped because the queue was full",
+	}, []string{"outcome"})
+)
+
+// Sign on methods for AuthAttempts
+const (
+	AuthMD5     = "md5"
+	AuthRoasted = "roasted"
+	AuthCookie  = "cookie"
+	AuthTOC     = "toc"
+)
+
+// Channel is the label for a FLAP channel
+func Channel(channel uint8) string {
+	return strconv.Itoa(int(channel))
+}
+
+// Hex is the label for a SNAC family or subtype
+func Hex(x uint16) string {
+	return fmt.Sprintf("0x%02x", x)
+}
+
+// AuthRateLimited counts a sign on attempt turned away for too many wrong passwords
+func AuthRateLimited(method string) {
+	AuthAttempts.WithLabelValues(method, "rate_limited").Inc()
+}
+
+// Auth counts a sign on attempt
+func Auth(method string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	AuthAttempts.WithLabelValues(method, result).Inc()
+}
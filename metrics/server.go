@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NewServer is the HTTP server for /metrics on addr. The metrics need the username and
+// password if they are both set. admin is served under /admin/, and only when the username and
+// password are set.
+func NewServer(addr, username, password string, admin http.Handler) *http.Server {
+	handler := promhttp.Handler()
+	if username != "" && password != "" {
+		handler = BasicAuth(handler.ServeHTTP, username, password, "identify yourself")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	if admin != nil && username != "" && password != "" {
+		mux.Handle("/admin/", BasicAuth(admin.ServeHTTP, username, password, "identify yourself"))
+	}
+	return &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	ConnectionsAccepted.Inc()
+
+	tt := map[string]struct {
+		username string
+		password string
+		auth     bool
+		expected int
+	}{
+		"open":                {"", "", false, http.StatusOK},
+		"with credentials":    {"user", "password", true, http.StatusOK},
+		"without credentials": {"user", "password", false, http.StatusUnauthorized},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			server := NewServer("localhost:0", tc.username, tc.password, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.auth {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, rec.Code)
+			}
+			if rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), "aim_connections_accepted_total") {
+				t.Errorf("expected the server metrics to be exposed")
+			}
+		})
+	}
+}
+
+func TestLabels(t *testing.T) {
+	if label := Channel(2); label != "2" {
+		t.Errorf("expected channel label 2, got %s", label)
+	}
+	if label := Hex(0x13); label != "0x13" {
+		t.Errorf("expected label 0x13, got %s", label)
+	}
+}
+
+// The admin handler is only served with credentials, and needs them
+func TestServerAdmin(t *testing.T) {
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tt := map[string]struct {
+		username string
+		password string
+		auth     bool
+		expected int
+	}{
+		"open":                {"", "", false, http.StatusNotFound},
+		"with credentials":    {"user", "password", true, http.StatusNoContent},
+		"without credentials": {"user", "password", false, http.StatusUnauthorized},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			server := NewServer("localhost:0", tc.username, tc.password, admin)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/migrate", nil)
+			if tc.auth {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
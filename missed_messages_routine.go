@@ -0,0 +1,36 @@
+package main
+
+import (
+	"aim-oscar/services"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// MissedMessagesFlushInterval is how long a user can go without being sent a message before
+// they're told about the messages they missed anyway
+var MissedMessagesFlushInterval = 30 * time.Second
+
+// MissedMessagesFlush tells users about the messages they missed, for users nobody is sending
+// messages that would tell them sooner. The routine stops once done is closed.
+func MissedMessagesFlush(icbm *services.ICBM, interval time.Duration, parentLogger *slog.Logger) func(done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "missed_messages_flush"))
+
+	return func(done <-chan struct{}) {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			icbm.FlushMissedMessages()
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// AuthCookieLength is how many random bytes make up an authorization cookie
+const AuthCookieLength = 256
+
+// AuthCookieTTL is how long a client has to sign on to BOS with its cookie
+const AuthCookieTTL = 5 * time.Minute
+
+// AuthCookie is handed out by the authorization server for the user to sign on to BOS with, or
+// by BOS for a signed on user to open a connection for one service. Each cookie can only be used
+// once.
+type AuthCookie struct {
+	bun.BaseModel `bun:"table:auth_cookies"`
+
+	Cookie    []byte    `bun:",pk"`
+	UIN       int64     `bun:",notnull"`
+	IP        string    // the address of the client the cookie was given to
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Family is the service the cookie's connection is for, 0 for signing on to BOS. Chat
+	// connections are for the room with RoomExchange and RoomCookie.
+	Family       uint16 `bun:",notnull,default:0"`
+	RoomExchange uint16 `bun:",notnull,default:0"`
+	RoomCookie   string
+}
+
+// CreateAuthCookie makes a new cookie for the user signing on from ip, clearing out any of theirs
+// that expired without being used
+func CreateAuthCookie(ctx context.Context, db bun.IDB, uin int64, ip string) ([]byte, error) {
+	return createCookie(ctx, db, &AuthCookie{UIN: uin, IP: ip})
+}
+
+// CreateServiceCookie makes a new cookie for the signed on user to open a connection for the
+// service family from ip. room is the chat room for chat connections, nil otherwise.
+func CreateServiceCookie(ctx context.Context, db bun.IDB, uin int64, ip string, family uint16, room *ChatRoom) ([]byte, error) {
+	authCookie := &AuthCookie{UIN: uin, IP: ip, Family: family}
+	if room != nil {
+		authCookie.RoomExchange = room.Exchange
+		authCookie.RoomCookie = room.Cookie
+	}
+	return createCookie(ctx, db, authCookie)
+}
+
+// createCookie fills in a random cookie and stores it
+func createCookie(ctx context.Context, db bun.IDB, authCookie *AuthCookie) ([]byte, error) {
+	if _, err := db.NewDelete().Model((*AuthCookie)(nil)).
+		Where("uin = ?", authCookie.UIN).
+		Where("created_at < ?", time.Now().Add(-AuthCookieTTL)).
+		Exec(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not delete expired auth cookies")
+	}
+
+	authCookie.Cookie = make([]byte, AuthCookieLength)
+	if _, err := rand.Read(authCookie.Cookie); err != nil {
+		return nil, errors.Wrap(err, "could not generate auth cookie")
+	}
+
+	authCookie.CreatedAt = time.Now()
+	if _, err := db.NewInsert().Model(authCookie).Exec(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not store auth cookie")
+	}
+	return authCookie.Cookie, nil
+}
+
+// UseAuthCookie forgets the cookie and returns what it was made for. Returns nil if the cookie
+// doesn't exist, has already been used or has expired.
+func UseAuthCookie(ctx context.Context, db bun.IDB, cookie []byte) (*AuthCookie, error) {
+	var used []*AuthCookie
+	_, err := db.NewDelete().Model((*AuthCookie)(nil)).
+		Where("cookie = ?", cookie).
+		Where("created_at >= ?", time.Now().Add(-AuthCookieTTL)).
+		Returning("*").
+		Exec(ctx, &used)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not use auth cookie")
+	}
+	if len(used) == 0 {
+		return nil, nil
+	}
+	return used[0], nil
+}
+
+// DeleteAuthCookies forgets every cookie made for the user so none of them can be used
+func DeleteAuthCookies(ctx context.Context, db bun.IDB, uin int64) error {
+	if _, err := db.NewDelete().Model((*AuthCookie)(nil)).Where("uin = ?", uin).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not delete auth cookies")
+	}
+	return nil
+}
+
+// DeleteExpiredAuthCookies forgets every cookie that expired without being used, and returns how
+// many there were
+func DeleteExpiredAuthCookies(ctx context.Context, db bun.IDB) (int64, error) {
+	res, err := db.NewDelete().Model((*AuthCookie)(nil)).Where("created_at < ?", time.Now().Add(-AuthCookieTTL)).Exec(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not delete expired auth cookies")
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"aim-oscar/util"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// Broadcast modes, which are how the broadcast is shown to users
+const (
+	// BroadcastModeIM sends the broadcast as an IM from the system screen name
+	BroadcastModeIM = "im"
+	// BroadcastModePopup sends the broadcast as a message of the day, which clients pop up
+	BroadcastModePopup = "popup"
+)
+
+// Broadcast is an announcement an operator sent to everyone signed on
+type Broadcast struct {
+	bun.BaseModel `bun:"table:broadcasts"`
+
+	ID     int    `bun:",pk,autoincrement"`
+	Sender string `bun:",notnull"` // the operator who sent it
+	Mode   string `bun:",notnull"`
+	Text   string `bun:",notnull"`
+
+	// Recipients is how many sessions were sent the broadcast, and Failed how many it couldn't
+	// be sent to. Queued is how many users who weren't signed on were left it as an offline
+	// message.
+	Recipients int `bun:",notnull,default:0"`
+	Failed     int `bun:",notnull,default:0"`
+	Queued     int `bun:",notnull,default:0"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// InsertBroadcast records the broadcast
+func InsertBroadcast(ctx context.Context, db bun.IDB, broadcast *Broadcast) error {
+	if broadcast.CreatedAt.IsZero() {
+		broadcast.CreatedAt = time.Now()
+	}
+	if _, err := db.NewInsert().Model(broadcast).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not record broadcast")
+	}
+	return nil
+}
+
+// QueueBroadcast stores the text as an IM from the screen name to every user but the bots,
+// deleted users and the normalized screen names in except, to be delivered when they next sign
+// on. Returns how many messages were stored.
+func QueueBroadcast(ctx context.Context, db bun.IDB, cookie uint64, from string, text string, except []string) (int, error) {
+	users := db.NewSelect().Model((*User)(nil)).
+		ColumnExpr("?, ?, normalized_screen_name, ?, true, 1, ?", cookie, util.NormalizeScreenName(from), text, time.Now()).
+		Where("NOT bot").
+		Where("deleted_at IS NULL").
+		Where("normalized_screen_name != ?", util.NormalizeScreenName(from))
+	if len(except) > 0 {
+		users = users.Where("normalized_screen_name NOT IN (?)", bun.In(except))
+	}
+
+	res, err := db.ExecContext(ctx, `INSERT INTO messages (cookie, "from", "to", contents, store_offline, channel, created_at) ?`, users)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not queue broadcast")
+	}
+	queued, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "could not queue broadcast")
+	}
+	return int(queued), nil
+}
+
+// RecentBroadcasts is the last limit broadcasts, newest first
+func RecentBroadcasts(ctx context.Context, db bun.IDB, limit int) ([]*Broadcast, error) {
+	broadcasts := make([]*Broadcast, 0)
+	if err := db.NewSelect().Model(&broadcasts).Order("id DESC").Limit(limit).Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch broadcasts")
+	}
+	return broadcasts, nil
+}
@@ -1,12 +1,244 @@
 package models
 
-import "github.com/uptrace/bun"
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// DefaultBuddyGroup holds buddies added without a group, like the ones old clients add
+const DefaultBuddyGroup = "Buddies"
 
 type Buddy struct {
 	bun.BaseModel `bun:"table:buddies"`
-	ID            int   `bun:",pk"`
-	SourceUIN     int64 `bun:",notnull"`
-	Source        *User `bun:"rel:has-one,join:source_uin=uin"`
-	WithUIN       int64 `bun:",notnull"`
-	Target        *User `bun:"rel:has-one,join:with_uin=uin"`
+	ID            int    `bun:",pk"`
+	SourceUIN     int64  `bun:",notnull"`
+	Source        *User  `bun:"rel:has-one,join:source_uin=uin"`
+	WithUIN       int64  `bun:",notnull"`
+	Target        *User  `bun:"rel:has-one,join:with_uin=uin"`
+	Group         string `bun:",notnull,default:'Buddies'"`
+	Position      int    `bun:",notnull,default:0"`
+	Alias         string `bun:",notnull,default:''"`
+	Note          string `bun:",notnull,default:''"`
+}
+
+// BuddyGroup is a group of a user's buddy list with its buddies in order. Each buddy has the
+// user they are as its Target.
+type BuddyGroup struct {
+	Name    string
+	Buddies []*Buddy
+}
+
+// AddBuddy adds withUIN to sourceUIN's buddy list in the default group. Returns false if they
+// were already buddies.
+func AddBuddy(ctx context.Context, db bun.IDB, sourceUIN, withUIN int64) (bool, error) {
+	return AddBuddyToGroup(ctx, db, sourceUIN, withUIN, DefaultBuddyGroup)
+}
+
+// AddBuddyToGroup adds withUIN to the end of a group of sourceUIN's buddy list. Returns false if
+// they were already buddies, leaving the buddy in the group they're in.
+func AddBuddyToGroup(ctx context.Context, db bun.IDB, sourceUIN, withUIN int64, group string) (bool, error) {
+	count, err := db.NewSelect().Model((*Buddy)(nil)).Where("source_uin = ?", sourceUIN).Where("with_uin = ?", withUIN).Count(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not count buddies")
+	}
+
+	// Already buddies
+	if count > 0 {
+		return false, nil
+	}
+
+	if group == "" {
+		group = DefaultBuddyGroup
+	}
+	position, err := nextBuddyPosition(ctx, db, sourceUIN, group)
+	if err != nil {
+		return false, err
+	}
+
+	rel := &Buddy{
+		SourceUIN: sourceUIN,
+		WithUIN:   withUIN,
+		Group:     group,
+		Position:  position,
+	}
+	if _, err := db.NewInsert().Model(rel).Exec(ctx); err != nil {
+		return false, errors.Wrap(err, "could not add buddy")
+	}
+
+	return true, nil
+}
+
+// nextBuddyPosition is the position after the last buddy in a group
+func nextBuddyPosition(ctx context.Context, db bun.IDB, sourceUIN int64, group string) (int, error) {
+	var max int
+	err := db.NewSelect().Model((*Buddy)(nil)).
+		ColumnExpr("COALESCE(MAX(position), -1)").
+		Where("source_uin = ?", sourceUIN).
+		Where(`"group" = ?`, group).
+		Scan(ctx, &max)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not find the end of the buddy group")
+	}
+	return max + 1, nil
+}
+
+// CountBuddies is how many buddies are on sourceUIN's buddy list
+func CountBuddies(ctx context.Context, db bun.IDB, sourceUIN int64) (int, error) {
+	count, err := db.NewSelect().Model((*Buddy)(nil)).Where("source_uin = ?", sourceUIN).Count(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count buddies")
+	}
+	return count, nil
+}
+
+// BuddiesOf returns the users on sourceUIN's buddy list, in the order they were added
+func BuddiesOf(ctx context.Context, db bun.IDB, sourceUIN int64) ([]*User, error) {
+	var buddies []*Buddy
+	if err := db.NewSelect().Model(&buddies).Where("source_uin = ?", sourceUIN).Relation("Target").Order("buddy.id ASC").Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch buddies")
+	}
+
+	users := make([]*User, 0, len(buddies))
+	for _, buddy := range buddies {
+		if buddy.Target != nil {
+			users = append(users, buddy.Target)
+		}
+	}
+	return users, nil
+}
+
+// BuddyGroupsOf returns sourceUIN's buddy list by group. Groups are in the order their first
+// buddy was added and buddies are in their position in the group.
+func BuddyGroupsOf(ctx context.Context, db bun.IDB, sourceUIN int64) ([]*BuddyGroup, error) {
+	var buddies []*Buddy
+	err := db.NewSelect().Model(&buddies).
+		Where("source_uin = ?", sourceUIN).
+		Relation("Target").
+		Order("buddy.position ASC", "buddy.id ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch buddies")
+	}
+
+	// The group a buddy was added to first comes first
+	firstID := make(map[string]int)
+	for _, buddy := range buddies {
+		if id, ok := firstID[buddy.Group]; !ok || buddy.ID < id {
+			firstID[buddy.Group] = buddy.ID
+		}
+	}
+
+	groups := make([]*BuddyGroup, 0, len(firstID))
+	byName := make(map[string]*BuddyGroup)
+	for _, buddy := range buddies {
+		if buddy.Target == nil {
+			continue
+		}
+		group, ok := byName[buddy.Group]
+		if !ok {
+			group = &BuddyGroup{Name: buddy.Group}
+			byName[buddy.Group] = group
+			groups = append(groups, group)
+		}
+		group.Buddies = append(group.Buddies, buddy)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return firstID[groups[i].Name] < firstID[groups[j].Name] })
+	return groups, nil
+}
+
+// MoveBuddy moves withUIN to the end of a group of sourceUIN's buddy list, if they're on it
+// and not in that group already
+func MoveBuddy(ctx context.Context, db bun.IDB, sourceUIN, withUIN int64, group string) error {
+	if group == "" {
+		group = DefaultBuddyGroup
+	}
+	position, err := nextBuddyPosition(ctx, db, sourceUIN, group)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.NewUpdate().Model((*Buddy)(nil)).
+		Set(`"group" = ?`, group).
+		Set("position = ?", position).
+		Where("source_uin = ?", sourceUIN).
+		Where("with_uin = ?", withUIN).
+		Where(`"group" != ?`, group).
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not move buddy")
+	}
+	return nil
+}
+
+// SetBuddyDetails sets the alias sourceUIN shows for withUIN and their note about them. Empty
+// strings clear them.
+func SetBuddyDetails(ctx context.Context, db bun.IDB, sourceUIN, withUIN int64, alias, note string) error {
+	_, err := db.NewUpdate().Model((*Buddy)(nil)).
+		Set("alias = ?", alias).
+		Set("note = ?", note).
+		Where("source_uin = ?", sourceUIN).
+		Where("with_uin = ?", withUIN).
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not set buddy alias and note")
+	}
+	return nil
+}
+
+// RenameBuddyGroup renames a group of sourceUIN's buddy list. Renaming it to a group that already
+// exists merges them, with the renamed group's buddies after the other's.
+func RenameBuddyGroup(ctx context.Context, db bun.IDB, sourceUIN int64, from, to string) error {
+	if from == to {
+		return nil
+	}
+	return runInTx(ctx, db, func(ctx context.Context, tx bun.IDB) error {
+		offset, err := nextBuddyPosition(ctx, tx, sourceUIN, to)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewUpdate().Model((*Buddy)(nil)).
+			Set(`"group" = ?`, to).
+			Set("position = position + ?", offset).
+			Where("source_uin = ?", sourceUIN).
+			Where(`"group" = ?`, from).
+			Exec(ctx)
+		if err != nil {
+			return errors.Wrap(err, "could not rename buddy group")
+		}
+		return nil
+	})
+}
+
+// DeleteBuddyGroup removes a group and every buddy in it from sourceUIN's buddy list, returning
+// how many buddies were removed
+func DeleteBuddyGroup(ctx context.Context, db bun.IDB, sourceUIN int64, group string) (int, error) {
+	var removed int
+	err := runInTx(ctx, db, func(ctx context.Context, tx bun.IDB) error {
+		res, err := tx.NewDelete().Model((*Buddy)(nil)).
+			Where("source_uin = ?", sourceUIN).
+			Where(`"group" = ?`, group).
+			Exec(ctx)
+		if err != nil {
+			return errors.Wrap(err, "could not delete buddy group")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "could not delete buddy group")
+		}
+		removed = int(n)
+		return nil
+	})
+	return removed, err
+}
+
+// RemoveBuddy removes withUIN from sourceUIN's buddy list
+func RemoveBuddy(ctx context.Context, db bun.IDB, sourceUIN, withUIN int64) error {
+	if _, err := db.NewDelete().Model((*Buddy)(nil)).Where("source_uin = ?", sourceUIN).Where("with_uin = ?", withUIN).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not remove buddy")
+	}
+	return nil
 }
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"context"
+	"crypto/md5"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// BuddyIcon is an uploaded buddy icon, stored once per unique image
+type BuddyIcon struct {
+	bun.BaseModel `bun:"table:buddy_icons"`
+
+	Hash      []byte    `bun:",pk"`
+	Data      []byte    `bun:",notnull"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// StoreBuddyIcon saves the icon if it hasn't been uploaded before and returns it
+func StoreBuddyIcon(ctx context.Context, db bun.IDB, data []byte) (*BuddyIcon, error) {
+	hash := md5.Sum(data)
+	icon := &BuddyIcon{
+		Hash:      hash[:],
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+
+	if _, err := db.NewInsert().Model(icon).On("CONFLICT (hash) DO NOTHING").Exec(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not store buddy icon")
+	}
+	return icon, nil
+}
+
+// BuddyIconByHash finds the icon with the MD5 hash. Returns nil if there isn't one.
+func BuddyIconByHash(ctx context.Context, db bun.IDB, hash []byte) (*BuddyIcon, error) {
+	var icons []*BuddyIcon
+	if err := db.NewSelect().Model(&icons).Where("hash = ?", hash).Limit(1).Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch buddy icon")
+	}
+	if len(icons) == 0 {
+		return nil, nil
+	}
+	return icons[0], nil
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// ChatRoom is a chat room created through chat navigation. Rooms are identified by their
+// exchange and cookie. Public rooms are listed in the room directory, and LastActiveAt is when
+// someone last joined or left the room.
+type ChatRoom struct {
+	bun.BaseModel `bun:"table:chat_rooms"`
+
+	ID           int    `bun:",pk,autoincrement"`
+	Exchange     uint16 `bun:",notnull"`
+	Cookie       string `bun:",unique,notnull"`
+	Instance     uint16 `bun:",notnull"`
+	Name         string `bun:",notnull"`
+	CreatorUIN   int64
+	CreatedAt    time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	LastActiveAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	Public       bool      `bun:",notnull,default:true"`
+}
+
+// ChatRoomByCookie finds the room in exchange with the cookie. Returns nil if there isn't one.
+func ChatRoomByCookie(ctx context.Context, db bun.IDB, exchange uint16, cookie string) (*ChatRoom, error) {
+	var rooms []*ChatRoom
+	err := db.NewSelect().Model(&rooms).
+		Where("exchange = ?", exchange).
+		Where("cookie = ?", cookie).
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch chat room")
+	}
+	if len(rooms) == 0 {
+		return nil, nil
+	}
+	return rooms[0], nil
+}
+
+// ChatRoomByName finds the room in exchange with the name, ignoring case. Returns nil if there
+// isn't one.
+func ChatRoomByName(ctx context.Context, db bun.IDB, exchange uint16, name string) (*ChatRoom, error) {
+	var rooms []*ChatRoom
+	err := db.NewSelect().Model(&rooms).
+		Where("exchange = ?", exchange).
+		Where("lower(name) = lower(?)", name).
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch chat room")
+	}
+	if len(rooms) == 0 {
+		return nil, nil
+	}
+	return rooms[0], nil
+}
+
+// PublicChatRooms is the public rooms in exchange, by name
+func PublicChatRooms(ctx context.Context, db bun.IDB, exchange uint16) ([]*ChatRoom, error) {
+	var rooms []*ChatRoom
+	err := db.NewSelect().Model(&rooms).
+		Where("exchange = ?", exchange).
+		Where("public = ?", true).
+		OrderExpr("lower(name)").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch public chat rooms")
+	}
+	return rooms, nil
+}
+
+// AllChatRooms is every room in every exchange, by exchange and name
+func AllChatRooms(ctx context.Context, db bun.IDB) ([]*ChatRoom, error) {
+	var rooms []*ChatRoom
+	err := db.NewSelect().Model(&rooms).
+		OrderExpr("exchange, lower(name)").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch chat rooms")
+	}
+	return rooms, nil
+}
+
+// IdleChatRooms is the rooms nobody joined or left since cutoff
+func IdleChatRooms(ctx context.Context, db bun.IDB, cutoff time.Time) ([]*ChatRoom, error) {
+	var rooms []*ChatRoom
+	err := db.NewSelect().Model(&rooms).
+		Where("last_active_at < ?", cutoff).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch idle chat rooms")
+	}
+	return rooms, nil
+}
+
+// Touch marks the room as active now
+func (r *ChatRoom) Touch(ctx context.Context, db bun.IDB) error {
+	r.LastActiveAt = time.Now()
+	_, err := db.NewUpdate().Model(r).Column("last_active_at").WherePK().Exec(ctx)
+	return errors.Wrap(err, "could not update chat room activity")
+}
+
+// Delete deletes the room
+func (r *ChatRoom) Delete(ctx context.Context, db bun.IDB) error {
+	_, err := db.NewDelete().Model(r).WherePK().Exec(ctx)
+	return errors.Wrap(err, "could not delete chat room")
+}
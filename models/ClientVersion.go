@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// ClientVersion counts the usage reports sent by one version of a client, so operators can see
+// which clients are in use
+type ClientVersion struct {
+	bun.BaseModel `bun:"table:client_versions"`
+
+	ID        int       `bun:",pk,autoincrement"`
+	Client    string    `bun:",notnull,unique:client_version"`
+	Version   string    `bun:",notnull,unique:client_version"`
+	Reports   int       `bun:",notnull,default:0"`
+	FirstSeen time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	LastSeen  time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// RecordClientVersion counts a usage report from the version of the client
+func RecordClientVersion(ctx context.Context, db bun.IDB, client, version string) error {
+	now := time.Now()
+	clientVersion := &ClientVersion{Client: client, Version: version, Reports: 1, FirstSeen: now, LastSeen: now}
+	_, err := db.NewInsert().Model(clientVersion).
+		On("CONFLICT (client, version) DO UPDATE").
+		Set("reports = client_version.reports + 1, last_seen = EXCLUDED.last_seen").
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not record client version")
+	}
+	return nil
+}
+
+// ClientVersions are the versions of clients that have sent usage reports, the most reported first
+func ClientVersions(ctx context.Context, db bun.IDB) ([]*ClientVersion, error) {
+	var versions []*ClientVersion
+	if err := db.NewSelect().Model(&versions).Order("reports DESC", "client", "version").Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch client versions")
+	}
+	return versions, nil
+}
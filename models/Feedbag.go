@@ -1,19 +1,127 @@
 package models
 
 import (
+	"context"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
+// Feedbag is a single item of a user's server-side buddy list
 type Feedbag struct {
 	bun.BaseModel `bun:"table:feedbag"`
 
-	ScreenName   string
-	GroupId      int
-	ItemId       int
-	ClassId      int
+	ID           int   `bun:",pk,autoincrement"`
+	UserUIN      int64 `bun:",notnull"`
+	GroupId      uint16
+	ItemId       uint16
+	ClassId      uint16
 	Name         string
 	Attributes   []byte
-	LastModified time.Time
+	LastModified time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// FeedbagRevision is the version of a user's SSI list. Every change to the list bumps the
+// revision and moves LastModified on by at least a second, so a client's cached copy from before
+// a change never looks current, even though the wire only has the time to the second.
+type FeedbagRevision struct {
+	bun.BaseModel `bun:"table:feedbag_revisions"`
+
+	UserUIN      int64     `bun:",pk"`
+	Revision     int64     `bun:",notnull"`
+	LastModified time.Time `bun:",notnull"`
+}
+
+// BumpFeedbagRevision bumps the revision of the user's SSI list after a change to it, returning
+// the new one
+func BumpFeedbagRevision(ctx context.Context, db bun.IDB, uin int64) (*FeedbagRevision, error) {
+	rev := &FeedbagRevision{UserUIN: uin, Revision: 1, LastModified: time.Now().Truncate(time.Second)}
+	_, err := db.NewInsert().Model(rev).
+		On("CONFLICT (user_uin) DO UPDATE").
+		Set("revision = feedbag_revision.revision + 1").
+		Set("last_modified = GREATEST(EXCLUDED.last_modified, feedbag_revision.last_modified + interval '1 second')").
+		Returning("*").
+		Exec(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not bump feedbag revision")
+	}
+	return rev, nil
+}
+
+// FeedbagRevisionFor is the revision of the user's SSI list, nil if it has never changed
+func FeedbagRevisionFor(ctx context.Context, db bun.IDB, uin int64) (*FeedbagRevision, error) {
+	var revs []*FeedbagRevision
+	if err := db.NewSelect().Model(&revs).Where("user_uin = ?", uin).Limit(1).Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch feedbag revision")
+	}
+	if len(revs) == 0 {
+		return nil, nil
+	}
+	return revs[0], nil
+}
+
+// FeedbagForUser returns all of the user's SSI items, ordered the way they were added
+func FeedbagForUser(ctx context.Context, db bun.IDB, uin int64) ([]*Feedbag, error) {
+	var items []*Feedbag
+	if err := db.NewSelect().Model(&items).Where("user_uin = ?", uin).Order("id ASC").Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch feedbag")
+	}
+	return items, nil
+}
+
+// FeedbagItem finds a single SSI item by its group and item ID. Returns nil if there isn't one.
+func FeedbagItem(ctx context.Context, db bun.IDB, uin int64, groupId, itemId uint16) (*Feedbag, error) {
+	var items []*Feedbag
+	err := db.NewSelect().Model(&items).
+		Where("user_uin = ?", uin).
+		Where("group_id = ?", groupId).
+		Where("item_id = ?", itemId).
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch feedbag item")
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return items[0], nil
+}
+
+// FeedbagLastModified is the time of the most recent change to the user's SSI items
+func FeedbagLastModified(items []*Feedbag) time.Time {
+	var last time.Time
+	for _, item := range items {
+		if item.LastModified.After(last) {
+			last = item.LastModified
+		}
+	}
+	return last
+}
+
+// FeedbagItemsByClass returns the user's SSI items of a class, like their permit or deny list
+func FeedbagItemsByClass(ctx context.Context, db bun.IDB, uin int64, classId uint16) ([]*Feedbag, error) {
+	var items []*Feedbag
+	err := db.NewSelect().Model(&items).
+		Where("user_uin = ?", uin).
+		Where("class_id = ?", classId).
+		Order("id ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch feedbag items")
+	}
+	return items, nil
+}
+
+// NextFeedbagItemId is an item ID the user isn't using yet
+func NextFeedbagItemId(ctx context.Context, db bun.IDB, uin int64) (uint16, error) {
+	var max int
+	err := db.NewSelect().Model((*Feedbag)(nil)).
+		ColumnExpr("COALESCE(MAX(item_id), 0)").
+		Where("user_uin = ?", uin).
+		Scan(ctx, &max)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not find a free feedbag item id")
+	}
+	return uint16(max + 1), nil
 }
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// Invitation is an email a user asked the server to send a friend, inviting them to sign up
+type Invitation struct {
+	bun.BaseModel `bun:"table:invitations"`
+
+	ID         int       `bun:",pk,autoincrement"`
+	InviterUIN int64     `bun:",notnull"`
+	Email      string    `bun:",notnull"`
+	Message    string    `bun:",notnull"`
+	CreatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// CreateInvitation records that the user invited the email
+func CreateInvitation(ctx context.Context, db bun.IDB, inviter *User, email, message string) (*Invitation, error) {
+	invitation := &Invitation{InviterUIN: inviter.UIN, Email: email, Message: message, CreatedAt: time.Now()}
+	if _, err := db.NewInsert().Model(invitation).Exec(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not create invitation")
+	}
+	return invitation, nil
+}
+
+// InvitationsSince counts the invitations the user has sent since the time
+func InvitationsSince(ctx context.Context, db bun.IDB, uin int64, since time.Time) (int, error) {
+	count, err := db.NewSelect().Model((*Invitation)(nil)).
+		Where("inviter_uin = ?", uin).
+		Where("created_at > ?", since).
+		Count(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count invitations")
+	}
+	return count, nil
+}
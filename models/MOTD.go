@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// MOTD types, which clients use to decide how to show the message
+const (
+	MOTDTypeMandatoryUpgrade = 0x0001
+	MOTDTypeAdvisableUpgrade = 0x0002
+	MOTDTypeAnnouncement     = 0x0003
+	MOTDTypeNone             = 0x0004 // a standard notice, sent without text when there's no MOTD
+	MOTDTypeNews             = 0x0006
+)
+
+// motdID is the only row of the motds table
+const motdID = 1
+
+// MOTD is the message of the day clients are sent when they sign on. There is at most one.
+type MOTD struct {
+	bun.BaseModel `bun:"table:motds"`
+
+	ID        int       `bun:",pk"`
+	Type      uint16    `bun:",notnull"`
+	Text      string    `bun:",notnull"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// CurrentMOTD is the message of the day. Returns nil if there isn't one.
+func CurrentMOTD(ctx context.Context, db bun.IDB) (*MOTD, error) {
+	var motds []*MOTD
+	if err := db.NewSelect().Model(&motds).Where("id = ?", motdID).Limit(1).Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch MOTD")
+	}
+	if len(motds) == 0 {
+		return nil, nil
+	}
+	return motds[0], nil
+}
+
+// SetMOTD replaces the message of the day. Clients that sign on afterwards get the new one.
+func SetMOTD(ctx context.Context, db bun.IDB, motdType uint16, text string) error {
+	motd := &MOTD{ID: motdID, Type: motdType, Text: text, UpdatedAt: time.Now()}
+	_, err := db.NewInsert().Model(motd).
+		On("CONFLICT (id) DO UPDATE").
+		Set("type = EXCLUDED.type, text = EXCLUDED.text, updated_at = EXCLUDED.updated_at").
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not set MOTD")
+	}
+	return nil
+}
+
+// ClearMOTD removes the message of the day
+func ClearMOTD(ctx context.Context, db bun.IDB) error {
+	if _, err := db.NewDelete().Model((*MOTD)(nil)).Where("id = ?", motdID).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not clear MOTD")
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"aim-oscar/util"
 	"context"
 	"fmt"
 	"time"
@@ -12,23 +13,43 @@ import (
 type Message struct {
 	bun.BaseModel `bun:"table:messages"`
 	ID            int    `bun:",pk"`
-	Cookie        uint64 `bun:",notnull"`
-	From          string
-	To            string
+	Cookie        uint64 `bun:",notnull,type:numeric(20)"` // bigint can't hold cookies >= 2^63
+	From          string // normalized screen name of the sender
+	To            string // normalized screen name of the recipient
 	Contents      string
 	StoreOffline  bool
 	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	DeliveredAt   time.Time `bun:",nullzero"`
+
+	// Channel is the ICBM channel the message was sent on: 1 for IMs, or 4 for old ICQ
+	// messages like URLs and authorization requests, which have an ICQType
+	Channel uint16 `bun:",notnull,default:1"`
+	ICQType uint8  `bun:"icq_type,notnull,default:0"`
+
+	// Queued is set on messages that are being delivered from the offline queue
+	Queued bool `bun:"-"`
+
+	// Attempts is how many times sending the message to the recipient's session has failed
+	Attempts int `bun:"-"`
+
+	// AutoResponse is set on automatic replies, like away messages, which clients show
+	// differently. Stored messages lose it.
+	AutoResponse bool `bun:"-"`
 }
 
 func InsertMessage(ctx context.Context, db *bun.DB, cookie uint64, from string, to string, contents string) (*Message, error) {
-	msg := &Message{
-		Cookie:       cookie,
-		From:         from,
-		To:           to,
-		Contents:     contents,
-		StoreOffline: true,
-	}
+	return insertMessage(ctx, db, &Message{Cookie: cookie, From: from, To: to, Contents: contents, Channel: 1})
+}
+
+// InsertICQMessage stores an old ICQ message (channel 4) of the ICQ message type
+func InsertICQMessage(ctx context.Context, db *bun.DB, cookie uint64, from string, to string, icqType uint8, contents string) (*Message, error) {
+	return insertMessage(ctx, db, &Message{Cookie: cookie, From: from, To: to, Contents: contents, Channel: 4, ICQType: icqType})
+}
+
+func insertMessage(ctx context.Context, db *bun.DB, msg *Message) (*Message, error) {
+	msg.From = util.NormalizeScreenName(msg.From)
+	msg.To = util.NormalizeScreenName(msg.To)
+	msg.StoreOffline = true
 	if _, err := db.NewInsert().Model(msg).Exec(ctx, msg); err != nil {
 		return nil, errors.Wrap(err, "could not update user")
 	}
@@ -40,13 +61,246 @@ func (m *Message) String() string {
 	return fmt.Sprintf("<Message from=%s to=%s content=\"%s\">", m.From, m.To, m.Contents)
 }
 
+// ClaimDelivery marks a stored message as delivered if nobody else has yet. It returns false
+// if the message was already claimed, e.g. when the recipient signed on while the message
+// was being sent and the offline queue picked it up first.
+func (m *Message) ClaimDelivery(ctx context.Context, db *bun.DB) (bool, error) {
+	now := time.Now()
+	res, err := db.NewUpdate().Model(m).Set("delivered_at = ?", now).WherePK().Where("delivered_at IS NULL").Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not claim message delivery")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "could not claim message delivery")
+	}
+
+	if n == 0 {
+		return false, nil
+	}
+
+	m.DeliveredAt = now
+	return true, nil
+}
+
+// ReleaseDelivery undoes ClaimDelivery so that the message is delivered the next time the
+// recipient signs on
+func (m *Message) ReleaseDelivery(ctx context.Context, db *bun.DB) error {
+	if _, err := db.NewUpdate().Model(m).Set("delivered_at = NULL").WherePK().Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not release message delivery")
+	}
+
+	m.DeliveredAt = time.Time{}
+	return nil
+}
+
 func (m *Message) MarkDelivered(ctx context.Context, db *bun.DB) error {
 	// Once messages are delivered, clear their contents
-	m.DeliveredAt = time.Now()
+	if m.DeliveredAt.IsZero() {
+		m.DeliveredAt = time.Now()
+	}
 	m.Contents = "####"
-	if _, err := db.NewUpdate().Model(m).Where("cookie = ?", m.Cookie).Exec(ctx); err != nil {
+	if _, err := db.NewUpdate().Model(m).Column("delivered_at", "contents").WherePK().Exec(ctx); err != nil {
 		return errors.Wrap(err, "could not mark message as updated")
 	}
 
 	return nil
 }
+
+// MessagesBetween is a page of the messages the two users sent each other before the time,
+// newest first. Pass the CreatedAt of the last message of a page to get the next one, or the
+// zero time for the first page.
+func MessagesBetween(ctx context.Context, db *bun.DB, userA, userB string, before time.Time, limit int) ([]*Message, error) {
+	userA, userB = util.NormalizeScreenName(userA), util.NormalizeScreenName(userB)
+
+	var messages []*Message
+	q := db.NewSelect().Model(&messages).
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.
+				WhereGroup(" OR ", func(q *bun.SelectQuery) *bun.SelectQuery {
+					return q.Where("\"from\" = ?", userA).Where("\"to\" = ?", userB)
+				}).
+				WhereGroup(" OR ", func(q *bun.SelectQuery) *bun.SelectQuery {
+					return q.Where("\"from\" = ?", userB).Where("\"to\" = ?", userA)
+				})
+		}).
+		Order("created_at DESC", "id DESC").
+		Limit(limit)
+
+	if !before.IsZero() {
+		q = q.Where("created_at < ?", before)
+	}
+
+	if err := q.Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch messages")
+	}
+	return messages, nil
+}
+
+// UndeliveredFor is the messages stored for the user while they were offline, oldest first.
+// A limit of 0 returns all of them.
+func UndeliveredFor(ctx context.Context, db *bun.DB, to string, limit int) ([]*Message, error) {
+	var messages []*Message
+	q := undelivered(db.NewSelect().Model(&messages), to).Order("created_at ASC", "id ASC")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	if err := q.Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch undelivered messages")
+	}
+	return messages, nil
+}
+
+// CountUndelivered is how many messages are stored for the user
+func CountUndelivered(ctx context.Context, db *bun.DB, to string) (int, error) {
+	n, err := undelivered(db.NewSelect().Model((*Message)(nil)), to).Count(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count undelivered messages")
+	}
+	return n, nil
+}
+
+// CountAllUndelivered is how many messages are stored for users who haven't signed on to get
+// them yet
+func CountAllUndelivered(ctx context.Context, db *bun.DB) (int, error) {
+	n, err := db.NewSelect().Model((*Message)(nil)).
+		Where("store_offline = ?", true).
+		Where("delivered_at IS NULL").
+		Count(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count undelivered messages")
+	}
+	return n, nil
+}
+
+// ClearUndelivered marks every message stored for the user as delivered and clears their
+// contents, for clients that fetch them all and then tell the server to forget them
+func ClearUndelivered(ctx context.Context, db *bun.DB, to string) error {
+	_, err := db.NewUpdate().Model((*Message)(nil)).
+		Set("delivered_at = current_timestamp").
+		Set("contents = ?", "####").
+		Where("\"to\" = ?", util.NormalizeScreenName(to)).
+		Where("store_offline = ?", true).
+		Where("delivered_at IS NULL").
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not clear undelivered messages")
+	}
+	return nil
+}
+
+// DeleteExpiredMessages deletes the messages stored for users who didn't sign on to get them
+// before cutoff. Delivered messages are kept.
+func DeleteExpiredMessages(ctx context.Context, db *bun.DB, cutoff time.Time) (int64, error) {
+	res, err := db.NewDelete().Model((*Message)(nil)).
+		Where("store_offline = ?", true).
+		Where("delivered_at IS NULL").
+		Where("created_at < ?", cutoff).
+		Exec(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not delete expired messages")
+	}
+	return res.RowsAffected()
+}
+
+// deliveredBefore is the delivered messages sent before cutoff
+func deliveredBefore(q *bun.SelectQuery, cutoff time.Time) *bun.SelectQuery {
+	return q.Where("delivered_at IS NOT NULL").Where("created_at < ?", cutoff)
+}
+
+// beyondConversationLimit is the delivered messages that aren't among the newest keep messages
+// two users sent each other. Undelivered messages count towards keep but are never included.
+func beyondConversationLimit(db bun.IDB, q *bun.SelectQuery, keep int) *bun.SelectQuery {
+	ranked := db.NewSelect().Model((*Message)(nil)).
+		Column("id", "delivered_at").
+		ColumnExpr(`row_number() OVER (PARTITION BY LEAST("from", "to"), GREATEST("from", "to") ORDER BY created_at DESC, id DESC) AS n`)
+	return q.TableExpr("(?) AS ranked", ranked).
+		Where("n > ?", keep).
+		Where("delivered_at IS NOT NULL")
+}
+
+// deleteBatch deletes up to batchSize of the messages with the IDs ids selects
+func deleteBatch(ctx context.Context, db bun.IDB, ids *bun.SelectQuery, batchSize int) (int64, error) {
+	res, err := db.NewDelete().Model((*Message)(nil)).
+		Where("id IN (?)", ids.Column("id").Limit(batchSize)).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteDeliveredBefore deletes up to batchSize delivered messages sent before cutoff, and
+// returns how many it deleted. Messages still waiting for their recipient are kept.
+func DeleteDeliveredBefore(ctx context.Context, db bun.IDB, cutoff time.Time, batchSize int) (int64, error) {
+	deleted, err := deleteBatch(ctx, db, deliveredBefore(db.NewSelect().Model((*Message)(nil)), cutoff), batchSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not delete delivered messages")
+	}
+	return deleted, nil
+}
+
+// CountDeliveredBefore is how many messages DeleteDeliveredBefore would delete, however many
+// batches it took
+func CountDeliveredBefore(ctx context.Context, db bun.IDB, cutoff time.Time) (int, error) {
+	n, err := deliveredBefore(db.NewSelect().Model((*Message)(nil)), cutoff).Count(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count delivered messages")
+	}
+	return n, nil
+}
+
+// DeleteBeyondConversationLimit deletes up to batchSize delivered messages from conversations
+// with more than keep messages, oldest first, and returns how many it deleted. Messages still
+// waiting for their recipient are kept.
+func DeleteBeyondConversationLimit(ctx context.Context, db bun.IDB, keep int, batchSize int) (int64, error) {
+	deleted, err := deleteBatch(ctx, db, beyondConversationLimit(db, db.NewSelect(), keep), batchSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not delete messages beyond conversation limit")
+	}
+	return deleted, nil
+}
+
+// CountBeyondConversationLimit is how many messages DeleteBeyondConversationLimit would delete,
+// however many batches it took
+func CountBeyondConversationLimit(ctx context.Context, db bun.IDB, keep int) (int, error) {
+	n, err := beyondConversationLimit(db, db.NewSelect(), keep).Count(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count messages beyond conversation limit")
+	}
+	return n, nil
+}
+
+// MessageCounts sums up the messages the server has handled
+type MessageCounts struct {
+	Total        int
+	Delivered    int
+	Undelivered  int        // stored for recipients who were offline
+	OldestStored *time.Time // when the oldest undelivered message was sent
+	SentLastDay  int
+}
+
+// MessageStats counts the messages the server has handled
+func MessageStats(ctx context.Context, db *bun.DB) (*MessageCounts, error) {
+	counts := &MessageCounts{}
+	err := db.NewSelect().Model((*Message)(nil)).
+		ColumnExpr("count(*) AS total").
+		ColumnExpr("count(delivered_at) AS delivered").
+		ColumnExpr("count(*) FILTER (WHERE store_offline AND delivered_at IS NULL) AS undelivered").
+		ColumnExpr("min(created_at) FILTER (WHERE store_offline AND delivered_at IS NULL) AS oldest_stored").
+		ColumnExpr("count(*) FILTER (WHERE created_at > now() - interval '1 day') AS sent_last_day").
+		Scan(ctx, &counts.Total, &counts.Delivered, &counts.Undelivered, &counts.OldestStored, &counts.SentLastDay)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not count messages")
+	}
+	return counts, nil
+}
+
+func undelivered(q *bun.SelectQuery, to string) *bun.SelectQuery {
+	return q.
+		Where("\"to\" = ?", util.NormalizeScreenName(to)).
+		Where("store_offline = ?", true).
+		Where("delivered_at IS NULL")
+}
@@ -0,0 +1,198 @@
+//go:build integration
+
+package models_test
+
+import (
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+func testDB(t *testing.T) *bun.DB {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+
+	d, err := db.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	if _, err := d.NewCreateTable().Model((*models.Message)(nil)).IfNotExists().Exec(context.Background()); err != nil {
+		t.Fatalf("could not create messages table: %s", err)
+	}
+
+	return d
+}
+
+// The recipient signing on while a message is being delivered means the offline queue and
+// the live delivery both try to send the same message. Only one of them may win.
+func TestClaimDeliveryRace(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	msg, err := models.InsertMessage(ctx, d, 1, "alice", "bob", "hello")
+	if err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+	defer d.NewDelete().Model(msg).WherePK().Exec(ctx)
+
+	var wg sync.WaitGroup
+	var claims int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := &models.Message{ID: msg.ID}
+			claimed, err := m.ClaimDelivery(ctx, d)
+			if err != nil {
+				t.Errorf("could not claim message: %s", err)
+			}
+			if claimed {
+				atomic.AddInt32(&claims, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if claims != 1 {
+		t.Errorf("expected exactly one delivery claim, got %d", claims)
+	}
+
+	// A failed delivery puts the message back in the queue
+	if err := msg.ReleaseDelivery(ctx, d); err != nil {
+		t.Fatalf("could not release message: %s", err)
+	}
+	claimed, err := msg.ClaimDelivery(ctx, d)
+	if err != nil || !claimed {
+		t.Errorf("expected released message to be claimable again, got %v %v", claimed, err)
+	}
+}
+
+func uniqueScreenName(prefix string) string {
+	return fmt.Sprintf("%s%d", prefix, time.Now().UnixNano()%1000000)
+}
+
+func TestMessagesBetweenPagination(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	alice, bob := uniqueScreenName("alice"), uniqueScreenName("bob")
+
+	// Five messages back and forth a second apart, and one to somebody else
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var sent []*models.Message
+	for i := 0; i < 5; i++ {
+		from, to := alice, bob
+		if i%2 == 1 {
+			from, to = bob, alice
+		}
+		msg := &models.Message{Cookie: uint64(i), From: from, To: to, Contents: fmt.Sprint(i), CreatedAt: start.Add(time.Duration(i) * time.Second)}
+		if _, err := d.NewInsert().Model(msg).Exec(ctx); err != nil {
+			t.Fatalf("could not insert message: %s", err)
+		}
+		sent = append(sent, msg)
+	}
+	other := &models.Message{From: alice, To: uniqueScreenName("carol"), Contents: "other", CreatedAt: start}
+	if _, err := d.NewInsert().Model(other).Exec(ctx); err != nil {
+		t.Fatalf("could not insert message: %s", err)
+	}
+	defer d.NewDelete().Model((*models.Message)(nil)).Where("\"from\" IN (?, ?)", alice, bob).Exec(ctx)
+
+	contents := func(messages []*models.Message) []string {
+		c := make([]string, len(messages))
+		for i, m := range messages {
+			c[i] = m.Contents
+		}
+		return c
+	}
+
+	tt := map[string]struct {
+		before time.Time
+		limit  int
+		expect []string
+	}{
+		"first page":                  {time.Time{}, 2, []string{"4", "3"}},
+		"second page":                 {sent[3].CreatedAt, 2, []string{"2", "1"}},
+		"last page is short":          {sent[1].CreatedAt, 2, []string{"0"}},
+		"nothing before the first":    {sent[0].CreatedAt, 2, []string{}},
+		"limit larger than the total": {time.Time{}, 10, []string{"4", "3", "2", "1", "0"}},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			for _, order := range [][]string{{alice, bob}, {bob, alice}} {
+				messages, err := models.MessagesBetween(ctx, d, order[0], order[1], tc.before, tc.limit)
+				if err != nil {
+					t.Fatalf("could not fetch messages: %s", err)
+				}
+				if got := contents(messages); fmt.Sprint(got) != fmt.Sprint(tc.expect) {
+					t.Errorf("expected %v, got %v", tc.expect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUndeliveredMessages(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	bob := uniqueScreenName("bob")
+	defer d.NewDelete().Model((*models.Message)(nil)).Where("\"to\" = ?", bob).Exec(ctx)
+
+	// Messages are stored between normalized screen names, however the sender formats them
+	var stored []*models.Message
+	for i := 0; i < 3; i++ {
+		msg, err := models.InsertMessage(ctx, d, uint64(i), "Alice", " "+strings.ToUpper(bob), fmt.Sprint(i))
+		if err != nil {
+			t.Fatalf("could not insert message: %s", err)
+		}
+		stored = append(stored, msg)
+	}
+
+	// A zero DeliveredAt is stored as NULL, so a fresh message counts as undelivered
+	n, err := models.CountUndelivered(ctx, d, bob)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 undelivered messages, got %d %v", n, err)
+	}
+
+	if err := stored[0].MarkDelivered(ctx, d); err != nil {
+		t.Fatalf("could not mark message delivered: %s", err)
+	}
+
+	messages, err := models.UndeliveredFor(ctx, d, bob, 1)
+	if err != nil {
+		t.Fatalf("could not fetch undelivered messages: %s", err)
+	}
+	if len(messages) != 1 || messages[0].ID != stored[1].ID {
+		t.Fatalf("expected the oldest undelivered message, got %v", messages)
+	}
+	if !messages[0].DeliveredAt.IsZero() {
+		t.Errorf("expected a NULL delivered_at to scan as the zero time, got %s", messages[0].DeliveredAt)
+	}
+
+	if messages, err = models.UndeliveredFor(ctx, d, bob, 0); err != nil || len(messages) != 2 {
+		t.Fatalf("expected every undelivered message without a limit, got %d %v", len(messages), err)
+	}
+
+	if err := models.ClearUndelivered(ctx, d, bob); err != nil {
+		t.Fatalf("could not clear undelivered messages: %s", err)
+	}
+	if n, err := models.CountUndelivered(ctx, d, bob); err != nil || n != 0 {
+		t.Errorf("expected no undelivered messages once cleared, got %d %v", n, err)
+	}
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// ServerStats is the server's running totals at a point in time. A row is saved every so often,
+// and the latest one is where the totals pick up from when the server restarts.
+type ServerStats struct {
+	bun.BaseModel `bun:"table:server_stats"`
+
+	ID         int       `bun:",pk,autoincrement"`
+	RecordedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	StartedAt  time.Time `bun:",nullzero,notnull"` // when the server that saved the row started
+
+	Sessions        int64 `bun:",notnull,default:0"` // signed on when the row was saved
+	PeakSessions    int64 `bun:",notnull,default:0"` // the most that have ever been signed on at once
+	Logins          int64 `bun:",notnull,default:0"`
+	MessagesRelayed int64 `bun:",notnull,default:0"`
+	MessagesStored  int64 `bun:",notnull,default:0"` // stored for users who were signed off
+	BytesIn         int64 `bun:",notnull,default:0"`
+	BytesOut        int64 `bun:",notnull,default:0"`
+}
+
+// InsertServerStats saves the totals
+func InsertServerStats(ctx context.Context, db bun.IDB, stats *ServerStats) error {
+	if _, err := db.NewInsert().Model(stats).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not save server stats")
+	}
+	return nil
+}
+
+// LatestServerStats is the last totals saved. Returns nil if none have been.
+func LatestServerStats(ctx context.Context, db bun.IDB) (*ServerStats, error) {
+	var stats []*ServerStats
+	if err := db.NewSelect().Model(&stats).Order("id DESC").Limit(1).Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch server stats")
+	}
+	if len(stats) == 0 {
+		return nil, nil
+	}
+	return stats[0], nil
+}
@@ -1,8 +1,11 @@
 package models
 
 import (
+	"aim-oscar/util"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"time"
 
 	"github.com/pkg/errors"
@@ -27,30 +30,21 @@ func (u UserStatus) String() string {
 		return "Free4Chat"
 	case UserStatusInvisible:
 		return "Invisible"
+	case UserStatusOffline:
+		return "Offline"
 	default:
 		return "Unknown"
 	}
 }
 
+// Connected is whether the user is signed on, even if buddies can't see them
 func (u UserStatus) Connected() bool {
-	switch u {
-	case UserStatusOnline:
-		return true
-	case UserStatusAway:
-		return false
-	case UserStatusDnd:
-		return false
-	case UserStatusNA:
-		return false
-	case UserStatusOccupied:
-		return true
-	case UserStatusFree4Chat:
-		return true
-	case UserStatusInvisible:
-		return true
-	default:
-		return false
-	}
+	return u != UserStatusOffline
+}
+
+// Visible is whether buddies see the user as signed on
+func (u UserStatus) Visible() bool {
+	return u.Connected() && u != UserStatusInvisible
 }
 
 const (
@@ -61,37 +55,143 @@ const (
 	UserStatusOccupied  = 0x10
 	UserStatusFree4Chat = 0x20
 	UserStatusInvisible = 0x100
+
+	// UserStatusOffline isn't an OSCAR status, it marks users without a connection and is never
+	// sent to clients
+	UserStatusOffline = -1
 )
 
 type User struct {
-	bun.BaseModel       `bun:"table:users"`
-	UIN                 int64  `bun:",pk,autoincrement"`
-	Email               string `bun:",unique"`
-	ScreenName          string `bun:",unique"`
-	Password            string
-	Cipher              string
-	CreatedAt           time.Time  `bun:",nullzero,notnull,default:current_timestamp"`
-	UpdatedAt           time.Time  `bun:",nullzero,notnull,default:current_timestamp"`
-	DeletedAt           *time.Time `bun:",nullzero"`
-	Status              UserStatus
-	Verified            bool `bun:",notnull,default:false"`
-	Profile             string
-	ProfileEncoding     string
-	AwayMessage         string
-	AwayMessageEncoding string
-	LastActivityAt      time.Time `bin:"-"`
-}
-
-func (user *User) SetAway(ctx context.Context, db *bun.DB) error {
-	user.Status = UserStatusAway
+	bun.BaseModel        `bun:"table:users"`
+	UIN                  int64  `bun:",pk,autoincrement"`
+	Email                string `bun:",unique"`
+	ScreenName           string `bun:",unique"`  // formatted the way the user likes it, which is what clients see
+	NormalizedScreenName string `bun:",notnull"` // ScreenName as util.NormalizeScreenName has it, which is how users are looked up
+	Password             string
+	Cipher               string
+	CreatedAt            time.Time  `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt            time.Time  `bun:",nullzero,notnull,default:current_timestamp"`
+	DeletedAt            *time.Time `bun:",nullzero"`
+	Status               UserStatus
+	Verified             bool `bun:",notnull,default:false"`
+	Unconfirmed          bool `bun:",notnull,default:false"` // email hasn't been confirmed since registering or changing it
+	Profile              string
+	ProfileEncoding      string
+	AwayMessage          string
+	AwayMessageEncoding  string
+	LastActivityAt       time.Time  `bin:"-"`
+	WarningLevel         uint16     `bun:",notnull,default:0"`
+	BuddyIconHash        []byte     // MD5 hash of the user's BuddyIcon, if they have one
+	Suspended            bool       `bun:",notnull,default:false"`
+	SuspendedUntil       *time.Time `bun:",nullzero"` // when a timed suspension ends, nil if it doesn't
+	SuspensionReason     string     `bun:",notnull,default:''"`
+	NoEmailLookup        bool       `bun:",notnull,default:false"` // others can't find the user by their email
+	Bot                  bool       `bun:",notnull,default:false"` // a virtual user the server runs, with no client
+}
+
+// MaxWarningLevel is a warning level of 99.9%
+const MaxWarningLevel = 999
+
+// SetOffline marks the user as signed off. Away messages only last as long as the session they
+// were set in.
+func (user *User) SetOffline(ctx context.Context, db *bun.DB) error {
+	user.Status = UserStatusOffline
 	user.Cipher = ""
-	if err := user.Update(ctx, db, "status", "cipher"); err != nil {
+	user.AwayMessage = ""
+	user.AwayMessageEncoding = ""
+	if err := user.Update(ctx, db, "status", "cipher", "away_message", "away_message_encoding"); err != nil {
 		return errors.Wrap(err, "could not set user as inactive")
 	}
 
 	return nil
 }
 
+// Warn raises the user's warning level by delta, up to MaxWarningLevel
+func (user *User) Warn(ctx context.Context, db *bun.DB, delta uint16) error {
+	_, err := db.NewUpdate().Model(user).
+		Set("warning_level = LEAST(?, warning_level + ?)", MaxWarningLevel, delta).
+		WherePK("uin").
+		Returning("warning_level").
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not warn user")
+	}
+	return nil
+}
+
+// IsSuspended is whether the user is suspended at now. Timed suspensions are over once their
+// end has passed.
+func (user *User) IsSuspended(now time.Time) bool {
+	return user.Suspended && (user.SuspendedUntil == nil || now.Before(*user.SuspendedUntil))
+}
+
+// Suspend keeps the user from logging in until they're unsuspended, or until until if it isn't
+// nil. Cookies they were given for BOS are thrown away.
+func (user *User) Suspend(ctx context.Context, db *bun.DB, until *time.Time, reason string) error {
+	user.Suspended = true
+	user.SuspendedUntil = until
+	user.SuspensionReason = reason
+	if err := user.Update(ctx, db, "suspended", "suspended_until", "suspension_reason"); err != nil {
+		return errors.Wrap(err, "could not suspend user")
+	}
+	return DeleteAuthCookies(ctx, db, user.UIN)
+}
+
+// Unsuspend lets a suspended user log in again
+func (user *User) Unsuspend(ctx context.Context, db *bun.DB) error {
+	user.Suspended = false
+	user.SuspendedUntil = nil
+	user.SuspensionReason = ""
+	if err := user.Update(ctx, db, "suspended", "suspended_until", "suspension_reason"); err != nil {
+		return errors.Wrap(err, "could not unsuspend user")
+	}
+	return nil
+}
+
+// DecayWarnings lowers every warning level by delta, down to 0, and returns the users whose
+// level went down. Users who haven't been warned aren't touched.
+func DecayWarnings(ctx context.Context, db *bun.DB, delta uint16) ([]*User, error) {
+	var users []*User
+	_, err := db.NewUpdate().Model(&users).
+		Set("warning_level = GREATEST(0, warning_level - ?)", delta).
+		Where("warning_level > 0").
+		Returning("*").
+		Exec(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decay warning levels")
+	}
+	return users, nil
+}
+
+// SetAllOffline marks every user who isn't offline as offline, for when no one can be signed
+// on, like at startup. It returns how many users were changed.
+func SetAllOffline(ctx context.Context, db *bun.DB) (int, error) {
+	res, err := db.NewUpdate().Model((*User)(nil)).
+		Set("status = ?", UserStatusOffline).
+		Set("cipher = ''").
+		Set("away_message = ''").
+		Set("away_message_encoding = ''").
+		Where("status != ?", UserStatusOffline).
+		Exec(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not set all users as offline")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count users set offline")
+	}
+	return int(n), nil
+}
+
+// SignedOnUsers returns the users whose status isn't offline.
+func SignedOnUsers(ctx context.Context, db *bun.DB) ([]*User, error) {
+	var users []*User
+	if err := db.NewSelect().Model(&users).Where("status != ?", UserStatusOffline).Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not find signed on users")
+	}
+	return users, nil
+}
+
 type userKey string
 
 func (s userKey) String() string {
@@ -104,9 +204,11 @@ var (
 
 func CreateUser(ctx context.Context, db *bun.DB, screen_name, password, email string) (*User, error) {
 	user := &User{
-		ScreenName: screen_name,
-		Password:   password,
-		Email:      email,
+		ScreenName:           screen_name,
+		NormalizedScreenName: util.NormalizeScreenName(screen_name),
+		Password:             password,
+		Email:                email,
+		Status:               UserStatusOffline,
 	}
 
 	_, err := db.NewInsert().Model(user).Exec(ctx, user)
@@ -117,9 +219,41 @@ func CreateUser(ctx context.Context, db *bun.DB, screen_name, password, email st
 	return user, nil
 }
 
-func UserByScreenName(ctx context.Context, db *bun.DB, screen_name string) (*User, error) {
+// BotUser is the bot with the screen name, which is registered the first time it's asked for.
+// Bots get a random password, so nobody can sign on as one. A screen name that already belongs
+// to someone who isn't a bot is an error.
+func BotUser(ctx context.Context, db *bun.DB, screenName string) (*User, error) {
+	user, err := UserByScreenName(ctx, db, screenName)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		if !user.Bot {
+			return nil, errors.Errorf("%s is not a bot", screenName)
+		}
+		return user, nil
+	}
+
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return nil, errors.Wrap(err, "could not make bot password")
+	}
+	normalized := util.NormalizeScreenName(screenName)
+	user, err = CreateUser(ctx, db, screenName, hex.EncodeToString(password), normalized+"@bot.invalid")
+	if err != nil {
+		return nil, err
+	}
+	user.Bot = true
+	if err := user.Update(ctx, db, "bot"); err != nil {
+		return nil, errors.Wrap(err, "could not mark user as a bot")
+	}
+	return user, nil
+}
+
+// UserByScreenName looks up the user ignoring case and spaces in the screen name
+func UserByScreenName(ctx context.Context, db bun.IDB, screen_name string) (*User, error) {
 	user := new(User)
-	if err := db.NewSelect().Model(user).Where("screen_name = ?", screen_name).Scan(ctx, user); err != nil {
+	if err := db.NewSelect().Model(user).Where("normalized_screen_name = ?", util.NormalizeScreenName(screen_name)).Scan(ctx, user); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -128,6 +262,176 @@ func UserByScreenName(ctx context.Context, db *bun.DB, screen_name string) (*Use
 	return user, nil
 }
 
+// ScreenNameTaken checks whether a user already has the screen name, ignoring case and spaces
+// like AIM does
+func ScreenNameTaken(ctx context.Context, db *bun.DB, screen_name string) (bool, error) {
+	exists, err := db.NewSelect().Model((*User)(nil)).Where("normalized_screen_name = ?", util.NormalizeScreenName(screen_name)).Exists(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not check screen name")
+	}
+	return exists, nil
+}
+
+// FormatScreenName changes how the user's screen name is formatted. The formatted screen name
+// has to normalize to the same one, since it can't be used to rename the user.
+func (user *User) FormatScreenName(ctx context.Context, db *bun.DB, formatted string) error {
+	if util.NormalizeScreenName(formatted) != user.NormalizedScreenName {
+		return errors.Errorf("%q is not a formatting of %q", formatted, user.ScreenName)
+	}
+
+	user.ScreenName = formatted
+	if err := user.Update(ctx, db, "screen_name"); err != nil {
+		return errors.Wrap(err, "could not format screen name")
+	}
+	return nil
+}
+
+// ListUsers returns every user, deleted ones included, in the order they were created
+func ListUsers(ctx context.Context, db *bun.DB) ([]*User, error) {
+	var users []*User
+	if err := db.NewSelect().Model(&users).Order("uin ASC").Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not list users")
+	}
+	return users, nil
+}
+
+// SetPassword changes the user's password. Cookies they were given for BOS are thrown away.
+func (user *User) SetPassword(ctx context.Context, db *bun.DB, password string) error {
+	user.Password = password
+	if err := user.Update(ctx, db, "password"); err != nil {
+		return errors.Wrap(err, "could not set password")
+	}
+	return DeleteAuthCookies(ctx, db, user.UIN)
+}
+
+// Delete marks the user as deleted so they can't log in. Their screen name stays taken.
+func (user *User) Delete(ctx context.Context, db *bun.DB) error {
+	now := time.Now()
+	user.DeletedAt = &now
+	if err := user.Update(ctx, db, "deleted_at"); err != nil {
+		return errors.Wrap(err, "could not delete user")
+	}
+	return DeleteAuthCookies(ctx, db, user.UIN)
+}
+
+// DeletedScreenName replaces a deleted user's screen name in the messages others keep. It can't
+// be anyone's screen name.
+const DeletedScreenName = "[deleted]"
+
+// DeleteAccount removes the user and everything about them in one transaction: their buddy
+// lists and the places they're on others', their feedbag and the items naming them on others',
+// cookies, email verification and invitations, messages still waiting to be delivered to or
+// from them, and their buddy icon if no one else uses it. Delivered messages stay in the history
+// of the users they talked to, with DeletedScreenName in place of theirs. Chat rooms they created
+// stay open for everyone else, with no creator.
+func DeleteAccount(ctx context.Context, db *bun.DB, user *User) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := deleteFeedbagItemsNaming(ctx, tx, user); err != nil {
+			return err
+		}
+
+		deletes := []*bun.DeleteQuery{
+			tx.NewDelete().Model((*Buddy)(nil)).Where("source_uin = ? OR with_uin = ?", user.UIN, user.UIN),
+			tx.NewDelete().Model((*Feedbag)(nil)).Where("user_uin = ?", user.UIN),
+			tx.NewDelete().Model((*FeedbagRevision)(nil)).Where("user_uin = ?", user.UIN),
+			tx.NewDelete().Model((*AuthCookie)(nil)).Where("uin = ?", user.UIN),
+			tx.NewDelete().Model((*EmailVerification)(nil)).Where("user_uin = ?", user.UIN),
+			tx.NewDelete().Model((*Invitation)(nil)).Where("inviter_uin = ?", user.UIN),
+			tx.NewDelete().Model((*Message)(nil)).
+				WhereGroup(" AND ", func(q *bun.DeleteQuery) *bun.DeleteQuery {
+					return q.Where("\"to\" = ?", user.NormalizedScreenName).WhereOr("\"from\" = ?", user.NormalizedScreenName)
+				}).
+				WhereGroup(" AND ", func(q *bun.DeleteQuery) *bun.DeleteQuery {
+					return q.Where("delivered_at IS NULL").WhereOr("\"to\" = \"from\"")
+				}),
+			tx.NewDelete().Model((*User)(nil)).Where("uin = ?", user.UIN),
+		}
+		if len(user.BuddyIconHash) > 0 {
+			deletes = append(deletes, tx.NewDelete().Model((*BuddyIcon)(nil)).
+				Where("hash = ?", user.BuddyIconHash).
+				Where("NOT EXISTS (SELECT 1 FROM users WHERE buddy_icon_hash = ?)", user.BuddyIconHash))
+		}
+		for _, q := range deletes {
+			if _, err := q.Exec(ctx); err != nil {
+				return errors.Wrap(err, "could not delete account")
+			}
+		}
+
+		updates := []*bun.UpdateQuery{
+			tx.NewUpdate().Model((*Message)(nil)).Set("\"from\" = ?", DeletedScreenName).Where("\"from\" = ?", user.NormalizedScreenName),
+			tx.NewUpdate().Model((*Message)(nil)).Set("\"to\" = ?", DeletedScreenName).Where("\"to\" = ?", user.NormalizedScreenName),
+			tx.NewUpdate().Model((*ChatRoom)(nil)).Set("creator_uin = 0").Where("creator_uin = ?", user.UIN),
+		}
+		for _, q := range updates {
+			if _, err := q.Exec(ctx); err != nil {
+				return errors.Wrap(err, "could not delete account")
+			}
+		}
+		return nil
+	})
+}
+
+// feedbagNamedClasses are the SSI item classes named after a screen name: buddies (0x00), permit
+// (0x02) and deny (0x03) list entries, and ignore list entries (0x0e)
+var feedbagNamedClasses = []uint16{0x00, 0x02, 0x03, 0x0e}
+
+// deleteFeedbagItemsNaming takes the user off everyone else's SSI list, however they spaced and
+// capitalized the screen name, and bumps the revision of each list that changed so clients fetch
+// it again
+func deleteFeedbagItemsNaming(ctx context.Context, db bun.IDB, user *User) error {
+	var items []*Feedbag
+	err := db.NewSelect().Model(&items).
+		Where("user_uin <> ?", user.UIN).
+		Where("class_id IN (?)", bun.In(feedbagNamedClasses)).
+		Where("lower(replace(name, ' ', '')) = ?", user.NormalizedScreenName).
+		Scan(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not fetch feedbag items naming user")
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	if _, err := db.NewDelete().Model(&items).WherePK().Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not delete feedbag items naming user")
+	}
+	bumped := make(map[int64]bool)
+	for _, item := range items {
+		if bumped[item.UserUIN] {
+			continue
+		}
+		bumped[item.UserUIN] = true
+		if _, err := BumpFeedbagRevision(ctx, db, item.UserUIN); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UsersByEmail finds the users others can look up by email, ignoring case
+func UsersByEmail(ctx context.Context, db *bun.DB, email string) ([]*User, error) {
+	var users []*User
+	err := db.NewSelect().Model(&users).
+		Where("lower(email) = lower(?)", email).
+		Where("NOT no_email_lookup").
+		Where("deleted_at IS NULL").
+		Order("uin ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not look up users by email")
+	}
+	return users, nil
+}
+
+// EmailTaken checks whether a user already has the email
+func EmailTaken(ctx context.Context, db *bun.DB, email string) (bool, error) {
+	exists, err := db.NewSelect().Model((*User)(nil)).Where("lower(email) = lower(?)", email).Exists(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not check email")
+	}
+	return exists, nil
+}
+
 func UserByUIN(ctx context.Context, db *bun.DB, uin int64) (*User, error) {
 	user := new(User)
 	if err := db.NewSelect().Model(user).Where("uin = ?", uin).Scan(ctx, user); err != nil {
@@ -0,0 +1,243 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// UserExport is everything the server keeps about a user, as they're given it when they ask for
+// their data. Their password and cipher and the auth cookies themselves are secrets and left out.
+type UserExport struct {
+	ExportedAt time.Time `json:"exported_at"`
+
+	Account           ExportedAccount       `json:"account"`
+	MessagesSent      []*ExportedMessage    `json:"messages_sent"`
+	MessagesReceived  []*ExportedMessage    `json:"messages_received"`
+	Buddies           []*ExportedBuddy      `json:"buddies"`
+	OnBuddyListsOf    []*ExportedBuddy      `json:"on_buddy_lists_of"`
+	Feedbag           []*ExportedFeedbag    `json:"feedbag"`
+	Logins            []*ExportedLogin      `json:"logins"`
+	Invitations       []*ExportedInvitation `json:"invitations"`
+	ChatRoomsCreated  []*ExportedChatRoom   `json:"chat_rooms_created"`
+	BuddyIcon         []byte                `json:"buddy_icon,omitempty"`
+	EmailVerification *time.Time            `json:"email_verification_sent_at,omitempty"`
+}
+
+// ExportedAccount is the user's row, including their profile and away message
+type ExportedAccount struct {
+	UIN                 int64      `json:"uin"`
+	ScreenName          string     `json:"screen_name"`
+	Email               string     `json:"email"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	DeletedAt           *time.Time `json:"deleted_at,omitempty"`
+	LastActivityAt      time.Time  `json:"last_activity_at"`
+	Status              string     `json:"status"`
+	Verified            bool       `json:"verified"`
+	Unconfirmed         bool       `json:"unconfirmed"`
+	Profile             string     `json:"profile"`
+	ProfileEncoding     string     `json:"profile_encoding"`
+	AwayMessage         string     `json:"away_message"`
+	AwayMessageEncoding string     `json:"away_message_encoding"`
+	WarningLevel        uint16     `json:"warning_level"`
+	Suspended           bool       `json:"suspended"`
+	SuspendedUntil      *time.Time `json:"suspended_until,omitempty"`
+	SuspensionReason    string     `json:"suspension_reason,omitempty"`
+	NoEmailLookup       bool       `json:"no_email_lookup"`
+}
+
+// ExportedMessage is a stored IM the user sent or was sent
+type ExportedMessage struct {
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	Contents    string     `json:"contents"`
+	Channel     uint16     `json:"channel"`
+	ICQType     uint8      `json:"icq_type,omitempty"`
+	SentAt      time.Time  `json:"sent_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// ExportedBuddy is someone on the user's buddy list, or someone with the user on theirs
+type ExportedBuddy struct {
+	ScreenName string `json:"screen_name"`
+	Group      string `json:"group,omitempty"`
+	Alias      string `json:"alias,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// ExportedFeedbag is an item of the user's server-side buddy list
+type ExportedFeedbag struct {
+	GroupID      uint16    `json:"group_id"`
+	ItemID       uint16    `json:"item_id"`
+	ClassID      uint16    `json:"class_id"`
+	Name         string    `json:"name"`
+	Attributes   []byte    `json:"attributes,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ExportedLogin is when and where the user was handed a cookie to sign on or open a service
+// with. Cookies are forgotten once they're used, so these are only the recent ones.
+type ExportedLogin struct {
+	IP     string    `json:"ip"`
+	At     time.Time `json:"at"`
+	Family uint16    `json:"family"`
+}
+
+// ExportedInvitation is an email the user had the server send a friend
+type ExportedInvitation struct {
+	Email     string    `json:"email"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportedChatRoom is a chat room the user created
+type ExportedChatRoom struct {
+	Name      string    `json:"name"`
+	Exchange  uint16    `json:"exchange"`
+	Public    bool      `json:"public"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportUser collects everything about the user, reading it all from one snapshot of the DB
+func ExportUser(ctx context.Context, db *bun.DB, user *User) (*UserExport, error) {
+	export := &UserExport{
+		ExportedAt: time.Now(),
+		Account: ExportedAccount{
+			UIN:                 user.UIN,
+			ScreenName:          user.ScreenName,
+			Email:               user.Email,
+			CreatedAt:           user.CreatedAt,
+			UpdatedAt:           user.UpdatedAt,
+			DeletedAt:           user.DeletedAt,
+			LastActivityAt:      user.LastActivityAt,
+			Status:              user.Status.String(),
+			Verified:            user.Verified,
+			Unconfirmed:         user.Unconfirmed,
+			Profile:             user.Profile,
+			ProfileEncoding:     user.ProfileEncoding,
+			AwayMessage:         user.AwayMessage,
+			AwayMessageEncoding: user.AwayMessageEncoding,
+			WarningLevel:        user.WarningLevel,
+			Suspended:           user.Suspended,
+			SuspendedUntil:      user.SuspendedUntil,
+			SuspensionReason:    user.SuspensionReason,
+			NoEmailLookup:       user.NoEmailLookup,
+		},
+	}
+
+	opts := &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	err := db.RunInTx(ctx, opts, func(ctx context.Context, tx bun.Tx) error {
+		var err error
+		if export.MessagesSent, err = exportMessages(ctx, tx, "from", user.NormalizedScreenName); err != nil {
+			return err
+		}
+		if export.MessagesReceived, err = exportMessages(ctx, tx, "to", user.NormalizedScreenName); err != nil {
+			return err
+		}
+
+		var buddies []*Buddy
+		if err := tx.NewSelect().Model(&buddies).Relation("Target").Where("source_uin = ?", user.UIN).Order("buddy.id ASC").Scan(ctx); err != nil {
+			return errors.Wrap(err, "could not export buddies")
+		}
+		export.Buddies = make([]*ExportedBuddy, 0, len(buddies))
+		for _, buddy := range buddies {
+			if buddy.Target != nil {
+				export.Buddies = append(export.Buddies, &ExportedBuddy{ScreenName: buddy.Target.ScreenName, Group: buddy.Group, Alias: buddy.Alias, Note: buddy.Note})
+			}
+		}
+
+		// What others call the user and note about them is theirs, so only who they are is exported
+		var watchers []*Buddy
+		if err := tx.NewSelect().Model(&watchers).Relation("Source").Where("with_uin = ?", user.UIN).Order("buddy.id ASC").Scan(ctx); err != nil {
+			return errors.Wrap(err, "could not export buddies")
+		}
+		export.OnBuddyListsOf = make([]*ExportedBuddy, 0, len(watchers))
+		for _, watcher := range watchers {
+			if watcher.Source != nil {
+				export.OnBuddyListsOf = append(export.OnBuddyListsOf, &ExportedBuddy{ScreenName: watcher.Source.ScreenName})
+			}
+		}
+
+		items, err := FeedbagForUser(ctx, tx, user.UIN)
+		if err != nil {
+			return err
+		}
+		export.Feedbag = make([]*ExportedFeedbag, 0, len(items))
+		for _, item := range items {
+			export.Feedbag = append(export.Feedbag, &ExportedFeedbag{GroupID: item.GroupId, ItemID: item.ItemId, ClassID: item.ClassId, Name: item.Name, Attributes: item.Attributes, LastModified: item.LastModified})
+		}
+
+		var cookies []*AuthCookie
+		if err := tx.NewSelect().Model(&cookies).Where("uin = ?", user.UIN).Order("created_at ASC").Scan(ctx); err != nil {
+			return errors.Wrap(err, "could not export logins")
+		}
+		export.Logins = make([]*ExportedLogin, 0, len(cookies))
+		for _, cookie := range cookies {
+			export.Logins = append(export.Logins, &ExportedLogin{IP: cookie.IP, At: cookie.CreatedAt, Family: cookie.Family})
+		}
+
+		var invitations []*Invitation
+		if err := tx.NewSelect().Model(&invitations).Where("inviter_uin = ?", user.UIN).Order("id ASC").Scan(ctx); err != nil {
+			return errors.Wrap(err, "could not export invitations")
+		}
+		export.Invitations = make([]*ExportedInvitation, 0, len(invitations))
+		for _, invitation := range invitations {
+			export.Invitations = append(export.Invitations, &ExportedInvitation{Email: invitation.Email, Message: invitation.Message, CreatedAt: invitation.CreatedAt})
+		}
+
+		var rooms []*ChatRoom
+		if err := tx.NewSelect().Model(&rooms).Where("creator_uin = ?", user.UIN).Order("id ASC").Scan(ctx); err != nil {
+			return errors.Wrap(err, "could not export chat rooms")
+		}
+		export.ChatRoomsCreated = make([]*ExportedChatRoom, 0, len(rooms))
+		for _, room := range rooms {
+			export.ChatRoomsCreated = append(export.ChatRoomsCreated, &ExportedChatRoom{Name: room.Name, Exchange: room.Exchange, Public: room.Public, CreatedAt: room.CreatedAt})
+		}
+
+		if len(user.BuddyIconHash) > 0 {
+			icon, err := BuddyIconByHash(ctx, tx, user.BuddyIconHash)
+			if err != nil {
+				return err
+			}
+			if icon != nil {
+				export.BuddyIcon = icon.Data
+			}
+		}
+
+		var verifications []*EmailVerification
+		if err := tx.NewSelect().Model(&verifications).Where("user_uin = ?", user.UIN).Limit(1).Scan(ctx); err != nil {
+			return errors.Wrap(err, "could not export email verification")
+		}
+		if len(verifications) > 0 {
+			export.EmailVerification = &verifications[0].CreatedAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// exportMessages is the messages with the screen name in the column, oldest first
+func exportMessages(ctx context.Context, db bun.IDB, column, screenName string) ([]*ExportedMessage, error) {
+	var messages []*Message
+	if err := db.NewSelect().Model(&messages).Where("? = ?", bun.Ident(column), screenName).Order("created_at ASC", "id ASC").Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not export messages")
+	}
+
+	exported := make([]*ExportedMessage, 0, len(messages))
+	for _, m := range messages {
+		e := &ExportedMessage{From: m.From, To: m.To, Contents: m.Contents, Channel: m.Channel, ICQType: m.ICQType, SentAt: m.CreatedAt}
+		if !m.DeliveredAt.IsZero() {
+			deliveredAt := m.DeliveredAt
+			e.DeliveredAt = &deliveredAt
+		}
+		exported = append(exported, e)
+	}
+	return exported, nil
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+// runInTx runs fn in a transaction on db, or straight on db when it's already a transaction
+func runInTx(ctx context.Context, db bun.IDB, fn func(ctx context.Context, tx bun.IDB) error) error {
+	if d, ok := db.(*bun.DB); ok {
+		return d.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			return fn(ctx, tx)
+		})
+	}
+	return fn(ctx, db)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// OfflineMessageExpiryInterval is how often messages stored for users who are offline are
+// checked for ones that are too old
+var OfflineMessageExpiryInterval = time.Hour
+
+// OfflineMessageExpiry deletes messages that were stored for users who are offline more than
+// maxAge ago, so messages for accounts nobody signs on to anymore don't pile up. The routine
+// stops once done is closed.
+func OfflineMessageExpiry(interval time.Duration, maxAge time.Duration, parentLogger *slog.Logger) func(db *bun.DB, done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "offline_message_expiry"))
+
+	return func(db *bun.DB, done <-chan struct{}) {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx := oscar.NewContextWithLogger(context.Background(), logger)
+			deleted, err := models.DeleteExpiredMessages(ctx, db, time.Now().Add(-maxAge))
+			if err != nil {
+				logger.Error("could not delete expired messages", slog.String("err", err.Error()))
+				continue
+			}
+			if deleted > 0 {
+				logger.Info("deleted expired messages", slog.Int64("count", deleted))
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Old messages nobody signed on to get are deleted, and recent and delivered ones are kept
+func TestOfflineMessageExpiry(t *testing.T) {
+	d := serverTestDB(t)
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	store := func(age time.Duration, delivered bool) *models.Message {
+		message, err := models.InsertMessage(ctx, d, 1, "alice", "bob", "hello")
+		if err != nil {
+			t.Fatalf("could not store message: %s", err)
+		}
+		message.CreatedAt = time.Now().Add(-age)
+		if _, err := d.NewUpdate().Model(message).Column("created_at").WherePK().Exec(ctx); err != nil {
+			t.Fatalf("could not age message: %s", err)
+		}
+		if delivered {
+			if err := message.MarkDelivered(ctx, d); err != nil {
+				t.Fatalf("could not deliver message: %s", err)
+			}
+		}
+		return message
+	}
+	expired := store(48*time.Hour, false)
+	recent := store(time.Hour, false)
+	delivered := store(48*time.Hour, true)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		OfflineMessageExpiry(50*time.Millisecond, 24*time.Hour, logger)(d, done)
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		exists, err := d.NewSelect().Model(expired).WherePK().Exists(ctx)
+		if err != nil {
+			t.Fatalf("could not look up message: %s", err)
+		}
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expired message to be deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("expected the routine to stop")
+	}
+
+	for name, message := range map[string]*models.Message{"recent": recent, "delivered": delivered} {
+		exists, err := d.NewSelect().Model(message).WherePK().Exists(ctx)
+		if err != nil {
+			t.Fatalf("could not look up message: %s", err)
+		}
+		if !exists {
+			t.Errorf("expected the %s message to be kept", name)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"aim-oscar/metrics"
 	"aim-oscar/models"
 	"aim-oscar/oscar"
+	"aim-oscar/services"
 	"aim-oscar/util"
+	"aim-oscar/webhook"
 	"context"
 	"fmt"
 	"time"
@@ -12,127 +15,290 @@ import (
 	"golang.org/x/exp/slog"
 )
 
-func OnlineNotification(sm *SessionManager, parentLogger *slog.Logger) (chan *models.User, routineFn) {
-	commCh := make(chan *models.User, 1)
+// buddyArrivedSNAC builds the oncoming buddy SNAC (0x03,0x0b) for user. session is the user's
+// session if they are connected and holds their in-memory presence like idle time.
+func buddyArrivedSNAC(user *models.User, session *oscar.Session) *oscar.SNAC {
+	onlineSnac := oscar.NewSNAC(0x3, 0xb)
+	services.WriteUserInfo(onlineSnac, user, session)
+	return onlineSnac
+}
+
+// buddyDepartedSNAC builds the offgoing buddy SNAC (0x03,0x0c) for user. Departed buddies only
+// have their user class, with no signon or online time.
+func buddyDepartedSNAC(user *models.User) *oscar.SNAC {
+	offlineSnac := oscar.NewSNAC(0x3, 0xc)
+	offlineSnac.Data.WriteLPString(user.ScreenName)
+	offlineSnac.Data.WriteUint16(user.WarningLevel)
+	tlvs := []*oscar.TLV{
+		oscar.NewTLV(1, util.Word(services.UserClassAOL)),
+	}
+	offlineSnac.AppendTLVs(tlvs)
+	return offlineSnac
+}
+
+// presenceDebounce is how long after telling buddies a user went away or came back that the next
+// toggle is held back. Only the last of the toggles in between is sent.
+var presenceDebounce = 2 * time.Second
+
+// debouncer holds back away and back toggles that come too quickly after the last one buddies
+// heard about
+type debouncer struct {
+	lastSent  map[int64]time.Time
+	announced map[int64]services.PresenceTransition
+	pending   map[int64]*services.PresenceEvent
+}
+
+func newDebouncer() *debouncer {
+	return &debouncer{
+		lastSent:  make(map[int64]time.Time),
+		announced: make(map[int64]services.PresenceTransition),
+		pending:   make(map[int64]*services.PresenceEvent),
+	}
+}
+
+// hold is true if the event has to wait. Arrivals and departures are never held, and replace any
+// toggle that was waiting.
+func (d *debouncer) hold(event *services.PresenceEvent, now time.Time) bool {
+	uin := event.User.UIN
+	if !event.Transition.Toggle() {
+		if event.Type == services.PresenceStatusChanged {
+			delete(d.pending, uin)
+			delete(d.lastSent, uin)
+			delete(d.announced, uin)
+		}
+		return false
+	}
+
+	if now.Sub(d.lastSent[uin]) < presenceDebounce {
+		d.pending[uin] = event
+		return true
+	}
+	d.sent(event, now)
+	return false
+}
+
+func (d *debouncer) sent(event *services.PresenceEvent, now time.Time) {
+	d.lastSent[event.User.UIN] = now
+	d.announced[event.User.UIN] = event.Transition
+}
+
+// due is the toggles that have waited long enough. Toggles that end up where buddies already
+// think the user is are dropped.
+func (d *debouncer) due(now time.Time) []*services.PresenceEvent {
+	var events []*services.PresenceEvent
+	for uin, event := range d.pending {
+		if now.Sub(d.lastSent[uin]) < presenceDebounce {
+			continue
+		}
+		delete(d.pending, uin)
+		if d.announced[uin] == event.Transition {
+			continue
+		}
+		d.sent(event, now)
+		events = append(events, event)
+	}
+	return events
+}
+
+// next is when the first pending toggle is due, or nil if none are waiting
+func (d *debouncer) next(now time.Time) <-chan time.Time {
+	if len(d.pending) == 0 {
+		return nil
+	}
+
+	var wait time.Duration = presenceDebounce
+	for uin := range d.pending {
+		if left := presenceDebounce - now.Sub(d.lastSent[uin]); left < wait {
+			wait = left
+		}
+	}
+	return time.After(wait)
+}
+
+// signons tells webhooks when users sign on and off, which status changes alone don't say
+type signons map[int64]bool
+
+func (s signons) emit(webhooks *webhook.Dispatcher, event *services.PresenceEvent) {
+	if event.Type != services.PresenceStatusChanged {
+		return
+	}
+
+	user := event.User
+	connected := user.Status.Connected()
+	switch {
+	case connected && !s[user.UIN]:
+		s[user.UIN] = true
+		webhooks.Emit(&webhook.Event{Type: webhook.EventSignon, ScreenName: user.ScreenName})
+	case !connected && s[user.UIN]:
+		delete(s, user.UIN)
+		webhooks.Emit(&webhook.Event{Type: webhook.EventSignoff, ScreenName: user.ScreenName})
+	}
+}
+
+// OnlineNotification tells buddies about the presence events sent to it, and webhooks when users
+// sign on and off. webhooks can be nil.
+func OnlineNotification(sm *SessionManager, webhooks *webhook.Dispatcher, parentLogger *slog.Logger) (chan *services.PresenceEvent, routineFn) {
+	commCh := make(chan *services.PresenceEvent, 1)
 	logger := parentLogger.With(slog.String("routine", "online_notification"))
 
 	routine := func(db *bun.DB) {
 		logger.Info("Starting up")
 		defer logger.Info("Shutting down")
 
+		toggles := newDebouncer()
+		signedOn := signons{}
+		var flush <-chan time.Time
+
 		for {
-			user, more := <-commCh
-			if !more {
-				return
+			select {
+			case event, more := <-commCh:
+				if !more {
+					return
+				}
+				signedOn.emit(webhooks, event)
+				if toggles.hold(event, time.Now()) {
+					if flush == nil {
+						flush = toggles.next(time.Now())
+					}
+					continue
+				}
+				notifyBuddies(db, sm, logger, event)
+
+			case <-flush:
+				for _, event := range toggles.due(time.Now()) {
+					notifyBuddies(db, sm, logger, event)
+				}
+				flush = toggles.next(time.Now())
 			}
+		}
+	}
 
-			userLogger := logger.With(slog.String("screen_name", user.ScreenName), slog.String("status", user.Status.String()))
-			userLogger.Info("Status change")
+	return commCh, routine
+}
 
-			// Find buddies who are friends with the user
-			ctx := context.Background()
-			var buddies []*models.Buddy
-			err := db.NewSelect().Model(&buddies).Where("with_uin = ?", user.UIN).Relation("Source").Scan(ctx, &buddies)
-			if err != nil {
-				userLogger.Error("Could not find user's buddies", slog.String("err", err.Error()))
-				continue
+// liveSession is the user's session, or nil if they don't have one or it's disconnected and
+// waiting for its close handler to take it out of the session manager
+func liveSession(sm *SessionManager, screenName string) *oscar.Session {
+	session := sm.GetSession(screenName)
+	if session == nil || session.Context().Err() != nil {
+		return nil
+	}
+	return session
+}
+
+// notifyBuddies tells the user's buddies about the event, and tells the user where their buddies
+// are if they just signed on or changed status
+func notifyBuddies(db *bun.DB, sm *SessionManager, logger *slog.Logger, event *services.PresenceEvent) {
+	user := event.User
+	userLogger := logger.With(slog.String("screen_name", user.ScreenName), slog.String("status", user.Status.String()))
+	userSession := liveSession(sm, user.ScreenName)
+	if userSession != nil {
+		userLogger = userLogger.With("session_id", userSession.ID)
+	}
+
+	switch event.Type {
+	case services.PresenceIdleChanged:
+		idle := userSession != nil && !userSession.IdleSince().IsZero()
+		userLogger.Info("Idle change", slog.Bool("idle", idle))
+	case services.PresenceInfoChanged:
+		userLogger.Info("Info change")
+	default:
+		userLogger.Info("Status change")
+	}
+
+	// Find buddies who are friends with the user
+	ctx := oscar.NewContextWithLogger(context.Background(), userLogger)
+	var buddies []*models.Buddy
+	err := db.NewSelect().Model(&buddies).Where("with_uin = ?", user.UIN).Relation("Source").Scan(ctx, &buddies)
+	if err != nil {
+		userLogger.Error("Could not find user's buddies", slog.String("err", err.Error()))
+		return
+	}
+
+	// Inform each buddy that the user is now online
+	for _, buddy := range buddies {
+		if !buddy.Source.Status.Connected() {
+			continue
+		}
+		userLogger.Debug(fmt.Sprintf("notifying %s", buddy.Source.ScreenName))
+
+		if buddySession := liveSession(sm, buddy.Source.ScreenName); buddySession != nil {
+			// Buddies the user blocks, and everyone while they're invisible, see them as
+			// offline
+			visible := user.Status.Visible()
+			if visible {
+				blocked, err := services.SessionBlocks(ctx, db, userSession, user, buddy.Source.ScreenName)
+				if err != nil {
+					userLogger.Error("could not check privacy settings", slog.String("err", err.Error()))
+					continue
+				}
+				visible = !blocked
 			}
 
-			// Inform each buddy that the user is now online
-			for _, buddy := range buddies {
-				if buddy.Source.Status == models.UserStatusAway || buddy.Source.Status == models.UserStatusDnd {
+			// If the user is now online or away...
+			if visible {
+				onlineFlap := oscar.NewFLAP(2)
+				onlineFlap.Data.WriteBinary(buddyArrivedSNAC(user, userSession))
+				if err := buddySession.Send(onlineFlap); err != nil {
+					userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", buddy.Source.ScreenName, user.ScreenName), "buddy_session_id", buddySession.ID, slog.String("err", err.Error()))
+				} else {
+					metrics.PresenceNotifications.WithLabelValues("arrived").Inc()
+				}
+
+				// If the user is now offline, or is hiding from the buddy
+			} else {
+				// Idle and info changes only matter to buddies who can see the user
+				if event.Type.InfoOnly() {
 					continue
 				}
-				userLogger.Debug(fmt.Sprintf("notifying %s", buddy.Source.ScreenName))
-
-				if buddySession := sm.GetSession(buddy.Source.ScreenName); buddySession != nil {
-					// If the user is now online...
-					if user.Status == models.UserStatusOnline {
-						onlineSnac := oscar.NewSNAC(0x3, 0xb)
-						onlineSnac.Data.WriteLPString(user.ScreenName)
-						onlineSnac.Data.WriteUint16(0) // TODO: user warning level
-
-						tlvs := []*oscar.TLV{
-							oscar.NewTLV(0x01, util.Word(0x0004)), // TODO: user class
-							oscar.NewTLV(0x06, util.Dword(uint32(user.Status))),
-							oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(user.LastActivityAt).Seconds()))), // Idle Time
-							oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                         // Client Signon Time
-							oscar.NewTLV(0x05, util.Dword(uint32(user.CreatedAt.Unix()))),                     // Member since
-						}
-						onlineSnac.AppendTLVs(tlvs)
-
-						onlineFlap := oscar.NewFLAP(2)
-						onlineFlap.Data.WriteBinary(onlineSnac)
-						if err := buddySession.Send(onlineFlap); err != nil {
-							userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", buddy.Source.ScreenName, user.ScreenName), slog.String("err", err.Error()))
-						}
-
-						// If the user is now away
-					} else if user.Status == models.UserStatusAway {
-						offlineSnac := oscar.NewSNAC(0x3, 0xc)
-						offlineSnac.Data.WriteLPString(user.ScreenName)
-						offlineSnac.Data.WriteUint16(0) // TODO: user warning level
-						tlvs := []*oscar.TLV{
-							oscar.NewTLV(1, util.Dword(0x0020)),
-						}
-						offlineSnac.AppendTLVs(tlvs)
-
-						offlineFlap := oscar.NewFLAP(2)
-						offlineFlap.Data.WriteBinary(offlineSnac)
-						if err := buddySession.Send(offlineFlap); err != nil {
-							userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", buddy.Source.ScreenName, user.ScreenName), slog.String("err", err.Error()))
-						}
-					}
+
+				offlineFlap := oscar.NewFLAP(2)
+				offlineFlap.Data.WriteBinary(buddyDepartedSNAC(user))
+				if err := buddySession.Send(offlineFlap); err != nil {
+					userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", buddy.Source.ScreenName, user.ScreenName), "buddy_session_id", buddySession.ID, slog.String("err", err.Error()))
+				} else {
+					metrics.PresenceNotifications.WithLabelValues("departed").Inc()
 				}
 			}
+		}
+	}
 
-			userSession := sm.GetSession(user.ScreenName)
-			// If the user is disconnected, don't try to send them notifications
-			if userSession == nil {
+	// If the user is disconnected, don't try to send them notifications. The user's own
+	// buddy list doesn't change when they go idle or away, or change their info.
+	if userSession == nil || event.Type.InfoOnly() || event.Transition.Toggle() {
+		return
+	}
+
+	// Get the user's list of online buddies and tell the user that they are online
+	for _, buddy := range buddies {
+		visible := buddy.Source.Status.Visible()
+		if visible {
+			blocked, err := services.SessionBlocks(ctx, db, liveSession(sm, buddy.Source.ScreenName), buddy.Source, user.ScreenName)
+			if err != nil {
+				userLogger.Error("could not check privacy settings", slog.String("err", err.Error()))
 				continue
 			}
+			visible = !blocked
+		}
 
-			// Get the user's list of online buddies and tell the user that they are online
-			for _, buddy := range buddies {
-				// If the buddy is away, tell the user
-				if buddy.Source.Status == models.UserStatusAway {
-					offlineSnac := oscar.NewSNAC(0x3, 0xc)
-					offlineSnac.Data.WriteLPString(buddy.Source.ScreenName)
-					offlineSnac.Data.WriteUint16(0) // TODO: user warning level
-					tlvs := []*oscar.TLV{
-						oscar.NewTLV(1, util.Dword(0x0020)),
-					}
-					offlineSnac.AppendTLVs(tlvs)
-
-					offlineFlap := oscar.NewFLAP(2)
-					offlineFlap.Data.WriteBinary(offlineSnac)
-					if err := userSession.Send(offlineFlap); err != nil {
-						userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", user.ScreenName, buddy.Source.ScreenName), slog.String("err", err.Error()))
-					}
-				} else if buddy.Source.Status == models.UserStatusOnline {
-					onlineSnac := oscar.NewSNAC(3, 0xb)
-					onlineSnac.Data.WriteLPString(buddy.Source.ScreenName)
-					onlineSnac.Data.WriteUint16(0) // TODO: user warning level
-
-					tlvs := []*oscar.TLV{
-						oscar.NewTLV(0x01, util.Word(0x0004)), // TODO: user class
-						oscar.NewTLV(0x06, util.Dword(uint32(buddy.Source.Status))),
-						oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(buddy.Source.LastActivityAt).Seconds()))), // Idle Time
-						oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                                 // Client Signon Time
-						oscar.NewTLV(0x05, util.Dword(uint32(buddy.Source.CreatedAt.Unix()))),                     // Member since
-					}
-					onlineSnac.AppendTLVs(tlvs)
-
-					onlineFlap := oscar.NewFLAP(2)
-					onlineFlap.Data.WriteBinary(onlineSnac)
-					if err := userSession.Send(onlineFlap); err != nil {
-						userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", user.ScreenName, buddy.Source.ScreenName), slog.String("err", err.Error()))
-					}
-				}
-
+		// If the buddy is offline, or is hiding from the user, tell the user
+		if !visible {
+			offlineFlap := oscar.NewFLAP(2)
+			offlineFlap.Data.WriteBinary(buddyDepartedSNAC(buddy.Source))
+			if err := userSession.Send(offlineFlap); err != nil {
+				userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", user.ScreenName, buddy.Source.ScreenName), slog.String("err", err.Error()))
+			} else {
+				metrics.PresenceNotifications.WithLabelValues("departed").Inc()
+			}
+		} else {
+			onlineFlap := oscar.NewFLAP(2)
+			onlineFlap.Data.WriteBinary(buddyArrivedSNAC(buddy.Source, liveSession(sm, buddy.Source.ScreenName)))
+			if err := userSession.Send(onlineFlap); err != nil {
+				userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", user.ScreenName, buddy.Source.ScreenName), slog.String("err", err.Error()))
+			} else {
+				metrics.PresenceNotifications.WithLabelValues("arrived").Inc()
 			}
 		}
-	}
 
-	return commCh, routine
+	}
 }
@@ -0,0 +1,153 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+func onlineTestDB(t *testing.T) *bun.DB {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+	d, err := db.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	for _, model := range []interface{}{(*models.User)(nil), (*models.Buddy)(nil), (*models.Feedbag)(nil)} {
+		if _, err := d.NewCreateTable().Model(model).IfNotExists().Exec(context.Background()); err != nil {
+			t.Fatalf("could not create table: %s", err)
+		}
+	}
+	return d
+}
+
+// signedOnUser is a user who is online with a session in sm. The SNACs sent to the session come
+// out of the channel.
+func signedOnUser(t *testing.T, d *bun.DB, sm *SessionManager, prefix string) (context.Context, *models.User, chan *oscar.SNAC) {
+	ctx := context.Background()
+	screenName := fmt.Sprintf("%s%d", prefix, time.Now().UnixNano()%100000)
+	user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+	if err != nil {
+		t.Fatalf("could not create user: %s", err)
+	}
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Buddy)(nil)).Where("source_uin = ? OR with_uin = ?", user.UIN, user.UIN).Exec(ctx)
+		d.NewDelete().Model(user).WherePK().Exec(ctx)
+	})
+	user.Status = models.UserStatusOnline
+	if err := user.Update(ctx, d, "status"); err != nil {
+		t.Fatalf("could not sign on user: %s", err)
+	}
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	sessionCtx := oscar.NewContextWithSession(ctx, server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	session, _ := oscar.SessionFromContext(sessionCtx)
+	sm.ClaimSession(user.ScreenName, session)
+	t.Cleanup(func() { sm.RemoveSession(user.ScreenName, session) })
+
+	snacs := make(chan *oscar.SNAC, 16)
+	go func() {
+		for {
+			header := make([]byte, 6)
+			if _, err := io.ReadFull(client, header); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+			if _, err := io.ReadFull(client, data); err != nil {
+				return
+			}
+			snac := &oscar.SNAC{}
+			if err := snac.UnmarshalBinary(data); err == nil {
+				snacs <- snac
+			}
+		}
+	}()
+
+	return models.NewContextWithUser(sessionCtx, user), user, snacs
+}
+
+// nextBuddySNAC is the next arrival or departure about screenName, skipping the ones about others
+func nextBuddySNAC(t *testing.T, snacs chan *oscar.SNAC, screenName string) *oscar.SNAC {
+	t.Helper()
+	for {
+		select {
+		case snac := <-snacs:
+			name, _ := snac.Data.ReadLPString()
+			if name == screenName {
+				return snac
+			}
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	}
+}
+
+// Removing a buddy stops presence for them, while everyone else who has them keeps getting it
+func TestRemovedBuddyDeparture(t *testing.T) {
+	d := onlineTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sm := NewSessionManager(KickOldSession)
+	onlineCh, routine := OnlineNotification(sm, nil, logger)
+	go routine(d)
+	defer close(onlineCh)
+
+	aliceCtx, _, aliceSNACs := signedOnUser(t, d, sm, "alice")
+	_, carol, carolSNACs := signedOnUser(t, d, sm, "carol")
+	_, bob, _ := signedOnUser(t, d, sm, "bob")
+
+	if _, err := models.AddBuddy(context.Background(), d, carol.UIN, bob.UIN); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+
+	b := &services.BuddyListManagement{OnlineCh: onlineCh}
+	add := oscar.NewSNAC(0x3, 0x4)
+	add.Data.WriteLPString(bob.ScreenName)
+	if _, err := b.HandleSNAC(aliceCtx, d, add); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	for name, snacs := range map[string]chan *oscar.SNAC{"alice": aliceSNACs, "carol": carolSNACs} {
+		if snac := nextBuddySNAC(t, snacs, bob.ScreenName); snac == nil || snac.Header.Subtype != 0x0b {
+			t.Fatalf("expected %s to see bob arrive, got %v", name, snac)
+		}
+	}
+
+	remove := oscar.NewSNAC(0x3, 0x5)
+	remove.Data.WriteLPString(bob.ScreenName)
+	if _, err := b.HandleSNAC(aliceCtx, d, remove); err != nil {
+		t.Fatalf("could not remove buddy: %s", err)
+	}
+
+	if err := bob.SetOffline(context.Background(), d); err != nil {
+		t.Fatalf("could not sign bob off: %s", err)
+	}
+	onlineCh <- services.StatusChanged(bob)
+
+	if snac := nextBuddySNAC(t, carolSNACs, bob.ScreenName); snac == nil || snac.Header.Subtype != 0x0c {
+		t.Errorf("expected carol to see bob leave, got %v", snac)
+	}
+	if snac := nextBuddySNAC(t, aliceSNACs, bob.ScreenName); snac != nil {
+		t.Errorf("expected alice not to hear about bob once bob was removed, got %s", snac)
+	}
+}
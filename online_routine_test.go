@@ -0,0 +1,113 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// userInfoTLVs reads the TLVs of the user info block in an arrival or departure SNAC
+func userInfoTLVs(t *testing.T, snac *oscar.SNAC) []*oscar.TLV {
+	t.Helper()
+	if _, err := snac.Data.ReadLPString(); err != nil {
+		t.Fatalf("could not read screen name: %s", err)
+	}
+	if _, err := snac.Data.ReadUint16(); err != nil {
+		t.Fatalf("could not read warning level: %s", err)
+	}
+	if _, err := snac.Data.ReadUint16(); err != nil {
+		t.Fatalf("could not read TLV count: %s", err)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read TLVs: %s", err)
+	}
+	return tlvs
+}
+
+// Buddies see the features the user's client supports when the user arrives, but nothing about
+// the session when they leave
+func TestBuddyArrivedCapabilities(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	user := &models.User{ScreenName: "alice"}
+	session := oscar.NewSession(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if tlv := oscar.FindTLV(userInfoTLVs(t, buddyArrivedSNAC(user, session)), 0x0d); tlv != nil {
+		t.Errorf("expected no capabilities before the client sets them, got %v", tlv)
+	}
+
+	session.SetCapabilities(bytes.Repeat([]byte{0x09}, 32))
+	tlv := oscar.FindTLV(userInfoTLVs(t, buddyArrivedSNAC(user, session)), 0x0d)
+	if tlv == nil || !bytes.Equal(tlv.Data, session.Capabilities()) {
+		t.Errorf("expected the client's capabilities, got %v", tlv)
+	}
+
+	for _, tlvType := range []uint16{0x03, 0x05, 0x0d, 0x0f} {
+		if tlv := oscar.FindTLV(userInfoTLVs(t, buddyDepartedSNAC(user)), tlvType); tlv != nil {
+			t.Errorf("expected no TLV 0x%02x for a departed buddy, got %v", tlvType, tlv)
+		}
+	}
+}
+
+// Toggling away and back quickly only tells buddies where the user ended up
+func TestDebouncerToggles(t *testing.T) {
+	user := &models.User{UIN: 1, ScreenName: "alice"}
+	toggles := newDebouncer()
+	now := time.Unix(1000, 0)
+
+	if toggles.hold(services.WentAway(user), now) {
+		t.Fatalf("expected the first toggle to go out right away")
+	}
+	if toggles.next(now) != nil {
+		t.Errorf("expected nothing to be waiting")
+	}
+
+	// Toggles right after are held, and only the last one counts
+	now = now.Add(presenceDebounce / 4)
+	for _, event := range []*services.PresenceEvent{services.CameBack(user), services.WentAway(user), services.CameBack(user)} {
+		if !toggles.hold(event, now) {
+			t.Fatalf("expected a toggle right after the last one to be held")
+		}
+	}
+	if toggles.next(now) == nil {
+		t.Errorf("expected a toggle to be waiting")
+	}
+	if events := toggles.due(now); len(events) != 0 {
+		t.Errorf("expected nothing to be due yet, got %d events", len(events))
+	}
+
+	now = now.Add(presenceDebounce)
+	events := toggles.due(now)
+	if len(events) != 1 || events[0].Transition != services.PresenceBack {
+		t.Fatalf("expected the user to come back, got %v", events)
+	}
+
+	// Toggles that end where buddies already think the user is are dropped
+	now = now.Add(presenceDebounce / 4)
+	toggles.hold(services.WentAway(user), now)
+	toggles.hold(services.CameBack(user), now)
+	if events := toggles.due(now.Add(presenceDebounce)); len(events) != 0 {
+		t.Errorf("expected no toggles, got %v", events)
+	}
+
+	// Signing off replaces any waiting toggle
+	now = now.Add(presenceDebounce / 4)
+	toggles.hold(services.WentAway(user), now)
+	user.Status = models.UserStatusOffline
+	if toggles.hold(services.StatusChanged(user), now) {
+		t.Errorf("expected signing off to go out right away")
+	}
+	if events := toggles.due(now.Add(presenceDebounce)); len(events) != 0 {
+		t.Errorf("expected the waiting toggle to be dropped, got %v", events)
+	}
+}
@@ -66,6 +66,45 @@ func (b *Buffer) ReadUint64() (uint64, error) {
 	return ret, nil
 }
 
+// ReadUint16LE reads a little-endian uint16. ICQ meta requests are little-endian while the
+// rest of OSCAR is big-endian.
+func (b *Buffer) ReadUint16LE() (uint16, error) {
+	if len(b.d) < 2 {
+		return 0, io.EOF
+	}
+	ret := binary.LittleEndian.Uint16(b.d[0:2])
+	b.d = b.d[2:]
+	return ret, nil
+}
+
+// ReadUint32LE reads a little-endian uint32
+func (b *Buffer) ReadUint32LE() (uint32, error) {
+	if len(b.d) < 4 {
+		return 0, io.EOF
+	}
+	ret := binary.LittleEndian.Uint32(b.d[0:4])
+	b.d = b.d[4:]
+	return ret, nil
+}
+
+// ReadLNTS reads an ICQ string: a little-endian uint16 length followed by that many bytes,
+// the last of which is a null terminator that isn't part of the string
+func (b *Buffer) ReadLNTS() (string, error) {
+	length, err := b.ReadUint16LE()
+	if err != nil {
+		return "", err
+	}
+
+	str, err := b.ReadBytes(int(length))
+	if err != nil {
+		return "", err
+	}
+	if length > 0 && str[length-1] == 0 {
+		str = str[:length-1]
+	}
+	return string(str), nil
+}
+
 // ReadLPString reads a length-prefixed string. The first byte should be the string length
 // followed by that many bytes. Returns io.EOF if there are less bytes than indicated.
 func (b *Buffer) ReadLPString() (string, error) {
@@ -83,6 +122,53 @@ func (b *Buffer) ReadLPString() (string, error) {
 	return str, nil
 }
 
+// ReadBytes reads the next n bytes. Returns io.EOF if there are less than n bytes left.
+func (b *Buffer) ReadBytes(n int) ([]byte, error) {
+	if n < 0 || len(b.d) < n {
+		return nil, io.EOF
+	}
+
+	ret := make([]byte, n)
+	copy(ret, b.d[:n])
+	b.d = b.d[n:]
+	return ret, nil
+}
+
+// ReadLPUint16String reads a string prefixed by its length as a uint16
+func (b *Buffer) ReadLPUint16String() (string, error) {
+	length, err := b.ReadUint16()
+	if err != nil {
+		return "", err
+	}
+
+	str, err := b.ReadBytes(int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
+// ReadTLVs reads the next count TLVs, for TLV blocks that are prefixed by the number of TLVs
+// rather than running to the end of the data
+func (b *Buffer) ReadTLVs(count int) (TLVList, error) {
+	// The count comes from the client, so it can't be trusted to size the slice beyond how
+	// many TLVs could fit in what's left
+	if max := len(b.d) / 4; count > max {
+		return nil, ErrTruncated
+	}
+
+	tlvs := make(TLVList, 0, count)
+	for i := 0; i < count; i++ {
+		tlv := &TLV{}
+		if err := tlv.UnmarshalBinary(b.d); err != nil {
+			return nil, err
+		}
+		tlvs = append(tlvs, tlv)
+		b.d = b.d[tlv.Len():]
+	}
+	return tlvs, nil
+}
+
 func (b *Buffer) WriteUint8(x uint8) {
 	b.d = append(b.d, x)
 }
@@ -102,6 +188,24 @@ func (b *Buffer) WriteUint64(x uint64) {
 	binary.BigEndian.PutUint64(b.d[len(b.d)-8:], x)
 }
 
+func (b *Buffer) WriteUint16LE(x uint16) {
+	b.d = append(b.d, 0, 0)
+	binary.LittleEndian.PutUint16(b.d[len(b.d)-2:], x)
+}
+
+func (b *Buffer) WriteUint32LE(x uint32) {
+	b.d = append(b.d, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b.d[len(b.d)-4:], x)
+}
+
+// WriteLNTS writes an ICQ string: a little-endian uint16 length, the string and a null
+// terminator, which is counted in the length
+func (b *Buffer) WriteLNTS(x string) {
+	b.WriteUint16LE(uint16(len(x) + 1))
+	b.WriteString(x)
+	b.WriteUint8(0)
+}
+
 func (b *Buffer) WriteString(x string) {
 	b.d = append(b.d, []byte(x)...)
 }
@@ -1,6 +1,10 @@
 package oscar
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
 
 func fail(t *testing.T, e error, method string) {
 	if e != nil {
@@ -53,3 +57,103 @@ func TestBufferLPString(t *testing.T) {
 		t.Errorf("expected to read %s, got %s", expectedStr, str)
 	}
 }
+
+func TestBufferLPUint16String(t *testing.T) {
+	b := Buffer{}
+
+	expectedStr := "Buddies"
+	b.WriteUint16(uint16(len(expectedStr)))
+	b.WriteString(expectedStr)
+	b.WriteUint8(0xff)
+
+	str, err := b.ReadLPUint16String()
+	fail(t, err, "ReadLPUint16String")
+	if str != expectedStr {
+		t.Errorf("expected to read %s, got %s", expectedStr, str)
+	}
+
+	if _, err := b.ReadBytes(2); err == nil {
+		t.Errorf("expected ReadBytes past the end of the buffer to fail")
+	}
+}
+
+func TestBufferReadTLVs(t *testing.T) {
+	b := Buffer{}
+	b.Write([]byte{0, 1, 0, 2, 'h', 'i', 0, 2, 0, 0, 0xff})
+
+	tlvs, err := b.ReadTLVs(2)
+	fail(t, err, "ReadTLVs")
+	if len(tlvs) != 2 {
+		t.Fatalf("expected 2 TLVs, got %d", len(tlvs))
+	}
+	if tlvs[0].Type != 1 || string(tlvs[0].Data) != "hi" {
+		t.Errorf("unexpected first TLV %v", tlvs[0])
+	}
+	if tlvs[1].Type != 2 || len(tlvs[1].Data) != 0 {
+		t.Errorf("unexpected second TLV %v", tlvs[1])
+	}
+
+	rest, err := b.ReadUint8()
+	fail(t, err, "ReadUint8")
+	if rest != 0xff {
+		t.Errorf("expected ReadTLVs to leave the rest of the buffer, got %d", rest)
+	}
+
+	if _, err := b.ReadTLVs(1); err == nil {
+		t.Errorf("expected an error reading past the end of the buffer")
+	}
+}
+
+func TestBufferLittleEndian(t *testing.T) {
+	b := Buffer{}
+	b.WriteUint16LE(0x0102)
+	b.WriteUint32LE(0x01020304)
+	b.WriteLNTS("hi")
+
+	expected := []byte{0x02, 0x01, 0x04, 0x03, 0x02, 0x01, 0x03, 0x00, 'h', 'i', 0x00}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Fatalf("expected %v, got %v", expected, b.Bytes())
+	}
+
+	x1, err := b.ReadUint16LE()
+	fail(t, err, "ReadUint16LE")
+	if x1 != 0x0102 {
+		t.Errorf("expected ReadUint16LE to read 0x0102, got 0x%04x", x1)
+	}
+
+	x2, err := b.ReadUint32LE()
+	fail(t, err, "ReadUint32LE")
+	if x2 != 0x01020304 {
+		t.Errorf("expected ReadUint32LE to read 0x01020304, got 0x%08x", x2)
+	}
+
+	str, err := b.ReadLNTS()
+	fail(t, err, "ReadLNTS")
+	if str != "hi" {
+		t.Errorf("expected ReadLNTS to read hi, got %q", str)
+	}
+
+	if _, err := b.ReadUint16LE(); err == nil {
+		t.Errorf("expected ReadUint16LE past the end of the buffer to fail")
+	}
+}
+
+func FuzzReadTLVs(f *testing.F) {
+	f.Add(uint16(1), []byte{0, 1, 0, 2, 'h', 'i'})
+	f.Add(uint16(0xffff), []byte{0, 1, 0, 0})
+
+	f.Fuzz(func(t *testing.T, count uint16, b []byte) {
+		buf := Buffer{}
+		buf.Write(b)
+		tlvs, err := buf.ReadTLVs(int(count))
+		if err != nil {
+			if !errors.Is(err, ErrTruncated) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if len(tlvs) != int(count) {
+			t.Errorf("expected %d TLVs, got %d", count, len(tlvs))
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package oscar
+
+import (
+	"encoding/binary"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Charsets of the text in an ICBM message fragment
+const (
+	CharsetASCII  = 0x0000
+	CharsetUCS2   = 0x0002 // UTF-16 big-endian, which is how clients send anything outside Latin-1
+	CharsetLatin1 = 0x0003 // ISO-8859-1
+)
+
+// DecodeText converts message text in the charset to UTF-8. Some clients send UTF-8 and say
+// it is ASCII, so ASCII that isn't valid UTF-8 is read as Latin-1 instead.
+func DecodeText(charset uint16, data []byte) (string, error) {
+	switch charset {
+	case CharsetUCS2:
+		if len(data)%2 != 0 {
+			return "", errors.Errorf("UCS-2 text has an odd length %d", len(data))
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(data[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+
+	case CharsetLatin1:
+		return decodeLatin1(data), nil
+
+	default:
+		if utf8.Valid(data) {
+			return string(data), nil
+		}
+		return decodeLatin1(data), nil
+	}
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// EncodeText converts UTF-8 text to the narrowest charset that holds it: ASCII, then Latin-1,
+// then UCS-2 for everything else, like emoji
+func EncodeText(text string) (uint16, []byte) {
+	charset := uint16(CharsetASCII)
+	for _, r := range text {
+		if r >= 0x100 {
+			charset = CharsetUCS2
+			break
+		}
+		if r >= 0x80 {
+			charset = CharsetLatin1
+		}
+	}
+
+	switch charset {
+	case CharsetUCS2:
+		units := utf16.Encode([]rune(text))
+		data := make([]byte, 2*len(units))
+		for i, unit := range units {
+			binary.BigEndian.PutUint16(data[2*i:], unit)
+		}
+		return charset, data
+
+	case CharsetLatin1:
+		data := make([]byte, 0, len(text))
+		for _, r := range text {
+			data = append(data, byte(r))
+		}
+		return charset, data
+	}
+
+	return charset, []byte(text)
+}
+
+// EncodeLatin1 converts UTF-8 text to Latin-1 for clients that only speak it, like old ICQ
+// clients. Characters outside Latin-1 become question marks.
+func EncodeLatin1(text string) []byte {
+	data := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r >= 0x100 {
+			r = '?'
+		}
+		data = append(data, byte(r))
+	}
+	return data
+}
@@ -0,0 +1,78 @@
+package oscar
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeText(t *testing.T) {
+	tt := map[string]struct {
+		text    string
+		charset uint16
+		data    []byte
+	}{
+		"ASCII":    {"hi", CharsetASCII, []byte("hi")},
+		"accented": {"café", CharsetLatin1, []byte{'c', 'a', 'f', 0xe9}},
+		"emoji":    {"hi 😀", CharsetUCS2, []byte{0, 'h', 0, 'i', 0, ' ', 0xd8, 0x3d, 0xde, 0x00}},
+		"CJK":      {"日本", CharsetUCS2, []byte{0x65, 0xe5, 0x67, 0x2c}},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			charset, data := EncodeText(tc.text)
+			if charset != tc.charset || !bytes.Equal(data, tc.data) {
+				t.Errorf("expected charset 0x%04x %v, got 0x%04x %v", tc.charset, tc.data, charset, data)
+			}
+
+			text, err := DecodeText(charset, data)
+			if err != nil || text != tc.text {
+				t.Errorf("expected %q to survive the round trip, got %q %v", tc.text, text, err)
+			}
+		})
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tt := map[string]struct {
+		charset uint16
+		data    []byte
+		text    string
+	}{
+		"UTF-8 sent as ASCII":       {CharsetASCII, []byte("café 😀"), "café 😀"},
+		"Latin-1 sent as ASCII":     {CharsetASCII, []byte{'c', 'a', 'f', 0xe9}, "café"},
+		"Latin-1":                   {CharsetLatin1, []byte{'c', 'a', 'f', 0xe9}, "café"},
+		"UCS-2 with surrogate pair": {CharsetUCS2, []byte{0xd8, 0x3d, 0xde, 0x00}, "😀"},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			text, err := DecodeText(tc.charset, tc.data)
+			if err != nil || text != tc.text {
+				t.Errorf("expected %q, got %q %v", tc.text, text, err)
+			}
+		})
+	}
+
+	if _, err := DecodeText(CharsetUCS2, []byte{0, 'h', 0}); err == nil {
+		t.Errorf("expected UCS-2 with an odd length to fail")
+	}
+}
+
+func TestEncodeLatin1(t *testing.T) {
+	tt := map[string]struct {
+		text string
+		data []byte
+	}{
+		"ASCII":           {"hi", []byte("hi")},
+		"ICQ separator":   {"Homepage\u00fehttp://example.com", append([]byte("Homepage\xfe"), "http://example.com"...)},
+		"outside Latin-1": {"hi 😀", []byte("hi ?")},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if data := EncodeLatin1(tc.text); !bytes.Equal(data, tc.data) {
+				t.Errorf("expected %v, got %v", tc.data, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+// Package client is an OSCAR client for tests and tools, like the load tester, that need to
+// talk to the server the way AIM clients do without building FLAPs by hand.
+package client
+
+import (
+	"aim-oscar/oscar"
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const aimMD5String = "AOL Instant Messenger (SM)"
+
+// DialTimeout is how long connecting to a server can take
+var DialTimeout = 10 * time.Second
+
+// Client is one user's connection to the server. It starts out connected to the authorization
+// server, and is connected to BOS once it logs in.
+type Client struct {
+	ScreenName string
+
+	conn   net.Conn
+	reader *bufio.Reader
+	events chan Event
+
+	writeMutex sync.Mutex
+	seq        uint16
+	requestID  uint32
+	cookie     uint64
+}
+
+// Dial connects to the authorization server at addr
+func Dial(addr string) (*Client, error) {
+	c := &Client{events: make(chan Event, 64)}
+	if err := c.connect(addr); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect opens a connection and waits for the server's hello
+func (c *Client) connect(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, DialTimeout)
+	if err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.seq = 0
+	c.writeMutex.Unlock()
+
+	hello, err := c.readFLAP()
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "could not read hello")
+	}
+	if hello.Header.Channel != 1 {
+		conn.Close()
+		return fmt.Errorf("expected a hello on channel 1, got channel %d", hello.Header.Channel)
+	}
+	return nil
+}
+
+// Events are what the server sends once the client has logged in, until it's disconnected.
+// The client stops reading from the server while nothing takes them.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Close disconnects from the server
+func (c *Client) Close() error {
+	c.Send(oscar.NewFLAP(4))
+	return c.conn.Close()
+}
+
+// Send sends a FLAP, numbered after the ones sent before it
+func (c *Client) Send(flap *oscar.FLAP) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.seq = oscar.NextSequenceNumber(c.seq)
+	flap.Header.SequenceNumber = c.seq
+	data, err := flap.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(data)
+	return err
+}
+
+// SendSNAC sends a SNAC on channel 2 and returns its request ID
+func (c *Client) SendSNAC(snac *oscar.SNAC) (uint32, error) {
+	c.writeMutex.Lock()
+	c.requestID++
+	snac.Header.RequestID = c.requestID
+	c.writeMutex.Unlock()
+
+	flap := oscar.NewFLAP(2)
+	flap.Data.WriteBinary(snac)
+	return snac.Header.RequestID, c.Send(flap)
+}
+
+func (c *Client) readFLAP() (*oscar.FLAP, error) {
+	return oscar.ReadFLAP(c.reader, 0)
+}
+
+// readSNAC reads FLAPs until one of the SNACs, skipping anything else the server sends
+// meanwhile. An error from the same family is returned as an error, and so is a reply that
+// doesn't have the ID of the request it answers, unless requestID is 0.
+func (c *Client) readSNAC(requestID uint32, family uint16, subtypes ...uint16) (*oscar.SNAC, error) {
+	for {
+		flap, err := c.readFLAP()
+		if err != nil {
+			return nil, err
+		}
+		if flap.Header.Channel == 4 {
+			return nil, errors.New("server closed the connection")
+		}
+		if flap.Header.Channel != 2 {
+			continue
+		}
+
+		snac := &oscar.SNAC{}
+		if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
+			return nil, err
+		}
+		if snac.Header.Family != family {
+			continue
+		}
+		if requestID != 0 && snac.Header.RequestID != requestID {
+			return nil, fmt.Errorf("reply 0x%02x,0x%02x has request ID %d, expected %d", family, snac.Header.Subtype, snac.Header.RequestID, requestID)
+		}
+		if snac.Header.Subtype == 0x01 {
+			code, _ := snac.Data.ReadUint16()
+			return nil, fmt.Errorf("error 0x%02x waiting for SNAC 0x%02x,%v", code, family, subtypes)
+		}
+		for _, subtype := range subtypes {
+			if snac.Header.Subtype == subtype {
+				return snac, nil
+			}
+		}
+	}
+}
+
+// Register creates an account from the authorization server, like the sign up screen of a
+// client. The server has to have open registration.
+func (c *Client) Register(screenName, password, email string) error {
+	snac := oscar.NewSNAC(0x17, 0x04)
+	snac.WriteTLV(oscar.NewTLV(0x01, []byte(screenName)))
+	snac.WriteTLV(oscar.NewTLV(0x02, []byte(password)))
+	snac.WriteTLV(oscar.NewTLV(0x11, []byte(email)))
+	requestID, err := c.SendSNAC(snac)
+	if err != nil {
+		return err
+	}
+
+	reply, err := c.readSNAC(requestID, 0x17, 0x05)
+	if err != nil {
+		return err
+	}
+	tlvs, err := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if err != nil {
+		return err
+	}
+	if codeTLV := oscar.FindTLV(tlvs, 0x08); codeTLV != nil && len(codeTLV.Data) == 2 {
+		return &RegistrationError{Code: binary.BigEndian.Uint16(codeTLV.Data)}
+	}
+	return nil
+}
+
+// RegistrationError is the server turning down a registration
+type RegistrationError struct {
+	Code uint16
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("registration failed with code 0x%02x", e.Code)
+}
+
+// LoginError is the authorization server turning down a login, like for a wrong password
+type LoginError struct {
+	Code uint16
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("login refused with code 0x%02x", e.Code)
+}
+
+// loginError reads the error code out of a login reply (0x17,0x03)
+func loginError(reply *oscar.SNAC) error {
+	tlvs, err := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if err != nil {
+		return err
+	}
+	loginErr := &LoginError{}
+	if codeTLV := oscar.FindTLV(tlvs, 0x08); codeTLV != nil && len(codeTLV.Data) == 2 {
+		loginErr.Code = binary.BigEndian.Uint16(codeTLV.Data)
+	}
+	return loginErr
+}
+
+// Login logs in on the authorization server with an MD5 login, then signs on to the BOS
+// server it's sent to. Events start coming once it's signed on.
+func (c *Client) Login(screenName, password string) error {
+	keySnac := oscar.NewSNAC(0x17, 0x06)
+	keySnac.WriteTLV(oscar.NewTLV(0x01, []byte(screenName)))
+	requestID, err := c.SendSNAC(keySnac)
+	if err != nil {
+		return err
+	}
+	keyReply, err := c.readSNAC(requestID, 0x17, 0x07, 0x03)
+	if err != nil {
+		return errors.Wrap(err, "could not get auth key")
+	}
+	if keyReply.Header.Subtype == 0x03 {
+		return loginError(keyReply)
+	}
+	key, err := keyReply.Data.ReadLPUint16String()
+	if err != nil {
+		return errors.Wrap(err, "could not read auth key")
+	}
+
+	hash := md5.New()
+	io.WriteString(hash, key)
+	io.WriteString(hash, password)
+	io.WriteString(hash, aimMD5String)
+	authSnac := oscar.NewSNAC(0x17, 0x02)
+	authSnac.WriteTLV(oscar.NewTLV(0x01, []byte(screenName)))
+	authSnac.WriteTLV(oscar.NewTLV(0x25, hash.Sum(nil)))
+	requestID, err = c.SendSNAC(authSnac)
+	if err != nil {
+		return err
+	}
+	authReply, err := c.readSNAC(requestID, 0x17, 0x03)
+	if err != nil {
+		return errors.Wrap(err, "could not log in")
+	}
+	c.conn.Close()
+
+	tlvs, err := oscar.UnmarshalTLVs(authReply.Data.Bytes())
+	if err != nil {
+		return err
+	}
+	bosTLV, cookieTLV := oscar.FindTLV(tlvs, 0x05), oscar.FindTLV(tlvs, 0x06)
+	if bosTLV == nil || cookieTLV == nil {
+		return loginError(authReply)
+	}
+
+	if err := c.connect(string(bosTLV.Data)); err != nil {
+		return errors.Wrap(err, "could not connect to BOS")
+	}
+
+	cookieFlap := oscar.NewFLAP(1)
+	cookieFlap.Data.WriteUint32(1)
+	cookieFlap.Data.WriteBinary(cookieTLV)
+	if err := c.Send(cookieFlap); err != nil {
+		return err
+	}
+	// The services the server has aren't a reply to anything
+	if _, err := c.readSNAC(0, 0x01, 0x03); err != nil {
+		return errors.Wrap(err, "could not sign on to BOS")
+	}
+
+	requestID, err = c.SendSNAC(oscar.NewSNAC(0x01, 0x17))
+	if err != nil {
+		return err
+	}
+	if _, err := c.readSNAC(requestID, 0x01, 0x18); err != nil {
+		return errors.Wrap(err, "could not get service versions")
+	}
+
+	c.ScreenName = screenName
+	go c.run()
+
+	_, err = c.SendSNAC(oscar.NewSNAC(0x01, 0x02))
+	return err
+}
+
+// run decodes what the server sends into events until the connection closes
+func (c *Client) run() {
+	defer close(c.events)
+
+	for {
+		flap, err := c.readFLAP()
+		if err != nil {
+			c.events <- &Disconnected{Err: err}
+			return
+		}
+
+		switch flap.Header.Channel {
+		case 2:
+			snac := &oscar.SNAC{}
+			if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
+				continue
+			}
+			event, err := decodeSNAC(snac)
+			if err != nil {
+				continue
+			}
+			c.events <- event
+		case 4:
+			c.events <- &Disconnected{}
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// SendIM sends an instant message, which the server keeps for the recipient if they're
+// offline
+func (c *Client) SendIM(to, text string) error {
+	c.writeMutex.Lock()
+	c.cookie++
+	cookie := c.cookie
+	c.writeMutex.Unlock()
+
+	snac := oscar.NewSNAC(0x04, 0x06)
+	snac.Data.WriteUint64(cookie)
+	snac.Data.WriteUint16(1) // channel
+	snac.Data.WriteLPString(to)
+
+	charset, data := oscar.EncodeText(text)
+	fragments := oscar.Buffer{}
+	fragments.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x01}) // required capabilities
+	fragments.Write([]byte{0x01, 0x01})                   // message text
+	fragments.WriteUint16(uint16(4 + len(data)))
+	fragments.WriteUint16(charset)
+	fragments.WriteUint16(0) // subcharset
+	fragments.Write(data)
+	snac.WriteTLV(oscar.NewTLV(0x02, fragments.Bytes()))
+	snac.WriteTLV(oscar.NewTLV(0x06, nil)) // store if the recipient is offline
+
+	_, err := c.SendSNAC(snac)
+	return err
+}
+
+// AddBuddy adds screen names to the buddy list
+func (c *Client) AddBuddy(screenNames ...string) error {
+	snac := oscar.NewSNAC(0x03, 0x04)
+	for _, screenName := range screenNames {
+		snac.Data.WriteLPString(screenName)
+	}
+	_, err := c.SendSNAC(snac)
+	return err
+}
+
+// SetAway puts up an away message, or takes it down if it's empty
+func (c *Client) SetAway(message string) error {
+	snac := oscar.NewSNAC(0x02, 0x04)
+	if message != "" {
+		snac.WriteTLV(oscar.NewTLV(0x03, []byte(`text/aolrtf; charset="us-ascii"`)))
+	}
+	snac.WriteTLV(oscar.NewTLV(0x04, []byte(message)))
+	_, err := c.SendSNAC(snac)
+	return err
+}
+
+// Keepalive tells the server the client is still there
+func (c *Client) Keepalive() error {
+	return c.Send(oscar.NewFLAP(5))
+}
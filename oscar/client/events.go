@@ -0,0 +1,181 @@
+package client
+
+import (
+	"aim-oscar/oscar"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Event is something the server told the client, decoded from the SNAC it came in
+type Event interface{}
+
+// IMReceived is an instant message sent to the user (0x04,0x07)
+type IMReceived struct {
+	From   string
+	Text   string
+	Cookie uint64
+
+	// SentAt is when a message that waited for the user to sign on was sent, zero for messages
+	// delivered straight away
+	SentAt time.Time
+
+	// Auto is whether the message is an automatic reply, like an away message
+	Auto bool
+}
+
+// BuddyArrived is a buddy signing on or changing their status (0x03,0x0b)
+type BuddyArrived struct {
+	ScreenName string
+	Class      uint16
+	TLVs       []*oscar.TLV
+}
+
+// Away is whether the buddy has an away message up
+func (b *BuddyArrived) Away() bool {
+	return b.Class&0x20 != 0
+}
+
+// BuddyDeparted is a buddy signing off (0x03,0x0c)
+type BuddyDeparted struct {
+	ScreenName string
+}
+
+// SNACError is an error reply from one of the server's services
+type SNACError struct {
+	Family    uint16
+	Code      uint16
+	RequestID uint32
+}
+
+// RateChanged is the server saying the client crossed a rate limit threshold (0x01,0x0a)
+type RateChanged struct {
+	Code uint16
+}
+
+// Disconnected is the connection to the server closing. It's the last event before the
+// channel is closed.
+type Disconnected struct {
+	Err error
+}
+
+// UnknownSNAC is a SNAC the client doesn't decode
+type UnknownSNAC struct {
+	SNAC *oscar.SNAC
+}
+
+// decodeSNAC turns a SNAC from the server into an Event
+func decodeSNAC(snac *oscar.SNAC) (Event, error) {
+	switch {
+	case snac.Header.Subtype == 0x01:
+		code, _ := snac.Data.ReadUint16()
+		return &SNACError{Family: snac.Header.Family, Code: code, RequestID: snac.Header.RequestID}, nil
+
+	case snac.Header.Family == 0x01 && snac.Header.Subtype == 0x0a:
+		code, _ := snac.Data.ReadUint16()
+		return &RateChanged{Code: code}, nil
+
+	case snac.Header.Family == 0x03 && snac.Header.Subtype == 0x0b:
+		return decodeBuddyArrived(snac)
+
+	case snac.Header.Family == 0x03 && snac.Header.Subtype == 0x0c:
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil {
+			return nil, err
+		}
+		return &BuddyDeparted{ScreenName: screenName}, nil
+
+	case snac.Header.Family == 0x04 && snac.Header.Subtype == 0x07:
+		return decodeIM(snac)
+	}
+
+	return &UnknownSNAC{SNAC: snac}, nil
+}
+
+func decodeBuddyArrived(snac *oscar.SNAC) (*BuddyArrived, error) {
+	screenName, err := snac.Data.ReadLPString()
+	if err != nil {
+		return nil, err
+	}
+	snac.Data.ReadUint16() // warning level
+	count, err := snac.Data.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	tlvs, err := snac.Data.ReadTLVs(int(count))
+	if err != nil {
+		return nil, err
+	}
+
+	arrived := &BuddyArrived{ScreenName: screenName, TLVs: tlvs}
+	if classTLV := oscar.FindTLV(tlvs, 0x01); classTLV != nil && len(classTLV.Data) == 2 {
+		arrived.Class = binary.BigEndian.Uint16(classTLV.Data)
+	}
+	return arrived, nil
+}
+
+// decodeIM reads a channel 1 message. Messages on other channels, like rendezvous, aren't
+// IMs the client knows about.
+func decodeIM(snac *oscar.SNAC) (Event, error) {
+	cookie, _ := snac.Data.ReadUint64()
+	channel, _ := snac.Data.ReadUint16()
+	if channel != 1 {
+		return &UnknownSNAC{SNAC: snac}, nil
+	}
+
+	from, err := snac.Data.ReadLPString()
+	if err != nil {
+		return nil, err
+	}
+	snac.Data.ReadUint16() // warning level
+
+	// The sender's user info
+	count, err := snac.Data.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := snac.Data.ReadTLVs(int(count)); err != nil {
+		return nil, err
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	messageTLV := oscar.FindTLV(tlvs, 0x02)
+	if messageTLV == nil {
+		return nil, errors.New("missing message TLV 0x02")
+	}
+	text, err := messageText(messageTLV.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	im := &IMReceived{From: from, Text: text, Cookie: cookie, Auto: oscar.FindTLV(tlvs, 0x04) != nil}
+	if sentTLV := oscar.FindTLV(tlvs, 0x16); sentTLV != nil && len(sentTLV.Data) == 4 {
+		im.SentAt = time.Unix(int64(binary.BigEndian.Uint32(sentTLV.Data)), 0)
+	}
+	return im, nil
+}
+
+// messageText finds the text fragment among the fragments of a message TLV
+func messageText(data []byte) (string, error) {
+	fragments := oscar.Buffer{}
+	fragments.Write(data)
+	for len(fragments.Bytes()) > 0 {
+		id, _ := fragments.ReadUint8()
+		fragments.ReadUint8() // version
+		length, err := fragments.ReadUint16()
+		if err != nil {
+			return "", err
+		}
+		fragment, err := fragments.ReadBytes(int(length))
+		if err != nil {
+			return "", err
+		}
+		if id == 0x01 && len(fragment) >= 4 {
+			return oscar.DecodeText(binary.BigEndian.Uint16(fragment[0:2]), fragment[4:])
+		}
+	}
+	return "", errors.New("missing message text")
+}
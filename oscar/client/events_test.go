@@ -0,0 +1,89 @@
+package client
+
+import (
+	"aim-oscar/oscar"
+	"testing"
+	"time"
+)
+
+// incomingIM builds a message the way the server delivers it
+func incomingIM(from, text string, sentAt time.Time) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x04, 0x07)
+	snac.Data.WriteUint64(42)
+	snac.Data.WriteUint16(1)
+	snac.Data.WriteLPString(from)
+	snac.Data.WriteUint16(0)
+	snac.AppendTLVs([]*oscar.TLV{oscar.NewTLV(0x01, []byte{0, 0x10}), oscar.NewTLV(0x06, []byte{0, 0, 0, 0})})
+
+	charset, data := oscar.EncodeText(text)
+	fragments := oscar.Buffer{}
+	fragments.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x01})
+	fragments.Write([]byte{0x01, 0x01})
+	fragments.WriteUint16(uint16(4 + len(data)))
+	fragments.WriteUint16(charset)
+	fragments.WriteUint16(0)
+	fragments.Write(data)
+	snac.Data.WriteBinary(oscar.NewTLV(0x02, fragments.Bytes()))
+
+	if !sentAt.IsZero() {
+		snac.Data.WriteBinary(oscar.NewTLV(0x06, nil))
+		sent := oscar.Buffer{}
+		sent.WriteUint32(uint32(sentAt.Unix()))
+		snac.Data.WriteBinary(oscar.NewTLV(0x16, sent.Bytes()))
+	}
+	return snac
+}
+
+func TestDecodeIM(t *testing.T) {
+	event, err := decodeSNAC(incomingIM("alice", "hi bob ☃", time.Time{}))
+	if err != nil {
+		t.Fatalf("could not decode IM: %s", err)
+	}
+	im, ok := event.(*IMReceived)
+	if !ok {
+		t.Fatalf("expected an IM, got %T", event)
+	}
+	if im.From != "alice" || im.Text != "hi bob ☃" || im.Cookie != 42 || !im.SentAt.IsZero() {
+		t.Errorf("unexpected IM %+v", im)
+	}
+
+	sentAt := time.Unix(1700000000, 0)
+	event, err = decodeSNAC(incomingIM("alice", "later", sentAt))
+	if err != nil {
+		t.Fatalf("could not decode IM: %s", err)
+	}
+	if im := event.(*IMReceived); !im.SentAt.Equal(sentAt) {
+		t.Errorf("expected the offline IM to be sent at %s, got %s", sentAt, im.SentAt)
+	}
+}
+
+func TestDecodeBuddies(t *testing.T) {
+	arrived := oscar.NewSNAC(0x03, 0x0b)
+	arrived.Data.WriteLPString("bob")
+	arrived.Data.WriteUint16(0)
+	arrived.AppendTLVs([]*oscar.TLV{oscar.NewTLV(0x01, []byte{0, 0x30})})
+
+	event, err := decodeSNAC(arrived)
+	if err != nil {
+		t.Fatalf("could not decode arrival: %s", err)
+	}
+	if buddy, ok := event.(*BuddyArrived); !ok || buddy.ScreenName != "bob" || !buddy.Away() {
+		t.Errorf("expected bob to arrive away, got %+v", event)
+	}
+
+	departed := oscar.NewSNAC(0x03, 0x0c)
+	departed.Data.WriteLPString("bob")
+	event, err = decodeSNAC(departed)
+	if err != nil {
+		t.Fatalf("could not decode departure: %s", err)
+	}
+	if buddy, ok := event.(*BuddyDeparted); !ok || buddy.ScreenName != "bob" {
+		t.Errorf("expected bob to depart, got %+v", event)
+	}
+
+	errorSnac := oscar.NewSNACError(0x04, 7, 0x04)
+	event, _ = decodeSNAC(errorSnac)
+	if snacErr, ok := event.(*SNACError); !ok || snacErr.Family != 0x04 || snacErr.Code != 0x04 || snacErr.RequestID != 7 {
+		t.Errorf("expected a not logged in error, got %+v", event)
+	}
+}
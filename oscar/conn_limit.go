@@ -0,0 +1,60 @@
+package oscar
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnLimiter caps how many connections each remote IP can have open at once. IPs are
+// forgotten once their last connection closes, so it only holds the IPs that are connected.
+type ConnLimiter struct {
+	max int
+
+	mutex sync.Mutex
+	conns map[string]int
+}
+
+// NewConnLimiter allows max connections per IP. A max of 0 doesn't limit them.
+func NewConnLimiter(max int) *ConnLimiter {
+	return &ConnLimiter{max: max, conns: make(map[string]int)}
+}
+
+// Acquire counts a new connection from ip. Returns false, without counting it, if ip already
+// has as many connections as it's allowed.
+func (l *ConnLimiter) Acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.max > 0 && l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// Release forgets a connection from ip that Acquire counted
+func (l *ConnLimiter) Release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
+
+// Len is how many IPs have connections open
+func (l *ConnLimiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.conns)
+}
+
+// addrIP is the IP of addr, or the whole address if it doesn't have a port
+func addrIP(addr net.Addr) string {
+	if ip, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return ip
+	}
+	return addr.String()
+}
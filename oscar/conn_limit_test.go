@@ -0,0 +1,121 @@
+package oscar
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := NewConnLimiter(2)
+
+	if !l.Acquire("192.0.2.1") || !l.Acquire("192.0.2.1") {
+		t.Fatalf("expected 2 connections from one IP to be allowed")
+	}
+	if l.Acquire("192.0.2.1") {
+		t.Errorf("expected a third connection from the IP to be refused")
+	}
+	if !l.Acquire("192.0.2.2") {
+		t.Errorf("expected another IP to be allowed")
+	}
+
+	l.Release("192.0.2.1")
+	if !l.Acquire("192.0.2.1") {
+		t.Errorf("expected a connection to be allowed once one closed")
+	}
+
+	// IPs without connections are forgotten
+	l.Release("192.0.2.1")
+	l.Release("192.0.2.1")
+	l.Release("192.0.2.2")
+	if n := l.Len(); n != 0 {
+		t.Errorf("expected every IP to be forgotten, got %d", n)
+	}
+}
+
+func TestConnLimiterUnlimited(t *testing.T) {
+	l := NewConnLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !l.Acquire("192.0.2.1") {
+			t.Fatalf("expected connection %d to be allowed", i)
+		}
+	}
+}
+
+// addrConn is a connection from a made up address
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// fakeListener accepts the connections sent on conns
+type fakeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5190}
+}
+
+func TestHandlerConnLimit(t *testing.T) {
+	listener := &fakeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context { return ctx }, func(ctx context.Context, s *Session) {})
+	h.ConnLimiter = NewConnLimiter(1)
+	go h.Serve(listener, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer listener.Close()
+
+	connect := func(ip string) net.Conn {
+		server, client := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		listener.conns <- &addrConn{Conn: server, addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+		return client
+	}
+
+	first := connect("192.0.2.1")
+	readFLAP(t, first) // hello
+
+	// A second connection from the same IP is closed without a hello
+	second := connect("192.0.2.1")
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the second connection to be closed, got %v", err)
+	}
+
+	// Other IPs aren't affected
+	readFLAP(t, connect("192.0.2.2"))
+
+	// Once the first connection is gone the IP can connect again
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for !h.ConnLimiter.Acquire("192.0.2.1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the first connection to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.ConnLimiter.Release("192.0.2.1")
+	readFLAP(t, connect("192.0.2.1"))
+}
@@ -2,12 +2,28 @@ package oscar
 
 import (
 	"aim-oscar/util"
-	"bytes"
 	"encoding"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 )
 
+// Errors decoding FLAPs, SNACs and TLVs from clients. Truncated data can be ignored, while a
+// client sending oversized FLAPs or something other than FLAPs has to be disconnected since
+// there's no telling where its next FLAP starts.
+var (
+	// ErrTruncated is data that ends before the lengths in it say it should
+	ErrTruncated = errors.New("truncated")
+	// ErrOversized is a FLAP bigger than the server accepts
+	ErrOversized = errors.New("oversized")
+	// ErrNotFLAP is data that doesn't start with the FLAP marker
+	ErrNotFLAP = errors.New("missing FLAP 0x2a marker")
+)
+
+// flapHeaderLength is the marker, channel, sequence number and data length of a FLAP
+const flapHeaderLength = 6
+
 var _ encoding.BinaryUnmarshaler = &FLAP{}
 var _ encoding.BinaryMarshaler = &FLAP{}
 
@@ -22,11 +38,21 @@ type FLAP struct {
 	Data   Buffer
 }
 
+// MaxSequenceNumber is the largest FLAP sequence number, after which they wrap around to 0
+const MaxSequenceNumber = 0x7fff
+
+// NextSequenceNumber is the sequence number of the FLAP after the one numbered seq
+func NextSequenceNumber(seq uint16) uint16 {
+	return (seq + 1) & MaxSequenceNumber
+}
+
+// NewFLAP makes a FLAP numbered as the first of a connection. Session.Send renumbers it
+// to follow the FLAPs sent before it.
 func NewFLAP(channel uint8) *FLAP {
 	return &FLAP{
 		Header: FLAPHeader{
 			Channel:        channel,
-			SequenceNumber: 0,
+			SequenceNumber: NextSequenceNumber(0),
 			DataLength:     0,
 		},
 	}
@@ -50,26 +76,62 @@ func (f *FLAP) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// UnmarshalBinary reads one FLAP. Data past the FLAP's data length is ignored.
 func (f *FLAP) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	start, err := buf.ReadByte()
-	if err != nil {
-		return err
+	if len(data) < flapHeaderLength {
+		return ErrTruncated
 	}
-	if start != 0x2a {
-		return fmt.Errorf("FLAP missing 0x2a header")
+	if data[0] != 0x2a {
+		return ErrNotFLAP
 	}
 
-	if err = binary.Read(buf, binary.BigEndian, &f.Header); err != nil {
-		return err
+	f.Header.Channel = data[1]
+	f.Header.SequenceNumber = binary.BigEndian.Uint16(data[2:4])
+	f.Header.DataLength = binary.BigEndian.Uint16(data[4:6])
+	end := flapHeaderLength + int(f.Header.DataLength)
+	if len(data) < end {
+		return ErrTruncated
 	}
 
-	f.Data.Write(buf.Bytes())
+	f.Data.Write(data[flapHeaderLength:end])
 	return nil
 }
 
+// ReadFLAP reads exactly one FLAP from r, however its bytes are split across reads. Returns
+// ErrNotFLAP if r doesn't start with a FLAP and ErrOversized if the FLAP's data is longer than
+// maxDataLength (0 allows any length), before reading the data. Errors reading from r are
+// returned as they are, except for r ending in the middle of a FLAP, which is
+// io.ErrUnexpectedEOF.
+func ReadFLAP(r io.Reader, maxDataLength int) (*FLAP, error) {
+	header := make([]byte, flapHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x2a {
+		return nil, ErrNotFLAP
+	}
+
+	flap := &FLAP{}
+	flap.Header.Channel = header[1]
+	flap.Header.SequenceNumber = binary.BigEndian.Uint16(header[2:4])
+	flap.Header.DataLength = binary.BigEndian.Uint16(header[4:6])
+	if maxDataLength > 0 && int(flap.Header.DataLength) > maxDataLength {
+		return nil, ErrOversized
+	}
+
+	data := make([]byte, flap.Header.DataLength)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	flap.Data.Write(data)
+	return flap, nil
+}
+
 func (f *FLAP) Len() int {
-	return 6 + int(f.Header.DataLength)
+	return flapHeaderLength + int(f.Header.DataLength)
 }
 
 func (f *FLAP) String() string {
@@ -1,8 +1,12 @@
 package oscar
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 func TestFLAP(t *testing.T) {
@@ -41,3 +45,123 @@ func TestUnmarshalFLAP(t *testing.T) {
 		t.Errorf("FLAP body should be %x, got %x", b[6:], hello.Data.Bytes())
 	}
 }
+
+func TestUnmarshalFLAPTruncated(t *testing.T) {
+	tests := map[string][]byte{
+		"short header":     {0x2a, 1, 0},
+		"data length lies": {0x2a, 1, 0, 1, 0, 8, 0, 0, 0, 1},
+		"missing all data": {0x2a, 2, 0, 1, 0xff, 0xff},
+		"empty":            {},
+	}
+	for name, b := range tests {
+		flap := FLAP{}
+		if err := flap.UnmarshalBinary(b); !errors.Is(err, ErrTruncated) {
+			t.Errorf("%s: expected ErrTruncated, got %v", name, err)
+		}
+	}
+
+	flap := FLAP{}
+	if err := flap.UnmarshalBinary([]byte{0x2b, 1, 0, 1, 0, 0}); !errors.Is(err, ErrNotFLAP) {
+		t.Errorf("expected ErrNotFLAP, got %v", err)
+	}
+}
+
+func TestReadFLAP(t *testing.T) {
+	b := []byte{0x2a, 1, 0, 1, 0, 4, 0, 0, 0, 1, 0x2a, 2, 0, 2, 0, 0}
+
+	// However the FLAPs are split up, the same FLAPs come out
+	for name, r := range map[string]io.Reader{
+		"whole":          bytes.NewReader(b),
+		"one byte reads": iotest.OneByteReader(bytes.NewReader(b)),
+		"half reads":     iotest.HalfReader(bytes.NewReader(b)),
+	} {
+		flap, err := ReadFLAP(r, 0)
+		if err != nil {
+			t.Fatalf("%s: could not read FLAP: %s", name, err)
+		}
+		if flap.Header.Channel != 1 || !bytes.Equal(flap.Data.Bytes(), []byte{0, 0, 0, 1}) {
+			t.Errorf("%s: expected the hello, got channel %d with %x", name, flap.Header.Channel, flap.Data.Bytes())
+		}
+
+		flap, err = ReadFLAP(r, 0)
+		if err != nil {
+			t.Fatalf("%s: could not read FLAP: %s", name, err)
+		}
+		if flap.Header.Channel != 2 || flap.Header.SequenceNumber != 2 || len(flap.Data.Bytes()) != 0 {
+			t.Errorf("%s: expected an empty FLAP on channel 2, got channel %d with %x", name, flap.Header.Channel, flap.Data.Bytes())
+		}
+
+		if _, err := ReadFLAP(r, 0); err != io.EOF {
+			t.Errorf("%s: expected EOF after the last FLAP, got %v", name, err)
+		}
+	}
+}
+
+func TestReadFLAPErrors(t *testing.T) {
+	tests := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"oversized":        {[]byte{0x2a, 2, 0, 1, 0x10, 0x00}, ErrOversized},
+		"not a FLAP":       {[]byte("GET / HTTP/1.1\r\n"), ErrNotFLAP},
+		"partial header":   {[]byte{0x2a, 1, 0}, io.ErrUnexpectedEOF},
+		"data length lies": {[]byte{0x2a, 1, 0, 1, 0, 8, 0, 0, 0, 1}, io.ErrUnexpectedEOF},
+		"no data":          {[]byte{0x2a, 1, 0, 1, 0, 8}, io.ErrUnexpectedEOF},
+	}
+	for name, test := range tests {
+		if _, err := ReadFLAP(bytes.NewReader(test.data), 1024); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", name, test.err, err)
+		}
+	}
+}
+
+func FuzzUnmarshalFLAP(f *testing.F) {
+	f.Add([]byte{0x2a, 1, 0, 1, 0, 4, 0, 0, 0, 1})
+	f.Add([]byte{0x2a, 2, 0, 1, 0, 8, 0, 0, 0, 1})
+	f.Add([]byte{0x2a, 4, 0xff, 0xff, 0, 0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		flap := FLAP{}
+		if err := flap.UnmarshalBinary(b); err != nil {
+			if !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrNotFLAP) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+
+		out, err := flap.MarshalBinary()
+		if err != nil {
+			t.Fatalf("could not marshal: %s", err)
+		}
+		if !bytes.Equal(out, b[:flap.Len()]) {
+			t.Errorf("expected %x to marshal back, got %x", b[:flap.Len()], out)
+		}
+	})
+}
+
+func FuzzReadFLAP(f *testing.F) {
+	f.Add([]byte{0x2a, 1, 0, 1, 0, 4, 0, 0, 0, 1, 0x2a, 2, 0, 2, 0, 0})
+	f.Add([]byte{0x2a, 2, 0, 1, 0x10, 0x00})
+	f.Add([]byte{0x2a, 1, 0, 1})
+
+	const maxDataLength = 1024
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bytes.NewReader(b)
+		for {
+			before := r.Len()
+			flap, err := ReadFLAP(iotest.OneByteReader(r), maxDataLength)
+			if err != nil {
+				if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, ErrOversized) && !errors.Is(err, ErrNotFLAP) {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if len(flap.Data.Bytes()) > maxDataLength || len(flap.Data.Bytes()) != int(flap.Header.DataLength) {
+				t.Fatalf("FLAP has %d bytes of data, header says %d", len(flap.Data.Bytes()), flap.Header.DataLength)
+			}
+			if read := before - r.Len(); read != flap.Len() {
+				t.Fatalf("expected %d bytes to be read, got %d", flap.Len(), read)
+			}
+		}
+	})
+}
@@ -0,0 +1,245 @@
+package oscar
+
+import (
+	"sync"
+	"time"
+)
+
+// RateState is where a rate class's current level sits relative to its thresholds
+type RateState uint8
+
+const (
+	RateStateClear      RateState = 0
+	RateStateAlert      RateState = 1
+	RateStateLimited    RateState = 2
+	RateStateDisconnect RateState = 3
+)
+
+// Codes for the rate change notification SNAC 0x01,0x0A
+const (
+	RateCodeChanged = 0x0001
+	RateCodeWarning = 0x0002
+	RateCodeLimited = 0x0003
+	RateCodeClear   = 0x0004
+)
+
+// RateClass defines how fast clients are allowed to send the SNACs in the class. Levels are a
+// moving average of the milliseconds between SNACs over WindowSize SNACs; the lower the level,
+// the faster the client is sending.
+type RateClass struct {
+	ID              uint16
+	WindowSize      uint32
+	ClearLevel      uint32
+	AlertLevel      uint32
+	LimitLevel      uint32
+	DisconnectLevel uint32
+	MaxLevel        uint32
+
+	// SNACs that count against this class, as family<<16 | subtype
+	SNACs []uint32
+}
+
+// Rate classes sent to every client. Class 1 covers everything that isn't in another class.
+var (
+	RateClassGeneral = RateClass{
+		ID:              1,
+		WindowSize:      80,
+		ClearLevel:      2500,
+		AlertLevel:      2000,
+		LimitLevel:      1500,
+		DisconnectLevel: 800,
+		MaxLevel:        6000,
+	}
+
+	RateClassICBM = RateClass{
+		ID:              2,
+		WindowSize:      20,
+		ClearLevel:      5100,
+		AlertLevel:      5000,
+		LimitLevel:      4000,
+		DisconnectLevel: 3000,
+		MaxLevel:        6000,
+		SNACs: []uint32{
+			0x0004<<16 | 0x0006, // send message
+			0x0004<<16 | 0x0008, // warn
+			0x0004<<16 | 0x0014, // typing notification
+		},
+	}
+
+	DefaultRateClasses = []RateClass{RateClassGeneral, RateClassICBM}
+)
+
+type rateClassState struct {
+	RateClass
+	level    uint32
+	lastTime time.Time
+	state    RateState
+}
+
+// RateLimiter tracks how fast a single session sends SNACs in each rate class
+type RateLimiter struct {
+	classes []*rateClassState
+	bySNAC  map[uint32]*rateClassState
+	now     func() time.Time
+	mutex   sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter for the classes. The first class is the default for any
+// SNAC that isn't listed in a class. now is the clock to use, nil for the wall clock.
+func NewRateLimiter(classes []RateClass, now func() time.Time) *RateLimiter {
+	if now == nil {
+		now = time.Now
+	}
+
+	rl := &RateLimiter{
+		bySNAC: make(map[uint32]*rateClassState),
+		now:    now,
+	}
+
+	for _, class := range classes {
+		state := &rateClassState{
+			RateClass: class,
+			level:     class.MaxLevel,
+		}
+		rl.classes = append(rl.classes, state)
+		for _, snac := range class.SNACs {
+			rl.bySNAC[snac] = state
+		}
+	}
+
+	return rl
+}
+
+func (rl *RateLimiter) classFor(family, subtype uint16) *rateClassState {
+	if class, ok := rl.bySNAC[uint32(family)<<16|uint32(subtype)]; ok {
+		return class
+	}
+	if len(rl.classes) == 0 {
+		return nil
+	}
+	return rl.classes[0]
+}
+
+// Check records that the client sent a SNAC and returns the state of its rate class afterwards.
+// changed is true if the state is different from the one the client was last told about, in
+// which case the client should get a rate change notification built with WriteRateChange.
+func (rl *RateLimiter) Check(family, subtype uint16) (class *RateClass, state RateState, changed bool) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	c := rl.classFor(family, subtype)
+	if c == nil {
+		return nil, RateStateClear, false
+	}
+
+	now := rl.now()
+	delta := uint32(c.MaxLevel)
+	if !c.lastTime.IsZero() {
+		ms := now.Sub(c.lastTime).Milliseconds()
+		if ms < int64(c.MaxLevel) {
+			delta = uint32(ms)
+		}
+	}
+
+	level := (uint64(c.level)*uint64(c.WindowSize-1) + uint64(delta)) / uint64(c.WindowSize)
+	if level > uint64(c.MaxLevel) {
+		level = uint64(c.MaxLevel)
+	}
+	c.level = uint32(level)
+	c.lastTime = now
+
+	newState := c.state
+	switch {
+	case c.level < c.DisconnectLevel:
+		newState = RateStateDisconnect
+	case c.level < c.LimitLevel:
+		newState = RateStateLimited
+	case c.level < c.AlertLevel:
+		// Once limited, a client stays limited until it recovers past the clear level
+		if c.state != RateStateLimited {
+			newState = RateStateAlert
+		}
+	case c.level >= c.ClearLevel:
+		newState = RateStateClear
+	}
+
+	changed = newState != c.state
+	c.state = newState
+	return &c.RateClass, newState, changed
+}
+
+func (rl *RateLimiter) writeClass(buf *Buffer, c *rateClassState) {
+	buf.WriteUint16(c.ID)
+	buf.WriteUint32(c.WindowSize)
+	buf.WriteUint32(c.ClearLevel)
+	buf.WriteUint32(c.AlertLevel)
+	buf.WriteUint32(c.LimitLevel)
+	buf.WriteUint32(c.DisconnectLevel)
+	buf.WriteUint32(c.level)
+	buf.WriteUint32(c.MaxLevel)
+
+	var last uint32
+	if !c.lastTime.IsZero() {
+		last = uint32(rl.now().Sub(c.lastTime).Milliseconds())
+	}
+	buf.WriteUint32(last)
+	buf.WriteUint8(uint8(c.state))
+}
+
+// WriteRateParams writes the body of the rate limits response SNAC 0x01,0x07. families are the
+// service families offered to the client; every subtype of those that isn't in a specific class
+// is put in the default class.
+func (rl *RateLimiter) WriteRateParams(buf *Buffer, families []uint16) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	buf.WriteUint16(uint16(len(rl.classes)))
+	for _, c := range rl.classes {
+		rl.writeClass(buf, c)
+	}
+
+	for i, c := range rl.classes {
+		snacs := c.SNACs
+
+		// The default class gets everything else. Subtypes of every family are below 0x21.
+		if i == 0 {
+			snacs = nil
+			for _, family := range families {
+				for subtype := uint16(0); subtype < 0x21; subtype++ {
+					if rl.classFor(family, subtype) == c {
+						snacs = append(snacs, uint32(family)<<16|uint32(subtype))
+					}
+				}
+			}
+		}
+
+		buf.WriteUint16(c.ID)
+		buf.WriteUint16(uint16(len(snacs)))
+		for _, snac := range snacs {
+			buf.WriteUint32(snac)
+		}
+	}
+}
+
+// WriteRateChange writes the body of the rate change notification SNAC 0x01,0x0A for a class
+func (rl *RateLimiter) WriteRateChange(buf *Buffer, class *RateClass, state RateState) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	code := uint16(RateCodeChanged)
+	switch state {
+	case RateStateClear:
+		code = RateCodeClear
+	case RateStateAlert:
+		code = RateCodeWarning
+	case RateStateLimited, RateStateDisconnect:
+		code = RateCodeLimited
+	}
+
+	buf.WriteUint16(code)
+	for _, c := range rl.classes {
+		if c.ID == class.ID {
+			rl.writeClass(buf, c)
+		}
+	}
+}
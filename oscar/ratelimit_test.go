@@ -0,0 +1,123 @@
+package oscar
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestRateLimiterSlowClient(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rl := NewRateLimiter(DefaultRateClasses, clock.Now)
+
+	for i := 0; i < 100; i++ {
+		clock.Advance(5 * time.Second)
+		if _, state, changed := rl.Check(4, 6); state != RateStateClear || changed {
+			t.Fatalf("expected a slow client to stay clear, got state %d (changed %v) after %d messages", state, changed, i)
+		}
+	}
+}
+
+func TestRateLimiterFastClient(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rl := NewRateLimiter(DefaultRateClasses, clock.Now)
+
+	seen := map[RateState]bool{}
+	for i := 0; i < 100; i++ {
+		clock.Advance(100 * time.Millisecond)
+		class, state, changed := rl.Check(4, 6)
+		if class.ID != RateClassICBM.ID {
+			t.Fatalf("expected message sends to use the ICBM rate class, got %d", class.ID)
+		}
+		if changed {
+			seen[state] = true
+		}
+		if state == RateStateDisconnect {
+			break
+		}
+	}
+
+	for _, state := range []RateState{RateStateAlert, RateStateLimited, RateStateDisconnect} {
+		if !seen[state] {
+			t.Errorf("expected a flooding client to pass through state %d", state)
+		}
+	}
+}
+
+func TestRateLimiterRecovers(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rl := NewRateLimiter(DefaultRateClasses, clock.Now)
+
+	state := RateStateClear
+	for state != RateStateLimited {
+		clock.Advance(100 * time.Millisecond)
+		_, state, _ = rl.Check(4, 6)
+	}
+
+	// Slowing down takes the client back through to clear
+	for i := 0; i < 100 && state != RateStateClear; i++ {
+		clock.Advance(6 * time.Second)
+		_, state, _ = rl.Check(4, 6)
+	}
+	if state != RateStateClear {
+		t.Errorf("expected client to recover, still in state %d", state)
+	}
+}
+
+func TestRateLimiterClassesAreIndependent(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	rl := NewRateLimiter(DefaultRateClasses, clock.Now)
+
+	for i := 0; i < 20; i++ {
+		clock.Advance(100 * time.Millisecond)
+		rl.Check(4, 6)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	if class, state, _ := rl.Check(2, 5); class.ID != RateClassGeneral.ID || state != RateStateClear {
+		t.Errorf("expected general class to be unaffected by ICBM flood, got class %d state %d", class.ID, state)
+	}
+}
+
+func TestWriteRateParams(t *testing.T) {
+	rl := NewRateLimiter(DefaultRateClasses, nil)
+	buf := Buffer{}
+	rl.WriteRateParams(&buf, []uint16{1, 4})
+
+	numClasses, _ := buf.ReadUint16()
+	if numClasses != 2 {
+		t.Fatalf("expected 2 rate classes, got %d", numClasses)
+	}
+
+	// Each class is 35 bytes
+	buf.Seek(35 * int(numClasses))
+
+	id, _ := buf.ReadUint16()
+	count, _ := buf.ReadUint16()
+	if id != 1 || count != 2*0x21-3 {
+		t.Errorf("expected default group to hold every other SNAC, got id %d with %d SNACs", id, count)
+	}
+	buf.Seek(4 * int(count))
+
+	id, _ = buf.ReadUint16()
+	count, _ = buf.ReadUint16()
+	if id != 2 || count != 3 {
+		t.Errorf("expected ICBM group with 3 SNACs, got id %d with %d SNACs", id, count)
+	}
+	buf.Seek(4 * int(count))
+
+	if len(buf.Bytes()) != 0 {
+		t.Errorf("expected no trailing bytes, got %d", len(buf.Bytes()))
+	}
+}
@@ -1,27 +1,48 @@
 package oscar
 
 import (
-	"aim-oscar/util"
-	"bytes"
+	"aim-oscar/metrics"
+	"bufio"
 	"context"
-
-	"encoding/binary"
-	"fmt"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"golang.org/x/exp/slog"
 )
 
 type HandlerFunc func(context.Context, *FLAP) context.Context
+
+// HandleCloseFn cleans up after a session once its connection is closed. The session's context
+// is done by then, so the one Handler passes it never is, for work like signing the user off.
 type HandleCloseFn func(context.Context, *Session)
 
 type Handler struct {
 	handle      HandlerFunc
 	handleClose HandleCloseFn
+
+	// IdleTimeout is how long a connection can go without sending a FLAP before it's treated
+	// as dead and closed. 0 waits forever.
+	IdleTimeout time.Duration
+
+	// MaxFLAPDataLength is the most data a FLAP from a client can carry. Clients that send
+	// bigger ones are disconnected rather than having them buffered. 0 allows any length.
+	MaxFLAPDataLength int
+
+	// ConnLimiter turns away connections from IPs that already have too many open. Handlers
+	// can share one so the limit covers all of their listeners. nil doesn't limit them.
+	ConnLimiter *ConnLimiter
+
+	// Context is the parent of each connection's context, so cancelling it disconnects every
+	// client. nil is context.Background().
+	Context context.Context
+
+	conns sync.WaitGroup
 }
 
 func NewHandler(fn HandlerFunc, handleClose HandleCloseFn) *Handler {
@@ -31,14 +52,91 @@ func NewHandler(fn HandlerFunc, handleClose HandleCloseFn) *Handler {
 	}
 }
 
+// Serve handles each connection the listener accepts. Returns nil once the listener is closed.
+func (h *Handler) Serve(listener net.Listener, logger *slog.Logger) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if h.ConnLimiter == nil {
+			metrics.ConnectionsAccepted.Inc()
+			h.Go(conn, logger, nil)
+			continue
+		}
+
+		ip := addrIP(conn.RemoteAddr())
+		if !h.ConnLimiter.Acquire(ip) {
+			logger.Warn("too many connections", "ip", ip)
+			metrics.ConnectionsRejected.Inc()
+			conn.Close()
+			continue
+		}
+
+		metrics.ConnectionsAccepted.Inc()
+		h.Go(conn, logger, func() { h.ConnLimiter.Release(ip) })
+	}
+}
+
+// Go handles the connection on a goroutine of its own. The connection counts for Wait before
+// the goroutine starts, so a Wait that has already begun waits for it too. done, if not nil, is
+// called once the connection is closed.
+func (h *Handler) Go(conn net.Conn, logger *slog.Logger, done func()) {
+	h.conns.Add(1)
+	go func() {
+		defer h.conns.Done()
+		if done != nil {
+			defer done()
+		}
+		h.Handle(conn, logger)
+	}()
+}
+
+// Wait waits for every connection handled with Go to be closed, and its close handler to return
+func (h *Handler) Wait() {
+	h.conns.Wait()
+}
+
+// Handle reads the connection's FLAPs until it's closed. The context FLAPs are handled with is
+// done once the session is disconnected.
 func (h *Handler) Handle(conn net.Conn, logger *slog.Logger) {
-	connLogger := logger.With("session_id", uuid.New(), "ip", conn.RemoteAddr().String())
+	sessionID := NewSessionID()
+	connLogger := logger.With("session_id", sessionID, "ip", conn.RemoteAddr().String())
 	connLogger.Info("New Connection")
 
-	ctx := NewContextWithSession(context.Background(), conn, connLogger)
+	parent := h.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx := NewContextWithSession(parent, conn, connLogger)
 	session, _ := SessionFromContext(ctx)
+	session.ID = sessionID
+
+	// A bug handling one connection's FLAPs only takes down that connection. The FLAP it was
+	// handling is logged so the packet that set it off can be replayed. Handlers read the FLAP's
+	// data away, so its data as it arrived is kept aside.
+	var handling *FLAP
+	defer func() {
+		if r := recover(); r != nil {
+			var flapHex string
+			if handling != nil {
+				if b, err := handling.MarshalBinary(); err == nil {
+					flapHex = hex.EncodeToString(b)
+				}
+			}
+			connLogger.Error("panic handling connection", "panic", r, "flap", flapHex, "stack", string(debug.Stack()))
+			session.Disconnect()
+			h.handleClose(WithoutCancel(ctx), session)
+		}
+	}()
 
-	var buf bytes.Buffer
+	// FLAPs are often split across reads, like a big buddy list or profile spanning TCP
+	// segments, so they're read a header and then exactly the data length at a time
+	reader := bufio.NewReader(conn)
 	for {
 		if !session.GreetedClient {
 			// send a hello
@@ -48,56 +146,40 @@ func (h *Handler) Handle(conn net.Conn, logger *slog.Logger) {
 			session.GreetedClient = true
 		}
 
-		// Wait for some data to read
-		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-
-		incoming := make([]byte, 512)
-		n, err := conn.Read(incoming)
-		if err != nil && err != io.EOF {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				session.Disconnect()
-				h.handleClose(ctx, session)
-				return
-			}
+		// Clients that vanish without closing the connection never send anything again, so
+		// only FLAPs push the deadline back
+		if h.IdleTimeout > 0 {
+			conn.SetReadDeadline(session.LastHeard().Add(h.IdleTimeout))
+		}
 
-			// If the read timed out, just try reading again
-			if err, ok := err.(net.Error); ok && err.Timeout() {
-				continue
+		flap, err := ReadFLAP(reader, h.MaxFLAPDataLength)
+		if err != nil {
+			// A client sending FLAPs too big to buffer, or something that isn't a FLAP, can't
+			// be read any further
+			if errors.Is(err, ErrOversized) || errors.Is(err, ErrNotFLAP) {
+				connLogger.Error("could not read FLAP", "err", err)
+			} else if err, ok := err.(net.Error); ok && err.Timeout() {
+				connLogger.Info("connection timed out", "last_heard", session.LastHeard())
+			} else if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				connLogger.Error("OSCAR Read Error", "err", err.Error())
 			}
 
-			connLogger.Error("OSCAR Read Error", "err", err.Error())
+			session.Disconnect()
+			h.handleClose(WithoutCancel(ctx), session)
 			return
 		}
 
-		if n == 0 {
+		if !session.receivedSequence(flap.Header.SequenceNumber) {
+			connLogger.Error("FLAP out of sequence", "expected", NextSequenceNumber(session.inboundSequence), "got", flap.Header.SequenceNumber)
+			session.Send(NewFLAP(4))
+			session.Disconnect()
+			h.handleClose(WithoutCancel(ctx), session)
 			return
 		}
 
-		buf.Write(incoming[:n])
-
-		// Try to parse all of the FLAPs in the buffer if we have enough bytes to
-		// fill a FLAP header
-		for buf.Len() >= 6 && buf.Bytes()[0] == 0x2a {
-			bufBytes := buf.Bytes()
-			dataLength := binary.BigEndian.Uint16(bufBytes[4:6])
-			flapLength := int(dataLength) + 6
-			if len(bufBytes) < flapLength {
-				connLogger.Error(fmt.Sprintf("not enough data, expected %d bytes but have %d bytes", flapLength, len(bufBytes)))
-				fmt.Printf("%s\n", util.PrettyBytes(bufBytes))
-				break
-			}
-
-			flap := &FLAP{}
-			flapBuf := make([]byte, flapLength)
-			buf.Read(flapBuf)
-			if err := flap.UnmarshalBinary(flapBuf); err != nil {
-				connLogger.Error("could not unmarshal FLAP", "err", err)
-				// Toss out everything
-				buf.Reset()
-				break
-			}
-
-			ctx = h.handle(ctx, flap)
-		}
+		session.Heard()
+		handling = &FLAP{Header: flap.Header}
+		handling.Data.d = flap.Data.Bytes()
+		ctx = h.handle(ctx, flap)
 	}
 }
@@ -0,0 +1,375 @@
+package oscar
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// readFLAP reads the next FLAP off the connection
+func readFLAP(t *testing.T, conn net.Conn) {
+	t.Helper()
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("could not read FLAP: %s", err)
+	}
+	io.ReadFull(conn, make([]byte, binary.BigEndian.Uint16(header[4:6])))
+}
+
+func TestHandlerRecoversFromPanic(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	closed := make(chan *Session, 1)
+	h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+		panic("bad FLAP")
+	}, func(ctx context.Context, s *Session) {
+		closed <- s
+	})
+
+	var logs bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		h.Handle(server, slog.New(slog.NewTextHandler(&logs, nil)))
+		close(done)
+	}()
+
+	readFLAP(t, client) // hello
+
+	flap := NewFLAP(2)
+	flap.Data.Write([]byte{1, 2, 3})
+	b, _ := flap.MarshalBinary()
+	client.Write(b)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the handler to return after the panic")
+	}
+
+	select {
+	case <-closed:
+	default:
+		t.Errorf("expected the connection to be closed")
+	}
+
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the connection to be disconnected")
+	}
+
+	if !strings.Contains(logs.String(), "flap="+hex.EncodeToString(b)) {
+		t.Errorf("expected the FLAP to be logged, got %s", logs.String())
+	}
+}
+
+func TestHandlerIdleTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	closed := make(chan *Session, 1)
+	h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+		return ctx
+	}, func(ctx context.Context, s *Session) {
+		closed <- s
+	})
+	h.IdleTimeout = 50 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		h.Handle(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		close(done)
+	}()
+	readFLAP(t, client) // hello
+
+	// Keepalives keep the connection open past the timeout
+	seq := uint16(0)
+	for i := 0; i < 5; i++ {
+		seq = NextSequenceNumber(seq)
+		keepalive := NewFLAP(5)
+		keepalive.Header.SequenceNumber = seq
+		b, _ := keepalive.MarshalBinary()
+		if _, err := client.Write(b); err != nil {
+			t.Fatalf("expected the connection to stay open while the client sends keepalives, got %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case <-closed:
+		t.Fatalf("expected the connection to stay open while the client sends keepalives")
+	default:
+	}
+
+	// Going quiet closes it
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the handler to close the silent connection")
+	}
+	select {
+	case <-closed:
+	default:
+		t.Errorf("expected the connection to be cleaned up")
+	}
+}
+
+// Wait waits for connections handed to Go, even ones whose goroutine hasn't started yet
+func TestHandlerWaitsForGo(t *testing.T) {
+	var closed, released bool
+	h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+		return ctx
+	}, func(ctx context.Context, s *Session) {
+		closed = true
+	})
+
+	server, client := net.Pipe()
+	h.Go(server, slog.New(slog.NewTextHandler(io.Discard, nil)), func() { released = true })
+	client.Close()
+	h.Wait()
+
+	if !closed || !released {
+		t.Errorf("expected Wait to return after the connection was cleaned up, closed %v released %v", closed, released)
+	}
+}
+
+// Clients that close the connection without signing off are cleaned up too
+func TestHandlerConnectionClosed(t *testing.T) {
+	server, client := net.Pipe()
+
+	closed := make(chan *Session, 1)
+	h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+		return ctx
+	}, func(ctx context.Context, s *Session) {
+		closed <- s
+	})
+
+	go h.Handle(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	readFLAP(t, client) // hello
+	client.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("expected the closed connection to be cleaned up")
+	}
+}
+
+// Cancelling the handler's context while a FLAP is being handled disconnects the client, and
+// whatever the handler sends after that never reaches it
+func TestHandlerCancelled(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	parent, cancel := context.WithCancel(context.Background())
+	handling := make(chan struct{})
+	sent := make(chan error, 1)
+	closeCtx := make(chan context.Context, 1)
+	h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+		close(handling)
+		<-ctx.Done()
+		session, _ := SessionFromContext(ctx)
+		sent <- session.Send(NewFLAP(2))
+		return ctx
+	}, func(ctx context.Context, s *Session) {
+		closeCtx <- ctx
+	})
+	h.Context = parent
+
+	go h.Handle(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	readFLAP(t, client) // hello
+
+	b, _ := NewFLAP(2).MarshalBinary()
+	client.Write(b)
+	<-handling
+	cancel()
+
+	select {
+	case err := <-sent:
+		if err != ErrSessionClosed {
+			t.Errorf("expected sending to the cancelled session to fail, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the handler's context to be done")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the connection to be closed, read %d bytes", n)
+	}
+
+	h.Wait()
+	if ctx := <-closeCtx; ctx.Err() != nil {
+		t.Errorf("expected the close handler to be able to finish its work, got %v", ctx.Err())
+	}
+}
+
+// syncBuffer is a buffer that the log lines of several goroutines can be written to
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+// Every line logged about a session, by the handler or whatever it hands the session to, has
+// the session's ID
+func TestHandlerLogsSessionID(t *testing.T) {
+	server, client := net.Pipe()
+
+	var logs syncBuffer
+	sessions := make(chan *Session, 1)
+	h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+		session, _ := SessionFromContext(ctx)
+		session.Logger = session.Logger.With("screen_name", "alice")
+		LoggerFromContext(ctx).Info("handling FLAP")
+		snacCtx := NewContextWithLogger(ctx, session.Logger.With("family", 1))
+		LoggerFromContext(snacCtx).Error("error handling SNAC")
+		return ctx
+	}, func(ctx context.Context, s *Session) {
+		s.Logger.Info("Disconnected")
+		sessions <- s
+	})
+
+	go h.Handle(server, slog.New(slog.NewJSONHandler(&logs, nil)))
+	readFLAP(t, client) // hello
+	b, _ := NewFLAP(2).MarshalBinary()
+	client.Write(b)
+	client.Close()
+
+	var session *Session
+	select {
+	case session = <-sessions:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the connection to be closed")
+	}
+	h.Wait()
+
+	lines := logs.Lines()
+	if len(lines) < 4 {
+		t.Fatalf("expected the connection, FLAP and close to be logged, got %v", lines)
+	}
+	for _, line := range lines {
+		var record struct {
+			SessionID string `json:"session_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("could not read log line %q: %s", line, err)
+		}
+		if session.ID == "" || record.SessionID != session.ID {
+			t.Errorf("expected the line to have session ID %q: %s", session.ID, line)
+		}
+	}
+}
+
+// Clients can't make the server buffer FLAPs bigger than it allows, or data that isn't FLAPs
+func TestHandlerFLAPTooLarge(t *testing.T) {
+	tt := map[string][]byte{
+		"header of a large FLAP": {0x2a, 2, 0, 1, 0x10, 0},
+		"not a FLAP":             make([]byte, 100),
+	}
+
+	for name, data := range tt {
+		t.Run(name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+
+			closed := make(chan *Session, 1)
+			h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+				t.Errorf("expected the FLAP not to be handled")
+				return ctx
+			}, func(ctx context.Context, s *Session) {
+				closed <- s
+			})
+			h.MaxFLAPDataLength = 16
+
+			go h.Handle(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			readFLAP(t, client) // hello
+			client.Write(data)
+
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Errorf("expected the connection to be closed")
+			}
+		})
+	}
+}
+
+// FLAPs split across writes, a byte at a time or with the end of one and the start of the
+// next together, are each handled once and whole
+func TestHandlerSplitFLAPs(t *testing.T) {
+	var stream []byte
+	for seq := uint16(1); seq <= 3; seq++ {
+		flap := NewFLAP(2)
+		flap.Header.SequenceNumber = seq
+		flap.Data.Write(bytes.Repeat([]byte{byte(seq)}, 100*int(seq)))
+		b, _ := flap.MarshalBinary()
+		stream = append(stream, b...)
+	}
+
+	tt := map[string]int{
+		"one byte at a time": 1,
+		"across FLAPs":       250,
+	}
+
+	for name, chunk := range tt {
+		t.Run(name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+
+			handled := make(chan *FLAP, 3)
+			h := NewHandler(func(ctx context.Context, flap *FLAP) context.Context {
+				handled <- flap
+				return ctx
+			}, func(ctx context.Context, s *Session) {})
+
+			go h.Handle(server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			readFLAP(t, client) // hello
+
+			go func() {
+				for b := stream; len(b) > 0; {
+					n := chunk
+					if n > len(b) {
+						n = len(b)
+					}
+					if _, err := client.Write(b[:n]); err != nil {
+						return
+					}
+					b = b[n:]
+				}
+			}()
+
+			for seq := uint16(1); seq <= 3; seq++ {
+				select {
+				case flap := <-handled:
+					expected := bytes.Repeat([]byte{byte(seq)}, 100*int(seq))
+					if flap.Header.SequenceNumber != seq || !bytes.Equal(flap.Data.Bytes(), expected) {
+						t.Errorf("expected FLAP %d with %d bytes, got FLAP %d with %d bytes", seq, len(expected), flap.Header.SequenceNumber, len(flap.Data.Bytes()))
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("expected FLAP %d to be handled", seq)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,16 @@
 package oscar
 
 import (
+	"aim-oscar/metrics"
+	"aim-oscar/stats"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/exp/slog"
@@ -16,29 +24,279 @@ func (s sessionKey) String() string {
 
 var (
 	currentSession = sessionKey("session")
+	currentLogger  = sessionKey("logger")
+)
+
+// SendQueueSize is how many FLAPs can wait to be written to a session. It has to fit a
+// burst like the arrival of every buddy on a full buddy list.
+var SendQueueSize = 1024
+
+// SendTimeout is how long writing one FLAP to a client can take before the client is treated
+// as stalled and disconnected
+var SendTimeout = 30 * time.Second
+
+// FlushTimeout is how long the FLAPs still queued for a session that's disconnected have to
+// be written, like a reply telling the client why
+var FlushTimeout = time.Second
+
+var (
+	// ErrSendQueueFull is a client that isn't reading what's sent to it fast enough, which is
+	// disconnected rather than holding up whoever sends to it
+	ErrSendQueueFull = errors.New("send queue is full")
+	// ErrSessionClosed is sending to a session that's disconnected
+	ErrSessionClosed = errors.New("session is closed")
 )
 
 type Session struct {
-	conn           net.Conn
+	conn net.Conn
+
+	// handle is what FLAPs are passed to instead of being written to a connection, for
+	// sessions the server runs itself
+	handle func(*FLAP)
+
+	// ID is a short random ID that's on every log line about the session, so one client's
+	// lines can be picked out of everyone else's
+	ID string
+
+	// SequenceNumber is the sequence number of the last FLAP sent to the client, only changed
+	// by the session's writer
 	SequenceNumber uint16
-	GreetedClient  bool
-	ScreenName     string
-	Logger         *slog.Logger
+
+	// inboundSequence is the sequence number of the last FLAP from the client, valid once
+	// inboundStarted is set
+	inboundSequence uint16
+	inboundStarted  bool
+
+	GreetedClient bool
+	Logger        *slog.Logger
+	RateLimiter   *RateLimiter
+
+	// Ready is whether the client has finished signing on, after which buddies hear about it
+	Ready bool
+
+	// What buddies are told about the session. The session's own goroutine changes it while
+	// others read it to tell buddies, so it's only used through the methods that lock
+	// presenceMutex.
+	screenName       string
+	signonAt         time.Time
+	idleSince        time.Time
+	capabilities     []byte
+	availableMessage string
+	presenceMutex    sync.RWMutex
+
+	// Versions are the service versions agreed with the client by family, nil if it never
+	// said which it speaks
+	Versions map[uint16]uint16
+
+	// InFeedbagBatch is whether the client started a batch of SSI changes it hasn't ended, and
+	// FeedbagBatchBumped whether the batch's changes already bumped the SSI revision
+	InFeedbagBatch     bool
+	FeedbagBatchBumped bool
+
+	// autoReplies is who was sent the user's away message, when and which one, so someone
+	// chatting with an away user isn't sent it again with every IM
+	autoReplies      map[string]autoReply
+	autoRepliesMutex sync.Mutex
+
+	// privacy is the user's privacy settings as the services last loaded them, nil until they're
+	// loaded and after they change. privacyGeneration counts the changes, so settings loaded
+	// before one aren't cached after it.
+	privacy           interface{}
+	privacyGeneration uint64
+	privacyMutex      sync.Mutex
+
+	// lastHeard is when the client last sent a FLAP, in Unix nanoseconds
+	lastHeard atomic.Int64
+
+	// pauseAcked is closed once the client acknowledges being paused for a migration
+	pauseAcked chan struct{}
+	pauseOnce  sync.Once
+
+	// queue holds the FLAPs waiting for the writer, which stops once ctx is done
+	queue      chan *FLAP
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closedOnce sync.Once
+}
+
+// ScreenName is the screen name of the user the session is signed on as, formatted as they
+// last formatted it, empty until they authenticate
+func (s *Session) ScreenName() string {
+	s.presenceMutex.RLock()
+	defer s.presenceMutex.RUnlock()
+	return s.screenName
+}
+
+func (s *Session) SetScreenName(screenName string) {
+	s.presenceMutex.Lock()
+	defer s.presenceMutex.Unlock()
+	s.screenName = screenName
+}
+
+// SignonAt is when the client authenticated with the BOS server
+func (s *Session) SignonAt() time.Time {
+	s.presenceMutex.RLock()
+	defer s.presenceMutex.RUnlock()
+	return s.signonAt
+}
+
+func (s *Session) SetSignonAt(t time.Time) {
+	s.presenceMutex.Lock()
+	defer s.presenceMutex.Unlock()
+	s.signonAt = t
+}
+
+// IdleSince is when the client says the user went idle, zero if they aren't idle
+func (s *Session) IdleSince() time.Time {
+	s.presenceMutex.RLock()
+	defer s.presenceMutex.RUnlock()
+	return s.idleSince
+}
+
+func (s *Session) SetIdleSince(t time.Time) {
+	s.presenceMutex.Lock()
+	defer s.presenceMutex.Unlock()
+	s.idleSince = t
+}
+
+// Capabilities are the 16 byte GUIDs of the features the client supports, like file transfer,
+// as it set them in its location info
+func (s *Session) Capabilities() []byte {
+	s.presenceMutex.RLock()
+	defer s.presenceMutex.RUnlock()
+	return s.capabilities
+}
+
+// SetCapabilities replaces the client's capabilities. The slice isn't changed afterwards, so
+// readers can keep the one they got.
+func (s *Session) SetCapabilities(capabilities []byte) {
+	s.presenceMutex.Lock()
+	defer s.presenceMutex.Unlock()
+	s.capabilities = capabilities
+}
+
+// AvailableMessage is the status text the client set for buddies to see while the user is
+// available, empty if there isn't one
+func (s *Session) AvailableMessage() string {
+	s.presenceMutex.RLock()
+	defer s.presenceMutex.RUnlock()
+	return s.availableMessage
+}
+
+// SetAvailableMessage sets the client's available message, returning whether it changed
+func (s *Session) SetAvailableMessage(message string) bool {
+	s.presenceMutex.Lock()
+	defer s.presenceMutex.Unlock()
+	changed := message != s.availableMessage
+	s.availableMessage = message
+	return changed
 }
 
 func NewSession(conn net.Conn, logger *slog.Logger) *Session {
-	return &Session{
+	return newSession(context.Background(), conn, logger)
+}
+
+// newSession makes a session that is disconnected when parent is done
+func newSession(parent context.Context, conn net.Conn, logger *slog.Logger) *Session {
+	ctx, cancel := context.WithCancel(parent)
+	session := &Session{
 		conn:           conn,
+		ID:             NewSessionID(),
 		SequenceNumber: 0,
 		GreetedClient:  false,
-		ScreenName:     "",
 		Logger:         logger,
+		RateLimiter:    NewRateLimiter(DefaultRateClasses, nil),
+		queue:          make(chan *FLAP, SendQueueSize),
+		ctx:            ctx,
+		cancel:         cancel,
+		pauseAcked:     make(chan struct{}),
+	}
+	session.Heard()
+	if conn != nil {
+		go session.writeQueue()
+	}
+	return session
+}
+
+// NewContextWithInternalSession makes a session for a user the server runs itself, like a bot,
+// that has no connection. FLAPs sent to it are passed to handle one at a time, in order. Like
+// NewContextWithSession, the returned context is done once the session is disconnected.
+func NewContextWithInternalSession(ctx context.Context, logger *slog.Logger, handle func(*FLAP)) context.Context {
+	session := newSession(ctx, nil, logger)
+	session.handle = handle
+	go session.handleQueue()
+	return context.WithValue(session.ctx, currentSession, session)
+}
+
+// Internal is whether the server runs the session itself, without a client connection
+func (s *Session) Internal() bool {
+	return s.handle != nil
+}
+
+// internalAddr is the address of an internal session
+type internalAddr struct{}
+
+func (internalAddr) Network() string { return "internal" }
+func (internalAddr) String() string  { return "internal" }
+
+// handleQueue passes the queued FLAPs to the session's handler until it's disconnected
+func (s *Session) handleQueue() {
+	for {
+		select {
+		case flap := <-s.queue:
+			s.handle(flap)
+		case <-s.ctx.Done():
+			s.Disconnect()
+			return
+		}
 	}
 }
 
+// NewSessionID is a random ID for a session, short enough to grep for
+func NewSessionID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// NewContextWithSession makes a session for the connection. The context it returns is done once
+// the session is disconnected, and disconnecting ctx disconnects the session, so work done for the
+// client stops with it.
 func NewContextWithSession(ctx context.Context, conn net.Conn, logger *slog.Logger) context.Context {
-	session := NewSession(conn, logger)
-	return context.WithValue(ctx, currentSession, session)
+	session := newSession(ctx, conn, logger)
+	return context.WithValue(session.ctx, currentSession, session)
+}
+
+// WithoutCancel is ctx with its values but never done, for work that has to finish after a
+// session is disconnected, like signing its user off. It's context.WithoutCancel from Go 1.21.
+func WithoutCancel(ctx context.Context) context.Context {
+	return withoutCancel{ctx}
+}
+
+type withoutCancel struct {
+	context.Context
+}
+
+func (withoutCancel) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (withoutCancel) Done() <-chan struct{}       { return nil }
+func (withoutCancel) Err() error                  { return nil }
+
+// NewContextWithLogger sets the logger for whatever is handling ctx, e.g. one with the fields of
+// the SNAC being handled
+func NewContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, currentLogger, logger)
+}
+
+// LoggerFromContext is the logger set by NewContextWithLogger, or else the session's logger, or
+// else the default logger
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(currentLogger).(*slog.Logger); ok && logger != nil {
+		return logger
+	}
+	if session, err := SessionFromContext(ctx); err == nil && session.Logger != nil {
+		return session.Logger
+	}
+	return slog.Default()
 }
 
 func SessionFromContext(ctx context.Context) (session *Session, err error) {
@@ -49,34 +307,224 @@ func SessionFromContext(ctx context.Context) (session *Session, err error) {
 	return s.(*Session), nil
 }
 
+// receivedSequence checks that a FLAP from the client follows the last one. Clients pick the
+// sequence number of their first FLAP, which has to be one that the rest can follow, no more
+// than MaxSequenceNumber.
+func (s *Session) receivedSequence(seq uint16) bool {
+	if s.inboundStarted && seq != NextSequenceNumber(s.inboundSequence) {
+		return false
+	}
+	if seq > MaxSequenceNumber {
+		return false
+	}
+
+	s.inboundSequence = seq
+	s.inboundStarted = true
+	return true
+}
+
+// Heard records that the client sent something, which tells live connections from dead ones
+func (s *Session) Heard() {
+	s.lastHeard.Store(time.Now().UnixNano())
+}
+
+// LastHeard is when the client last sent a FLAP
+func (s *Session) LastHeard() time.Time {
+	return time.Unix(0, s.lastHeard.Load())
+}
+
+// TLS is whether the client connected over TLS
+func (s *Session) TLS() bool {
+	_, ok := s.conn.(*tls.Conn)
+	return ok
+}
+
 func (s *Session) RemoteAddr() net.Addr {
+	if s.conn == nil {
+		return internalAddr{}
+	}
 	return s.conn.RemoteAddr()
 }
 
+// Context is done once the session is disconnected
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Send queues the FLAP for the session's writer, so senders like the routines shared by every
+// session never wait on a slow client. A client whose queue fills up is disconnected, and
+// Send returns ErrSendQueueFull, instead of making the sender wait.
 func (s *Session) Send(flap *FLAP) error {
-	s.SequenceNumber += 1
+	select {
+	case <-s.ctx.Done():
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case s.queue <- flap:
+		return nil
+	default:
+		if s.Logger != nil {
+			s.Logger.Warn("disconnecting session that isn't keeping up", "queued", len(s.queue))
+		}
+		s.close()
+		return ErrSendQueueFull
+	}
+}
+
+// writeQueue writes the queued FLAPs to the client in order, numbering them as it goes. Once
+// the session is disconnected it writes whatever is still queued and closes the connection.
+func (s *Session) writeQueue() {
+	defer s.conn.Close()
+
+	for {
+		select {
+		case flap := <-s.queue:
+			if err := s.write(flap); err != nil {
+				if s.Logger != nil {
+					s.Logger.Error("could not send FLAP", "err", err.Error())
+				}
+				s.close()
+				return
+			}
+		case <-s.ctx.Done():
+			// The session's parent context, like the server's, may be what's done
+			s.Disconnect()
+			for {
+				select {
+				case flap := <-s.queue:
+					if err := s.write(flap); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Session) write(flap *FLAP) error {
+	s.SequenceNumber = NextSequenceNumber(s.SequenceNumber)
 	flap.Header.SequenceNumber = s.SequenceNumber
 	bytes, err := flap.MarshalBinary()
 	if err != nil {
 		return errors.Wrap(err, "could not marshal message")
 	}
 
-	if s.Logger != nil {
-		if s.ScreenName != "" {
-			s.Logger.Debug("SEND",
-				slog.String("screen_name", s.ScreenName),
-				"flap",
-				flap,
-			)
-		} else {
-			s.Logger.Debug("SEND", "flap", flap)
+	if s.Logger != nil && s.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		s.Logger.Debug("SEND", slog.Int("channel", int(flap.Header.Channel)), "flap", flap)
+	}
+
+	// Disconnect sets the deadline for writing what's left
+	select {
+	case <-s.ctx.Done():
+	default:
+		if SendTimeout > 0 {
+			s.conn.SetWriteDeadline(time.Now().Add(SendTimeout))
 		}
 	}
+	if _, err = s.conn.Write(bytes); err != nil {
+		return errors.Wrap(err, "could not write to client connection")
+	}
+
+	metrics.FLAPsSent.WithLabelValues(metrics.Channel(flap.Header.Channel)).Inc()
+	stats.Default.BytesOut(len(bytes))
+	return nil
+}
+
+type autoReply struct {
+	message string
+	at      time.Time
+}
+
+// AutoReplyDue is whether sender should be sent the user's away message, which they shouldn't if
+// they were sent the same one less than window ago. If they should, it's recorded as sent.
+func (s *Session) AutoReplyDue(sender string, message string, window time.Duration, now time.Time) bool {
+	s.autoRepliesMutex.Lock()
+	defer s.autoRepliesMutex.Unlock()
+
+	if last, ok := s.autoReplies[sender]; ok && last.message == message && now.Sub(last.at) < window {
+		return false
+	}
+
+	if s.autoReplies == nil {
+		s.autoReplies = make(map[string]autoReply)
+	}
+	// Senders who were replied to long enough ago would be replied to again anyway
+	for other, last := range s.autoReplies {
+		if now.Sub(last.at) >= window {
+			delete(s.autoReplies, other)
+		}
+	}
+	s.autoReplies[sender] = autoReply{message: message, at: now}
+	return true
+}
+
+// ResetAutoReplies forgets who was sent the user's away message, for when the user comes back
+func (s *Session) ResetAutoReplies() {
+	s.autoRepliesMutex.Lock()
+	defer s.autoRepliesMutex.Unlock()
+	s.autoReplies = nil
+}
+
+// CachedPrivacy is the user's privacy settings cached on the session, nil if they aren't, and the
+// generation to cache settings loaded now at
+func (s *Session) CachedPrivacy() (interface{}, uint64) {
+	s.privacyMutex.Lock()
+	defer s.privacyMutex.Unlock()
+	return s.privacy, s.privacyGeneration
+}
+
+// CachePrivacy caches the user's privacy settings loaded at the generation, unless they changed
+// since
+func (s *Session) CachePrivacy(privacy interface{}, generation uint64) {
+	s.privacyMutex.Lock()
+	defer s.privacyMutex.Unlock()
+	if generation == s.privacyGeneration {
+		s.privacy = privacy
+	}
+}
 
-	_, err = s.conn.Write(bytes)
-	return errors.Wrap(err, "could not write to client connection")
+// InvalidatePrivacy drops the cached privacy settings after they change
+func (s *Session) InvalidatePrivacy() {
+	s.privacyMutex.Lock()
+	defer s.privacyMutex.Unlock()
+	s.privacy = nil
+	s.privacyGeneration++
 }
 
+// AckPause records that the client acknowledged being paused (0x01,0x0c)
+func (s *Session) AckPause() {
+	s.pauseOnce.Do(func() {
+		close(s.pauseAcked)
+	})
+}
+
+// PauseAcked is closed once the client acknowledges being paused
+func (s *Session) PauseAcked() <-chan struct{} {
+	return s.pauseAcked
+}
+
+// Disconnect stops the session from sending anything else and closes the connection once
+// the FLAPs already queued are written, or FlushTimeout passes
 func (s *Session) Disconnect() error {
-	return s.conn.Close()
+	s.closedOnce.Do(func() {
+		if s.conn != nil {
+			s.conn.SetWriteDeadline(time.Now().Add(FlushTimeout))
+		}
+		s.cancel()
+	})
+	return nil
+}
+
+// close disconnects the session straight away, dropping whatever is queued
+func (s *Session) close() {
+	s.closedOnce.Do(func() {
+		s.cancel()
+	})
+	if s.conn != nil {
+		s.conn.Close()
+	}
 }
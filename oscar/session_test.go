@@ -0,0 +1,291 @@
+package oscar
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNextSequenceNumber(t *testing.T) {
+	tt := map[string]struct {
+		seq      uint16
+		expected uint16
+	}{
+		"start":        {0, 1},
+		"middle":       {0x1234, 0x1235},
+		"before wrap":  {0x7ffe, 0x7fff},
+		"wrap":         {0x7fff, 0},
+		"out of range": {0xffff, 0},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if next := NextSequenceNumber(tc.seq); next != tc.expected {
+				t.Errorf("expected 0x%04x, got 0x%04x", tc.expected, next)
+			}
+		})
+	}
+}
+
+func TestReceivedSequence(t *testing.T) {
+	s := NewSession(nil, nil)
+
+	// Clients choose where to start
+	for _, seq := range []uint16{0x7ffe, 0x7fff, 0, 1} {
+		if !s.receivedSequence(seq) {
+			t.Fatalf("expected 0x%04x to be in sequence", seq)
+		}
+	}
+
+	if s.receivedSequence(1) {
+		t.Errorf("expected a repeated sequence number to be out of sequence")
+	}
+	if s.receivedSequence(5) {
+		t.Errorf("expected a skipped sequence number to be out of sequence")
+	}
+
+	s = NewSession(nil, nil)
+	s.receivedSequence(0x7fff)
+	if s.receivedSequence(0x8000) {
+		t.Errorf("expected 0x8000 to be out of sequence after 0x7fff")
+	}
+
+	// No FLAP could follow a first one past the largest sequence number
+	for _, seq := range []uint16{0x8000, 0xffff} {
+		s = NewSession(nil, nil)
+		if s.receivedSequence(seq) {
+			t.Errorf("expected a first sequence number of 0x%04x to be refused", seq)
+		}
+	}
+}
+
+func TestSendSequenceConcurrent(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	s := NewSession(server, nil)
+	s.SequenceNumber = MaxSequenceNumber - 10 // cross the wraparound
+
+	const senders, sends = 8, 10
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < sends; j++ {
+					flap := NewFLAP(2)
+					flap.Data.Write([]byte{1, 2, 3})
+					s.Send(flap)
+				}
+			}()
+		}
+		wg.Wait()
+		s.Disconnect()
+	}()
+
+	expected := uint16(MaxSequenceNumber - 10)
+	received := 0
+	for {
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(client, header); err != nil {
+			break
+		}
+		io.ReadFull(client, make([]byte, binary.BigEndian.Uint16(header[4:6])))
+
+		expected = NextSequenceNumber(expected)
+		if seq := binary.BigEndian.Uint16(header[2:4]); seq != expected {
+			t.Fatalf("expected sequence number 0x%04x, got 0x%04x", expected, seq)
+		}
+		received++
+	}
+
+	if received != senders*sends {
+		t.Errorf("expected %d FLAPs, got %d", senders*sends, received)
+	}
+}
+
+// One routine sending to every session, like message delivery, keeps going when a client stops
+// reading, and that client is disconnected once its queue fills up
+func TestSendStalledSession(t *testing.T) {
+	defer func(size int) { SendQueueSize = size }(SendQueueSize)
+	const sends = 100
+
+	SendQueueSize = 8
+	stalledServer, stalledClient := net.Pipe()
+	defer stalledClient.Close()
+	stalled := NewSession(stalledServer, nil)
+
+	SendQueueSize = sends
+	server, client := net.Pipe()
+	defer client.Close()
+	reading := NewSession(server, nil)
+	received := make(chan int)
+	go func() {
+		n := 0
+		for {
+			header := make([]byte, 6)
+			if _, err := io.ReadFull(client, header); err != nil {
+				break
+			}
+			io.ReadFull(client, make([]byte, binary.BigEndian.Uint16(header[4:6])))
+			n++
+		}
+		received <- n
+	}()
+
+	done := make(chan error)
+	go func() {
+		var stalledErr error
+		for i := 0; i < sends; i++ {
+			if err := stalled.Send(NewFLAP(2)); err != nil && stalledErr == nil {
+				stalledErr = err
+			}
+			if err := reading.Send(NewFLAP(2)); err != nil {
+				t.Errorf("could not send to the reading session: %s", err)
+			}
+		}
+		reading.Disconnect()
+		done <- stalledErr
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrSendQueueFull) {
+			t.Errorf("expected the stalled session's queue to fill up, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected sending to carry on past the stalled session")
+	}
+
+	if n := <-received; n != sends {
+		t.Errorf("expected the reading session to get %d FLAPs, got %d", sends, n)
+	}
+	if err := stalled.Send(NewFLAP(2)); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("expected the stalled session to be disconnected, got %v", err)
+	}
+	if _, err := stalledClient.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the stalled session's connection to be closed")
+	}
+}
+
+func TestAutoReplyDue(t *testing.T) {
+	s := NewSession(nil, nil)
+	window := 10 * time.Minute
+	start := time.Unix(1000, 0)
+
+	if !s.AutoReplyDue("alice", "out to lunch", window, start) {
+		t.Fatalf("expected the first message to get an auto-reply")
+	}
+
+	// Repeated messages within the window don't
+	if s.AutoReplyDue("alice", "out to lunch", window, start.Add(time.Minute)) {
+		t.Errorf("expected no auto-reply within the window")
+	}
+	if s.AutoReplyDue("alice", "out to lunch", window, start.Add(window-time.Second)) {
+		t.Errorf("expected no auto-reply right before the window is up")
+	}
+
+	// Other senders have windows of their own
+	if !s.AutoReplyDue("bob", "out to lunch", window, start.Add(time.Minute)) {
+		t.Errorf("expected another sender to get an auto-reply")
+	}
+
+	// The window starts again from each auto-reply
+	if !s.AutoReplyDue("alice", "out to lunch", window, start.Add(window)) {
+		t.Errorf("expected an auto-reply once the window is up")
+	}
+	if s.AutoReplyDue("alice", "out to lunch", window, start.Add(window+time.Minute)) {
+		t.Errorf("expected no auto-reply within the new window")
+	}
+
+	// Editing the away message sends the new one straight away
+	if !s.AutoReplyDue("alice", "back at 2", window, start.Add(window+2*time.Minute)) {
+		t.Errorf("expected an auto-reply with the edited away message")
+	}
+	if s.AutoReplyDue("alice", "back at 2", window, start.Add(window+3*time.Minute)) {
+		t.Errorf("expected no auto-reply within the window of the edited away message")
+	}
+
+	// Senders whose windows are up are pruned
+	if _, ok := s.autoReplies["bob"]; ok {
+		t.Errorf("expected bob to be pruned once his window was up")
+	}
+
+	// Coming back forgets everyone
+	s.ResetAutoReplies()
+	if !s.AutoReplyDue("alice", "back at 2", window, start.Add(window+4*time.Minute)) {
+		t.Errorf("expected an auto-reply after going away again")
+	}
+}
+
+func TestCachedPrivacy(t *testing.T) {
+	s := NewSession(nil, nil)
+	if privacy, _ := s.CachedPrivacy(); privacy != nil {
+		t.Fatalf("expected nothing cached, got %v", privacy)
+	}
+
+	_, generation := s.CachedPrivacy()
+	s.CachePrivacy("deny bob", generation)
+	if privacy, _ := s.CachedPrivacy(); privacy != "deny bob" {
+		t.Errorf("expected the cached settings, got %v", privacy)
+	}
+
+	// Settings loaded before a change aren't cached after it
+	_, stale := s.CachedPrivacy()
+	s.InvalidatePrivacy()
+	s.CachePrivacy("deny bob", stale)
+	if privacy, _ := s.CachedPrivacy(); privacy != nil {
+		t.Errorf("expected stale settings not to be cached, got %v", privacy)
+	}
+}
+
+func TestInternalSession(t *testing.T) {
+	handled := make(chan uint8, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	sessionCtx := NewContextWithInternalSession(ctx, nil, func(flap *FLAP) {
+		handled <- flap.Header.Channel
+	})
+	session, err := SessionFromContext(sessionCtx)
+	if err != nil {
+		t.Fatalf("expected the context to hold the session: %s", err)
+	}
+	if !session.Internal() || session.TLS() {
+		t.Errorf("expected an internal session without TLS")
+	}
+	if addr := session.RemoteAddr().String(); addr != "internal" {
+		t.Errorf("expected the internal address, got %s", addr)
+	}
+
+	// FLAPs are handled in the order they were sent
+	for channel := uint8(1); channel <= 3; channel++ {
+		if err := session.Send(NewFLAP(channel)); err != nil {
+			t.Fatalf("could not send: %s", err)
+		}
+	}
+	for channel := uint8(1); channel <= 3; channel++ {
+		select {
+		case got := <-handled:
+			if got != channel {
+				t.Errorf("expected FLAP on channel %d, got %d", channel, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for FLAP %d to be handled", channel)
+		}
+	}
+
+	// Like any other session it's disconnected with its parent
+	cancel()
+	select {
+	case <-sessionCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expected the session to be disconnected")
+	}
+	if err := session.Send(NewFLAP(2)); err != ErrSessionClosed {
+		t.Errorf("expected sending to a disconnected session to fail, got %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package oscar
 
 import (
-	"bytes"
 	"encoding"
 	"encoding/binary"
 	"fmt"
@@ -33,6 +32,24 @@ func NewSNAC(family uint16, subtype uint16) *SNAC {
 	}
 }
 
+// NewReplySNAC is a reply to the original request, with its request ID and flags so clients that
+// have several requests in flight can tell which one it answers
+func NewReplySNAC(original *SNAC, family uint16, subtype uint16) *SNAC {
+	snac := NewSNAC(family, subtype)
+	snac.Header.Flags = original.Header.Flags
+	snac.Header.RequestID = original.Header.RequestID
+	return snac
+}
+
+// NewSNACError is the error reply (subtype 0x01) to a request in the family, with the
+// request's ID so the client knows which request failed
+func NewSNACError(family uint16, requestID uint32, code uint16) *SNAC {
+	snac := NewSNAC(family, 0x01)
+	snac.Header.RequestID = requestID
+	snac.Data.WriteUint16(code)
+	return snac
+}
+
 func (s *SNAC) MarshalBinary() ([]byte, error) {
 	buf := Buffer{}
 
@@ -49,14 +66,19 @@ func (s *SNAC) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// snacHeaderLength is the family, subtype, flags and request ID of a SNAC
+const snacHeaderLength = 10
+
 func (s *SNAC) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	if err := binary.Read(buf, binary.BigEndian, &s.Header); err != nil {
-		return err
+	if len(data) < snacHeaderLength {
+		return ErrTruncated
 	}
 
-	s.Data.Write(buf.Bytes())
-
+	s.Header.Family = binary.BigEndian.Uint16(data[0:2])
+	s.Header.Subtype = binary.BigEndian.Uint16(data[2:4])
+	s.Header.Flags = binary.BigEndian.Uint16(data[4:6])
+	s.Header.RequestID = binary.BigEndian.Uint32(data[6:10])
+	s.Data.Write(data[snacHeaderLength:])
 	return nil
 }
 
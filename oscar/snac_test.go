@@ -0,0 +1,71 @@
+package oscar
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestNewSNACError(t *testing.T) {
+	errSnac := NewSNACError(0x04, 0x01020304, 0x0e)
+	b, err := errSnac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not marshal SNAC: %s", err)
+	}
+
+	expected := []byte{
+		0x00, 0x04, // family
+		0x00, 0x01, // subtype
+		0x00, 0x00, // flags
+		0x01, 0x02, 0x03, 0x04, // request ID
+		0x00, 0x0e, // error code
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected %v, got %v", expected, b)
+	}
+}
+
+func TestUnmarshalSNACTruncated(t *testing.T) {
+	snac := SNAC{}
+	if err := snac.UnmarshalBinary([]byte{0, 4, 0, 6, 0, 0, 0}); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+}
+
+func FuzzUnmarshalSNAC(f *testing.F) {
+	f.Add([]byte{0, 4, 0, 1, 0, 0, 1, 2, 3, 4, 0, 0x0e})
+	f.Add([]byte{0, 1, 0, 2, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{0, 4})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		snac := SNAC{}
+		if err := snac.UnmarshalBinary(b); err != nil {
+			if !errors.Is(err, ErrTruncated) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+
+		out, err := snac.MarshalBinary()
+		if err != nil {
+			t.Fatalf("could not marshal: %s", err)
+		}
+		if !bytes.Equal(out, b) {
+			t.Errorf("expected %x to marshal back, got %x", b, out)
+		}
+	})
+}
+
+func TestNewReplySNAC(t *testing.T) {
+	request := NewSNAC(0x02, 0x02)
+	request.Header.Flags = 0x0001
+	request.Header.RequestID = 0x01020304
+
+	reply := NewReplySNAC(request, 0x02, 0x03)
+	if reply.Header.Family != 0x02 || reply.Header.Subtype != 0x03 {
+		t.Errorf("expected SNAC 0x02,0x03, got %s", reply)
+	}
+	if reply.Header.RequestID != request.Header.RequestID || reply.Header.Flags != request.Header.Flags {
+		t.Errorf("expected the request's ID and flags, got %d and %#x", reply.Header.RequestID, reply.Header.Flags)
+	}
+}
@@ -1,11 +1,8 @@
 package oscar
 
 import (
-	"aim-oscar/util"
 	"encoding"
 	"encoding/binary"
-	"fmt"
-	"io"
 
 	"github.com/pkg/errors"
 )
@@ -39,33 +36,102 @@ func (t *TLV) MarshalBinary() ([]byte, error) {
 	return buf, nil
 }
 
+// UnmarshalBinary reads one TLV. Returns ErrTruncated if the data is shorter than the TLV's
+// length says, which also keeps a TLV from being longer than the FLAP it came in.
 func (t *TLV) UnmarshalBinary(data []byte) error {
 	if len(data) < 4 {
-		return io.ErrUnexpectedEOF
+		return ErrTruncated
 	}
 	t.Type = binary.BigEndian.Uint16(data[:2])
 	t.DataLength = binary.BigEndian.Uint16(data[2:4])
 	if len(data) < 4+int(t.DataLength) {
-		return io.ErrUnexpectedEOF
+		return ErrTruncated
 	}
 	t.Data = make([]byte, int(t.DataLength))
 	copy(t.Data, data[4:4+int(t.DataLength)])
 	return nil
 }
 
+// ErrTLVLength is a TLV whose data is the wrong length for the value it holds
+var ErrTLVLength = errors.New("wrong TLV length")
+
+func NewTLVString(tlvType uint16, s string) *TLV {
+	return NewTLV(tlvType, []byte(s))
+}
+
+func NewTLVUint8(tlvType uint16, n uint8) *TLV {
+	return NewTLV(tlvType, []byte{n})
+}
+
+func NewTLVUint16(tlvType uint16, n uint16) *TLV {
+	return NewTLV(tlvType, binary.BigEndian.AppendUint16(nil, n))
+}
+
+func NewTLVUint32(tlvType uint16, n uint32) *TLV {
+	return NewTLV(tlvType, binary.BigEndian.AppendUint32(nil, n))
+}
+
+// String is the TLV's data as text, like a screen name or password
 func (t *TLV) String() string {
-	return fmt.Sprintf("TLV(%#x):\n%s", t.Type, util.PrettyBytes(t.Data))
+	return string(t.Data)
+}
+
+// Bytes is the TLV's data
+func (t *TLV) Bytes() []byte {
+	return t.Data
+}
+
+func (t *TLV) checkLength(length int) error {
+	if len(t.Data) != length {
+		return errors.Wrapf(ErrTLVLength, "TLV %#x has %d bytes, expected %d", t.Type, len(t.Data), length)
+	}
+	return nil
+}
+
+func (t *TLV) Uint8() (uint8, error) {
+	if err := t.checkLength(1); err != nil {
+		return 0, err
+	}
+	return t.Data[0], nil
+}
+
+func (t *TLV) Uint16() (uint16, error) {
+	if err := t.checkLength(2); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(t.Data), nil
+}
+
+func (t *TLV) Uint32() (uint32, error) {
+	if err := t.checkLength(4); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(t.Data), nil
+}
+
+// TLVList is the TLVs of a SNAC or FLAP, which usually has at most one TLV of each type
+type TLVList []*TLV
+
+// Get finds the first TLV of the type
+func (l TLVList) Get(tlvType uint16) (*TLV, bool) {
+	tlv := FindTLV(l, tlvType)
+	return tlv, tlv != nil
+}
+
+// Has is whether there is a TLV of the type, for flags that are TLVs without data
+func (l TLVList) Has(tlvType uint16) bool {
+	return FindTLV(l, tlvType) != nil
 }
 
-func UnmarshalTLVs(data []byte) ([]*TLV, error) {
-	tlvs := make([]*TLV, 0)
-	d := make([]byte, len(data))
-	copy(d, data)
+// UnmarshalTLVs reads TLVs until the end of the data
+func UnmarshalTLVs(data []byte) (TLVList, error) {
+	tlvs := make(TLVList, 0)
+	d := data
 
 	for len(d) > 0 {
 		tlv := &TLV{}
 		if err := tlv.UnmarshalBinary(d); err != nil {
-			return nil, errors.Wrap(err, "enexpected end to unmarshalling TLVs")
+			return nil, errors.Wrap(err, "unexpected end to unmarshalling TLVs")
 		}
 		tlvs = append(tlvs, tlv)
 		d = d[tlv.Len():]
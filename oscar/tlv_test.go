@@ -0,0 +1,108 @@
+package oscar
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestUnmarshalTLVs(t *testing.T) {
+	b := []byte{0, 1, 0, 2, 'h', 'i', 0, 6, 0, 0}
+	tlvs, err := UnmarshalTLVs(b)
+	if err != nil {
+		t.Fatalf("could not unmarshal TLVs: %s", err)
+	}
+	if len(tlvs) != 2 {
+		t.Fatalf("expected 2 TLVs, got %d", len(tlvs))
+	}
+	if tlvs[0].Type != 1 || string(tlvs[0].Data) != "hi" {
+		t.Errorf("expected TLV 1 with hi, got %#x %q", tlvs[0].Type, tlvs[0].Data)
+	}
+	if tlvs[1].Type != 6 || len(tlvs[1].Data) != 0 {
+		t.Errorf("expected an empty TLV 6, got %#x %x", tlvs[1].Type, tlvs[1].Data)
+	}
+}
+
+func TestUnmarshalTLVsTruncated(t *testing.T) {
+	tests := map[string][]byte{
+		"short header": {0, 1, 0},
+		"length lies":  {0, 1, 0xff, 0xff, 'h', 'i'},
+		"second TLV":   {0, 1, 0, 0, 0, 2, 0, 1},
+	}
+	for name, b := range tests {
+		if _, err := UnmarshalTLVs(b); !errors.Is(err, ErrTruncated) {
+			t.Errorf("%s: expected ErrTruncated, got %v", name, err)
+		}
+	}
+}
+
+func FuzzUnmarshalTLVs(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 2, 'h', 'i', 0, 6, 0, 0})
+	f.Add([]byte{0, 1, 0xff, 0xff})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tlvs, err := UnmarshalTLVs(b)
+		if err != nil {
+			if !errors.Is(err, ErrTruncated) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+
+		out := Buffer{}
+		for _, tlv := range tlvs {
+			if len(tlv.Data) != int(tlv.DataLength) {
+				t.Fatalf("TLV has %d bytes of data, header says %d", len(tlv.Data), tlv.DataLength)
+			}
+			out.WriteBinary(tlv)
+		}
+		if !bytes.Equal(out.Bytes(), b) {
+			t.Errorf("expected %x to marshal back, got %x", b, out.Bytes())
+		}
+	})
+}
+
+func TestTLVAccessors(t *testing.T) {
+	if n, err := NewTLVUint16(0x08, 0x0304).Uint16(); err != nil || n != 0x0304 {
+		t.Errorf("expected 0x0304, got %#x, %v", n, err)
+	}
+	if n, err := NewTLVUint32(0x06, 0x01020304).Uint32(); err != nil || n != 0x01020304 {
+		t.Errorf("expected 0x01020304, got %#x, %v", n, err)
+	}
+	if n, err := NewTLVUint8(0x0a, 7).Uint8(); err != nil || n != 7 {
+		t.Errorf("expected 7, got %d, %v", n, err)
+	}
+	if s := NewTLVString(0x01, "alice").String(); s != "alice" {
+		t.Errorf("expected alice, got %q", s)
+	}
+
+	short := NewTLV(0x08, []byte{0x04})
+	if _, err := short.Uint16(); !errors.Is(err, ErrTLVLength) {
+		t.Errorf("expected ErrTLVLength for a 1 byte TLV, got %v", err)
+	}
+	if _, err := short.Uint32(); !errors.Is(err, ErrTLVLength) {
+		t.Errorf("expected ErrTLVLength for a 1 byte TLV, got %v", err)
+	}
+	if _, err := NewTLV(0x0a, nil).Uint8(); !errors.Is(err, ErrTLVLength) {
+		t.Errorf("expected ErrTLVLength for an empty TLV, got %v", err)
+	}
+}
+
+func TestTLVListGet(t *testing.T) {
+	tlvs, err := UnmarshalTLVs([]byte{0, 1, 0, 2, 'h', 'i', 0, 6, 0, 0, 0, 1, 0, 1, 'x'})
+	if err != nil {
+		t.Fatalf("could not unmarshal TLVs: %s", err)
+	}
+
+	tlv, ok := tlvs.Get(0x01)
+	if !ok || tlv.String() != "hi" {
+		t.Errorf("expected the first TLV 1, got %v", tlv)
+	}
+	if !tlvs.Has(0x06) {
+		t.Errorf("expected the empty TLV 6 to be there")
+	}
+	if tlv, ok := tlvs.Get(0x02); ok || tlv != nil {
+		t.Errorf("expected no TLV 2, got %v", tlv)
+	}
+}
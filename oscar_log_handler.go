@@ -45,8 +45,10 @@ func (h *OSCARLogHandler) Handle(ctx context.Context, r slog.Record) error {
 		h.logger.Printf("  %s=%s\n", color.YellowString(h.openGroup+attr.Key), color.WhiteString("%v", attr.Value.Any()))
 	}
 
+	// FLAPs are dumped below, and anything else logged as a flap, like a FLAP's hex, is printed
+	// with the other attributes
 	r.Attrs(func(a slog.Attr) bool {
-		if a.Key == "flap" {
+		if _, ok := a.Value.Any().(*oscar.FLAP); ok && a.Key == "flap" {
 			return true
 		} else {
 			h.logger.Printf("  %s=%s\n", color.YellowString(h.openGroup+a.Key), color.WhiteString("%v", a.Value.Any()))
@@ -56,8 +58,7 @@ func (h *OSCARLogHandler) Handle(ctx context.Context, r slog.Record) error {
 	})
 
 	r.Attrs(func(a slog.Attr) bool {
-		if a.Key == "flap" {
-			flap := a.Value.Any().(*oscar.FLAP)
+		if flap, ok := a.Value.Any().(*oscar.FLAP); ok && a.Key == "flap" {
 			snac := &oscar.SNAC{}
 			if err := snac.UnmarshalBinary(flap.Data.Bytes()); err == nil {
 				h.logger.Printf("  FLAP(CH:%d, SEQ:%d):", flap.Header.Channel, flap.Header.SequenceNumber)
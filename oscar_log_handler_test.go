@@ -0,0 +1,54 @@
+package main
+
+import (
+	"aim-oscar/oscar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// A connection that panics is logged through the server's log handler with the FLAP that set it
+// off as hex, not dropped for not being a FLAP
+func TestOSCARLogHandlerLogsPanic(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	h := oscar.NewHandler(func(ctx context.Context, flap *oscar.FLAP) context.Context {
+		panic("bad FLAP")
+	}, func(ctx context.Context, s *oscar.Session) {})
+
+	var logs bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		h.Handle(server, slog.New(NewOSCARLogHandler(&logs, nil)))
+		close(done)
+	}()
+
+	if _, err := oscar.ReadFLAP(client, 0); err != nil {
+		t.Fatalf("could not read hello: %s", err)
+	}
+
+	flap := oscar.NewFLAP(2)
+	flap.Data.Write([]byte{1, 2, 3})
+	b, _ := flap.MarshalBinary()
+	client.Write(b)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the handler to return after the panic")
+	}
+
+	logged := logs.String()
+	for _, expected := range []string{"panic handling connection", "bad FLAP", hex.EncodeToString(b), "server.go"} {
+		if !strings.Contains(logged, expected) {
+			t.Errorf("expected %q to be logged, got %s", expected, logged)
+		}
+	}
+}
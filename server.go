@@ -0,0 +1,705 @@
+package main
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/bot"
+	"aim-oscar/config"
+	"aim-oscar/metrics"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"aim-oscar/stats"
+	"aim-oscar/toc"
+	"aim-oscar/tunnel"
+	"aim-oscar/webhook"
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// Server is the authorization and BOS servers, along with the routines that deliver messages
+// and presence between their sessions
+type Server struct {
+	Sessions *SessionManager
+	Chat     *services.ChatService
+
+	logger      *slog.Logger
+	bosHost     string
+	authHandler *oscar.Handler
+	bosHandler  *oscar.Handler
+	tocHandler  *toc.Handler
+
+	tunnelHandler *tunnel.Handler
+
+	commCh            chan *models.Message
+	onlineCh          chan *services.PresenceEvent
+	stopDecay         chan struct{}
+	decayStopped      chan struct{}
+	stopStatusReaper  chan struct{}
+	statusReaperDone  chan struct{}
+	stopCookieCleanup chan struct{}
+	stopMessageExpiry chan struct{}
+	stopMissedFlush   chan struct{}
+	messageExpiryDone chan struct{}
+	stopRoomReaper    chan struct{}
+	roomReaperDone    chan struct{}
+	stopStats         chan struct{}
+	statsDone         chan struct{}
+
+	stopMessagePruning chan struct{}
+	messagePruningDone chan struct{}
+
+	// disconnectAll cancels the context every client's session is under
+	disconnectAll context.CancelFunc
+
+	// bots is the bots that are signed on, which sign off once disconnectAll is called
+	bots *sync.WaitGroup
+
+	// serving is set while the listeners are accepting clients, and draining once the server
+	// is shutting down
+	serving  atomic.Bool
+	draining atomic.Bool
+
+	listenersMutex sync.Mutex
+	listeners      []net.Listener
+	shutdownOnce   sync.Once
+}
+
+// ServerOption changes how NewServer sets up the services, for builds that plug in their own
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	filter   services.MessageFilter
+	webhooks *webhook.Dispatcher
+	bots     map[string]bot.Bot
+}
+
+// WithMessageFilter checks IMs, chat messages and away messages with the filter before they are
+// stored or delivered
+func WithMessageFilter(filter services.MessageFilter) ServerOption {
+	return func(o *serverOptions) {
+		o.filter = filter
+	}
+}
+
+// WithWebhooks tells the dispatcher about messages, warnings and users signing on and off
+func WithWebhooks(webhooks *webhook.Dispatcher) ServerOption {
+	return func(o *serverOptions) {
+		o.webhooks = webhooks
+	}
+}
+
+// WithBot signs the bot on as the screen name, along with the bots in the config
+func WithBot(screenName string, b bot.Bot) ServerOption {
+	return func(o *serverOptions) {
+		o.bots[screenName] = b
+	}
+}
+
+// NewServer sets up the services and starts the routines the servers share. Clients can
+// connect once it's serving.
+func NewServer(conf config.OscarConfig, db *bun.DB, logger *slog.Logger, opts ...ServerOption) *Server {
+	options := &serverOptions{bots: make(map[string]bot.Bot)}
+	for screenName, kind := range conf.Bots {
+		b, err := bot.New(kind)
+		if err != nil {
+			logger.Error("Could not make bot", slog.String("bot", screenName), slog.String("err", err.Error()))
+			continue
+		}
+		options.bots[screenName] = b
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	sessionManager := NewSessionManager(MultipleLoginPolicy(conf.MultipleLogins))
+
+	// Goroutine that listens for messages to deliver and tries to find a user socket to push them to
+	commCh, messageRoutine := MessageDelivery(sessionManager, logger)
+	go messageRoutine(db)
+
+	// Goroutine that listens for users who change their online status and notifies their buddies
+	onlineCh, onlineRoutine := OnlineNotification(sessionManager, options.webhooks, logger)
+	go onlineRoutine(db)
+
+	// Goroutine that lowers warning levels over time. It sends to onlineCh, so it has to stop
+	// before onlineCh is closed.
+	stopDecay := make(chan struct{})
+	decayStopped := make(chan struct{})
+	if conf.WarningDecayInterval > 0 {
+		decayRoutine := WarningDecay(sessionManager, onlineCh, conf.WarningDecayInterval, uint16(conf.WarningDecay), logger)
+		go func() {
+			decayRoutine(db, stopDecay)
+			close(decayStopped)
+		}()
+	} else {
+		close(decayStopped)
+	}
+
+	// Goroutine that signs off users left signed on without a session. It also sends to onlineCh.
+	stopStatusReaper := make(chan struct{})
+	statusReaperDone := make(chan struct{})
+	if conf.StatusReapInterval > 0 {
+		statusRoutine := StatusReaper(sessionManager, onlineCh, conf.StatusReapInterval, logger)
+		go func() {
+			statusRoutine(db, stopStatusReaper)
+			close(statusReaperDone)
+		}()
+	} else {
+		close(statusReaperDone)
+	}
+
+	// Goroutine that forgets cookies clients never signed on with
+	stopCookieCleanup := make(chan struct{})
+	go AuthCookieCleanup(models.AuthCookieTTL, logger)(db, stopCookieCleanup)
+
+	// Goroutine that deletes messages stored for users who never signed on to get them
+	stopMessageExpiry := make(chan struct{})
+	messageExpiryDone := make(chan struct{})
+	if conf.OfflineMessageMaxAge > 0 {
+		expiryRoutine := OfflineMessageExpiry(OfflineMessageExpiryInterval, conf.OfflineMessageMaxAge, logger)
+		go func() {
+			expiryRoutine(db, stopMessageExpiry)
+			close(messageExpiryDone)
+		}()
+	} else {
+		close(messageExpiryDone)
+	}
+
+	// Goroutine that saves the running totals so they survive restarts
+	stopStats := make(chan struct{})
+	statsDone := make(chan struct{})
+	statsRoutine := StatsRecorder(stats.Default, conf.StatsInterval, conf.StatsSummaryInterval, logger)
+	go func() {
+		statsRoutine(db, stopStats)
+		close(statsDone)
+	}()
+
+	// Goroutine that deletes the delivered messages the retention policy doesn't keep
+	stopMessagePruning := make(chan struct{})
+	messagePruningDone := make(chan struct{})
+	if (conf.MessageRetentionDays > 0 || conf.DeleteDelivered || conf.MaxMessagesPerConversation > 0) && conf.MessagePruneInterval > 0 {
+		retention := MessageRetention{
+			MaxAge:             -1,
+			MaxPerConversation: conf.MaxMessagesPerConversation,
+			BatchSize:          conf.MessagePruneBatchSize,
+			DryRun:             conf.MessagePruneDryRun,
+		}
+		if conf.DeleteDelivered {
+			retention.MaxAge = 0
+		} else if conf.MessageRetentionDays > 0 {
+			retention.MaxAge = time.Duration(conf.MessageRetentionDays) * 24 * time.Hour
+		}
+		pruningRoutine := MessagePruning(conf.MessagePruneInterval, retention, logger)
+		go func() {
+			pruningRoutine(db, stopMessagePruning)
+			close(messagePruningDone)
+		}()
+	} else {
+		close(messagePruningDone)
+	}
+
+	// Goroutine that disconnects users whose clients have gone quiet
+	if conf.KeepaliveTimeout > 0 {
+		go SessionReaper(sessionManager, conf.KeepaliveTimeout, logger)()
+	}
+
+	chatService := &services.ChatService{Registry: services.NewChatRegistry(), Filter: options.filter}
+
+	// Goroutine that deletes chat rooms nobody has been in for a while
+	stopRoomReaper := make(chan struct{})
+	roomReaperDone := make(chan struct{})
+	if conf.ChatRoomIdleTimeout > 0 {
+		reaperRoutine := ChatRoomReaper(chatService.Registry, ChatRoomReapInterval, conf.ChatRoomIdleTimeout, logger)
+		go func() {
+			reaperRoutine(db, stopRoomReaper)
+			close(roomReaperDone)
+		}()
+	} else {
+		close(roomReaperDone)
+	}
+
+	authService := &services.AuthorizationRegistrationService{
+		BOSAddress:       conf.AdvertisedBOS(),
+		OpenRegistration: conf.OpenRegistration,
+		RequireTLS:       conf.RequireTLSAuth,
+	}
+	if conf.LoginMaxFailures > 0 {
+		authService.Logins = services.NewLoginLimiter(conf.LoginMaxFailures, conf.LoginFailureWindow)
+	}
+
+	// The authorization server only logs users in, so clients can't use any other service until
+	// they've signed on to BOS
+	authServices := NewServiceManager()
+	authServices.RegisterService(0x17, authService)
+
+	bosServices := NewServiceManager()
+	bosServices.RegisterService(0x01, &services.GenericServiceControls{
+		OnlineCh:            onlineCh,
+		CommCh:              commCh,
+		Chat:                chatService,
+		ServerHostname:      conf.AdvertisedBOS(),
+		UsageReportInterval: uint16(conf.UsageReportInterval / time.Hour),
+	})
+	bosServices.RegisterService(0x02, &services.LocationServices{OnlineCh: onlineCh, Sessions: sessionManager})
+	bosServices.RegisterService(0x03, &services.BuddyListManagement{
+		OnlineCh:               onlineCh,
+		Sessions:               sessionManager,
+		MaxBuddies:             uint16(conf.MaxBuddies),
+		MaxWatchers:            uint16(conf.MaxWatchers),
+		MaxOnlineNotifications: uint16(conf.MaxOnlineNotifications),
+	})
+	icbm := &services.ICBM{
+		CommCh:             commCh,
+		OnlineCh:           onlineCh,
+		Sessions:           sessionManager,
+		Chat:               chatService.Registry,
+		MaxMessageSize:     uint16(conf.MaxMessageSize),
+		AutoReplyWindow:    conf.AutoReplyWindow,
+		MaxOfflineMessages: conf.MaxOfflineMessages,
+		OnlyStoreOffline:   conf.DeleteDelivered,
+		HideUnregistered:   conf.HideUnregistered,
+		Filter:             options.filter,
+		Webhooks:           options.webhooks,
+		Flood: services.FloodLimit{
+			Rate:       conf.IMRate,
+			Burst:      conf.IMBurst,
+			MaxStrikes: conf.IMFloodStrikes,
+		},
+	}
+	bosServices.RegisterService(0x04, icbm)
+
+	// Goroutine that tells users about the messages they missed when nobody sends them one
+	stopMissedFlush := make(chan struct{})
+	go MissedMessagesFlush(icbm, MissedMessagesFlushInterval, logger)(stopMissedFlush)
+	bosServices.RegisterService(0x06, &services.InvitationService{MaxPerDay: conf.MaxInvitationsPerDay})
+	bosServices.RegisterService(0x07, &services.AdministrationService{OnlineCh: onlineCh})
+	bosServices.RegisterService(0x09, &services.PrivacyService{OnlineCh: onlineCh})
+	bosServices.RegisterService(0x0a, &services.UserLookupService{})
+	bosServices.RegisterService(0x0b, &services.UsageStatsService{Record: conf.RecordUsageStats})
+	bosServices.RegisterService(0x0d, &services.ChatNavService{})
+	bosServices.RegisterService(0x0e, chatService)
+	// bosServices.RegisterService(0x0f, &services.DirectorySearchService{})
+	bosServices.RegisterService(0x10, &services.BuddyIconService{OnlineCh: onlineCh})
+	bosServices.RegisterService(0x13, &services.FeedbagService{OnlineCh: onlineCh, Sessions: sessionManager})
+	bosServices.RegisterService(0x15, &services.ICQService{})
+	bosServices.RegisterService(0x18, &services.AlertService{})
+
+	handleCloseFn := func(ctx context.Context, session *oscar.Session) {
+		session.Logger.Info("Disconnected")
+
+		// Disconnecting the rate limited and TOC sessions before this is called leaves their
+		// context done, but the user still has to be signed off
+		ctx = oscar.WithoutCancel(ctx)
+
+		// Closing a service connection, like leaving a chat room, doesn't sign the user off
+		if services.ServiceFamilyFromContext(ctx) != 0 {
+			if room := services.ChatRoomFromContext(ctx); room != nil {
+				chatService.Leave(ctx)
+				if err := room.Touch(ctx, db); err != nil {
+					logger.Error("Could not update chat room activity", slog.String("err", err.Error()))
+				}
+			}
+			session.Disconnect()
+			return
+		}
+
+		user := models.UserFromContext(ctx)
+		if user != nil {
+			// A session that was kicked for a newer one leaves the user signed on
+			if !sessionManager.RemoveSession(user.ScreenName, session) {
+				session.Disconnect()
+				return
+			}
+
+			if err := user.SetOffline(ctx, db); err != nil {
+				logger.Error("Could not set user as offline", slog.String("err", err.Error()))
+			}
+
+			logger.Info("Disconnecting user", slog.String("screen_name", user.ScreenName))
+
+			onlineCh <- services.StatusChanged(user)
+			session.Disconnect()
+		}
+	}
+
+	// authLogin handles the channel 1 logins of clients from before family 0x17, which send their
+	// password to the authorization server
+	authLogin := func(ctx context.Context, flap *oscar.FLAP) context.Context {
+		session, _ := oscar.SessionFromContext(ctx)
+		if !services.IsRoastedLogin(flap) {
+			session.Logger.Warn("Ignoring sign on to the authorization server")
+			return ctx
+		}
+
+		if err := authService.RoastedLogin(ctx, db, flap); err != nil {
+			session.Logger.Error("Could not log in user", slog.String("err", err.Error()))
+			session.Disconnect()
+		}
+		return ctx
+	}
+
+	// claimSession makes session the user's, kicking their other session or turning this one
+	// away as the multiple login policy says
+	claimSession := func(ctx context.Context, session *oscar.Session, user *models.User) (context.Context, bool) {
+		session.Logger = session.Logger.With("screen_name", user.ScreenName)
+		session.Logger.Info("Authenticated user")
+		session.SetScreenName(user.ScreenName)
+		session.SetSignonAt(time.Now())
+
+		previous, ok := sessionManager.ClaimSession(user.ScreenName, session)
+		if !ok {
+			session.Logger.Info("Rejected second sign on")
+			session.Send(signedOnElsewhereFLAP(user.ScreenName))
+			session.Disconnect()
+			return ctx, false
+		}
+
+		// The old connection runs handleCloseFn once it's closed, which leaves the user signed
+		// on since the session is no longer theirs
+		if previous != nil {
+			session.Logger.Info("Kicking session signed on elsewhere")
+			previous.Send(signedOnElsewhereFLAP(user.ScreenName))
+			previous.Disconnect()
+		}
+
+		// Who the user blocks is checked for every message to them and every buddy who signs
+		// on, so it's kept with the session until they change it
+		if _, err := services.SessionPrivacy(ctx, db, session, user); err != nil {
+			session.Logger.Error("Could not load privacy settings", slog.String("err", err.Error()))
+		}
+
+		return models.NewContextWithUser(ctx, user), true
+	}
+
+	// bosLogin signs a client on to BOS with the cookie it got from the authorization server
+	bosLogin := func(ctx context.Context, flap *oscar.FLAP) context.Context {
+		session, _ := oscar.SessionFromContext(ctx)
+
+		user, cookie, err := services.AuthenticateFLAPCookie(ctx, db, flap)
+		metrics.Auth(metrics.AuthCookie, err == nil)
+		if err != nil {
+			session.Logger.Error("Could not authenticate user cookie", slog.String("err", err.Error()))
+			session.Send(services.CookieRejectedFLAP())
+			session.Disconnect()
+			return ctx
+		}
+
+		// Service connections only offer their one service, to a user who is already signed on
+		if cookie.Family != 0 {
+			session.Logger = session.Logger.With("screen_name", user.ScreenName, "family", metrics.Hex(cookie.Family))
+			ctx, err = services.NewServiceContext(models.NewContextWithUser(ctx, user), db, cookie)
+			if err != nil {
+				session.Logger.Error("Could not open service connection", slog.String("err", err.Error()))
+				session.Send(services.CookieRejectedFLAP())
+				session.Disconnect()
+				return ctx
+			}
+			session.Logger.Info("Opened service connection")
+			session.SetScreenName(user.ScreenName)
+			session.SetSignonAt(time.Now())
+
+			servicesSnac := oscar.NewSNAC(0x1, 0x3)
+			servicesSnac.Data.WriteUint16(0x01)
+			servicesSnac.Data.WriteUint16(cookie.Family)
+			servicesFlap := oscar.NewFLAP(2)
+			servicesFlap.Data.WriteBinary(servicesSnac)
+			session.Send(servicesFlap)
+			return ctx
+		}
+
+		ctx, ok := claimSession(ctx, session, user)
+		if !ok {
+			return ctx
+		}
+
+		// Send available services
+		servicesSnac := oscar.NewSNAC(0x1, 0x3)
+		for _, service := range services.ServiceVersions {
+			servicesSnac.Data.WriteUint16(service.Family)
+		}
+
+		servicesFlap := oscar.NewFLAP(2)
+		servicesFlap.Data.WriteBinary(servicesSnac)
+		session.Send(servicesFlap)
+
+		return ctx
+	}
+
+	// handleFLAP handles the FLAPs of either server, passing logins on channel 1 to login and
+	// SNACs to the server's services
+	handleFLAP := func(serviceManager *ServiceManager, login func(context.Context, *oscar.FLAP) context.Context) oscar.HandlerFunc {
+		return func(ctx context.Context, flap *oscar.FLAP) context.Context {
+			session, err := oscar.SessionFromContext(ctx)
+			if err != nil {
+				// TODO
+				logger.Error("no session in context", slog.String("flap", flap.String()))
+				return ctx
+			}
+
+			// Protocol dumps are only worth building when they'll be logged
+			if session.Logger.Enabled(ctx, slog.LevelDebug) {
+				session.Logger.Debug("RECV", slog.Int("channel", int(flap.Header.Channel)), "flap", flap)
+			}
+
+			if user := models.UserFromContext(ctx); user != nil {
+				user.LastActivityAt = time.Now()
+			}
+
+			metrics.FLAPsReceived.WithLabelValues(metrics.Channel(flap.Header.Channel)).Inc()
+			stats.Default.BytesIn(flap.Len())
+
+			if flap.Header.Channel == 1 {
+				// Is this a hello?
+				if bytes.Equal(flap.Data.Bytes(), []byte{0, 0, 0, 1}) {
+					return ctx
+				}
+
+				return login(ctx, flap)
+			} else if flap.Header.Channel == 2 {
+				snac := &oscar.SNAC{}
+				if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
+					session.Logger.Error("could not unmarshal FLAP data", "err", err)
+					errFlap := oscar.NewFLAP(2)
+					errFlap.Data.WriteBinary(oscar.NewSNACError(0x01, 0, aimerror.CodeInvalidSNACHeader))
+					session.Send(errFlap)
+					return ctx
+				}
+
+				// Tell the client when it crosses a rate limit threshold, and stop listening to it
+				// if it keeps going
+				rateClass, rateState, rateChanged := session.RateLimiter.Check(snac.Header.Family, snac.Header.Subtype)
+				if rateChanged {
+					rateSnac := oscar.NewSNAC(1, 0xa)
+					session.RateLimiter.WriteRateChange(&rateSnac.Data, rateClass, rateState)
+					rateFlap := oscar.NewFLAP(2)
+					rateFlap.Data.WriteBinary(rateSnac)
+					session.Send(rateFlap)
+				}
+				if rateState == oscar.RateStateDisconnect {
+					session.Logger.Warn("disconnecting rate limited client", "rate_class", rateClass.ID)
+					session.Disconnect()
+					handleCloseFn(ctx, session)
+					return ctx
+				}
+				if rateState == oscar.RateStateLimited {
+					session.Logger.Debug("dropping rate limited SNAC", "snac", snac.String(), "rate_class", rateClass.ID)
+					return ctx
+				}
+
+				return serviceManager.HandleSNAC(ctx, db, snac)
+			} else if flap.Header.Channel == 4 {
+				handleCloseFn(ctx, session)
+			} else if flap.Header.Channel == 5 {
+				// Keepalive. The session has already heard from the client, which is all it's for.
+				return ctx
+			} else {
+				session.Logger.Info("unhandled channel message", "channel", flap.Header.Channel, "flap", flap)
+			}
+
+			return ctx
+		}
+	}
+
+	// Every session's context is under this one, which shutting down cancels
+	sessionsCtx, disconnectAll := context.WithCancel(context.Background())
+
+	// Bots are signed on for as long as the server runs
+	var bots sync.WaitGroup
+	for screenName, b := range options.bots {
+		bots.Add(1)
+		if err := startBot(sessionsCtx, db, sessionManager, bosServices, onlineCh, screenName, b, logger, bots.Done); err != nil {
+			logger.Error("Could not start bot", slog.String("bot", screenName), slog.String("err", err.Error()))
+			bots.Done()
+		}
+	}
+
+	authHandler := oscar.NewHandler(handleFLAP(authServices, authLogin), handleCloseFn)
+	authHandler.Context = sessionsCtx
+	authHandler.IdleTimeout = conf.KeepaliveTimeout
+	authHandler.MaxFLAPDataLength = conf.MaxFLAPSize
+
+	bosHandler := oscar.NewHandler(handleFLAP(bosServices, bosLogin), handleCloseFn)
+	bosHandler.Context = sessionsCtx
+	bosHandler.IdleTimeout = conf.KeepaliveTimeout
+	bosHandler.MaxFLAPDataLength = conf.MaxFLAPSize
+
+	// TOC clients sign on with their password and get a BOS session of their own
+	tocHandler := &toc.Handler{
+		DB:          db,
+		Services:    bosServices,
+		SignOn:      claimSession,
+		Close:       handleCloseFn,
+		Logins:      authService.Logins,
+		IdleTimeout: conf.KeepaliveTimeout,
+		Context:     sessionsCtx,
+	}
+
+	// Clients behind firewalls reach either server through the HTTP tunnel, by the port they
+	// would have connected to
+	_, authPort, _ := net.SplitHostPort(conf.Addr)
+	_, bosPort, _ := net.SplitHostPort(conf.AdvertisedBOS())
+	tunnelHandler := &tunnel.Handler{
+		Auth:           authHandler,
+		BOS:            bosHandler,
+		AuthPort:       authPort,
+		BOSPort:        bosPort,
+		TrustForwarded: conf.HTTPTunnelTrustForwarded,
+	}
+
+	// Clients connect to both servers, so they share the limit
+	if conf.MaxConnectionsPerIP > 0 {
+		connLimiter := oscar.NewConnLimiter(conf.MaxConnectionsPerIP)
+		authHandler.ConnLimiter = connLimiter
+		bosHandler.ConnLimiter = connLimiter
+		tocHandler.ConnLimiter = connLimiter
+		tunnelHandler.ConnLimiter = connLimiter
+	}
+
+	return &Server{
+		Sessions:          sessionManager,
+		Chat:              chatService,
+		logger:            logger,
+		bosHost:           conf.AdvertisedBOS(),
+		authHandler:       authHandler,
+		bosHandler:        bosHandler,
+		tocHandler:        tocHandler,
+		tunnelHandler:     tunnelHandler,
+		commCh:            commCh,
+		onlineCh:          onlineCh,
+		stopDecay:         stopDecay,
+		decayStopped:      decayStopped,
+		stopStatusReaper:  stopStatusReaper,
+		statusReaperDone:  statusReaperDone,
+		stopCookieCleanup: stopCookieCleanup,
+		stopMessageExpiry: stopMessageExpiry,
+		stopMissedFlush:   stopMissedFlush,
+		messageExpiryDone: messageExpiryDone,
+		stopRoomReaper:    stopRoomReaper,
+		roomReaperDone:    roomReaperDone,
+		stopStats:         stopStats,
+		statsDone:         statsDone,
+		disconnectAll:     disconnectAll,
+		bots:              &bots,
+
+		stopMessagePruning: stopMessagePruning,
+		messagePruningDone: messagePruningDone,
+	}
+}
+
+// Listeners are what the server accepts clients on
+type Listeners struct {
+	Auth []net.Listener
+	BOS  net.Listener
+
+	// TOC and Tunnel are nil when the TOC server and HTTP tunnel are off
+	TOC    net.Listener
+	Tunnel net.Listener
+}
+
+// Serve accepts clients on the listeners until one of them fails or the server shuts down
+func (s *Server) Serve(listeners Listeners) error {
+	all := append(append([]net.Listener{}, listeners.Auth...), listeners.BOS)
+	if listeners.TOC != nil {
+		all = append(all, listeners.TOC)
+	}
+	if listeners.Tunnel != nil {
+		all = append(all, listeners.Tunnel)
+	}
+	s.listenersMutex.Lock()
+	s.listeners = all
+	s.listenersMutex.Unlock()
+
+	s.logger.Info("BOS host " + s.bosHost)
+	s.serving.Store(true)
+	defer s.serving.Store(false)
+	acceptErr := make(chan error, len(all))
+	serve := func(listener net.Listener, handler connHandler, server string) {
+		s.logger.Info("Listening on "+listener.Addr().String(), "server", server)
+		go func() {
+			acceptErr <- handler.Serve(listener, s.logger.With("server", server))
+		}()
+	}
+	for _, listener := range listeners.Auth {
+		serve(listener, s.authHandler, "auth")
+	}
+	serve(listeners.BOS, s.bosHandler, "bos")
+	if listeners.TOC != nil {
+		serve(listeners.TOC, s.tocHandler, "toc")
+	}
+	if listeners.Tunnel != nil {
+		serve(listeners.Tunnel, s.tunnelHandler, "tunnel")
+	}
+
+	return <-acceptErr
+}
+
+// connHandler serves the connections a listener accepts, like the OSCAR, TOC and tunnel
+// handlers do
+type connHandler interface {
+	Serve(listener net.Listener, logger *slog.Logger) error
+}
+
+// Serving is whether the listeners are accepting clients
+func (s *Server) Serving() bool {
+	return s.serving.Load()
+}
+
+// Ready is whether the server is accepting clients and isn't shutting down, so it should be sent
+// new ones
+func (s *Server) Ready() bool {
+	return s.Serving() && !s.draining.Load()
+}
+
+// Drain stops reporting the server as ready, ahead of shutting it down
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Shutdown stops every listener, disconnects every client and stops the routines, whether it's
+// because of a signal or a listener failing
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		s.logger.Info("Shutting down")
+		s.Drain()
+		s.listenersMutex.Lock()
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+		s.listenersMutex.Unlock()
+
+		// Close handlers tell the routines users signed off, so they have to be done before
+		// the routines stop
+		s.disconnectAll()
+		s.authHandler.Wait()
+		s.bosHandler.Wait()
+		s.tocHandler.Wait()
+		s.bots.Wait()
+
+		close(s.stopDecay)
+		<-s.decayStopped
+		close(s.stopStatusReaper)
+		<-s.statusReaperDone
+		close(s.stopCookieCleanup)
+		close(s.stopMissedFlush)
+		close(s.stopMessageExpiry)
+		<-s.messageExpiryDone
+		close(s.stopRoomReaper)
+		<-s.roomReaperDone
+		close(s.stopMessagePruning)
+		<-s.messagePruningDone
+
+		close(s.commCh)
+		close(s.onlineCh)
+
+		// The totals are saved once more on the way out
+		close(s.stopStats)
+		<-s.statsDone
+	})
+}
@@ -0,0 +1,288 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/cmd/migrate/migrations"
+	"aim-oscar/config"
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/oscar/client"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// serverTestDB is a DB in a schema of its own, migrated like the server does when it starts
+// and dropped after the test
+func serverTestDB(t *testing.T) *bun.DB {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+	admin, err := db.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("server_test_%d", time.Now().UnixNano())
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("could not create schema: %s", err)
+	}
+	t.Cleanup(func() { admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE") })
+
+	// Every connection starts out in the schema
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("could not parse DSN: %s", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	d, err := db.NewDB(u.String())
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	if _, err := migrations.Up(ctx, d); err != nil {
+		t.Fatalf("could not migrate: %s", err)
+	}
+	return d
+}
+
+// startServer runs the server on ephemeral ports and returns the authorization server's address
+func startServer(t *testing.T, d *bun.DB, opts ...ServerOption) (*Server, string) {
+	server, authAddr, _ := startServerWithTOC(t, d, opts...)
+	return server, authAddr
+}
+
+// startServerWithTOC is startServer with a TOC listener too, and returns its address as well
+func startServerWithTOC(t *testing.T, d *bun.DB, opts ...ServerOption) (*Server, string, string) {
+	authListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	bosListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	tocListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	conf := config.OscarConfig{BOS: bosListener.Addr().String(), MultipleLogins: string(KickOldSession)}
+	server := NewServer(conf, d, slog.New(slog.NewTextHandler(io.Discard, nil)), opts...)
+	go server.Serve(Listeners{Auth: []net.Listener{authListener}, BOS: bosListener, TOC: tocListener})
+
+	// Clients signing off still tell their buddies, so they have to be gone before the routines
+	// stop
+	t.Cleanup(func() {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			signedOn := false
+			server.Sessions.Range(func(session *oscar.Session) bool {
+				signedOn = !session.Internal()
+				return !signedOn
+			})
+			if !signedOn {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		server.Shutdown()
+	})
+	return server, authListener.Addr().String(), tocListener.Addr().String()
+}
+
+// loggedInClient creates a verified account and logs it in
+func loggedInClient(t *testing.T, d *bun.DB, addr, screenName string) *client.Client {
+	ctx := context.Background()
+	if user, _ := models.UserByScreenName(ctx, d, screenName); user == nil {
+		user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+		if err != nil {
+			t.Fatalf("could not create user: %s", err)
+		}
+		user.Verified = true
+		if err := user.Update(ctx, d, "verified"); err != nil {
+			t.Fatalf("could not verify user: %s", err)
+		}
+	}
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	if err := c.Login(screenName, "password"); err != nil {
+		t.Fatalf("could not log in %s: %s", screenName, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// nextIM waits for the client to get an IM, skipping other events
+func nextIM(t *testing.T, c *client.Client) *client.IMReceived {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-c.Events():
+			if !ok {
+				t.Fatalf("%s was disconnected", c.ScreenName)
+			}
+			if im, ok := event.(*client.IMReceived); ok {
+				return im
+			}
+		case <-timeout:
+			t.Fatalf("expected %s to get an IM", c.ScreenName)
+		}
+	}
+}
+
+// Two clients log in through the authorization server and BOS, and IMs reach the recipient
+// straight away or once they sign back on
+func TestSendIM(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+
+	alice := loggedInClient(t, d, addr, "alice")
+	bob := loggedInClient(t, d, addr, "bob")
+	if err := alice.AddBuddy("bob"); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+
+	if err := alice.SendIM("bob", "hello bob"); err != nil {
+		t.Fatalf("could not send IM: %s", err)
+	}
+	im := nextIM(t, bob)
+	if im.From != "alice" || im.Text != "hello bob" {
+		t.Errorf("expected hello bob from alice, got %q from %s", im.Text, im.From)
+	}
+	if !im.SentAt.IsZero() {
+		t.Errorf("expected the IM to be delivered straight away, not from the offline queue")
+	}
+
+	bob.Close()
+	for deadline := time.Now().Add(5 * time.Second); server.Sessions.GetSession("bob") != nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected bob to be signed off")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := alice.SendIM("bob", "while you were out"); err != nil {
+		t.Fatalf("could not send IM: %s", err)
+	}
+	// The IM is stored once the server has handled it, which alice can't see
+	time.Sleep(100 * time.Millisecond)
+
+	bob = loggedInClient(t, d, addr, "bob")
+	im = nextIM(t, bob)
+	if im.From != "alice" || im.Text != "while you were out" {
+		t.Errorf("expected the offline IM from alice, got %q from %s", im.Text, im.From)
+	}
+	if im.SentAt.IsZero() {
+		t.Errorf("expected the offline IM to say when it was sent")
+	}
+}
+
+// nextReply waits for the client to get a SNAC, skipping other events
+func nextReply(t *testing.T, c *client.Client, family, subtype uint16) *oscar.SNAC {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-c.Events():
+			if !ok {
+				t.Fatalf("%s was disconnected", c.ScreenName)
+			}
+			if unknown, ok := event.(*client.UnknownSNAC); ok && unknown.SNAC.Header.Family == family && unknown.SNAC.Header.Subtype == subtype {
+				return unknown.SNAC
+			}
+		case <-timeout:
+			t.Fatalf("expected %s to get SNAC 0x%02x,0x%02x", c.ScreenName, family, subtype)
+		}
+	}
+}
+
+// Replies have the request ID of the request they answer, so clients with several requests in
+// flight can tell them apart. The login replies are checked by the client as it logs in.
+func TestReplyRequestIDs(t *testing.T) {
+	d := serverTestDB(t)
+	_, addr := startServer(t, d)
+
+	alice := loggedInClient(t, d, addr, "alice")
+	loggedInClient(t, d, addr, "bob")
+
+	userInfo := oscar.NewSNAC(0x02, 0x05)
+	userInfo.Data.WriteUint16(1) // profile
+	userInfo.Data.WriteLPString("bob")
+
+	tests := []struct {
+		name    string
+		request *oscar.SNAC
+		subtype uint16
+	}{
+		{"rate limits", oscar.NewSNAC(0x01, 0x06), 0x07},
+		{"self info", oscar.NewSNAC(0x01, 0x0e), 0x0f},
+		{"location rights", oscar.NewSNAC(0x02, 0x02), 0x03},
+		{"user info", userInfo, 0x06},
+		{"buddy list rights", oscar.NewSNAC(0x03, 0x02), 0x03},
+		{"ICBM parameters", oscar.NewSNAC(0x04, 0x04), 0x05},
+		{"privacy rights", oscar.NewSNAC(0x09, 0x02), 0x03},
+	}
+	for _, test := range tests {
+		requestID, err := alice.SendSNAC(test.request)
+		if err != nil {
+			t.Fatalf("could not send %s request: %s", test.name, err)
+		}
+		reply := nextReply(t, alice, test.request.Header.Family, test.subtype)
+		if reply.Header.RequestID != requestID {
+			t.Errorf("expected the %s reply to have request ID %d, got %d", test.name, requestID, reply.Header.RequestID)
+		}
+	}
+}
+
+// A client sending garbage only loses its own connection, and everyone else carries on
+func TestGarbageAfterLogin(t *testing.T) {
+	d := serverTestDB(t)
+	_, addr := startServer(t, d)
+
+	alice := loggedInClient(t, d, addr, "alice")
+	bob := loggedInClient(t, d, addr, "bob")
+	mallory := loggedInClient(t, d, addr, "mallory")
+
+	// A truncated SNAC header, then SNACs for each family with data that doesn't parse
+	truncated := oscar.NewFLAP(2)
+	truncated.Data.Write([]byte{0x00, 0x04, 0x00})
+	mallory.Send(truncated)
+	for family := uint16(0x01); family <= 0x17; family++ {
+		for _, subtype := range []uint16{0x02, 0x04, 0x05, 0x06, 0x08, 0x0b} {
+			snac := oscar.NewSNAC(family, subtype)
+			snac.Data.Write([]byte{0xff, 0xff, 0x00, 0x07, 0xde, 0xad})
+			mallory.SendSNAC(snac)
+		}
+	}
+	mallory.Send(&oscar.FLAP{Header: oscar.FLAPHeader{Channel: 9}})
+	mallory.Close()
+
+	if err := alice.SendIM("bob", "still here?"); err != nil {
+		t.Fatalf("could not send IM: %s", err)
+	}
+	if im := nextIM(t, bob); im.From != "alice" || im.Text != "still here?" {
+		t.Errorf("expected still here? from alice, got %q from %s", im.Text, im.From)
+	}
+}
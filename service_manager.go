@@ -1,6 +1,17 @@
 package main
 
-import "aim-oscar/services"
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/metrics"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
 
 type ServiceManager struct {
 	services map[uint16]services.Service
@@ -20,3 +31,56 @@ func (sm *ServiceManager) GetService(family uint16) (services.Service, bool) {
 	s, ok := sm.services[family]
 	return s, ok
 }
+
+// HandleSNAC passes the SNAC to the service for its family. A request the service fails to
+// handle or doesn't support, or for a family this server or service connection doesn't offer,
+// gets an error reply and leaves the connection open.
+func (sm *ServiceManager) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) context.Context {
+	session, err := oscar.SessionFromContext(ctx)
+	if err != nil {
+		return ctx
+	}
+
+	// Families nothing here implements are answered in generic service controls, since there's
+	// no service to answer in their own family
+	service, ok := sm.GetService(snac.Header.Family)
+	if !ok {
+		session.Logger.Debug("SNAC for a family this server doesn't support", "family", metrics.Hex(snac.Header.Family), "subtype", metrics.Hex(snac.Header.Subtype))
+		errFlap := oscar.NewFLAP(2)
+		errFlap.Data.WriteBinary(oscar.NewSNACError(0x01, snac.Header.RequestID, aimerror.CodeNotSupportedByHost))
+		session.Send(errFlap)
+		return ctx
+	}
+	if family := services.ServiceFamilyFromContext(ctx); family != 0 && snac.Header.Family != 0x01 && snac.Header.Family != family {
+		session.Logger.Warn("SNAC for a family this service connection doesn't offer", "snac", snac.String())
+		errFlap := oscar.NewFLAP(2)
+		errFlap.Data.WriteBinary(oscar.NewSNACError(snac.Header.Family, snac.Header.RequestID, aimerror.CodeServiceNotDefined))
+		session.Send(errFlap)
+		return ctx
+	}
+
+	family, subtype := metrics.Hex(snac.Header.Family), metrics.Hex(snac.Header.Subtype)
+	snacCtx := oscar.NewContextWithLogger(ctx, session.Logger.With("family", family, "subtype", subtype))
+
+	start := time.Now()
+	newCtx, err := service.HandleSNAC(snacCtx, db, snac)
+	metrics.SNACDuration.WithLabelValues(family, subtype).Observe(time.Since(start).Seconds())
+	metrics.SNACsHandled.WithLabelValues(family, subtype).Inc()
+	if err != nil {
+		// Services log the subtypes they don't support themselves
+		if !errors.Is(err, aimerror.NotSupported) {
+			oscar.LoggerFromContext(snacCtx).Error("error handling SNAC", slog.String("err", err.Error()))
+		}
+
+		errFlap := oscar.NewFLAP(2)
+		errFlap.Data.WriteBinary(oscar.NewSNACError(snac.Header.Family, snac.Header.RequestID, aimerror.Code(err)))
+		session.Send(errFlap)
+		return ctx
+	}
+
+	// The SNAC's logger is only for this SNAC
+	if newCtx == snacCtx {
+		return ctx
+	}
+	return newCtx
+}
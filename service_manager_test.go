@@ -0,0 +1,131 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Truncated SNACs and SNACs the server doesn't support get an error reply with their request ID,
+// in their family or in generic service controls for families the server doesn't have, and the
+// connection stays open
+func TestHandleSNACTruncated(t *testing.T) {
+	sm := NewServiceManager()
+	sm.RegisterService(0x04, &services.ICBM{})
+	sm.RegisterService(0x13, &services.FeedbagService{})
+
+	tt := map[string]struct {
+		snac     *oscar.SNAC
+		expected []byte
+	}{
+		"typing notification without a screen name": {
+			func() *oscar.SNAC {
+				snac := oscar.NewSNAC(0x04, 0x14)
+				snac.Header.RequestID = 7
+				snac.Data.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 1})
+				return snac
+			}(),
+			[]byte{0x00, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x0e},
+		},
+		"message without a channel": {
+			func() *oscar.SNAC {
+				snac := oscar.NewSNAC(0x04, 0x06)
+				snac.Header.RequestID = 0x01020304
+				snac.Data.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 0})
+				return snac
+			}(),
+			[]byte{0x00, 0x04, 0x00, 0x01, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x00, 0x0e},
+		},
+		"unknown ICBM subtype": {
+			func() *oscar.SNAC {
+				snac := oscar.NewSNAC(0x04, 0x7f)
+				snac.Header.RequestID = 11
+				return snac
+			}(),
+			[]byte{0x00, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0b, 0x00, 0x08},
+		},
+		"login on the BOS server": {
+			func() *oscar.SNAC {
+				snac := oscar.NewSNAC(0x17, 0x06)
+				snac.Header.RequestID = 9
+				return snac
+			}(),
+			[]byte{0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x00, 0x08},
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			ctx := oscar.NewContextWithSession(context.Background(), server, logger)
+			ctx = models.NewContextWithUser(ctx, &models.User{ScreenName: "alice"})
+
+			go sm.HandleSNAC(ctx, nil, tc.snac)
+
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			header := make([]byte, 6)
+			if _, err := io.ReadFull(client, header); err != nil {
+				t.Fatalf("expected an error reply, got %s", err)
+			}
+			data := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+			if _, err := io.ReadFull(client, data); err != nil {
+				t.Fatalf("could not read error reply: %s", err)
+			}
+			if !bytes.Equal(data, tc.expected) {
+				t.Errorf("expected error SNAC %v, got %v", tc.expected, data)
+			}
+
+			// Still connected
+			session, _ := oscar.SessionFromContext(ctx)
+			go session.Send(oscar.NewFLAP(5))
+			if _, err := io.ReadFull(client, header); err != nil {
+				t.Errorf("expected the connection to stay open, got %s", err)
+			}
+		})
+	}
+}
+
+// Service connections only reach generic service controls and their own service
+func TestHandleSNACServiceConnection(t *testing.T) {
+	sm := NewServiceManager()
+	sm.RegisterService(0x04, &services.ICBM{})
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := oscar.NewContextWithSession(context.Background(), server, logger)
+	ctx = services.NewContextWithServiceFamily(ctx, 0x0e)
+
+	snac := oscar.NewSNAC(0x04, 0x06)
+	snac.Header.RequestID = 3
+	go sm.HandleSNAC(ctx, nil, snac)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(client, header); err != nil {
+		t.Fatalf("expected an error reply, got %s", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if _, err := io.ReadFull(client, data); err != nil {
+		t.Fatalf("could not read error reply: %s", err)
+	}
+	expected := []byte{0x00, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x06}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected error SNAC %v, got %v", expected, data)
+	}
+}
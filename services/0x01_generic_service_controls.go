@@ -5,8 +5,11 @@ import (
 	"aim-oscar/models"
 	"aim-oscar/oscar"
 	"aim-oscar/util"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/pkg/errors"
@@ -26,81 +29,282 @@ func init() {
 		{0x02, 1},
 		{0x03, 1},
 		{0x04, 1},
+		{0x06, 1},
+		{0x07, 1},
+		{0x09, 1},
+		{0x0a, 1},
+		{0x0b, 1},
+		{0x0d, 1},
 		{0x0f, 1},
+		{0x10, 1},
 		{0x13, 1},
-		{0x17, 1},
+		{0x15, 1},
 		{0x18, 1},
 	}
 }
 
+// NegotiateVersions picks the version of each family the client asked for that the server
+// offers, the lower of the two. Families the server doesn't offer are left out.
+func NegotiateVersions(requested []ServiceVersion) map[uint16]uint16 {
+	versions := make(map[uint16]uint16)
+	for _, request := range requested {
+		for _, service := range ServiceVersions {
+			if service.Family != request.Family {
+				continue
+			}
+			version := service.Version
+			if request.Version < version {
+				version = request.Version
+			}
+			versions[request.Family] = version
+		}
+	}
+	return versions
+}
+
+// NegotiatedVersion is the version of the family the session's client and the server agreed
+// on. Clients that never said which versions they speak get the server's. Returns 0 for
+// families the server doesn't offer.
+func NegotiatedVersion(session *oscar.Session, family uint16) uint16 {
+	if session != nil && session.Versions != nil {
+		return session.Versions[family]
+	}
+	for _, service := range ServiceVersions {
+		if service.Family == family {
+			return service.Version
+		}
+	}
+	return 0
+}
+
+// ServiceFamilies are the services clients can open a connection of their own for with a
+// service request (0x01,0x04)
+var ServiceFamilies = map[uint16]bool{
+	0x0d: true, // chat navigation
+	0x0e: true, // chat
+	0x10: true, // buddy icons
+}
+
+type serviceKey string
+
+func (s serviceKey) String() string {
+	return "service-" + string(s)
+}
+
+var serviceFamilyKey = serviceKey("family")
+
+// NewContextWithServiceFamily limits the connection to the service family, besides generic
+// service controls
+func NewContextWithServiceFamily(ctx context.Context, family uint16) context.Context {
+	return context.WithValue(ctx, serviceFamilyKey, family)
+}
+
+// ServiceFamilyFromContext is the family a service connection is for, 0 for a BOS connection
+// which can use every service
+func ServiceFamilyFromContext(ctx context.Context) uint16 {
+	family, _ := ctx.Value(serviceFamilyKey).(uint16)
+	return family
+}
+
+// NewServiceContext sets up a connection opened with a service cookie for the cookie's family,
+// and for chat joins it to the cookie's room once the client is ready
+func NewServiceContext(ctx context.Context, db bun.IDB, cookie *models.AuthCookie) (context.Context, error) {
+	ctx = NewContextWithServiceFamily(ctx, cookie.Family)
+	if cookie.Family != 0x0e {
+		return ctx, nil
+	}
+
+	room, err := models.ChatRoomByCookie(ctx, db, cookie.RoomExchange, cookie.RoomCookie)
+	if err != nil {
+		return ctx, err
+	}
+	if room == nil {
+		return ctx, errors.New("service cookie for a chat room that no longer exists")
+	}
+	return NewContextWithChatRoom(ctx, room), nil
+}
+
+// readServiceRoom reads the room of a chat service request, which is the room info block
+// without a detail level
+func readServiceRoom(ctx context.Context, db bun.IDB, data []byte) (*models.ChatRoom, error) {
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	exchange, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read exchange")
+	}
+	cookieLength, err := buf.ReadUint8()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read cookie length")
+	}
+	cookie, err := buf.ReadBytes(int(cookieLength))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read cookie")
+	}
+
+	return models.ChatRoomByCookie(ctx, db, exchange, string(cookie))
+}
+
+// MOTDSNAC is the message of the day SNAC (0x01,0x13) for motd, or the one saying there isn't one
+// if motd is nil
+func MOTDSNAC(motd *models.MOTD) *oscar.SNAC {
+	motdSnac := oscar.NewSNAC(0x01, 0x13)
+	if motd == nil {
+		motdSnac.Data.WriteUint16(models.MOTDTypeNone)
+		return motdSnac
+	}
+
+	motdSnac.Data.WriteUint16(motd.Type)
+	motdSnac.WriteTLV(oscar.NewTLV(0x0b, []byte(motd.Text)))
+	return motdSnac
+}
+
+// writeSelfInfo writes the user's own online information (0x01,0x0f) to the SNAC. Besides what
+// buddies see, the user also sees the address they're connecting from.
+func writeSelfInfo(ctx context.Context, snac *oscar.SNAC, user *models.User, session *oscar.Session) {
+	externalIP := make([]byte, 4)
+	if ip := net.ParseIP(sessionIP(ctx)).To4(); ip != nil {
+		externalIP = ip
+	}
+	WriteUserInfo(snac, user, session, oscar.NewTLV(0x0a, externalIP))
+}
+
+// OfflineMessageLimit is the most stored messages delivered when a user signs on. The rest
+// are delivered the next time they sign on.
+const OfflineMessageLimit = 25
+
 type GenericServiceControls struct {
-	OnlineCh       chan *models.User
+	OnlineCh       chan *PresenceEvent
+	CommCh         chan *models.Message
+	Chat           *ChatService
 	ServerHostname string
+
+	// UsageReportInterval is how many hours clients are told to wait between usage reports. 0
+	// doesn't tell them.
+	UsageReportInterval uint16
 }
 
 func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, _ := oscar.SessionFromContext(ctx)
-	logger := session.Logger.With("service", "generic service controls")
+	logger := oscar.LoggerFromContext(ctx).With("service", "generic service controls")
 
 	switch snac.Header.Subtype {
 
 	// Client is ONLINE and READY
 	case 0x02:
+		// Chat connections join their room instead of signing the user on
+		if room := ChatRoomFromContext(ctx); room != nil {
+			if err := g.Chat.Join(ctx, room); err != nil {
+				return ctx, err
+			}
+			return ctx, room.Touch(ctx, db)
+		}
+
+		// The user is already signed on through BOS
+		if ServiceFamilyFromContext(ctx) != 0 {
+			return ctx, nil
+		}
+
 		user := models.UserFromContext(ctx)
 		if user != nil {
-			user.Status = models.UserStatusOnline
+			// Clients can set a status, like invisible, before they're ready
+			if !user.Status.Connected() {
+				user.Status = models.UserStatusOnline
+				if user.AwayMessage != "" {
+					user.Status = models.UserStatusAway
+				}
+			}
 			if err := user.Update(ctx, db, "status"); err != nil {
 				return ctx, errors.Wrap(err, "could not set user as active")
 			}
 
-			g.OnlineCh <- user
+			session.Ready = true
+			g.OnlineCh <- StatusChanged(user)
+
+			// Deliver the messages that were sent while the user was offline, oldest first
+			messages, err := models.UndeliveredFor(ctx, db, user.ScreenName, OfflineMessageLimit)
+			if err != nil {
+				return ctx, err
+			}
+
+			for _, message := range messages {
+				message.Queued = true
+				g.CommCh <- message
+			}
 
 			return models.NewContextWithUser(ctx, user), nil
 		}
 
 		return ctx, nil
 
+	// Client wants a connection of its own for a service, like a chat room
 	case 0x04:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
 		family, err := snac.Data.ReadUint16()
 		if err != nil {
 			return ctx, errors.Wrap(err, "could not read family")
 		}
-		logger.Warn(fmt.Sprintf("client wants service for family 0x%02x", family))
-		return ctx, nil
+
+		// Only BOS connections can open more
+		if !ServiceFamilies[family] || ServiceFamilyFromContext(ctx) != 0 {
+			logger.Info(fmt.Sprintf("refusing service for family 0x%02x", family))
+			errFlap := oscar.NewFLAP(2)
+			errFlap.Data.WriteBinary(oscar.NewSNACError(0x01, snac.Header.RequestID, aimerror.CodeServiceNotDefined))
+			return ctx, session.Send(errFlap)
+		}
+
+		// Chat connections are for the room in TLV 0x01
+		var room *models.ChatRoom
+		if family == 0x0e {
+			tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+			if err != nil {
+				return ctx, errors.Wrap(err, "could not read service request TLVs")
+			}
+			roomTLV := oscar.FindTLV(tlvs, 0x01)
+			if roomTLV == nil {
+				return ctx, errors.New("chat service request missing room TLV 0x01")
+			}
+			if room, err = readServiceRoom(ctx, db, roomTLV.Data); err != nil {
+				return ctx, err
+			}
+			if room == nil {
+				return ctx, errors.New("chat service request for a room that doesn't exist")
+			}
+			if g.Chat != nil && !g.Chat.Registry.Admit(room, user.ScreenName, time.Now()) {
+				logger.Info("refusing chat service for a full room", "room", room.Name)
+				errFlap := oscar.NewFLAP(2)
+				errFlap.Data.WriteBinary(oscar.NewSNACError(0x01, snac.Header.RequestID, aimerror.CodeRequestDenied))
+				return ctx, session.Send(errFlap)
+			}
+		}
+
+		cookie, err := models.CreateServiceCookie(ctx, db, user.UIN, sessionIP(ctx), family, room)
+		if err != nil {
+			return ctx, err
+		}
+
+		redirectSnac := oscar.NewReplySNAC(snac, 0x01, 0x05)
+		redirectSnac.Data.WriteBinary(oscar.NewTLV(0x0d, util.Word(family)))
+		redirectSnac.Data.WriteBinary(oscar.NewTLV(0x05, []byte(g.ServerHostname)))
+		redirectSnac.Data.WriteBinary(oscar.NewTLV(0x06, cookie))
+		redirectFlap := oscar.NewFLAP(2)
+		redirectFlap.Data.WriteBinary(redirectSnac)
+		return ctx, session.Send(redirectFlap)
 
 	// Client wants to know the rate limits for all services
 	case 0x06:
-		rateSnac := oscar.NewSNAC(1, 7)
-		rateSnac.Data.WriteUint16(1) // one rate class
-
-		// Define a Rate Class
-		rc := oscar.Buffer{}
-		rc.WriteUint16(1)    // ID
-		rc.WriteUint32(80)   // Window Size
-		rc.WriteUint32(2500) // Clear level
-		rc.WriteUint32(2000) // Alert level
-		rc.WriteUint32(1500) // Limit level
-		rc.WriteUint32(800)  // Disconnect level
-		rc.WriteUint32(3400) // Current level (fake)
-		rc.WriteUint32(6000) // Max level
-		rc.WriteUint32(0)    // Last time ?
-		rc.WriteUint8(0)     // Current state ?
-		rateSnac.Data.Write(rc.Bytes())
-
-		// Define a Rate Group
-		rg := oscar.Buffer{}
-		rg.WriteUint16(1) // ID
-
-		// TODO: make actual rate groups instead of this hack. I can't tell which subtypes are supported so
-		// make it set rate limits for every family and all subtypes under 0x21.
-		rg.WriteUint16(uint16(len(ServiceVersions)) * 0x21) // Number of rate groups
+		families := make([]uint16, 0, len(ServiceVersions))
 		for _, service := range ServiceVersions {
-			for subtype := 0; subtype < 0x21; subtype++ {
-				rg.WriteUint16(service.Family)
-				rg.WriteUint16(uint16(subtype))
-			}
+			families = append(families, service.Family)
 		}
-		rateSnac.Data.Write(rg.Bytes())
+
+		rateSnac := oscar.NewReplySNAC(snac, 1, 7)
+		session.RateLimiter.WriteRateParams(&rateSnac.Data, families)
 
 		rateFlap := oscar.NewFLAP(2)
 		rateFlap.Data.WriteBinary(rateSnac)
@@ -110,6 +314,11 @@ func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, sna
 	case 0x08:
 		return ctx, nil
 
+	// Client has stopped sending because the server paused it to migrate it to another host
+	case 0x0c:
+		session.AckPause()
+		return ctx, nil
+
 	// Client wants their own online information
 	case 0x0e:
 		user := models.UserFromContext(ctx)
@@ -117,52 +326,200 @@ func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, sna
 			return ctx, aimerror.NoUserInSession
 		}
 
-		onlineSnac := oscar.NewSNAC(0x1, 0xf)
-		onlineSnac.Data.WriteUint8(uint8(len(user.ScreenName)))
-		onlineSnac.Data.WriteString(user.ScreenName)
-		onlineSnac.Data.WriteUint16(0) // warning level
-
-		user.Status = models.UserStatusOnline
-		if err := user.Update(ctx, db, "status"); err != nil {
-			return ctx, errors.Wrap(err, "could not set user as active")
+		// The user's warning level changes when other people warn them
+		if current, err := models.UserByUIN(ctx, db, user.UIN); err == nil && current != nil {
+			user.WarningLevel = current.WarningLevel
 		}
 
-		tlvs := []*oscar.TLV{
-			oscar.NewTLV(0x01, util.Dword(0x0100)),                                            // User Class
-			oscar.NewTLV(0x06, util.Dword(uint32(user.Status))),                               // user status
-			oscar.NewTLV(0x0a, util.Dword(0)),                                                 // External IP of the client?
-			oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(user.LastActivityAt).Seconds()))), // Idle Time
-			oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                         // Client Signon Time
-			oscar.NewTLV(0x1e, util.Dword(0x0)),                                               // Unknown value
-			oscar.NewTLV(0x05, util.Dword(uint32(user.CreatedAt.Unix()))),                     // Member since
+		// Asking for their own info doesn't bring an away user back
+		if !user.Status.Connected() {
+			user.Status = models.UserStatusOnline
+			if err := user.Update(ctx, db, "status"); err != nil {
+				return ctx, errors.Wrap(err, "could not set user as active")
+			}
 		}
 
-		onlineSnac.AppendTLVs(tlvs)
+		selfInfoSnac := oscar.NewReplySNAC(snac, 0x1, 0xf)
+		writeSelfInfo(ctx, selfInfoSnac, user, session)
 
-		onlineFlap := oscar.NewFLAP(2)
-		onlineFlap.Data.WriteBinary(onlineSnac)
-		return models.NewContextWithUser(ctx, user), session.Send(onlineFlap)
+		selfInfoFlap := oscar.NewFLAP(2)
+		selfInfoFlap.Data.WriteBinary(selfInfoSnac)
+		return models.NewContextWithUser(ctx, user), session.Send(selfInfoFlap)
 
 	// Client tells us the idle time
 	case 0x11:
-		// TODO: keep track of idle time
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		idleSeconds, err := snac.Data.ReadUint32()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read idle time")
+		}
+
+		// Zero means the user is no longer idle
+		if idleSeconds == 0 {
+			session.SetIdleSince(time.Time{})
+		} else {
+			session.SetIdleSince(time.Now().Add(-time.Duration(idleSeconds) * time.Second))
+		}
+
+		g.OnlineCh <- IdleChanged(user)
+		return ctx, nil
+
+	// Client sets its extended status, like invisible or do not disturb, its available message
+	// or its buddy icon
+	case 0x1e:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read extended status TLVs")
+		}
+
+		infoChanged := false
+		if bartTLV := oscar.FindTLV(tlvs, 0x1d); bartTLV != nil {
+			if infoChanged, err = g.setBARTInfo(ctx, db, session, user, bartTLV.Data); err != nil {
+				return ctx, err
+			}
+		}
+
+		// The high word holds flags like whether the user's web aware, which buddies don't see
+		status := user.Status
+		if statusTLV := oscar.FindTLV(tlvs, 0x06); statusTLV != nil && len(statusTLV.Data) >= 4 {
+			status = StatusFromFlags(binary.BigEndian.Uint16(statusTLV.Data[2:4]))
+		}
+
+		// Clients send their status again whenever anything about it changes, which buddies
+		// only need to hear about if it's the status itself. Before the client is ready the
+		// status is kept for when it signs on.
+		if !session.Ready || status == user.Status {
+			user.Status = status
+			if session.Ready && infoChanged {
+				g.OnlineCh <- InfoChanged(user)
+			}
+			return ctx, nil
+		}
+
+		// Whoever was sent the away message gets it again if the user goes away again
+		if user.Status == models.UserStatusAway {
+			session.ResetAutoReplies()
+		}
+		user.Status = status
+		if err := user.Update(ctx, db, "status"); err != nil {
+			return ctx, errors.Wrap(err, "could not set status")
+		}
+		g.OnlineCh <- StatusChanged(user)
 		return ctx, nil
 
 	case 0x16:
 		// NOP, client keepalive
 		return ctx, nil
 
-	// Client wants to know the ServiceVersions of all of the services offered
+	// Client says which version of each service it speaks, and wants to know which the server will use
 	case 0x17:
-		versionsSnac := oscar.NewSNAC(0x1, 0x18)
-		for _, service := range ServiceVersions {
-			versionsSnac.Data.WriteUint16(service.Family)
-			versionsSnac.Data.WriteUint16(service.Version)
+		var requested []ServiceVersion
+		for len(snac.Data.Bytes()) >= 4 {
+			family, _ := snac.Data.ReadUint16()
+			version, _ := snac.Data.ReadUint16()
+			requested = append(requested, ServiceVersion{Family: family, Version: version})
+		}
+		session.Versions = NegotiateVersions(requested)
+
+		// Only the families both sides know about, in the order the client asked for them
+		versionsSnac := oscar.NewReplySNAC(snac, 0x1, 0x18)
+		for _, request := range requested {
+			if version, ok := session.Versions[request.Family]; ok {
+				versionsSnac.Data.WriteUint16(request.Family)
+				versionsSnac.Data.WriteUint16(version)
+			}
 		}
 		versionsFlap := oscar.NewFLAP(2)
 		versionsFlap.Data.WriteBinary(versionsSnac)
-		return ctx, session.Send(versionsFlap)
+		if err := session.Send(versionsFlap); err != nil {
+			return ctx, err
+		}
+
+		// Users get the message of the day and the usage report interval once, on their BOS
+		// connection. Some clients wait for the MOTD, so it's sent even when there isn't one.
+		if ServiceFamilyFromContext(ctx) != 0 {
+			return ctx, nil
+		}
+		motd, err := models.CurrentMOTD(ctx, db)
+		if err != nil {
+			logger.Error("could not fetch MOTD", "err", err)
+		}
+		motdFlap := oscar.NewFLAP(2)
+		motdFlap.Data.WriteBinary(MOTDSNAC(motd))
+		if err := session.Send(motdFlap); err != nil {
+			return ctx, err
+		}
+
+		if g.UsageReportInterval == 0 {
+			return ctx, nil
+		}
+		intervalFlap := oscar.NewFLAP(2)
+		intervalFlap.Data.WriteBinary(ReportIntervalSNAC(g.UsageReportInterval))
+		return ctx, session.Send(intervalFlap)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown generic service controls family/subtype: 0x01, 0x%02x", snac.Header.Subtype))
+	return ctx, aimerror.NotSupported
+}
+
+// setBARTInfo applies the BART items from an extended status update: the available message
+// goes on the session and a buddy icon the server already has becomes the user's. The client
+// is asked to upload icons the server doesn't have. Returns whether buddies need to hear about
+// it.
+func (g *GenericServiceControls) setBARTInfo(ctx context.Context, db *bun.DB, session *oscar.Session, user *models.User, data []byte) (bool, error) {
+	ids, err := readBARTIDs(data)
+	if err != nil {
+		return false, errors.Wrap(err, "could not read BART info")
+	}
+
+	changed := false
+	for _, id := range ids {
+		switch id.Type {
+		case BARTTypeStatusText:
+			message, err := readStatusText(id)
+			if err != nil {
+				return false, err
+			}
+			if session.SetAvailableMessage(message) {
+				changed = true
+			}
+
+		case BARTTypeBuddyIcon:
+			if len(id.Hash) == 0 || bytes.Equal(id.Hash, user.BuddyIconHash) {
+				continue
+			}
+
+			icon, err := models.BuddyIconByHash(ctx, db, id.Hash)
+			if err != nil {
+				return false, err
+			}
+			if icon == nil {
+				replySnac := oscar.NewSNAC(0x01, 0x21)
+				replySnac.Data.Write((&bartID{Type: id.Type, Flags: BARTFlagKnown | BARTFlagUpload, Hash: id.Hash}).Bytes())
+				replyFlap := oscar.NewFLAP(2)
+				replyFlap.Data.WriteBinary(replySnac)
+				if err := session.Send(replyFlap); err != nil {
+					return false, err
+				}
+				continue
+			}
+
+			user.BuddyIconHash = icon.Hash
+			if err := user.Update(ctx, db, "buddy_icon_hash"); err != nil {
+				return false, errors.Wrap(err, "could not set buddy icon")
+			}
+			changed = true
+		}
 	}
 
-	return ctx, nil
+	return changed, nil
 }
@@ -0,0 +1,430 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func extendedStatus(flags uint32) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x01, 0x1e)
+	snac.WriteTLV(oscar.NewTLV(0x06, util.Dword(flags)))
+	return snac
+}
+
+// Buddies only hear about the extended status once the user has signed on, and only when it
+// changes
+func TestExtendedStatus(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	alice.Status = models.UserStatusOffline
+	ctx, _ := fakeClient(t, alice.ScreenName)
+	ctx = models.NewContextWithUser(ctx, alice)
+
+	onlineCh := make(chan *PresenceEvent, 4)
+	g := &GenericServiceControls{OnlineCh: onlineCh}
+
+	expectEvent := func(status models.UserStatus) {
+		t.Helper()
+		select {
+		case event := <-onlineCh:
+			if event.User.Status != status {
+				t.Errorf("expected buddies to hear alice is %s, got %s", status, event.User.Status)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("expected buddies to hear alice is %s", status)
+		}
+	}
+	expectNoEvent := func() {
+		t.Helper()
+		select {
+		case event := <-onlineCh:
+			t.Fatalf("expected no presence event, got %s", event.User.Status)
+		default:
+		}
+	}
+
+	// Invisible before the client is ready, which signs on invisible
+	if _, err := g.HandleSNAC(ctx, d, extendedStatus(0x00000100)); err != nil {
+		t.Fatalf("could not set status: %s", err)
+	}
+	expectNoEvent()
+	if _, err := g.HandleSNAC(ctx, d, oscar.NewSNAC(0x01, 0x02)); err != nil {
+		t.Fatalf("could not sign on: %s", err)
+	}
+	expectEvent(models.UserStatusInvisible)
+
+	// Setting invisible again changes nothing
+	if _, err := g.HandleSNAC(ctx, d, extendedStatus(0x00000100)); err != nil {
+		t.Fatalf("could not set status: %s", err)
+	}
+	expectNoEvent()
+
+	// The web aware flag in the high word doesn't matter
+	if _, err := g.HandleSNAC(ctx, d, extendedStatus(0x00010013)); err != nil {
+		t.Fatalf("could not set status: %s", err)
+	}
+	expectEvent(models.UserStatusDnd)
+
+	user, err := models.UserByUIN(context.Background(), d, alice.UIN)
+	if err != nil {
+		t.Fatalf("could not fetch user: %s", err)
+	}
+	if user.Status != models.UserStatusDnd {
+		t.Errorf("expected the status to be saved, got %s", user.Status)
+	}
+}
+
+// Advertising an icon the server doesn't have asks the client to upload it, and one it has
+// becomes the user's icon
+func TestExtendedStatusBuddyIcon(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.BuddyIcon)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+
+	alice := testUser(t, d, "alice")
+	aliceCtx, snacs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	session, _ := oscar.SessionFromContext(aliceCtx)
+	session.Ready = true
+
+	onlineCh := make(chan *PresenceEvent, 4)
+	g := &GenericServiceControls{OnlineCh: onlineCh}
+
+	advertise := func(hash []byte) {
+		t.Helper()
+		snac := oscar.NewSNAC(0x01, 0x1e)
+		snac.WriteTLV(oscar.NewTLV(0x1d, (&bartID{Type: BARTTypeBuddyIcon, Flags: BARTFlagKnown, Hash: hash}).Bytes()))
+		if _, err := g.HandleSNAC(aliceCtx, d, snac); err != nil {
+			t.Fatalf("could not advertise icon: %s", err)
+		}
+	}
+
+	unknown := []byte(uuid.New().String())[:16]
+	advertise(unknown)
+	reply := expectSNAC(t, snacs, 0x01, 0x21)
+	id, err := readBARTID(&reply.Data)
+	if err != nil {
+		t.Fatalf("could not read BART ID: %s", err)
+	}
+	if id.Flags&BARTFlagUpload == 0 || string(id.Hash) != string(unknown) {
+		t.Errorf("expected an upload request for the icon, got %+v", id)
+	}
+	if len(alice.BuddyIconHash) != 0 {
+		t.Errorf("expected an unknown icon not to be set")
+	}
+
+	icon, err := models.StoreBuddyIcon(ctx, d, []byte(uuid.New().String()))
+	if err != nil {
+		t.Fatalf("could not store icon: %s", err)
+	}
+	advertise(icon.Hash)
+	expectNoSNAC(t, snacs)
+	select {
+	case event := <-onlineCh:
+		if event.Type != PresenceInfoChanged {
+			t.Errorf("expected an info change, got %v", event.Type)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("expected buddies to hear about the icon")
+	}
+
+	user, err := models.UserByUIN(ctx, d, alice.UIN)
+	if err != nil {
+		t.Fatalf("could not fetch user: %s", err)
+	}
+	if string(user.BuddyIconHash) != string(icon.Hash) {
+		t.Errorf("expected the icon to be saved")
+	}
+}
+
+// A chat service request hands out a cookie that opens one connection to the room
+func TestServiceRequestChat(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.ChatRoom)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+	room := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: uuid.New().String(), Name: "service request"}
+	if _, err := d.NewInsert().Model(room).Exec(ctx); err != nil {
+		t.Fatalf("could not create room: %s", err)
+	}
+	defer d.NewDelete().Model(room).WherePK().Exec(ctx)
+
+	alice := testUser(t, d, "alice")
+	aliceCtx, snacs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	g := &GenericServiceControls{ServerHostname: "aim.example.com:5191"}
+
+	roomInfo := oscar.Buffer{}
+	roomInfo.WriteUint16(room.Exchange)
+	roomInfo.WriteLPString(room.Cookie)
+	roomInfo.WriteUint16(room.Instance)
+	request := serviceRequest(0x0e)
+	request.WriteTLV(oscar.NewTLV(0x01, roomInfo.Bytes()))
+	if _, err := g.HandleSNAC(aliceCtx, d, request); err != nil {
+		t.Fatalf("could not request chat service: %s", err)
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(expectSNAC(t, snacs, 0x01, 0x05).Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read redirect TLVs: %s", err)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x0d); tlv == nil || string(tlv.Data) != string(util.Word(0x0e)) {
+		t.Errorf("expected the chat family, got %v", tlv)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x05); tlv == nil || string(tlv.Data) != g.ServerHostname {
+		t.Errorf("expected the server address, got %v", tlv)
+	}
+	cookieTLV := oscar.FindTLV(tlvs, 0x06)
+	if cookieTLV == nil {
+		t.Fatalf("expected a cookie")
+	}
+
+	cookieFlap := oscar.NewFLAP(1)
+	cookieFlap.Data.WriteUint32(1)
+	cookieFlap.Data.WriteBinary(cookieTLV)
+	user, cookie, err := AuthenticateFLAPCookie(ctx, d, cookieFlap)
+	if err != nil {
+		t.Fatalf("expected the cookie to open a connection, got %s", err)
+	}
+	if user.UIN != alice.UIN || cookie.Family != 0x0e {
+		t.Errorf("expected a chat connection for alice, got family 0x%02x for %s", cookie.Family, user.ScreenName)
+	}
+
+	serviceCtx, err := NewServiceContext(ctx, d, cookie)
+	if err != nil {
+		t.Fatalf("could not open service connection: %s", err)
+	}
+	if ServiceFamilyFromContext(serviceCtx) != 0x0e {
+		t.Errorf("expected the connection to be for chat")
+	}
+	if joined := ChatRoomFromContext(serviceCtx); joined == nil || joined.Cookie != room.Cookie {
+		t.Errorf("expected the connection to be for the room, got %v", joined)
+	}
+
+	if _, _, err := AuthenticateFLAPCookie(ctx, d, cookieFlap); err == nil {
+		t.Errorf("expected a used service cookie to be rejected")
+	}
+}
+
+// Users get the current MOTD after the service versions, and a service connection gets none
+func TestMOTDAfterVersions(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.MOTD)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+	previous, err := models.CurrentMOTD(ctx, d)
+	if err != nil {
+		t.Fatalf("could not fetch MOTD: %s", err)
+	}
+	defer func() {
+		if previous == nil {
+			models.ClearMOTD(ctx, d)
+		} else {
+			models.SetMOTD(ctx, d, previous.Type, previous.Text)
+		}
+	}()
+
+	g := &GenericServiceControls{}
+	readMOTD := func() (uint16, *oscar.TLV) {
+		t.Helper()
+		aliceCtx, snacs := fakeClient(t, "alice")
+		if _, err := g.HandleSNAC(aliceCtx, d, oscar.NewSNAC(0x01, 0x17)); err != nil {
+			t.Fatalf("could not ask for versions: %s", err)
+		}
+		expectSNAC(t, snacs, 0x01, 0x18)
+		motd := expectSNAC(t, snacs, 0x01, 0x13)
+		motdType, _ := motd.Data.ReadUint16()
+		tlvs, _ := oscar.UnmarshalTLVs(motd.Data.Bytes())
+		return motdType, oscar.FindTLV(tlvs, 0x0b)
+	}
+
+	if err := models.ClearMOTD(ctx, d); err != nil {
+		t.Fatalf("could not clear MOTD: %s", err)
+	}
+	if motdType, _ := readMOTD(); motdType != models.MOTDTypeNone {
+		t.Errorf("expected no MOTD, got type 0x%04x", motdType)
+	}
+
+	// Changing the MOTD takes effect for the next sign on
+	for _, text := range []string{"first", "second"} {
+		if err := models.SetMOTD(ctx, d, models.MOTDTypeNews, text); err != nil {
+			t.Fatalf("could not set MOTD: %s", err)
+		}
+		if motdType, tlv := readMOTD(); motdType != models.MOTDTypeNews || tlv == nil || string(tlv.Data) != text {
+			t.Errorf("expected the MOTD %q, got type 0x%04x with %v", text, motdType, tlv)
+		}
+	}
+
+	chatCtx, snacs := fakeClient(t, "alice")
+	if _, err := g.HandleSNAC(NewContextWithServiceFamily(chatCtx, 0x0e), d, oscar.NewSNAC(0x01, 0x17)); err != nil {
+		t.Fatalf("could not ask for versions: %s", err)
+	}
+	expectSNAC(t, snacs, 0x01, 0x18)
+	expectNoSNAC(t, snacs)
+
+	// The usage report interval follows the MOTD when there is one
+	reporting := &GenericServiceControls{UsageReportInterval: 24}
+	reportCtx, snacs := fakeClient(t, "alice")
+	if _, err := reporting.HandleSNAC(reportCtx, d, oscar.NewSNAC(0x01, 0x17)); err != nil {
+		t.Fatalf("could not ask for versions: %s", err)
+	}
+	expectSNAC(t, snacs, 0x01, 0x18)
+	expectSNAC(t, snacs, 0x01, 0x13)
+	if hours, _ := expectSNAC(t, snacs, 0x0b, 0x02).Data.ReadUint16(); hours != 24 {
+		t.Errorf("expected a report interval of 24 hours, got %d", hours)
+	}
+}
+
+// Self info has the same user info block buddies see, with the user's current warning level,
+// and answers the request
+func TestSelfInfo(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	alice := testUser(t, d, "alice")
+	alice.Status = models.UserStatusAway
+	alice.WarningLevel = 100
+	if err := alice.Update(ctx, d, "status", "warning_level"); err != nil {
+		t.Fatalf("could not update alice: %s", err)
+	}
+
+	aliceCtx, snacs := fakeClient(t, alice.ScreenName)
+	session, _ := oscar.SessionFromContext(aliceCtx)
+	session.SetSignonAt(time.Now().Add(-time.Hour))
+	session.SetIdleSince(time.Now().Add(-10 * time.Minute))
+	stale := *alice
+	stale.WarningLevel = 0
+	aliceCtx = models.NewContextWithUser(aliceCtx, &stale)
+
+	request := oscar.NewSNAC(0x01, 0x0e)
+	request.Header.RequestID = 42
+	g := &GenericServiceControls{}
+	if _, err := g.HandleSNAC(aliceCtx, d, request); err != nil {
+		t.Fatalf("could not ask for self info: %s", err)
+	}
+
+	reply := expectSNAC(t, snacs, 0x01, 0x0f)
+	if reply.Header.RequestID != 42 {
+		t.Errorf("expected the request ID 42, got %d", reply.Header.RequestID)
+	}
+	if screenName, _ := reply.Data.ReadLPString(); screenName != alice.ScreenName {
+		t.Errorf("expected %s, got %s", alice.ScreenName, screenName)
+	}
+	if warningLevel, _ := reply.Data.ReadUint16(); warningLevel != 100 {
+		t.Errorf("expected warning level 100, got %d", warningLevel)
+	}
+	reply.Data.ReadUint16() // TLV count
+	tlvs, err := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read TLVs: %s", err)
+	}
+
+	for _, expected := range UserInfoTLVs(alice, session) {
+		tlv := oscar.FindTLV(tlvs, expected.Type)
+		if tlv == nil {
+			t.Errorf("expected TLV 0x%02x like buddies see", expected.Type)
+		} else if len(tlv.Data) != len(expected.Data) {
+			t.Errorf("expected TLV 0x%02x to be %d bytes, got %d", expected.Type, len(expected.Data), len(tlv.Data))
+		}
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x01); tlv == nil || string(tlv.Data) != string(util.Word(UserClassAOL|UserClassAway)) {
+		t.Errorf("expected an away user class, got %v", tlv)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x04); tlv == nil || string(tlv.Data) != string(util.Word(10)) {
+		t.Errorf("expected 10 minutes idle, got %v", tlv)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x0a); tlv == nil || len(tlv.Data) != 4 {
+		t.Errorf("expected the external IP, got %v", tlv)
+	}
+}
+
+// Buddies read a session's idle time, capabilities and available message while its own
+// connection changes them. Run with -race.
+func TestPresenceChangesWhileBuddiesRead(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	aliceCtx, snacs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	session, _ := oscar.SessionFromContext(aliceCtx)
+	session.Ready = true
+
+	onlineCh := make(chan *PresenceEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-onlineCh:
+			case <-snacs:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// A buddy signing on reads alice's session the whole time
+	reading := make(chan struct{})
+	stopReading := make(chan struct{})
+	go func() {
+		defer close(reading)
+		for {
+			select {
+			case <-stopReading:
+				return
+			default:
+				UserInfoTLVs(alice, session)
+			}
+		}
+	}()
+
+	g := &GenericServiceControls{OnlineCh: onlineCh}
+	l := &LocationServices{OnlineCh: onlineCh}
+	for i := 0; i < 50; i++ {
+		idle := oscar.NewSNAC(0x01, 0x11)
+		idle.Data.WriteUint32(uint32(i % 2 * 60))
+		if _, err := g.HandleSNAC(aliceCtx, d, idle); err != nil {
+			t.Fatalf("could not set idle time: %s", err)
+		}
+
+		setInfo := oscar.NewSNAC(0x02, 0x04)
+		setInfo.WriteTLV(oscar.NewTLV(0x05, bytes.Repeat([]byte{byte(i)}, 16)))
+		if _, err := l.HandleSNAC(aliceCtx, d, setInfo); err != nil {
+			t.Fatalf("could not set capabilities: %s", err)
+		}
+
+		if _, err := g.HandleSNAC(aliceCtx, d, availableMessage(fmt.Sprintf("message %d", i))); err != nil {
+			t.Fatalf("could not set available message: %s", err)
+		}
+	}
+	close(stopReading)
+	<-reading
+
+	if !bytes.Equal(session.Capabilities(), bytes.Repeat([]byte{49}, 16)) || session.AvailableMessage() != "message 49" || session.IdleSince().IsZero() {
+		t.Errorf("expected the last changes to stick, got %v %q %s", session.Capabilities(), session.AvailableMessage(), session.IdleSince())
+	}
+}
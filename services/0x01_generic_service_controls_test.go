@@ -0,0 +1,173 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func serviceRequest(family uint16) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x01, 0x04)
+	snac.Header.RequestID = 5
+	snac.Data.WriteUint16(family)
+	return snac
+}
+
+// Families that don't get connections of their own, and requests from service connections, get
+// a service not defined error
+func TestServiceRequestRefused(t *testing.T) {
+	g := &GenericServiceControls{ServerHostname: "10.0.1.29:5191"}
+	user := &models.User{ScreenName: "alice"}
+
+	tt := map[string]struct {
+		family  uint16
+		service uint16
+	}{
+		"icbm":                   {0x04, 0},
+		"unknown":                {0x99, 0},
+		"from a chat connection": {0x0d, 0x0e},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			ctx, snacs := fakeClient(t, user.ScreenName)
+			ctx = models.NewContextWithUser(ctx, user)
+			if tc.service != 0 {
+				ctx = NewContextWithServiceFamily(ctx, tc.service)
+			}
+
+			if _, err := g.HandleSNAC(ctx, nil, serviceRequest(tc.family)); err != nil {
+				t.Fatalf("could not handle service request: %s", err)
+			}
+			errSnac := expectSNAC(t, snacs, 0x01, 0x01)
+			if errSnac.Header.RequestID != 5 {
+				t.Errorf("expected the request ID 5, got %d", errSnac.Header.RequestID)
+			}
+			if code, _ := errSnac.Data.ReadUint16(); code != aimerror.CodeServiceNotDefined {
+				t.Errorf("expected error 0x%02x, got 0x%02x", aimerror.CodeServiceNotDefined, code)
+			}
+		})
+	}
+}
+
+func TestMOTDSNAC(t *testing.T) {
+	none := MOTDSNAC(nil)
+	if motdType, _ := none.Data.ReadUint16(); motdType != models.MOTDTypeNone {
+		t.Errorf("expected type 0x%04x without a MOTD, got 0x%04x", models.MOTDTypeNone, motdType)
+	}
+	if len(none.Data.Bytes()) != 0 {
+		t.Errorf("expected no text without a MOTD, got %d bytes", len(none.Data.Bytes()))
+	}
+
+	motd := MOTDSNAC(&models.MOTD{Type: models.MOTDTypeNews, Text: "welcome back"})
+	if motdType, _ := motd.Data.ReadUint16(); motdType != models.MOTDTypeNews {
+		t.Errorf("expected type 0x%04x, got 0x%04x", models.MOTDTypeNews, motdType)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(motd.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read TLVs: %s", err)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x0b); tlv == nil || string(tlv.Data) != "welcome back" {
+		t.Errorf("expected the text in TLV 0x0b, got %v", tlv)
+	}
+}
+
+// The reply has the families both sides know, at the lower of the two versions
+func TestServiceVersions(t *testing.T) {
+	// Service connections don't get a MOTD, so there's no need for a DB
+	ctx, snacs := fakeClient(t, "alice")
+	ctx = NewContextWithServiceFamily(ctx, 0x0e)
+	session, _ := oscar.SessionFromContext(ctx)
+	g := &GenericServiceControls{}
+
+	request := oscar.NewSNAC(0x01, 0x17)
+	for _, pair := range [][2]uint16{{0x01, 4}, {0x99, 1}, {0x13, 5}, {0x03, 1}} {
+		request.Data.WriteUint16(pair[0])
+		request.Data.WriteUint16(pair[1])
+	}
+	if _, err := g.HandleSNAC(ctx, nil, request); err != nil {
+		t.Fatalf("could not send versions: %s", err)
+	}
+
+	reply := expectSNAC(t, snacs, 0x01, 0x18)
+	expected := []byte{0x00, 0x01, 0x00, 0x03, 0x00, 0x13, 0x00, 0x01, 0x00, 0x03, 0x00, 0x01}
+	if !bytes.Equal(reply.Data.Bytes(), expected) {
+		t.Errorf("expected versions %x, got %x", expected, reply.Data.Bytes())
+	}
+
+	if version := NegotiatedVersion(session, 0x01); version != 3 {
+		t.Errorf("expected version 3 of family 0x01, got %d", version)
+	}
+	if version := NegotiatedVersion(session, 0x99); version != 0 {
+		t.Errorf("expected no version of a family the server doesn't offer, got %d", version)
+	}
+	if version := NegotiatedVersion(session, 0x04); version != 0 {
+		t.Errorf("expected no version of a family the client didn't ask for, got %d", version)
+	}
+}
+
+// Clients that never send their versions get the server's
+func TestServiceVersionsOmitted(t *testing.T) {
+	ctx, _ := fakeClient(t, "alice")
+	session, _ := oscar.SessionFromContext(ctx)
+
+	for _, service := range ServiceVersions {
+		if version := NegotiatedVersion(session, service.Family); version != service.Version {
+			t.Errorf("expected version %d of family 0x%02x, got %d", service.Version, service.Family, version)
+		}
+	}
+	if version := NegotiatedVersion(session, 0x99); version != 0 {
+		t.Errorf("expected no version of a family the server doesn't offer, got %d", version)
+	}
+}
+
+func availableMessage(message string) *oscar.SNAC {
+	id := &bartID{Type: BARTTypeStatusText, Flags: BARTFlagData}
+	if message != "" {
+		id = statusTextBARTID(message)
+	}
+	snac := oscar.NewSNAC(0x01, 0x1e)
+	snac.WriteTLV(oscar.NewTLV(0x1d, id.Bytes()))
+	return snac
+}
+
+// Buddies hear about the available message when it's set, changed or cleared
+func TestAvailableMessage(t *testing.T) {
+	ctx, _ := fakeClient(t, "alice")
+	session, _ := oscar.SessionFromContext(ctx)
+	session.Ready = true
+
+	onlineCh := make(chan *PresenceEvent, 4)
+	g := &GenericServiceControls{OnlineCh: onlineCh}
+
+	setMessage := func(message string, notified bool) {
+		t.Helper()
+		if _, err := g.HandleSNAC(ctx, nil, availableMessage(message)); err != nil {
+			t.Fatalf("could not set available message: %s", err)
+		}
+		if session.AvailableMessage() != message {
+			t.Errorf("expected available message %q, got %q", message, session.AvailableMessage())
+		}
+
+		select {
+		case event := <-onlineCh:
+			if !notified {
+				t.Errorf("expected no presence event for %q", message)
+			} else if event.Type != PresenceInfoChanged {
+				t.Errorf("expected an info change, got %v", event.Type)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if notified {
+				t.Errorf("expected buddies to hear about %q", message)
+			}
+		}
+	}
+
+	setMessage("at lunch", true)
+	setMessage("at lunch", false)
+	setMessage("back at 2", true)
+	setMessage("", true)
+}
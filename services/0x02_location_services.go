@@ -6,14 +6,46 @@ import (
 	"aim-oscar/oscar"
 	"aim-oscar/util"
 	"context"
-	"time"
+	"fmt"
 
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
+// MaxProfileLength is the longest profile, in bytes, clients are allowed to set
+const MaxProfileLength = 512
+
+// MaxCapabilities is the most capabilities a client can advertise
+const MaxCapabilities = 32
+
+// CapabilityLength is the length of each capability GUID
+const CapabilityLength = 16
+
+// CapabilitiesTLV is the capabilities TLV (0x0d) telling others which features the session's
+// client supports. Returns nil if it hasn't said.
+func CapabilitiesTLV(session *oscar.Session) *oscar.TLV {
+	if session == nil {
+		return nil
+	}
+	capabilities := session.Capabilities()
+	if len(capabilities) == 0 {
+		return nil
+	}
+	return oscar.NewTLV(0x0d, capabilities)
+}
+
+// validCapabilities checks that the capabilities a client set are whole GUIDs
+func validCapabilities(capabilities []byte) bool {
+	return len(capabilities)%CapabilityLength == 0 && len(capabilities) <= MaxCapabilities*CapabilityLength
+}
+
+// DirectoryInfoAllowSearch is the directory info TLV clients set to 0 to keep others from
+// finding them, like by their email
+const DirectoryInfoAllowSearch = 0x1a
+
 type LocationServices struct {
-	OnlineCh chan *models.User
+	OnlineCh chan *PresenceEvent
+	Sessions SessionManager
 }
 
 func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
@@ -23,13 +55,13 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 
 	// Client wants to know the limits/permissions for Location services
 	case 0x02:
-		respSnac := oscar.NewSNAC(0x2, 0x3)
+		respSnac := oscar.NewReplySNAC(snac, 0x2, 0x3)
 
 		tlvs := []*oscar.TLV{
-			oscar.NewTLV(0x01, util.Word(512)), // profile max len // TODO: set a length?
-			oscar.NewTLV(0x02, util.Word(0)),   // max CLSIDS // TODO: implement?
-			oscar.NewTLV(0x03, util.Word(0)),   // unknown
-			oscar.NewTLV(0x04, util.Word(0)),   // unknown
+			oscar.NewTLV(0x01, util.Word(MaxProfileLength)), // profile max len
+			oscar.NewTLV(0x02, util.Word(MaxCapabilities)),  // max capabilities
+			oscar.NewTLV(0x03, util.Word(0)),                // unknown
+			oscar.NewTLV(0x04, util.Word(0)),                // unknown
 		}
 
 		respSnac.AppendTLVs(tlvs)
@@ -53,36 +85,69 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 
 		awayMessageTLV := oscar.FindTLV(tlvs, 0x4)
 		if awayMessageTLV != nil {
-			// Away message encoding is set in TLV 0x3
-			awayMessageMimeTLV := oscar.FindTLV(tlvs, 0x3)
-			if awayMessageMimeTLV == nil {
-				return nil, errors.New("missing away message mime TLV 0x3")
-			}
 			user.AwayMessage = string(awayMessageTLV.Data)
-			user.AwayMessageEncoding = string(awayMessageMimeTLV.Data)
+			user.AwayMessageEncoding = ""
+
+			// Away message encoding is set in TLV 0x3. Clearing the away message doesn't need one.
+			if user.AwayMessage != "" {
+				awayMessageMimeTLV := oscar.FindTLV(tlvs, 0x3)
+				if awayMessageMimeTLV == nil {
+					return ctx, errors.New("missing away message mime TLV 0x3")
+				}
+				user.AwayMessageEncoding = string(awayMessageMimeTLV.Data)
+			}
 		}
 
 		profileTLV := oscar.FindTLV(tlvs, 0x2)
 		if profileTLV != nil {
 			profileMimeTLV := oscar.FindTLV(tlvs, 0x1)
 			if profileMimeTLV == nil {
-				return nil, errors.New("missing away message mime TLV 0x3")
+				return ctx, errors.New("missing profile mime TLV 0x1")
 			}
+
+			if len(profileTLV.Data) > MaxProfileLength {
+				tooLongSnac := oscar.NewSNACError(0x2, snac.Header.RequestID, 0x0d) // error code 0x0d: Request denied
+				tooLongFlap := oscar.NewFLAP(2)
+				tooLongFlap.Data.WriteBinary(tooLongSnac)
+				return ctx, session.Send(tooLongFlap)
+			}
+
 			user.Profile = string(profileTLV.Data)
 			user.ProfileEncoding = string(profileMimeTLV.Data)
 		}
 
-		if user.AwayMessage == "" {
-			user.Status = models.UserStatusOnline
-		} else {
-			user.Status = models.UserStatusAway
+		// Capabilities that aren't whole GUIDs can't be told apart, so they're all dropped
+		if capabilitiesTLV := oscar.FindTLV(tlvs, 0x5); capabilitiesTLV != nil {
+			if validCapabilities(capabilitiesTLV.Data) {
+				session.SetCapabilities(capabilitiesTLV.Data)
+			} else {
+				oscar.LoggerFromContext(ctx).Warn("dropping invalid capabilities", "length", len(capabilitiesTLV.Data))
+			}
+		}
+
+		// An away message doesn't make an invisible user visible, or change the status of one
+		// that hasn't signed on yet
+		previousStatus := user.Status
+		if previousStatus == models.UserStatusOnline || previousStatus == models.UserStatusAway {
+			if user.AwayMessage == "" {
+				user.Status = models.UserStatusOnline
+			} else {
+				user.Status = models.UserStatusAway
+			}
 		}
 
-		if err := user.Update(ctx, db, "away_message", "away_message_encoding", "profile", "profile_encoding"); err != nil {
+		if err := user.Update(ctx, db, "status", "away_message", "away_message_encoding", "profile", "profile_encoding"); err != nil {
 			return ctx, errors.Wrap(err, "could not set away message")
 		}
 
-		s.OnlineCh <- user
+		// Buddies only need to hear about the user going away or coming back
+		switch {
+		case previousStatus == models.UserStatusOnline && user.Status == models.UserStatusAway:
+			s.OnlineCh <- WentAway(user)
+		case previousStatus == models.UserStatusAway && user.Status == models.UserStatusOnline:
+			session.ResetAutoReplies()
+			s.OnlineCh <- CameBack(user)
+		}
 
 		return models.NewContextWithUser(ctx, user), nil
 
@@ -98,57 +163,57 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 			return ctx, errors.Wrap(err, "missing requested screen_name")
 		}
 
-		session.Logger.Debug("requesting profile", "requested_screen_name", requestedScreenName, "requestType", requestType)
+		oscar.LoggerFromContext(ctx).Debug("requesting profile", "requested_screen_name", requestedScreenName, "requestType", requestType)
+
+		// Request Type 2 = online status, no TLVs
+		// TODO: Request Type 4 - User capabilities
+		return ctx, s.sendUserInfo(ctx, db, snac, requestedScreenName, requestType == 1, requestType == 3)
 
-		requestedUser, err := models.UserByScreenName(ctx, db, requestedScreenName)
+	// Client is asking for user information with a bitmask of what it wants
+	case 0x15:
+		flags, err := snac.Data.ReadUint32()
 		if err != nil {
-			return ctx, aimerror.FetchingUser(err, requestedScreenName)
+			return ctx, errors.Wrap(err, "missing request flags")
 		}
 
-		if requestedUser == nil {
-			noMatchSnac := oscar.NewSNAC(0x2, 1)
-			noMatchSnac.Data.WriteUint16(0x14) // error code 0x14: No Match
-			noMatchFlap := oscar.NewFLAP(2)
-			noMatchFlap.Data.WriteBinary(noMatchSnac)
-			session.Send(noMatchFlap)
-			return ctx, nil
+		requestedScreenName, err := snac.Data.ReadLPString()
+		if err != nil {
+			return ctx, errors.Wrap(err, "missing requested screen_name")
 		}
 
-		respSnac := oscar.NewSNAC(2, 6)
-		respSnac.Data.WriteLPString(requestedUser.ScreenName)
-		respSnac.Data.WriteUint16(0) // TODO: warning level
+		oscar.LoggerFromContext(ctx).Debug("requesting user info", "requested_screen_name", requestedScreenName, "flags", flags)
 
-		tlvs := []*oscar.TLV{
-			oscar.NewTLV(1, util.Dword(0)),                                                             // user class
-			oscar.NewTLV(6, util.Dword(uint32(requestedUser.Status))),                                  // user status
-			oscar.NewTLV(0x0a, util.Dword(0)),                                                          // user external IP
-			oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(requestedUser.LastActivityAt).Seconds()))), // idle time
-			oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                                  // TODO: signon time
-			oscar.NewTLV(0x05, util.Dword(uint32(requestedUser.CreatedAt.Unix()))),                     // member since
-		}
+		// TODO: 0x04 - User capabilities
+		return ctx, s.sendUserInfo(ctx, db, snac, requestedScreenName, flags&0x01 != 0, flags&0x02 != 0)
 
-		// General info (Profile)
-		if requestType == 1 {
-			tlvs = append(tlvs, oscar.NewTLV(1, util.LPUint16String(requestedUser.ProfileEncoding)))
-			tlvs = append(tlvs, oscar.NewTLV(2, util.LPUint16String(requestedUser.Profile)))
+	// Client updates their directory info. Only whether they can be found is kept.
+	case 0x09:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
 		}
 
-		// Request Type 2 = online status, no TLVs
-
-		// Away message
-		if requestType == 3 {
-			tlvs = append(tlvs, oscar.NewTLV(3, util.LPUint16String(requestedUser.AwayMessageEncoding)))
-			tlvs = append(tlvs, oscar.NewTLV(4, util.LPUint16String(requestedUser.AwayMessage)))
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read directory info TLVs")
 		}
 
-		// TODO: Request Type 4 - User capabilities
-
-		respSnac.AppendTLVs(tlvs)
-
-		respFlap := oscar.NewFLAP(2)
-		respFlap.Data.WriteBinary(respSnac)
+		if allowTLV, ok := tlvs.Get(DirectoryInfoAllowSearch); ok {
+			allow, err := allowTLV.Uint16()
+			if err != nil {
+				return ctx, errors.Wrap(err, "invalid allow search TLV")
+			}
+			user.NoEmailLookup = allow == 0
+			if err := user.Update(ctx, db, "no_email_lookup"); err != nil {
+				return ctx, errors.Wrap(err, "could not update directory info")
+			}
+		}
 
-		return ctx, session.Send(respFlap)
+		replySnac := oscar.NewReplySNAC(snac, 0x02, 0x0a)
+		replySnac.Data.WriteUint16(1) // success
+		replyFlap := oscar.NewFLAP(2)
+		replyFlap.Data.WriteBinary(replySnac)
+		return models.NewContextWithUser(ctx, user), session.Send(replyFlap)
 
 	case 0xb:
 		/* Nobody seems to know what this client request is for
@@ -157,7 +222,7 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 
 		But the one dump that exists looks like a TLV 0x1 with empty data
 		*/
-		unknownSnac := oscar.NewSNAC(2, 0xc)
+		unknownSnac := oscar.NewReplySNAC(snac, 2, 0xc)
 		unknownSnac.Data.WriteUint16(1)
 		unknownSnac.Data.WriteUint16(0)
 		unknownFlap := oscar.NewFLAP(2)
@@ -165,5 +230,50 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 		return ctx, session.Send(unknownFlap)
 	}
 
-	return ctx, nil
+	oscar.LoggerFromContext(ctx).With("service", "location").Error(fmt.Sprintf("Unknown location services family/subtype: 0x02, 0x%02x", snac.Header.Subtype))
+	return ctx, aimerror.NotSupported
+}
+
+// sendUserInfo answers a user info request (0x02,0x06) for screenName with their profile and/or
+// away message. Users who are offline or don't exist get a "not logged on" error instead.
+func (s *LocationServices) sendUserInfo(ctx context.Context, db *bun.DB, request *oscar.SNAC, screenName string, profile bool, awayMessage bool) error {
+	session, _ := oscar.SessionFromContext(ctx)
+
+	requestedUser, err := models.UserByScreenName(ctx, db, screenName)
+	if err != nil {
+		return aimerror.FetchingUser(err, screenName)
+	}
+
+	if requestedUser == nil || !requestedUser.Status.Visible() {
+		notOnlineSnac := oscar.NewSNACError(0x2, request.Header.RequestID, 0x04) // error code 0x04: Recipient is not logged in
+		notOnlineFlap := oscar.NewFLAP(2)
+		notOnlineFlap.Data.WriteBinary(notOnlineSnac)
+		return session.Send(notOnlineFlap)
+	}
+
+	respSnac := oscar.NewReplySNAC(request, 2, 6)
+	respSnac.Data.WriteLPString(requestedUser.ScreenName)
+	respSnac.Data.WriteUint16(requestedUser.WarningLevel)
+
+	requestedSession := s.Sessions.GetSession(requestedUser.ScreenName)
+	tlvs := UserInfoTLVs(requestedUser, requestedSession)
+
+	// General info (Profile)
+	if profile {
+		tlvs = append(tlvs, oscar.NewTLV(1, []byte(requestedUser.ProfileEncoding)))
+		tlvs = append(tlvs, oscar.NewTLV(2, []byte(requestedUser.Profile)))
+	}
+
+	// Away message, only while the user is away
+	if awayMessage && requestedUser.Status == models.UserStatusAway {
+		tlvs = append(tlvs, oscar.NewTLV(3, []byte(requestedUser.AwayMessageEncoding)))
+		tlvs = append(tlvs, oscar.NewTLV(4, []byte(requestedUser.AwayMessage)))
+	}
+
+	respSnac.AppendTLVs(tlvs)
+
+	respFlap := oscar.NewFLAP(2)
+	respFlap.Data.WriteBinary(respSnac)
+
+	return session.Send(respFlap)
 }
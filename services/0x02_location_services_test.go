@@ -0,0 +1,47 @@
+package services
+
+import (
+	"aim-oscar/oscar"
+	"bytes"
+	"testing"
+)
+
+func TestValidCapabilities(t *testing.T) {
+	tt := map[string]struct {
+		capabilities []byte
+		expected     bool
+	}{
+		"none":             {[]byte{}, true},
+		"one":              {make([]byte, 16), true},
+		"several":          {make([]byte, 48), true},
+		"partial":          {make([]byte, 17), false},
+		"too many":         {make([]byte, (MaxCapabilities+1)*CapabilityLength), false},
+		"shorter than one": {make([]byte, 15), false},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if valid := validCapabilities(tc.capabilities); valid != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, valid)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesTLV(t *testing.T) {
+	if tlv := CapabilitiesTLV(nil); tlv != nil {
+		t.Errorf("expected no capabilities without a session, got %v", tlv)
+	}
+
+	ctx, _ := fakeClient(t, "alice")
+	session, _ := oscar.SessionFromContext(ctx)
+	if tlv := CapabilitiesTLV(session); tlv != nil {
+		t.Errorf("expected no capabilities before the client sets them, got %v", tlv)
+	}
+
+	session.SetCapabilities(bytes.Repeat([]byte{0x09}, 32))
+	tlv := CapabilitiesTLV(session)
+	if tlv == nil || tlv.Type != 0x0d || !bytes.Equal(tlv.Data, session.Capabilities()) {
+		t.Errorf("expected the capabilities in TLV 0x0d, got %v", tlv)
+	}
+}
@@ -6,29 +6,51 @@ import (
 	"aim-oscar/oscar"
 	"aim-oscar/util"
 	"context"
-	"database/sql"
 	"fmt"
 
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
+// Buddy list limits of servers that don't set their own
+const (
+	DefaultMaxBuddies             = 600
+	DefaultMaxWatchers            = 64
+	DefaultMaxOnlineNotifications = 64
+)
+
 type BuddyListManagement struct {
-	OnlineCh chan *models.User
+	OnlineCh chan *PresenceEvent
+
+	// Sessions is where bots are found to tell them who added them. Nil doesn't tell them.
+	Sessions SessionManager
+
+	// Most buddies a user can have, how many users can have a user on their list, and how many
+	// online notifications a user can get. Zero uses the default.
+	MaxBuddies             uint16
+	MaxWatchers            uint16
+	MaxOnlineNotifications uint16
+}
+
+func orDefault(limit uint16, def uint16) uint16 {
+	if limit == 0 {
+		return def
+	}
+	return limit
 }
 
 func (b *BuddyListManagement) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, _ := oscar.SessionFromContext(ctx)
-	logger := session.Logger.With("service", "buddy list management")
+	logger := oscar.LoggerFromContext(ctx).With("service", "buddy list management")
 
 	switch snac.Header.Subtype {
 
 	// Client wants to know the buddy list params + limitations
 	case 0x2:
-		limitSnac := oscar.NewSNAC(0x3, 0x3)
-		limitSnac.Data.WriteBinary(oscar.NewTLV(0x1, util.Word(600))) // Max buddy list size
-		limitSnac.Data.WriteBinary(oscar.NewTLV(0x2, util.Word(64)))  // Max list watchers
-		limitSnac.Data.WriteBinary(oscar.NewTLV(0x3, util.Word(64)))  // Max online notifications ?
+		limitSnac := oscar.NewReplySNAC(snac, 0x3, 0x3)
+		limitSnac.Data.WriteBinary(oscar.NewTLV(0x1, util.Word(orDefault(b.MaxBuddies, DefaultMaxBuddies))))                         // Max buddy list size
+		limitSnac.Data.WriteBinary(oscar.NewTLV(0x2, util.Word(orDefault(b.MaxWatchers, DefaultMaxWatchers))))                       // Max list watchers
+		limitSnac.Data.WriteBinary(oscar.NewTLV(0x3, util.Word(orDefault(b.MaxOnlineNotifications, DefaultMaxOnlineNotifications)))) // Max online notifications
 		limitSnac.Data.WriteBinary(oscar.NewTLV(0x4, util.Word(100)))
 
 		limitFlap := oscar.NewFLAP(2)
@@ -53,35 +75,36 @@ func (b *BuddyListManagement) HandleSNAC(ctx context.Context, db *bun.DB, snac *
 				return ctx, errors.Wrap(err, "error looking for User")
 			}
 			if buddy == nil {
-				noMatchSnac := oscar.NewSNAC(0x3, 1)
-				noMatchSnac.Data.WriteUint16(0x14) // error code 0x14: No Match
+				noMatchSnac := oscar.NewSNACError(0x3, snac.Header.RequestID, 0x14) // error code 0x14: No Match
 				noMatchFlap := oscar.NewFLAP(2)
 				noMatchFlap.Data.WriteBinary(noMatchSnac)
 				session.Send(noMatchFlap)
 				return ctx, nil
 			}
 
-			rel := &models.Buddy{
-				SourceUIN: user.UIN,
-				WithUIN:   buddy.UIN,
+			count, err := models.CountBuddies(ctx, db, user.UIN)
+			if err != nil {
+				return ctx, err
+			}
+			if count >= int(orDefault(b.MaxBuddies, DefaultMaxBuddies)) {
+				limitSnac := oscar.NewSNACError(0x3, snac.Header.RequestID, 0x0c) // error code 0x0c: Limit exceeded
+				limitFlap := oscar.NewFLAP(2)
+				limitFlap.Data.WriteBinary(limitSnac)
+				return ctx, session.Send(limitFlap)
 			}
 
-			count, err := db.NewSelect().Model((*models.Buddy)(nil)).Where("source_uin = ?", user.UIN).Where("with_uin = ?", buddy.UIN).Count(ctx)
-			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			added, err := models.AddBuddy(ctx, db, user.UIN, buddy.UIN)
+			if err != nil {
 				return ctx, err
 			}
 
 			// Already buddies
-			if count > 0 {
+			if !added {
 				return ctx, nil
 			}
 
-			_, err = db.NewInsert().Model(rel).Exec(ctx)
-			if err != nil {
-				return ctx, err
-			}
-
-			b.OnlineCh <- buddy
+			b.OnlineCh <- StatusChanged(buddy)
+			tellBotAdded(b.Sessions, user, buddy)
 
 			logger.Info(fmt.Sprintf("%s added buddy %s to buddy list", user.ScreenName, buddyScreename), "screen_name", user.ScreenName)
 		}
@@ -106,16 +129,14 @@ func (b *BuddyListManagement) HandleSNAC(ctx context.Context, db *bun.DB, snac *
 				return ctx, errors.Wrap(err, "error looking for User")
 			}
 			if buddy == nil {
-				noMatchSnac := oscar.NewSNAC(0x3, 1)
-				noMatchSnac.Data.WriteUint16(0x14) // error code 0x14: No Match
+				noMatchSnac := oscar.NewSNACError(0x3, snac.Header.RequestID, 0x14) // error code 0x14: No Match
 				noMatchFlap := oscar.NewFLAP(2)
 				noMatchFlap.Data.WriteBinary(noMatchSnac)
 				session.Send(noMatchFlap)
 				return ctx, nil
 			}
 
-			_, err = db.NewDelete().Model((*models.Buddy)(nil)).Where("source_uin = ?", user.UIN).Where("with_uin = ?", buddy.UIN).Exec(ctx)
-			if err != nil {
+			if err := models.RemoveBuddy(ctx, db, user.UIN, buddy.UIN); err != nil {
 				return ctx, err
 			}
 
@@ -127,5 +148,5 @@ func (b *BuddyListManagement) HandleSNAC(ctx context.Context, db *bun.DB, snac *
 
 	logger.Error(fmt.Sprintf("Unknown buddy list management family/subtype: 0x03, 0x%02x", snac.Header.Subtype))
 
-	return ctx, nil
+	return ctx, aimerror.NotSupported
 }
@@ -0,0 +1,127 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestBuddyListLimit(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.Buddy)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create buddies table: %s", err)
+	}
+
+	alice := testUser(t, d, "alice")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Buddy)(nil)).Where("source_uin = ?", alice.UIN).Exec(ctx)
+	})
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	onlineCh := make(chan *PresenceEvent, 10)
+	b := &BuddyListManagement{OnlineCh: onlineCh, MaxBuddies: 3}
+
+	add := func(screenName string) {
+		t.Helper()
+		snac := oscar.NewSNAC(0x3, 0x4)
+		snac.Data.WriteLPString(screenName)
+		if _, err := b.HandleSNAC(aliceCtx, d, snac); err != nil {
+			t.Fatalf("could not add buddy: %s", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		add(testUser(t, d, "buddy").ScreenName)
+		<-onlineCh
+	}
+	expectNoSNAC(t, aliceSNACs)
+
+	add(testUser(t, d, "buddy").ScreenName)
+	if code, _ := expectSNAC(t, aliceSNACs, 0x3, 0x1).Data.ReadUint16(); code != 0x0c {
+		t.Errorf("expected error 0x0c, got 0x%02x", code)
+	}
+
+	if count, err := models.CountBuddies(ctx, d, alice.UIN); err != nil || count != 3 {
+		t.Errorf("expected 3 buddies, got %d %v", count, err)
+	}
+}
+
+func TestBuddyGroups(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.Buddy)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create buddies table: %s", err)
+	}
+
+	alice := testUser(t, d, "alice")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Buddy)(nil)).Where("source_uin = ?", alice.UIN).Exec(ctx)
+	})
+	bob, carol, dave := testUser(t, d, "bob"), testUser(t, d, "carol"), testUser(t, d, "dave")
+
+	// Old clients' adds go in the default group
+	b := &BuddyListManagement{OnlineCh: make(chan *PresenceEvent, 10)}
+	aliceCtx, _ := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	snac := oscar.NewSNAC(0x3, 0x4)
+	snac.Data.WriteLPString(bob.ScreenName)
+	if _, err := b.HandleSNAC(aliceCtx, d, snac); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	for _, buddy := range []*models.User{carol, dave} {
+		if _, err := models.AddBuddyToGroup(ctx, d, alice.UIN, buddy.UIN, "Work"); err != nil {
+			t.Fatalf("could not add buddy: %s", err)
+		}
+	}
+
+	expectGroups := func(expected map[string][]string, order ...string) {
+		t.Helper()
+		groups, err := models.BuddyGroupsOf(ctx, d, alice.UIN)
+		if err != nil {
+			t.Fatalf("could not fetch buddy groups: %s", err)
+		}
+		if len(groups) != len(order) {
+			t.Fatalf("expected %d groups, got %d", len(order), len(groups))
+		}
+		for i, group := range groups {
+			if group.Name != order[i] {
+				t.Errorf("expected group %d to be %s, got %s", i, order[i], group.Name)
+			}
+			var names []string
+			for _, buddy := range group.Buddies {
+				names = append(names, buddy.Target.ScreenName)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(expected[group.Name]) {
+				t.Errorf("expected %s to have %v, got %v", group.Name, expected[group.Name], names)
+			}
+		}
+	}
+	expectGroups(map[string][]string{
+		models.DefaultBuddyGroup: {bob.ScreenName},
+		"Work":                   {carol.ScreenName, dave.ScreenName},
+	}, models.DefaultBuddyGroup, "Work")
+
+	// Renaming onto an existing group puts its buddies after the other group's
+	if err := models.RenameBuddyGroup(ctx, d, alice.UIN, "Work", models.DefaultBuddyGroup); err != nil {
+		t.Fatalf("could not rename group: %s", err)
+	}
+	expectGroups(map[string][]string{
+		models.DefaultBuddyGroup: {bob.ScreenName, carol.ScreenName, dave.ScreenName},
+	}, models.DefaultBuddyGroup)
+
+	if removed, err := models.DeleteBuddyGroup(ctx, d, alice.UIN, models.DefaultBuddyGroup); err != nil || removed != 3 {
+		t.Fatalf("expected 3 buddies removed, got %d %v", removed, err)
+	}
+	expectGroups(nil)
+}
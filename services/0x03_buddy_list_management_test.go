@@ -0,0 +1,41 @@
+package services
+
+import (
+	"aim-oscar/oscar"
+	"testing"
+)
+
+func TestBuddyListRights(t *testing.T) {
+	tt := map[string]struct {
+		service  *BuddyListManagement
+		expected [3]uint16
+	}{
+		"defaults":   {&BuddyListManagement{}, [3]uint16{DefaultMaxBuddies, DefaultMaxWatchers, DefaultMaxOnlineNotifications}},
+		"configured": {&BuddyListManagement{MaxBuddies: 1000, MaxWatchers: 200, MaxOnlineNotifications: 300}, [3]uint16{1000, 200, 300}},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			ctx, snacs := fakeClient(t, "alice")
+			if _, err := tc.service.HandleSNAC(ctx, nil, oscar.NewSNAC(0x3, 0x2)); err != nil {
+				t.Fatalf("could not get buddy list rights: %s", err)
+			}
+
+			tlvs, err := oscar.UnmarshalTLVs(expectSNAC(t, snacs, 0x3, 0x3).Data.Bytes())
+			if err != nil {
+				t.Fatalf("could not read rights: %s", err)
+			}
+			for i, expected := range tc.expected {
+				tlv := oscar.FindTLV(tlvs, uint16(i+1))
+				if tlv == nil {
+					t.Fatalf("missing TLV 0x%02x", i+1)
+				}
+				buf := oscar.Buffer{}
+				buf.Write(tlv.Data)
+				if limit, _ := buf.ReadUint16(); limit != expected {
+					t.Errorf("expected TLV 0x%02x to be %d, got %d", i+1, expected, limit)
+				}
+			}
+		})
+	}
+}
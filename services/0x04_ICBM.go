@@ -4,19 +4,114 @@ import (
 	"aim-oscar/aimerror"
 	"aim-oscar/models"
 	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"aim-oscar/webhook"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
 type ICBM struct {
-	CommCh chan *models.Message
+	CommCh   chan *models.Message
+	OnlineCh chan *PresenceEvent
+	Sessions SessionManager
+
+	// MaxMessageSize is the most bytes of text a message can have, however much the client
+	// says it can take. Zero uses ICBMMaxMessageSize.
+	MaxMessageSize uint16
+
+	// MaxOfflineMessages is how many messages can wait for a user to sign on. Zero doesn't limit
+	// them.
+	MaxOfflineMessages int
+
+	// OnlyStoreOffline stores messages only for recipients who aren't signed on, which is all
+	// the offline queue needs. Messages sent straight to the recipient's session leave nothing
+	// behind, but are lost rather than left for their next sign on if that session dies.
+	OnlyStoreOffline bool
+
+	// HideUnregistered answers messages to screen names nobody has the way messages to a user
+	// who's signed off are answered, instead of saying there's no such user, so senders can't
+	// find out which screen names are registered
+	HideUnregistered bool
+
+	// AutoReplyWindow is how long after someone is sent an away user's away message that they
+	// aren't sent it again. Zero uses DefaultAutoReplyWindow.
+	AutoReplyWindow time.Duration
+
+	// Chat is where users who accept an invitation to a chat room are let in ahead of asking for a
+	// connection to it. Nil doesn't let them in any sooner.
+	Chat *ChatRegistry
+
+	// Webhooks is told about messages and warnings. Nil doesn't tell anyone.
+	Webhooks *webhook.Dispatcher
+
+	// Filter checks the text of messages and away message auto-replies before they are stored or
+	// delivered. Nil lets everything through.
+	Filter MessageFilter
+
+	// Flood is how fast each session can send messages
+	Flood FloodLimit
+	clock func() time.Time
+
+	// Who each user got messages from, and when, to check they are allowed to warn them
+	received      map[string]map[string]time.Time
+	receivedMutex sync.Mutex
+
+	// When each user last sent a message, to hold them to their minimum message interval
+	sent      map[string]time.Time
+	sentMutex sync.Mutex
+
+	// Messages dropped on the way to each session that it hasn't been told about yet
+	missed      map[*oscar.Session]map[missedKey]*missed
+	missedMutex sync.Mutex
+
+	// Rendezvous proposed between users that haven't been cancelled, to tell who answers them
+	// whether the other side is still there
+	rendezvous      map[rendezvousKey]*pendingRendezvous
+	rendezvousMutex sync.Mutex
 }
 
+// DefaultAutoReplyWindow is how long someone chatting with an away user goes between being sent
+// their away message
+const DefaultAutoReplyWindow = 10 * time.Minute
+
+// WarnWindow is how long after someone sends a user a message the user can warn them
+const WarnWindow = 10 * time.Minute
+
+// How much a warning raises the warned user's level when the warner has no warnings themselves
+const (
+	WarnIncrease          = 100
+	WarnIncreaseAnonymous = 30
+)
+
+// Message flags for the ICBM parameters
+const (
+	ICBMFlagChannelMessages    = 0x01
+	ICBMFlagMissedCalls        = 0x02
+	ICBMFlagTypingNotification = 0x08
+)
+
+// Typing notification (MTN) states
+const (
+	TypingFinished = 0x0000
+	TypingTyped    = 0x0001
+	TypingBegun    = 0x0002
+)
+
+// Limits on the ICBM parameters clients can set for themselves
+const (
+	ICBMMinMessageSize     = 512
+	ICBMMaxMessageSize     = 8000
+	ICBMMaxMessageInterval = 5000 // milliseconds
+)
+
 type icbmKey string
 
 func (s icbmKey) String() string {
@@ -48,9 +143,48 @@ type channel struct {
 	MinimumMessageInterval  uint32
 }
 
+// defaultChannel is the ICBM parameters of clients that haven't set their own
+func defaultChannel() *channel {
+	return &channel{
+		MaxSlots:                100,
+		MessageFlags:            ICBMFlagChannelMessages | ICBMFlagMissedCalls | ICBMFlagTypingNotification,
+		MaxMessageSnacSize:      ICBMMaxMessageSize,
+		MaxSenderWarningLevel:   models.MaxWarningLevel,
+		MaxReceiverWarningLevel: models.MaxWarningLevel,
+		MinimumMessageInterval:  0,
+	}
+}
+
+// maxMessageSize is the most bytes of text in a message from a client with the parameters
+func (icbm *ICBM) maxMessageSize(c *channel) uint16 {
+	if limit := orDefault(icbm.MaxMessageSize, ICBMMaxMessageSize); limit < c.MaxMessageSnacSize {
+		return limit
+	}
+	return c.MaxMessageSnacSize
+}
+
+// clamp brings parameters the client set into the range the server allows
+func (c *channel) clamp() {
+	if c.MaxMessageSnacSize < ICBMMinMessageSize {
+		c.MaxMessageSnacSize = ICBMMinMessageSize
+	}
+	if c.MaxMessageSnacSize > ICBMMaxMessageSize {
+		c.MaxMessageSnacSize = ICBMMaxMessageSize
+	}
+	if c.MaxSenderWarningLevel > models.MaxWarningLevel {
+		c.MaxSenderWarningLevel = models.MaxWarningLevel
+	}
+	if c.MaxReceiverWarningLevel > models.MaxWarningLevel {
+		c.MaxReceiverWarningLevel = models.MaxWarningLevel
+	}
+	if c.MinimumMessageInterval > ICBMMaxMessageInterval {
+		c.MinimumMessageInterval = ICBMMaxMessageInterval
+	}
+}
+
 func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, _ := oscar.SessionFromContext(ctx)
-	logger := session.Logger.With("service", "icbm")
+	logger := oscar.LoggerFromContext(ctx).With("service", "icbm")
 
 	switch snac.Header.Subtype {
 	// Client is telling us about their ICBM capabilities
@@ -71,6 +205,7 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 			return ctx, errors.Wrap(err, "could not read channel settings")
 		}
 
+		channel.clamp()
 		logger.Debug("got channel", "channel", channel)
 
 		newCtx := NewContextWithChannel(ctx, channel)
@@ -78,22 +213,15 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 
 	// Client asks about the ICBM capabilities we set for them
 	case 0x04:
-		// c := ChannelFromContext(ctx)
-		// if c == nil {
-		c := &channel{
-			MaxSlots:                100,
-			MessageFlags:            3,
-			MaxMessageSnacSize:      512,
-			MaxSenderWarningLevel:   999,
-			MaxReceiverWarningLevel: 999,
-			MinimumMessageInterval:  0,
-		}
-		// }
-
-		channelSnac := oscar.NewSNAC(0x4, 0x5)
-		channelSnac.Data.WriteUint16(100)
+		c := ChannelFromContext(ctx)
+		if c == nil {
+			c = defaultChannel()
+		}
+
+		channelSnac := oscar.NewReplySNAC(snac, 0x4, 0x5)
+		channelSnac.Data.WriteUint16(c.MaxSlots)
 		channelSnac.Data.WriteUint32(c.MessageFlags)
-		channelSnac.Data.WriteUint16(c.MaxMessageSnacSize)
+		channelSnac.Data.WriteUint16(icbm.maxMessageSize(c))
 		channelSnac.Data.WriteUint16(c.MaxSenderWarningLevel)
 		channelSnac.Data.WriteUint16(c.MaxReceiverWarningLevel)
 		channelSnac.Data.WriteUint32(c.MinimumMessageInterval)
@@ -111,13 +239,19 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 			return ctx, aimerror.NoUserInSession
 		}
 
-		msgID, _ := snac.Data.ReadUint64()
-		msgChannel, _ := snac.Data.ReadUint16()
-		to, _ := snac.Data.ReadLPString()
+		msgID, err := snac.Data.ReadUint64()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read message cookie")
+		}
+
+		msgChannel, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read message channel")
+		}
 
-		if msgChannel != 1 {
-			logger.Warn(fmt.Sprintf("Message for unsupported channel %d", msgChannel))
-			return ctx, nil
+		to, err := snac.Data.ReadLPString()
+		if err != nil || to == "" {
+			return ctx, errors.New("could not read message recipient")
 		}
 
 		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
@@ -125,105 +259,874 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 			return ctx, errors.Wrap(err, "could not unmarshal message tlvs")
 		}
 
-		messageTLV := oscar.FindTLV(tlvs, 0x2)
-		if messageTLV == nil {
-			return ctx, errors.New("missing messageTLV 0x2")
+		// Channel 2 carries file transfer and direct connection offers for the clients to work
+		// out between themselves
+		if msgChannel == 2 {
+			return ctx, icbm.relayRendezvous(ctx, db, session, user, snac.Header.RequestID, msgID, to, tlvs)
 		}
 
-		// Parse fragment (array of required capabilities, yawn)
-		messageTLVData := oscar.Buffer{}
-		messageTLVData.Write(messageTLV.Data)
+		var charset uint16
+		var messageContents []byte
+		var icqType uint8
+		switch msgChannel {
+		case 1:
+			messageTLV, ok := tlvs.Get(0x2)
+			if !ok {
+				return ctx, errors.New("missing messageTLV 0x2")
+			}
 
-		fragmentNum, err := messageTLVData.ReadUint8()
-		if err != nil {
-			return ctx, errors.Wrap(err, "could not read fragment identifier")
-		} else if fragmentNum != 5 {
-			return ctx, errors.New("expected first fragment identifier to be 5")
-		}
+			charset, messageContents, err = ReadMessageFragments(messageTLV.Bytes())
+			if err != nil {
+				return ctx, err
+			}
 
-		fragmentVersion, err := messageTLVData.ReadUint8()
-		if err != nil {
-			return ctx, errors.Wrap(err, "could not read fragment version")
-		} else if fragmentVersion != 1 {
-			return ctx, errors.New("expected first fragment version to be 1")
-		}
+		// Channel 4 carries old ICQ messages, like URLs and authorization requests, whose text
+		// is Latin-1
+		case 4:
+			icqTLV, ok := tlvs.Get(0x5)
+			if !ok {
+				return ctx, errors.New("missing ICQ message TLV 0x5")
+			}
 
-		fragmentLength, err := messageTLVData.ReadUint16()
-		if err != nil {
-			return ctx, errors.Wrap(err, "could not read fragment data length")
+			icqType, messageContents, err = ReadICQMessage(icqTLV.Bytes())
+			if err != nil {
+				return ctx, err
+			}
+			charset = oscar.CharsetLatin1
+
+		default:
+			return ctx, errors.Wrapf(aimerror.NotSupported, "message for channel %d", msgChannel)
 		}
 
-		// Skip over all the capabilities
-		messageTLVData.Seek(int(fragmentLength))
+		params := ChannelFromContext(ctx)
+		if params == nil {
+			params = defaultChannel()
+		}
+		if len(messageContents) > int(icbm.maxMessageSize(params)) {
+			logger.Info("Message too large", "size", len(messageContents), "max", icbm.maxMessageSize(params))
+			icbm.messageMissed(to, user, msgChannel, MissedTooLarge)
+			errFlap := oscar.NewFLAP(2)
+			errFlap.Data.WriteBinary(oscar.NewSNACError(0x04, snac.Header.RequestID, aimerror.CodeMessageTooLarge))
+			return ctx, session.Send(errFlap)
+		}
+		var allowed bool
+		ctx, allowed = icbm.checkFlood(ctx)
+		tooSoon := icbm.sentTooSoon(user.ScreenName, time.Duration(params.MinimumMessageInterval)*time.Millisecond)
+		if !allowed || tooSoon {
+			icbm.messageMissed(to, user, msgChannel, MissedRateExceeded)
+			return icbm.strike(ctx, session, snac.Header.RequestID)
+		}
 
-		// This should be the start of the message contents fragment
-		fragmentNum, err = messageTLVData.ReadUint8()
-		if err != nil {
-			return ctx, errors.Wrap(err, "could not read fragment identifier")
-		} else if fragmentNum != 1 {
-			return ctx, errors.New("expected second fragment identifier to be 1")
+		// Messages from users the recipient blocks are turned away before they can be stored
+		recipient, err := icbm.recipient(ctx, db, session, snac.Header.RequestID, msgID, user, msgChannel, to, tlvs)
+		if recipient == nil {
+			return ctx, err
 		}
 
-		fragmentVersion, err = messageTLVData.ReadUint8()
-		if err != nil {
-			return ctx, errors.Wrap(err, "could not read fragment version")
-		} else if fragmentVersion != 1 {
-			return ctx, errors.New("expected second fragment version to be 1")
+		// TLV 0x6 is the client telling the server to store the message if the recipient is
+		// offline. Without it, a message to someone who's offline goes nowhere.
+		saveOffline := tlvs.Has(6)
+		if !saveOffline && icbm.Sessions.GetSession(to) == nil {
+			return ctx, icbm.sendRecipientError(session, snac.Header.RequestID, aimerror.CodeRecipientNotLoggedIn, to)
 		}
 
-		fragmentLength, err = messageTLVData.ReadUint16()
+		// Messages are stored as UTF-8 and encoded again for the recipient when delivered
+		text, err := oscar.DecodeText(charset, messageContents)
 		if err != nil {
-			return ctx, errors.Wrap(err, "could not read second fragment data length")
+			return ctx, errors.Wrap(err, "could not decode message text")
 		}
 
-		// Skip over the charset + language
-		messageTLVData.Seek(4)
-
-		messageContents := make([]byte, fragmentLength-4)
-		n, err := messageTLVData.Read(messageContents)
+		// Filtered messages never reach the recipient or the database
+		text, action, err := filterMessage(ctx, icbm.Filter, user.ScreenName, to, text)
 		if err != nil {
-			return ctx, errors.Wrap(err, "could not read message contents from fragment")
+			return ctx, err
 		}
-		if n < int(fragmentLength)-4 {
-			return ctx, errors.New("read insufficient data from message fragment")
+		if action == FilterBlock {
+			logger.Info("message blocked by filter", "to", to)
+			return ctx, icbm.sendError(session, snac.Header.RequestID, aimerror.CodeRequestDenied)
 		}
 
+		// TLV 0x4 marks an automatic reply, like an away message, which clients show differently
+		autoResponse := tlvs.Has(4)
+
 		var message *models.Message
+		if saveOffline && !(icbm.OnlyStoreOffline && icbm.Sessions.GetSession(to) != nil) {
+			// Senders are told straight away when the recipient has too many messages waiting
+			if icbm.MaxOfflineMessages > 0 {
+				queued, err := models.CountUndelivered(ctx, db, to)
+				if err != nil {
+					return ctx, err
+				}
+				if queued >= icbm.MaxOfflineMessages {
+					logger.Info("recipient has too many messages waiting", "to", to, "queued", queued)
+					return ctx, icbm.sendError(session, snac.Header.RequestID, aimerror.CodeUserTemporarilyUnavailable)
+				}
+			}
 
-		// TLV 0x6 is the client telling the server to store the message if the recipient is offline
-		saveofflineTLV := oscar.FindTLV(tlvs, 6)
-		if saveofflineTLV != nil {
-			message, err = models.InsertMessage(ctx, db, msgID, user.ScreenName, to, string(messageContents))
+			if msgChannel == 4 {
+				message, err = models.InsertICQMessage(ctx, db, msgID, user.ScreenName, to, icqType, text)
+			} else {
+				message, err = models.InsertMessage(ctx, db, msgID, user.ScreenName, to, text)
+			}
 			if err != nil {
 				return ctx, errors.Wrap(err, "could not insert message")
 			}
 		} else {
 			message = &models.Message{
 				Cookie:   msgID,
-				From:     user.ScreenName,
-				To:       to,
-				Contents: string(messageContents),
+				From:     util.NormalizeScreenName(user.ScreenName),
+				To:       util.NormalizeScreenName(to),
+				Contents: text,
+				Channel:  msgChannel,
+				ICQType:  icqType,
+			}
+		}
+
+		message.AutoResponse = autoResponse
+
+		// The recipient hears about messages they missed before the one they're getting
+		eventType := webhook.EventMessageDeliveredOffline
+		if toSession := icbm.Sessions.GetSession(to); toSession != nil {
+			eventType = webhook.EventMessageSent
+			if err := icbm.tellMissed(toSession); err != nil {
+				logger.Error("could not send missed messages", "to", to, "err", err.Error())
 			}
 		}
+		icbm.Webhooks.Emit(&webhook.Event{Type: eventType, From: user.ScreenName, To: to, Message: text})
 
 		// Fire the message off into the communication channel to get delivered
 		icbm.CommCh <- message
+		icbm.messageReceived(to, user.ScreenName)
 
-		// The Client usually wants a response that the server got the message. It checks that the message
-		// back has the same message ID that was sent and the user it was sent to.
-		ackTLV := oscar.FindTLV(tlvs, 3)
-		if ackTLV != nil {
-			ackSnac := oscar.NewSNAC(4, 0xc)
-			ackSnac.Data.WriteUint64(msgID)
-			ackSnac.Data.WriteUint16(2)
-			ackSnac.Data.WriteLPString(user.ScreenName)
+		// TLV 0x3 is the client asking for an acknowledgement that the server took the message,
+		// without which it shows the message as still sending
+		if tlvs.Has(3) {
 			ackFlap := oscar.NewFLAP(2)
-			ackFlap.Data.WriteBinary(ackSnac)
-			return ctx, session.Send(ackFlap)
+			ackFlap.Data.WriteBinary(icbmAck(snac.Header.RequestID, msgID, msgChannel, to))
+			if err := session.Send(ackFlap); err != nil {
+				return ctx, err
+			}
+		}
+
+		// Automatic replies aren't answered, or two away users would answer each other forever.
+		// ICQ messages like authorization requests aren't chat, so they aren't answered either.
+		if !autoResponse && msgChannel == 1 {
+			if err := icbm.sendAwayMessage(ctx, session, user.ScreenName, msgID, recipient); err != nil {
+				logger.Error("could not send away message", "to", to, "err", err.Error())
+			}
 		}
 
 		return ctx, nil
+
+	// Client warns someone who messaged them
+	case 0x08:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		anonymous, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read anonymous flag")
+		}
+
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil || screenName == "" {
+			return ctx, errors.New("could not read screen name to warn")
+		}
+
+		if util.NormalizeScreenName(screenName) == util.NormalizeScreenName(user.ScreenName) {
+			return ctx, icbm.sendError(session, snac.Header.RequestID, aimerror.CodeRequestDenied)
+		}
+
+		targetSession := icbm.Sessions.GetSession(screenName)
+		if targetSession == nil {
+			return ctx, icbm.sendError(session, snac.Header.RequestID, aimerror.CodeRecipientNotLoggedIn)
+		}
+
+		if !icbm.receivedRecently(user.ScreenName, screenName) {
+			return ctx, icbm.sendError(session, snac.Header.RequestID, aimerror.CodeRequestDenied)
+		}
+
+		// Users can't be warned by someone they block
+		blocked, err := isBlocked(ctx, db, icbm.Sessions, screenName, user.ScreenName)
+		if err != nil {
+			return ctx, err
+		}
+		if blocked {
+			return ctx, icbm.sendError(session, snac.Header.RequestID, aimerror.CodeInLocalPermitDeny)
+		}
+
+		target, err := models.UserByScreenName(ctx, db, screenName)
+		if err != nil {
+			return ctx, aimerror.FetchingUser(err, screenName)
+		}
+		if target == nil {
+			return ctx, icbm.sendError(session, snac.Header.RequestID, aimerror.CodeRecipientNotLoggedIn)
+		}
+
+		// The warner's own level may have changed since they signed on
+		warner, err := models.UserByUIN(ctx, db, user.UIN)
+		if err != nil || warner == nil {
+			return ctx, aimerror.FetchingUser(err, user.ScreenName)
+		}
+
+		delta := warnIncrease(warner.WarningLevel, anonymous == 1)
+		if err := target.Warn(ctx, db, delta); err != nil {
+			return ctx, err
+		}
+
+		logger.Info("Warned user", "warned", target.ScreenName, "level", target.WarningLevel, "anonymous", anonymous == 1)
+
+		// Tell the warned user who warned them, unless it was anonymous
+		var from *models.User
+		if anonymous != 1 {
+			from = warner
+		}
+		evilFlap := oscar.NewFLAP(2)
+		evilFlap.Data.WriteBinary(WarningLevelSNAC(target.WarningLevel, from))
+		if err := targetSession.Send(evilFlap); err != nil {
+			logger.Error("could not tell user they were warned", "warned", target.ScreenName, "err", err.Error())
+		}
+
+		// Buddies see the new level
+		icbm.OnlineCh <- StatusChanged(target)
+
+		warnEvent := &webhook.Event{Type: webhook.EventWarning, To: target.ScreenName, WarningLevel: target.WarningLevel}
+		if from != nil {
+			warnEvent.From = from.ScreenName
+		}
+		icbm.Webhooks.Emit(warnEvent)
+
+		warnSnac := oscar.NewReplySNAC(snac, 0x4, 0x09)
+		warnSnac.Data.WriteUint16(delta)
+		warnSnac.Data.WriteUint16(target.WarningLevel)
+		warnFlap := oscar.NewFLAP(2)
+		warnFlap.Data.WriteBinary(warnSnac)
+		return ctx, session.Send(warnFlap)
+
+	// Client tells the other end of a conversation that the user is typing
+	case 0x14:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		to, notification, err := readTypingNotification(&snac.Data, user.ScreenName)
+		if err != nil {
+			return ctx, errors.Wrap(err, "invalid typing notification")
+		}
+
+		// Nobody to tell
+		toSession := icbm.Sessions.GetSession(to)
+		if toSession == nil {
+			return ctx, nil
+		}
+
+		blocked, err := isBlocked(ctx, db, icbm.Sessions, to, user.ScreenName)
+		if err != nil {
+			return ctx, err
+		}
+		if blocked {
+			return ctx, nil
+		}
+
+		notificationFlap := oscar.NewFLAP(2)
+		notificationFlap.Data.WriteBinary(notification)
+		return ctx, toSession.Send(notificationFlap)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown ICBM family/subtype: 0x04, 0x%02x", snac.Header.Subtype))
+	return ctx, aimerror.NotSupported
+}
+
+// sendAwayMessage answers a message from one user to another who is signed on and away with
+// their away message, as an automatic reply from them with the message's cookie
+func (icbm *ICBM) sendAwayMessage(ctx context.Context, session *oscar.Session, from string, cookie uint64, recipient *models.User) error {
+	toSession := icbm.Sessions.GetSession(recipient.ScreenName)
+	if toSession == nil {
+		return nil
+	}
+	if recipient.Status != models.UserStatusAway || recipient.AwayMessage == "" {
+		return nil
+	}
+
+	text, err := AwayMessageText(recipient)
+	if err != nil {
+		return err
+	}
+	text, action, err := filterMessage(ctx, icbm.Filter, recipient.ScreenName, from, text)
+	if err != nil {
+		return err
+	}
+	if action == FilterBlock {
+		return nil
+	}
+
+	// Someone chatting with an away user gets their away message once, not with every IM
+	window := icbm.AutoReplyWindow
+	if window == 0 {
+		window = DefaultAutoReplyWindow
+	}
+	if !toSession.AutoReplyDue(util.NormalizeScreenName(from), text, window, icbm.now()) {
+		return nil
+	}
+
+	awayFlap := oscar.NewFLAP(2)
+	awayFlap.Data.WriteBinary(autoResponseSNAC(recipient, toSession, cookie, text))
+	return session.Send(awayFlap)
+}
+
+// autoResponseSNAC is an automatic reply from the user, flagged with TLV 0x04 so clients show it
+// as one
+func autoResponseSNAC(from *models.User, fromSession *oscar.Session, cookie uint64, text string) *oscar.SNAC {
+	autoSnac := oscar.NewSNAC(0x4, 0x07)
+	autoSnac.Data.WriteUint64(cookie)
+	autoSnac.Data.WriteUint16(1)
+	WriteUserInfo(autoSnac, from, fromSession)
+	autoSnac.Data.WriteBinary(MessageFragments(text))
+	autoSnac.Data.WriteBinary(oscar.NewTLV(0x04, nil))
+	return autoSnac
+}
+
+// AwayMessageText is the user's away message as text, read in the charset of its MIME type
+func AwayMessageText(user *models.User) (string, error) {
+	charset := uint16(oscar.CharsetASCII)
+	switch encoding := strings.ToLower(user.AwayMessageEncoding); {
+	case strings.Contains(encoding, "unicode-2-0"):
+		charset = oscar.CharsetUCS2
+	case strings.Contains(encoding, "iso-8859-1"):
+		charset = oscar.CharsetLatin1
+	}
+
+	text, err := oscar.DecodeText(charset, []byte(user.AwayMessage))
+	if err != nil {
+		return "", errors.Wrap(err, "could not decode away message")
+	}
+	return text, nil
+}
+
+// Rendezvous message types, the first word of the rendezvous data
+const (
+	RendezvousPropose = 0x0000
+	RendezvousCancel  = 0x0001
+	RendezvousAccept  = 0x0002
+)
+
+// CapabilityChat is the capability of a rendezvous inviting the recipient to a chat room, which
+// is in TLV 0x2711 of the rendezvous data
+var CapabilityChat = []byte{0x74, 0x8f, 0x24, 0x20, 0x62, 0x87, 0x11, 0xd1, 0x82, 0x22, 0x44, 0x45, 0x53, 0x54, 0x00, 0x00}
+
+// rendezvousBlock is the rendezvous data of a channel 2 message
+type rendezvousBlock struct {
+	Type       uint16
+	Cookie     [8]byte
+	Capability []byte
+	TLVs       oscar.TLVList
+}
+
+// relayRendezvous passes a rendezvous message (TLV 0x05) on to its recipient as it is, so the
+// sequence number and the addresses the proposer advertises get through untouched. Unlike text
+// messages they can't wait for the recipient to sign on, and accepts and cancels for a
+// rendezvous the recipient disconnected from since it was proposed are refused. Chat invitations
+// are only passed on while their room exists, and accepting one lets the user into the room.
+func (icbm *ICBM) relayRendezvous(ctx context.Context, db *bun.DB, session *oscar.Session, user *models.User, requestID uint32, cookie uint64, to string, tlvs oscar.TLVList) error {
+	logger := oscar.LoggerFromContext(ctx).With("service", "icbm")
+
+	rendezvousTLV, ok := tlvs.Get(0x05)
+	if !ok {
+		logger.Warn("rendezvous message missing TLV 0x05")
+		return icbm.sendError(session, requestID, aimerror.CodeIncorrectSNACFormat)
+	}
+	block, err := readRendezvous(rendezvousTLV.Bytes())
+	if err != nil {
+		logger.Warn("invalid rendezvous message", "err", err.Error())
+		return icbm.sendError(session, requestID, aimerror.CodeIncorrectSNACFormat)
+	}
+
+	// Offers only make sense to a client that's there to answer them, so they're never stored
+	if recipient, err := icbm.recipient(ctx, db, session, requestID, cookie, user, 2, to, tlvs); recipient == nil {
+		return err
+	}
+
+	key := newRendezvousKey(block.Cookie, user.ScreenName, to)
+	toSession := icbm.Sessions.GetSession(to)
+	if toSession == nil {
+		icbm.forgetRendezvous(key)
+		return icbm.sendRecipientError(session, requestID, aimerror.CodeRecipientNotLoggedIn, to)
+	}
+
+	chat := bytes.Equal(block.Capability, CapabilityChat)
+	var room *models.ChatRoom
+	switch block.Type {
+	case RendezvousPropose:
+		if chat {
+			roomTLV, ok := block.TLVs.Get(0x2711)
+			if !ok {
+				logger.Warn("chat invitation missing TLV 0x2711")
+				return icbm.sendError(session, requestID, aimerror.CodeIncorrectSNACFormat)
+			}
+			if room, err = readServiceRoom(ctx, db, roomTLV.Bytes()); err != nil {
+				logger.Warn("invalid chat invitation", "err", err.Error())
+				return icbm.sendError(session, requestID, aimerror.CodeIncorrectSNACFormat)
+			}
+			if room == nil {
+				return icbm.sendError(session, requestID, aimerror.CodeNoMatch)
+			}
+		}
+		icbm.proposeRendezvous(key, user.ScreenName, session, to, toSession, room)
+
+	case RendezvousAccept, RendezvousCancel:
+		invitedTo, ok := icbm.answerRendezvous(key, to, toSession)
+		if !ok {
+			return icbm.sendRecipientError(session, requestID, aimerror.CodeRecipientNotLoggedIn, to)
+		}
+
+		// The room may have gone since the invitation
+		if chat && invitedTo != nil {
+			if room, err = models.ChatRoomByCookie(ctx, db, invitedTo.Exchange, invitedTo.Cookie); err != nil {
+				return err
+			}
+			if room == nil {
+				icbm.forgetRendezvous(key)
+				return icbm.sendError(session, requestID, aimerror.CodeNoMatch)
+			}
+		}
+	}
+
+	rendezvousFlap := oscar.NewFLAP(2)
+	rendezvousFlap.Data.WriteBinary(rendezvousSNAC(user, session, cookie, rendezvousTLV))
+	if err := toSession.Send(rendezvousFlap); err != nil {
+		logger.Error("could not relay rendezvous message", "to", to, "err", err.Error())
+		icbm.forgetRendezvous(key)
+		return icbm.sendRecipientError(session, requestID, aimerror.CodeRecipientNotLoggedIn, to)
+	}
+
+	if block.Type == RendezvousCancel {
+		icbm.forgetRendezvous(key)
+	}
+	if block.Type == RendezvousAccept && room != nil && icbm.Chat != nil {
+		icbm.Chat.Invite(room, user.ScreenName, icbm.now())
+	}
+
+	if tlvs.Has(3) {
+		ackFlap := oscar.NewFLAP(2)
+		ackFlap.Data.WriteBinary(icbmAck(requestID, cookie, 2, to))
+		return session.Send(ackFlap)
+	}
+
+	return nil
+}
+
+// readRendezvous reads the rendezvous data, checking it has a known message type, a cookie and
+// a capability, followed by well formed TLVs
+func readRendezvous(data []byte) (*rendezvousBlock, error) {
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	block := &rendezvousBlock{}
+	var err error
+
+	if block.Type, err = buf.ReadUint16(); err != nil {
+		return nil, errors.Wrap(err, "could not read rendezvous message type")
+	}
+	if block.Type > RendezvousAccept {
+		return nil, fmt.Errorf("unknown rendezvous message type 0x%04x", block.Type)
+	}
+
+	cookie, err := buf.ReadBytes(8)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read rendezvous cookie")
+	}
+	copy(block.Cookie[:], cookie)
+
+	if block.Capability, err = buf.ReadBytes(CapabilityLength); err != nil {
+		return nil, errors.Wrap(err, "could not read rendezvous capability")
 	}
 
-	return ctx, nil
+	if block.TLVs, err = oscar.UnmarshalTLVs(buf.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "could not read rendezvous TLVs")
+	}
+	return block, nil
+}
+
+// rendezvousSNAC is the rendezvous message as the recipient gets it, from the sender
+func rendezvousSNAC(from *models.User, fromSession *oscar.Session, cookie uint64, rendezvous *oscar.TLV) *oscar.SNAC {
+	rendezvousSnac := oscar.NewSNAC(0x4, 0x07)
+	rendezvousSnac.Data.WriteUint64(cookie)
+	rendezvousSnac.Data.WriteUint16(2)
+	WriteUserInfo(rendezvousSnac, from, fromSession)
+	rendezvousSnac.WriteTLV(rendezvous)
+	return rendezvousSnac
+}
+
+// ReadMessageFragments reads the charset and text of a channel 1 message from the data of its
+// message TLV (0x02), skipping the capabilities fragment before it
+func ReadMessageFragments(data []byte) (uint16, []byte, error) {
+	// Parse fragment (array of required capabilities, yawn)
+	messageTLVData := oscar.Buffer{}
+	messageTLVData.Write(data)
+
+	fragmentNum, err := messageTLVData.ReadUint8()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read fragment identifier")
+	} else if fragmentNum != 5 {
+		return 0, nil, errors.New("expected first fragment identifier to be 5")
+	}
+
+	fragmentVersion, err := messageTLVData.ReadUint8()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read fragment version")
+	} else if fragmentVersion != 1 {
+		return 0, nil, errors.New("expected first fragment version to be 1")
+	}
+
+	fragmentLength, err := messageTLVData.ReadUint16()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read fragment data length")
+	}
+
+	// Skip over all the capabilities
+	messageTLVData.Seek(int(fragmentLength))
+
+	// This should be the start of the message contents fragment
+	fragmentNum, err = messageTLVData.ReadUint8()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read fragment identifier")
+	} else if fragmentNum != 1 {
+		return 0, nil, errors.New("expected second fragment identifier to be 1")
+	}
+
+	fragmentVersion, err = messageTLVData.ReadUint8()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read fragment version")
+	} else if fragmentVersion != 1 {
+		return 0, nil, errors.New("expected second fragment version to be 1")
+	}
+
+	fragmentLength, err = messageTLVData.ReadUint16()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read second fragment data length")
+	}
+
+	if fragmentLength < 4 {
+		return 0, nil, errors.New("message fragment too short for its charset")
+	}
+
+	charset, err := messageTLVData.ReadUint16()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read message charset")
+	}
+
+	// The subcharset is the language, which doesn't change how the text is read
+	messageTLVData.Seek(2)
+
+	messageContents := make([]byte, fragmentLength-4)
+	n, err := messageTLVData.Read(messageContents)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read message contents from fragment")
+	}
+	if n < int(fragmentLength)-4 {
+		return 0, nil, errors.New("read insufficient data from message fragment")
+	}
+	return charset, messageContents, nil
+}
+
+// ReadICQMessage reads the body of an old ICQ message (channel 4): the sender's UIN, the ICQ
+// message type and flags, all little-endian, then the text
+func ReadICQMessage(data []byte) (uint8, []byte, error) {
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	if _, err := buf.ReadUint32LE(); err != nil {
+		return 0, nil, errors.Wrap(err, "could not read ICQ message UIN")
+	}
+	icqType, err := buf.ReadUint8()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read ICQ message type")
+	}
+	if _, err := buf.ReadUint8(); err != nil {
+		return 0, nil, errors.Wrap(err, "could not read ICQ message flags")
+	}
+	text, err := buf.ReadLNTS()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read ICQ message text")
+	}
+	return icqType, []byte(text), nil
+}
+
+// ICQMessage is the TLV 0x05 of an old ICQ message (channel 4) from the UIN, with the text in
+// Latin-1
+func ICQMessage(from uint32, icqType uint8, text string) *oscar.TLV {
+	buf := oscar.Buffer{}
+	buf.WriteUint32LE(from)
+	buf.WriteUint8(icqType)
+	buf.WriteUint8(0) // message flags
+	buf.WriteLNTS(string(oscar.EncodeLatin1(text)))
+	return oscar.NewTLV(0x05, buf.Bytes())
+}
+
+// MessageFragments is the message TLV (0x02) of a channel 1 message with the text, encoded in
+// whichever charset holds it
+func MessageFragments(text string) *oscar.TLV {
+	charset, data := oscar.EncodeText(text)
+
+	frag := oscar.Buffer{}
+	frag.Write([]byte{5, 1, 0, 4, 1, 1, 1, 2}) // TODO: first fragment [id, version, len, len, (cap * len)... ]
+	frag.Write([]byte{1, 1})                   // message text fragment start (this is a busted "TLV")
+	frag.WriteUint16(uint16(len(data) + 4))    // length of TLV
+	frag.WriteUint16(charset)
+	frag.WriteUint16(0) // subcharset
+	frag.Write(data)
+	return oscar.NewTLV(2, frag.Bytes())
+}
+
+// WarningLevelSNAC tells a user their warning level changed (0x01,0x10). warner is who warned
+// them, nil if it was anonymous or the level went down on its own.
+func WarningLevelSNAC(level uint16, warner *models.User) *oscar.SNAC {
+	evilSnac := oscar.NewSNAC(0x1, 0x10)
+	evilSnac.Data.WriteUint16(level)
+	if warner != nil {
+		evilSnac.Data.WriteLPString(warner.ScreenName)
+		evilSnac.Data.WriteUint16(warner.WarningLevel)
+		evilSnac.AppendTLVs([]*oscar.TLV{
+			oscar.NewTLVUint16(0x01, UserClass(warner)),
+		})
+	}
+	return evilSnac
+}
+
+// icbmAck acknowledges the message request. Clients match it to the message they sent by the
+// request ID, cookie, channel and recipient.
+func icbmAck(requestID uint32, cookie uint64, channel uint16, to string) *oscar.SNAC {
+	ackSnac := oscar.NewSNAC(0x4, 0x0c)
+	ackSnac.Header.RequestID = requestID
+	ackSnac.Data.WriteUint64(cookie)
+	ackSnac.Data.WriteUint16(channel)
+	ackSnac.Data.WriteLPString(to)
+	return ackSnac
+}
+
+// ReadIncomingMessage reads an IM sent to a client (0x04,0x07) for who it's from, its text and
+// whether it's an automatic reply. ok is false for messages on channels other than 1, which
+// aren't read.
+func ReadIncomingMessage(snac *oscar.SNAC) (from string, text string, auto bool, ok bool, err error) {
+	if _, err := snac.Data.ReadUint64(); err != nil {
+		return "", "", false, false, errors.Wrap(err, "could not read message cookie")
+	}
+	channel, err := snac.Data.ReadUint16()
+	if err != nil {
+		return "", "", false, false, errors.Wrap(err, "could not read message channel")
+	}
+	if channel != 1 {
+		return "", "", false, false, nil
+	}
+
+	from, err = snac.Data.ReadLPString()
+	if err != nil || from == "" {
+		return "", "", false, false, errors.New("could not read screen name")
+	}
+	if _, err := snac.Data.ReadUint16(); err != nil {
+		return "", "", false, false, errors.Wrap(err, "could not read warning level")
+	}
+	count, err := snac.Data.ReadUint16()
+	if err != nil {
+		return "", "", false, false, errors.Wrap(err, "could not read TLV count")
+	}
+	if _, err := snac.Data.ReadTLVs(int(count)); err != nil {
+		return "", "", false, false, errors.Wrap(err, "could not read user info TLVs")
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+	if err != nil {
+		return "", "", false, false, errors.Wrap(err, "could not read message TLVs")
+	}
+	messageTLV, found := tlvs.Get(0x02)
+	if !found {
+		return "", "", false, false, errors.New("missing message TLV 0x02")
+	}
+	charset, contents, err := ReadMessageFragments(messageTLV.Bytes())
+	if err != nil {
+		return "", "", false, false, err
+	}
+	text, err = oscar.DecodeText(charset, contents)
+	if err != nil {
+		return "", "", false, false, errors.Wrap(err, "could not decode message text")
+	}
+
+	// TLV 0x04 marks an automatic reply, like an away message
+	return from, text, tlvs.Has(0x04), true, nil
+}
+
+// readTypingNotification reads a typing notification (0x04,0x14) from the sender. Returns who it
+// is for and the notification to send them, which names the sender instead.
+func readTypingNotification(buf *oscar.Buffer, from string) (string, *oscar.SNAC, error) {
+	cookie, err := buf.ReadBytes(8)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "could not read cookie")
+	}
+
+	channel, err := buf.ReadUint16()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "could not read channel")
+	}
+
+	to, err := buf.ReadLPString()
+	if err != nil || to == "" {
+		return "", nil, errors.New("could not read screen name")
+	}
+
+	state, err := buf.ReadUint16()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "could not read typing state")
+	}
+
+	notification := oscar.NewSNAC(0x4, 0x14)
+	notification.Data.Write(cookie)
+	notification.Data.WriteUint16(channel)
+	notification.Data.WriteLPString(from)
+	notification.Data.WriteUint16(state)
+	return to, notification, nil
+}
+
+// warnIncrease is how much a warning raises the warned user's level. Warnings from users who
+// have been warned a lot themselves count for less.
+func warnIncrease(warnerLevel uint16, anonymous bool) uint16 {
+	increase := uint32(WarnIncrease)
+	if anonymous {
+		increase = WarnIncreaseAnonymous
+	}
+
+	if warnerLevel > models.MaxWarningLevel {
+		warnerLevel = models.MaxWarningLevel
+	}
+	return uint16(increase * uint32(models.MaxWarningLevel+1-warnerLevel) / (models.MaxWarningLevel + 1))
+}
+
+// messageReceived records that to got a message from from
+func (icbm *ICBM) messageReceived(to, from string) {
+	icbm.receivedMutex.Lock()
+	defer icbm.receivedMutex.Unlock()
+
+	if icbm.received == nil {
+		icbm.received = make(map[string]map[string]time.Time)
+	}
+
+	to, from = util.NormalizeScreenName(to), util.NormalizeScreenName(from)
+	senders, ok := icbm.received[to]
+	if !ok {
+		senders = make(map[string]time.Time)
+		icbm.received[to] = senders
+	}
+
+	// Forget about old messages while we're here
+	for sender, at := range senders {
+		if time.Since(at) > WarnWindow {
+			delete(senders, sender)
+		}
+	}
+
+	senders[from] = time.Now()
+}
+
+// receivedRecently is true if to got a message from from within the WarnWindow
+func (icbm *ICBM) receivedRecently(to, from string) bool {
+	icbm.receivedMutex.Lock()
+	defer icbm.receivedMutex.Unlock()
+
+	at, ok := icbm.received[util.NormalizeScreenName(to)][util.NormalizeScreenName(from)]
+	return ok && time.Since(at) <= WarnWindow
+}
+
+// sentTooSoon is true if from sent their last message less than interval ago. Otherwise this
+// message becomes their last one.
+func (icbm *ICBM) sentTooSoon(from string, interval time.Duration) bool {
+	// Most clients don't have an interval, so there's no need to remember when they sent
+	if interval <= 0 {
+		return false
+	}
+
+	icbm.sentMutex.Lock()
+	defer icbm.sentMutex.Unlock()
+
+	if icbm.sent == nil {
+		icbm.sent = make(map[string]time.Time)
+	}
+
+	from = util.NormalizeScreenName(from)
+	if time.Since(icbm.sent[from]) < interval {
+		return true
+	}
+
+	icbm.sent[from] = time.Now()
+	return false
+}
+
+// recipient is the user a message on the channel is for. If there's nobody with the screen name,
+// or they block the sender, it's nil and the sender has been sent an error. Blocked senders are
+// told the recipient has them on their permit/deny list, and their message isn't stored.
+func (icbm *ICBM) recipient(ctx context.Context, db *bun.DB, session *oscar.Session, requestID uint32, cookie uint64, from *models.User, channel uint16, to string, tlvs oscar.TLVList) (*models.User, error) {
+	recipient, err := models.UserByScreenName(ctx, db, to)
+	if err != nil {
+		return nil, aimerror.FetchingUser(err, to)
+	}
+	if recipient == nil {
+		if icbm.HideUnregistered {
+			return nil, icbm.answerAsSignedOff(session, requestID, cookie, channel, to, tlvs)
+		}
+		return nil, icbm.sendRecipientError(session, requestID, aimerror.CodeNoMatch, to)
+	}
+
+	blocked, err := SessionBlocks(ctx, db, icbm.Sessions.GetSession(to), recipient, from.ScreenName)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		// Clients don't have a reason for messages from someone the user blocks
+		icbm.messageMissed(to, from, channel, MissedInvalid)
+		return nil, icbm.sendRecipientError(session, requestID, aimerror.CodeInLocalPermitDeny, to)
+	}
+	return recipient, nil
+}
+
+// answerAsSignedOff answers a message to a screen name nobody has like one to a user who's
+// signed off. Messages the sender asked to store (TLV 0x6) look stored, and are acknowledged if
+// the sender asked for that (TLV 0x3), but go nowhere. Anything else can't reach someone who's
+// signed off.
+func (icbm *ICBM) answerAsSignedOff(session *oscar.Session, requestID uint32, cookie uint64, channel uint16, to string, tlvs oscar.TLVList) error {
+	if channel == 2 || !tlvs.Has(6) {
+		return icbm.sendRecipientError(session, requestID, aimerror.CodeRecipientNotLoggedIn, to)
+	}
+	if tlvs.Has(3) {
+		ackFlap := oscar.NewFLAP(2)
+		ackFlap.Data.WriteBinary(icbmAck(requestID, cookie, channel, to))
+		return session.Send(ackFlap)
+	}
+	return nil
+}
+
+func (icbm *ICBM) sendRecipientError(session *oscar.Session, requestID uint32, code uint16, to string) error {
+	return session.Send(ICBMRecipientError(requestID, code, to))
+}
+
+func (icbm *ICBM) sendError(session *oscar.Session, requestID uint32, code uint16) error {
+	return session.Send(ICBMError(requestID, code))
+}
+
+// ICBMError tells the client that its message couldn't be sent
+func ICBMError(requestID uint32, code uint16) *oscar.FLAP {
+	errSnac := oscar.NewSNACError(0x4, requestID, code)
+	errFlap := oscar.NewFLAP(2)
+	errFlap.Data.WriteBinary(errSnac)
+	return errFlap
+}
+
+// ICBMRecipientError tells the client that its message to the screen name couldn't be sent, like
+// when the recipient isn't logged in. The screen name is in TLV 0x01.
+func ICBMRecipientError(requestID uint32, code uint16, to string) *oscar.FLAP {
+	errSnac := oscar.NewSNACError(0x4, requestID, code)
+	errSnac.WriteTLV(oscar.NewTLVString(0x01, to))
+	errFlap := oscar.NewFLAP(2)
+	errFlap.Data.WriteBinary(errSnac)
+	return errFlap
 }
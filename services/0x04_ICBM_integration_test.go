@@ -0,0 +1,757 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMessageAck(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	if _, err := d.NewCreateTable().Model((*models.Message)(nil)).IfNotExists().Exec(context.Background()); err != nil {
+		t.Fatalf("could not create messages table: %s", err)
+	}
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Message)(nil)).Where("\"from\" = ?", alice.ScreenName).Exec(context.Background())
+	})
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	bobCtx, _ := fakeClient(t, bob.ScreenName)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	sessions := fakeSessionManager{}
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: sessions}
+
+	message := func(store bool) *oscar.SNAC {
+		snac := instantMessage(bob.ScreenName, "hello")
+		snac.Header.RequestID = 42
+		snac.WriteTLV(oscar.NewTLV(0x03, []byte{}))
+		if store {
+			snac.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+		}
+		return snac
+	}
+
+	expectAck := func() {
+		t.Helper()
+		ack := expectSNAC(t, aliceSNACs, 0x4, 0x0c)
+		if ack.Header.RequestID != 42 {
+			t.Errorf("expected the ack to have the request's ID, got %d", ack.Header.RequestID)
+		}
+		cookie, _ := ack.Data.ReadUint64()
+		channel, _ := ack.Data.ReadUint16()
+		to, _ := ack.Data.ReadLPString()
+		if cookie != 1 || channel != 1 || to != bob.ScreenName {
+			t.Errorf("expected the ack to echo the message, got %d %d %s", cookie, channel, to)
+		}
+	}
+
+	// bob is offline and the message can't wait for him
+	if _, err := icbm.HandleSNAC(aliceCtx, d, message(false)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectRecipientError(t, aliceSNACs, 42, 0x04, bob.ScreenName)
+	expectNoSNAC(t, aliceSNACs)
+	if len(commCh) != 0 {
+		t.Errorf("expected the message not to be delivered")
+	}
+
+	// Stored messages are acknowledged once they're saved
+	if _, err := icbm.HandleSNAC(aliceCtx, d, message(true)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectAck()
+	if stored := <-commCh; stored.ID == 0 {
+		t.Errorf("expected the message to be stored before it was acknowledged")
+	}
+
+	// Messages to online users are acknowledged once they're handed off to be delivered
+	sessions[bob.ScreenName] = bobSession
+	if _, err := icbm.HandleSNAC(aliceCtx, d, message(false)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectAck()
+	if len(commCh) != 1 {
+		t.Errorf("expected the message to be delivered")
+	}
+}
+
+func TestRendezvousRelay(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	bobCtx, bobSNACs := fakeClient(t, bob.ScreenName)
+	bobCtx = models.NewContextWithUser(bobCtx, bob)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	sessions := fakeSessionManager{}
+	icbm := &ICBM{Sessions: sessions}
+
+	// Offers can't wait for bob to sign on
+	if _, err := icbm.HandleSNAC(aliceCtx, d, rendezvousMessage(bob.ScreenName, rendezvous(RendezvousPropose))); err != nil {
+		t.Fatalf("could not send rendezvous: %s", err)
+	}
+	expectRecipientError(t, aliceSNACs, 0, 0x04, bob.ScreenName)
+
+	sessions[bob.ScreenName] = bobSession
+	offer := rendezvous(RendezvousPropose)
+	if _, err := icbm.HandleSNAC(aliceCtx, d, rendezvousMessage(bob.ScreenName, offer)); err != nil {
+		t.Fatalf("could not send rendezvous: %s", err)
+	}
+	relayed := expectSNAC(t, bobSNACs, 0x4, 0x07)
+	if from, _, data := readRelayedRendezvous(t, relayed); from != alice.ScreenName || !bytes.Equal(data, offer) {
+		t.Errorf("expected bob to get alice's offer as it is")
+	}
+
+	// bob accepting goes back to alice
+	sessions[alice.ScreenName], _ = oscar.SessionFromContext(aliceCtx)
+	if _, err := icbm.HandleSNAC(bobCtx, d, rendezvousMessage(alice.ScreenName, rendezvous(RendezvousAccept))); err != nil {
+		t.Fatalf("could not send rendezvous: %s", err)
+	}
+	expectSNAC(t, aliceSNACs, 0x4, 0x07)
+}
+
+// directIM is the rendezvous data of a Direct IM proposal with the request sequence number and
+// the proposer's internal and external addresses
+func directIM(messageType uint16, sequence uint16) []byte {
+	buf := oscar.Buffer{}
+	buf.WriteUint16(messageType)
+	buf.Write([]byte{8, 7, 6, 5, 4, 3, 2, 1}) // cookie
+	buf.Write([]byte{0x09, 0x46, 0x13, 0x45, 0x4c, 0x7f, 0x11, 0xd1, 0x82, 0x22, 0x44, 0x45, 0x53, 0x54, 0x00, 0x00})
+	buf.WriteBinary(oscar.NewTLV(0x0a, []byte{byte(sequence >> 8), byte(sequence)}))
+	buf.WriteBinary(oscar.NewTLV(0x0f, nil))
+	buf.WriteBinary(oscar.NewTLV(0x03, []byte{192, 168, 1, 2}))   // internal IP
+	buf.WriteBinary(oscar.NewTLV(0x04, []byte{203, 0, 113, 7}))   // external IP
+	buf.WriteBinary(oscar.NewTLV(0x05, []byte{0x13, 0x88}))       // port
+	buf.WriteBinary(oscar.NewTLV(0x17, []byte{0xec, 0x77}))       // port check
+	buf.WriteBinary(oscar.NewTLV(0x16, []byte{63, 87, 254, 253})) // IP check
+	return buf.Bytes()
+}
+
+// A Direct IM is proposed, counter-proposed and accepted, dropped when bob signs off, and
+// proposed again once bob is back
+func TestDirectIMRenegotiation(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	aliceSession, _ := oscar.SessionFromContext(aliceCtx)
+	bobCtx, bobSNACs := fakeClient(t, bob.ScreenName)
+	bobCtx = models.NewContextWithUser(bobCtx, bob)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	sessions := fakeSessionManager{alice.ScreenName: aliceSession, bob.ScreenName: bobSession}
+	icbm := &ICBM{Sessions: sessions}
+
+	relay := func(ctx context.Context, to *models.User, data []byte, snacs chan *oscar.SNAC, from *models.User) {
+		t.Helper()
+		if _, err := icbm.HandleSNAC(ctx, d, rendezvousMessage(to.ScreenName, data)); err != nil {
+			t.Fatalf("could not send rendezvous: %s", err)
+		}
+		relayed := expectSNAC(t, snacs, 0x4, 0x07)
+		if sender, _, relayedData := readRelayedRendezvous(t, relayed); sender != from.ScreenName || !bytes.Equal(relayedData, data) {
+			t.Errorf("expected %s to get the rendezvous from %s as it is", to.ScreenName, from.ScreenName)
+		}
+	}
+
+	// bob can't connect to alice, so he proposes the other way round with the next sequence number
+	relay(aliceCtx, bob, directIM(RendezvousPropose, 1), bobSNACs, alice)
+	relay(bobCtx, alice, directIM(RendezvousPropose, 2), aliceSNACs, bob)
+	relay(aliceCtx, bob, directIM(RendezvousAccept, 2), bobSNACs, alice)
+
+	// bob signs on again before alice hangs up, and his new session knows nothing of the old
+	// connection
+	bobSession.Disconnect()
+	bobAgainCtx, bobAgainSNACs := fakeClient(t, bob.ScreenName)
+	bobAgainCtx = models.NewContextWithUser(bobAgainCtx, bob)
+	sessions[bob.ScreenName], _ = oscar.SessionFromContext(bobAgainCtx)
+
+	cancel := rendezvousMessage(bob.ScreenName, directIM(RendezvousCancel, 2))
+	cancel.Header.RequestID = 7
+	if _, err := icbm.HandleSNAC(aliceCtx, d, cancel); err != nil {
+		t.Fatalf("could not send rendezvous: %s", err)
+	}
+	expectRecipientError(t, aliceSNACs, 7, 0x04, bob.ScreenName)
+	expectNoSNAC(t, bobAgainSNACs)
+
+	// They connect again with the same cookie, and hang up
+	relay(bobAgainCtx, alice, directIM(RendezvousPropose, 1), aliceSNACs, bob)
+	relay(aliceCtx, bob, directIM(RendezvousAccept, 1), bobAgainSNACs, alice)
+	relay(aliceCtx, bob, directIM(RendezvousCancel, 1), bobAgainSNACs, alice)
+	if len(icbm.rendezvous) != 0 {
+		t.Errorf("expected the cancelled rendezvous to be forgotten")
+	}
+}
+
+// chatInvitation is the rendezvous data of an invitation to the room, or an answer to one when
+// room is nil
+func chatInvitation(messageType uint16, cookie byte, room *models.ChatRoom) []byte {
+	buf := oscar.Buffer{}
+	buf.WriteUint16(messageType)
+	buf.Write([]byte{cookie, 0, 0, 0, 0, 0, 0, 0})
+	buf.Write(CapabilityChat)
+	if room != nil {
+		buf.WriteBinary(oscar.NewTLV(0x0a, []byte{0, 1}))
+		buf.WriteBinary(oscar.NewTLV(0x0c, []byte("Join me in this chat")))
+		info := oscar.Buffer{}
+		info.WriteUint16(room.Exchange)
+		info.WriteLPString(room.Cookie)
+		info.WriteUint16(room.Instance)
+		buf.WriteBinary(oscar.NewTLV(0x2711, info.Bytes()))
+	}
+	return buf.Bytes()
+}
+
+// Invitations to a chat room reach the invitee while the room exists, and accepting one lets
+// them into it
+func TestChatInvitation(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+	ctx := context.Background()
+
+	if _, err := d.NewCreateTable().Model((*models.ChatRoom)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+	room := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: uuid.New().String(), Name: "invitation"}
+	if _, err := d.NewInsert().Model(room).Exec(ctx); err != nil {
+		t.Fatalf("could not create room: %s", err)
+	}
+	defer d.NewDelete().Model(room).WherePK().Exec(ctx)
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	aliceSession, _ := oscar.SessionFromContext(aliceCtx)
+	bobCtx, bobSNACs := fakeClient(t, bob.ScreenName)
+	bobCtx = models.NewContextWithUser(bobCtx, bob)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	registry := NewChatRegistry()
+	icbm := &ICBM{Sessions: fakeSessionManager{alice.ScreenName: aliceSession, bob.ScreenName: bobSession}, Chat: registry}
+
+	send := func(ctx context.Context, to string, requestID uint32, data []byte) {
+		t.Helper()
+		message := rendezvousMessage(to, data)
+		message.Header.RequestID = requestID
+		if _, err := icbm.HandleSNAC(ctx, d, message); err != nil {
+			t.Fatalf("could not send rendezvous: %s", err)
+		}
+	}
+
+	// Rooms that don't exist can't be invited to
+	gone := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: uuid.New().String()}
+	send(aliceCtx, bob.ScreenName, 1, chatInvitation(RendezvousPropose, 1, gone))
+	if code, _ := expectSNAC(t, aliceSNACs, 0x4, 0x01).Data.ReadUint16(); code != 0x14 {
+		t.Errorf("expected error 0x14, got 0x%02x", code)
+	}
+	expectNoSNAC(t, bobSNACs)
+
+	invitation := chatInvitation(RendezvousPropose, 2, room)
+	send(aliceCtx, bob.ScreenName, 2, invitation)
+	relayed := expectSNAC(t, bobSNACs, 0x4, 0x07)
+	if from, _, data := readRelayedRendezvous(t, relayed); from != alice.ScreenName || !bytes.Equal(data, invitation) {
+		t.Errorf("expected bob to get alice's invitation as it is")
+	}
+
+	// Accepting goes back to alice, and bob gets in even when the room is full
+	for i := 0; i < ChatMaxOccupancy; i++ {
+		registry.Join(room, &oscar.Session{}, &models.User{ScreenName: fmt.Sprintf("user%d", i)})
+	}
+	send(bobCtx, alice.ScreenName, 3, chatInvitation(RendezvousAccept, 2, nil))
+	expectSNAC(t, aliceSNACs, 0x4, 0x07)
+	if !registry.Admit(room, bob.ScreenName, time.Now()) {
+		t.Errorf("expected bob to be let into the room they accepted the invitation to")
+	}
+
+	// Declining once the room is gone is refused
+	send(aliceCtx, bob.ScreenName, 4, chatInvitation(RendezvousPropose, 3, room))
+	expectSNAC(t, bobSNACs, 0x4, 0x07)
+	if _, err := d.NewDelete().Model(room).WherePK().Exec(ctx); err != nil {
+		t.Fatalf("could not delete room: %s", err)
+	}
+	send(bobCtx, alice.ScreenName, 5, chatInvitation(RendezvousCancel, 3, nil))
+	errSnac := expectSNAC(t, bobSNACs, 0x4, 0x01)
+	if code, _ := errSnac.Data.ReadUint16(); code != 0x14 || errSnac.Header.RequestID != 5 {
+		t.Errorf("expected error 0x14 for request 5, got 0x%02x for %d", code, errSnac.Header.RequestID)
+	}
+	expectNoSNAC(t, aliceSNACs)
+}
+
+// Text is stored as UTF-8 whatever charset it was sent in, and sent on in one the recipient can
+// read
+func TestMessageCharsets(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Message)(nil)).Where("\"from\" = ?", alice.NormalizedScreenName).Exec(context.Background())
+	})
+
+	aliceCtx, _ := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{}}
+
+	ucs2 := oscar.NewSNAC(0x4, 0x06)
+	ucs2.Data.WriteUint64(2)
+	ucs2.Data.WriteUint16(1)
+	ucs2.Data.WriteLPString(bob.ScreenName)
+	ucs2.WriteTLV(MessageFragments("日本 😀"))
+
+	tt := map[string]struct {
+		snac    *oscar.SNAC
+		text    string
+		charset uint16
+	}{
+		"plain ASCII":      {instantMessage(bob.ScreenName, "hello"), "hello", oscar.CharsetASCII},
+		"accented UTF-8":   {instantMessage(bob.ScreenName, "café"), "café", oscar.CharsetLatin1},
+		"emoji UTF-8":      {instantMessage(bob.ScreenName, "hi 😀"), "hi 😀", oscar.CharsetUCS2},
+		"UCS-2 with emoji": {ucs2, "日本 😀", oscar.CharsetUCS2},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			tc.snac.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+			if _, err := icbm.HandleSNAC(aliceCtx, d, tc.snac); err != nil {
+				t.Fatalf("could not send message: %s", err)
+			}
+
+			message := <-commCh
+			stored := &models.Message{ID: message.ID}
+			if err := d.NewSelect().Model(stored).WherePK().Scan(context.Background()); err != nil {
+				t.Fatalf("could not fetch message: %s", err)
+			}
+			if stored.Contents != tc.text {
+				t.Errorf("expected %q to be stored, got %q", tc.text, stored.Contents)
+			}
+
+			fragments := oscar.Buffer{}
+			fragments.Write(MessageFragments(stored.Contents).Data)
+			fragments.Seek(8 + 4) // capabilities fragment and the text fragment's header
+			charset, _ := fragments.ReadUint16()
+			fragments.Seek(2)
+			text, err := oscar.DecodeText(charset, fragments.Bytes())
+			if charset != tc.charset || err != nil || text != tc.text {
+				t.Errorf("expected %q in charset 0x%04x, got %q in 0x%04x %v", tc.text, tc.charset, text, charset, err)
+			}
+		})
+	}
+}
+
+func TestAwayAutoResponse(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+
+	bob.Status = models.UserStatusAway
+	bob.AwayMessage = "out to lunch"
+	bob.AwayMessageEncoding = `text/aolrtf; charset="us-ascii"`
+	if _, err := d.NewUpdate().Model(bob).Column("status", "away_message", "away_message_encoding").WherePK().Exec(context.Background()); err != nil {
+		t.Fatalf("could not set bob away: %s", err)
+	}
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	bobCtx, _ := fakeClient(t, bob.ScreenName)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{bob.ScreenName: bobSession}}
+
+	// The message is still delivered, and alice gets bob's away message back
+	if _, err := icbm.HandleSNAC(aliceCtx, d, instantMessage(bob.ScreenName, "hello")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if delivered := <-commCh; delivered.Contents != "hello" || delivered.AutoResponse {
+		t.Errorf("expected the message to be delivered as sent, got %+v", delivered)
+	}
+
+	reply := expectSNAC(t, aliceSNACs, 0x4, 0x07)
+	cookie, _ := reply.Data.ReadUint64()
+	channel, _ := reply.Data.ReadUint16()
+	from, _ := reply.Data.ReadLPString()
+	if cookie != 1 || channel != 1 || from != bob.ScreenName {
+		t.Errorf("expected an auto-response from bob with the message's cookie, got %d %d %s", cookie, channel, from)
+	}
+	reply.Data.ReadUint16() // warning level
+	count, _ := reply.Data.ReadUint16()
+	if _, err := reply.Data.ReadTLVs(int(count)); err != nil {
+		t.Fatalf("could not read user info: %s", err)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read auto-response TLVs: %s", err)
+	}
+	if oscar.FindTLV(tlvs, 0x04) == nil {
+		t.Errorf("expected the auto-response to be flagged with TLV 0x04")
+	}
+	messageTLV := oscar.FindTLV(tlvs, 0x02)
+	if messageTLV == nil {
+		t.Fatalf("expected the auto-response to have a message")
+	}
+	charset, text, err := ReadMessageFragments(messageTLV.Data)
+	if err != nil {
+		t.Fatalf("could not read auto-response text: %s", err)
+	}
+	if decoded, _ := oscar.DecodeText(charset, text); decoded != "out to lunch" {
+		t.Errorf("expected bob's away message, got %q", decoded)
+	}
+
+	// alice already has the away message, so the next message only gets delivered
+	if _, err := icbm.HandleSNAC(aliceCtx, d, instantMessage(bob.ScreenName, "are you there?")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	<-commCh
+	expectNoSNAC(t, aliceSNACs)
+
+	// Auto-responses aren't answered with another one, even once the window is reset
+	bobSession.ResetAutoReplies()
+	auto := instantMessage(bob.ScreenName, "I'm away too")
+	auto.WriteTLV(oscar.NewTLV(0x04, []byte{}))
+	if _, err := icbm.HandleSNAC(aliceCtx, d, auto); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if delivered := <-commCh; !delivered.AutoResponse {
+		t.Errorf("expected the message to be delivered as an auto-response")
+	}
+	expectNoSNAC(t, aliceSNACs)
+}
+
+func TestOfflineMessageCap(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Message)(nil)).Where("\"from\" = ?", alice.NormalizedScreenName).Exec(context.Background())
+	})
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{}, MaxOfflineMessages: 2}
+
+	message := func() *oscar.SNAC {
+		snac := instantMessage(bob.ScreenName, "hello")
+		snac.Header.RequestID = 42
+		snac.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+		return snac
+	}
+
+	// bob is offline, and his messages wait for him until there are too many
+	for i := 0; i < 2; i++ {
+		if _, err := icbm.HandleSNAC(aliceCtx, d, message()); err != nil {
+			t.Fatalf("could not send message: %s", err)
+		}
+		<-commCh
+	}
+	expectNoSNAC(t, aliceSNACs)
+
+	if _, err := icbm.HandleSNAC(aliceCtx, d, message()); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	errSnac := expectSNAC(t, aliceSNACs, 0x4, 0x01)
+	if errSnac.Header.RequestID != 42 {
+		t.Errorf("expected the error to have the request's ID, got %d", errSnac.Header.RequestID)
+	}
+	if code, _ := errSnac.Data.ReadUint16(); code != 0x13 {
+		t.Errorf("expected error 0x13, got 0x%02x", code)
+	}
+	if len(commCh) != 0 {
+		t.Errorf("expected the message not to be stored")
+	}
+	if queued, _ := models.CountUndelivered(context.Background(), d, bob.ScreenName); queued != 2 {
+		t.Errorf("expected 2 messages waiting for bob, got %d", queued)
+	}
+}
+
+func TestMessageToUnknownUser(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	nobody := fmt.Sprintf("nobody%d", time.Now().UnixNano()%100000)
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{}}
+
+	// Messages for screen names nobody has aren't stored, whatever the client asks
+	message := instantMessage(nobody, "hello")
+	message.Header.RequestID = 42
+	message.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+	if _, err := icbm.HandleSNAC(aliceCtx, d, message); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectRecipientError(t, aliceSNACs, 42, 0x14, nobody)
+	if len(commCh) != 0 {
+		t.Errorf("expected the message not to be stored")
+	}
+	if queued, _ := models.CountUndelivered(context.Background(), d, nobody); queued != 0 {
+		t.Errorf("expected no messages waiting for %s, got %d", nobody, queued)
+	}
+
+	offer := rendezvousMessage(nobody, rendezvous(RendezvousPropose))
+	offer.Header.RequestID = 43
+	if _, err := icbm.HandleSNAC(aliceCtx, d, offer); err != nil {
+		t.Fatalf("could not send rendezvous: %s", err)
+	}
+	expectRecipientError(t, aliceSNACs, 43, 0x14, nobody)
+}
+
+// With HideUnregistered, screen names nobody has are answered like users who are signed off
+func TestMessageToUnknownUserHidden(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	nobody := fmt.Sprintf("nobody%d", time.Now().UnixNano()%100000)
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{}, HideUnregistered: true}
+
+	// Messages to store are acknowledged for both, though only bob's is stored
+	for i, to := range []string{bob.ScreenName, nobody} {
+		message := instantMessage(to, "hello")
+		message.Header.RequestID = uint32(42 + i)
+		message.WriteTLV(oscar.NewTLV(0x03, []byte{}))
+		message.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+		if _, err := icbm.HandleSNAC(aliceCtx, d, message); err != nil {
+			t.Fatalf("could not send message to %s: %s", to, err)
+		}
+		if ack := expectSNAC(t, aliceSNACs, 0x04, 0x0c); ack.Header.RequestID != uint32(42+i) {
+			t.Errorf("expected the ack for %s to have the request's ID, got %d", to, ack.Header.RequestID)
+		}
+	}
+	if len(commCh) != 1 || (<-commCh).To != bob.ScreenName {
+		t.Errorf("expected only bob's message to be stored")
+	}
+	if queued, _ := models.CountUndelivered(context.Background(), d, nobody); queued != 0 {
+		t.Errorf("expected no messages waiting for %s, got %d", nobody, queued)
+	}
+
+	// Messages that can't be stored, and rendezvous, can't reach either of them
+	for i, to := range []string{bob.ScreenName, nobody} {
+		message := instantMessage(to, "hello")
+		message.Header.RequestID = uint32(44 + i)
+		if _, err := icbm.HandleSNAC(aliceCtx, d, message); err != nil {
+			t.Fatalf("could not send message to %s: %s", to, err)
+		}
+		expectRecipientError(t, aliceSNACs, uint32(44+i), 0x04, to)
+
+		offer := rendezvousMessage(to, rendezvous(RendezvousPropose))
+		offer.Header.RequestID = uint32(46 + i)
+		if _, err := icbm.HandleSNAC(aliceCtx, d, offer); err != nil {
+			t.Fatalf("could not send rendezvous to %s: %s", to, err)
+		}
+		expectRecipientError(t, aliceSNACs, uint32(46+i), 0x04, to)
+	}
+}
+
+func TestMissedMessagesOnDelivery(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	carol := testUser(t, d, "carol")
+
+	aliceCtx, _ := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	bobCtx, bobSNACs := fakeClient(t, bob.ScreenName)
+	bobCtx = models.NewContextWithUser(bobCtx, bob)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+	carolCtx, _ := fakeClient(t, carol.ScreenName)
+	carolCtx = models.NewContextWithUser(carolCtx, carol)
+
+	// bob denies alice
+	deny := oscar.NewSNAC(0x09, 0x07)
+	deny.Data.WriteLPString(alice.ScreenName)
+	if _, err := (&PrivacyService{OnlineCh: make(chan *PresenceEvent, 10)}).HandleSNAC(bobCtx, d, deny); err != nil {
+		t.Fatalf("could not deny: %s", err)
+	}
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{bob.ScreenName: bobSession}}
+
+	if _, err := icbm.HandleSNAC(aliceCtx, d, instantMessage(bob.ScreenName, "hello")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectNoSNAC(t, bobSNACs)
+
+	// bob hears about alice's message along with the next one he gets
+	if _, err := icbm.HandleSNAC(carolCtx, d, instantMessage(bob.ScreenName, "hi bob")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	blocks := readMissed(t, expectSNAC(t, bobSNACs, 0x4, 0x0a))
+	if len(blocks) != 1 || blocks[0] != (missedBlock{channel: 1, from: alice.ScreenName, count: 1, reason: MissedInvalid}) {
+		t.Errorf("expected one missed message from alice, got %v", blocks)
+	}
+	if delivered := <-commCh; delivered.Contents != "hi bob" {
+		t.Errorf("expected carol's message to be delivered, got %s", delivered)
+	}
+}
+
+func TestICQMessageStored(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Message)(nil)).Where("\"from\" = ?", alice.NormalizedScreenName).Exec(context.Background())
+	})
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{}}
+
+	url := icqMessage(bob.ScreenName, uint32(alice.UIN), 0x04, "Homepage\u00fehttp://example.com")
+	url.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+	if _, err := icbm.HandleSNAC(aliceCtx, d, url); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectNoSNAC(t, aliceSNACs)
+
+	message := <-commCh
+	stored := &models.Message{ID: message.ID}
+	if err := d.NewSelect().Model(stored).WherePK().Scan(context.Background()); err != nil {
+		t.Fatalf("could not fetch message: %s", err)
+	}
+	if stored.Channel != 4 || stored.ICQType != 0x04 || stored.Contents != "Homepage\u00fehttp://example.com" {
+		t.Errorf("expected the URL message to be stored as it was sent, got %d 0x%02x %q", stored.Channel, stored.ICQType, stored.Contents)
+	}
+}
+
+func TestMessageFilter(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Message)(nil)).Where("\"from\" = ?", alice.ScreenName).Exec(context.Background())
+	})
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	bobCtx, _ := fakeClient(t, bob.ScreenName)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{bob.ScreenName: bobSession}, Filter: testWordFilter(t, "darn\n!meet me\n")}
+
+	if _, err := icbm.HandleSNAC(aliceCtx, d, instantMessage(bob.ScreenName, "darn it")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if message := <-commCh; message.Contents != "**** it" {
+		t.Errorf("expected the message to be redacted, got %q", message.Contents)
+	}
+
+	// Blocked messages are refused, even when they could be stored
+	blocked := instantMessage(bob.ScreenName, "meet me at the park")
+	blocked.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+	if _, err := icbm.HandleSNAC(aliceCtx, d, blocked); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	errSnac := expectSNAC(t, aliceSNACs, 0x4, 0x01)
+	if code, _ := errSnac.Data.ReadUint16(); code != 0x0d {
+		t.Errorf("expected error 0x0d, got 0x%02x", code)
+	}
+	if len(commCh) != 0 {
+		t.Errorf("expected the message not to be delivered")
+	}
+	stored, err := d.NewSelect().Model((*models.Message)(nil)).Where("\"from\" = ?", alice.ScreenName).Count(context.Background())
+	if err != nil {
+		t.Fatalf("could not count messages: %s", err)
+	}
+	if stored != 0 {
+		t.Errorf("expected the message not to be stored, got %d", stored)
+	}
+}
+
+func TestOnlyStoreOffline(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	carol := testUser(t, d, "carol")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Message)(nil)).Where("\"from\" = ?", alice.NormalizedScreenName).Exec(context.Background())
+	})
+
+	aliceCtx, _ := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	bobCtx, _ := fakeClient(t, bob.ScreenName)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, Sessions: fakeSessionManager{bob.ScreenName: bobSession}, OnlyStoreOffline: true}
+
+	message := func(to string) *oscar.SNAC {
+		snac := instantMessage(to, "hello")
+		snac.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+		return snac
+	}
+
+	// bob is signed on, so his message goes straight to him without being stored
+	if _, err := icbm.HandleSNAC(aliceCtx, d, message(bob.ScreenName)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if sent := <-commCh; sent.ID != 0 {
+		t.Errorf("expected the message to bob not to be stored, got ID %d", sent.ID)
+	}
+
+	// carol is signed off, so hers waits for her
+	if _, err := icbm.HandleSNAC(aliceCtx, d, message(carol.ScreenName)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if sent := <-commCh; sent.ID == 0 {
+		t.Errorf("expected the message to carol to be stored")
+	}
+	if queued, _ := models.CountUndelivered(context.Background(), d, carol.ScreenName); queued != 1 {
+		t.Errorf("expected 1 message waiting for carol, got %d", queued)
+	}
+}
@@ -0,0 +1,490 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+type fakeSessionManager map[string]*oscar.Session
+
+func (sm fakeSessionManager) GetSession(screenName string) *oscar.Session {
+	return sm[screenName]
+}
+
+// instantMessage is a channel 1 message with the text sent as ASCII
+func instantMessage(to string, text string) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x4, 0x06)
+	snac.Data.WriteUint64(1) // cookie
+	snac.Data.WriteUint16(1) // channel
+	snac.Data.WriteLPString(to)
+
+	fragments := oscar.Buffer{}
+	fragments.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x01}) // required capabilities
+	fragments.Write([]byte{0x01, 0x01})                   // message text
+	fragments.WriteUint16(uint16(4 + len(text)))
+	fragments.WriteUint32(0) // charset and language
+	fragments.WriteString(text)
+	snac.WriteTLV(oscar.NewTLV(0x02, fragments.Bytes()))
+	return snac
+}
+
+func typingNotification(screenName string, state uint16) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x4, 0x14)
+	snac.Data.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8}) // cookie
+	snac.Data.WriteUint16(1)                        // channel
+	snac.Data.WriteLPString(screenName)
+	snac.Data.WriteUint16(state)
+	return snac
+}
+
+func TestTypingNotificationRoundTrip(t *testing.T) {
+	aliceCtx, aliceSNACs := fakeClient(t, "alice")
+	aliceSession, _ := oscar.SessionFromContext(aliceCtx)
+
+	// bob's client says bob started typing to alice
+	snac := typingNotification("alice", TypingBegun)
+	to, notification, err := readTypingNotification(&snac.Data, "bob")
+	if err != nil {
+		t.Fatalf("could not read typing notification: %s", err)
+	}
+	if to != "alice" {
+		t.Errorf("expected the notification to be for alice, got %s", to)
+	}
+
+	notificationFlap := oscar.NewFLAP(2)
+	notificationFlap.Data.WriteBinary(notification)
+	if err := aliceSession.Send(notificationFlap); err != nil {
+		t.Fatalf("could not send notification: %s", err)
+	}
+
+	// alice's client hears that bob started typing
+	received := expectSNAC(t, aliceSNACs, 0x4, 0x14)
+	expected := typingNotification("bob", TypingBegun).Data.Bytes()
+	if !bytes.Equal(received.Data.Bytes(), expected) {
+		t.Errorf("expected relayed notification %v, got %v", expected, received.Data.Bytes())
+	}
+}
+
+func TestTypingNotificationOffline(t *testing.T) {
+	bobCtx, bobSNACs := fakeClient(t, "bob")
+	icbm := &ICBM{Sessions: fakeSessionManager{}}
+
+	// alice isn't signed on so the notification is dropped
+	if _, err := icbm.HandleSNAC(bobCtx, nil, typingNotification("alice", TypingTyped)); err != nil {
+		t.Fatalf("expected notification to an offline user to be dropped, got %s", err)
+	}
+	expectNoSNAC(t, bobSNACs)
+}
+
+func TestTypingNotificationTruncated(t *testing.T) {
+	snac := oscar.NewSNAC(0x4, 0x14)
+	snac.Data.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 1})
+
+	if _, _, err := readTypingNotification(&snac.Data, "bob"); err == nil {
+		t.Errorf("expected an error reading a notification without a screen name")
+	}
+}
+
+func TestWarnIncrease(t *testing.T) {
+	tt := map[string]struct {
+		warnerLevel uint16
+		anonymous   bool
+		expected    uint16
+	}{
+		"unwarned":           {0, false, WarnIncrease},
+		"unwarned anonymous": {0, true, WarnIncreaseAnonymous},
+		"half warned":        {500, false, 50},
+		"fully warned":       {999, false, 0},
+		"over the limit":     {2000, false, 0},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if increase := warnIncrease(tc.warnerLevel, tc.anonymous); increase != tc.expected {
+				t.Errorf("expected increase of %d, got %d", tc.expected, increase)
+			}
+		})
+	}
+}
+
+func TestWarnOnlyRecentSenders(t *testing.T) {
+	aliceCtx, aliceSNACs := fakeClient(t, "alice")
+	bobCtx, _ := fakeClient(t, "bob")
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	icbm := &ICBM{Sessions: fakeSessionManager{"bob": bobSession}}
+
+	warn := func(screenName string) *oscar.SNAC {
+		snac := oscar.NewSNAC(0x4, 0x08)
+		snac.Data.WriteUint16(0)
+		snac.Data.WriteLPString(screenName)
+		return snac
+	}
+
+	// Users can't warn themselves
+	if _, err := icbm.HandleSNAC(aliceCtx, nil, warn("Alice")); err != nil {
+		t.Fatalf("could not warn: %s", err)
+	}
+	if code, _ := expectSNAC(t, aliceSNACs, 0x4, 0x01).Data.ReadUint16(); code != 0x0d {
+		t.Errorf("expected error 0x0d for a self warning, got 0x%02x", code)
+	}
+
+	// bob hasn't messaged alice
+	if _, err := icbm.HandleSNAC(aliceCtx, nil, warn("bob")); err != nil {
+		t.Fatalf("could not warn: %s", err)
+	}
+	if code, _ := expectSNAC(t, aliceSNACs, 0x4, 0x01).Data.ReadUint16(); code != 0x0d {
+		t.Errorf("expected error 0x0d for warning someone who didn't message, got 0x%02x", code)
+	}
+
+	icbm.messageReceived("alice", "Bob")
+	if !icbm.receivedRecently("Alice", "bob") {
+		t.Errorf("expected alice to have received a message from bob recently")
+	}
+	if icbm.receivedRecently("bob", "alice") {
+		t.Errorf("expected bob not to have received a message from alice")
+	}
+}
+
+func TestICBMAck(t *testing.T) {
+	ack := icbmAck(42, 0x0102030405060708, 1, "bob")
+	if ack.Header.Family != 0x4 || ack.Header.Subtype != 0x0c {
+		t.Fatalf("expected SNAC(0x04, 0x0c), got %s", ack)
+	}
+	if ack.Header.RequestID != 42 {
+		t.Errorf("expected the ack to have the request's ID, got %d", ack.Header.RequestID)
+	}
+
+	expected := oscar.Buffer{}
+	expected.WriteUint64(0x0102030405060708)
+	expected.WriteUint16(1)
+	expected.WriteLPString("bob")
+	if !bytes.Equal(ack.Data.Bytes(), expected.Bytes()) {
+		t.Errorf("expected ack %v, got %v", expected.Bytes(), ack.Data.Bytes())
+	}
+}
+
+// Messages on a channel the server doesn't carry are answered with an error instead of dropped
+func TestMessageUnsupportedChannel(t *testing.T) {
+	ctx, _ := fakeClient(t, "alice")
+	snac := oscar.NewSNAC(0x4, 0x06)
+	snac.Data.WriteUint64(1) // cookie
+	snac.Data.WriteUint16(3) // channel
+	snac.Data.WriteLPString("bob")
+
+	_, err := (&ICBM{}).HandleSNAC(ctx, nil, snac)
+	if aimerror.Code(err) != aimerror.CodeNotSupportedByHost {
+		t.Errorf("expected a not supported error, got %v", err)
+	}
+}
+
+// rendezvous is the rendezvous data of a file transfer offer from 10.0.0.1:5190
+func rendezvous(messageType uint16) []byte {
+	buf := oscar.Buffer{}
+	buf.WriteUint16(messageType)
+	buf.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8}) // cookie
+	buf.Write([]byte{0x09, 0x46, 0x13, 0x43, 0x4c, 0x7f, 0x11, 0xd1, 0x82, 0x22, 0x44, 0x45, 0x53, 0x54, 0x00, 0x00})
+	buf.WriteBinary(oscar.NewTLV(0x0a, []byte{0, 1}))        // request sequence
+	buf.WriteBinary(oscar.NewTLV(0x03, []byte{10, 0, 0, 1})) // proposer's internal IP
+	buf.WriteBinary(oscar.NewTLV(0x05, []byte{0x14, 0x46}))  // port
+	return buf.Bytes()
+}
+
+func rendezvousMessage(to string, data []byte) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x4, 0x06)
+	snac.Data.WriteUint64(1) // cookie
+	snac.Data.WriteUint16(2) // channel
+	snac.Data.WriteLPString(to)
+	snac.WriteTLV(oscar.NewTLV(0x05, data))
+	return snac
+}
+
+func TestReadRendezvous(t *testing.T) {
+	tt := map[string]struct {
+		data  []byte
+		valid bool
+	}{
+		"propose":               {rendezvous(RendezvousPropose), true},
+		"cancel":                {rendezvous(RendezvousCancel), true},
+		"accept":                {rendezvous(RendezvousAccept), true},
+		"unknown type":          {rendezvous(0x0003), false},
+		"no capability":         {rendezvous(RendezvousPropose)[:20], false},
+		"truncated TLV":         {rendezvous(RendezvousPropose)[:29], false},
+		"without TLVs":          {rendezvous(RendezvousCancel)[:26], true},
+		"empty":                 {[]byte{}, false},
+		"just the message type": {[]byte{0, 0}, false},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readRendezvous(tc.data); (err == nil) != tc.valid {
+				t.Errorf("expected valid to be %v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+// readRelayedRendezvous reads who a relayed rendezvous message (0x04,0x07) is from, the TLVs of
+// their user info block and the rendezvous data (TLV 0x05) passed on
+func readRelayedRendezvous(t *testing.T, snac *oscar.SNAC) (string, oscar.TLVList, []byte) {
+	t.Helper()
+	snac.Data.ReadUint64() // cookie
+	if channel, _ := snac.Data.ReadUint16(); channel != 2 {
+		t.Errorf("expected the rendezvous on channel 2, got %d", channel)
+	}
+	from, _ := snac.Data.ReadLPString()
+
+	snac.Data.ReadUint16() // warning level
+	count, _ := snac.Data.ReadUint16()
+	info, err := snac.Data.ReadTLVs(int(count))
+	if err != nil {
+		t.Fatalf("could not read user info: %s", err)
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read rendezvous TLV: %s", err)
+	}
+	tlv, ok := tlvs.Get(0x05)
+	if !ok {
+		t.Fatalf("expected the rendezvous data in TLV 0x05")
+	}
+	return from, info, tlv.Data
+}
+
+func TestRendezvousSNAC(t *testing.T) {
+	data := rendezvous(RendezvousPropose)
+	aliceCtx, _ := fakeClient(t, "alice")
+	session, _ := oscar.SessionFromContext(aliceCtx)
+	signonAt := time.Now().Add(-time.Hour)
+	session.SetSignonAt(signonAt)
+	snac := rendezvousSNAC(&models.User{ScreenName: "alice"}, session, 1, oscar.NewTLV(0x05, data))
+
+	from, info, relayed := readRelayedRendezvous(t, snac)
+	if from != "alice" {
+		t.Errorf("expected the rendezvous to come from alice, got %s", from)
+	}
+	// The sender's user info is the same block buddies see
+	if tlv := oscar.FindTLV(info, 0x03); tlv == nil || !bytes.Equal(tlv.Data, util.Dword(uint32(signonAt.Unix()))) {
+		t.Errorf("expected alice's signon time in her user info, got %v", tlv)
+	}
+	if !bytes.Equal(relayed, data) {
+		t.Errorf("expected the rendezvous data to be passed on as it is")
+	}
+}
+
+func TestRendezvousInvalid(t *testing.T) {
+	bobCtx, bobSNACs := fakeClient(t, "bob")
+	icbm := &ICBM{Sessions: fakeSessionManager{}}
+
+	if _, err := icbm.HandleSNAC(bobCtx, nil, rendezvousMessage("alice", []byte{0, 0, 1})); err != nil {
+		t.Fatalf("expected an invalid rendezvous to be refused, got %s", err)
+	}
+	if code, _ := expectSNAC(t, bobSNACs, 0x4, 0x01).Data.ReadUint16(); code != 0x0e {
+		t.Errorf("expected error 0x0e, got 0x%02x", code)
+	}
+}
+
+func icbmParams(c *channel) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x4, 0x02)
+	snac.Data.WriteUint16(c.MaxSlots)
+	snac.Data.WriteUint32(c.MessageFlags)
+	snac.Data.WriteUint16(c.MaxMessageSnacSize)
+	snac.Data.WriteUint16(c.MaxSenderWarningLevel)
+	snac.Data.WriteUint16(c.MaxReceiverWarningLevel)
+	snac.Data.WriteUint32(c.MinimumMessageInterval)
+	return snac
+}
+
+func TestICBMParamsClamp(t *testing.T) {
+	tt := map[string]struct {
+		set      channel
+		expected channel
+	}{
+		"in range":  {channel{0, 0x0b, 1000, 500, 500, 1000}, channel{0, 0x0b, 1000, 500, 500, 1000}},
+		"too small": {channel{0, 0x0b, 0, 0, 0, 0}, channel{0, 0x0b, ICBMMinMessageSize, 0, 0, 0}},
+		"too large": {channel{0, 0x0b, 0xffff, 0xffff, 0xffff, 0xffffffff}, channel{0, 0x0b, ICBMMaxMessageSize, 999, 999, ICBMMaxMessageInterval}},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			c := tc.set
+			c.clamp()
+			if c != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, c)
+			}
+		})
+	}
+}
+
+func TestICBMParamsSetAndGet(t *testing.T) {
+	aliceCtx, aliceSNACs := fakeClient(t, "alice")
+	icbm := &ICBM{Sessions: fakeSessionManager{}}
+
+	get := func(ctx context.Context) *channel {
+		t.Helper()
+		if _, err := icbm.HandleSNAC(ctx, nil, oscar.NewSNAC(0x4, 0x04)); err != nil {
+			t.Fatalf("could not get ICBM params: %s", err)
+		}
+		reply := expectSNAC(t, aliceSNACs, 0x4, 0x05)
+		c := &channel{}
+		if err := binary.Read(bytes.NewReader(reply.Data.Bytes()), binary.BigEndian, c); err != nil {
+			t.Fatalf("could not read ICBM params: %s", err)
+		}
+		return c
+	}
+
+	if c := get(aliceCtx); *c != *defaultChannel() {
+		t.Errorf("expected the default params before any are set, got %+v", c)
+	}
+
+	ctx, err := icbm.HandleSNAC(aliceCtx, nil, icbmParams(&channel{0, 0x0b, 0xffff, 500, 500, 1000}))
+	if err != nil {
+		t.Fatalf("could not set ICBM params: %s", err)
+	}
+	expectNoSNAC(t, aliceSNACs)
+
+	if c := get(ctx); *c != (channel{0, 0x0b, ICBMMaxMessageSize, 500, 500, 1000}) {
+		t.Errorf("expected the params that were set, clamped, got %+v", c)
+	}
+
+	// Messages longer than the max message size are refused
+	ctx, _ = icbm.HandleSNAC(ctx, nil, icbmParams(&channel{0, 0x0b, ICBMMinMessageSize, 500, 500, 0}))
+	longMessage := func() *oscar.SNAC {
+		snac := oscar.NewSNAC(0x4, 0x06)
+		snac.Header.RequestID = 42
+		snac.Data.WriteUint64(1)
+		snac.Data.WriteUint16(1)
+		snac.Data.WriteLPString("bob")
+		text := bytes.Repeat([]byte("a"), ICBMMinMessageSize+1)
+		fragments := oscar.Buffer{}
+		fragments.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x01})
+		fragments.Write([]byte{0x01, 0x01})
+		fragments.WriteUint16(uint16(4 + len(text)))
+		fragments.WriteUint32(0)
+		fragments.Write(text)
+		snac.WriteTLV(oscar.NewTLV(0x02, fragments.Bytes()))
+		return snac
+	}
+
+	expectTooLarge := func() {
+		t.Helper()
+		reply := expectSNAC(t, aliceSNACs, 0x4, 0x01)
+		if code, _ := reply.Data.ReadUint16(); code != aimerror.CodeMessageTooLarge || reply.Header.RequestID != 42 {
+			t.Errorf("expected error 0x0a for request 42, got 0x%02x for %d", code, reply.Header.RequestID)
+		}
+	}
+
+	if _, err := icbm.HandleSNAC(ctx, nil, longMessage()); err != nil {
+		t.Fatalf("expected a long message to be refused, got %s", err)
+	}
+	expectTooLarge()
+
+	// The server's own limit wins over the client's, and is what the client is told
+	icbm.MaxMessageSize = 256
+	ctx, _ = icbm.HandleSNAC(ctx, nil, icbmParams(&channel{0, 0x0b, ICBMMaxMessageSize, 500, 500, 0}))
+	if c := get(ctx); c.MaxMessageSnacSize != 256 {
+		t.Errorf("expected the server's max message size, got %d", c.MaxMessageSnacSize)
+	}
+	if _, err := icbm.HandleSNAC(ctx, nil, longMessage()); err != nil {
+		t.Fatalf("expected a long message to be refused, got %s", err)
+	}
+	expectTooLarge()
+}
+
+func TestSentTooSoon(t *testing.T) {
+	icbm := &ICBM{}
+
+	if icbm.sentTooSoon("alice", 0) || icbm.sentTooSoon("alice", 0) {
+		t.Errorf("expected no limit without an interval")
+	}
+
+	if icbm.sentTooSoon("alice", time.Hour) {
+		t.Errorf("expected the first message to be sent")
+	}
+	if !icbm.sentTooSoon("Alice", time.Hour) {
+		t.Errorf("expected a second message within the interval to be refused")
+	}
+	if icbm.sentTooSoon("bob", time.Hour) {
+		t.Errorf("expected other users not to be held to alice's interval")
+	}
+
+	if icbm.sentTooSoon("carol", time.Millisecond) {
+		t.Errorf("expected the first message to be sent")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if icbm.sentTooSoon("carol", time.Millisecond) {
+		t.Errorf("expected a message after the interval to be sent")
+	}
+}
+
+// expectRecipientError is the error telling the sender that their message to the screen name
+// couldn't be sent
+func expectRecipientError(t *testing.T, snacs chan *oscar.SNAC, requestID uint32, code uint16, to string) {
+	t.Helper()
+	errSnac := expectSNAC(t, snacs, 0x4, 0x01)
+	if errSnac.Header.RequestID != requestID {
+		t.Errorf("expected the error to have the request's ID %d, got %d", requestID, errSnac.Header.RequestID)
+	}
+	if got, _ := errSnac.Data.ReadUint16(); got != code {
+		t.Errorf("expected error 0x%02x, got 0x%02x", code, got)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(errSnac.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read error TLVs: %s", err)
+	}
+	if screenName := oscar.FindTLV(tlvs, 0x01); screenName == nil || string(screenName.Data) != to {
+		t.Errorf("expected the error to name %s, got %v", to, screenName)
+	}
+}
+
+func TestICBMRecipientError(t *testing.T) {
+	flap := ICBMRecipientError(42, aimerror.CodeRecipientNotLoggedIn, "Bob")
+	snac := &oscar.SNAC{}
+	if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
+		t.Fatalf("could not read SNAC: %s", err)
+	}
+
+	snacs := make(chan *oscar.SNAC, 1)
+	snacs <- snac
+	expectRecipientError(t, snacs, 42, 0x04, "Bob")
+}
+
+// icqMessage is a channel 4 message of the ICQ message type from the UIN
+func icqMessage(to string, from uint32, icqType uint8, text string) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x4, 0x06)
+	snac.Data.WriteUint64(1) // cookie
+	snac.Data.WriteUint16(4) // channel
+	snac.Data.WriteLPString(to)
+	snac.WriteTLV(ICQMessage(from, icqType, text))
+	return snac
+}
+
+func TestICQMessage(t *testing.T) {
+	tlv := ICQMessage(123456, 0x04, "Homepage\u00fehttp://example.com")
+	if tlv.Type != 0x05 {
+		t.Errorf("expected TLV 0x05, got 0x%02x", tlv.Type)
+	}
+
+	expected := []byte{0x40, 0xe2, 0x01, 0x00, 0x04, 0x00, 0x1c, 0x00}
+	expected = append(expected, "Homepage\xfehttp://example.com\x00"...)
+	if !bytes.Equal(tlv.Data, expected) {
+		t.Errorf("expected %v, got %v", expected, tlv.Data)
+	}
+
+	icqType, text, err := ReadICQMessage(tlv.Data)
+	if err != nil || icqType != 0x04 || string(text) != "Homepage\xfehttp://example.com" {
+		t.Errorf("expected the URL message back, got 0x%02x %q %v", icqType, text, err)
+	}
+
+	if _, _, err := ReadICQMessage(tlv.Data[:5]); err == nil {
+		t.Errorf("expected an error reading a truncated message")
+	}
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// InvitationService sends friends an email from a user inviting them to sign up
+type InvitationService struct {
+	Mailer Mailer
+
+	// MaxPerDay is how many invitations a user can send in a day. 0 doesn't limit them.
+	MaxPerDay int
+}
+
+// invitationError is the error reply to an invitation request
+func invitationError(request *oscar.SNAC, code uint16) *oscar.FLAP {
+	errFlap := oscar.NewFLAP(2)
+	errFlap.Data.WriteBinary(oscar.NewSNACError(0x06, request.Header.RequestID, code))
+	return errFlap
+}
+
+func (i *InvitationService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "invitation")
+
+	switch snac.Header.Subtype {
+
+	// Client invites a friend with their email (TLV 0x11) and a message (TLV 0x15)
+	case 0x02:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read invitation TLVs")
+		}
+		email, message := "", ""
+		if emailTLV, ok := tlvs.Get(0x11); ok {
+			email = emailTLV.String()
+		}
+		if messageTLV, ok := tlvs.Get(0x15); ok {
+			message = messageTLV.String()
+		}
+
+		if !validEmail(email) {
+			logger.Debug("invitation to an invalid email", "email", email)
+			return ctx, session.Send(invitationError(snac, aimerror.CodeIncorrectSNACFormat))
+		}
+
+		if i.MaxPerDay > 0 {
+			sent, err := models.InvitationsSince(ctx, db, user.UIN, time.Now().Add(-24*time.Hour))
+			if err != nil {
+				return ctx, err
+			}
+			if sent >= i.MaxPerDay {
+				logger.Info("too many invitations", "screen_name", user.ScreenName, "sent", sent)
+				return ctx, session.Send(invitationError(snac, aimerror.CodeLimitExceeded))
+			}
+		}
+
+		if _, err := models.CreateInvitation(ctx, db, user, email, message); err != nil {
+			return ctx, err
+		}
+		if i.Mailer != nil {
+			if err := i.Mailer.SendInvitation(ctx, user, email, message); err != nil {
+				return ctx, errors.Wrap(err, "could not send invitation email")
+			}
+		}
+		logger.Info("Invited a friend", "screen_name", user.ScreenName)
+
+		ackFlap := oscar.NewFLAP(2)
+		ackFlap.Data.WriteBinary(oscar.NewReplySNAC(snac, 0x06, 0x03))
+		return ctx, session.Send(ackFlap)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown invitation family/subtype: 0x06, 0x%02x", snac.Header.Subtype))
+	return ctx, aimerror.NotSupported
+}
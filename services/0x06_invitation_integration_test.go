@@ -0,0 +1,57 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"context"
+	"testing"
+)
+
+// Invitations are recorded and emailed until the user has sent their day's worth
+func TestInvitationSentAndLimited(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.Invitation)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+	alice := testUser(t, d, "alice")
+	defer d.NewDelete().Model((*models.Invitation)(nil)).Where("inviter_uin = ?", alice.UIN).Exec(ctx)
+
+	aliceCtx, snacs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	mailer := &fakeMailer{}
+	i := &InvitationService{Mailer: mailer, MaxPerDay: 2}
+
+	for _, email := range []string{"one@example.com", "two@example.com"} {
+		request := invitation(email, "join me")
+		request.Header.RequestID = 9
+		if _, err := i.HandleSNAC(aliceCtx, d, request); err != nil {
+			t.Fatalf("could not invite %s: %s", email, err)
+		}
+		if ack := expectSNAC(t, snacs, 0x06, 0x03); ack.Header.RequestID != 9 {
+			t.Errorf("expected the ack to have the request's ID, got %d", ack.Header.RequestID)
+		}
+	}
+
+	if _, err := i.HandleSNAC(aliceCtx, d, invitation("three@example.com", "join me")); err != nil {
+		t.Fatalf("could not invite: %s", err)
+	}
+	if code, _ := expectSNAC(t, snacs, 0x06, 0x01).Data.ReadUint16(); code != aimerror.CodeLimitExceeded {
+		t.Errorf("expected the third invitation to be over the limit, got 0x%02x", code)
+	}
+
+	if len(mailer.invitations) != 2 || mailer.invitations[0] != "one@example.com" || mailer.invitations[1] != "two@example.com" {
+		t.Errorf("expected the first two invitations to be emailed, got %v", mailer.invitations)
+	}
+	var invitations []*models.Invitation
+	if err := d.NewSelect().Model(&invitations).Where("inviter_uin = ?", alice.UIN).Scan(ctx); err != nil {
+		t.Fatalf("could not fetch invitations: %s", err)
+	}
+	if len(invitations) != 2 || invitations[0].Message != "join me" {
+		t.Errorf("expected 2 invitations recorded, got %d", len(invitations))
+	}
+}
@@ -0,0 +1,28 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/oscar"
+	"testing"
+)
+
+func invitation(email, message string) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x06, 0x02)
+	snac.WriteTLV(oscar.NewTLVString(0x11, email))
+	snac.WriteTLV(oscar.NewTLVString(0x15, message))
+	return snac
+}
+
+// Invitations to something that isn't an email address are refused before anything is recorded
+func TestInvitationInvalidEmail(t *testing.T) {
+	for _, email := range []string{"", "friend", "Friend <friend@example.com>"} {
+		ctx, snacs := fakeClient(t, "alice")
+		i := &InvitationService{MaxPerDay: 5}
+		if _, err := i.HandleSNAC(ctx, nil, invitation(email, "join me")); err != nil {
+			t.Fatalf("could not invite %q: %s", email, err)
+		}
+		if code, _ := expectSNAC(t, snacs, 0x06, 0x01).Data.ReadUint16(); code != aimerror.CodeIncorrectSNACFormat {
+			t.Errorf("expected %q to be refused as malformed, got 0x%02x", email, code)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// Error codes in TLV 0x08 of an info change reply
+const (
+	AdminErrorFormatScreenName = 0x01 // new formatting isn't of the user's screen name
+	AdminErrorValidatePassword = 0x02 // old password is wrong
+	AdminErrorInvalidPassword  = 0x07 // new password breaks the password rules
+	AdminErrorInvalidEmail     = 0x08 // not an email address, or another account has it
+)
+
+// Statuses of an account confirmation reply
+const (
+	AdminConfirmSent             = 0x00
+	AdminConfirmAlreadyConfirmed = 0x1e
+	AdminConfirmNotSent          = 0x23
+)
+
+// AdminPermissions is sent with every info change reply
+const AdminPermissions = 0x0003
+
+type AdministrationService struct {
+	OnlineCh chan *PresenceEvent
+	Mailer   Mailer
+}
+
+// infoChangeReply is the 0x07,0x05 reply to an info change. The error code is left out when
+// it is 0.
+func infoChangeReply(request *oscar.SNAC, tlvs []*oscar.TLV, code uint16) *oscar.SNAC {
+	if code != 0 {
+		tlvs = append(tlvs,
+			oscar.NewTLV(0x04, []byte(fmt.Sprintf("http://runningman.network/errors/admin/%d", code))),
+			oscar.NewTLV(0x08, util.Word(code)),
+		)
+	}
+
+	snac := oscar.NewReplySNAC(request, 0x07, 0x05)
+	snac.Data.WriteUint16(AdminPermissions)
+	snac.Data.WriteUint16(uint16(len(tlvs)))
+	for _, tlv := range tlvs {
+		snac.Data.WriteBinary(tlv)
+	}
+	return snac
+}
+
+// accountInfo is the value of the account info TLV type, nil for types that aren't supported
+func accountInfo(user *models.User, tlvType uint16) *oscar.TLV {
+	switch tlvType {
+	case 0x01:
+		return oscar.NewTLV(0x01, []byte(user.ScreenName))
+	case 0x11:
+		return oscar.NewTLV(0x11, []byte(user.Email))
+	}
+	return nil
+}
+
+// formatScreenName changes how the user's screen name is formatted. Returns the error code, 0
+// if the formatting was changed.
+func (a *AdministrationService) formatScreenName(ctx context.Context, db *bun.DB, user *models.User, formatted string) (uint16, error) {
+	if util.NormalizeScreenName(formatted) != user.NormalizedScreenName || !validScreenName(formatted) {
+		return AdminErrorFormatScreenName, nil
+	}
+
+	if err := user.FormatScreenName(ctx, db, formatted); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// changePassword changes the user's password if they know their old one. Returns the error
+// code, 0 if the password was changed.
+func (a *AdministrationService) changePassword(ctx context.Context, db *bun.DB, user *models.User, oldPassword, newPassword string) (uint16, error) {
+	if subtle.ConstantTimeCompare([]byte(oldPassword), []byte(user.Password)) != 1 {
+		return AdminErrorValidatePassword, nil
+	}
+
+	if !validPassword(newPassword) {
+		return AdminErrorInvalidPassword, nil
+	}
+
+	user.Password = newPassword
+	if err := user.Update(ctx, db, "password"); err != nil {
+		return 0, errors.Wrap(err, "could not change password")
+	}
+
+	// No cookie handed out with the old password can be used to sign on
+	if err := models.DeleteAuthCookies(ctx, db, user.UIN); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// changeEmail changes the user's email, which then needs confirming. Returns the error code, 0
+// if the email was changed.
+func (a *AdministrationService) changeEmail(ctx context.Context, db *bun.DB, user *models.User, email string) (uint16, error) {
+	if !validEmail(email) {
+		return AdminErrorInvalidEmail, nil
+	}
+
+	if !strings.EqualFold(email, user.Email) {
+		taken, err := models.EmailTaken(ctx, db, email)
+		if err != nil {
+			return 0, err
+		}
+		if taken {
+			return AdminErrorInvalidEmail, nil
+		}
+	}
+
+	user.Email = email
+	user.Unconfirmed = true
+	if err := user.Update(ctx, db, "email", "unconfirmed"); err != nil {
+		return 0, errors.Wrap(err, "could not change email")
+	}
+	return 0, nil
+}
+
+// confirm confirms the user's account and returns the confirmation status
+func (a *AdministrationService) confirm(ctx context.Context, db *bun.DB, user *models.User) (uint16, error) {
+	if !user.Unconfirmed {
+		return AdminConfirmAlreadyConfirmed, nil
+	}
+
+	status := uint16(AdminConfirmNotSent)
+	if a.Mailer != nil {
+		if err := a.Mailer.SendConfirmation(ctx, user); err != nil {
+			return 0, errors.Wrap(err, "could not send confirmation email")
+		}
+		status = AdminConfirmSent
+	}
+
+	user.Unconfirmed = false
+	if err := user.Update(ctx, db, "unconfirmed"); err != nil {
+		return 0, errors.Wrap(err, "could not confirm account")
+	}
+	return status, nil
+}
+
+func (a *AdministrationService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "administration")
+
+	switch snac.Header.Subtype {
+
+	// Client wants their account info, e.g. their email
+	case 0x02:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read info request TLVs")
+		}
+
+		infoTLVs := make([]*oscar.TLV, 0, len(tlvs))
+		for _, tlv := range tlvs {
+			if info := accountInfo(user, tlv.Type); info != nil {
+				infoTLVs = append(infoTLVs, info)
+			}
+		}
+
+		infoSnac := oscar.NewReplySNAC(snac, 0x07, 0x03)
+		infoSnac.Data.WriteUint16(AdminPermissions)
+		infoSnac.Data.WriteUint16(uint16(len(infoTLVs)))
+		for _, tlv := range infoTLVs {
+			infoSnac.Data.WriteBinary(tlv)
+		}
+		infoFlap := oscar.NewFLAP(2)
+		infoFlap.Data.WriteBinary(infoSnac)
+		return ctx, session.Send(infoFlap)
+
+	// Client changes their account info
+	case 0x04:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read info change TLVs")
+		}
+
+		screenNameTLV := oscar.FindTLV(tlvs, 0x01)
+		newPasswordTLV := oscar.FindTLV(tlvs, 0x02)
+		oldPasswordTLV := oscar.FindTLV(tlvs, 0x12)
+		emailTLV := oscar.FindTLV(tlvs, 0x11)
+
+		var code uint16
+		var changed *oscar.TLV
+		switch {
+		case screenNameTLV != nil:
+			code, err = a.formatScreenName(ctx, db, user, string(screenNameTLV.Data))
+			changed = oscar.NewTLV(0x01, []byte(user.ScreenName))
+			if code == 0 && err == nil {
+				session.SetScreenName(user.ScreenName)
+				logger.Info("Formatted screen name", "screen_name", user.ScreenName)
+			}
+
+		case newPasswordTLV != nil && oldPasswordTLV != nil:
+			code, err = a.changePassword(ctx, db, user, string(oldPasswordTLV.Data), string(newPasswordTLV.Data))
+			changed = oscar.NewTLV(0x02, []byte{})
+			if code == 0 && err == nil {
+				logger.Info("Changed password", "screen_name", user.ScreenName)
+			}
+
+		case emailTLV != nil:
+			code, err = a.changeEmail(ctx, db, user, string(emailTLV.Data))
+			changed = oscar.NewTLV(0x11, emailTLV.Data)
+			if code == 0 && err == nil {
+				logger.Info("Changed email", "screen_name", user.ScreenName)
+			}
+
+		default:
+			logger.Warn("unsupported info change", "tlvs", tlvs)
+			return ctx, nil
+		}
+		if err != nil {
+			return ctx, err
+		}
+
+		replyFlap := oscar.NewFLAP(2)
+		replyFlap.Data.WriteBinary(infoChangeReply(snac, []*oscar.TLV{changed}, code))
+		if err := session.Send(replyFlap); err != nil {
+			return ctx, err
+		}
+
+		// The user and their buddies see the new formatting straight away
+		if screenNameTLV != nil && code == 0 {
+			selfInfoSnac := oscar.NewSNAC(0x01, 0x0f)
+			writeSelfInfo(ctx, selfInfoSnac, user, session)
+			selfInfoFlap := oscar.NewFLAP(2)
+			selfInfoFlap.Data.WriteBinary(selfInfoSnac)
+			if err := session.Send(selfInfoFlap); err != nil {
+				return ctx, err
+			}
+			if a.OnlineCh != nil {
+				a.OnlineCh <- InfoChanged(user)
+			}
+		}
+		return models.NewContextWithUser(ctx, user), nil
+
+	// Client wants to confirm their account
+	case 0x06:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		status, err := a.confirm(ctx, db, user)
+		if err != nil {
+			return ctx, err
+		}
+
+		confirmSnac := oscar.NewReplySNAC(snac, 0x07, 0x07)
+		confirmSnac.Data.WriteUint16(status)
+		confirmFlap := oscar.NewFLAP(2)
+		confirmFlap.Data.WriteBinary(confirmSnac)
+		return models.NewContextWithUser(ctx, user), session.Send(confirmFlap)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown administration family/subtype: 0x07, 0x%02x", snac.Header.Subtype))
+
+	return ctx, aimerror.NotSupported
+}
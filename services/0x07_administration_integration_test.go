@@ -0,0 +1,175 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestPasswordChangeInvalidatesCookies(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	alice := testUser(t, d, "alice")
+
+	// A cookie handed out by the login server that hasn't been used yet
+	cookie, err := authorize(ctx, d, alice)
+	if err != nil {
+		t.Fatalf("could not authorize: %s", err)
+	}
+	cookieFlap := oscar.NewFLAP(1)
+	cookieFlap.Data.WriteUint32(1)
+	cookieFlap.Data.WriteBinary(oscar.NewTLV(0x06, cookie))
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	admin := &AdministrationService{}
+	if _, err := admin.HandleSNAC(aliceCtx, d, passwordChange("password", "newpassword")); err != nil {
+		t.Fatalf("could not change password: %s", err)
+	}
+	expectSNAC(t, aliceSNACs, 0x07, 0x05)
+
+	user, err := models.UserByUIN(ctx, d, alice.UIN)
+	if err != nil {
+		t.Fatalf("could not fetch user: %s", err)
+	}
+	if user.Password != "newpassword" {
+		t.Errorf("expected the new password to be saved, got %s", user.Password)
+	}
+
+	if _, _, err := AuthenticateFLAPCookie(ctx, d, cookieFlap); err == nil {
+		t.Errorf("expected the cookie to be rejected after the password change")
+	}
+}
+
+type fakeMailer struct {
+	sent        []*models.User
+	invitations []string
+}
+
+func (m *fakeMailer) SendConfirmation(ctx context.Context, user *models.User) error {
+	m.sent = append(m.sent, user)
+	return nil
+}
+
+func (m *fakeMailer) SendInvitation(ctx context.Context, inviter *models.User, email, message string) error {
+	m.invitations = append(m.invitations, email)
+	return nil
+}
+
+func TestEmailChangeAndConfirm(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	mailer := &fakeMailer{}
+	admin := &AdministrationService{Mailer: mailer}
+
+	change := oscar.NewSNAC(0x07, 0x04)
+	change.WriteTLV(oscar.NewTLV(0x11, []byte("new"+alice.Email)))
+	if _, err := admin.HandleSNAC(aliceCtx, d, change); err != nil {
+		t.Fatalf("could not change email: %s", err)
+	}
+	expectSNAC(t, aliceSNACs, 0x07, 0x05)
+
+	if !alice.Unconfirmed {
+		t.Errorf("expected a changed email to need confirming")
+	}
+
+	if _, err := admin.HandleSNAC(aliceCtx, d, oscar.NewSNAC(0x07, 0x06)); err != nil {
+		t.Fatalf("could not confirm: %s", err)
+	}
+	if status, _ := expectSNAC(t, aliceSNACs, 0x07, 0x07).Data.ReadUint16(); status != AdminConfirmSent {
+		t.Errorf("expected the confirmation email to be sent, got 0x%02x", status)
+	}
+	if len(mailer.sent) != 1 {
+		t.Errorf("expected 1 confirmation email, got %d", len(mailer.sent))
+	}
+
+	user, err := models.UserByUIN(context.Background(), d, alice.UIN)
+	if err != nil {
+		t.Fatalf("could not fetch user: %s", err)
+	}
+	if user.Email != "new"+alice.Email || user.Unconfirmed {
+		t.Errorf("expected a confirmed account with the new email, got %s unconfirmed=%v", user.Email, user.Unconfirmed)
+	}
+}
+
+func TestFormatScreenName(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	alice := testUser(t, d, "alice")
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	onlineCh := make(chan *PresenceEvent, 1)
+	admin := &AdministrationService{OnlineCh: onlineCh}
+
+	formatted := "Ali Ce" + alice.ScreenName[len("alice"):]
+	format := oscar.NewSNAC(0x07, 0x04)
+	format.WriteTLV(oscar.NewTLV(0x01, []byte(formatted)))
+	if _, err := admin.HandleSNAC(aliceCtx, d, format); err != nil {
+		t.Fatalf("could not format screen name: %s", err)
+	}
+	reply := expectSNAC(t, aliceSNACs, 0x07, 0x05)
+	reply.Data.ReadUint16() // permissions
+	reply.Data.ReadUint16() // number of TLVs
+	tlvs, _ := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if oscar.FindTLV(tlvs, 0x08) != nil {
+		t.Fatalf("expected the formatting to be accepted, got %v", tlvs)
+	}
+
+	// The user's own info and their buddies get the new formatting
+	selfInfo := expectSNAC(t, aliceSNACs, 0x01, 0x0f)
+	if screenName, _ := selfInfo.Data.ReadLPString(); screenName != formatted {
+		t.Errorf("expected self info for %s, got %s", formatted, screenName)
+	}
+	select {
+	case event := <-onlineCh:
+		if event.Type != PresenceInfoChanged || event.User.ScreenName != formatted {
+			t.Errorf("expected buddies to hear about %s, got %+v", formatted, event)
+		}
+	default:
+		t.Errorf("expected buddies to be told about the new formatting")
+	}
+
+	// Lookups ignore the formatting, and find the user formatted the new way
+	user, err := models.UserByScreenName(ctx, d, alice.NormalizedScreenName)
+	if err != nil || user == nil {
+		t.Fatalf("could not fetch user: %v %s", user, err)
+	}
+	if user.ScreenName != formatted {
+		t.Errorf("expected screen name to be formatted as %s, got %s", formatted, user.ScreenName)
+	}
+
+	// Formatting can't rename the user
+	rename := oscar.NewSNAC(0x07, 0x04)
+	rename.WriteTLV(oscar.NewTLV(0x01, []byte("bob"+alice.ScreenName)))
+	if _, err := admin.HandleSNAC(aliceCtx, d, rename); err != nil {
+		t.Fatalf("could not format screen name: %s", err)
+	}
+	reply = expectSNAC(t, aliceSNACs, 0x07, 0x05)
+	reply.Data.ReadUint16()
+	reply.Data.ReadUint16()
+	tlvs, _ = oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if code := oscar.FindTLV(tlvs, 0x08); code == nil || !bytes.Equal(code.Data, util.Word(AdminErrorFormatScreenName)) {
+		t.Errorf("expected a renaming to be rejected, got %v", tlvs)
+	}
+	if alice.ScreenName != formatted {
+		t.Errorf("expected the screen name to keep its formatting, got %s", alice.ScreenName)
+	}
+	expectNoSNAC(t, aliceSNACs)
+	if len(onlineCh) != 0 {
+		t.Errorf("expected buddies not to hear about a rejected formatting")
+	}
+}
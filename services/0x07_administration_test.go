@@ -0,0 +1,120 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"testing"
+)
+
+func passwordChange(oldPassword, newPassword string) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x07, 0x04)
+	snac.WriteTLV(oscar.NewTLV(0x02, []byte(newPassword)))
+	snac.WriteTLV(oscar.NewTLV(0x12, []byte(oldPassword)))
+	return snac
+}
+
+func TestPasswordChangeErrors(t *testing.T) {
+	tt := map[string]struct {
+		oldPassword string
+		newPassword string
+		expected    uint16
+	}{
+		"wrong old password":     {"wrong", "newpassword", AdminErrorValidatePassword},
+		"new password too short": {"password", "pw", AdminErrorInvalidPassword},
+		"new password too long":  {"password", "thispasswordistoolong", AdminErrorInvalidPassword},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			ctx, snacs := fakeClient(t, "alice")
+			models.UserFromContext(ctx).Password = "password"
+
+			admin := &AdministrationService{}
+			if _, err := admin.HandleSNAC(ctx, nil, passwordChange(tc.oldPassword, tc.newPassword)); err != nil {
+				t.Fatalf("could not change password: %s", err)
+			}
+
+			reply := expectSNAC(t, snacs, 0x07, 0x05)
+			reply.Data.ReadUint16() // permissions
+			count, _ := reply.Data.ReadUint16()
+			tlvs, err := reply.Data.ReadTLVs(int(count))
+			if err != nil {
+				t.Fatalf("could not read reply TLVs: %s", err)
+			}
+
+			codeTLV := oscar.FindTLV(tlvs, 0x08)
+			if codeTLV == nil {
+				t.Fatalf("expected an error code in the reply")
+			}
+			if code := uint16(codeTLV.Data[0])<<8 | uint16(codeTLV.Data[1]); code != tc.expected {
+				t.Errorf("expected error code 0x%02x, got 0x%02x", tc.expected, code)
+			}
+
+			if password := models.UserFromContext(ctx).Password; password != "password" {
+				t.Errorf("expected the password not to change, got %s", password)
+			}
+		})
+	}
+}
+
+func TestAccountInfoQuery(t *testing.T) {
+	ctx, snacs := fakeClient(t, "alice")
+	models.UserFromContext(ctx).Email = "alice@example.com"
+
+	query := oscar.NewSNAC(0x07, 0x02)
+	query.WriteTLV(oscar.NewTLV(0x11, []byte{}))
+	query.WriteTLV(oscar.NewTLV(0x99, []byte{})) // unsupported
+
+	admin := &AdministrationService{}
+	if _, err := admin.HandleSNAC(ctx, nil, query); err != nil {
+		t.Fatalf("could not query account info: %s", err)
+	}
+
+	reply := expectSNAC(t, snacs, 0x07, 0x03)
+	reply.Data.ReadUint16() // permissions
+	count, _ := reply.Data.ReadUint16()
+	if count != 1 {
+		t.Fatalf("expected 1 TLV, got %d", count)
+	}
+	tlvs, err := reply.Data.ReadTLVs(int(count))
+	if err != nil {
+		t.Fatalf("could not read reply TLVs: %s", err)
+	}
+	if email := oscar.FindTLV(tlvs, 0x11); email == nil || string(email.Data) != "alice@example.com" {
+		t.Errorf("expected the email in the reply, got %v", tlvs)
+	}
+}
+
+func TestEmailChangeInvalid(t *testing.T) {
+	ctx, snacs := fakeClient(t, "alice")
+
+	change := oscar.NewSNAC(0x07, 0x04)
+	change.WriteTLV(oscar.NewTLV(0x11, []byte("not an email")))
+
+	admin := &AdministrationService{}
+	if _, err := admin.HandleSNAC(ctx, nil, change); err != nil {
+		t.Fatalf("could not change email: %s", err)
+	}
+
+	reply := expectSNAC(t, snacs, 0x07, 0x05)
+	reply.Data.ReadUint16() // permissions
+	count, _ := reply.Data.ReadUint16()
+	tlvs, _ := reply.Data.ReadTLVs(int(count))
+	if code := oscar.FindTLV(tlvs, 0x08); code == nil || code.Data[1] != AdminErrorInvalidEmail {
+		t.Errorf("expected an invalid email error, got %v", tlvs)
+	}
+}
+
+func TestConfirmAlreadyConfirmed(t *testing.T) {
+	ctx, snacs := fakeClient(t, "alice")
+
+	admin := &AdministrationService{}
+	if _, err := admin.HandleSNAC(ctx, nil, oscar.NewSNAC(0x07, 0x06)); err != nil {
+		t.Fatalf("could not confirm: %s", err)
+	}
+
+	reply := expectSNAC(t, snacs, 0x07, 0x07)
+	if status, _ := reply.Data.ReadUint16(); status != AdminConfirmAlreadyConfirmed {
+		t.Errorf("expected already confirmed, got 0x%02x", status)
+	}
+}
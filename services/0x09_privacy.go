@@ -0,0 +1,279 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// Most entries allowed on each of the permit and deny lists
+const (
+	MaxPermits = 200
+	MaxDenies  = 200
+)
+
+// PrivacyMode is who is allowed to see the user and message them. It's set by the client in the
+// permit/deny settings item (0xca TLV) of their SSI.
+type PrivacyMode uint8
+
+const (
+	PrivacyPermitAll     PrivacyMode = 0x01
+	PrivacyDenyAll       PrivacyMode = 0x02
+	PrivacyPermitSome    PrivacyMode = 0x03
+	PrivacyDenySome      PrivacyMode = 0x04
+	PrivacyPermitBuddies PrivacyMode = 0x05
+)
+
+type PrivacyService struct {
+	OnlineCh chan *PresenceEvent
+}
+
+// privacyMode is the user's privacy mode. Users who never set one get their deny list enforced.
+func privacyMode(ctx context.Context, db bun.IDB, uin int64) (PrivacyMode, error) {
+	items, err := models.FeedbagItemsByClass(ctx, db, uin, uint16(FeedbagItemTypePDSetting))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item := range items {
+		tlvs, err := oscar.UnmarshalTLVs(item.Attributes)
+		if err != nil {
+			continue
+		}
+		if modeTLV := oscar.FindTLV(tlvs, 0xca); modeTLV != nil && len(modeTLV.Data) == 1 {
+			return PrivacyMode(modeTLV.Data[0]), nil
+		}
+	}
+
+	return PrivacyDenySome, nil
+}
+
+// hasItem is true if one of the items is for screenName
+func hasItem(items []*models.Feedbag, screenName string) bool {
+	for _, item := range items {
+		if util.NormalizeScreenName(item.Name) == util.NormalizeScreenName(screenName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Privacy is a user's privacy mode and who is on the list the mode goes by
+type Privacy struct {
+	Mode   PrivacyMode
+	listed map[string]bool
+}
+
+// LoadPrivacy reads the user's privacy settings from their SSI list
+func LoadPrivacy(ctx context.Context, db bun.IDB, uin int64) (*Privacy, error) {
+	mode, err := privacyMode(ctx, db, uin)
+	if err != nil {
+		return nil, err
+	}
+
+	privacy := &Privacy{Mode: mode, listed: make(map[string]bool)}
+	var class FeedbagItemType
+	switch mode {
+	case PrivacyPermitAll, PrivacyDenyAll:
+		return privacy, nil
+	case PrivacyPermitSome:
+		class = FeedbagItemTypePermit
+	case PrivacyPermitBuddies:
+		class = FeedbagItemTypeUser
+	default:
+		class = FeedbagItemTypeDeny
+	}
+
+	items, err := models.FeedbagItemsByClass(ctx, db, uin, uint16(class))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not check privacy lists")
+	}
+	for _, item := range items {
+		privacy.listed[util.NormalizeScreenName(item.Name)] = true
+	}
+	return privacy, nil
+}
+
+// Blocks is true if the settings keep the user hidden from screenName, who can't see them online
+// or send them messages
+func (p *Privacy) Blocks(screenName string) bool {
+	listed := p.listed[util.NormalizeScreenName(screenName)]
+	switch p.Mode {
+	case PrivacyPermitAll:
+		return false
+	case PrivacyDenyAll:
+		return true
+	case PrivacyPermitSome, PrivacyPermitBuddies:
+		return !listed
+	}
+	return listed
+}
+
+// Blocks is true if the user's privacy settings keep them hidden from screenName, who can't see
+// them online or send them messages
+func Blocks(ctx context.Context, db bun.IDB, user *models.User, screenName string) (bool, error) {
+	privacy, err := LoadPrivacy(ctx, db, user.UIN)
+	if err != nil {
+		return false, err
+	}
+	return privacy.Blocks(screenName), nil
+}
+
+// SessionPrivacy is the user's privacy settings, from the cache on their session so they aren't
+// read for every message and presence change. Without a session they're read from the DB.
+func SessionPrivacy(ctx context.Context, db bun.IDB, session *oscar.Session, user *models.User) (*Privacy, error) {
+	if session == nil {
+		return LoadPrivacy(ctx, db, user.UIN)
+	}
+
+	cached, generation := session.CachedPrivacy()
+	if privacy, ok := cached.(*Privacy); ok {
+		return privacy, nil
+	}
+	privacy, err := LoadPrivacy(ctx, db, user.UIN)
+	if err != nil {
+		return nil, err
+	}
+	session.CachePrivacy(privacy, generation)
+	return privacy, nil
+}
+
+// SessionBlocks is Blocks with the settings cached on the user's session, which is nil if they
+// aren't signed on
+func SessionBlocks(ctx context.Context, db bun.IDB, session *oscar.Session, user *models.User, screenName string) (bool, error) {
+	privacy, err := SessionPrivacy(ctx, db, session, user)
+	if err != nil {
+		return false, err
+	}
+	return privacy.Blocks(screenName), nil
+}
+
+// isBlocked is true if the user with screenName blocks from. Their settings come from the cache
+// on their session when they're signed on.
+func isBlocked(ctx context.Context, db *bun.DB, sessions SessionManager, screenName string, from string) (bool, error) {
+	user, err := models.UserByScreenName(ctx, db, screenName)
+	if err != nil {
+		return false, aimerror.FetchingUser(err, screenName)
+	}
+	if user == nil {
+		return false, nil
+	}
+
+	return SessionBlocks(ctx, db, sessions.GetSession(screenName), user, from)
+}
+
+func (p *PrivacyService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "privacy")
+
+	switch snac.Header.Subtype {
+
+	// Client wants to know the limits of the permit and deny lists
+	case 0x02:
+		rightsSnac := oscar.NewReplySNAC(snac, 0x09, 0x03)
+		rightsSnac.WriteTLV(oscar.NewTLV(0x01, util.Word(MaxPermits)))
+		rightsSnac.WriteTLV(oscar.NewTLV(0x02, util.Word(MaxDenies)))
+
+		rightsFlap := oscar.NewFLAP(2)
+		rightsFlap.Data.WriteBinary(rightsSnac)
+		return ctx, session.Send(rightsFlap)
+
+	// Client adds to (0x05) or removes from (0x06) their permit list, or adds to (0x07) or
+	// removes from (0x08) their deny list
+	case 0x05, 0x06, 0x07, 0x08:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		class, max := FeedbagItemTypePermit, MaxPermits
+		if snac.Header.Subtype == 0x07 || snac.Header.Subtype == 0x08 {
+			class, max = FeedbagItemTypeDeny, MaxDenies
+		}
+		add := snac.Header.Subtype == 0x05 || snac.Header.Subtype == 0x07
+
+		// The lists are kept on the user's SSI list, so changing them is a new revision of it
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			for len(snac.Data.Bytes()) > 0 {
+				screenName, err := snac.Data.ReadLPString()
+				if err != nil || screenName == "" {
+					return errors.New("could not read screen name")
+				}
+
+				if add {
+					err = addPrivacyItem(ctx, tx, user, uint16(class), max, screenName)
+				} else {
+					err = removePrivacyItem(ctx, tx, user, uint16(class), screenName)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			_, err := models.BumpFeedbagRevision(ctx, tx, user.UIN)
+			return err
+		})
+		if err != nil {
+			return ctx, err
+		}
+		session.InvalidatePrivacy()
+
+		// Who can see the user changed
+		p.OnlineCh <- StatusChanged(user)
+		return ctx, nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown privacy family/subtype: 0x09, 0x%02x", snac.Header.Subtype))
+
+	return ctx, aimerror.NotSupported
+}
+
+// addPrivacyItem puts screenName on the permit or deny list, unless it's already there or the
+// list is full
+func addPrivacyItem(ctx context.Context, db bun.IDB, user *models.User, class uint16, max int, screenName string) error {
+	items, err := models.FeedbagItemsByClass(ctx, db, user.UIN, class)
+	if err != nil {
+		return err
+	}
+	if hasItem(items, screenName) || len(items) >= max {
+		return nil
+	}
+
+	itemId, err := models.NextFeedbagItemId(ctx, db, user.UIN)
+	if err != nil {
+		return err
+	}
+
+	item := &models.Feedbag{
+		UserUIN:      user.UIN,
+		GroupId:      0,
+		ItemId:       itemId,
+		ClassId:      class,
+		Name:         screenName,
+		LastModified: time.Now(),
+	}
+	if _, err := db.NewInsert().Model(item).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not add privacy list item")
+	}
+	return nil
+}
+
+// removePrivacyItem takes screenName off the permit or deny list, however it's spaced and
+// capitalized
+func removePrivacyItem(ctx context.Context, db bun.IDB, user *models.User, class uint16, screenName string) error {
+	_, err := db.NewDelete().Model((*models.Feedbag)(nil)).
+		Where("user_uin = ?", user.UIN).
+		Where("class_id = ?", class).
+		Where("lower(replace(name, ' ', '')) = ?", util.NormalizeScreenName(screenName)).
+		Exec(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not remove privacy list item")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Run with: DB_DSN=postgres://... go test -tags integration ./services
+func testDB(t *testing.T) *bun.DB {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+
+	d, err := db.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	ctx := context.Background()
+	for _, model := range []interface{}{(*models.User)(nil), (*models.Feedbag)(nil), (*models.FeedbagRevision)(nil), (*models.AuthCookie)(nil), (*models.Message)(nil)} {
+		if _, err := d.NewCreateTable().Model(model).IfNotExists().Exec(ctx); err != nil {
+			t.Fatalf("could not create table: %s", err)
+		}
+	}
+
+	return d
+}
+
+func testUser(t *testing.T, d *bun.DB, screenName string) *models.User {
+	ctx := context.Background()
+	screenName = fmt.Sprintf("%s%d", screenName, time.Now().UnixNano()%100000)
+	user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+	if err != nil {
+		t.Fatalf("could not create user: %s", err)
+	}
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Feedbag)(nil)).Where("user_uin = ?", user.UIN).Exec(ctx)
+		d.NewDelete().Model((*models.FeedbagRevision)(nil)).Where("user_uin = ?", user.UIN).Exec(ctx)
+		d.NewDelete().Model((*models.AuthCookie)(nil)).Where("uin = ?", user.UIN).Exec(ctx)
+		d.NewDelete().Model(user).WherePK().Exec(ctx)
+	})
+	return user
+}
+
+func TestDeniedSenderIsRejected(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	aliceSession, _ := oscar.SessionFromContext(aliceCtx)
+	bobCtx, bobSNACs := fakeClient(t, bob.ScreenName)
+	bobCtx = models.NewContextWithUser(bobCtx, bob)
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	onlineCh := make(chan *PresenceEvent, 10)
+	privacy := &PrivacyService{OnlineCh: onlineCh}
+	commCh := make(chan *models.Message, 10)
+	icbm := &ICBM{CommCh: commCh, OnlineCh: onlineCh, Sessions: fakeSessionManager{alice.ScreenName: aliceSession, bob.ScreenName: bobSession}}
+
+	// Delivering a message caches bob's privacy settings on his session
+	if _, err := icbm.HandleSNAC(aliceCtx, d, instantMessage(bob.ScreenName, "hello")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if len(commCh) != 1 {
+		t.Fatalf("expected the message to be delivered")
+	}
+	<-commCh
+	if cached, _ := bobSession.CachedPrivacy(); cached == nil {
+		t.Fatalf("expected bob's privacy settings to be cached")
+	}
+
+	// bob denies alice
+	deny := oscar.NewSNAC(0x09, 0x07)
+	deny.Data.WriteLPString(alice.ScreenName)
+	if _, err := privacy.HandleSNAC(bobCtx, d, deny); err != nil {
+		t.Fatalf("could not deny: %s", err)
+	}
+	if cached, _ := bobSession.CachedPrivacy(); cached != nil {
+		t.Fatalf("expected bob's cached privacy settings to be dropped")
+	}
+
+	blocked, err := Blocks(context.Background(), d, bob, alice.ScreenName)
+	if err != nil {
+		t.Fatalf("could not check privacy: %s", err)
+	}
+	if !blocked {
+		t.Fatalf("expected bob to block alice")
+	}
+
+	if _, err := icbm.HandleSNAC(aliceCtx, d, instantMessage(bob.ScreenName, "hello")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	errSnac := expectSNAC(t, aliceSNACs, 0x4, 0x01)
+	if code, _ := errSnac.Data.ReadUint16(); code != 0x10 {
+		t.Errorf("expected error 0x10, got 0x%02x", code)
+	}
+	if len(commCh) != 0 {
+		t.Errorf("expected the message not to be delivered")
+	}
+
+	// alice's typing notifications are dropped too
+	if _, err := icbm.HandleSNAC(aliceCtx, d, typingNotification(bob.ScreenName, TypingBegun)); err != nil {
+		t.Fatalf("could not send typing notification: %s", err)
+	}
+	expectNoSNAC(t, bobSNACs)
+
+	// Denying only works one way, so bob can still message alice
+	if _, err := icbm.HandleSNAC(bobCtx, d, instantMessage(alice.ScreenName, "hello")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if len(commCh) != 1 {
+		t.Fatalf("expected bob's message to be delivered")
+	}
+	<-commCh
+
+	// Once bob allows alice again, alice's messages go through
+	allow := oscar.NewSNAC(0x09, 0x08)
+	allow.Data.WriteLPString(alice.ScreenName)
+	if _, err := privacy.HandleSNAC(bobCtx, d, allow); err != nil {
+		t.Fatalf("could not remove deny: %s", err)
+	}
+
+	if _, err := icbm.HandleSNAC(aliceCtx, d, instantMessage(bob.ScreenName, "hello")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	if len(commCh) != 1 {
+		t.Errorf("expected the message to be delivered")
+	}
+	expectNoSNAC(t, aliceSNACs)
+}
+
+// A screen name comes off the deny list however it's spaced and capitalized, like it's matched
+// when blocking
+func TestUndenyNormalizedScreenName(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	bob := testUser(t, d, "bob")
+	bobCtx, _ := fakeClient(t, bob.ScreenName)
+	bobCtx = models.NewContextWithUser(bobCtx, bob)
+	privacy := &PrivacyService{OnlineCh: make(chan *PresenceEvent, 10)}
+
+	deny := oscar.NewSNAC(0x09, 0x07)
+	deny.Data.WriteLPString("Foo Bar")
+	if _, err := privacy.HandleSNAC(bobCtx, d, deny); err != nil {
+		t.Fatalf("could not deny: %s", err)
+	}
+	if blocked, err := Blocks(context.Background(), d, bob, "foobar"); err != nil || !blocked {
+		t.Fatalf("expected bob to block foobar: %v", err)
+	}
+
+	allow := oscar.NewSNAC(0x09, 0x08)
+	allow.Data.WriteLPString("foobar")
+	if _, err := privacy.HandleSNAC(bobCtx, d, allow); err != nil {
+		t.Fatalf("could not remove deny: %s", err)
+	}
+	if blocked, err := Blocks(context.Background(), d, bob, "Foo Bar"); err != nil || blocked {
+		t.Errorf("expected bob to no longer block Foo Bar: %v", err)
+	}
+	if items, _ := models.FeedbagItemsByClass(context.Background(), d, bob.UIN, uint16(FeedbagItemTypeDeny)); len(items) != 0 {
+		t.Errorf("expected bob's deny list to be empty, got %d items", len(items))
+	}
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"testing"
+)
+
+func TestHasItem(t *testing.T) {
+	items := []*models.Feedbag{
+		{Name: "Alice", ClassId: uint16(FeedbagItemTypeDeny)},
+		{Name: "bob", ClassId: uint16(FeedbagItemTypeDeny)},
+	}
+
+	if !hasItem(items, "alice") {
+		t.Errorf("expected screen names to match regardless of case")
+	}
+	if hasItem(items, "carol") {
+		t.Errorf("expected carol not to be on the list")
+	}
+	if hasItem(nil, "alice") {
+		t.Errorf("expected an empty list to have no items")
+	}
+}
+
+func TestPrivacyBlocks(t *testing.T) {
+	listed := map[string]bool{"alice": true}
+	for _, tc := range []struct {
+		mode         PrivacyMode
+		alice, carol bool
+	}{
+		{PrivacyPermitAll, false, false},
+		{PrivacyDenyAll, true, true},
+		{PrivacyPermitSome, false, true},
+		{PrivacyDenySome, true, false},
+		{PrivacyPermitBuddies, false, true},
+	} {
+		privacy := &Privacy{Mode: tc.mode, listed: listed}
+		if blocked := privacy.Blocks("Alice"); blocked != tc.alice {
+			t.Errorf("mode %d: expected alice blocked %v, got %v", tc.mode, tc.alice, blocked)
+		}
+		if blocked := privacy.Blocks("carol"); blocked != tc.carol {
+			t.Errorf("mode %d: expected carol blocked %v, got %v", tc.mode, tc.carol, blocked)
+		}
+	}
+}
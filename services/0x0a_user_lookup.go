@@ -0,0 +1,51 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+
+	"github.com/uptrace/bun"
+)
+
+// UserLookupErrorNoMatch is the SNAC error code when no one has the email
+const UserLookupErrorNoMatch = 0x14
+
+// UserLookupService finds buddies by their email for clients' "find buddy by e-mail"
+type UserLookupService struct{}
+
+func (u *UserLookupService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "user_lookup")
+
+	switch snac.Header.Subtype {
+
+	// Client wants the screen names with an email, which is the rest of the SNAC
+	case 0x02:
+		email := string(snac.Data.Bytes())
+		users, err := models.UsersByEmail(ctx, db, email)
+		if err != nil {
+			return ctx, err
+		}
+
+		if len(users) == 0 {
+			logger.Debug("no users with email")
+			errFlap := oscar.NewFLAP(2)
+			errFlap.Data.WriteBinary(oscar.NewSNACError(0x0a, snac.Header.RequestID, UserLookupErrorNoMatch))
+			return ctx, session.Send(errFlap)
+		}
+
+		resultSnac := oscar.NewReplySNAC(snac, 0x0a, 0x03)
+		for _, user := range users {
+			resultSnac.Data.WriteBinary(oscar.NewTLVString(0x01, user.ScreenName))
+		}
+		resultFlap := oscar.NewFLAP(2)
+		resultFlap.Data.WriteBinary(resultSnac)
+		return ctx, session.Send(resultFlap)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown user lookup family/subtype: 0x0a, 0x%02x", snac.Header.Subtype))
+	return ctx, aimerror.NotSupported
+}
@@ -0,0 +1,74 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Users are found by their whole email in any case, unless they've asked not to be
+func TestUserLookupByEmail(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	alice := testUser(t, d, "alice")
+	bob := testUser(t, d, "bob")
+	ctx, snacs := fakeClient(t, bob.ScreenName)
+	ctx = models.NewContextWithUser(ctx, bob)
+	u := &UserLookupService{}
+
+	lookup := func(email string) *oscar.SNAC {
+		t.Helper()
+		request := oscar.NewSNAC(0x0a, 0x02)
+		request.Data.Write([]byte(email))
+		if _, err := u.HandleSNAC(ctx, d, request); err != nil {
+			t.Fatalf("could not look up %s: %s", email, err)
+		}
+		select {
+		case snac := <-snacs:
+			return snac
+		case <-time.After(time.Second):
+			t.Fatalf("expected a reply to looking up %s", email)
+		}
+		return nil
+	}
+
+	reply := lookup(strings.ToUpper(alice.Email))
+	if reply.Header.Subtype != 0x03 {
+		t.Fatalf("expected alice to be found, got %s", reply)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not unmarshal TLVs: %s", err)
+	}
+	if len(tlvs) != 1 || tlvs[0].Type != 0x01 || tlvs[0].String() != alice.ScreenName {
+		t.Errorf("expected alice's screen name, got %v", tlvs)
+	}
+
+	// Only whole emails match
+	if reply := lookup(alice.Email[1:]); reply.Header.Subtype != 0x01 {
+		t.Errorf("expected no match for part of an email, got %s", reply)
+	} else if code, _ := reply.Data.ReadUint16(); code != UserLookupErrorNoMatch {
+		t.Errorf("expected error 0x%02x, got 0x%02x", UserLookupErrorNoMatch, code)
+	}
+
+	// Alice stops others from finding her
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+	dirInfo := oscar.NewSNAC(0x02, 0x09)
+	dirInfo.WriteTLV(oscar.NewTLVUint16(DirectoryInfoAllowSearch, 0))
+	if _, err := (&LocationServices{}).HandleSNAC(aliceCtx, d, dirInfo); err != nil {
+		t.Fatalf("could not update directory info: %s", err)
+	}
+	if result, _ := expectSNAC(t, aliceSNACs, 0x02, 0x0a).Data.ReadUint16(); result != 1 {
+		t.Errorf("expected the directory info update to succeed, got %d", result)
+	}
+
+	if reply := lookup(alice.Email); reply.Header.Subtype != 0x01 {
+		t.Errorf("expected alice to be hidden, got %s", reply)
+	}
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// UsageStatsService takes the usage reports clients send every report interval. Clients that
+// don't get an ack keep sending them, so every report is acked even when it can't be read.
+type UsageStatsService struct {
+	// Record counts the client and version of each report in the client_versions table
+	Record bool
+}
+
+// ReportIntervalSNAC (0x0b,0x02) tells clients how many hours to wait between usage reports
+func ReportIntervalSNAC(hours uint16) *oscar.SNAC {
+	intervalSnac := oscar.NewSNAC(0x0b, 0x02)
+	intervalSnac.Data.WriteUint16(hours)
+	return intervalSnac
+}
+
+// usageReport is what the server cares about in a usage report
+type usageReport struct {
+	ScreenName string
+	Client     string
+	Version    string
+}
+
+// readUsageReport reads the client's time, the screen name and the TLVs of a usage report. The
+// client and its version are in the same TLVs as in a login.
+func readUsageReport(snac *oscar.SNAC) (*usageReport, error) {
+	if _, err := snac.Data.ReadUint32(); err != nil {
+		return nil, errors.Wrap(err, "could not read report time")
+	}
+	screenName, err := snac.Data.ReadLPString()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read screen name")
+	}
+	count, err := snac.Data.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read TLV count")
+	}
+	tlvs, err := snac.Data.ReadTLVs(int(count))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read report TLVs")
+	}
+
+	report := &usageReport{ScreenName: screenName}
+	if clientTLV, ok := tlvs.Get(0x03); ok {
+		report.Client = clientTLV.String()
+	}
+
+	// Major, minor, lesser and build, missing parts left out
+	for _, tlvType := range []uint16{0x17, 0x18, 0x19, 0x1a} {
+		tlv, ok := tlvs.Get(tlvType)
+		if !ok {
+			continue
+		}
+		part, err := tlv.Uint16()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read version")
+		}
+		if report.Version != "" {
+			report.Version += "."
+		}
+		report.Version += fmt.Sprint(part)
+	}
+
+	return report, nil
+}
+
+func (u *UsageStatsService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "usage_stats")
+
+	switch snac.Header.Subtype {
+
+	// Client's usage report
+	case 0x03:
+		report, err := readUsageReport(snac)
+		if err != nil {
+			logger.Debug("could not read usage report", "err", err)
+		} else if u.Record && report.Client != "" {
+			if err := models.RecordClientVersion(ctx, db, report.Client, report.Version); err != nil {
+				logger.Error("could not record usage report", "err", err)
+			}
+		}
+
+		ackFlap := oscar.NewFLAP(2)
+		ackFlap.Data.WriteBinary(oscar.NewReplySNAC(snac, 0x0b, 0x04))
+		return ctx, session.Send(ackFlap)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown usage stats family/subtype: 0x0b, 0x%02x", snac.Header.Subtype))
+	return ctx, aimerror.NotSupported
+}
@@ -0,0 +1,51 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"context"
+	"testing"
+)
+
+// Reports are counted by client and version when recording is on
+func TestUsageReportRecorded(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.ClientVersion)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+	client := "test client " + testUser(t, d, "usage").ScreenName
+	defer d.NewDelete().Model((*models.ClientVersion)(nil)).Where("client = ?", client).Exec(ctx)
+
+	report := func(u *UsageStatsService, version ...uint16) {
+		t.Helper()
+		aliceCtx, snacs := fakeClient(t, "alice")
+		if _, err := u.HandleSNAC(aliceCtx, d, usageReportSNAC(client, version...)); err != nil {
+			t.Fatalf("could not handle report: %s", err)
+		}
+		expectSNAC(t, snacs, 0x0b, 0x04)
+	}
+
+	recording := &UsageStatsService{Record: true}
+	report(recording, 1, 5)
+	report(recording, 1, 5)
+	report(recording, 2, 0)
+	report(&UsageStatsService{}, 2, 0)
+
+	versions, err := models.ClientVersions(ctx, d)
+	if err != nil {
+		t.Fatalf("could not fetch client versions: %s", err)
+	}
+	reports := make(map[string]int)
+	for _, version := range versions {
+		if version.Client == client {
+			reports[version.Version] = version.Reports
+		}
+	}
+	if len(reports) != 2 || reports["1.5"] != 2 || reports["2.0"] != 1 {
+		t.Errorf("expected 2 reports from 1.5 and 1 from 2.0, got %v", reports)
+	}
+}
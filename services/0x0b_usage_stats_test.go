@@ -0,0 +1,72 @@
+package services
+
+import (
+	"aim-oscar/oscar"
+	"testing"
+)
+
+func usageReportSNAC(client string, version ...uint16) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x0b, 0x03)
+	snac.Data.WriteUint32(1700000000)
+	snac.Data.WriteLPString("alice")
+	snac.Data.WriteUint16(uint16(1 + len(version)))
+	snac.WriteTLV(oscar.NewTLVString(0x03, client))
+	for i, part := range version {
+		snac.WriteTLV(oscar.NewTLVUint16(0x17+uint16(i), part))
+	}
+	return snac
+}
+
+func TestReadUsageReport(t *testing.T) {
+	report, err := readUsageReport(usageReportSNAC("AOL Instant Messenger, version 5.9.3702/WIN32", 5, 9, 0, 3702))
+	if err != nil {
+		t.Fatalf("could not read report: %s", err)
+	}
+	if report.ScreenName != "alice" || report.Client != "AOL Instant Messenger, version 5.9.3702/WIN32" || report.Version != "5.9.0.3702" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// Clients that leave out the build still have a version
+	report, err = readUsageReport(usageReportSNAC("gaim", 1, 5))
+	if err != nil {
+		t.Fatalf("could not read report: %s", err)
+	}
+	if report.Version != "1.5" {
+		t.Errorf("expected version 1.5, got %q", report.Version)
+	}
+}
+
+// Reports are acked, even ones the server can't read, so clients don't keep resending them
+func TestUsageReportAck(t *testing.T) {
+	tt := map[string]*oscar.SNAC{
+		"report":    usageReportSNAC("gaim", 1, 5),
+		"empty":     oscar.NewSNAC(0x0b, 0x03),
+		"truncated": oscar.NewSNAC(0x0b, 0x03),
+	}
+	tt["report"].Header.RequestID = 7
+	tt["truncated"].Data.Write([]byte{0, 0, 0, 1, 10, 'a'}) // screen name cut short
+
+	for name, report := range tt {
+		t.Run(name, func(t *testing.T) {
+			ctx, snacs := fakeClient(t, "alice")
+			u := &UsageStatsService{}
+			if _, err := u.HandleSNAC(ctx, nil, report); err != nil {
+				t.Fatalf("could not handle report: %s", err)
+			}
+			ack := expectSNAC(t, snacs, 0x0b, 0x04)
+			if ack.Header.RequestID != report.Header.RequestID {
+				t.Errorf("expected the ack to have request ID %d, got %d", report.Header.RequestID, ack.Header.RequestID)
+			}
+		})
+	}
+}
+
+func TestReportIntervalSNAC(t *testing.T) {
+	snac := ReportIntervalSNAC(24)
+	if snac.Header.Family != 0x0b || snac.Header.Subtype != 0x02 {
+		t.Fatalf("expected SNAC(0x0b, 0x02), got %s", snac)
+	}
+	if hours, _ := snac.Data.ReadUint16(); hours != 24 {
+		t.Errorf("expected 24 hours, got %d", hours)
+	}
+}
@@ -0,0 +1,273 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// ChatExchangePublic is the exchange users create their own rooms in. It's the only one offered.
+const ChatExchangePublic = 4
+
+// Limits advertised for chat rooms
+const (
+	ChatMaxConcurrentRooms = 10
+	ChatMaxMessageLength   = 1024
+	ChatMaxOccupancy       = 100
+)
+
+// Room info detail levels
+const (
+	ChatDetailShort = 0x01
+	ChatDetailFull  = 0x02
+)
+
+type ChatNavService struct{}
+
+// ChatRoomInfo is the room info block that identifies a room in chat nav requests and replies,
+// and that the client sends back when it asks for a chat service connection
+type ChatRoomInfo struct {
+	Exchange    uint16
+	Cookie      string
+	Instance    uint16
+	DetailLevel uint8
+	TLVs        []*oscar.TLV
+}
+
+func (r *ChatRoomInfo) Bytes() []byte {
+	buf := oscar.Buffer{}
+	buf.WriteUint16(r.Exchange)
+	buf.WriteLPString(r.Cookie)
+	buf.WriteUint16(r.Instance)
+	buf.WriteUint8(r.DetailLevel)
+	buf.WriteUint16(uint16(len(r.TLVs)))
+	for _, tlv := range r.TLVs {
+		buf.WriteBinary(tlv)
+	}
+	return buf.Bytes()
+}
+
+// readChatRoomInfo reads a room info block. withTLVs is false for requests that only carry the
+// room identity and detail level.
+func readChatRoomInfo(buf *oscar.Buffer, withTLVs bool) (*ChatRoomInfo, error) {
+	info := &ChatRoomInfo{}
+	var err error
+
+	if info.Exchange, err = buf.ReadUint16(); err != nil {
+		return nil, errors.Wrap(err, "could not read exchange")
+	}
+
+	cookieLength, err := buf.ReadUint8()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read cookie length")
+	}
+	cookie, err := buf.ReadBytes(int(cookieLength))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read cookie")
+	}
+	info.Cookie = string(cookie)
+
+	if info.Instance, err = buf.ReadUint16(); err != nil {
+		return nil, errors.Wrap(err, "could not read instance")
+	}
+
+	if info.DetailLevel, err = buf.ReadUint8(); err != nil {
+		return nil, errors.Wrap(err, "could not read detail level")
+	}
+
+	if !withTLVs {
+		return info, nil
+	}
+
+	tlvCount, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read TLV count")
+	}
+
+	if info.TLVs, err = buf.ReadTLVs(int(tlvCount)); err != nil {
+		return nil, errors.Wrap(err, "could not read room TLVs")
+	}
+
+	return info, nil
+}
+
+// chatRoomInfoFromModel builds the full room info block for a room
+func chatRoomInfoFromModel(room *models.ChatRoom) *ChatRoomInfo {
+	return &ChatRoomInfo{
+		Exchange:    room.Exchange,
+		Cookie:      room.Cookie,
+		Instance:    room.Instance,
+		DetailLevel: ChatDetailFull,
+		TLVs: []*oscar.TLV{
+			oscar.NewTLV(0x6a, []byte(room.Name)),                         // fully qualified name
+			oscar.NewTLV(0xc9, util.Word(0x0f)),                           // flags
+			oscar.NewTLV(0xca, util.Dword(uint32(room.CreatedAt.Unix()))), // creation time
+			oscar.NewTLV(0xd1, util.Word(ChatMaxMessageLength)),           // max message length
+			oscar.NewTLV(0xd2, util.Word(ChatMaxOccupancy)),               // max occupancy
+			oscar.NewTLV(0xd3, []byte(room.Name)),                         // room name
+			oscar.NewTLV(0xd5, []byte{0x02}),                              // creation permissions
+			oscar.NewTLV(0xd6, []byte("us-ascii")),                        // charset
+			oscar.NewTLV(0xd7, []byte("en")),                              // language
+		},
+	}
+}
+
+// chatExchangeInfo is the exchange info block (TLV 0x03 of the rights reply) for an exchange
+func chatExchangeInfo(exchange uint16) []byte {
+	tlvs := []*oscar.TLV{
+		oscar.NewTLV(0x02, util.Word(0x10)),                 // class permissions
+		oscar.NewTLV(0xc9, util.Word(0x0f)),                 // flags
+		oscar.NewTLV(0xd1, util.Word(ChatMaxMessageLength)), // max message length
+		oscar.NewTLV(0xd2, util.Word(ChatMaxOccupancy)),     // max occupancy
+		oscar.NewTLV(0xd3, []byte("default Exchange")),      // exchange name
+		oscar.NewTLV(0xd5, []byte{0x02}),                    // creation permissions
+		oscar.NewTLV(0xd6, []byte("us-ascii")),              // charset
+		oscar.NewTLV(0xd7, []byte("en")),                    // language
+	}
+
+	buf := oscar.Buffer{}
+	buf.WriteUint16(exchange)
+	buf.WriteUint16(uint16(len(tlvs)))
+	for _, tlv := range tlvs {
+		buf.WriteBinary(tlv)
+	}
+	return buf.Bytes()
+}
+
+func (c *ChatNavService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "chat nav")
+
+	switch snac.Header.Subtype {
+
+	// Client wants the chat limits and the exchanges it can use
+	case 0x02:
+		respSnac := oscar.NewReplySNAC(snac, 0x0d, 0x09)
+		respSnac.WriteTLV(oscar.NewTLV(0x02, []byte{ChatMaxConcurrentRooms}))
+		respSnac.WriteTLV(oscar.NewTLV(0x03, chatExchangeInfo(ChatExchangePublic)))
+
+		respFlap := oscar.NewFLAP(2)
+		respFlap.Data.WriteBinary(respSnac)
+		return ctx, session.Send(respFlap)
+
+	// Client wants the exchange's info and the public rooms in it, to browse them
+	case 0x03:
+		exchange, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read exchange")
+		}
+
+		if exchange != ChatExchangePublic {
+			return ctx, c.sendError(session, snac.Header.RequestID, aimerror.CodeNoMatch)
+		}
+
+		rooms, err := models.PublicChatRooms(ctx, db, exchange)
+		if err != nil {
+			return ctx, err
+		}
+
+		respSnac := oscar.NewReplySNAC(snac, 0x0d, 0x09)
+		respSnac.WriteTLV(oscar.NewTLV(0x03, chatExchangeInfo(exchange)))
+		for _, room := range rooms {
+			respSnac.WriteTLV(oscar.NewTLV(0x04, chatRoomInfoFromModel(room).Bytes()))
+		}
+
+		respFlap := oscar.NewFLAP(2)
+		respFlap.Data.WriteBinary(respSnac)
+		return ctx, session.Send(respFlap)
+
+	// Client wants the info for a room
+	case 0x04:
+		info, err := readChatRoomInfo(&snac.Data, false)
+		if err != nil {
+			return ctx, errors.Wrap(err, "invalid room info request")
+		}
+
+		room, err := models.ChatRoomByCookie(ctx, db, info.Exchange, info.Cookie)
+		if err != nil {
+			return ctx, err
+		}
+
+		if room == nil {
+			return ctx, c.sendError(session, snac.Header.RequestID, aimerror.CodeNoMatch)
+		}
+
+		return ctx, c.sendRoomInfo(session, snac, room)
+
+	// Client creates a room, or joins the room with that name if it already exists
+	case 0x08:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		info, err := readChatRoomInfo(&snac.Data, true)
+		if err != nil {
+			return ctx, errors.Wrap(err, "invalid create room request")
+		}
+
+		if info.Exchange != ChatExchangePublic {
+			return ctx, c.sendError(session, snac.Header.RequestID, aimerror.CodeRequestDenied)
+		}
+
+		nameTLV := oscar.FindTLV(info.TLVs, 0xd3)
+		if nameTLV == nil || len(nameTLV.Data) == 0 {
+			return ctx, c.sendError(session, snac.Header.RequestID, aimerror.CodeIncorrectSNACFormat)
+		}
+		name := string(nameTLV.Data)
+
+		room, err := models.ChatRoomByName(ctx, db, info.Exchange, name)
+		if err != nil {
+			return ctx, err
+		}
+
+		if room == nil {
+			now := time.Now()
+			room = &models.ChatRoom{
+				Exchange:     info.Exchange,
+				Cookie:       uuid.New().String(),
+				Name:         name,
+				CreatorUIN:   user.UIN,
+				CreatedAt:    now,
+				LastActiveAt: now,
+				Public:       true,
+			}
+			if _, err := db.NewInsert().Model(room).Exec(ctx); err != nil {
+				return ctx, errors.Wrap(err, "could not create chat room")
+			}
+			logger.Info("Created chat room", "name", room.Name, "exchange", room.Exchange)
+		}
+
+		return ctx, c.sendRoomInfo(session, snac, room)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown chat nav family/subtype: 0x0d, 0x%02x", snac.Header.Subtype))
+
+	return ctx, aimerror.NotSupported
+}
+
+// sendRoomInfo replies with the full room info block, which the client uses to ask for a chat
+// service connection to the room
+func (c *ChatNavService) sendRoomInfo(session *oscar.Session, request *oscar.SNAC, room *models.ChatRoom) error {
+	respSnac := oscar.NewReplySNAC(request, 0x0d, 0x09)
+	respSnac.WriteTLV(oscar.NewTLV(0x04, chatRoomInfoFromModel(room).Bytes()))
+
+	respFlap := oscar.NewFLAP(2)
+	respFlap.Data.WriteBinary(respSnac)
+	return session.Send(respFlap)
+}
+
+func (c *ChatNavService) sendError(session *oscar.Session, requestID uint32, code uint16) error {
+	errSnac := oscar.NewSNACError(0x0d, requestID, code)
+	errFlap := oscar.NewFLAP(2)
+	errFlap.Data.WriteBinary(errSnac)
+	return session.Send(errFlap)
+}
@@ -0,0 +1,80 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Asking for an exchange's info lists its public rooms, so clients can browse them
+func TestChatNavListRooms(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+	ctx := context.Background()
+
+	if _, err := d.NewCreateTable().Model((*models.ChatRoom)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+	public := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: uuid.New().String(), Name: "public " + uuid.New().String(), CreatedAt: time.Now(), Public: true}
+	private := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: uuid.New().String(), Name: "private " + uuid.New().String(), CreatedAt: time.Now()}
+	for _, room := range []*models.ChatRoom{public, private} {
+		if _, err := d.NewInsert().Model(room).Exec(ctx); err != nil {
+			t.Fatalf("could not create room: %s", err)
+		}
+		defer d.NewDelete().Model(room).WherePK().Exec(ctx)
+	}
+
+	aliceCtx, snacs := fakeClient(t, "alice")
+	nav := &ChatNavService{}
+
+	request := oscar.NewSNAC(0x0d, 0x03)
+	request.Header.RequestID = 9
+	request.Data.WriteUint16(ChatExchangePublic)
+	if _, err := nav.HandleSNAC(aliceCtx, d, request); err != nil {
+		t.Fatalf("could not list rooms: %s", err)
+	}
+
+	reply := expectSNAC(t, snacs, 0x0d, 0x09)
+	if reply.Header.RequestID != 9 {
+		t.Errorf("expected the reply to have request ID 9, got %d", reply.Header.RequestID)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read reply: %s", err)
+	}
+	if !tlvs.Has(0x03) {
+		t.Errorf("expected the exchange info")
+	}
+	cookies := map[string]bool{}
+	for _, tlv := range tlvs {
+		if tlv.Type != 0x04 {
+			continue
+		}
+		buf := oscar.Buffer{}
+		buf.Write(tlv.Data)
+		info, err := readChatRoomInfo(&buf, true)
+		if err != nil {
+			t.Fatalf("could not read room info: %s", err)
+		}
+		cookies[info.Cookie] = true
+	}
+	if !cookies[public.Cookie] || cookies[private.Cookie] {
+		t.Errorf("expected only the public room to be listed, got %v", cookies)
+	}
+
+	// Exchanges that aren't offered have no rooms
+	request = oscar.NewSNAC(0x0d, 0x03)
+	request.Data.WriteUint16(5)
+	if _, err := nav.HandleSNAC(aliceCtx, d, request); err != nil {
+		t.Fatalf("could not list rooms: %s", err)
+	}
+	if code, _ := expectSNAC(t, snacs, 0x0d, 0x01).Data.ReadUint16(); code != 0x14 {
+		t.Errorf("expected error 0x14, got 0x%02x", code)
+	}
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReadChatRoomInfoCreate(t *testing.T) {
+	// Create room request (0x0d,0x08) for "Test Room" as sent by Pidgin
+	data := []byte{
+		0x00, 0x04, // exchange
+		0x06, 'c', 'r', 'e', 'a', 't', 'e', // cookie
+		0xff, 0xff, // instance
+		0x01,       // detail level
+		0x00, 0x03, // TLV count
+		0x00, 0xd3, 0x00, 0x09, 'T', 'e', 's', 't', ' ', 'R', 'o', 'o', 'm',
+		0x00, 0xd6, 0x00, 0x08, 'u', 's', '-', 'a', 's', 'c', 'i', 'i',
+		0x00, 0xd7, 0x00, 0x02, 'e', 'n',
+	}
+
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	info, err := readChatRoomInfo(&buf, true)
+	if err != nil {
+		t.Fatalf("could not read room info: %s", err)
+	}
+
+	if info.Exchange != 4 || info.Cookie != "create" || info.Instance != 0xffff || info.DetailLevel != ChatDetailShort {
+		t.Errorf("unexpected room info %+v", info)
+	}
+
+	if len(info.TLVs) != 3 {
+		t.Fatalf("expected 3 TLVs, got %d", len(info.TLVs))
+	}
+
+	name := oscar.FindTLV(info.TLVs, 0xd3)
+	if name == nil || string(name.Data) != "Test Room" {
+		t.Errorf("expected room name TLV \"Test Room\", got %v", name)
+	}
+
+	if len(buf.Bytes()) != 0 {
+		t.Errorf("expected the whole request to be read, %d bytes left", len(buf.Bytes()))
+	}
+}
+
+func TestReadChatRoomInfoRequest(t *testing.T) {
+	// Room info request (0x0d,0x04) has no TLV block
+	data := []byte{
+		0x00, 0x04, // exchange
+		0x04, 'a', 'b', 'c', 'd', // cookie
+		0x00, 0x00, // instance
+		0x02, // detail level
+	}
+
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	info, err := readChatRoomInfo(&buf, false)
+	if err != nil {
+		t.Fatalf("could not read room info: %s", err)
+	}
+
+	if info.Exchange != 4 || info.Cookie != "abcd" || info.Instance != 0 || info.DetailLevel != ChatDetailFull {
+		t.Errorf("unexpected room info %+v", info)
+	}
+}
+
+func TestReadChatRoomInfoTruncated(t *testing.T) {
+	data := []byte{
+		0x00, 0x04, // exchange
+		0x06, 'c', 'r', 'e', // cookie cut short
+	}
+
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	if _, err := readChatRoomInfo(&buf, true); err == nil {
+		t.Errorf("expected an error reading a truncated room info block")
+	}
+}
+
+func TestChatRoomInfoFromModel(t *testing.T) {
+	room := &models.ChatRoom{
+		Exchange:  4,
+		Cookie:    "abcd",
+		Instance:  0,
+		Name:      "Hi",
+		CreatedAt: time.Unix(0x01020304, 0),
+	}
+
+	expected := []byte{
+		0x00, 0x04, // exchange
+		0x04, 'a', 'b', 'c', 'd', // cookie
+		0x00, 0x00, // instance
+		0x02,       // detail level
+		0x00, 0x09, // TLV count
+		0x00, 0x6a, 0x00, 0x02, 'H', 'i', // fully qualified name
+		0x00, 0xc9, 0x00, 0x02, 0x00, 0x0f, // flags
+		0x00, 0xca, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04, // creation time
+		0x00, 0xd1, 0x00, 0x02, 0x04, 0x00, // max message length
+		0x00, 0xd2, 0x00, 0x02, 0x00, 0x64, // max occupancy
+		0x00, 0xd3, 0x00, 0x02, 'H', 'i', // room name
+		0x00, 0xd5, 0x00, 0x01, 0x02, // creation permissions
+		0x00, 0xd6, 0x00, 0x08, 'u', 's', '-', 'a', 's', 'c', 'i', 'i', // charset
+		0x00, 0xd7, 0x00, 0x02, 'e', 'n', // language
+	}
+
+	b := chatRoomInfoFromModel(room).Bytes()
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected room info bytes\n%v\ngot\n%v", expected, b)
+	}
+
+	// The client echoes the block back, so it must read back the same way
+	buf := oscar.Buffer{}
+	buf.Write(b)
+	info, err := readChatRoomInfo(&buf, true)
+	if err != nil {
+		t.Fatalf("could not read room info back: %s", err)
+	}
+	if info.Cookie != room.Cookie || len(info.TLVs) != 9 {
+		t.Errorf("unexpected room info read back %+v", info)
+	}
+}
+
+func TestChatExchangeInfo(t *testing.T) {
+	expected := []byte{
+		0x00, 0x04, // exchange
+		0x00, 0x08, // TLV count
+		0x00, 0x02, 0x00, 0x02, 0x00, 0x10, // class permissions
+		0x00, 0xc9, 0x00, 0x02, 0x00, 0x0f, // flags
+		0x00, 0xd1, 0x00, 0x02, 0x04, 0x00, // max message length
+		0x00, 0xd2, 0x00, 0x02, 0x00, 0x64, // max occupancy
+		0x00, 0xd3, 0x00, 0x10, 'd', 'e', 'f', 'a', 'u', 'l', 't', ' ', 'E', 'x', 'c', 'h', 'a', 'n', 'g', 'e', // exchange name
+		0x00, 0xd5, 0x00, 0x01, 0x02, // creation permissions
+		0x00, 0xd6, 0x00, 0x08, 'u', 's', '-', 'a', 's', 'c', 'i', 'i', // charset
+		0x00, 0xd7, 0x00, 0x02, 'e', 'n', // language
+	}
+
+	b := chatExchangeInfo(ChatExchangePublic)
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected exchange info bytes\n%v\ngot\n%v", expected, b)
+	}
+}
@@ -0,0 +1,430 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+type chatKey string
+
+func (s chatKey) String() string {
+	return "chat-" + string(s)
+}
+
+var (
+	chatRoomKey = chatKey("room")
+)
+
+// NewContextWithChatRoom marks the connection as a chat connection for the room
+func NewContextWithChatRoom(ctx context.Context, room *models.ChatRoom) context.Context {
+	return context.WithValue(ctx, chatRoomKey, room)
+}
+
+// ChatRoomFromContext is the room of a chat connection, nil for any other connection
+func ChatRoomFromContext(ctx context.Context) *models.ChatRoom {
+	r := ctx.Value(chatRoomKey)
+	if r == nil {
+		return nil
+	}
+	return r.(*models.ChatRoom)
+}
+
+type chatParticipant struct {
+	User    *models.User
+	Session *oscar.Session
+}
+
+type chatRoomMembers struct {
+	Room         *models.ChatRoom
+	Participants map[*oscar.Session]*models.User
+}
+
+// ChatInvitationTimeout is how long someone who accepted an invitation to a chat room has to
+// ask for a connection to it
+const ChatInvitationTimeout = 5 * time.Minute
+
+// ChatRegistry keeps track of who is in each chat room, keyed by room cookie
+type ChatRegistry struct {
+	rooms map[string]*chatRoomMembers
+
+	// Who accepted an invitation to each room, by normalized screen name, and until when they
+	// are let in
+	invited map[string]map[string]time.Time
+
+	mutex sync.RWMutex
+}
+
+func NewChatRegistry() *ChatRegistry {
+	return &ChatRegistry{
+		rooms:   make(map[string]*chatRoomMembers),
+		invited: make(map[string]map[string]time.Time),
+	}
+}
+
+// Invite lets the screen name into the room for ChatInvitationTimeout from now, whoever else is
+// in it
+func (r *ChatRegistry) Invite(room *models.ChatRoom, screenName string, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Invitations nobody took up are forgotten as others are made
+	for cookie, invited := range r.invited {
+		for name, expires := range invited {
+			if expires.Before(now) {
+				delete(invited, name)
+			}
+		}
+		if len(invited) == 0 {
+			delete(r.invited, cookie)
+		}
+	}
+
+	if r.invited[room.Cookie] == nil {
+		r.invited[room.Cookie] = make(map[string]time.Time)
+	}
+	r.invited[room.Cookie][util.NormalizeScreenName(screenName)] = now.Add(ChatInvitationTimeout)
+}
+
+// Admit is whether the screen name can have a connection to the room. Users invited to it get
+// in once, even when it's full.
+func (r *ChatRegistry) Admit(room *models.ChatRoom, screenName string, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name := util.NormalizeScreenName(screenName)
+	if until, ok := r.invited[room.Cookie][name]; ok {
+		delete(r.invited[room.Cookie], name)
+		if len(r.invited[room.Cookie]) == 0 {
+			delete(r.invited, room.Cookie)
+		}
+		if !now.After(until) {
+			return true
+		}
+	}
+
+	members, ok := r.rooms[room.Cookie]
+	return !ok || len(members.Participants) < ChatMaxOccupancy
+}
+
+// Join adds the session to the room and returns everyone who was already in it
+func (r *ChatRegistry) Join(room *models.ChatRoom, session *oscar.Session, user *models.User) []chatParticipant {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	members, ok := r.rooms[room.Cookie]
+	if !ok {
+		members = &chatRoomMembers{
+			Room:         room,
+			Participants: make(map[*oscar.Session]*models.User),
+		}
+		r.rooms[room.Cookie] = members
+	}
+
+	others := members.list()
+	members.Participants[session] = user
+	return others
+}
+
+// Leave removes the session from every room it is in. Returns the rooms it left, with who is
+// still in each of them.
+func (r *ChatRegistry) Leave(session *oscar.Session) map[*models.ChatRoom][]chatParticipant {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	left := make(map[*models.ChatRoom][]chatParticipant)
+	for cookie, members := range r.rooms {
+		if _, ok := members.Participants[session]; !ok {
+			continue
+		}
+
+		delete(members.Participants, session)
+		left[members.Room] = members.list()
+
+		if len(members.Participants) == 0 {
+			delete(r.rooms, cookie)
+		}
+	}
+	return left
+}
+
+// Close forgets the room with the cookie and the invitations to it, and returns who was in it
+func (r *ChatRegistry) Close(cookie string) []chatParticipant {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.invited, cookie)
+	members, ok := r.rooms[cookie]
+	if !ok {
+		return nil
+	}
+	delete(r.rooms, cookie)
+	return members.list()
+}
+
+// Participants is everyone in the room with the cookie
+func (r *ChatRegistry) Participants(cookie string) []chatParticipant {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	members, ok := r.rooms[cookie]
+	if !ok {
+		return nil
+	}
+	return members.list()
+}
+
+func (m *chatRoomMembers) list() []chatParticipant {
+	participants := make([]chatParticipant, 0, len(m.Participants))
+	for session, user := range m.Participants {
+		participants = append(participants, chatParticipant{User: user, Session: session})
+	}
+	return participants
+}
+
+type ChatService struct {
+	Registry *ChatRegistry
+
+	// Filter checks the text of messages to the room before they are sent on. Nil lets
+	// everything through.
+	Filter MessageFilter
+}
+
+// chatMessageText is the text of a chat message information block (TLV 0x05), whose TLV 0x02
+// names its charset
+func chatMessageText(info oscar.TLVList) (string, error) {
+	textTLV, ok := info.Get(0x01)
+	if !ok {
+		return "", errors.New("chat message missing text TLV 0x01")
+	}
+
+	charset := uint16(oscar.CharsetASCII)
+	if charsetTLV, ok := info.Get(0x02); ok {
+		switch name := strings.ToLower(charsetTLV.String()); {
+		case strings.Contains(name, "unicode-2-0"):
+			charset = oscar.CharsetUCS2
+		case strings.Contains(name, "iso-8859-1"):
+			charset = oscar.CharsetLatin1
+		}
+	}
+	return oscar.DecodeText(charset, textTLV.Bytes())
+}
+
+// chatMessageInfo is the message information block with its text replaced, keeping the other
+// TLVs, like the language, as they were
+func chatMessageInfo(info oscar.TLVList, text string) *oscar.TLV {
+	charset, data := oscar.EncodeText(text)
+	charsetName := "us-ascii"
+	switch charset {
+	case oscar.CharsetUCS2:
+		charsetName = "unicode-2-0"
+	case oscar.CharsetLatin1:
+		charsetName = "iso-8859-1"
+	}
+
+	buf := oscar.Buffer{}
+	buf.WriteBinary(oscar.NewTLV(0x01, data))
+	buf.WriteBinary(oscar.NewTLVString(0x02, charsetName))
+	for _, tlv := range info {
+		if tlv.Type != 0x01 && tlv.Type != 0x02 {
+			buf.WriteBinary(tlv)
+		}
+	}
+	return oscar.NewTLV(0x05, buf.Bytes())
+}
+
+// chatUserInfo is the user info block for a chat participant
+func chatUserInfo(user *models.User) []byte {
+	buf := oscar.Buffer{}
+	buf.WriteLPString(user.ScreenName)
+	buf.WriteUint16(user.WarningLevel)
+	buf.WriteUint16(1) // number of TLVs
+	buf.WriteBinary(oscar.NewTLV(0x01, util.Word(UserClass(user))))
+	return buf.Bytes()
+}
+
+// fanOut queues a copy of the SNAC to each participant. Participants whose queue is full are
+// disconnected rather than holding up the room.
+func (c *ChatService) fanOut(snac *oscar.SNAC, participants []chatParticipant) {
+	data, err := snac.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	for _, participant := range participants {
+		flap := oscar.NewFLAP(2)
+		flap.Data.Write(data)
+		if err := participant.Session.Send(flap); err != nil && participant.Session.Logger != nil {
+			participant.Session.Logger.Error("could not queue chat SNAC", "screen_name", participant.User.ScreenName, "err", err.Error())
+		}
+	}
+}
+
+// Join puts the session in the room, sends it the room info and the people already there, and
+// tells them that the user joined
+func (c *ChatService) Join(ctx context.Context, room *models.ChatRoom) error {
+	session, _ := oscar.SessionFromContext(ctx)
+	user := models.UserFromContext(ctx)
+	if user == nil {
+		return errors.New("no user to join chat room")
+	}
+
+	others := c.Registry.Join(room, session, user)
+
+	infoSnac := oscar.NewSNAC(0x0e, 0x02)
+	infoSnac.Data.Write(chatRoomInfoFromModel(room).Bytes())
+	infoFlap := oscar.NewFLAP(2)
+	infoFlap.Data.WriteBinary(infoSnac)
+	if err := session.Send(infoFlap); err != nil {
+		return err
+	}
+
+	// Everyone in the room, including the user, as far as the user is concerned
+	joinedSnac := oscar.NewSNAC(0x0e, 0x03)
+	joinedSnac.Data.Write(chatUserInfo(user))
+	for _, other := range others {
+		joinedSnac.Data.Write(chatUserInfo(other.User))
+	}
+	joinedFlap := oscar.NewFLAP(2)
+	joinedFlap.Data.WriteBinary(joinedSnac)
+	if err := session.Send(joinedFlap); err != nil {
+		return err
+	}
+
+	arrivedSnac := oscar.NewSNAC(0x0e, 0x03)
+	arrivedSnac.Data.Write(chatUserInfo(user))
+	c.fanOut(arrivedSnac, others)
+
+	return nil
+}
+
+// Leave takes the session out of its rooms and tells everyone left in them
+func (c *ChatService) Leave(ctx context.Context) {
+	session, _ := oscar.SessionFromContext(ctx)
+	user := models.UserFromContext(ctx)
+	if session == nil || user == nil {
+		return
+	}
+
+	for _, remaining := range c.Registry.Leave(session) {
+		leftSnac := oscar.NewSNAC(0x0e, 0x04)
+		leftSnac.Data.Write(chatUserInfo(user))
+		c.fanOut(leftSnac, remaining)
+	}
+}
+
+// Close evicts everyone from the room. Each of them is told that everyone left, themselves
+// included, and their connection to the room is closed. Returns how many were in it.
+func (c *ChatService) Close(room *models.ChatRoom) int {
+	participants := c.Registry.Close(room.Cookie)
+	if len(participants) == 0 {
+		return 0
+	}
+
+	leftSnac := oscar.NewSNAC(0x0e, 0x04)
+	for _, participant := range participants {
+		leftSnac.Data.Write(chatUserInfo(participant.User))
+	}
+	c.fanOut(leftSnac, participants)
+
+	for _, participant := range participants {
+		participant.Session.Disconnect()
+	}
+	return len(participants)
+}
+
+func (c *ChatService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "chat")
+
+	switch snac.Header.Subtype {
+
+	// Client sends a message to the room
+	case 0x05:
+		user := models.UserFromContext(ctx)
+		room := ChatRoomFromContext(ctx)
+		if user == nil || room == nil {
+			return ctx, errors.New("chat message outside of a chat room")
+		}
+
+		cookie, err := snac.Data.ReadBytes(8)
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read message cookie")
+		}
+
+		channel, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read message channel")
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read message TLVs")
+		}
+
+		messageTLV := oscar.FindTLV(tlvs, 0x05)
+		if messageTLV == nil {
+			return ctx, errors.New("chat message missing message TLV 0x05")
+		}
+
+		if c.Filter != nil {
+			info, err := oscar.UnmarshalTLVs(messageTLV.Bytes())
+			if err != nil {
+				return ctx, errors.Wrap(err, "could not read message information TLVs")
+			}
+			text, err := chatMessageText(info)
+			if err != nil {
+				return ctx, err
+			}
+
+			filtered, action, err := filterMessage(ctx, c.Filter, user.ScreenName, room.Name, text)
+			if err != nil {
+				return ctx, err
+			}
+			switch action {
+			case FilterBlock:
+				logger.Info("chat message blocked by filter", "room", room.Name)
+				errFlap := oscar.NewFLAP(2)
+				errFlap.Data.WriteBinary(oscar.NewSNACError(0x0e, snac.Header.RequestID, aimerror.CodeRequestDenied))
+				return ctx, session.Send(errFlap)
+			case FilterRedact:
+				messageTLV = chatMessageInfo(info, filtered)
+			}
+		}
+
+		messageSnac := oscar.NewSNAC(0x0e, 0x06)
+		messageSnac.Data.Write(cookie)
+		messageSnac.Data.WriteUint16(channel)
+		messageSnac.WriteTLV(oscar.NewTLV(0x03, chatUserInfo(user)))
+		messageSnac.WriteTLV(oscar.NewTLV(0x01, []byte{})) // public message
+		messageSnac.WriteTLV(messageTLV)
+
+		participants := c.Registry.Participants(room.Cookie)
+
+		// The sender only gets their own message back if they asked for it
+		reflect := oscar.FindTLV(tlvs, 0x06) != nil
+		recipients := make([]chatParticipant, 0, len(participants))
+		for _, participant := range participants {
+			if participant.Session == session && !reflect {
+				continue
+			}
+			recipients = append(recipients, participant)
+		}
+
+		c.fanOut(messageSnac, recipients)
+		return ctx, nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown chat family/subtype: 0x0e, 0x%02x", snac.Header.Subtype))
+
+	return ctx, aimerror.NotSupported
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// fakeClient is a connection for the user whose SNACs from the server can be read off snacs
+func fakeClient(t *testing.T, screenName string) (context.Context, chan *oscar.SNAC) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := oscar.NewContextWithSession(context.Background(), server, logger)
+	ctx = models.NewContextWithUser(ctx, &models.User{ScreenName: screenName})
+
+	snacs := make(chan *oscar.SNAC, 16)
+	go func() {
+		for {
+			header := make([]byte, 6)
+			if _, err := io.ReadFull(client, header); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+			if _, err := io.ReadFull(client, data); err != nil {
+				return
+			}
+
+			snac := &oscar.SNAC{}
+			if err := snac.UnmarshalBinary(data); err != nil {
+				return
+			}
+			snacs <- snac
+		}
+	}()
+
+	return ctx, snacs
+}
+
+// fakeChatClient is a chat connection to the room for the user
+func fakeChatClient(t *testing.T, room *models.ChatRoom, screenName string) (context.Context, chan *oscar.SNAC) {
+	ctx, snacs := fakeClient(t, screenName)
+	return NewContextWithChatRoom(NewContextWithServiceFamily(ctx, 0x0e), room), snacs
+}
+
+func expectSNAC(t *testing.T, snacs chan *oscar.SNAC, family, subtype uint16) *oscar.SNAC {
+	t.Helper()
+	select {
+	case snac := <-snacs:
+		if snac.Header.Family != family || snac.Header.Subtype != subtype {
+			t.Fatalf("expected SNAC(0x%02x, 0x%02x), got %s", family, subtype, snac)
+		}
+		return snac
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for SNAC(0x%02x, 0x%02x)", family, subtype)
+	}
+	return nil
+}
+
+func expectNoSNAC(t *testing.T, snacs chan *oscar.SNAC) {
+	t.Helper()
+	select {
+	case snac := <-snacs:
+		t.Fatalf("expected no SNAC, got %s", snac)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func chatMessage(reflect bool) *oscar.SNAC {
+	snac := oscar.NewSNAC(0x0e, 0x05)
+	snac.Data.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8}) // cookie
+	snac.Data.WriteUint16(3)                        // channel
+	snac.WriteTLV(oscar.NewTLV(0x01, []byte{}))
+	if reflect {
+		snac.WriteTLV(oscar.NewTLV(0x06, []byte{}))
+	}
+	text, _ := oscar.NewTLV(0x01, []byte("hello")).MarshalBinary()
+	snac.WriteTLV(oscar.NewTLV(0x05, text)) // message info with the text in TLV 0x01
+	return snac
+}
+
+func TestChatJoinMessageLeave(t *testing.T) {
+	room := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: "room", Name: "Room", CreatedAt: time.Now()}
+	chat := &ChatService{Registry: NewChatRegistry()}
+
+	aliceCtx, alice := fakeChatClient(t, room, "alice")
+	bobCtx, bob := fakeChatClient(t, room, "bob")
+
+	if err := chat.Join(aliceCtx, room); err != nil {
+		t.Fatalf("alice could not join: %s", err)
+	}
+	expectSNAC(t, alice, 0x0e, 0x02)
+	expectSNAC(t, alice, 0x0e, 0x03)
+
+	if err := chat.Join(bobCtx, room); err != nil {
+		t.Fatalf("bob could not join: %s", err)
+	}
+	expectSNAC(t, bob, 0x0e, 0x02)
+	joined := expectSNAC(t, bob, 0x0e, 0x03)
+	if name, _ := joined.Data.ReadLPString(); name != "bob" {
+		t.Errorf("expected bob to be first in their own join list, got %s", name)
+	}
+
+	arrived := expectSNAC(t, alice, 0x0e, 0x03)
+	if name, _ := arrived.Data.ReadLPString(); name != "bob" {
+		t.Errorf("expected alice to hear bob joined, got %s", name)
+	}
+
+	// Without the reflect TLV only the others get the message
+	if _, err := chat.HandleSNAC(aliceCtx, nil, chatMessage(false)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	message := expectSNAC(t, bob, 0x0e, 0x06)
+	if cookie, _ := message.Data.ReadBytes(8); cookie[7] != 8 {
+		t.Errorf("expected the message cookie to be relayed, got %v", cookie)
+	}
+	expectNoSNAC(t, alice)
+
+	// With it the sender gets their message too
+	if _, err := chat.HandleSNAC(aliceCtx, nil, chatMessage(true)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectSNAC(t, bob, 0x0e, 0x06)
+	expectSNAC(t, alice, 0x0e, 0x06)
+
+	chat.Leave(bobCtx)
+	left := expectSNAC(t, alice, 0x0e, 0x04)
+	if name, _ := left.Data.ReadLPString(); name != "bob" {
+		t.Errorf("expected alice to hear bob left, got %s", name)
+	}
+
+	if participants := chat.Registry.Participants(room.Cookie); len(participants) != 1 {
+		t.Errorf("expected 1 participant left, got %d", len(participants))
+	}
+
+	chat.Leave(aliceCtx)
+	if participants := chat.Registry.Participants(room.Cookie); participants != nil {
+		t.Errorf("expected the empty room to be removed, got %v", participants)
+	}
+}
+
+func TestChatRegistryAdmit(t *testing.T) {
+	room := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: "room", Name: "Room", CreatedAt: time.Now()}
+	registry := NewChatRegistry()
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < ChatMaxOccupancy; i++ {
+		if !registry.Admit(room, "someone", now) {
+			t.Fatalf("expected user %d to be let into the room", i)
+		}
+		registry.Join(room, &oscar.Session{}, &models.User{ScreenName: fmt.Sprintf("user%d", i)})
+	}
+	if registry.Admit(room, "bob", now) {
+		t.Errorf("expected a full room to refuse bob")
+	}
+
+	// bob gets in once after accepting an invitation, however their screen name is written
+	registry.Invite(room, "Bob", now)
+	if !registry.Admit(room, "b o b", now.Add(time.Minute)) {
+		t.Errorf("expected bob to be let in with their invitation")
+	}
+	if registry.Admit(room, "bob", now.Add(time.Minute)) {
+		t.Errorf("expected the invitation to be used up")
+	}
+
+	registry.Invite(room, "bob", now)
+	if registry.Admit(room, "bob", now.Add(ChatInvitationTimeout+time.Second)) {
+		t.Errorf("expected the invitation to have run out")
+	}
+	if len(registry.invited) != 0 {
+		t.Errorf("expected no invitations left, got %v", registry.invited)
+	}
+}
+
+func TestChatClose(t *testing.T) {
+	room := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: "room", Name: "Room", CreatedAt: time.Now()}
+	chat := &ChatService{Registry: NewChatRegistry()}
+
+	aliceCtx, alice := fakeChatClient(t, room, "alice")
+	bobCtx, bob := fakeChatClient(t, room, "bob")
+	for _, ctx := range []context.Context{aliceCtx, bobCtx} {
+		if err := chat.Join(ctx, room); err != nil {
+			t.Fatalf("could not join: %s", err)
+		}
+	}
+	registry := chat.Registry
+	registry.Invite(room, "carol", time.Now())
+
+	if evicted := chat.Close(room); evicted != 2 {
+		t.Errorf("expected 2 to be evicted, got %d", evicted)
+	}
+
+	// Everyone is told that everyone left, themselves included
+	for name, snacs := range map[string]chan *oscar.SNAC{"alice": alice, "bob": bob} {
+		var left *oscar.SNAC
+		for left == nil {
+			select {
+			case snac := <-snacs:
+				if snac.Header.Subtype == 0x04 {
+					left = snac
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected %s to be told everyone left", name)
+			}
+		}
+		names := map[string]bool{}
+		for len(left.Data.Bytes()) > 0 {
+			screenName, _ := left.Data.ReadLPString()
+			left.Data.ReadUint16() // warning level
+			count, _ := left.Data.ReadUint16()
+			left.Data.ReadTLVs(int(count))
+			names[screenName] = true
+		}
+		if !names["alice"] || !names["bob"] || len(names) != 2 {
+			t.Errorf("expected %s to be told alice and bob left, got %v", name, names)
+		}
+	}
+
+	for _, ctx := range []context.Context{aliceCtx, bobCtx} {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("expected the chat connections to be closed")
+		}
+	}
+	if len(registry.Participants(room.Cookie)) != 0 || len(registry.invited) != 0 {
+		t.Errorf("expected the room to be forgotten")
+	}
+	if chat.Close(room) != 0 {
+		t.Errorf("expected closing the room again to evict nobody")
+	}
+}
+
+func TestChatMessageFilter(t *testing.T) {
+	room := &models.ChatRoom{Exchange: ChatExchangePublic, Cookie: "room", Name: "Room", CreatedAt: time.Now()}
+	chat := &ChatService{Registry: NewChatRegistry(), Filter: testWordFilter(t, "hello\n")}
+
+	aliceCtx, alice := fakeChatClient(t, room, "alice")
+	bobCtx, bob := fakeChatClient(t, room, "bob")
+	for _, ctx := range []context.Context{aliceCtx, bobCtx} {
+		if err := chat.Join(ctx, room); err != nil {
+			t.Fatalf("could not join: %s", err)
+		}
+	}
+	expectSNAC(t, alice, 0x0e, 0x02)
+	expectSNAC(t, alice, 0x0e, 0x03)
+	expectSNAC(t, bob, 0x0e, 0x02)
+	expectSNAC(t, bob, 0x0e, 0x03)
+	expectSNAC(t, alice, 0x0e, 0x03)
+
+	// bob gets the message with the word blanked out
+	if _, err := chat.HandleSNAC(aliceCtx, nil, chatMessage(false)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	message := expectSNAC(t, bob, 0x0e, 0x06)
+	message.Data.ReadBytes(10) // cookie and channel
+	tlvs, _ := oscar.UnmarshalTLVs(message.Data.Bytes())
+	infoTLV, _ := tlvs.Get(0x05)
+	info, _ := oscar.UnmarshalTLVs(infoTLV.Bytes())
+	if text, _ := chatMessageText(info); text != "*****" {
+		t.Errorf("expected the message to be redacted, got %q", text)
+	}
+
+	// Blocked messages only get the sender an error
+	chat.Filter = testWordFilter(t, "!hello\n")
+	if _, err := chat.HandleSNAC(aliceCtx, nil, chatMessage(false)); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	errSnac := expectSNAC(t, alice, 0x0e, 0x01)
+	if code, _ := errSnac.Data.ReadUint16(); code != 0x0d {
+		t.Errorf("expected error 0x0d, got 0x%02x", code)
+	}
+	expectNoSNAC(t, bob)
+}
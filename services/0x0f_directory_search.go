@@ -1,6 +1,7 @@
 package services
 
 import (
+	"aim-oscar/aimerror"
 	"aim-oscar/oscar"
 	"context"
 
@@ -10,5 +11,5 @@ import (
 type DirectorySearchService struct{}
 
 func (d *DirectorySearchService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
-	return ctx, nil
+	return ctx, aimerror.NotSupported
 }
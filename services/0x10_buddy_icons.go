@@ -0,0 +1,331 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// MaxBuddyIconSize is the largest buddy icon, in bytes, that can be uploaded
+const MaxBuddyIconSize = 8192
+
+// BART (buddy art) item types
+const (
+	BARTTypeBuddyIconSmall = 0x0000
+	BARTTypeBuddyIcon      = 0x0001
+	BARTTypeStatusText     = 0x0002
+)
+
+// BART flags
+const (
+	BARTFlagKnown = 0x01
+	// The item carries its data in place of a hash, like the text of an available message
+	BARTFlagData = 0x04
+	// The server doesn't have the item and wants the client to upload it
+	BARTFlagUpload = 0x40
+)
+
+// Result codes for BART uploads and downloads
+const (
+	BARTReplySuccess     = 0x00
+	BARTReplyInvalid     = 0x01
+	BARTReplyTooSmall    = 0x03
+	BARTReplyTooBig      = 0x04
+	BARTReplyInvalidType = 0x05
+	BARTReplyNotFound    = 0x07
+)
+
+type BuddyIconService struct {
+	OnlineCh chan *PresenceEvent
+}
+
+// bartID identifies a BART item by its type and hash
+type bartID struct {
+	Type  uint16
+	Flags uint8
+	Hash  []byte
+}
+
+func (b *bartID) Bytes() []byte {
+	buf := oscar.Buffer{}
+	buf.WriteUint16(b.Type)
+	buf.WriteUint8(b.Flags)
+	buf.WriteUint8(uint8(len(b.Hash)))
+	buf.Write(b.Hash)
+	return buf.Bytes()
+}
+
+func readBARTID(buf *oscar.Buffer) (*bartID, error) {
+	id := &bartID{}
+	var err error
+
+	if id.Type, err = buf.ReadUint16(); err != nil {
+		return nil, errors.Wrap(err, "could not read BART type")
+	}
+
+	if id.Flags, err = buf.ReadUint8(); err != nil {
+		return nil, errors.Wrap(err, "could not read BART flags")
+	}
+
+	hashLength, err := buf.ReadUint8()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read BART hash length")
+	}
+
+	if id.Hash, err = buf.ReadBytes(int(hashLength)); err != nil {
+		return nil, errors.Wrap(err, "could not read BART hash")
+	}
+
+	return id, nil
+}
+
+// MaxStatusTextLength is the longest available message that fits in a BART item, whose data
+// length is a single byte
+const MaxStatusTextLength = 251
+
+// statusTextBARTID is the BART item for an available message. Its data is the word
+// length-prefixed text followed by an empty encoding.
+func statusTextBARTID(message string) *bartID {
+	if len(message) > MaxStatusTextLength {
+		message = message[:MaxStatusTextLength]
+	}
+
+	buf := oscar.Buffer{}
+	buf.WriteUint16(uint16(len(message)))
+	buf.WriteString(message)
+	buf.WriteUint16(0)
+	return &bartID{Type: BARTTypeStatusText, Flags: BARTFlagData, Hash: buf.Bytes()}
+}
+
+// readStatusText reads the available message out of a status text BART item
+func readStatusText(id *bartID) (string, error) {
+	if len(id.Hash) == 0 {
+		return "", nil
+	}
+
+	buf := oscar.Buffer{}
+	buf.Write(id.Hash)
+	length, err := buf.ReadUint16()
+	if err != nil {
+		return "", errors.Wrap(err, "could not read status text length")
+	}
+	message, err := buf.ReadBytes(int(length))
+	if err != nil {
+		return "", errors.Wrap(err, "could not read status text")
+	}
+	return string(message), nil
+}
+
+// readBARTIDs reads the BART items packed one after another in a BART info TLV
+func readBARTIDs(data []byte) ([]*bartID, error) {
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	var ids []*bartID
+	for len(buf.Bytes()) > 0 {
+		id, err := readBARTID(&buf)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// BARTInfoTLV is the BART info TLV (0x1d) advertising the user's buddy icon and available
+// message to others. Returns nil if they have neither.
+func BARTInfoTLV(user *models.User, session *oscar.Session) *oscar.TLV {
+	buf := oscar.Buffer{}
+	if len(user.BuddyIconHash) > 0 {
+		id := &bartID{Type: BARTTypeBuddyIcon, Flags: BARTFlagKnown, Hash: user.BuddyIconHash}
+		buf.Write(id.Bytes())
+	}
+	if session != nil {
+		if message := session.AvailableMessage(); message != "" {
+			buf.Write(statusTextBARTID(message).Bytes())
+		}
+	}
+
+	if len(buf.Bytes()) == 0 {
+		return nil
+	}
+	return oscar.NewTLV(0x1d, buf.Bytes())
+}
+
+// validBuddyIcon checks an uploaded icon and returns the BART reply code for it
+func validBuddyIcon(data []byte) uint8 {
+	switch {
+	case len(data) == 0:
+		return BARTReplyTooSmall
+	case len(data) > MaxBuddyIconSize:
+		return BARTReplyTooBig
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return BARTReplySuccess
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}): // JPEG
+		return BARTReplySuccess
+	case bytes.HasPrefix(data, []byte("BM")): // BMP
+		return BARTReplySuccess
+	default:
+		return BARTReplyInvalidType
+	}
+}
+
+func (b *BuddyIconService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "buddy icons")
+
+	switch snac.Header.Subtype {
+
+	// Client uploads their buddy icon
+	case 0x02:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		bartType, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read BART type")
+		}
+
+		length, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read icon length")
+		}
+
+		data, err := snac.Data.ReadBytes(int(length))
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read icon")
+		}
+
+		id := &bartID{Type: bartType}
+		code := validBuddyIcon(data)
+		if bartType != BARTTypeBuddyIcon && bartType != BARTTypeBuddyIconSmall {
+			code = BARTReplyInvalid
+		}
+
+		if code == BARTReplySuccess {
+			icon, err := models.StoreBuddyIcon(ctx, db, data)
+			if err != nil {
+				return ctx, err
+			}
+			id.Flags = BARTFlagKnown
+			id.Hash = icon.Hash
+
+			user.BuddyIconHash = icon.Hash
+			if err := user.Update(ctx, db, "buddy_icon_hash"); err != nil {
+				return ctx, errors.Wrap(err, "could not set buddy icon")
+			}
+
+			// Buddies find out about the new icon with the user's presence
+			b.OnlineCh <- StatusChanged(user)
+		}
+
+		ackSnac := oscar.NewReplySNAC(snac, 0x10, 0x03)
+		ackSnac.Data.WriteUint8(code)
+		ackSnac.Data.Write(id.Bytes())
+		ackFlap := oscar.NewFLAP(2)
+		ackFlap.Data.WriteBinary(ackSnac)
+		return models.NewContextWithUser(ctx, user), session.Send(ackFlap)
+
+	// Client wants someone's buddy icon
+	case 0x04:
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil || screenName == "" {
+			return ctx, errors.New("could not read screen name")
+		}
+
+		count, err := snac.Data.ReadUint8()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read number of icons")
+		}
+
+		for i := 0; i < int(count); i++ {
+			id, err := readBARTID(&snac.Data)
+			if err != nil {
+				return ctx, err
+			}
+
+			icon, err := models.BuddyIconByHash(ctx, db, id.Hash)
+			if err != nil {
+				return ctx, err
+			}
+
+			// Old clients can't be told an icon is missing, so they get an empty one
+			var data []byte
+			if icon != nil {
+				data = icon.Data
+			}
+
+			iconSnac := oscar.NewReplySNAC(snac, 0x10, 0x05)
+			iconSnac.Data.WriteLPString(screenName)
+			iconSnac.Data.Write(id.Bytes())
+			iconSnac.Data.WriteUint16(uint16(len(data)))
+			iconSnac.Data.Write(data)
+			iconFlap := oscar.NewFLAP(2)
+			iconFlap.Data.WriteBinary(iconSnac)
+			if err := session.Send(iconFlap); err != nil {
+				return ctx, err
+			}
+		}
+
+		return ctx, nil
+
+	// Client wants someone's buddy icons, and to be told about the ones that don't exist
+	case 0x06:
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil || screenName == "" {
+			return ctx, errors.New("could not read screen name")
+		}
+
+		count, err := snac.Data.ReadUint8()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read number of icons")
+		}
+
+		for i := 0; i < int(count); i++ {
+			id, err := readBARTID(&snac.Data)
+			if err != nil {
+				return ctx, err
+			}
+
+			icon, err := models.BuddyIconByHash(ctx, db, id.Hash)
+			if err != nil {
+				return ctx, err
+			}
+
+			code := uint8(BARTReplySuccess)
+			var data []byte
+			if icon == nil {
+				code = BARTReplyNotFound
+			} else {
+				data = icon.Data
+			}
+
+			iconSnac := oscar.NewReplySNAC(snac, 0x10, 0x07)
+			iconSnac.Data.WriteLPString(screenName)
+			iconSnac.Data.Write(id.Bytes())
+			iconSnac.Data.WriteUint8(code)
+			iconSnac.Data.Write(id.Bytes())
+			iconSnac.Data.WriteUint16(uint16(len(data)))
+			iconSnac.Data.Write(data)
+			iconFlap := oscar.NewFLAP(2)
+			iconFlap.Data.WriteBinary(iconSnac)
+			if err := session.Send(iconFlap); err != nil {
+				return ctx, err
+			}
+		}
+
+		return ctx, nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown buddy icon family/subtype: 0x10, 0x%02x", snac.Header.Subtype))
+
+	return ctx, aimerror.NotSupported
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"testing"
+)
+
+func TestValidBuddyIcon(t *testing.T) {
+	tt := map[string]struct {
+		data     []byte
+		expected uint8
+	}{
+		"gif":   {[]byte("GIF89a\x01\x00"), BARTReplySuccess},
+		"jpeg":  {[]byte{0xff, 0xd8, 0xff, 0xe0}, BARTReplySuccess},
+		"bmp":   {[]byte("BM\x00\x00"), BARTReplySuccess},
+		"png":   {[]byte("\x89PNG\r\n\x1a\n"), BARTReplyInvalidType},
+		"empty": {[]byte{}, BARTReplyTooSmall},
+		"big":   {append([]byte("GIF89a"), make([]byte, MaxBuddyIconSize)...), BARTReplyTooBig},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if code := validBuddyIcon(tc.data); code != tc.expected {
+				t.Errorf("expected reply code %d, got %d", tc.expected, code)
+			}
+		})
+	}
+}
+
+func TestBARTInfoTLV(t *testing.T) {
+	if tlv := BARTInfoTLV(&models.User{}, &oscar.Session{}); tlv != nil {
+		t.Errorf("expected no TLV for a user without an icon or available message, got %v", tlv)
+	}
+
+	hash := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	tlv := BARTInfoTLV(&models.User{BuddyIconHash: hash}, nil)
+	if tlv == nil || tlv.Type != 0x1d {
+		t.Fatalf("expected BART info TLV 0x1d, got %v", tlv)
+	}
+
+	expected := append([]byte{0x00, 0x01, BARTFlagKnown, 16}, hash...)
+	if !bytes.Equal(tlv.Data, expected) {
+		t.Errorf("expected BART info %v, got %v", expected, tlv.Data)
+	}
+
+	session := &oscar.Session{}
+	session.SetAvailableMessage("at lunch")
+	tlv = BARTInfoTLV(&models.User{BuddyIconHash: hash}, session)
+	ids, err := readBARTIDs(tlv.Data)
+	if err != nil {
+		t.Fatalf("could not read BART IDs back: %s", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected an icon and a status text item, got %d items", len(ids))
+	}
+	if ids[0].Type != BARTTypeBuddyIcon || !bytes.Equal(ids[0].Hash, hash) {
+		t.Errorf("unexpected icon BART ID read back %+v", ids[0])
+	}
+	if ids[1].Type != BARTTypeStatusText || ids[1].Flags != BARTFlagData {
+		t.Errorf("unexpected status text BART ID read back %+v", ids[1])
+	}
+	if message, err := readStatusText(ids[1]); err != nil || message != "at lunch" {
+		t.Errorf("expected available message \"at lunch\", got %q (%v)", message, err)
+	}
+}
+
+func TestReadStatusText(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		expected string
+		err      bool
+	}{
+		{"empty block clears the message", nil, "", false},
+		{"with encoding", []byte{0x00, 0x02, 'h', 'i', 0x00, 0x00}, "hi", false},
+		{"without encoding", []byte{0x00, 0x02, 'h', 'i'}, "hi", false},
+		{"truncated", []byte{0x00, 0x05, 'h', 'i'}, "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			message, err := readStatusText(&bartID{Type: BARTTypeStatusText, Flags: BARTFlagData, Hash: tc.data})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if message != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, message)
+			}
+		})
+	}
+}
+
+func TestBuddyIconUploadInvalidType(t *testing.T) {
+	ctx, snacs := fakeClient(t, "alice")
+	service := &BuddyIconService{}
+
+	png := []byte("\x89PNG\r\n\x1a\n")
+	upload := oscar.NewSNAC(0x10, 0x02)
+	upload.Data.WriteUint16(BARTTypeBuddyIcon)
+	upload.Data.WriteUint16(uint16(len(png)))
+	upload.Data.Write(png)
+
+	if _, err := service.HandleSNAC(ctx, nil, upload); err != nil {
+		t.Fatalf("could not upload icon: %s", err)
+	}
+
+	ack := expectSNAC(t, snacs, 0x10, 0x03)
+	if code, _ := ack.Data.ReadUint8(); code != BARTReplyInvalidType {
+		t.Errorf("expected reply code %d for a PNG, got %d", BARTReplyInvalidType, code)
+	}
+}
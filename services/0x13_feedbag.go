@@ -1,30 +1,53 @@
 package services
 
 import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
 	"aim-oscar/oscar"
 	"aim-oscar/util"
 	"bytes"
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
-type FeedbagService struct{}
+type FeedbagService struct {
+	OnlineCh chan *PresenceEvent
+
+	// Sessions is where bots are found to tell them who added them. Nil doesn't tell them.
+	Sessions SessionManager
+}
 
 type FeedbagItemType uint16
 
 var (
 	FeedbagItemTypeUser             FeedbagItemType = 0x0000
-	FeedbagItemTypeGroup                            = 0x0001
-	FeedbagItemTypePermit                           = 0x0002
-	FeedbagItemTypeDeny                             = 0x0003
-	FeedbagItemTypePDSetting                        = 0x0004 // permit/deny settings and/or AIM class bitmask
-	FeedbagItemTypePresenceInfo                     = 0x0005
-	FeedbagItemTypeIgnoreList                       = 0x000e
-	FeedbagItemTypeLastUpdateTime                   = 0x000f
-	FeedbagItemTypeRosterImportTime                 = 0x0013
-	FeedbagItemTypeIconInfo                         = 0x0014 // avatar id
+	FeedbagItemTypeGroup            FeedbagItemType = 0x0001
+	FeedbagItemTypePermit           FeedbagItemType = 0x0002
+	FeedbagItemTypeDeny             FeedbagItemType = 0x0003
+	FeedbagItemTypePDSetting        FeedbagItemType = 0x0004 // permit/deny settings and/or AIM class bitmask
+	FeedbagItemTypePresenceInfo     FeedbagItemType = 0x0005
+	FeedbagItemTypeIgnoreList       FeedbagItemType = 0x000e
+	FeedbagItemTypeLastUpdateTime   FeedbagItemType = 0x000f
+	FeedbagItemTypeRosterImportTime FeedbagItemType = 0x0013
+	FeedbagItemTypeIconInfo         FeedbagItemType = 0x0014 // avatar id
+)
+
+// Attributes of a buddy item that the buddy list keeps too
+const (
+	FeedbagAttrAlias = 0x0131
+	FeedbagAttrNote  = 0x013c
+)
+
+// Result codes for each item in a feedbag add/update/delete request
+const (
+	FeedbagStatusSuccess       = 0x0000
+	FeedbagStatusNotFound      = 0x0002
+	FeedbagStatusAlreadyExists = 0x0003
+	FeedbagStatusInvalid       = 0x000a
 )
 
 type FeedbagItem struct {
@@ -38,32 +61,312 @@ type FeedbagItem struct {
 func (f *FeedbagItem) Bytes() []byte {
 	buf := bytes.Buffer{}
 
+	tlvs := bytes.Buffer{}
+	for _, tlv := range f.AdditionalData {
+		b, _ := tlv.MarshalBinary()
+		tlvs.Write(b)
+	}
+
 	buf.Write(util.LPUint16String(f.Name))
 	buf.Write(util.Word(f.GroupID))
 	buf.Write(util.Word(f.ItemID))
 	buf.Write(util.Word(uint16(f.ItemType)))
-	buf.Write(util.Word(uint16(len(f.AdditionalData))))
+	buf.Write(util.Word(uint16(tlvs.Len()))) // length of the TLV block, not the number of TLVs
+	buf.Write(tlvs.Bytes())
+
+	return buf.Bytes()
+}
+
+// feedbagItemFromModel converts a stored item into the wire format
+func feedbagItemFromModel(item *models.Feedbag) (*FeedbagItem, error) {
+	tlvs, err := oscar.UnmarshalTLVs(item.Attributes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid attributes on feedbag item %d", item.ID)
+	}
+
+	return &FeedbagItem{
+		Name:           item.Name,
+		GroupID:        item.GroupId,
+		ItemID:         item.ItemId,
+		ItemType:       FeedbagItemType(item.ClassId),
+		AdditionalData: tlvs,
+	}, nil
+}
+
+// FeedbagBuddyDetails is the alias and note in a buddy item's attributes, empty if it has none
+func FeedbagBuddyDetails(attributes []byte) (alias, note string) {
+	tlvs, _ := oscar.UnmarshalTLVs(attributes)
+	if tlv, ok := tlvs.Get(FeedbagAttrAlias); ok {
+		alias = string(tlv.Data)
+	}
+	if tlv, ok := tlvs.Get(FeedbagAttrNote); ok {
+		note = string(tlv.Data)
+	}
+	return alias, note
+}
+
+// feedbagFromBuddyGroups lays out buddy groups as SSI items: the master group listing the
+// groups, then each group listing its buddies, then the buddies with their aliases and notes
+func feedbagFromBuddyGroups(uin int64, groups []*models.BuddyGroup) []*models.Feedbag {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	master := &models.Feedbag{UserUIN: uin, ClassId: uint16(FeedbagItemTypeGroup)}
+	items := []*models.Feedbag{master}
+	groupIds := oscar.Buffer{}
+	var itemId uint16
+	for i, group := range groups {
+		groupId := uint16(i + 1)
+		groupIds.WriteUint16(groupId)
 
-	if len(f.AdditionalData) > 0 {
-		for _, tlv := range f.AdditionalData {
-			b, _ := tlv.MarshalBinary()
-			buf.Write(b)
+		groupItem := &models.Feedbag{UserUIN: uin, GroupId: groupId, ClassId: uint16(FeedbagItemTypeGroup), Name: group.Name}
+		items = append(items, groupItem)
+		itemIds := oscar.Buffer{}
+		for _, buddy := range group.Buddies {
+			itemId++
+			itemIds.WriteUint16(itemId)
+			attrs := oscar.Buffer{}
+			if buddy.Alias != "" {
+				attrs.WriteBinary(oscar.NewTLVString(FeedbagAttrAlias, buddy.Alias))
+			}
+			if buddy.Note != "" {
+				attrs.WriteBinary(oscar.NewTLVString(FeedbagAttrNote, buddy.Note))
+			}
+			items = append(items, &models.Feedbag{UserUIN: uin, GroupId: groupId, ItemId: itemId, ClassId: uint16(FeedbagItemTypeUser), Name: buddy.Target.ScreenName, Attributes: attrs.Bytes()})
+		}
+		groupItem.Attributes, _ = oscar.NewTLV(0xc8, itemIds.Bytes()).MarshalBinary()
+	}
+	master.Attributes, _ = oscar.NewTLV(0xc8, groupIds.Bytes()).MarshalBinary()
+	return items
+}
+
+// seedFeedbag stores the user's buddy list groups as their SSI list, returning the items
+func seedFeedbag(ctx context.Context, db *bun.DB, user *models.User) ([]*models.Feedbag, error) {
+	groups, err := models.BuddyGroupsOf(ctx, db, user.UIN)
+	if err != nil {
+		return nil, err
+	}
+	items := feedbagFromBuddyGroups(user.UIN, groups)
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	for _, item := range items {
+		item.LastModified = now
+	}
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(&items).Exec(ctx); err != nil {
+			return errors.Wrap(err, "could not add buddy list to feedbag")
+		}
+		_, err := models.BumpFeedbagRevision(ctx, tx, user.UIN)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// AddFeedbagBuddy puts a buddy on the user's SSI list in the named group, adding the group if
+// they don't have it, and sets the alias and note on them when they're given. Buddies already on
+// the list stay in their group. Users without an SSI list are left alone, since theirs is seeded
+// from the buddy list the first time they ask for it. Returns whether the list changed, for the
+// caller to bump its revision.
+func AddFeedbagBuddy(ctx context.Context, db bun.IDB, uin int64, groupName, screenName, alias, note string) (bool, error) {
+	items, err := models.FeedbagForUser(ctx, db, uin)
+	if err != nil {
+		return false, err
+	}
+	if len(items) == 0 {
+		return false, nil
+	}
+	if groupName == "" {
+		groupName = models.DefaultBuddyGroup
+	}
+
+	var master, group *models.Feedbag
+	var maxGroupId uint16
+	for _, item := range items {
+		switch FeedbagItemType(item.ClassId) {
+		case FeedbagItemTypeUser:
+			if util.NormalizeScreenName(item.Name) == util.NormalizeScreenName(screenName) {
+				return setFeedbagBuddyDetails(ctx, db, item, alias, note)
+			}
+		case FeedbagItemTypeGroup:
+			if item.GroupId == 0 {
+				master = item
+			} else if group == nil && item.Name == groupName {
+				group = item
+			}
+		}
+		if item.GroupId > maxGroupId {
+			maxGroupId = item.GroupId
 		}
 	}
 
+	now := time.Now()
+	if group == nil {
+		group = &models.Feedbag{UserUIN: uin, GroupId: maxGroupId + 1, ClassId: uint16(FeedbagItemTypeGroup), Name: groupName, LastModified: now}
+		if _, err := db.NewInsert().Model(group).Exec(ctx); err != nil {
+			return false, errors.Wrap(err, "could not add feedbag group")
+		}
+		if master != nil {
+			if err := appendFeedbagOrder(ctx, db, master, group.GroupId); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	itemId, err := models.NextFeedbagItemId(ctx, db, uin)
+	if err != nil {
+		return false, err
+	}
+	attrs := oscar.Buffer{}
+	if alias != "" {
+		attrs.WriteBinary(oscar.NewTLVString(FeedbagAttrAlias, alias))
+	}
+	if note != "" {
+		attrs.WriteBinary(oscar.NewTLVString(FeedbagAttrNote, note))
+	}
+	buddy := &models.Feedbag{UserUIN: uin, GroupId: group.GroupId, ItemId: itemId, ClassId: uint16(FeedbagItemTypeUser), Name: screenName, Attributes: attrs.Bytes(), LastModified: now}
+	if _, err := db.NewInsert().Model(buddy).Exec(ctx); err != nil {
+		return false, errors.Wrap(err, "could not add feedbag item")
+	}
+	return true, appendFeedbagOrder(ctx, db, group, itemId)
+}
+
+// setFeedbagBuddyDetails sets the alias and note that are given on a buddy item, keeping its
+// other attributes. Returns whether the item changed.
+func setFeedbagBuddyDetails(ctx context.Context, db bun.IDB, item *models.Feedbag, alias, note string) (bool, error) {
+	attrs := item.Attributes
+	if alias != "" {
+		attrs = setFeedbagAttr(attrs, oscar.NewTLVString(FeedbagAttrAlias, alias))
+	}
+	if note != "" {
+		attrs = setFeedbagAttr(attrs, oscar.NewTLVString(FeedbagAttrNote, note))
+	}
+	if bytes.Equal(attrs, item.Attributes) {
+		return false, nil
+	}
+
+	item.Attributes = attrs
+	item.LastModified = time.Now()
+	if _, err := db.NewUpdate().Model(item).WherePK().Exec(ctx); err != nil {
+		return false, errors.Wrap(err, "could not update feedbag item")
+	}
+	return true, nil
+}
+
+// appendFeedbagOrder adds an ID to the end of the order (0xc8) a group item keeps its buddies
+// in, or the master group its groups in
+func appendFeedbagOrder(ctx context.Context, db bun.IDB, group *models.Feedbag, id uint16) error {
+	order := oscar.Buffer{}
+	if tlvs, err := oscar.UnmarshalTLVs(group.Attributes); err == nil {
+		if tlv, ok := tlvs.Get(0xc8); ok {
+			order.Write(tlv.Data)
+		}
+	}
+	order.WriteUint16(id)
+
+	group.Attributes = setFeedbagAttr(group.Attributes, oscar.NewTLV(0xc8, order.Bytes()))
+	group.LastModified = time.Now()
+	if _, err := db.NewUpdate().Model(group).WherePK().Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not update feedbag group")
+	}
+	return nil
+}
+
+// setFeedbagAttr replaces the attribute of the TLV's type in an item's attributes, or adds it if
+// the item doesn't have one
+func setFeedbagAttr(attributes []byte, tlv *oscar.TLV) []byte {
+	tlvs, err := oscar.UnmarshalTLVs(attributes)
+	if err != nil {
+		tlvs = nil
+	}
+
+	buf := oscar.Buffer{}
+	replaced := false
+	for _, existing := range tlvs {
+		if existing.Type == tlv.Type {
+			if replaced {
+				continue
+			}
+			existing, replaced = tlv, true
+		}
+		buf.WriteBinary(existing)
+	}
+	if !replaced {
+		buf.WriteBinary(tlv)
+	}
 	return buf.Bytes()
 }
 
+// feedbagLastModified is when the user's SSI list last changed, from its revision. Lists that
+// haven't changed since revisions were kept go by their newest item.
+func feedbagLastModified(ctx context.Context, db bun.IDB, uin int64, items []*models.Feedbag) (time.Time, error) {
+	rev, err := models.FeedbagRevisionFor(ctx, db, uin)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if rev == nil {
+		return models.FeedbagLastModified(items), nil
+	}
+	return rev.LastModified, nil
+}
+
+// readFeedbagItem reads one item from a feedbag add/update/delete request
+func readFeedbagItem(buf *oscar.Buffer) (*models.Feedbag, error) {
+	name, err := buf.ReadLPUint16String()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read item name")
+	}
+
+	groupId, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read group id")
+	}
+
+	itemId, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read item id")
+	}
+
+	classId, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read class id")
+	}
+
+	attrLength, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read attributes length")
+	}
+
+	attrs, err := buf.ReadBytes(int(attrLength))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read attributes")
+	}
+
+	return &models.Feedbag{
+		GroupId:    groupId,
+		ItemId:     itemId,
+		ClassId:    classId,
+		Name:       name,
+		Attributes: attrs,
+	}, nil
+}
+
 func (f *FeedbagService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, _ := oscar.SessionFromContext(ctx)
-	logger := session.Logger.With("service", "feedbag")
+	logger := oscar.LoggerFromContext(ctx).With("service", "feedbag")
 
 	switch snac.Header.Subtype {
 
 	// Client requests SSI service limitations
 	case 0x02:
 
-		respSnac := oscar.NewSNAC(0x13, 0x3)
+		respSnac := oscar.NewReplySNAC(snac, 0x13, 0x3)
 
 		maxitems := [][]byte{
 			util.Word(0x3D),
@@ -104,22 +407,349 @@ func (f *FeedbagService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar
 
 		return ctx, session.Send(respFlap)
 
-	case 0x04:
-		respSnac := oscar.NewSNAC(0x13, 0x6)
+	// Client requests their whole list, or the list if it changed since the time they have cached
+	case 0x04, 0x05:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
 
-		respSnac.Data.WriteUint8(0) // SSI Version
-		items := []FeedbagItem{}
+		items, err := models.FeedbagForUser(ctx, db, user.UIN)
+		if err != nil {
+			return ctx, err
+		}
+
+		// Users who only had a buddy list from old clients get it on their SSI list, by group
+		if len(items) == 0 {
+			if items, err = seedFeedbag(ctx, db, user); err != nil {
+				return ctx, err
+			}
+		}
+
+		lastModified, err := feedbagLastModified(ctx, db, user.UIN, items)
+		if err != nil {
+			return ctx, err
+		}
+
+		// The client's cached copy is current when it's from the last change and has every item
+		if snac.Header.Subtype == 0x05 {
+			cachedTime, timeErr := snac.Data.ReadUint32()
+			cachedCount, countErr := snac.Data.ReadUint16()
+			if timeErr == nil && countErr == nil && cachedTime == uint32(lastModified.Unix()) && int(cachedCount) == len(items) {
+				unchangedSnac := oscar.NewReplySNAC(snac, 0x13, 0x0f)
+				unchangedSnac.Data.WriteUint32(cachedTime)
+				unchangedSnac.Data.WriteUint16(cachedCount)
 
+				unchangedFlap := oscar.NewFLAP(2)
+				unchangedFlap.Data.WriteBinary(unchangedSnac)
+				return ctx, session.Send(unchangedFlap)
+			}
+		}
+
+		respSnac := oscar.NewReplySNAC(snac, 0x13, 0x6)
+		respSnac.Data.WriteUint8(0) // SSI Version
 		respSnac.Data.WriteUint16(uint16(len(items)))
-		respSnac.Data.WriteUint32(0) // SSI last change time // TODO: add SSI change time
+		for _, item := range items {
+			feedbagItem, err := feedbagItemFromModel(item)
+			if err != nil {
+				return ctx, err
+			}
+			respSnac.Data.Write(feedbagItem.Bytes())
+		}
+		respSnac.Data.WriteUint32(uint32(lastModified.Unix())) // SSI last change time
 
 		respFlap := oscar.NewFLAP(2)
 		respFlap.Data.WriteBinary(respSnac)
 
 		return ctx, session.Send(respFlap)
+
+	// Client activated their SSI list, so start sending presence for the buddies on it
+	case 0x07:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		items, err := models.FeedbagForUser(ctx, db, user.UIN)
+		if err != nil {
+			return ctx, err
+		}
+
+		for _, item := range items {
+			if FeedbagItemType(item.ClassId) != FeedbagItemTypeUser {
+				continue
+			}
+			added, err := f.addBuddy(ctx, db, user, item)
+			if err != nil {
+				return ctx, err
+			}
+			if added != nil {
+				f.OnlineCh <- StatusChanged(added)
+			}
+		}
+
+		f.OnlineCh <- StatusChanged(user)
+		return ctx, nil
+
+	// Client adds, updates or deletes items on their list
+	case 0x08, 0x09, 0x0a:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		// The items change together with the list's revision. A batch of changes bumps it once,
+		// with its first change.
+		ackSnac := oscar.NewReplySNAC(snac, 0x13, 0x0e)
+		var addedBuddies []*models.User
+		bumped := false
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			changed := false
+			for len(snac.Data.Bytes()) > 0 {
+				item, err := readFeedbagItem(&snac.Data)
+				if err != nil {
+					return errors.Wrap(err, "invalid feedbag item")
+				}
+				item.UserUIN = user.UIN
+
+				status, added, err := f.modifyItem(ctx, tx, user, snac.Header.Subtype, item)
+				if err != nil {
+					return err
+				}
+				if added != nil {
+					addedBuddies = append(addedBuddies, added)
+				}
+				changed = changed || status == FeedbagStatusSuccess
+				ackSnac.Data.WriteUint16(status)
+			}
+
+			if !changed || (session.InFeedbagBatch && session.FeedbagBatchBumped) {
+				return nil
+			}
+			if _, err := models.BumpFeedbagRevision(ctx, tx, user.UIN); err != nil {
+				return err
+			}
+			bumped = true
+			return nil
+		})
+		if err != nil {
+			return ctx, err
+		}
+		if bumped && session.InFeedbagBatch {
+			session.FeedbagBatchBumped = true
+		}
+
+		// The permit and deny lists, privacy mode and buddies who may be permitted are all items
+		session.InvalidatePrivacy()
+
+		// Buddies are only looked up for presence once they're committed
+		for _, buddy := range addedBuddies {
+			f.OnlineCh <- StatusChanged(buddy)
+			tellBotAdded(f.Sessions, user, buddy)
+		}
+
+		ackFlap := oscar.NewFLAP(2)
+		ackFlap.Data.WriteBinary(ackSnac)
+		return ctx, session.Send(ackFlap)
+
+	// Client starts a batch of changes
+	case 0x11:
+		session.InFeedbagBatch = true
+		session.FeedbagBatchBumped = false
+		return ctx, nil
+
+	// Client ends a batch of changes
+	case 0x12:
+		session.InFeedbagBatch = false
+		session.FeedbagBatchBumped = false
+		return ctx, nil
 	}
 
 	logger.Error(fmt.Sprintf("Unknown feedbag family/subtype: 0x13, 0x%02x", snac.Header.Subtype))
 
-	return ctx, nil
+	return ctx, aimerror.NotSupported
+}
+
+// modifyItem adds (0x08), updates (0x09) or deletes (0x0a) an item on the user's list and
+// returns the status code to acknowledge it with, and the buddy it added to the buddy list if
+// it did
+func (f *FeedbagService) modifyItem(ctx context.Context, db bun.IDB, user *models.User, subtype uint16, item *models.Feedbag) (uint16, *models.User, error) {
+	if _, err := oscar.UnmarshalTLVs(item.Attributes); err != nil {
+		return FeedbagStatusInvalid, nil, nil
+	}
+
+	existing, err := models.FeedbagItem(ctx, db, user.UIN, item.GroupId, item.ItemId)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var added *models.User
+
+	switch subtype {
+	case 0x08:
+		if existing != nil {
+			return FeedbagStatusAlreadyExists, nil, nil
+		}
+
+		item.LastModified = time.Now()
+		if _, err := db.NewInsert().Model(item).Exec(ctx); err != nil {
+			return 0, nil, errors.Wrap(err, "could not add feedbag item")
+		}
+
+		if FeedbagItemType(item.ClassId) == FeedbagItemTypeUser {
+			if added, err = f.addBuddy(ctx, db, user, item); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case 0x09:
+		if existing == nil {
+			return FeedbagStatusNotFound, nil, nil
+		}
+
+		// Renaming a group renames it on the buddy list too
+		if FeedbagItemType(existing.ClassId) == FeedbagItemTypeGroup && existing.GroupId != 0 && existing.Name != item.Name {
+			if err := models.RenameBuddyGroup(ctx, db, user.UIN, existing.Name, item.Name); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		existing.Name = item.Name
+		existing.ClassId = item.ClassId
+		existing.Attributes = item.Attributes
+		existing.LastModified = time.Now()
+		if _, err := db.NewUpdate().Model(existing).WherePK().Exec(ctx); err != nil {
+			return 0, nil, errors.Wrap(err, "could not update feedbag item")
+		}
+
+		// An update without an alias or note clears them
+		if FeedbagItemType(existing.ClassId) == FeedbagItemTypeUser {
+			if added, err = f.addBuddy(ctx, db, user, existing); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case 0x0a:
+		if existing == nil {
+			return FeedbagStatusNotFound, nil, nil
+		}
+
+		if _, err := db.NewDelete().Model(existing).WherePK().Exec(ctx); err != nil {
+			return 0, nil, errors.Wrap(err, "could not delete feedbag item")
+		}
+
+		switch FeedbagItemType(existing.ClassId) {
+		case FeedbagItemTypeUser:
+			if err := f.removeBuddy(ctx, db, user, existing.Name); err != nil {
+				return 0, nil, err
+			}
+		case FeedbagItemTypeGroup:
+			if existing.GroupId != 0 {
+				if _, err := models.DeleteBuddyGroup(ctx, db, user.UIN, existing.Name); err != nil {
+					return 0, nil, err
+				}
+			}
+		}
+	}
+
+	return FeedbagStatusSuccess, added, nil
+}
+
+// feedbagGroupName is the name of one of the user's SSI groups, or the default group if they
+// don't have it
+func feedbagGroupName(ctx context.Context, db bun.IDB, uin int64, groupId uint16) (string, error) {
+	if groupId == 0 {
+		return models.DefaultBuddyGroup, nil
+	}
+	group, err := models.FeedbagItem(ctx, db, uin, groupId, 0)
+	if err != nil {
+		return "", err
+	}
+	if group == nil || FeedbagItemType(group.ClassId) != FeedbagItemTypeGroup || group.Name == "" {
+		return models.DefaultBuddyGroup, nil
+	}
+	return group.Name, nil
+}
+
+// tellBotAdded sends the "you were added" SNAC (0x13,0x1c) to a bot the user added. AIM clients
+// only expect it for ICQ, so bots are the only ones told.
+func tellBotAdded(sessions SessionManager, user *models.User, buddy *models.User) {
+	if sessions == nil || !buddy.Bot {
+		return
+	}
+	session := sessions.GetSession(buddy.ScreenName)
+	if session == nil {
+		return
+	}
+
+	addedSnac := oscar.NewSNAC(0x13, 0x1c)
+	addedSnac.Data.WriteLPString(user.ScreenName)
+	addedFlap := oscar.NewFLAP(2)
+	addedFlap.Data.WriteBinary(addedSnac)
+	session.Send(addedFlap)
+}
+
+// addBuddy mirrors a buddy item on the SSI list into the buddy list that presence notifications
+// use, in the buddy's SSI group and with its alias and note. Returns the buddy if they weren't on
+// the buddy list yet, for the caller to send their presence once the change is committed.
+func (f *FeedbagService) addBuddy(ctx context.Context, db bun.IDB, user *models.User, item *models.Feedbag) (*models.User, error) {
+	buddy, err := models.UserByScreenName(ctx, db, item.Name)
+	if err != nil {
+		return nil, aimerror.FetchingUser(err, item.Name)
+	}
+
+	// The list can hold screen names that aren't registered with us
+	if buddy == nil {
+		return nil, nil
+	}
+
+	group, err := feedbagGroupName(ctx, db, user.UIN, item.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	added, err := models.AddBuddyToGroup(ctx, db, user.UIN, buddy.UIN, group)
+	if err != nil {
+		return nil, err
+	}
+	alias, note := FeedbagBuddyDetails(item.Attributes)
+	if err := models.SetBuddyDetails(ctx, db, user.UIN, buddy.UIN, alias, note); err != nil {
+		return nil, err
+	}
+	if !added {
+		return nil, nil
+	}
+	return buddy, nil
+}
+
+// removeBuddy removes a buddy from the presence buddy list once it is in none of the user's SSI
+// groups. While it's still in one, the buddy moves to that group.
+func (f *FeedbagService) removeBuddy(ctx context.Context, db bun.IDB, user *models.User, screenName string) error {
+	var remaining []*models.Feedbag
+	err := db.NewSelect().Model(&remaining).
+		Where("user_uin = ?", user.UIN).
+		Where("class_id = ?", uint16(FeedbagItemTypeUser)).
+		Where("lower(replace(name, ' ', '')) = ?", util.NormalizeScreenName(screenName)).
+		Order("id ASC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not fetch feedbag items")
+	}
+
+	buddy, err := models.UserByScreenName(ctx, db, screenName)
+	if err != nil {
+		return aimerror.FetchingUser(err, screenName)
+	}
+	if buddy == nil {
+		return nil
+	}
+
+	if len(remaining) > 0 {
+		group, err := feedbagGroupName(ctx, db, user.UIN, remaining[0].GroupId)
+		if err != nil {
+			return err
+		}
+		return models.MoveBuddy(ctx, db, user.UIN, buddy.UIN, group)
+	}
+	return models.RemoveBuddy(ctx, db, user.UIN, buddy.UIN)
 }
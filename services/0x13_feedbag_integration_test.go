@@ -0,0 +1,163 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"testing"
+)
+
+// Aliases on SSI buddy items are kept per owner, and an update without one clears it
+func TestFeedbagBuddyAliases(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.Buddy)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create buddies table: %s", err)
+	}
+
+	alice, bob, carol := testUser(t, d, "alice"), testUser(t, d, "bob"), testUser(t, d, "carol")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Buddy)(nil)).Where("source_uin IN (?, ?)", alice.UIN, carol.UIN).Exec(ctx)
+	})
+
+	f := &FeedbagService{OnlineCh: make(chan *PresenceEvent, 10)}
+	modify := func(user *models.User, subtype uint16, alias string) {
+		t.Helper()
+		userCtx, snacs := fakeClient(t, user.ScreenName)
+		userCtx = models.NewContextWithUser(userCtx, user)
+
+		attrs := oscar.Buffer{}
+		if alias != "" {
+			attrs.WriteBinary(oscar.NewTLVString(FeedbagAttrAlias, alias))
+		}
+		item := &FeedbagItem{Name: bob.ScreenName, GroupID: 1, ItemID: 1, ItemType: FeedbagItemTypeUser}
+		item.AdditionalData, _ = oscar.UnmarshalTLVs(attrs.Bytes())
+
+		snac := oscar.NewSNAC(0x13, subtype)
+		snac.Data.Write(item.Bytes())
+		if _, err := f.HandleSNAC(userCtx, d, snac); err != nil {
+			t.Fatalf("could not modify feedbag: %s", err)
+		}
+		if status, _ := expectSNAC(t, snacs, 0x13, 0x0e).Data.ReadUint16(); status != FeedbagStatusSuccess {
+			t.Fatalf("expected success, got 0x%04x", status)
+		}
+	}
+	expectAlias := func(user *models.User, expected string) {
+		t.Helper()
+		var buddy models.Buddy
+		if err := d.NewSelect().Model(&buddy).Where("source_uin = ?", user.UIN).Where("with_uin = ?", bob.UIN).Scan(ctx); err != nil {
+			t.Fatalf("could not fetch buddy: %s", err)
+		}
+		if buddy.Alias != expected {
+			t.Errorf("expected %s to alias bob %q, got %q", user.ScreenName, expected, buddy.Alias)
+		}
+	}
+
+	modify(alice, 0x08, "Bobby")
+	modify(carol, 0x08, "Robert")
+	expectAlias(alice, "Bobby")
+	expectAlias(carol, "Robert")
+
+	modify(alice, 0x09, "")
+	expectAlias(alice, "")
+	expectAlias(carol, "Robert")
+}
+
+// A client whose cached list is from the last change is told it's unchanged, and one whose
+// copy is older gets the whole list
+func TestFeedbagUnchanged(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.Buddy)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create buddies table: %s", err)
+	}
+
+	alice := testUser(t, d, "alice")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.Buddy)(nil)).Where("source_uin = ?", alice.UIN).Exec(ctx)
+	})
+
+	f := &FeedbagService{OnlineCh: make(chan *PresenceEvent, 10)}
+	aliceCtx, aliceSNACs := fakeClient(t, alice.ScreenName)
+	aliceCtx = models.NewContextWithUser(aliceCtx, alice)
+
+	send := func(snac *oscar.SNAC) {
+		t.Helper()
+		if _, err := f.HandleSNAC(aliceCtx, d, snac); err != nil {
+			t.Fatalf("could not handle SNAC: %s", err)
+		}
+	}
+	add := func(name string, itemId uint16) {
+		t.Helper()
+		item := &FeedbagItem{Name: name, GroupID: 1, ItemID: itemId, ItemType: FeedbagItemTypeUser}
+		snac := oscar.NewSNAC(0x13, 0x08)
+		snac.Data.Write(item.Bytes())
+		send(snac)
+		expectSNAC(t, aliceSNACs, 0x13, 0x0e)
+	}
+	revision := func() int64 {
+		t.Helper()
+		rev, err := models.FeedbagRevisionFor(ctx, d, alice.UIN)
+		if err != nil || rev == nil {
+			t.Fatalf("expected a revision, got %v %v", rev, err)
+		}
+		return rev.Revision
+	}
+	// checkList asks for the list if it changed since the time and count, returning the
+	// time and count of the list if it's sent
+	checkList := func(cachedTime uint32, cachedCount uint16) (uint32, uint16, bool) {
+		t.Helper()
+		snac := oscar.NewSNAC(0x13, 0x05)
+		snac.Data.WriteUint32(cachedTime)
+		snac.Data.WriteUint16(cachedCount)
+		send(snac)
+
+		reply := <-aliceSNACs
+		switch reply.Header.Subtype {
+		case 0x0f:
+			return cachedTime, cachedCount, false
+		case 0x06:
+			reply.Data.ReadUint8()
+			count, _ := reply.Data.ReadUint16()
+			data := reply.Data.Bytes()
+			lastModified := uint32(data[len(data)-4])<<24 | uint32(data[len(data)-3])<<16 | uint32(data[len(data)-2])<<8 | uint32(data[len(data)-1])
+			return lastModified, count, true
+		}
+		t.Fatalf("expected SNAC(0x13, 0x06) or SNAC(0x13, 0x0f), got %s", reply)
+		return 0, 0, false
+	}
+
+	add("bob", 1)
+	lastModified, count, sent := checkList(0, 0)
+	if !sent || count != 1 {
+		t.Fatalf("expected the whole list with 1 item, got %v %d", sent, count)
+	}
+	if _, _, sent := checkList(lastModified, count); sent {
+		t.Errorf("expected a current copy to be unchanged")
+	}
+
+	// Two changes in one batch are one revision, and even in the same second the cached copy
+	// from before them is stale
+	before := revision()
+	send(oscar.NewSNAC(0x13, 0x11))
+	add("carol", 2)
+	add("dave", 3)
+	send(oscar.NewSNAC(0x13, 0x12))
+	if after := revision(); after != before+1 {
+		t.Errorf("expected the batch to bump the revision once, from %d to %d", before, after)
+	}
+
+	newModified, count, sent := checkList(lastModified, 1)
+	if !sent || count != 3 || newModified <= lastModified {
+		t.Errorf("expected a stale copy to get the whole list of 3 changed after %d, got %v %d %d", lastModified, sent, count, newModified)
+	}
+	if _, _, sent := checkList(newModified, count); sent {
+		t.Errorf("expected the new copy to be unchanged")
+	}
+}
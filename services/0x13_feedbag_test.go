@@ -0,0 +1,98 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"testing"
+)
+
+func TestFeedbagItemRoundTrip(t *testing.T) {
+	item := &models.Feedbag{
+		Name:       "Buddies",
+		GroupId:    1,
+		ItemId:     0,
+		ClassId:    uint16(FeedbagItemTypeGroup),
+		Attributes: []byte{0x00, 0xc8, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02},
+	}
+
+	feedbagItem, err := feedbagItemFromModel(item)
+	if err != nil {
+		t.Fatalf("could not convert item: %s", err)
+	}
+
+	expected := []byte{0, 7, 'B', 'u', 'd', 'd', 'i', 'e', 's', 0, 1, 0, 0, 0, 1, 0, 8, 0x00, 0xc8, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02}
+	if !bytes.Equal(feedbagItem.Bytes(), expected) {
+		t.Errorf("expected item bytes %v, got %v", expected, feedbagItem.Bytes())
+	}
+
+	buf := oscar.Buffer{}
+	buf.Write(feedbagItem.Bytes())
+	read, err := readFeedbagItem(&buf)
+	if err != nil {
+		t.Fatalf("could not read item: %s", err)
+	}
+
+	if read.Name != item.Name || read.GroupId != item.GroupId || read.ItemId != item.ItemId || read.ClassId != item.ClassId || !bytes.Equal(read.Attributes, item.Attributes) {
+		t.Errorf("expected to read %+v, got %+v", item, read)
+	}
+}
+
+func TestReadFeedbagItemTruncated(t *testing.T) {
+	buf := oscar.Buffer{}
+	buf.Write([]byte{0, 7, 'B', 'u', 'd', 'd', 'i', 'e', 's', 0, 1, 0, 0, 0, 1, 0, 8, 0x00})
+	if _, err := readFeedbagItem(&buf); err == nil {
+		t.Errorf("expected truncated item to fail")
+	}
+}
+
+func TestFeedbagFromBuddyGroups(t *testing.T) {
+	groups := []*models.BuddyGroup{
+		{Name: "Friends", Buddies: []*models.Buddy{{Target: &models.User{ScreenName: "bob"}, Alias: "Bobby"}, {Target: &models.User{ScreenName: "carol"}}}},
+		{Name: "Work", Buddies: []*models.Buddy{{Target: &models.User{ScreenName: "dave"}, Note: "boss"}}},
+	}
+
+	items := feedbagFromBuddyGroups(1, groups)
+	if len(items) != 6 {
+		t.Fatalf("expected 6 items, got %d", len(items))
+	}
+
+	expected := []struct {
+		name    string
+		groupId uint16
+		itemId  uint16
+		class   FeedbagItemType
+		attrs   []byte
+	}{
+		{"", 0, 0, FeedbagItemTypeGroup, []byte{0x00, 0xc8, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02}},
+		{"Friends", 1, 0, FeedbagItemTypeGroup, []byte{0x00, 0xc8, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02}},
+		{"bob", 1, 1, FeedbagItemTypeUser, []byte{0x01, 0x31, 0x00, 0x05, 'B', 'o', 'b', 'b', 'y'}},
+		{"carol", 1, 2, FeedbagItemTypeUser, nil},
+		{"Work", 2, 0, FeedbagItemTypeGroup, []byte{0x00, 0xc8, 0x00, 0x02, 0x00, 0x03}},
+		{"dave", 2, 3, FeedbagItemTypeUser, []byte{0x01, 0x3c, 0x00, 0x04, 'b', 'o', 's', 's'}},
+	}
+	for i, e := range expected {
+		item := items[i]
+		if item.UserUIN != 1 || item.Name != e.name || item.GroupId != e.groupId || item.ItemId != e.itemId || FeedbagItemType(item.ClassId) != e.class || !bytes.Equal(item.Attributes, e.attrs) {
+			t.Errorf("expected item %d to be %+v, got %+v", i, e, item)
+		}
+	}
+
+	if items := feedbagFromBuddyGroups(1, nil); items != nil {
+		t.Errorf("expected no items without groups, got %d", len(items))
+	}
+}
+
+func TestFeedbagBuddyDetails(t *testing.T) {
+	attrs := oscar.Buffer{}
+	attrs.WriteBinary(oscar.NewTLVString(FeedbagAttrNote, "met at camp"))
+	attrs.WriteBinary(oscar.NewTLVString(FeedbagAttrAlias, "Bobby"))
+	if alias, note := FeedbagBuddyDetails(attrs.Bytes()); alias != "Bobby" || note != "met at camp" {
+		t.Errorf("expected alias Bobby and note, got %q %q", alias, note)
+	}
+
+	// Without the attributes they're blank, which clears them
+	if alias, note := FeedbagBuddyDetails(nil); alias != "" || note != "" {
+		t.Errorf("expected no alias or note, got %q %q", alias, note)
+	}
+}
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// ICQ meta request and reply types, from the little-endian envelope in TLV 0x01
+const (
+	ICQOfflineMessagesRequest = 0x3c
+	ICQOfflineMessage         = 0x41
+	ICQOfflineMessagesEnd     = 0x42
+	ICQDeleteOfflineMessages  = 0x3e
+	ICQMetaRequest            = 0x07d0
+	ICQMetaReply              = 0x07da
+)
+
+// ICQ meta request subtypes
+const (
+	ICQMetaFullInfoRequest  = 0x04b2
+	ICQMetaFullInfoRequest2 = 0x04d0
+)
+
+// ICQ meta reply subtypes for the full info request, sent in this order. Clients wait for the
+// affiliations reply before showing the user's info.
+const (
+	ICQMetaBasicInfo    = 0x00c8
+	ICQMetaWorkInfo     = 0x00d2
+	ICQMetaMoreInfo     = 0x00dc
+	ICQMetaNotes        = 0x00e6
+	ICQMetaEmails       = 0x00eb
+	ICQMetaInterests    = 0x00f0
+	ICQMetaAffiliations = 0x00fa
+)
+
+// Result codes for meta replies
+const (
+	ICQMetaSuccess = 0x0a
+	ICQMetaFailure = 0x32
+)
+
+const (
+	// ICQOfflineMessagePlain is the message type of a plain text offline message
+	ICQOfflineMessagePlain = 0x01
+
+	// ICQOfflineMessagesKept ends the offline messages without any having been dropped
+	ICQOfflineMessagesKept = 0x00
+)
+
+type ICQService struct{}
+
+// icqMeta is the little-endian envelope that ICQ clients wrap their requests in
+type icqMeta struct {
+	UIN  uint32
+	Type uint16
+	Seq  uint16
+	Data []byte
+}
+
+func readICQMeta(data []byte) (*icqMeta, error) {
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	length, err := buf.ReadUint16LE()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read meta length")
+	}
+
+	chunk, err := buf.ReadBytes(int(length))
+	if err != nil {
+		return nil, errors.Wrap(err, "meta request shorter than its length")
+	}
+	buf = oscar.Buffer{}
+	buf.Write(chunk)
+
+	meta := &icqMeta{}
+	if meta.UIN, err = buf.ReadUint32LE(); err != nil {
+		return nil, errors.Wrap(err, "could not read meta UIN")
+	}
+
+	if meta.Type, err = buf.ReadUint16LE(); err != nil {
+		return nil, errors.Wrap(err, "could not read meta request type")
+	}
+
+	if meta.Seq, err = buf.ReadUint16LE(); err != nil {
+		return nil, errors.Wrap(err, "could not read meta sequence number")
+	}
+
+	meta.Data = buf.Bytes()
+	return meta, nil
+}
+
+func (m *icqMeta) Bytes() []byte {
+	buf := oscar.Buffer{}
+	buf.WriteUint16LE(uint16(8 + len(m.Data)))
+	buf.WriteUint32LE(m.UIN)
+	buf.WriteUint16LE(m.Type)
+	buf.WriteUint16LE(m.Seq)
+	buf.Write(m.Data)
+	return buf.Bytes()
+}
+
+// reply sends the client an ICQ reply of the type in the envelope of its request
+func (i *ICQService) reply(session *oscar.Session, snac *oscar.SNAC, request *icqMeta, replyType uint16, data []byte) error {
+	meta := &icqMeta{UIN: request.UIN, Type: replyType, Seq: request.Seq, Data: data}
+
+	replySnac := oscar.NewReplySNAC(snac, 0x15, 0x03)
+	replySnac.WriteTLV(oscar.NewTLV(0x01, meta.Bytes()))
+	replyFlap := oscar.NewFLAP(2)
+	replyFlap.Data.WriteBinary(replySnac)
+	return session.Send(replyFlap)
+}
+
+// offlineMessage is the body of an offline message reply (0x41). Old ICQ messages, like URLs,
+// keep their type.
+func offlineMessage(from uint32, message *models.Message) []byte {
+	sent := message.CreatedAt.UTC()
+
+	messageType := uint8(ICQOfflineMessagePlain)
+	contents := message.Contents
+	if message.Channel == 4 {
+		messageType = message.ICQType
+		contents = string(oscar.EncodeLatin1(message.Contents))
+	}
+
+	buf := oscar.Buffer{}
+	buf.WriteUint32LE(from)
+	buf.WriteUint16LE(uint16(sent.Year()))
+	buf.WriteUint8(uint8(sent.Month()))
+	buf.WriteUint8(uint8(sent.Day()))
+	buf.WriteUint8(uint8(sent.Hour()))
+	buf.WriteUint8(uint8(sent.Minute()))
+	buf.WriteUint8(messageType)
+	buf.WriteUint8(0) // message flags
+	buf.WriteLNTS(contents)
+	return buf.Bytes()
+}
+
+// fullInfo is each of the meta replies to a full info request, in the order they are sent.
+// Only the basic info and notes are filled in from the user, the rest are empty.
+func fullInfo(user *models.User) [][]byte {
+	basic := oscar.Buffer{}
+	basic.WriteUint16LE(ICQMetaBasicInfo)
+	basic.WriteUint8(ICQMetaSuccess)
+	basic.WriteLNTS(user.ScreenName) // nickname
+	basic.WriteLNTS("")              // first name
+	basic.WriteLNTS("")              // last name
+	basic.WriteLNTS(user.Email)
+	for i := 0; i < 7; i++ {
+		basic.WriteLNTS("") // city, state, phone, fax, street, cellular, zip
+	}
+	basic.WriteUint16LE(0) // country
+	basic.WriteUint8(0)    // GMT offset
+	basic.WriteUint8(1)    // authorization not required
+	basic.WriteUint8(0)    // web aware
+	basic.WriteUint8(0)    // direct connection permissions
+	basic.WriteUint8(0)    // publish primary email
+
+	more := oscar.Buffer{}
+	more.WriteUint16LE(ICQMetaMoreInfo)
+	more.WriteUint8(ICQMetaSuccess)
+	more.WriteUint16LE(0) // age
+	more.WriteUint8(0)    // gender
+	more.WriteLNTS("")    // homepage
+	more.WriteUint16LE(0) // birth year
+	more.WriteUint8(0)    // birth month
+	more.WriteUint8(0)    // birth day
+	more.WriteUint8(0)    // languages
+	more.WriteUint8(0)
+	more.WriteUint8(0)
+
+	emails := oscar.Buffer{}
+	emails.WriteUint16LE(ICQMetaEmails)
+	emails.WriteUint8(ICQMetaSuccess)
+	emails.WriteUint8(0) // number of extra emails
+
+	work := oscar.Buffer{}
+	work.WriteUint16LE(ICQMetaWorkInfo)
+	work.WriteUint8(ICQMetaSuccess)
+	for i := 0; i < 6; i++ {
+		work.WriteLNTS("") // city, state, phone, fax, address, zip
+	}
+	work.WriteUint16LE(0) // country
+	work.WriteLNTS("")    // company
+	work.WriteLNTS("")    // department
+	work.WriteLNTS("")    // position
+	work.WriteUint16LE(0) // occupation
+	work.WriteLNTS("")    // webpage
+
+	notes := oscar.Buffer{}
+	notes.WriteUint16LE(ICQMetaNotes)
+	notes.WriteUint8(ICQMetaSuccess)
+	notes.WriteLNTS(user.Profile)
+
+	interests := oscar.Buffer{}
+	interests.WriteUint16LE(ICQMetaInterests)
+	interests.WriteUint8(ICQMetaSuccess)
+	interests.WriteUint8(0) // number of interests
+
+	affiliations := oscar.Buffer{}
+	affiliations.WriteUint16LE(ICQMetaAffiliations)
+	affiliations.WriteUint8(ICQMetaSuccess)
+	affiliations.WriteUint8(0) // number of past backgrounds
+	affiliations.WriteUint8(0) // number of affiliations
+
+	return [][]byte{basic.Bytes(), more.Bytes(), emails.Bytes(), work.Bytes(), notes.Bytes(), interests.Bytes(), affiliations.Bytes()}
+}
+
+func (i *ICQService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := oscar.LoggerFromContext(ctx).With("service", "icq")
+
+	switch snac.Header.Subtype {
+
+	// Client sends an ICQ request wrapped in TLV 0x01
+	case 0x02:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read ICQ request TLVs")
+		}
+
+		metaTLV := oscar.FindTLV(tlvs, 0x01)
+		if metaTLV == nil {
+			return ctx, errors.New("ICQ request missing TLV 0x01")
+		}
+
+		request, err := readICQMeta(metaTLV.Data)
+		if err != nil {
+			return ctx, err
+		}
+
+		switch request.Type {
+
+		// Client wants the messages sent while it was offline
+		case ICQOfflineMessagesRequest:
+			messages, err := models.UndeliveredFor(ctx, db, user.ScreenName, 0)
+			if err != nil {
+				return ctx, err
+			}
+
+			for _, message := range messages {
+				from, err := models.UserByScreenName(ctx, db, message.From)
+				if err != nil {
+					return ctx, err
+				}
+				if from == nil {
+					continue
+				}
+
+				if err := i.reply(session, snac, request, ICQOfflineMessage, offlineMessage(uint32(from.UIN), message)); err != nil {
+					return ctx, err
+				}
+			}
+
+			return ctx, i.reply(session, snac, request, ICQOfflineMessagesEnd, []byte{ICQOfflineMessagesKept})
+
+		// Client got its offline messages and the server can forget them
+		case ICQDeleteOfflineMessages:
+			return ctx, models.ClearUndelivered(ctx, db, user.ScreenName)
+
+		case ICQMetaRequest:
+			buf := oscar.Buffer{}
+			buf.Write(request.Data)
+
+			subtype, err := buf.ReadUint16LE()
+			if err != nil {
+				return ctx, errors.Wrap(err, "could not read meta request subtype")
+			}
+
+			switch subtype {
+
+			// Client wants everything about a user
+			case ICQMetaFullInfoRequest, ICQMetaFullInfoRequest2:
+				uin, err := buf.ReadUint32LE()
+				if err != nil {
+					return ctx, errors.Wrap(err, "could not read UIN")
+				}
+
+				target, err := models.UserByUIN(ctx, db, int64(uin))
+				if err != nil {
+					return ctx, err
+				}
+
+				if target == nil {
+					failed := oscar.Buffer{}
+					failed.WriteUint16LE(ICQMetaBasicInfo)
+					failed.WriteUint8(ICQMetaFailure)
+					return ctx, i.reply(session, snac, request, ICQMetaReply, failed.Bytes())
+				}
+
+				for _, info := range fullInfo(target) {
+					if err := i.reply(session, snac, request, ICQMetaReply, info); err != nil {
+						return ctx, err
+					}
+				}
+				return ctx, nil
+			}
+
+			logger.Warn(fmt.Sprintf("Unknown ICQ meta request subtype 0x%04x", subtype))
+			return ctx, nil
+		}
+
+		logger.Warn(fmt.Sprintf("Unknown ICQ request type 0x%04x", request.Type))
+		return ctx, nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown ICQ family/subtype: 0x15, 0x%02x", snac.Header.Subtype))
+
+	return ctx, aimerror.NotSupported
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReadICQMeta(t *testing.T) {
+	// Offline messages request from ICQ 2003b for UIN 123456
+	data := []byte{
+		0x08, 0x00, // length
+		0x40, 0xe2, 0x01, 0x00, // UIN
+		0x3c, 0x00, // request type
+		0x02, 0x00, // sequence number
+	}
+
+	meta, err := readICQMeta(data)
+	if err != nil {
+		t.Fatalf("could not read meta request: %s", err)
+	}
+
+	if meta.UIN != 123456 || meta.Type != ICQOfflineMessagesRequest || meta.Seq != 2 || len(meta.Data) != 0 {
+		t.Errorf("unexpected meta request %+v", meta)
+	}
+
+	// The reply envelope is written the same way
+	if b := meta.Bytes(); !bytes.Equal(b, data) {
+		t.Errorf("expected envelope bytes\n%v\ngot\n%v", data, b)
+	}
+}
+
+func TestReadICQMetaTruncated(t *testing.T) {
+	data := []byte{
+		0x0a, 0x00, // length longer than the rest of the request
+		0x40, 0xe2, 0x01, 0x00,
+		0x3c, 0x00,
+	}
+
+	if _, err := readICQMeta(data); err == nil {
+		t.Errorf("expected an error reading a truncated meta request")
+	}
+}
+
+func TestOfflineMessage(t *testing.T) {
+	message := &models.Message{
+		Contents:  "hi",
+		CreatedAt: time.Date(2003, time.May, 4, 13, 37, 0, 0, time.UTC),
+	}
+
+	expected := []byte{
+		0x40, 0xe2, 0x01, 0x00, // sender UIN
+		0xd3, 0x07, // year
+		0x05, 0x04, 0x0d, 0x25, // month, day, hour, minute
+		0x01, 0x00, // plain message, no flags
+		0x03, 0x00, 'h', 'i', 0x00, // message
+	}
+
+	if b := offlineMessage(123456, message); !bytes.Equal(b, expected) {
+		t.Errorf("expected offline message bytes\n%v\ngot\n%v", expected, b)
+	}
+}
+
+func TestOfflineICQMessage(t *testing.T) {
+	message := &models.Message{
+		Contents:  "hi\u00fehttp://a.b",
+		Channel:   4,
+		ICQType:   0x04, // URL
+		CreatedAt: time.Date(2003, time.May, 4, 13, 37, 0, 0, time.UTC),
+	}
+
+	expected := []byte{
+		0x40, 0xe2, 0x01, 0x00, // sender UIN
+		0xd3, 0x07, // year
+		0x05, 0x04, 0x0d, 0x25, // month, day, hour, minute
+		0x04, 0x00, // URL message, no flags
+		0x0e, 0x00, 'h', 'i', 0xfe, 'h', 't', 't', 'p', ':', '/', '/', 'a', '.', 'b', 0x00, // message
+	}
+
+	if b := offlineMessage(123456, message); !bytes.Equal(b, expected) {
+		t.Errorf("expected offline message bytes\n%v\ngot\n%v", expected, b)
+	}
+}
+
+func TestFullInfo(t *testing.T) {
+	user := &models.User{ScreenName: "123456", Email: "a@b.c", Profile: "hello"}
+
+	replies := fullInfo(user)
+	if len(replies) != 7 {
+		t.Fatalf("expected 7 replies, got %d", len(replies))
+	}
+
+	basic := oscar.Buffer{}
+	basic.Write(replies[0])
+	if subtype, _ := basic.ReadUint16LE(); subtype != ICQMetaBasicInfo {
+		t.Errorf("expected basic info first, got 0x%04x", subtype)
+	}
+	if result, _ := basic.ReadUint8(); result != ICQMetaSuccess {
+		t.Errorf("expected success, got 0x%02x", result)
+	}
+	if nickname, _ := basic.ReadLNTS(); nickname != "123456" {
+		t.Errorf("expected nickname 123456, got %s", nickname)
+	}
+	basic.ReadLNTS()
+	basic.ReadLNTS()
+	if email, _ := basic.ReadLNTS(); email != "a@b.c" {
+		t.Errorf("expected email a@b.c, got %s", email)
+	}
+
+	last := oscar.Buffer{}
+	last.Write(replies[len(replies)-1])
+	if subtype, _ := last.ReadUint16LE(); subtype != ICQMetaAffiliations {
+		t.Errorf("expected affiliations last, got 0x%04x", subtype)
+	}
+}
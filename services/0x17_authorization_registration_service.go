@@ -1,15 +1,19 @@
 package services
 
 import (
+	"aim-oscar/aimerror"
 	"bytes"
 	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/base32"
-	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/mail"
+	"time"
 
+	"aim-oscar/metrics"
 	"aim-oscar/models"
 	"aim-oscar/oscar"
 
@@ -30,78 +34,370 @@ func roast(password string) []byte {
 	return ret
 }
 
-type AuthorizationCookie struct {
-	UIN int64
-	X   string
+type authKey string
+
+func (s authKey) String() string {
+	return "auth-" + string(s)
+}
+
+var (
+	authChallengeKey = authKey("challenge")
+)
+
+// authChallenge is the MD5 auth key sent to a connection, kept until it logs in
+type authChallenge struct {
+	ScreenName string
+	Key        string
+}
+
+// passwordHash is the digest a client logs in with for the auth key. Clients that send TLV 0x4c
+// hash the MD5 of the password rather than the password itself.
+func passwordHash(key, password string, md5Password bool) []byte {
+	h := md5.New()
+	io.WriteString(h, key)
+	if md5Password {
+		passwordMD5 := md5.Sum([]byte(password))
+		h.Write(passwordMD5[:])
+	} else {
+		io.WriteString(h, password)
+	}
+	io.WriteString(h, AIM_MD5_STRING)
+	return h.Sum(nil)
+}
+
+// rateLimitedURL is where clients send users who have had too many wrong passwords
+const rateLimitedURL = "http://runningman.network/errors/rate-limited"
+
+// suspendedURL is where clients send suspended users to find out why
+const suspendedURL = "http://runningman.network/errors/suspended-account"
+
+// loginError tells the client why it couldn't log in
+func loginError(request *oscar.SNAC, screenNameTLV *oscar.TLV, code uint16) *oscar.SNAC {
+	snac := oscar.NewReplySNAC(request, 0x17, 0x03)
+	snac.Data.WriteBinary(screenNameTLV)
+	snac.Data.WriteBinary(oscar.NewTLVUint16(0x08, code))
+	return snac
+}
+
+// Error codes in TLV 0x08 of a registration reply
+const (
+	RegistrationErrorInvalidRequest    = 0x01
+	RegistrationErrorInvalidScreenName = 0x02
+	RegistrationErrorScreenNameTaken   = 0x03
+	RegistrationErrorInvalidPassword   = 0x04
+	RegistrationErrorInvalidEmail      = 0x05
+	RegistrationErrorDisabled          = 0x06
+)
+
+// registration is a request for a new account
+type registration struct {
+	ScreenName string
+	Password   string
+	Email      string
+}
+
+// readRegistration reads the screen name (TLV 0x01), password (TLV 0x02) and email (TLV 0x11)
+// of a registration request
+func readRegistration(data []byte) (*registration, error) {
+	tlvs, err := oscar.UnmarshalTLVs(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal TLVs")
+	}
+
+	screenNameTLV, hasScreenName := tlvs.Get(0x01)
+	passwordTLV, hasPassword := tlvs.Get(0x02)
+	emailTLV, hasEmail := tlvs.Get(0x11)
+	if !hasScreenName || !hasPassword || !hasEmail {
+		return nil, errors.New("registration missing screen name, password or email TLV")
+	}
+
+	return &registration{
+		ScreenName: screenNameTLV.String(),
+		Password:   passwordTLV.String(),
+		Email:      emailTLV.String(),
+	}, nil
+}
+
+// validScreenName follows AIM's rules: 3 to 16 letters, numbers and spaces, starting with a
+// letter
+func validScreenName(screenName string) bool {
+	if len(screenName) < 3 || len(screenName) > 16 {
+		return false
+	}
+
+	for i, c := range screenName {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == ' '):
+		default:
+			return false
+		}
+	}
+	return screenName[len(screenName)-1] != ' '
+}
+
+// validPassword follows AIM's rules: 4 to 16 characters
+func validPassword(password string) bool {
+	return len(password) >= 4 && len(password) <= 16
+}
+
+// validEmail accepts a bare email address
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+// validate returns the error code for the first thing wrong with the registration, or 0 if
+// it can be created
+func (r *registration) validate() uint16 {
+	if !validScreenName(r.ScreenName) {
+		return RegistrationErrorInvalidScreenName
+	}
+
+	if !validPassword(r.Password) {
+		return RegistrationErrorInvalidPassword
+	}
+
+	if !validEmail(r.Email) {
+		return RegistrationErrorInvalidEmail
+	}
+
+	return 0
+}
+
+// ValidateRegistration checks an account the way registrations from clients are checked.
+// Returns the registration error code, 0 if the account can be created.
+func ValidateRegistration(screenName, password, email string) uint16 {
+	r := &registration{ScreenName: screenName, Password: password, Email: email}
+	return r.validate()
 }
 
 type AuthorizationRegistrationService struct {
-	BOSAddress string
+	// BOSAddress is the host:port clients are sent to after logging in. The host can be an IP
+	// or a DNS name.
+	BOSAddress       string
+	OpenRegistration bool
+
+	// RequireTLS turns away logins and registrations from clients that didn't connect over TLS
+	RequireTLS bool
+
+	// Logins turns away logins from IPs and for screen names with too many wrong passwords.
+	// nil doesn't limit them.
+	Logins *LoginLimiter
 }
 
-func AuthenticateFLAPCookie(ctx context.Context, db *bun.DB, flap *oscar.FLAP) (*models.User, string, error) {
-	// Otherwise this is a protocol negotiation from the client. They're likely trying to connect
-	// and sending a cookie to verify who they are.
+// AuthenticateFLAPCookie signs a client on to BOS with the cookie the authorization server gave
+// it, or opens a service connection with a cookie from a service request. Cookies can only be
+// used once.
+func AuthenticateFLAPCookie(ctx context.Context, db *bun.DB, flap *oscar.FLAP) (*models.User, *models.AuthCookie, error) {
+	if len(flap.Data.Bytes()) < 4 {
+		return nil, nil, errors.New("authentication request missing FLAP version")
+	}
+
 	tlvs, err := oscar.UnmarshalTLVs(flap.Data.Bytes()[4:])
 	if err != nil {
-		return nil, "", errors.Wrap(err, "authentication request missing TLVs")
+		return nil, nil, errors.Wrap(err, "authentication request missing TLVs")
+	}
+
+	cookieTLV, ok := tlvs.Get(0x6)
+	if !ok {
+		return nil, nil, errors.New("authentication request missing Cookie TLV 0x6")
+	}
+
+	cookie, err := models.UseAuthCookie(ctx, db, cookieTLV.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	if cookie == nil {
+		return nil, nil, errors.New("unknown or expired cookie")
 	}
 
-	/*
-		There are 2 ways that clients authenticate: channel 1 auth w/ roasted password, or via MD5 hash. The
-		former is used by the 1.0 client, whereas the second is used by 3.5 and up (I believe).
-	*/
+	user, err := models.UserByUIN(ctx, db, cookie.UIN)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not get User by UIN")
+	}
+	if user == nil {
+		return nil, nil, errors.New("cookie for a user that does not exist")
+	}
+	if user.IsSuspended(time.Now()) {
+		return nil, nil, errors.New("cookie for a suspended user")
+	}
 
-	// This is channel 1 auth
-	screenNameTLV := oscar.FindTLV(tlvs, 0x1)
-	roastedPWTLV := oscar.FindTLV(tlvs, 0x2)
-	screenName := ""
+	return user, cookie, nil
+}
 
-	// This is a roasted password auth
-	if screenNameTLV != nil && roastedPWTLV != nil {
-		screenName := string(screenNameTLV.Data)
-		user, err := models.UserByScreenName(ctx, db, screenName)
-		if err != nil {
-			return nil, screenName, errors.Wrap(err, "could not get User by Screen Name")
+// bosAddressTLV tells the client where to sign on to BOS with its cookie
+func (a *AuthorizationRegistrationService) bosAddressTLV() *oscar.TLV {
+	return oscar.NewTLVString(0x05, a.BOSAddress)
+}
+
+// CookieRejectedFLAP tells a client that its cookie was unknown, expired or already used before
+// it is disconnected
+func CookieRejectedFLAP() *oscar.FLAP {
+	flap := oscar.NewFLAP(4)
+	flap.Data.WriteBinary(oscar.NewTLVUint16(0x08, 0x06)) // internal client error (bad input to authorizer)
+	return flap
+}
+
+// authorize returns a cookie for the user to sign on to the BOS server with. The cookie
+// remembers the address of the session in ctx.
+func authorize(ctx context.Context, db *bun.DB, user *models.User) ([]byte, error) {
+	return models.CreateAuthCookie(ctx, db, user.UIN, sessionIP(ctx))
+}
+
+// sessionIP is the address of the client of the session in ctx, empty if it isn't an IP
+// connection
+func sessionIP(ctx context.Context) string {
+	session, err := oscar.SessionFromContext(ctx)
+	if err != nil {
+		return ""
+	}
+	ip, _, _ := net.SplitHostPort(session.RemoteAddr().String())
+	return ip
+}
+
+// IsRoastedLogin is true for the channel 1 logins of clients from before family 0x17, which
+// carry the screen name and roasted password after the FLAP version
+func IsRoastedLogin(flap *oscar.FLAP) bool {
+	if len(flap.Data.Bytes()) <= 4 {
+		return false
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(flap.Data.Bytes()[4:])
+	if err != nil {
+		return false
+	}
+	return tlvs.Has(0x01) && tlvs.Has(0x02)
+}
+
+// RoastedLogin authenticates a channel 1 login and answers on channel 4 with either the BOS
+// address and cookie or the error code and URL, then disconnects the client
+func (a *AuthorizationRegistrationService) RoastedLogin(ctx context.Context, db *bun.DB, flap *oscar.FLAP) error {
+	session, err := oscar.SessionFromContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not extract session from context")
+	}
+
+	if a.RequireTLS && !session.TLS() {
+		return aimerror.TLSRequired
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(flap.Data.Bytes()[4:])
+	if err != nil {
+		return errors.Wrap(err, "could not unmarshal TLVs")
+	}
+
+	screenNameTLV, hasScreenName := tlvs.Get(0x01)
+	roastedPWTLV, hasPassword := tlvs.Get(0x02)
+	if !hasScreenName || !hasPassword {
+		return errors.New("roasted login missing screen name or password TLV")
+	}
+	screenName := screenNameTLV.String()
+	logger := oscar.LoggerFromContext(ctx).With("service", "authorization/registration", "screen_name", screenName)
+
+	reply := oscar.NewFLAP(4)
+	reply.Data.WriteBinary(screenNameTLV)
+
+	ip := sessionIP(ctx)
+	if !a.Logins.Allowed(ip, screenName) {
+		logger.Warn("Too many failed logins", "ip", ip)
+		metrics.AuthRateLimited(metrics.AuthRoasted)
+		reply.Data.WriteBinary(oscar.NewTLVString(0x04, rateLimitedURL))
+		reply.Data.WriteBinary(oscar.NewTLVUint16(0x08, 0x18)) // rate limited
+		if err := session.Send(reply); err != nil {
+			return err
 		}
+		return session.Disconnect()
+	}
+
+	user, err := models.UserByScreenName(ctx, db, screenName)
+	if err != nil {
+		return err
+	}
 
-		if !bytes.Equal(roastedPWTLV.Data, roast(user.Password)) {
-			return nil, screenName, errors.New("invalid password")
+	validPassword := user != nil && bytes.Equal(roastedPWTLV.Bytes(), roast(user.Password))
+	metrics.Auth(metrics.AuthRoasted, validPassword)
+	if validPassword {
+		a.Logins.Succeeded(screenName)
+	} else {
+		a.Logins.Failed(ip, screenName)
+	}
+
+	switch {
+	case !validPassword:
+		logger.Info("Invalid screen name or password")
+		reply.Data.WriteBinary(oscar.NewTLVString(0x04, "http://runningman.network/errors/incorrect-password"))
+		reply.Data.WriteBinary(oscar.NewTLVUint16(0x08, 0x04)) // incorrect nick/pass
+
+	case !user.Verified || user.DeletedAt != nil:
+		logger.Info("User is unverified or deleted")
+		reply.Data.WriteBinary(oscar.NewTLVString(0x04, "http://runningman.network/errors/unverified-account"))
+		reply.Data.WriteBinary(oscar.NewTLVUint16(0x08, 0x07)) // invalid account
+
+	case user.IsSuspended(time.Now()):
+		logger.Info("User is suspended", "reason", user.SuspensionReason)
+		reply.Data.WriteBinary(oscar.NewTLVString(0x04, suspendedURL))
+		reply.Data.WriteBinary(oscar.NewTLVUint16(0x08, 0x11)) // account suspended
+
+	default:
+		cookie, err := authorize(ctx, db, user)
+		if err != nil {
+			return err
 		}
 
-		return user, screenName, nil
+		reply.Data.WriteBinary(a.bosAddressTLV())
+		reply.Data.WriteBinary(oscar.NewTLV(0x06, cookie))
+		logger.Info("Sent Authorization Cookie")
+	}
+
+	if err := session.Send(reply); err != nil {
+		return err
 	}
+	return session.Disconnect()
+}
 
-	// This is MD5 hash auth
-	cookieTLV := oscar.FindTLV(tlvs, 0x6)
-	if cookieTLV == nil {
-		return nil, screenName, errors.New("authentication request missing Cookie TLV 0x6")
+// register creates the account in the registration request. Returns the registration error
+// code, 0 if the account was created.
+func (a *AuthorizationRegistrationService) register(ctx context.Context, db *bun.DB, data []byte) (uint16, string, error) {
+	r, err := readRegistration(data)
+	if err != nil {
+		return RegistrationErrorInvalidRequest, "", nil
 	}
 
-	auth := AuthorizationCookie{}
-	if err := json.Unmarshal(cookieTLV.Data, &auth); err != nil {
-		return nil, screenName, errors.Wrap(err, "could not unmarshal cookie")
+	if code := r.validate(); code != 0 {
+		return code, r.ScreenName, nil
 	}
 
-	user, err := models.UserByUIN(ctx, db, auth.UIN)
+	taken, err := models.ScreenNameTaken(ctx, db, r.ScreenName)
 	if err != nil {
-		return nil, screenName, errors.Wrap(err, "could not get User by UIN")
+		return 0, r.ScreenName, err
+	}
+	if taken {
+		return RegistrationErrorScreenNameTaken, r.ScreenName, nil
 	}
 
-	screenName = user.ScreenName
+	emailTaken, err := models.EmailTaken(ctx, db, r.Email)
+	if err != nil {
+		return 0, r.ScreenName, err
+	}
+	if emailTaken {
+		return RegistrationErrorInvalidEmail, r.ScreenName, nil
+	}
 
-	h := md5.New()
-	io.WriteString(h, user.Cipher)
-	io.WriteString(h, user.Password)
-	io.WriteString(h, AIM_MD5_STRING)
-	expectedPasswordHash := fmt.Sprintf("%x", h.Sum(nil))
+	user, err := models.CreateUser(ctx, db, r.ScreenName, r.Password, r.Email)
+	if err != nil {
+		return 0, r.ScreenName, err
+	}
 
-	// Make sure the hash passed in matches the one from the DB
-	if expectedPasswordHash != auth.X {
-		return nil, screenName, errors.New("unexpected cookie hash")
+	// Accounts made from a client can sign on straight away, and confirm their email from the
+	// client once they have
+	user.Verified = true
+	user.Unconfirmed = true
+	if err := user.Update(ctx, db, "verified", "unconfirmed"); err != nil {
+		return 0, r.ScreenName, err
 	}
 
-	return user, screenName, nil
+	return 0, r.ScreenName, nil
 }
 
 func (a *AuthorizationRegistrationService) GenerateCipher() (string, error) {
@@ -115,12 +411,41 @@ func (a *AuthorizationRegistrationService) GenerateCipher() (string, error) {
 
 func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, err := oscar.SessionFromContext(ctx)
-	logger := session.Logger.With("service", "authorization/registration")
+	logger := oscar.LoggerFromContext(ctx).With("service", "authorization/registration")
 	if err != nil {
 		return ctx, errors.Wrap(err, "could not extract session from context")
 	}
 
+	if a.RequireTLS && !session.TLS() {
+		return ctx, aimerror.TLSRequired
+	}
+
 	switch snac.Header.Subtype {
+	// Client wants a new account
+	case 0x04:
+		code := uint16(RegistrationErrorDisabled)
+		screenName := ""
+
+		if a.OpenRegistration {
+			code, screenName, err = a.register(ctx, db, snac.Data.Bytes())
+			if err != nil {
+				return ctx, err
+			}
+		}
+
+		replySnac := oscar.NewReplySNAC(snac, 0x17, 0x05)
+		replySnac.Data.WriteBinary(oscar.NewTLVString(0x01, screenName))
+		if code != 0 {
+			logger.Info("Registration failed", "screen_name", screenName, "code", code)
+			replySnac.Data.WriteBinary(oscar.NewTLVUint16(0x08, code))
+		} else {
+			logger.Info("Registered user", "screen_name", screenName)
+		}
+
+		replyFlap := oscar.NewFLAP(2)
+		replyFlap.Data.WriteBinary(replySnac)
+		return ctx, session.Send(replyFlap)
+
 	// Request MD5 Auth Key
 	case 0x06:
 		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
@@ -128,40 +453,36 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 			return ctx, errors.Wrap(err, "could not unmarshal TLVs")
 		}
 
-		screenNameTLV := oscar.FindTLV(tlvs, 1)
-		if screenNameTLV == nil {
+		screenNameTLV, ok := tlvs.Get(1)
+		if !ok {
 			return ctx, errors.New("missing screen_name TLV")
 		}
 
 		// Fetch the user
-		user, err := models.UserByScreenName(ctx, db, string(screenNameTLV.Data))
+		user, err := models.UserByScreenName(ctx, db, screenNameTLV.String())
 		if err != nil {
 			return ctx, err
 		}
 		if user == nil {
-			snac := oscar.NewSNAC(0x17, 0x03)
-			snac.Data.WriteBinary(screenNameTLV)
-			snac.Data.WriteBinary(oscar.NewTLV(0x08, []byte{0, 4}))
 			resp := oscar.NewFLAP(2)
-			resp.Data.WriteBinary(snac)
+			resp.Data.WriteBinary(loginError(snac, screenNameTLV, 0x04))
 			return ctx, session.Send(resp)
 		}
 
-		// Create cipher for this user
-		user.Cipher, err = a.GenerateCipher()
+		// The key only lives as long as this connection, so logins for the same screen name on
+		// other connections don't replace it
+		key, err := a.GenerateCipher()
 		if err != nil {
 			return ctx, err
 		}
-		if err = user.Update(ctx, db, "cipher"); err != nil {
-			return ctx, err
-		}
+		ctx = context.WithValue(ctx, authChallengeKey, &authChallenge{ScreenName: user.ScreenName, Key: key})
 
-		snac := oscar.NewSNAC(0x17, 0x07)
-		snac.Data.WriteUint16(uint16(len(user.Cipher)))
-		snac.Data.WriteString(user.Cipher)
+		keySnac := oscar.NewReplySNAC(snac, 0x17, 0x07)
+		keySnac.Data.WriteUint16(uint16(len(key)))
+		keySnac.Data.WriteString(key)
 
 		resp := oscar.NewFLAP(2)
-		resp.Data.WriteBinary(snac)
+		resp.Data.WriteBinary(keySnac)
 		return ctx, session.Send(resp)
 
 	// Client Authorization Request
@@ -171,50 +492,59 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 			return ctx, errors.Wrap(err, "could not unmarshal TLVs")
 		}
 
-		screenNameTLV := oscar.FindTLV(tlvs, 1)
-		if screenNameTLV == nil {
+		screenNameTLV, ok := tlvs.Get(1)
+		if !ok {
 			return ctx, errors.New("missing screen_name TLV 0x1")
 		}
 
-		screen_name := string(screenNameTLV.Data)
-		ctx := context.Background()
+		screen_name := screenNameTLV.String()
+		ip := sessionIP(ctx)
+		if !a.Logins.Allowed(ip, screen_name) {
+			logger.Warn("Too many failed logins", "screen_name", screen_name, "ip", ip)
+			metrics.AuthRateLimited(metrics.AuthMD5)
+			limitedSnac := loginError(snac, screenNameTLV, 0x18) // rate limited
+			limitedSnac.Data.WriteBinary(oscar.NewTLVString(0x04, rateLimitedURL))
+			limitedFlap := oscar.NewFLAP(2)
+			limitedFlap.Data.WriteBinary(limitedSnac)
+			return ctx, session.Send(limitedFlap)
+		}
+
 		user, err := models.UserByScreenName(ctx, db, screen_name)
 		if err != nil {
 			return ctx, err
 		}
 
 		if user == nil {
+			metrics.Auth(metrics.AuthMD5, false)
+			a.Logins.Failed(ip, screen_name)
 			logger.Info("User does not exist", "screen_name", screen_name)
-			snac := oscar.NewSNAC(0x17, 0x03)
-			snac.Data.WriteBinary(screenNameTLV)
-			snac.Data.WriteBinary(oscar.NewTLV(0x08, []byte{0, 4}))
 			resp := oscar.NewFLAP(2)
-			resp.Data.WriteBinary(snac)
+			resp.Data.WriteBinary(loginError(snac, screenNameTLV, 0x04))
 			return ctx, session.Send(resp)
 		}
 
 		logger.Info("Attempting to authenticate", "screen_name", screen_name)
 
-		passwordHashTLV := oscar.FindTLV(tlvs, 0x25)
-		if passwordHashTLV == nil {
+		passwordHashTLV, ok := tlvs.Get(0x25)
+		if !ok {
 			return ctx, errors.New("missing password hash TLV 0x25")
 		}
 
-		// Compute password has that we expect the client to send back if the password was right
-		h := md5.New()
-		io.WriteString(h, user.Cipher)
-		io.WriteString(h, user.Password)
-		io.WriteString(h, AIM_MD5_STRING)
-		expectedPasswordHash := h.Sum(nil)
+		// Compute password hash that we expect the client to send back if the password was right
+		challenge, _ := ctx.Value(authChallengeKey).(*authChallenge)
+		validPassword := false
+		if challenge != nil && challenge.ScreenName == user.ScreenName {
+			md5Password := tlvs.Has(0x4c)
+			validPassword = bytes.Equal(passwordHash(challenge.Key, user.Password, md5Password), passwordHashTLV.Bytes())
+		}
 
-		if !bytes.Equal(expectedPasswordHash, passwordHashTLV.Data) {
+		metrics.Auth(metrics.AuthMD5, validPassword)
+		if !validPassword {
+			a.Logins.Failed(ip, screen_name)
 			logger.Info("Invalid password", "screen_name", screen_name)
 			// Tell the client this was a bad password
-			badPasswordSnac := oscar.NewSNAC(0x17, 0x03)
-			badPasswordSnac.Data.WriteBinary(screenNameTLV)
-			badPasswordSnac.Data.WriteBinary(oscar.NewTLV(0x08, []byte{0, 4})) // incorrect nick/pass
 			badPasswordFlap := oscar.NewFLAP(2)
-			badPasswordFlap.Data.WriteBinary(badPasswordSnac)
+			badPasswordFlap.Data.WriteBinary(loginError(snac, screenNameTLV, 0x04)) // incorrect nick/pass
 			session.Send(badPasswordFlap)
 
 			// Tell them to leave
@@ -222,14 +552,14 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 			return ctx, session.Send(discoFlap)
 		}
 
+		a.Logins.Succeeded(screen_name)
+
 		// Only users that have verified their email can use the service
 		if !user.Verified || user.DeletedAt != nil {
 			logger.Info("User is unverified or deleted", "screen_name", screen_name)
 			// Tell the client this was a bad password
-			badPasswordSnac := oscar.NewSNAC(0x17, 0x03)
-			badPasswordSnac.Data.WriteBinary(screenNameTLV)
-			badPasswordSnac.Data.WriteBinary(oscar.NewTLV(0x08, []byte{0, 7})) // invalid account
-			badPasswordSnac.Data.WriteBinary(oscar.NewTLV(0x04, []byte("http://runningman.network/errors/unverified-account")))
+			badPasswordSnac := loginError(snac, screenNameTLV, 0x07) // invalid account
+			badPasswordSnac.Data.WriteBinary(oscar.NewTLVString(0x04, "http://runningman.network/errors/unverified-account"))
 			badPasswordFlap := oscar.NewFLAP(2)
 			badPasswordFlap.Data.WriteBinary(badPasswordSnac)
 			session.Send(badPasswordFlap)
@@ -239,21 +569,30 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 			return ctx, session.Send(discoFlap)
 		}
 
-		// Send BOS response + cookie
-		authSnac := oscar.NewSNAC(0x17, 0x3)
-		authSnac.Data.WriteBinary(screenNameTLV)
-		authSnac.Data.WriteBinary(oscar.NewTLV(0x5, []byte(a.BOSAddress)))
+		if user.IsSuspended(time.Now()) {
+			logger.Info("User is suspended", "screen_name", screen_name, "reason", user.SuspensionReason)
+			suspendedSnac := loginError(snac, screenNameTLV, 0x11) // account suspended
+			suspendedSnac.Data.WriteBinary(oscar.NewTLVString(0x04, suspendedURL))
+			suspendedFlap := oscar.NewFLAP(2)
+			suspendedFlap.Data.WriteBinary(suspendedSnac)
+			session.Send(suspendedFlap)
 
-		cookie, err := json.Marshal(AuthorizationCookie{
-			UIN: user.UIN,
-			X:   fmt.Sprintf("%x", expectedPasswordHash),
-		})
+			discoFlap := oscar.NewFLAP(4)
+			return ctx, session.Send(discoFlap)
+		}
+
+		cookie, err := authorize(ctx, db, user)
 		if err != nil {
-			return ctx, errors.Wrap(err, "could not marshal authorization cookie")
+			return ctx, err
 		}
 
+		// Send BOS response + cookie
+		authSnac := oscar.NewReplySNAC(snac, 0x17, 0x3)
+		authSnac.Data.WriteBinary(screenNameTLV)
+		authSnac.Data.WriteBinary(a.bosAddressTLV())
+
 		authSnac.Data.WriteBinary(oscar.NewTLV(0x6, cookie))
-		authSnac.Data.WriteBinary(oscar.NewTLV(0x11, []byte(user.Email)))
+		authSnac.Data.WriteBinary(oscar.NewTLVString(0x11, user.Email))
 		authFlap := oscar.NewFLAP(2)
 		authFlap.Data.WriteBinary(authSnac)
 		session.Send(authFlap)
@@ -266,5 +605,6 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 		return ctx, session.Disconnect()
 	}
 
-	return ctx, nil
+	logger.Error(fmt.Sprintf("Unknown authorization/registration family/subtype: 0x17, 0x%02x", snac.Header.Subtype))
+	return ctx, aimerror.NotSupported
 }
@@ -0,0 +1,128 @@
+//go:build integration
+
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterDuplicateScreenName(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	screenName := fmt.Sprintf("Reg%d", time.Now().UnixNano()%100000)
+	email := strings.ToLower(screenName) + "@example.com"
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.User)(nil)).Where("email LIKE ?", strings.ToLower(screenName)+"%").Exec(ctx)
+	})
+
+	auth := &AuthorizationRegistrationService{OpenRegistration: true}
+
+	code, _, err := auth.register(ctx, d, registrationBlock(screenName, "password", email))
+	if err != nil {
+		t.Fatalf("could not register: %s", err)
+	}
+	if code != 0 {
+		t.Fatalf("expected registration to succeed, got code 0x%02x", code)
+	}
+
+	user, err := models.UserByScreenName(ctx, d, screenName)
+	if err != nil || user == nil {
+		t.Fatalf("expected the user to be created, got %v %v", user, err)
+	}
+	if !user.Verified {
+		t.Errorf("expected a registered user to be able to sign on")
+	}
+
+	// Screen names are the same regardless of case and spaces
+	duplicate := strings.ToUpper(screenName[:2]) + " " + screenName[2:]
+	code, _, err = auth.register(ctx, d, registrationBlock(duplicate, "password", "other"+email))
+	if err != nil {
+		t.Fatalf("could not register: %s", err)
+	}
+	if code != RegistrationErrorScreenNameTaken {
+		t.Errorf("expected screen name taken, got code 0x%02x", code)
+	}
+
+	// Emails can only have one account
+	code, _, err = auth.register(ctx, d, registrationBlock(screenName+"x", "password", email))
+	if err != nil {
+		t.Fatalf("could not register: %s", err)
+	}
+	if code != RegistrationErrorInvalidEmail {
+		t.Errorf("expected invalid email for a used email, got code 0x%02x", code)
+	}
+}
+
+func TestCookieOnlyUsedOnce(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	alice := testUser(t, d, "alice")
+
+	cookie, err := authorize(ctx, d, alice)
+	if err != nil {
+		t.Fatalf("could not authorize: %s", err)
+	}
+	cookieFlap := oscar.NewFLAP(1)
+	cookieFlap.Data.WriteUint32(1)
+	cookieFlap.Data.WriteBinary(oscar.NewTLV(0x06, cookie))
+
+	user, _, err := AuthenticateFLAPCookie(ctx, d, cookieFlap)
+	if err != nil {
+		t.Fatalf("expected the cookie to sign alice on, got %s", err)
+	}
+	if user.UIN != alice.UIN {
+		t.Errorf("expected alice to be signed on, got %s", user.ScreenName)
+	}
+
+	if _, _, err := AuthenticateFLAPCookie(ctx, d, cookieFlap); err == nil {
+		t.Errorf("expected a used cookie to be rejected")
+	}
+}
+
+func TestExpiredCookie(t *testing.T) {
+	d := testDB(t)
+	defer d.Close()
+
+	ctx := context.Background()
+	alice := testUser(t, d, "alice")
+
+	cookie, err := models.CreateAuthCookie(ctx, d, alice.UIN, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("could not authorize: %s", err)
+	}
+	if _, err := models.CreateAuthCookie(ctx, d, alice.UIN, "192.0.2.1"); err != nil {
+		t.Fatalf("could not authorize: %s", err)
+	}
+	if _, err := d.NewUpdate().Model((*models.AuthCookie)(nil)).
+		Set("created_at = ?", time.Now().Add(-2*models.AuthCookieTTL)).
+		Where("cookie = ?", cookie).
+		Exec(ctx); err != nil {
+		t.Fatalf("could not expire cookie: %s", err)
+	}
+
+	cookieFlap := oscar.NewFLAP(1)
+	cookieFlap.Data.WriteUint32(1)
+	cookieFlap.Data.WriteBinary(oscar.NewTLV(0x06, cookie))
+	if _, _, err := AuthenticateFLAPCookie(ctx, d, cookieFlap); err == nil {
+		t.Errorf("expected an expired cookie to be rejected")
+	}
+
+	// Expired cookies are purged, and fresh ones are kept
+	if deleted, err := models.DeleteExpiredAuthCookies(ctx, d); err != nil || deleted < 1 {
+		t.Errorf("expected the expired cookie to be deleted, got %d: %v", deleted, err)
+	}
+	left, err := d.NewSelect().Model((*models.AuthCookie)(nil)).Where("uin = ?", alice.UIN).Where("ip = ?", "192.0.2.1").Count(ctx)
+	if err != nil || left != 1 {
+		t.Errorf("expected the fresh cookie to be kept, got %d: %v", left, err)
+	}
+}
@@ -2,7 +2,13 @@ package services
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"testing"
+	"time"
+
+	"aim-oscar/aimerror"
+	"aim-oscar/oscar"
 )
 
 func TestRoast(t *testing.T) {
@@ -12,3 +18,184 @@ func TestRoast(t *testing.T) {
 		t.Errorf("expected %+v, but got %+v", expected, result)
 	}
 }
+
+func TestPasswordHash(t *testing.T) {
+	tt := map[string]struct {
+		md5Password bool
+		expected    string
+	}{
+		"password":        {false, "58e706fc0c148b1f2144312f4bc7976a"},
+		"md5 of password": {true, "cad95684a8eacb26491af81736b61d91"},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			expected, _ := hex.DecodeString(tc.expected)
+			if result := passwordHash("1234567890", "password", tc.md5Password); !bytes.Equal(result, expected) {
+				t.Errorf("expected %x, got %x", expected, result)
+			}
+		})
+	}
+}
+
+func TestIsRoastedLogin(t *testing.T) {
+	login := func(tlvs ...*oscar.TLV) *oscar.FLAP {
+		flap := oscar.NewFLAP(1)
+		flap.Data.WriteUint32(1) // FLAP version
+		for _, tlv := range tlvs {
+			flap.Data.WriteBinary(tlv)
+		}
+		return flap
+	}
+
+	tt := map[string]struct {
+		flap     *oscar.FLAP
+		expected bool
+	}{
+		"hello":  {login(), false},
+		"cookie": {login(oscar.NewTLV(0x06, []byte("cookie"))), false},
+		"roasted password": {login(
+			oscar.NewTLV(0x01, []byte("alice")),
+			oscar.NewTLV(0x02, roast("password")),
+			oscar.NewTLV(0x03, []byte("AOL Instant Messenger (SM), version 3.5.1670/WIN32")),
+		), true},
+		"no password": {login(oscar.NewTLV(0x01, []byte("alice"))), false},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if result := IsRoastedLogin(tc.flap); result != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func registrationBlock(screenName, password, email string) []byte {
+	buf := oscar.Buffer{}
+	buf.WriteBinary(oscar.NewTLV(0x01, []byte(screenName)))
+	buf.WriteBinary(oscar.NewTLV(0x02, []byte(password)))
+	buf.WriteBinary(oscar.NewTLV(0x11, []byte(email)))
+	return buf.Bytes()
+}
+
+func TestReadRegistrationMalformed(t *testing.T) {
+	tt := map[string][]byte{
+		"empty":           {},
+		"truncated TLV":   {0x00, 0x01, 0x00, 0x05, 'a', 'l'},
+		"missing email":   registrationBlock("alice", "password", "")[:21],
+		"only screenname": {0x00, 0x01, 0x00, 0x05, 'a', 'l', 'i', 'c', 'e'},
+	}
+
+	for name, data := range tt {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readRegistration(data); err == nil {
+				t.Errorf("expected an error reading a malformed registration")
+			}
+		})
+	}
+}
+
+func TestRegistrationValidate(t *testing.T) {
+	tt := map[string]struct {
+		screenName string
+		password   string
+		email      string
+		expected   uint16
+	}{
+		"valid":                  {"Alice Smith1", "password", "alice@example.com", 0},
+		"too short":              {"al", "password", "alice@example.com", RegistrationErrorInvalidScreenName},
+		"too long":               {"alicealicealicealice", "password", "alice@example.com", RegistrationErrorInvalidScreenName},
+		"starts with a number":   {"1alice", "password", "alice@example.com", RegistrationErrorInvalidScreenName},
+		"punctuation":            {"alice!", "password", "alice@example.com", RegistrationErrorInvalidScreenName},
+		"trailing space":         {"alice ", "password", "alice@example.com", RegistrationErrorInvalidScreenName},
+		"short password":         {"alice", "pw", "alice@example.com", RegistrationErrorInvalidPassword},
+		"invalid email":          {"alice", "password", "alice", RegistrationErrorInvalidEmail},
+		"email with a name part": {"alice", "password", "Alice <alice@example.com>", RegistrationErrorInvalidEmail},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			r, err := readRegistration(registrationBlock(tc.screenName, tc.password, tc.email))
+			if err != nil {
+				t.Fatalf("could not read registration: %s", err)
+			}
+			if code := r.validate(); code != tc.expected {
+				t.Errorf("expected code 0x%02x, got 0x%02x", tc.expected, code)
+			}
+		})
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	ctx, snacs := fakeClient(t, "alice")
+	a := &AuthorizationRegistrationService{RequireTLS: true}
+
+	keyRequest := oscar.NewSNAC(0x17, 0x06)
+	keyRequest.WriteTLV(oscar.NewTLV(0x01, []byte("alice")))
+	if _, err := a.HandleSNAC(ctx, nil, keyRequest); !errors.Is(err, aimerror.TLSRequired) {
+		t.Errorf("expected a login over a plain connection to need TLS, got %v", err)
+	}
+	expectNoSNAC(t, snacs)
+
+	login := oscar.NewFLAP(1)
+	login.Data.Write([]byte{0, 0, 0, 1})
+	login.Data.WriteBinary(oscar.NewTLV(0x01, []byte("alice")))
+	login.Data.WriteBinary(oscar.NewTLV(0x02, roast("password")))
+	if err := a.RoastedLogin(ctx, nil, login); !errors.Is(err, aimerror.TLSRequired) {
+		t.Errorf("expected a roasted login over a plain connection to need TLS, got %v", err)
+	}
+}
+
+// Logins with too many wrong passwords are turned away before the password is checked
+func TestLoginRateLimited(t *testing.T) {
+	ctx, snacs := fakeClient(t, "alice")
+	a := &AuthorizationRegistrationService{Logins: NewLoginLimiter(1, time.Minute)}
+	a.Logins.Failed("192.0.2.1", "alice")
+
+	login := oscar.NewSNAC(0x17, 0x02)
+	login.WriteTLV(oscar.NewTLV(0x01, []byte("alice")))
+	login.WriteTLV(oscar.NewTLV(0x25, make([]byte, 16)))
+	if _, err := a.HandleSNAC(ctx, nil, login); err != nil {
+		t.Fatalf("could not handle login: %s", err)
+	}
+
+	reply := expectSNAC(t, snacs, 0x17, 0x03)
+	tlvs, err := oscar.UnmarshalTLVs(reply.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not unmarshal TLVs: %s", err)
+	}
+	code, ok := tlvs.Get(0x08)
+	if !ok {
+		t.Fatalf("expected an error code")
+	}
+	if n, _ := code.Uint16(); n != 0x18 {
+		t.Errorf("expected rate limited error 0x18, got 0x%02x", n)
+	}
+	if !tlvs.Has(0x04) {
+		t.Errorf("expected an error URL")
+	}
+}
+
+func TestBOSAddressTLV(t *testing.T) {
+	tt := map[string]struct {
+		address  string
+		expected []byte
+	}{
+		"ip":       {"10.0.1.29:5191", append([]byte{0x00, 0x05, 0x00, 0x0e}, "10.0.1.29:5191"...)},
+		"hostname": {"aim.example.com:5190", append([]byte{0x00, 0x05, 0x00, 0x14}, "aim.example.com:5190"...)},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			a := &AuthorizationRegistrationService{BOSAddress: tc.address}
+			data, err := a.bosAddressTLV().MarshalBinary()
+			if err != nil {
+				t.Fatalf("could not marshal TLV: %s", err)
+			}
+			if !bytes.Equal(data, tc.expected) {
+				t.Errorf("expected %x, got %x", tc.expected, data)
+			}
+		})
+	}
+}
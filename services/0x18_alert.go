@@ -1,6 +1,7 @@
 package services
 
 import (
+	"aim-oscar/aimerror"
 	"aim-oscar/oscar"
 	"context"
 
@@ -11,5 +12,5 @@ type AlertService struct{}
 
 // This service doesn't seem to do anything
 func (a *AlertService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
-	return ctx, nil
+	return ctx, aimerror.NotSupported
 }
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"aim-oscar/oscar"
+	"context"
+	"time"
+)
+
+// FloodLimit is how many messages a session can send. Sessions build up Rate messages a second,
+// up to Burst of them, and are disconnected once they have been refused MaxStrikes times. A
+// Rate of 0 doesn't limit messages.
+type FloodLimit struct {
+	Rate       float64
+	Burst      int
+	MaxStrikes int
+}
+
+// floodBucket is how many messages a session has left to send, and how many times it has been
+// refused for sending too fast
+type floodBucket struct {
+	tokens  float64
+	last    time.Time
+	strikes int
+}
+
+var floodKey = icbmKey("flood")
+
+// floodBucket is the session's bucket, which starts out full. The returned context holds it.
+func (icbm *ICBM) floodBucket(ctx context.Context) (context.Context, *floodBucket) {
+	if b, ok := ctx.Value(floodKey).(*floodBucket); ok {
+		return ctx, b
+	}
+
+	b := &floodBucket{tokens: float64(icbm.Flood.Burst), last: icbm.now()}
+	return context.WithValue(ctx, floodKey, b), b
+}
+
+// take uses up one of the bucket's messages if it has one, after topping it up for the time
+// since the last message. A session that has stopped flooding for long enough to fill the bucket
+// again has its strikes forgiven.
+func (b *floodBucket) take(limit FloodLimit, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens >= float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+		b.strikes = 0
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (icbm *ICBM) now() time.Time {
+	if icbm.clock != nil {
+		return icbm.clock()
+	}
+	return time.Now()
+}
+
+// checkFlood is false if the session has sent more messages than the flood limit allows. The
+// returned context holds the session's bucket.
+func (icbm *ICBM) checkFlood(ctx context.Context) (context.Context, bool) {
+	if icbm.Flood.Rate <= 0 {
+		return ctx, true
+	}
+
+	ctx, bucket := icbm.floodBucket(ctx)
+	return ctx, bucket.take(icbm.Flood, icbm.now())
+}
+
+// strike refuses a message that was sent too fast. Sessions that keep at it are disconnected.
+func (icbm *ICBM) strike(ctx context.Context, session *oscar.Session, requestID uint32) (context.Context, error) {
+	ctx, bucket := icbm.floodBucket(ctx)
+	bucket.strikes++
+
+	logger := oscar.LoggerFromContext(ctx)
+	logger.Warn("IM flood", "ip", session.RemoteAddr().String(), "strikes", bucket.strikes)
+
+	if icbm.Flood.MaxStrikes > 0 && bucket.strikes >= icbm.Flood.MaxStrikes {
+		logger.Warn("disconnecting flooding session", "ip", session.RemoteAddr().String())
+		return ctx, session.Disconnect()
+	}
+	return ctx, icbm.sendError(session, requestID, 0x03) // error code 0x03: Client rate limit exceeded
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"aim-oscar/oscar"
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestFloodBurst(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	icbm := &ICBM{Flood: FloodLimit{Rate: 1, Burst: 3, MaxStrikes: 5}, clock: clock.Now}
+	ctx := context.Background()
+
+	// A burst goes through all at once
+	var allowed bool
+	for i := 0; i < 3; i++ {
+		if ctx, allowed = icbm.checkFlood(ctx); !allowed {
+			t.Fatalf("expected message %d of the burst to be allowed", i)
+		}
+	}
+	if ctx, allowed = icbm.checkFlood(ctx); allowed {
+		t.Fatalf("expected a message past the burst to be refused")
+	}
+
+	// Then only as fast as the rate
+	clock.Advance(time.Second)
+	if ctx, allowed = icbm.checkFlood(ctx); !allowed {
+		t.Errorf("expected a message a second later to be allowed")
+	}
+	if ctx, allowed = icbm.checkFlood(ctx); allowed {
+		t.Errorf("expected a second message in the same second to be refused")
+	}
+
+	// Waiting long enough fills the bucket again, but no further
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ctx, allowed = icbm.checkFlood(ctx); !allowed {
+			t.Fatalf("expected message %d of the burst to be allowed", i)
+		}
+	}
+	if _, allowed = icbm.checkFlood(ctx); allowed {
+		t.Errorf("expected the bucket not to hold more than a burst")
+	}
+
+	// Other sessions have their own bucket
+	if _, allowed = icbm.checkFlood(context.Background()); !allowed {
+		t.Errorf("expected a new session to be allowed")
+	}
+}
+
+func TestFloodUnlimited(t *testing.T) {
+	icbm := &ICBM{}
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		var allowed bool
+		if ctx, allowed = icbm.checkFlood(ctx); !allowed {
+			t.Fatalf("expected messages without a flood limit to be allowed")
+		}
+	}
+}
+
+func TestFloodDisconnects(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	icbm := &ICBM{Flood: FloodLimit{Rate: 1, Burst: 1, MaxStrikes: 3}, Sessions: fakeSessionManager{}, clock: clock.Now}
+	aliceCtx, aliceSNACs := fakeClient(t, "alice")
+	session, _ := oscar.SessionFromContext(aliceCtx)
+
+	ctx, allowed := icbm.checkFlood(aliceCtx)
+	if !allowed {
+		t.Fatalf("expected the first message to be allowed")
+	}
+
+	// Refused messages get the rate limit error until the session runs out of strikes
+	for i := 0; i < 2; i++ {
+		var err error
+		if ctx, err = icbm.HandleSNAC(ctx, nil, instantMessage("bob", "spam")); err != nil {
+			t.Fatalf("could not send message: %s", err)
+		}
+		if code, _ := expectSNAC(t, aliceSNACs, 0x4, 0x01).Data.ReadUint16(); code != 0x03 {
+			t.Errorf("expected error 0x03, got 0x%02x", code)
+		}
+	}
+
+	icbm.HandleSNAC(ctx, nil, instantMessage("bob", "spam"))
+	expectNoSNAC(t, aliceSNACs)
+	if err := session.Send(oscar.NewFLAP(2)); err == nil {
+		t.Errorf("expected the flooding session to be disconnected")
+	}
+}
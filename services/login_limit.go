@@ -0,0 +1,124 @@
+package services
+
+import (
+	"aim-oscar/util"
+	"sync"
+	"time"
+)
+
+// LoginLimiter turns away logins from an IP, or for a screen name, that has had MaxFailures
+// wrong passwords within Window. The count starts over once Window has passed since the first
+// of them, and entries that old are forgotten so the limiter doesn't grow forever.
+type LoginLimiter struct {
+	MaxFailures int
+	Window      time.Duration
+
+	clock func() time.Time
+
+	mutex     sync.Mutex
+	failures  map[string]*loginFailures
+	lastEvict time.Time
+}
+
+// loginFailures is how many wrong passwords there have been since first
+type loginFailures struct {
+	count int
+	first time.Time
+}
+
+// NewLoginLimiter allows maxFailures wrong passwords per IP and per screen name within window
+func NewLoginLimiter(maxFailures int, window time.Duration) *LoginLimiter {
+	return &LoginLimiter{MaxFailures: maxFailures, Window: window}
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func screenNameKey(screenName string) string {
+	return "sn:" + util.NormalizeScreenName(screenName)
+}
+
+func (l *LoginLimiter) now() time.Time {
+	if l.clock != nil {
+		return l.clock()
+	}
+	return time.Now()
+}
+
+// Allowed is false if ip or screenName has had too many wrong passwords lately. A nil limiter
+// allows everything.
+func (l *LoginLimiter) Allowed(ip, screenName string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.evict(now)
+	for _, key := range []string{ipKey(ip), screenNameKey(screenName)} {
+		if f := l.failures[key]; f != nil && now.Sub(f.first) < l.Window && f.count >= l.MaxFailures {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed counts a wrong password for screenName from ip
+func (l *LoginLimiter) Failed(ip, screenName string) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.evict(now)
+	if l.failures == nil {
+		l.failures = make(map[string]*loginFailures)
+	}
+	for _, key := range []string{ipKey(ip), screenNameKey(screenName)} {
+		f := l.failures[key]
+		if f == nil || now.Sub(f.first) >= l.Window {
+			f = &loginFailures{first: now}
+			l.failures[key] = f
+		}
+		f.count++
+	}
+}
+
+// Succeeded forgets the wrong passwords for screenName once someone gets it right. The IP's
+// are kept, since one host guessing at many accounts can get some of them right.
+func (l *LoginLimiter) Succeeded(screenName string) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, screenNameKey(screenName))
+}
+
+// evict forgets the failures whose window has passed, at most once a window
+func (l *LoginLimiter) evict(now time.Time) {
+	if now.Sub(l.lastEvict) < l.Window {
+		return
+	}
+	l.lastEvict = now
+
+	for key, f := range l.failures {
+		if now.Sub(f.first) >= l.Window {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// Len is how many IPs and screen names have failures being counted
+func (l *LoginLimiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.failures)
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterIP(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := NewLoginLimiter(3, time.Minute)
+	l.clock = clock.Now
+
+	// One IP guessing at different accounts
+	for i := 0; i < 3; i++ {
+		sn := fmt.Sprintf("victim%d", i)
+		if !l.Allowed("192.0.2.1", sn) {
+			t.Fatalf("expected attempt %d to be allowed", i)
+		}
+		l.Failed("192.0.2.1", sn)
+	}
+	if l.Allowed("192.0.2.1", "victim9") {
+		t.Errorf("expected the IP to be limited after 3 failures")
+	}
+	if !l.Allowed("192.0.2.2", "victim9") {
+		t.Errorf("expected other IPs to be allowed")
+	}
+
+	clock.Advance(time.Minute)
+	if !l.Allowed("192.0.2.1", "victim9") {
+		t.Errorf("expected the IP to be allowed once the window passed")
+	}
+}
+
+func TestLoginLimiterScreenName(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := NewLoginLimiter(3, time.Minute)
+	l.clock = clock.Now
+
+	// Many IPs guessing at one account, however they format its screen name
+	for i, sn := range []string{"alice", "Alice", "A lice"} {
+		l.Failed(fmt.Sprintf("198.51.100.%d", i), sn)
+	}
+	if l.Allowed("203.0.113.1", "ALICE") {
+		t.Errorf("expected the screen name to be limited after 3 failures")
+	}
+
+	// Getting it right clears the screen name but not the IPs
+	l.Succeeded("alice")
+	if !l.Allowed("203.0.113.1", "alice") {
+		t.Errorf("expected the screen name to be allowed after a good password")
+	}
+}
+
+func TestLoginLimiterEviction(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := NewLoginLimiter(3, time.Minute)
+	l.clock = clock.Now
+
+	for i := 0; i < 100; i++ {
+		l.Failed(fmt.Sprintf("192.0.2.%d", i), fmt.Sprintf("user%d", i))
+	}
+	if n := l.Len(); n != 200 {
+		t.Fatalf("expected 200 entries, got %d", n)
+	}
+
+	clock.Advance(time.Minute)
+	l.Failed("198.51.100.1", "bob")
+	if n := l.Len(); n != 2 {
+		t.Errorf("expected expired entries to be forgotten, got %d", n)
+	}
+}
+
+func TestLoginLimiterNil(t *testing.T) {
+	var l *LoginLimiter
+	l.Failed("192.0.2.1", "alice")
+	l.Succeeded("alice")
+	if !l.Allowed("192.0.2.1", "alice") {
+		t.Errorf("expected a nil limiter to allow everything")
+	}
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FilterAction is what happens to a message once it has been filtered
+type FilterAction int
+
+const (
+	// FilterAllow delivers the message as it was sent
+	FilterAllow FilterAction = iota
+	// FilterRedact delivers the filtered text in place of what was sent
+	FilterRedact
+	// FilterBlock drops the message, and the sender is told it wasn't delivered
+	FilterBlock
+)
+
+// MessageFilter checks the text of IMs, chat room messages and away message auto-replies before
+// they are stored or delivered. to is the recipient's screen name, or the name of the chat room.
+// The returned text is only used when the action is FilterRedact.
+type MessageFilter interface {
+	Filter(ctx context.Context, from, to string, body string) (string, FilterAction, error)
+}
+
+// filterMessage runs the text through the filter, letting everything through without one
+func filterMessage(ctx context.Context, filter MessageFilter, from, to, body string) (string, FilterAction, error) {
+	if filter == nil {
+		return body, FilterAllow, nil
+	}
+	filtered, action, err := filter.Filter(ctx, from, to, body)
+	if err != nil {
+		return body, FilterAllow, errors.Wrap(err, "could not filter message")
+	}
+	if action != FilterRedact {
+		filtered = body
+	}
+	return filtered, action, nil
+}
+
+// WordFilter is a MessageFilter that blocks messages matching some patterns and blanks out what
+// matches the others
+type WordFilter struct {
+	redact []*regexp.Regexp
+	block  []*regexp.Regexp
+}
+
+// LoadWordFilter reads a WordFilter from a file with a pattern on each line. A pattern is a word
+// or phrase, matched as a whole word whatever its case, or a regular expression between slashes
+// like /fr[e3]+/. Matches are replaced with asterisks, unless the line starts with ! in which case
+// messages matching it are blocked. Blank lines and lines starting with # are ignored.
+func LoadWordFilter(path string) (*WordFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open word list")
+	}
+	defer f.Close()
+
+	filter := &WordFilter{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		block := strings.HasPrefix(pattern, "!")
+		if block {
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+
+		re, err := compileFilterPattern(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern on line %d", line)
+		}
+		if block {
+			filter.block = append(filter.block, re)
+		} else {
+			filter.redact = append(filter.redact, re)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read word list")
+	}
+	return filter, nil
+}
+
+func compileFilterPattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+	}
+	if pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+	return regexp.Compile(`(?i)\b` + regexp.QuoteMeta(pattern) + `\b`)
+}
+
+func (f *WordFilter) Filter(ctx context.Context, from, to string, body string) (string, FilterAction, error) {
+	for _, re := range f.block {
+		if re.MatchString(body) {
+			return "", FilterBlock, nil
+		}
+	}
+
+	action := FilterAllow
+	for _, re := range f.redact {
+		body = re.ReplaceAllStringFunc(body, func(match string) string {
+			action = FilterRedact
+			return strings.Repeat("*", len([]rune(match)))
+		})
+	}
+	return body, action, nil
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testWordFilter(t *testing.T, words string) *WordFilter {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte(words), 0600); err != nil {
+		t.Fatalf("could not write word list: %s", err)
+	}
+	filter, err := LoadWordFilter(path)
+	if err != nil {
+		t.Fatalf("could not load word list: %s", err)
+	}
+	return filter
+}
+
+func TestWordFilter(t *testing.T) {
+	filter := testWordFilter(t, "# words\n\ndarn\n/fr[e3]+d/\n! meet me\n")
+
+	tt := map[string]struct {
+		body     string
+		expected string
+		action   FilterAction
+	}{
+		"clean":               {"hello there", "hello there", FilterAllow},
+		"word":                {"Darn it", "**** it", FilterRedact},
+		"part of a word":      {"darning socks", "darning socks", FilterAllow},
+		"regular expression":  {"hi fr3d and FREED", "hi **** and *****", FilterRedact},
+		"block":               {"can you MEET ME later", "", FilterBlock},
+		"block beats redact":  {"darn, meet me", "", FilterBlock},
+		"phrase across words": {"meet meg", "meet meg", FilterAllow},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			body, action, err := filter.Filter(context.Background(), "alice", "bob", tc.body)
+			if err != nil {
+				t.Fatalf("could not filter: %s", err)
+			}
+			if action != tc.action {
+				t.Errorf("expected action %d, got %d", tc.action, action)
+			}
+			if action != FilterBlock && body != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, body)
+			}
+		})
+	}
+}
+
+func TestLoadWordFilterInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(path, []byte("fine\n/[/\n"), 0600); err != nil {
+		t.Fatalf("could not write word list: %s", err)
+	}
+	if _, err := LoadWordFilter(path); err == nil {
+		t.Errorf("expected an invalid regular expression to be an error")
+	}
+}
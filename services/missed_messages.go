@@ -0,0 +1,129 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"sort"
+)
+
+// Why messages to a user were dropped, in the missed messages SNAC (0x04,0x0a)
+const (
+	MissedInvalid         = 0x00
+	MissedTooLarge        = 0x01
+	MissedRateExceeded    = 0x02
+	MissedSenderWarned    = 0x03
+	MissedRecipientWarned = 0x04
+)
+
+// missedKey is who a user missed messages from, on which channel and why
+type missedKey struct {
+	from    string
+	channel uint16
+	reason  uint16
+}
+
+// missed is how many messages a user missed for the same reason from the same sender, who is
+// as they were when the last one was dropped
+type missed struct {
+	sender  models.User
+	channel uint16
+	reason  uint16
+	count   uint16
+}
+
+// messageMissed counts a message from the sender that was dropped on its way to the screen
+// name, which they're told about with the next message they get. Users who aren't signed on
+// aren't told.
+func (icbm *ICBM) messageMissed(to string, from *models.User, channel uint16, reason uint16) {
+	toSession := icbm.Sessions.GetSession(to)
+	if toSession == nil {
+		return
+	}
+
+	icbm.missedMutex.Lock()
+	defer icbm.missedMutex.Unlock()
+
+	if icbm.missed == nil {
+		icbm.missed = make(map[*oscar.Session]map[missedKey]*missed)
+	}
+	if icbm.missed[toSession] == nil {
+		icbm.missed[toSession] = make(map[missedKey]*missed)
+	}
+
+	key := missedKey{util.NormalizeScreenName(from.ScreenName), channel, reason}
+	m := icbm.missed[toSession][key]
+	if m == nil {
+		m = &missed{channel: channel, reason: reason}
+		icbm.missed[toSession][key] = m
+	}
+	m.sender = *from
+	if m.count < 0xffff {
+		m.count++
+	}
+}
+
+// tellMissed sends the session the messages it missed since it was last told, if there are any
+func (icbm *ICBM) tellMissed(session *oscar.Session) error {
+	icbm.missedMutex.Lock()
+	counts := icbm.missed[session]
+	delete(icbm.missed, session)
+	icbm.missedMutex.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	missedFlap := oscar.NewFLAP(2)
+	missedFlap.Data.WriteBinary(missedMessagesSNAC(counts))
+	return session.Send(missedFlap)
+}
+
+// FlushMissedMessages tells every session the messages it missed, for users who haven't been
+// sent a message since. Sessions that have disconnected are forgotten.
+func (icbm *ICBM) FlushMissedMessages() {
+	icbm.missedMutex.Lock()
+	sessions := make([]*oscar.Session, 0, len(icbm.missed))
+	for session := range icbm.missed {
+		if session.Context().Err() != nil {
+			delete(icbm.missed, session)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	icbm.missedMutex.Unlock()
+
+	for _, session := range sessions {
+		if err := icbm.tellMissed(session); err != nil && session.Logger != nil {
+			session.Logger.Error("could not send missed messages", "err", err.Error())
+		}
+	}
+}
+
+// missedMessagesSNAC lists the missed messages by sender, each with its channel, the sender's
+// user info, how many were missed and why
+func missedMessagesSNAC(counts map[missedKey]*missed) *oscar.SNAC {
+	keys := make([]missedKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].from != keys[j].from {
+			return keys[i].from < keys[j].from
+		}
+		if keys[i].channel != keys[j].channel {
+			return keys[i].channel < keys[j].channel
+		}
+		return keys[i].reason < keys[j].reason
+	})
+
+	missedSnac := oscar.NewSNAC(0x04, 0x0a)
+	for _, key := range keys {
+		m := counts[key]
+		missedSnac.Data.WriteUint16(m.channel)
+		WriteUserInfo(missedSnac, &m.sender, nil)
+		missedSnac.Data.WriteUint16(m.count)
+		missedSnac.Data.WriteUint16(m.reason)
+	}
+	return missedSnac
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"testing"
+)
+
+// missedBlock is one sender's entry in a missed messages SNAC
+type missedBlock struct {
+	channel uint16
+	from    string
+	count   uint16
+	reason  uint16
+}
+
+func readMissed(t *testing.T, snac *oscar.SNAC) []missedBlock {
+	t.Helper()
+	var blocks []missedBlock
+	for len(snac.Data.Bytes()) > 0 {
+		var block missedBlock
+		block.channel, _ = snac.Data.ReadUint16()
+		block.from, _ = snac.Data.ReadLPString()
+		snac.Data.ReadUint16() // warning level
+		count, _ := snac.Data.ReadUint16()
+		if _, err := snac.Data.ReadTLVs(int(count)); err != nil {
+			t.Fatalf("could not read user info: %s", err)
+		}
+		block.count, _ = snac.Data.ReadUint16()
+		var err error
+		if block.reason, err = snac.Data.ReadUint16(); err != nil {
+			t.Fatalf("could not read missed messages: %s", err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestMissedMessages(t *testing.T) {
+	aliceCtx, aliceSNACs := fakeClient(t, "alice")
+	bobCtx, bobSNACs := fakeClient(t, "bob")
+	bobSession, _ := oscar.SessionFromContext(bobCtx)
+
+	icbm := &ICBM{
+		Sessions:       fakeSessionManager{"bob": bobSession},
+		MaxMessageSize: 4,
+		Flood:          FloodLimit{Rate: 1, Burst: 1, MaxStrikes: 10},
+	}
+
+	// Messages too large for the server
+	for i := 0; i < 2; i++ {
+		if _, err := icbm.HandleSNAC(aliceCtx, nil, instantMessage("bob", "hello")); err != nil {
+			t.Fatalf("could not send message: %s", err)
+		}
+		expectSNAC(t, aliceSNACs, 0x4, 0x01)
+	}
+
+	// A message sent too fast
+	ctx, _ := icbm.checkFlood(aliceCtx)
+	if _, err := icbm.HandleSNAC(ctx, nil, instantMessage("bob", "hi")); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+	expectSNAC(t, aliceSNACs, 0x4, 0x01)
+
+	// Nobody was sent anything about them yet
+	expectNoSNAC(t, bobSNACs)
+
+	icbm.FlushMissedMessages()
+	blocks := readMissed(t, expectSNAC(t, bobSNACs, 0x4, 0x0a))
+	expected := []missedBlock{
+		{channel: 1, from: "alice", count: 2, reason: MissedTooLarge},
+		{channel: 1, from: "alice", count: 1, reason: MissedRateExceeded},
+	}
+	if len(blocks) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, blocks)
+	}
+	for i := range expected {
+		if blocks[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], blocks[i])
+		}
+	}
+
+	// Once told, bob isn't told again
+	icbm.FlushMissedMessages()
+	expectNoSNAC(t, bobSNACs)
+
+	// Sessions that disconnect before they're told are forgotten
+	icbm.messageMissed("bob", &models.User{ScreenName: "alice"}, 1, MissedTooLarge)
+	bobSession.Disconnect()
+	icbm.FlushMissedMessages()
+	if len(icbm.missed) != 0 {
+		t.Errorf("expected the disconnected session to be forgotten")
+	}
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"time"
+)
+
+type PresenceEventType int
+
+const (
+	// The user's online status changed (signed on, went away, signed off)
+	PresenceStatusChanged PresenceEventType = iota
+	// The user went idle or came back from being idle
+	PresenceIdleChanged
+	// The user changed something buddies see in their user info, like their available message
+	PresenceInfoChanged
+)
+
+// InfoOnly is true for events that change what buddies see about the user but not whether they
+// can see them
+func (t PresenceEventType) InfoOnly() bool {
+	return t == PresenceIdleChanged || t == PresenceInfoChanged
+}
+
+// PresenceTransition is what a status change means to the user's buddies
+type PresenceTransition int
+
+const (
+	// The user signed on, or changed their status to one buddies can see
+	PresenceOnline PresenceTransition = iota
+	// The user set an away message
+	PresenceAway
+	// The user cleared their away message
+	PresenceBack
+	// The user signed off, or is hiding from buddies
+	PresenceOffline
+)
+
+// Toggle is true for transitions that only flip the away bit, which clients can send many of in
+// a row
+func (t PresenceTransition) Toggle() bool {
+	return t == PresenceAway || t == PresenceBack
+}
+
+// PresenceEvent tells the online notification routine that buddies need to hear about a user.
+// User is a copy of the user as they were when the event was made, since the session that made
+// it goes on changing its own.
+type PresenceEvent struct {
+	User       *models.User
+	Type       PresenceEventType
+	Transition PresenceTransition
+}
+
+// StatusChanged is a PresenceEvent for a change to user.Status
+func StatusChanged(user *models.User) *PresenceEvent {
+	transition := PresenceOnline
+	if !user.Status.Visible() {
+		transition = PresenceOffline
+	}
+	u := *user
+	return &PresenceEvent{User: &u, Type: PresenceStatusChanged, Transition: transition}
+}
+
+// WentAway is a PresenceEvent for the user setting an away message
+func WentAway(user *models.User) *PresenceEvent {
+	u := *user
+	return &PresenceEvent{User: &u, Type: PresenceStatusChanged, Transition: PresenceAway}
+}
+
+// CameBack is a PresenceEvent for the user clearing their away message
+func CameBack(user *models.User) *PresenceEvent {
+	u := *user
+	return &PresenceEvent{User: &u, Type: PresenceStatusChanged, Transition: PresenceBack}
+}
+
+// IdleChanged is a PresenceEvent for the user going idle or coming back
+func IdleChanged(user *models.User) *PresenceEvent {
+	u := *user
+	return &PresenceEvent{User: &u, Type: PresenceIdleChanged, Transition: PresenceOnline}
+}
+
+// InfoChanged is a PresenceEvent for the user changing their available message, buddy icon or
+// the formatting of their screen name
+func InfoChanged(user *models.User) *PresenceEvent {
+	u := *user
+	return &PresenceEvent{User: &u, Type: PresenceInfoChanged, Transition: PresenceOnline}
+}
+
+// User class bits sent in TLV 0x01 of user info blocks
+const (
+	UserClassAOL  = 0x0004
+	UserClassFree = 0x0010
+	UserClassAway = 0x0020
+	UserClassBot  = 0x0400
+)
+
+// UserClass is the user class bitmask buddies see for user. Clients only know about away, so
+// users who don't want to be disturbed are away too.
+func UserClass(user *models.User) uint16 {
+	class := uint16(UserClassAOL)
+	switch user.Status {
+	case models.UserStatusAway, models.UserStatusDnd, models.UserStatusNA, models.UserStatusOccupied:
+		class |= UserClassAway
+	}
+	if user.Bot {
+		class |= UserClassBot
+	}
+	return class
+}
+
+// WriteUserInfo writes the user info block for user to the SNAC: their screen name, warning
+// level and UserInfoTLVs, then any extra TLVs only the user themself sees. Buddy arrivals and
+// self info share it so their formats can't drift apart.
+func WriteUserInfo(snac *oscar.SNAC, user *models.User, session *oscar.Session, extra ...*oscar.TLV) {
+	snac.Data.WriteLPString(user.ScreenName)
+	snac.Data.WriteUint16(user.WarningLevel)
+	snac.AppendTLVs(append(UserInfoTLVs(user, session), extra...))
+}
+
+// UserInfoTLVs are the TLVs of the user info block others see for user, in buddy arrivals and
+// user info replies. session is the user's session if they are connected and holds their
+// in-memory presence like when they signed on and idle time.
+func UserInfoTLVs(user *models.User, session *oscar.Session) []*oscar.TLV {
+	signonAt := time.Now()
+	var idleSince time.Time
+	if session != nil {
+		if at := session.SignonAt(); !at.IsZero() {
+			signonAt = at
+		}
+		idleSince = session.IdleSince()
+	}
+
+	tlvs := []*oscar.TLV{
+		oscar.NewTLV(0x01, util.Word(UserClass(user))),
+		oscar.NewTLV(0x06, util.Dword(uint32(user.Status))),
+		oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(signonAt).Seconds()))), // online time
+		oscar.NewTLV(0x03, util.Dword(uint32(signonAt.Unix()))),                // signon time
+	}
+
+	if !user.CreatedAt.IsZero() {
+		tlvs = append(tlvs, oscar.NewTLV(0x05, util.Dword(uint32(user.CreatedAt.Unix())))) // member since
+	}
+
+	// Idle time in minutes
+	if !idleSince.IsZero() {
+		tlvs = append(tlvs, oscar.NewTLV(0x04, util.Word(uint16(time.Since(idleSince).Minutes()))))
+	}
+
+	if bartTLV := BARTInfoTLV(user, session); bartTLV != nil {
+		tlvs = append(tlvs, bartTLV)
+	}
+
+	if capabilitiesTLV := CapabilitiesTLV(session); capabilitiesTLV != nil {
+		tlvs = append(tlvs, capabilitiesTLV)
+	}
+
+	return tlvs
+}
+
+// Status flags in the low word of an extended status (TLV 0x06). ICQ clients combine them, e.g.
+// do not disturb is sent as 0x0013.
+const (
+	StatusFlagAway      = 0x0001
+	StatusFlagDnd       = 0x0002
+	StatusFlagNA        = 0x0004
+	StatusFlagOccupied  = 0x0010
+	StatusFlagFree4Chat = 0x0020
+	StatusFlagInvisible = 0x0100
+)
+
+// StatusFromFlags is the status a client means by the flags of its extended status, the most
+// restrictive one if it sets several
+func StatusFromFlags(flags uint16) models.UserStatus {
+	switch {
+	case flags&StatusFlagInvisible != 0:
+		return models.UserStatusInvisible
+	case flags&StatusFlagDnd != 0:
+		return models.UserStatusDnd
+	case flags&StatusFlagOccupied != 0:
+		return models.UserStatusOccupied
+	case flags&StatusFlagNA != 0:
+		return models.UserStatusNA
+	case flags&StatusFlagAway != 0:
+		return models.UserStatusAway
+	case flags&StatusFlagFree4Chat != 0:
+		return models.UserStatusFree4Chat
+	}
+	return models.UserStatusOnline
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Events keep the user as they were, not as their session goes on to change them
+func TestPresenceEventCopiesUser(t *testing.T) {
+	constructors := map[string]func(*models.User) *PresenceEvent{
+		"StatusChanged": StatusChanged,
+		"WentAway":      WentAway,
+		"CameBack":      CameBack,
+		"IdleChanged":   IdleChanged,
+		"InfoChanged":   InfoChanged,
+	}
+
+	for name, constructor := range constructors {
+		t.Run(name, func(t *testing.T) {
+			user := &models.User{ScreenName: "alice", Status: models.UserStatusAway}
+			event := constructor(user)
+			user.ScreenName = "Alice"
+			user.Status = models.UserStatusOnline
+
+			if event.User == user || event.User.ScreenName != "alice" || event.User.Status != models.UserStatusAway {
+				t.Errorf("expected the event to keep alice away, got %+v", event.User)
+			}
+		})
+	}
+}
+
+func TestUserClass(t *testing.T) {
+	tt := map[string]struct {
+		status   models.UserStatus
+		bot      bool
+		expected uint16
+	}{
+		"online":    {models.UserStatusOnline, false, UserClassAOL},
+		"away":      {models.UserStatusAway, false, UserClassAOL | UserClassAway},
+		"dnd":       {models.UserStatusDnd, false, UserClassAOL | UserClassAway},
+		"invisible": {models.UserStatusInvisible, false, UserClassAOL},
+		"offline":   {models.UserStatusOffline, false, UserClassAOL},
+		"bot":       {models.UserStatusOnline, true, UserClassAOL | UserClassBot},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			class := UserClass(&models.User{Status: tc.status, Bot: tc.bot})
+			if class != tc.expected {
+				t.Errorf("expected class 0x%04x, got 0x%04x", tc.expected, class)
+			}
+		})
+	}
+}
+
+func TestStatusFromFlags(t *testing.T) {
+	tt := map[string]struct {
+		flags    uint16
+		expected models.UserStatus
+	}{
+		"online":           {0x0000, models.UserStatusOnline},
+		"away":             {0x0001, models.UserStatusAway},
+		"icq dnd":          {0x0013, models.UserStatusDnd},
+		"icq na":           {0x0005, models.UserStatusNA},
+		"icq occupied":     {0x0011, models.UserStatusOccupied},
+		"free for chat":    {0x0020, models.UserStatusFree4Chat},
+		"invisible":        {0x0100, models.UserStatusInvisible},
+		"invisible and na": {0x0105, models.UserStatusInvisible},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if status := StatusFromFlags(tc.flags); status != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, status)
+			}
+		})
+	}
+}
+
+func TestUserInfoTLVs(t *testing.T) {
+	ctx, _ := fakeClient(t, "alice")
+	session, _ := oscar.SessionFromContext(ctx)
+	session.SetSignonAt(time.Now().Add(-time.Hour))
+	createdAt := time.Date(2001, 9, 9, 1, 46, 40, 0, time.UTC)
+
+	tlvs := UserInfoTLVs(&models.User{ScreenName: "alice", CreatedAt: createdAt}, session)
+
+	expected := map[uint16]uint32{
+		0x03: uint32(session.SignonAt().Unix()),
+		0x05: uint32(createdAt.Unix()),
+		0x0f: 3600,
+	}
+	for tlvType, value := range expected {
+		tlv := oscar.FindTLV(tlvs, tlvType)
+		if tlv == nil || len(tlv.Data) != 4 {
+			t.Errorf("expected TLV 0x%02x to be a dword, got %v", tlvType, tlv)
+			continue
+		}
+		if got := binary.BigEndian.Uint32(tlv.Data); got < value || got > value+1 {
+			t.Errorf("expected TLV 0x%02x to be %d, got %d", tlvType, value, got)
+		}
+	}
+
+	// Users from before member since was recorded don't have it
+	if tlv := oscar.FindTLV(UserInfoTLVs(&models.User{ScreenName: "alice"}, session), 0x05); tlv != nil {
+		t.Errorf("expected no member since without a creation time, got %v", tlv)
+	}
+}
+
+// Buddies read the session's presence while its own connection changes it. Run with -race.
+func TestUserInfoTLVsWhilePresenceChanges(t *testing.T) {
+	ctx, _ := fakeClient(t, "alice")
+	session, _ := oscar.SessionFromContext(ctx)
+	user := models.UserFromContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			session.SetIdleSince(time.Now().Add(-time.Duration(i) * time.Minute))
+			session.SetCapabilities([]byte(fmt.Sprintf("%016d", i)))
+			session.SetAvailableMessage(fmt.Sprintf("message %d", i))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			UserInfoTLVs(user, session)
+			CapabilitiesTLV(session)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"time"
+)
+
+// RendezvousTimeout is how long a rendezvous nobody has sent anything for is remembered
+const RendezvousTimeout = 30 * time.Minute
+
+// rendezvousKey is a rendezvous between two users, by its cookie. The screen names are
+// normalized and in order, so both users have the same key.
+type rendezvousKey struct {
+	cookie [8]byte
+	a, b   string
+}
+
+func newRendezvousKey(cookie [8]byte, from, to string) rendezvousKey {
+	a, b := util.NormalizeScreenName(from), util.NormalizeScreenName(to)
+	if b < a {
+		a, b = b, a
+	}
+	return rendezvousKey{cookie, a, b}
+}
+
+// pendingRendezvous is the sessions of the two users when the rendezvous was proposed, by
+// normalized screen name, and when either of them last sent anything for it. Chat invitations
+// have the room they are for.
+type pendingRendezvous struct {
+	sessions map[string]*oscar.Session
+	room     *models.ChatRoom
+	updated  time.Time
+}
+
+// proposeRendezvous remembers the sessions the rendezvous is between. Counter-proposals and
+// proposals after a user signed back on take the sessions they are sent between.
+func (icbm *ICBM) proposeRendezvous(key rendezvousKey, from string, fromSession *oscar.Session, to string, toSession *oscar.Session, room *models.ChatRoom) {
+	icbm.rendezvousMutex.Lock()
+	defer icbm.rendezvousMutex.Unlock()
+
+	icbm.pruneRendezvous()
+	if icbm.rendezvous == nil {
+		icbm.rendezvous = make(map[rendezvousKey]*pendingRendezvous)
+	}
+	icbm.rendezvous[key] = &pendingRendezvous{
+		sessions: map[string]*oscar.Session{
+			util.NormalizeScreenName(from): fromSession,
+			util.NormalizeScreenName(to):   toSession,
+		},
+		room:    room,
+		updated: icbm.now(),
+	}
+}
+
+// answerRendezvous is whether the recipient of an accept or cancel is still signed on with the
+// session the rendezvous was proposed to or from, and the room if it's a chat invitation.
+// Rendezvous the server doesn't know, like ones proposed before it started, are let through.
+func (icbm *ICBM) answerRendezvous(key rendezvousKey, to string, toSession *oscar.Session) (*models.ChatRoom, bool) {
+	icbm.rendezvousMutex.Lock()
+	defer icbm.rendezvousMutex.Unlock()
+
+	icbm.pruneRendezvous()
+	r := icbm.rendezvous[key]
+	if r == nil {
+		return nil, true
+	}
+	if r.sessions[util.NormalizeScreenName(to)] != toSession {
+		delete(icbm.rendezvous, key)
+		return nil, false
+	}
+	r.updated = icbm.now()
+	return r.room, true
+}
+
+// forgetRendezvous forgets a rendezvous that was cancelled or can't go on
+func (icbm *ICBM) forgetRendezvous(key rendezvousKey) {
+	icbm.rendezvousMutex.Lock()
+	defer icbm.rendezvousMutex.Unlock()
+
+	delete(icbm.rendezvous, key)
+}
+
+// pruneRendezvous forgets rendezvous that timed out or that both users disconnected from. One
+// user is enough to keep it, as they can still answer it and be told the other side is gone.
+// The caller holds rendezvousMutex.
+func (icbm *ICBM) pruneRendezvous() {
+	cutoff := icbm.now().Add(-RendezvousTimeout)
+	for key, r := range icbm.rendezvous {
+		connected := false
+		for _, session := range r.sessions {
+			if session.Context().Err() == nil {
+				connected = true
+			}
+		}
+		if !connected || r.updated.Before(cutoff) {
+			delete(icbm.rendezvous, key)
+		}
+	}
+}
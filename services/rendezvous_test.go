@@ -0,0 +1,103 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"testing"
+	"time"
+)
+
+// reachable is whether answerRendezvous let the answer through
+func reachable(_ *models.ChatRoom, ok bool) bool {
+	return ok
+}
+
+func TestAnswerRendezvous(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	icbm := &ICBM{clock: clock.Now}
+
+	aliceCtx, _ := fakeClient(t, "alice")
+	alice, _ := oscar.SessionFromContext(aliceCtx)
+	bobCtx, _ := fakeClient(t, "bob")
+	bob, _ := oscar.SessionFromContext(bobCtx)
+	cookie := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// Both users have the same key, however they write their screen names
+	key := newRendezvousKey(cookie, "Alice", "bob")
+	if newRendezvousKey(cookie, "B O B", "alice") != key {
+		t.Fatalf("expected both users to have the same rendezvous key")
+	}
+
+	// Rendezvous the server never saw proposed are let through
+	if !reachable(icbm.answerRendezvous(key, "bob", bob)) {
+		t.Errorf("expected an unknown rendezvous to be let through")
+	}
+
+	icbm.proposeRendezvous(key, "Alice", alice, "bob", bob, nil)
+	if !reachable(icbm.answerRendezvous(key, "BOB", bob)) || !reachable(icbm.answerRendezvous(key, "alice", alice)) {
+		t.Errorf("expected both sides to be reachable")
+	}
+
+	// bob signing on again is a different session, which knows nothing of the rendezvous
+	bobAgainCtx, _ := fakeClient(t, "bob")
+	bobAgain, _ := oscar.SessionFromContext(bobAgainCtx)
+	if reachable(icbm.answerRendezvous(key, "bob", bobAgain)) {
+		t.Errorf("expected bob's new session not to be reachable")
+	}
+	if len(icbm.rendezvous) != 0 {
+		t.Errorf("expected the rendezvous to be forgotten")
+	}
+
+	// A new proposal starts it again between the sessions it is sent between
+	icbm.proposeRendezvous(key, "bob", bobAgain, "alice", alice, nil)
+	if !reachable(icbm.answerRendezvous(key, "bob", bobAgain)) {
+		t.Errorf("expected bob's new session to be reachable after proposing again")
+	}
+	icbm.forgetRendezvous(key)
+	if len(icbm.rendezvous) != 0 {
+		t.Errorf("expected the rendezvous to be forgotten")
+	}
+}
+
+func TestRendezvousPruned(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	icbm := &ICBM{clock: clock.Now}
+
+	aliceCtx, _ := fakeClient(t, "alice")
+	alice, _ := oscar.SessionFromContext(aliceCtx)
+	bobCtx, _ := fakeClient(t, "bob")
+	bob, _ := oscar.SessionFromContext(bobCtx)
+	carolCtx, _ := fakeClient(t, "carol")
+	carol, _ := oscar.SessionFromContext(carolCtx)
+
+	answered := newRendezvousKey([8]byte{1}, "alice", "bob")
+	timedOut := newRendezvousKey([8]byte{2}, "alice", "carol")
+	icbm.proposeRendezvous(answered, "alice", alice, "bob", bob, nil)
+	icbm.proposeRendezvous(timedOut, "alice", alice, "carol", carol, nil)
+
+	// Answering keeps a rendezvous from timing out
+	clock.Advance(RendezvousTimeout / 2)
+	icbm.answerRendezvous(answered, "bob", bob)
+	clock.Advance(RendezvousTimeout/2 + time.Second)
+	icbm.pruneRendezvous()
+	if _, ok := icbm.rendezvous[timedOut]; ok {
+		t.Errorf("expected the rendezvous nobody answered to time out")
+	}
+	if _, ok := icbm.rendezvous[answered]; !ok {
+		t.Fatalf("expected the answered rendezvous to be remembered")
+	}
+
+	// alice can still answer it when bob has gone, but not once she has too
+	bob.Disconnect()
+	<-bob.Context().Done()
+	icbm.pruneRendezvous()
+	if _, ok := icbm.rendezvous[answered]; !ok {
+		t.Fatalf("expected the rendezvous alice is still there for to be remembered")
+	}
+	alice.Disconnect()
+	<-alice.Context().Done()
+	icbm.pruneRendezvous()
+	if len(icbm.rendezvous) != 0 {
+		t.Errorf("expected the rendezvous both users disconnected from to be forgotten")
+	}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"aim-oscar/models"
 	"aim-oscar/oscar"
 	"context"
 
@@ -10,3 +11,16 @@ import (
 type Service interface {
 	HandleSNAC(context.Context, *bun.DB, *oscar.SNAC) (context.Context, error)
 }
+
+// SessionManager finds the session of a signed on user, nil if they aren't connected
+type SessionManager interface {
+	GetSession(screenName string) *oscar.Session
+}
+
+// Mailer emails users. Without one no email is sent.
+type Mailer interface {
+	SendConfirmation(ctx context.Context, user *models.User) error
+
+	// SendInvitation emails the user's friend their invitation to sign up
+	SendInvitation(ctx context.Context, inviter *models.User, email, message string) error
+}
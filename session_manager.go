@@ -1,33 +1,79 @@
 package main
 
 import (
+	"aim-oscar/metrics"
 	"aim-oscar/oscar"
+	"aim-oscar/stats"
+	"aim-oscar/util"
+	"encoding/json"
+	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
-// SessionManager maps screen names to user sessions
+// MultipleLoginPolicy decides what happens when a user signs on while they already have a
+// session
+type MultipleLoginPolicy string
+
+const (
+	// KickOldSession signs off the existing session in favour of the new one
+	KickOldSession MultipleLoginPolicy = "kick-old"
+
+	// RejectNewSession keeps the existing session and turns the new one away
+	RejectNewSession MultipleLoginPolicy = "reject-new"
+)
+
+// SessionManager maps screen names to user sessions. Screen names are looked up ignoring case
+// and spaces, so "Some User" and "someuser" share a session.
 type SessionManager struct {
 	sessions map[string]*oscar.Session
 	mutex    *sync.RWMutex
+	policy   MultipleLoginPolicy
 }
 
-func NewSessionManager() *SessionManager {
+func NewSessionManager(policy MultipleLoginPolicy) *SessionManager {
 	sm := &SessionManager{
 		sessions: make(map[string]*oscar.Session),
 		mutex:    &sync.RWMutex{},
+		policy:   policy,
 	}
 	return sm
 }
 
-func (sm *SessionManager) SetSession(screen_name string, session *oscar.Session) {
+// ClaimSession makes session the user's session according to the multiple login policy. It
+// returns the session that was kicked to make way for it, if any, and false if the session
+// was rejected because the user already has one.
+func (sm *SessionManager) ClaimSession(screen_name string, session *oscar.Session) (*oscar.Session, bool) {
+	screen_name = util.NormalizeScreenName(screen_name)
+
 	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	existing := sm.sessions[screen_name]
+	if existing == session {
+		return nil, true
+	}
+	if existing == nil {
+		metrics.ActiveSessions.Inc()
+		stats.Default.SessionStarted()
+		stats.Default.Login()
+		sm.sessions[screen_name] = session
+		return nil, true
+	}
+
+	if sm.policy == RejectNewSession {
+		return existing, false
+	}
+
+	stats.Default.Login()
 	sm.sessions[screen_name] = session
-	sm.mutex.Unlock()
+	return existing, true
 }
 
 func (sm *SessionManager) GetSession(screen_name string) *oscar.Session {
 	sm.mutex.RLock()
-	s, ok := sm.sessions[screen_name]
+	s, ok := sm.sessions[util.NormalizeScreenName(screen_name)]
 	sm.mutex.RUnlock()
 
 	if ok {
@@ -36,8 +82,110 @@ func (sm *SessionManager) GetSession(screen_name string) *oscar.Session {
 	return nil
 }
 
-func (sm *SessionManager) RemoveSession(screen_name string) {
+// Count is how many users have a session
+func (sm *SessionManager) Count() int {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return len(sm.sessions)
+}
+
+// Range calls fn with each session until it returns false. The sessions are those at the
+// time Range was called, so fn is free to use the SessionManager.
+func (sm *SessionManager) Range(fn func(session *oscar.Session) bool) {
+	sm.mutex.RLock()
+	sessions := make([]*oscar.Session, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	sm.mutex.RUnlock()
+
+	for _, session := range sessions {
+		if !fn(session) {
+			return
+		}
+	}
+}
+
+// Silent is every session that hasn't heard from its client since the time. Internal sessions,
+// which have no client, are never silent.
+func (sm *SessionManager) Silent(since time.Time) []*oscar.Session {
+	silent := make([]*oscar.Session, 0)
+	sm.Range(func(session *oscar.Session) bool {
+		if !session.Internal() && session.LastHeard().Before(since) {
+			silent = append(silent, session)
+		}
+		return true
+	})
+	return silent
+}
+
+// RemoveSession forgets the user's session if it is still session. Returns false if the user
+// has since signed on with another session, which has to be left alone.
+func (sm *SessionManager) RemoveSession(screen_name string, session *oscar.Session) bool {
+	screen_name = util.NormalizeScreenName(screen_name)
+
 	sm.mutex.Lock()
-	sm.sessions[screen_name] = nil
-	sm.mutex.Unlock()
+	defer sm.mutex.Unlock()
+
+	if sm.sessions[screen_name] != session {
+		return false
+	}
+	delete(sm.sessions, screen_name)
+	metrics.ActiveSessions.Dec()
+	stats.Default.SessionEnded()
+	return true
+}
+
+// SessionInfo is a signed on session as the admin API lists it
+type SessionInfo struct {
+	ID         string     `json:"id"`
+	ScreenName string     `json:"screen_name"`
+	IP         string     `json:"ip"`
+	SignonAt   time.Time  `json:"signon_at"`
+	LastHeard  time.Time  `json:"last_heard"`
+	IdleSince  *time.Time `json:"idle_since,omitempty"`
+}
+
+// List is every session, by screen name
+func (sm *SessionManager) List() []SessionInfo {
+	list := make([]SessionInfo, 0)
+	sm.Range(func(session *oscar.Session) bool {
+		info := SessionInfo{
+			ID:         session.ID,
+			ScreenName: session.ScreenName(),
+			IP:         session.RemoteAddr().String(),
+			SignonAt:   session.SignonAt(),
+			LastHeard:  session.LastHeard(),
+		}
+		if idleSince := session.IdleSince(); !idleSince.IsZero() {
+			info.IdleSince = &idleSince
+		}
+		list = append(list, info)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ScreenName < list[j].ScreenName })
+	return list
+}
+
+// sessionsHandler is the admin endpoint that lists the signed on sessions, with the IDs their
+// log lines have
+func sessionsHandler(sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sm.List())
+	}
+}
+
+// signedOnElsewhereFLAP tells a client that its user has signed on from another location
+func signedOnElsewhereFLAP(screen_name string) *oscar.FLAP {
+	flap := oscar.NewFLAP(4)
+	flap.Data.WriteBinary(oscar.NewTLV(0x01, []byte(screen_name)))
+	flap.Data.WriteBinary(oscar.NewTLV(0x09, util.Word(0x01))) // signed on from another location
+	return flap
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClaimSessionKickOld(t *testing.T) {
+	sm := NewSessionManager(KickOldSession)
+	first, second := &oscar.Session{}, &oscar.Session{}
+
+	if previous, ok := sm.ClaimSession("alice", first); !ok || previous != nil {
+		t.Fatalf("expected the first session to be claimed, got %v %v", previous, ok)
+	}
+
+	if previous, ok := sm.ClaimSession("alice", second); !ok || previous != first {
+		t.Fatalf("expected the second session to kick the first, got %v %v", previous, ok)
+	}
+
+	// The kicked session closing leaves the new one alone
+	if sm.RemoveSession("alice", first) {
+		t.Errorf("expected the kicked session not to remove the new one")
+	}
+	if sm.GetSession("alice") != second {
+		t.Errorf("expected the second session to be alice's session")
+	}
+
+	if !sm.RemoveSession("alice", second) || sm.GetSession("alice") != nil {
+		t.Errorf("expected alice to have no session once the second closes")
+	}
+}
+
+func TestClaimSessionRejectNew(t *testing.T) {
+	sm := NewSessionManager(RejectNewSession)
+	first, second := &oscar.Session{}, &oscar.Session{}
+
+	sm.ClaimSession("alice", first)
+	if previous, ok := sm.ClaimSession("alice", second); ok || previous != first {
+		t.Fatalf("expected the second session to be rejected, got %v %v", previous, ok)
+	}
+	if sm.GetSession("alice") != first {
+		t.Errorf("expected the first session to still be alice's session")
+	}
+
+	// Claiming again with the same session is fine
+	if _, ok := sm.ClaimSession("alice", first); !ok {
+		t.Errorf("expected the first session to be able to claim again")
+	}
+}
+
+func TestClaimSessionSimultaneous(t *testing.T) {
+	for _, policy := range []MultipleLoginPolicy{KickOldSession, RejectNewSession} {
+		t.Run(string(policy), func(t *testing.T) {
+			sm := NewSessionManager(policy)
+			sessions := make([]*oscar.Session, 50)
+			for i := range sessions {
+				sessions[i] = &oscar.Session{}
+			}
+
+			var mutex sync.Mutex
+			kicked := make(map[*oscar.Session]bool)
+			rejected := 0
+
+			var wg sync.WaitGroup
+			for _, session := range sessions {
+				wg.Add(1)
+				go func(session *oscar.Session) {
+					defer wg.Done()
+					previous, ok := sm.ClaimSession("alice", session)
+
+					mutex.Lock()
+					defer mutex.Unlock()
+					if !ok {
+						rejected++
+					} else if previous != nil {
+						kicked[previous] = true
+					}
+				}(session)
+			}
+			wg.Wait()
+
+			// Every session but the one left standing was turned away or kicked, exactly once
+			current := sm.GetSession("alice")
+			if current == nil {
+				t.Fatalf("expected alice to have a session")
+			}
+			if kicked[current] {
+				t.Errorf("expected the current session not to have been kicked")
+			}
+			if len(kicked)+rejected != len(sessions)-1 {
+				t.Errorf("expected %d sessions turned away, got %d kicked and %d rejected", len(sessions)-1, len(kicked), rejected)
+			}
+		})
+	}
+}
+
+func TestSilentSessions(t *testing.T) {
+	sm := NewSessionManager(KickOldSession)
+	session := oscar.NewSession(nil, nil)
+	sm.ClaimSession("alice", session)
+
+	if silent := sm.Silent(time.Now().Add(-time.Minute)); len(silent) != 0 {
+		t.Errorf("expected a session that was just heard from not to be silent, got %d", len(silent))
+	}
+
+	if silent := sm.Silent(time.Now().Add(time.Minute)); len(silent) != 1 || silent[0] != session {
+		t.Errorf("expected the session to be silent, got %v", silent)
+	}
+
+	session.Heard()
+	if heard := session.LastHeard(); time.Since(heard) > time.Second {
+		t.Errorf("expected the session to have just been heard from, got %s", heard)
+	}
+
+	// Bots have no client to hear from, so they're never silent
+	botCtx, stopBot := context.WithCancel(context.Background())
+	defer stopBot()
+	bot, _ := oscar.SessionFromContext(oscar.NewContextWithInternalSession(botCtx, nil, func(*oscar.FLAP) {}))
+	sm.ClaimSession("echobot", bot)
+	if silent := sm.Silent(time.Now().Add(time.Minute)); len(silent) != 1 || silent[0] != session {
+		t.Errorf("expected only the client's session to be silent, got %v", silent)
+	}
+}
+
+func TestSessionScreenNamesNormalized(t *testing.T) {
+	sm := NewSessionManager(KickOldSession)
+	session := &oscar.Session{}
+	sm.ClaimSession("Some User", session)
+
+	for _, screenName := range []string{"Some User", "someuser", "SOME USER", "s o m e u s e r"} {
+		if sm.GetSession(screenName) != session {
+			t.Errorf("expected %q to find the session", screenName)
+		}
+	}
+
+	if !sm.RemoveSession("someuser", session) || sm.GetSession("Some User") != nil {
+		t.Errorf("expected the session to be removed by its normalized screen name")
+	}
+}
+
+// Run with -race: users signing on and off at once while the routines look them up
+func TestSessionsConcurrent(t *testing.T) {
+	sm := NewSessionManager(KickOldSession)
+
+	const users = 50
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(2)
+		screenName := fmt.Sprintf("user%d", i)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				session := &oscar.Session{}
+				sm.ClaimSession(screenName, session)
+				sm.GetSession(strings.ToUpper(screenName))
+				sm.RemoveSession(screenName, session)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				sm.Range(func(session *oscar.Session) bool { return true })
+			}
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	sm.Range(func(session *oscar.Session) bool {
+		count++
+		return true
+	})
+	if count != 0 {
+		t.Errorf("expected every session to be removed, got %d left", count)
+	}
+}
+
+func TestSessionList(t *testing.T) {
+	sm := NewSessionManager(KickOldSession)
+	for _, screenName := range []string{"bob", "alice"} {
+		conn, other := net.Pipe()
+		t.Cleanup(func() { conn.Close(); other.Close() })
+
+		session := oscar.NewSession(conn, nil)
+		session.SetScreenName(screenName)
+		sm.ClaimSession(screenName, session)
+	}
+	sm.GetSession("bob").SetIdleSince(time.Now())
+
+	list := sm.List()
+	if len(list) != 2 || list[0].ScreenName != "alice" || list[1].ScreenName != "bob" {
+		t.Fatalf("expected alice and bob, got %+v", list)
+	}
+	if list[0].ID != sm.GetSession("alice").ID || list[0].ID == list[1].ID {
+		t.Errorf("expected each session's own ID, got %q and %q", list[0].ID, list[1].ID)
+	}
+	if list[0].IdleSince != nil || list[1].IdleSince == nil {
+		t.Errorf("expected only bob to be idle, got %v and %v", list[0].IdleSince, list[1].IdleSince)
+	}
+}
+
+// A user reformatting their screen name while the sessions are listed is fine under -race
+func TestSessionListWhileReformatting(t *testing.T) {
+	sm := NewSessionManager(KickOldSession)
+	conn, other := net.Pipe()
+	t.Cleanup(func() { conn.Close(); other.Close() })
+
+	session := oscar.NewSession(conn, nil)
+	session.SetScreenName("alice")
+	sm.ClaimSession("alice", session)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			session.SetScreenName("Alice")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if list := sm.List(); len(list) != 1 || util.NormalizeScreenName(list[0].ScreenName) != "alice" {
+			t.Fatalf("expected alice, got %+v", list)
+		}
+	}
+	<-done
+}
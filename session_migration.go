@@ -0,0 +1,124 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// MigrationPauseTimeout is how long a client has to acknowledge being paused before it is
+// disconnected instead of migrated
+const MigrationPauseTimeout = 10 * time.Second
+
+// pauseFLAP tells the client to stop sending until it is migrated (0x01,0x0b)
+func pauseFLAP() *oscar.FLAP {
+	flap := oscar.NewFLAP(2)
+	flap.Data.WriteBinary(oscar.NewSNAC(0x01, 0x0b))
+	return flap
+}
+
+// migrateFLAP tells the client to sign on to host with the cookie instead (0x01,0x12). Every
+// family moves.
+func migrateFLAP(host string, cookie []byte) *oscar.FLAP {
+	migrateSnac := oscar.NewSNAC(0x01, 0x12)
+	migrateSnac.Data.WriteUint16(0) // number of families, 0 for all of them
+	migrateSnac.WriteTLV(oscar.NewTLV(0x05, []byte(host)))
+	migrateSnac.WriteTLV(oscar.NewTLV(0x06, cookie))
+
+	flap := oscar.NewFLAP(2)
+	flap.Data.WriteBinary(migrateSnac)
+	return flap
+}
+
+// MigrateSessions moves every signed on client to the BOS server at host, which has to share
+// the database. Each client is paused, and once it acknowledges it is sent a cookie for host
+// and disconnected without signing the user off. Clients that don't acknowledge within the
+// timeout are just disconnected. Returns how many clients were migrated and disconnected.
+func MigrateSessions(ctx context.Context, db *bun.DB, sm *SessionManager, host string, timeout time.Duration, logger *slog.Logger) (int, int) {
+	var migrated, disconnected atomic.Int64
+	var wg sync.WaitGroup
+
+	sm.Range(func(session *oscar.Session) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := migrateSession(ctx, db, sm, session, host, timeout); err != nil {
+				logger.Info("disconnecting client instead of migrating it", "screen_name", session.ScreenName(), "err", err.Error())
+				session.Disconnect()
+				disconnected.Add(1)
+				return
+			}
+			migrated.Add(1)
+		}()
+		return true
+	})
+
+	wg.Wait()
+	return int(migrated.Load()), int(disconnected.Load())
+}
+
+func migrateSession(ctx context.Context, db *bun.DB, sm *SessionManager, session *oscar.Session, host string, timeout time.Duration) error {
+	if err := session.Send(pauseFLAP()); err != nil {
+		return err
+	}
+
+	select {
+	case <-session.PauseAcked():
+	case <-time.After(timeout):
+		return fmt.Errorf("client didn't acknowledge the pause within %s", timeout)
+	}
+
+	user, err := models.UserByScreenName(ctx, db, session.ScreenName())
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("no user %s", session.ScreenName())
+	}
+
+	ip, _, _ := net.SplitHostPort(session.RemoteAddr().String())
+	cookie, err := models.CreateAuthCookie(ctx, db, user.UIN, ip)
+	if err != nil {
+		return err
+	}
+	if err := session.Send(migrateFLAP(host, cookie)); err != nil {
+		return err
+	}
+
+	// The user stays signed on, since they're coming back on host
+	sm.RemoveSession(session.ScreenName(), session)
+	session.Disconnect()
+	return nil
+}
+
+// migrateHandler is the admin endpoint that migrates every client to the host:port in the host
+// form value
+func migrateHandler(db *bun.DB, sm *SessionManager, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		host := r.FormValue("host")
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			http.Error(w, fmt.Sprintf("invalid host %q: %s", host, err), http.StatusBadRequest)
+			return
+		}
+
+		logger.Info("migrating clients", "host", host)
+		migrated, disconnected := MigrateSessions(r.Context(), db, sm, host, MigrationPauseTimeout, logger)
+		logger.Info("migrated clients", "host", host, "migrated", migrated, "disconnected", disconnected)
+		fmt.Fprintf(w, "migrated %d, disconnected %d\n", migrated, disconnected)
+	}
+}
@@ -0,0 +1,93 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Clients that acknowledge the pause get a cookie for the new host and stay signed on
+func TestMigrateSessions(t *testing.T) {
+	d := onlineTestDB(t)
+	if _, err := d.NewCreateTable().Model((*models.AuthCookie)(nil)).IfNotExists().Exec(context.Background()); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sm := NewSessionManager(KickOldSession)
+
+	aliceCtx, alice, snacs := signedOnUser(t, d, sm, "alice")
+	t.Cleanup(func() {
+		d.NewDelete().Model((*models.AuthCookie)(nil)).Where("uin = ?", alice.UIN).Exec(context.Background())
+	})
+	session, _ := oscar.SessionFromContext(aliceCtx)
+
+	done := make(chan struct{})
+	var migrated, disconnected int
+	go func() {
+		migrated, disconnected = MigrateSessions(context.Background(), d, sm, "10.0.1.30:5191", time.Second, logger)
+		close(done)
+	}()
+
+	expectSNAC := func(subtype uint16) *oscar.SNAC {
+		t.Helper()
+		select {
+		case snac := <-snacs:
+			if snac.Header.Family != 0x01 || snac.Header.Subtype != subtype {
+				t.Fatalf("expected SNAC(0x01, 0x%02x), got %s", subtype, snac)
+			}
+			return snac
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for SNAC(0x01, 0x%02x)", subtype)
+		}
+		return nil
+	}
+
+	expectSNAC(0x0b)
+	g := &services.GenericServiceControls{}
+	if _, err := g.HandleSNAC(aliceCtx, d, oscar.NewSNAC(0x01, 0x0c)); err != nil {
+		t.Fatalf("could not acknowledge pause: %s", err)
+	}
+
+	migrateSnac := expectSNAC(0x12)
+	if families, _ := migrateSnac.Data.ReadUint16(); families != 0 {
+		t.Errorf("expected every family to move, got %d families", families)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(migrateSnac.Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read migration TLVs: %s", err)
+	}
+	if tlv := oscar.FindTLV(tlvs, 0x05); tlv == nil || string(tlv.Data) != "10.0.1.30:5191" {
+		t.Errorf("expected the new host, got %v", tlv)
+	}
+
+	<-done
+	if migrated != 1 || disconnected != 0 {
+		t.Errorf("expected the client to be migrated, got %d migrated and %d disconnected", migrated, disconnected)
+	}
+	if sm.GetSession(alice.ScreenName) != nil {
+		t.Errorf("expected the session to be gone")
+	}
+	if err := session.Send(oscar.NewFLAP(5)); err == nil {
+		t.Errorf("expected the client to be disconnected")
+	}
+
+	// The cookie signs alice on at the new host, which shares the database
+	cookieFlap := oscar.NewFLAP(1)
+	cookieFlap.Data.WriteUint32(1)
+	cookieFlap.Data.WriteBinary(oscar.FindTLV(tlvs, 0x06))
+	user, _, err := services.AuthenticateFLAPCookie(context.Background(), d, cookieFlap)
+	if err != nil || user.UIN != alice.UIN {
+		t.Errorf("expected the cookie to sign alice on, got %v", err)
+	}
+	if current, _ := models.UserByUIN(context.Background(), d, alice.UIN); current == nil || current.Status != models.UserStatusOnline {
+		t.Errorf("expected alice to stay signed on")
+	}
+}
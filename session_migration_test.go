@@ -0,0 +1,88 @@
+package main
+
+import (
+	"aim-oscar/oscar"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Clients that don't acknowledge the pause are disconnected instead of migrated
+func TestMigrateSessionsWithoutAck(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sm := NewSessionManager(KickOldSession)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	session := oscar.NewSession(server, logger)
+	session.SetScreenName("alice")
+	sm.ClaimSession("alice", session)
+
+	paused := make(chan *oscar.SNAC, 1)
+	go func() {
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(client, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+		if _, err := io.ReadFull(client, data); err != nil {
+			return
+		}
+		snac := &oscar.SNAC{}
+		snac.UnmarshalBinary(data)
+		paused <- snac
+	}()
+
+	migrated, disconnected := MigrateSessions(context.Background(), nil, sm, "10.0.1.30:5191", 50*time.Millisecond, logger)
+	if migrated != 0 || disconnected != 1 {
+		t.Errorf("expected the client to be disconnected, got %d migrated and %d disconnected", migrated, disconnected)
+	}
+
+	select {
+	case snac := <-paused:
+		if snac.Header.Family != 0x01 || snac.Header.Subtype != 0x0b {
+			t.Errorf("expected the client to be paused, got %s", snac)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the client to be paused")
+	}
+
+	if err := session.Send(oscar.NewFLAP(5)); err == nil {
+		t.Errorf("expected the client to be disconnected")
+	}
+}
+
+func TestMigrateHandlerInvalid(t *testing.T) {
+	handler := migrateHandler(nil, NewSessionManager(KickOldSession), slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tt := map[string]struct {
+		method   string
+		host     string
+		expected int
+	}{
+		"get":               {http.MethodGet, "10.0.1.30:5191", http.StatusMethodNotAllowed},
+		"no host":           {http.MethodPost, "", http.StatusBadRequest},
+		"host without port": {http.MethodPost, "10.0.1.30", http.StatusBadRequest},
+		"no sessions":       {http.MethodPost, "10.0.1.30:5191", http.StatusOK},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/admin/migrate", strings.NewReader("host="+tc.host))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
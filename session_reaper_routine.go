@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// SessionReaper disconnects signed on users whose clients haven't sent anything, keepalives
+// included, within the timeout. Closing the connection makes its handler run handleCloseFn,
+// which tells the user's buddies they left.
+func SessionReaper(sm *SessionManager, timeout time.Duration, parentLogger *slog.Logger) func() {
+	logger := parentLogger.With(slog.String("routine", "session_reaper"))
+
+	return func() {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for _, session := range sm.Silent(time.Now().Add(-timeout)) {
+				logger.Info("disconnecting silent client", "screen_name", session.ScreenName(), "last_heard", session.LastHeard())
+				session.Disconnect()
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package stats keeps the server's running totals, like how many users have signed on and how
+// many messages have been relayed. Unlike the metrics, which start over with the process, the
+// totals are saved to the database and carry on from where they were after a restart.
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Collector counts what the server does. Its counters are only updated with atomic operations,
+// so the handlers and routines counting into it never wait on each other.
+type Collector struct {
+	startedAt time.Time
+
+	sessions     atomic.Int64
+	peakSessions atomic.Int64
+
+	logins          atomic.Uint64
+	messagesRelayed atomic.Uint64
+	messagesStored  atomic.Uint64
+	bytesIn         atomic.Uint64
+	bytesOut        atomic.Uint64
+
+	// base is the totals saved before the process started, which the counters are added to
+	base atomic.Pointer[Snapshot]
+}
+
+// NewCollector starts counting from zero, with the uptime counted from now
+func NewCollector() *Collector {
+	c := &Collector{startedAt: time.Now()}
+	c.base.Store(&Snapshot{})
+	return c
+}
+
+// Default is the collector the server counts into
+var Default = NewCollector()
+
+// SessionStarted counts a user signing on
+func (c *Collector) SessionStarted() {
+	sessions := c.sessions.Add(1)
+	for {
+		peak := c.peakSessions.Load()
+		if sessions <= peak || c.peakSessions.CompareAndSwap(peak, sessions) {
+			return
+		}
+	}
+}
+
+// SessionEnded counts a user signing off
+func (c *Collector) SessionEnded() {
+	c.sessions.Add(-1)
+}
+
+// Login counts a successful sign on, including ones that replace the user's other session
+func (c *Collector) Login() {
+	c.logins.Add(1)
+}
+
+// MessageRelayed counts an IM sent to the recipient's session
+func (c *Collector) MessageRelayed() {
+	c.messagesRelayed.Add(1)
+}
+
+// MessageStored counts an IM stored for a recipient who is signed off
+func (c *Collector) MessageStored() {
+	c.messagesStored.Add(1)
+}
+
+// BytesIn counts bytes read from clients
+func (c *Collector) BytesIn(n int) {
+	c.bytesIn.Add(uint64(n))
+}
+
+// BytesOut counts bytes written to clients
+func (c *Collector) BytesOut(n int) {
+	c.bytesOut.Add(uint64(n))
+}
+
+// Snapshot is the totals at a point in time, as the admin API has them. The totals include
+// those from before the server last restarted.
+type Snapshot struct {
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+
+	Sessions int64 `json:"sessions"`
+	// PeakSessions is the most signed on at once since the server started, and
+	// AllTimePeakSessions the most there have ever been
+	PeakSessions        int64 `json:"peak_sessions"`
+	AllTimePeakSessions int64 `json:"all_time_peak_sessions"`
+
+	Logins          int64 `json:"logins"`
+	MessagesRelayed int64 `json:"messages_relayed"`
+	MessagesStored  int64 `json:"messages_stored_offline"`
+	BytesIn         int64 `json:"bytes_in"`
+	BytesOut        int64 `json:"bytes_out"`
+}
+
+// Snapshot is the totals now
+func (c *Collector) Snapshot() Snapshot {
+	base := c.base.Load()
+	peak := c.peakSessions.Load()
+	allTimePeak := base.AllTimePeakSessions
+	if peak > allTimePeak {
+		allTimePeak = peak
+	}
+
+	return Snapshot{
+		StartedAt:           c.startedAt,
+		UptimeSeconds:       int64(time.Since(c.startedAt).Seconds()),
+		Sessions:            c.sessions.Load(),
+		PeakSessions:        peak,
+		AllTimePeakSessions: allTimePeak,
+		Logins:              base.Logins + int64(c.logins.Load()),
+		MessagesRelayed:     base.MessagesRelayed + int64(c.messagesRelayed.Load()),
+		MessagesStored:      base.MessagesStored + int64(c.messagesStored.Load()),
+		BytesIn:             base.BytesIn + int64(c.bytesIn.Load()),
+		BytesOut:            base.BytesOut + int64(c.bytesOut.Load()),
+	}
+}
+
+// Restore picks the totals up from where they were before the server restarted. It's called
+// once when the server starts, before the totals are first saved.
+func (c *Collector) Restore(saved Snapshot) {
+	c.base.Store(&saved)
+}
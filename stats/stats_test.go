@@ -0,0 +1,48 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPeakSessions(t *testing.T) {
+	c := NewCollector()
+
+	// 50 users sign on at once, then all but 10 sign off
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.SessionStarted()
+			c.Login()
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 40; i++ {
+		c.SessionEnded()
+	}
+
+	s := c.Snapshot()
+	if s.Sessions != 10 || s.PeakSessions != 50 || s.AllTimePeakSessions != 50 || s.Logins != 50 {
+		t.Errorf("expected 10 sessions with a peak of 50 and 50 logins, got %+v", s)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	c := NewCollector()
+	c.SessionStarted()
+	c.MessageRelayed()
+	c.MessageStored()
+	c.BytesIn(100)
+	c.BytesOut(200)
+
+	c.Restore(Snapshot{AllTimePeakSessions: 7, Logins: 3, MessagesRelayed: 10, MessagesStored: 5, BytesIn: 1000, BytesOut: 2000})
+	s := c.Snapshot()
+	if s.Logins != 3 || s.MessagesRelayed != 11 || s.MessagesStored != 6 || s.BytesIn != 1100 || s.BytesOut != 2200 {
+		t.Errorf("expected the counts to carry on from the restored totals, got %+v", s)
+	}
+	if s.Sessions != 1 || s.PeakSessions != 1 || s.AllTimePeakSessions != 7 {
+		t.Errorf("expected 1 session now and an all time peak of 7, got %+v", s)
+	}
+}
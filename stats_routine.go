@@ -0,0 +1,111 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/stats"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// StatsRecorder picks the collector's totals up from where they were last saved, then saves them
+// every interval and once more when it stops, so they survive restarts. Every summaryInterval the
+// totals are also written to the log. An interval of 0 doesn't save them, and a summaryInterval
+// of 0 doesn't log them. The routine stops once done is closed.
+func StatsRecorder(collector *stats.Collector, interval, summaryInterval time.Duration, parentLogger *slog.Logger) func(db *bun.DB, done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "stats"))
+
+	return func(db *bun.DB, done <-chan struct{}) {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ctx := oscar.NewContextWithLogger(context.Background(), logger)
+		saved, err := models.LatestServerStats(ctx, db)
+		if err != nil {
+			logger.Error("could not load saved stats, totals start over", slog.String("err", err.Error()))
+		} else if saved != nil {
+			collector.Restore(stats.Snapshot{
+				AllTimePeakSessions: saved.PeakSessions,
+				Logins:              saved.Logins,
+				MessagesRelayed:     saved.MessagesRelayed,
+				MessagesStored:      saved.MessagesStored,
+				BytesIn:             saved.BytesIn,
+				BytesOut:            saved.BytesOut,
+			})
+		}
+
+		var saveCh, summaryCh <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			saveCh = ticker.C
+		}
+		if summaryInterval > 0 {
+			ticker := time.NewTicker(summaryInterval)
+			defer ticker.Stop()
+			summaryCh = ticker.C
+		}
+
+		for {
+			select {
+			case <-done:
+				if interval > 0 {
+					saveStats(ctx, db, collector, logger)
+				}
+				return
+			case <-saveCh:
+				saveStats(ctx, db, collector, logger)
+			case <-summaryCh:
+				s := collector.Snapshot()
+				logger.Info("Server stats",
+					slog.Duration("uptime", time.Duration(s.UptimeSeconds)*time.Second),
+					slog.Int64("sessions", s.Sessions),
+					slog.Int64("peak_sessions", s.PeakSessions),
+					slog.Int64("all_time_peak_sessions", s.AllTimePeakSessions),
+					slog.Int64("logins", s.Logins),
+					slog.Int64("messages_relayed", s.MessagesRelayed),
+					slog.Int64("messages_stored_offline", s.MessagesStored),
+					slog.Int64("bytes_in", s.BytesIn),
+					slog.Int64("bytes_out", s.BytesOut),
+				)
+			}
+		}
+	}
+}
+
+func saveStats(ctx context.Context, db *bun.DB, collector *stats.Collector, logger *slog.Logger) {
+	s := collector.Snapshot()
+	err := models.InsertServerStats(ctx, db, &models.ServerStats{
+		RecordedAt:      time.Now(),
+		StartedAt:       s.StartedAt,
+		Sessions:        s.Sessions,
+		PeakSessions:    s.AllTimePeakSessions,
+		Logins:          s.Logins,
+		MessagesRelayed: s.MessagesRelayed,
+		MessagesStored:  s.MessagesStored,
+		BytesIn:         s.BytesIn,
+		BytesOut:        s.BytesOut,
+	})
+	if err != nil {
+		logger.Error("could not save stats", slog.String("err", err.Error()))
+	}
+}
+
+// statsHandler is the admin endpoint with the server's uptime and running totals
+func statsHandler(collector *stats.Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collector.Snapshot())
+	}
+}
@@ -0,0 +1,76 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/stats"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// The totals a server saves are where the next one picks up from
+func TestStatsSurviveRestart(t *testing.T) {
+	d := serverTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The first server counts some activity, then shuts down
+	before := stats.NewCollector()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		StatsRecorder(before, time.Hour, 0, logger)(d, done)
+		close(stopped)
+	}()
+	for i := 0; i < 3; i++ {
+		before.SessionStarted()
+		before.Login()
+	}
+	before.SessionEnded()
+	before.MessageRelayed()
+	before.MessageStored()
+	before.BytesIn(100)
+	before.BytesOut(250)
+	close(done)
+	<-stopped
+
+	// The next one starts counting from zero, on top of the saved totals
+	after := stats.NewCollector()
+	done = make(chan struct{})
+	stopped = make(chan struct{})
+	go func() {
+		StatsRecorder(after, time.Hour, 0, logger)(d, done)
+		close(stopped)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	after.SessionStarted()
+	after.Login()
+	expected := stats.Snapshot{Sessions: 1, PeakSessions: 1, AllTimePeakSessions: 3, Logins: 4, MessagesRelayed: 1, MessagesStored: 1, BytesIn: 100, BytesOut: 250}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		s := after.Snapshot()
+		s.StartedAt, s.UptimeSeconds = time.Time{}, 0
+		if s == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the totals to carry on after the restart, got %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	statsHandler(after)(w, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	var s stats.Snapshot
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil || s.Logins != 4 || s.AllTimePeakSessions != 3 {
+		t.Errorf("expected the admin endpoint to have the totals, got %+v %v", s, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// StatusReaper signs off users the database says are signed on but who have no session, like
+// when a session was lost without its close handler running. Their buddies are told they left.
+// Sessions that are still registered but have gone quiet are left to SessionReaper. The routine
+// stops once done is closed.
+func StatusReaper(sm *SessionManager, onlineCh chan *services.PresenceEvent, interval time.Duration, parentLogger *slog.Logger) func(db *bun.DB, done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "status_reaper"))
+
+	return func(db *bun.DB, done <-chan struct{}) {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx := oscar.NewContextWithLogger(context.Background(), logger)
+			if _, err := reapStatuses(ctx, db, sm, onlineCh, done); err != nil {
+				logger.Error("could not reap user statuses", slog.String("err", err.Error()))
+			}
+		}
+	}
+}
+
+// reapStatuses sets every signed on user without a session offline and tells their buddies. It
+// returns how many users it signed off.
+func reapStatuses(ctx context.Context, db *bun.DB, sm *SessionManager, onlineCh chan *services.PresenceEvent, done <-chan struct{}) (int, error) {
+	logger := oscar.LoggerFromContext(ctx)
+
+	users, err := models.SignedOnUsers(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for _, user := range users {
+		if sm.GetSession(user.ScreenName) != nil {
+			continue
+		}
+
+		logger.Info("signing off user without a session", slog.String("screen_name", user.ScreenName), slog.String("status", user.Status.String()))
+		if err := user.SetOffline(ctx, db); err != nil {
+			logger.Error("could not set user as offline", slog.String("screen_name", user.ScreenName), slog.String("err", err.Error()))
+			continue
+		}
+		reaped++
+
+		select {
+		case <-done:
+			return reaped, nil
+		case onlineCh <- services.StatusChanged(user):
+		}
+	}
+
+	return reaped, nil
+}
@@ -0,0 +1,64 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// A user whose session vanished without signing them off is signed off, and their buddies see
+// them leave
+func TestStatusReaper(t *testing.T) {
+	d := onlineTestDB(t)
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sm := NewSessionManager(KickOldSession)
+	onlineCh, routine := OnlineNotification(sm, nil, logger)
+	go routine(d)
+	defer close(onlineCh)
+
+	_, alice, aliceSNACs := signedOnUser(t, d, sm, "alice")
+	_, bob, _ := signedOnUser(t, d, sm, "bob")
+	if _, err := models.AddBuddy(ctx, d, alice.UIN, bob.UIN); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+
+	// Bob's session crashes without the close handler running
+	sm.RemoveSession(bob.ScreenName, sm.GetSession(bob.ScreenName))
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		StatusReaper(sm, onlineCh, 50*time.Millisecond, logger)(d, done)
+		close(stopped)
+	}()
+
+	if snac := nextBuddySNAC(t, aliceSNACs, bob.ScreenName); snac == nil || snac.Header.Subtype != 0x0c {
+		t.Fatalf("expected alice to see bob leave, got %v", snac)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("expected the routine to stop")
+	}
+
+	for _, user := range []*models.User{alice, bob} {
+		if err := d.NewSelect().Model(user).WherePK().Scan(ctx); err != nil {
+			t.Fatalf("could not load user: %s", err)
+		}
+	}
+	if bob.Status != models.UserStatusOffline {
+		t.Errorf("expected bob to be offline, got %s", bob.Status)
+	}
+	if alice.Status != models.UserStatusOnline {
+		t.Errorf("expected alice to stay online with a session, got %s", alice.Status)
+	}
+}
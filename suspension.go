@@ -0,0 +1,107 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// SuspendUser suspends the user with screenName, for good if until is nil, and disconnects them
+// if they're signed on. The close handler tells their buddies they left. It returns nil if there
+// is no such user.
+func SuspendUser(ctx context.Context, db *bun.DB, sm *SessionManager, screenName string, until *time.Time, reason string) (*models.User, error) {
+	user, err := models.UserByScreenName(ctx, db, screenName)
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	if err := user.Suspend(ctx, db, until, reason); err != nil {
+		return nil, err
+	}
+
+	if session := sm.GetSession(user.ScreenName); session != nil {
+		session.Disconnect()
+	}
+	return user, nil
+}
+
+// suspendHandler is the admin endpoint that suspends the user in the screen_name form value.
+// The suspension lasts for the duration form value (like 72h), or until they're unsuspended if
+// there isn't one.
+func suspendHandler(db *bun.DB, sm *SessionManager, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var until *time.Time
+		if duration := r.FormValue("duration"); duration != "" {
+			d, err := time.ParseDuration(duration)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", duration), http.StatusBadRequest)
+				return
+			}
+			end := time.Now().Add(d)
+			until = &end
+		}
+
+		screenName := r.FormValue("screen_name")
+		user, err := SuspendUser(r.Context(), db, sm, screenName, until, r.FormValue("reason"))
+		if err != nil {
+			logger.Error("could not suspend user", "screen_name", screenName, "err", err.Error())
+			http.Error(w, "could not suspend user", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, fmt.Sprintf("unknown user %q", screenName), http.StatusNotFound)
+			return
+		}
+
+		logger.Info("suspended user", "screen_name", user.ScreenName, "until", user.SuspendedUntil, "reason", user.SuspensionReason)
+		if until != nil {
+			fmt.Fprintf(w, "suspended %s until %s\n", user.ScreenName, until.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(w, "suspended %s\n", user.ScreenName)
+		}
+	}
+}
+
+// unsuspendHandler is the admin endpoint that lets the user in the screen_name form value log
+// in again
+func unsuspendHandler(db *bun.DB, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		screenName := r.FormValue("screen_name")
+		user, err := models.UserByScreenName(r.Context(), db, screenName)
+		if err != nil {
+			logger.Error("could not find user", "screen_name", screenName, "err", err.Error())
+			http.Error(w, "could not unsuspend user", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, fmt.Sprintf("unknown user %q", screenName), http.StatusNotFound)
+			return
+		}
+
+		if err := user.Unsuspend(r.Context(), db); err != nil {
+			logger.Error("could not unsuspend user", "screen_name", screenName, "err", err.Error())
+			http.Error(w, "could not unsuspend user", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("unsuspended user", "screen_name", user.ScreenName)
+		fmt.Fprintf(w, "unsuspended %s\n", user.ScreenName)
+	}
+}
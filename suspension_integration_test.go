@@ -0,0 +1,84 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/oscar/client"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// loginRefused logs in as screenName and expects to be turned away with code
+func loginRefused(t *testing.T, addr, screenName string, code uint16) {
+	t.Helper()
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer c.Close()
+
+	var loginErr *client.LoginError
+	if err := c.Login(screenName, "password"); !errors.As(err, &loginErr) || loginErr.Code != code {
+		t.Errorf("expected %s to be refused with code 0x%02x, got %v", screenName, code, err)
+	}
+}
+
+// Suspending a signed on user disconnects them and keeps them out until they're unsuspended
+func TestSuspendUser(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	ctx := context.Background()
+
+	alice := loggedInClient(t, d, addr, "alice")
+	user, err := SuspendUser(ctx, d, server.Sessions, "alice", nil, "spam")
+	if err != nil || user == nil {
+		t.Fatalf("could not suspend alice: %v %v", user, err)
+	}
+
+	disconnected := false
+	timeout := time.After(5 * time.Second)
+	for !disconnected {
+		select {
+		case _, ok := <-alice.Events():
+			disconnected = !ok
+		case <-timeout:
+			t.Fatalf("expected alice to be disconnected")
+		}
+	}
+
+	loginRefused(t, addr, "alice", 0x11)
+
+	if err := user.Unsuspend(ctx, d); err != nil {
+		t.Fatalf("could not unsuspend alice: %s", err)
+	}
+	loggedInClient(t, d, addr, "alice")
+}
+
+// A timed suspension lets the user back in once it's over
+func TestTimedSuspension(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr := startServer(t, d)
+	ctx := context.Background()
+
+	loggedInClient(t, d, addr, "bob").Close()
+	until := time.Now().Add(time.Second)
+	if user, err := SuspendUser(ctx, d, server.Sessions, "bob", &until, ""); err != nil || user == nil {
+		t.Fatalf("could not suspend bob: %v %v", user, err)
+	}
+
+	loginRefused(t, addr, "bob", 0x11)
+
+	time.Sleep(time.Until(until))
+	loggedInClient(t, d, addr, "bob")
+}
+
+func TestSuspendUnknownUser(t *testing.T) {
+	d := serverTestDB(t)
+	server, _ := startServer(t, d)
+
+	if user, err := SuspendUser(context.Background(), d, server.Sessions, "nobody", nil, ""); user != nil || err != nil {
+		t.Errorf("expected no user to suspend, got %v %v", user, err)
+	}
+}
@@ -0,0 +1,128 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoginOverTLS(t *testing.T) {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+	d, err := db.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	for _, model := range []interface{}{(*models.User)(nil), (*models.AuthCookie)(nil)} {
+		if _, err := d.NewCreateTable().Model(model).IfNotExists().Exec(ctx); err != nil {
+			t.Fatalf("could not create table: %s", err)
+		}
+	}
+
+	screenName := fmt.Sprintf("tls%d", time.Now().UnixNano()%100000)
+	user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+	if err != nil {
+		t.Fatalf("could not create user: %s", err)
+	}
+	defer d.NewDelete().Model(user).WherePK().Exec(ctx)
+	defer d.NewDelete().Model((*models.AuthCookie)(nil)).Where("uin = ?", user.UIN).Exec(ctx)
+	user.Verified = true
+	if err := user.Update(ctx, d, "verified"); err != nil {
+		t.Fatalf("could not verify user: %s", err)
+	}
+
+	sm := NewServiceManager()
+	sm.RegisterService(0x17, &services.AuthorizationRegistrationService{BOSAddress: "bos.example.com:5190", RequireTLS: true})
+	handler := oscar.NewHandler(func(ctx context.Context, flap *oscar.FLAP) context.Context {
+		if flap.Header.Channel != 2 {
+			return ctx
+		}
+		snac := &oscar.SNAC{}
+		if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
+			return ctx
+		}
+		return sm.HandleSNAC(ctx, d, snac)
+	}, func(ctx context.Context, s *oscar.Session) {})
+	addr := serveTLS(t, handler)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer conn.Close()
+
+	seq := uint16(0)
+	send := func(snac *oscar.SNAC) {
+		t.Helper()
+		seq = oscar.NextSequenceNumber(seq)
+		flap := oscar.NewFLAP(2)
+		flap.Header.SequenceNumber = seq
+		flap.Data.WriteBinary(snac)
+		b, _ := flap.MarshalBinary()
+		if _, err := conn.Write(b); err != nil {
+			t.Fatalf("could not send SNAC: %s", err)
+		}
+	}
+	receive := func(subtype uint16) *oscar.SNAC {
+		t.Helper()
+		snac := &oscar.SNAC{}
+		if err := snac.UnmarshalBinary(readTestFLAP(t, conn).Data.Bytes()); err != nil {
+			t.Fatalf("could not unmarshal SNAC: %s", err)
+		}
+		if snac.Header.Family != 0x17 || snac.Header.Subtype != subtype {
+			t.Fatalf("expected SNAC(0x17, 0x%02x), got %s", subtype, snac)
+		}
+		return snac
+	}
+
+	readTestFLAP(t, conn) // hello
+
+	keyRequest := oscar.NewSNAC(0x17, 0x06)
+	keyRequest.WriteTLV(oscar.NewTLV(0x01, []byte(screenName)))
+	send(keyRequest)
+
+	keyReply := receive(0x07)
+	key, err := keyReply.Data.ReadLPUint16String()
+	if err != nil {
+		t.Fatalf("could not read key: %s", err)
+	}
+
+	passwordMD5 := md5.Sum([]byte("password"))
+	h := md5.New()
+	io.WriteString(h, key)
+	h.Write(passwordMD5[:])
+	io.WriteString(h, services.AIM_MD5_STRING)
+
+	login := oscar.NewSNAC(0x17, 0x02)
+	login.WriteTLV(oscar.NewTLV(0x01, []byte(screenName)))
+	login.WriteTLV(oscar.NewTLV(0x25, h.Sum(nil)))
+	login.WriteTLV(oscar.NewTLV(0x4c, []byte{}))
+	send(login)
+
+	tlvs, err := oscar.UnmarshalTLVs(receive(0x03).Data.Bytes())
+	if err != nil {
+		t.Fatalf("could not read login reply: %s", err)
+	}
+	if bos := oscar.FindTLV(tlvs, 0x05); bos == nil || string(bos.Data) != "bos.example.com:5190" {
+		t.Errorf("expected to be sent to the BOS server, got %v", bos)
+	}
+	if oscar.FindTLV(tlvs, 0x06) == nil {
+		t.Errorf("expected an authorization cookie")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"aim-oscar/oscar"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// selfSignedCert writes a self-signed certificate and its key to files in a temporary directory
+func selfSignedCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "login.oscar.aol.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %s", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+	return certFile, keyFile
+}
+
+// serveTLS serves the handler on a TLS listener on a free port, returning its address
+func serveTLS(t *testing.T, handler *oscar.Handler) string {
+	t.Helper()
+	certFile, keyFile := selfSignedCert(t)
+	listener, err := listenTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go handler.Serve(listener, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return listener.Addr().String()
+}
+
+func readTestFLAP(t *testing.T, conn net.Conn) *oscar.FLAP {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("could not read FLAP: %s", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("could not read FLAP: %s", err)
+	}
+
+	flap := &oscar.FLAP{}
+	if err := flap.UnmarshalBinary(append(header, data...)); err != nil {
+		t.Fatalf("could not unmarshal FLAP: %s", err)
+	}
+	return flap
+}
+
+func TestTLSListener(t *testing.T) {
+	sessions := make(chan bool, 1)
+	handler := oscar.NewHandler(func(ctx context.Context, flap *oscar.FLAP) context.Context {
+		session, _ := oscar.SessionFromContext(ctx)
+		sessions <- session.TLS()
+		return ctx
+	}, func(ctx context.Context, s *oscar.Session) {})
+	addr := serveTLS(t, handler)
+
+	// Whatever server name the client asks for, it gets the certificate
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "bos.example.com"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer conn.Close()
+
+	hello := readTestFLAP(t, conn)
+	if hello.Header.Channel != 1 {
+		t.Fatalf("expected a hello on channel 1, got channel %d", hello.Header.Channel)
+	}
+
+	reply := oscar.NewFLAP(1)
+	reply.Data.Write([]byte{0, 0, 0, 1})
+	b, _ := reply.MarshalBinary()
+	conn.Write(b)
+
+	select {
+	case isTLS := <-sessions:
+		if !isTLS {
+			t.Errorf("expected the session to know it's over TLS")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the hello to be handled")
+	}
+}
@@ -0,0 +1,49 @@
+package toc
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parseCommand splits a command from a client into its name and arguments. Arguments with
+// spaces are quoted, and quotes and other special characters in them are escaped with a
+// backslash. Commands are null terminated.
+func parseCommand(line string) (string, []string, error) {
+	line = strings.TrimRight(line, "\x00")
+
+	var args []string
+	var arg []byte
+	inArg, quoted, escaped := false, false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			arg = append(arg, c)
+			escaped = false
+		case c == '\\':
+			escaped, inArg = true, true
+		case c == '"':
+			quoted, inArg = !quoted, true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = arg[:0], false
+			}
+		default:
+			arg = append(arg, c)
+			inArg = true
+		}
+	}
+
+	if quoted || escaped {
+		return "", nil, errors.New("unterminated argument")
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	if len(args) == 0 {
+		return "", nil, errors.New("empty command")
+	}
+	return args[0], args[1:], nil
+}
@@ -0,0 +1,56 @@
+package toc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tt := map[string]struct {
+		line string
+		name string
+		args []string
+	}{
+		"no arguments":     {"toc_init_done\x00", "toc_init_done", []string{}},
+		"plain arguments":  {"toc_add_buddy alice bob\x00", "toc_add_buddy", []string{"alice", "bob"}},
+		"quoted argument":  {`toc_send_im alice "hello there"` + "\x00", "toc_send_im", []string{"alice", "hello there"}},
+		"escaped quote":    {`toc_send_im alice "say \"hi\""`, "toc_send_im", []string{"alice", `say "hi"`}},
+		"escaped dollar":   {`toc_send_im alice "costs \$5"`, "toc_send_im", []string{"alice", "costs $5"}},
+		"empty quoted":     {`toc_set_away ""`, "toc_set_away", []string{""}},
+		"repeated spaces":  {"toc_add_buddy  alice   bob", "toc_add_buddy", []string{"alice", "bob"}},
+		"auto after quote": {`toc_send_im alice "brb" auto`, "toc_send_im", []string{"alice", "brb", "auto"}},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			command, args, err := parseCommand(tc.line)
+			if err != nil {
+				t.Fatalf("could not parse %q: %s", tc.line, err)
+			}
+			if command != tc.name || !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("expected %s %q, got %s %q", tc.name, tc.args, command, args)
+			}
+		})
+	}
+}
+
+func TestParseCommandInvalid(t *testing.T) {
+	for name, line := range map[string]string{
+		"empty":             "\x00",
+		"only spaces":       "   ",
+		"unterminated":      `toc_send_im alice "hello`,
+		"trailing escape":   `toc_send_im alice hello\`,
+		"unterminated null": "toc_send_im alice \"hi\x00",
+	} {
+		if _, _, err := parseCommand(line); err == nil {
+			t.Errorf("%s: expected %q to be invalid", name, line)
+		}
+	}
+}
+
+func TestRoast(t *testing.T) {
+	// "password" XORed with "Tic/Toc", the key wrapping around for the last byte
+	if roasted := Roast("password"); roasted != "0x2408105c23001130" {
+		t.Errorf("expected 0x2408105c23001130, got %s", roasted)
+	}
+}
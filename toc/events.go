@@ -0,0 +1,126 @@
+package toc
+
+import (
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// TOC error codes the gateway sends, as ERROR:<code>[:<argument>]
+const (
+	ErrorNotAvailable      = 901 // the user in the argument isn't signed on
+	ErrorMessageDropped    = 903 // the client is sending too fast
+	ErrorBadPassword       = 980
+	ErrorConnectingTooMuch = 983
+	ErrorSignonFailed      = 989
+)
+
+// errorMessage is the TOC ERROR message for the code, with the argument if there is one
+func errorMessage(code int, arg string) string {
+	if arg == "" {
+		return fmt.Sprintf("ERROR:%d", code)
+	}
+	return fmt.Sprintf("ERROR:%d:%s", code, arg)
+}
+
+// translateSNAC is the TOC message for a SNAC the services sent the client's OSCAR session,
+// empty for SNACs TOC has nothing for. imTo is who the client last sent an IM, which ICBM
+// errors are about.
+func translateSNAC(snac *oscar.SNAC, imTo string) (string, error) {
+	switch {
+
+	// Buddy arrived, or changed something like their away status
+	case snac.Header.Family == 0x03 && snac.Header.Subtype == 0x0b:
+		screenName, warning, tlvs, err := readUserInfo(snac)
+		if err != nil {
+			return "", err
+		}
+		var class, idle uint16
+		var signon uint32
+		if tlv, ok := tlvs.Get(0x01); ok {
+			class, _ = tlv.Uint16()
+		}
+		if tlv, ok := tlvs.Get(0x03); ok {
+			signon, _ = tlv.Uint32()
+		}
+		if tlv, ok := tlvs.Get(0x04); ok {
+			idle, _ = tlv.Uint16()
+		}
+		return fmt.Sprintf("UPDATE_BUDDY:%s:T:%d:%d:%d:%s", screenName, warning/10, signon, idle, userClass(class)), nil
+
+	// Buddy departed
+	case snac.Header.Family == 0x03 && snac.Header.Subtype == 0x0c:
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil || screenName == "" {
+			return "", errors.New("could not read departed buddy")
+		}
+		return fmt.Sprintf("UPDATE_BUDDY:%s:F:0:0:0:%s", screenName, userClass(0)), nil
+
+	// Incoming IM
+	case snac.Header.Family == 0x04 && snac.Header.Subtype == 0x07:
+		screenName, text, autoResponse, ok, err := services.ReadIncomingMessage(snac)
+		if err != nil || !ok {
+			return "", err
+		}
+		auto := "F"
+		if autoResponse {
+			auto = "T"
+		}
+		return fmt.Sprintf("IM_IN:%s:%s:%s", screenName, auto, text), nil
+
+	// An IM the client sent wasn't delivered
+	case snac.Header.Family == 0x04 && snac.Header.Subtype == 0x01:
+		code, _ := snac.Data.ReadUint16()
+		switch code {
+		case 0x04, 0x13, 0x14: // recipient is not logged in, can't take any more stored messages or doesn't exist
+			return errorMessage(ErrorNotAvailable, imTo), nil
+		case 0x02, 0x03: // rate limited
+			return errorMessage(ErrorMessageDropped, ""), nil
+		}
+		return "", nil
+
+	// User was warned, or their warning level went down
+	case snac.Header.Family == 0x01 && snac.Header.Subtype == 0x10:
+		level, err := snac.Data.ReadUint16()
+		if err != nil {
+			return "", errors.Wrap(err, "could not read warning level")
+		}
+		warner, _ := snac.Data.ReadLPString()
+		return fmt.Sprintf("EVIL:%d:%s", level/10, warner), nil
+	}
+
+	return "", nil
+}
+
+// readUserInfo reads the user info block at the start of the SNAC's data: the screen name,
+// warning level and TLVs
+func readUserInfo(snac *oscar.SNAC) (string, uint16, oscar.TLVList, error) {
+	screenName, err := snac.Data.ReadLPString()
+	if err != nil || screenName == "" {
+		return "", 0, nil, errors.New("could not read screen name")
+	}
+	warning, err := snac.Data.ReadUint16()
+	if err != nil {
+		return "", 0, nil, errors.Wrap(err, "could not read warning level")
+	}
+	count, err := snac.Data.ReadUint16()
+	if err != nil {
+		return "", 0, nil, errors.Wrap(err, "could not read TLV count")
+	}
+	tlvs, err := snac.Data.ReadTLVs(int(count))
+	if err != nil {
+		return "", 0, nil, errors.Wrap(err, "could not read user info TLVs")
+	}
+	return screenName, warning, tlvs, nil
+}
+
+// userClass is the user class of UPDATE_BUDDY: not on AOL, an ordinary user, and U when the
+// buddy is away
+func userClass(class uint16) string {
+	if class&services.UserClassAway != 0 {
+		return " OU"
+	}
+	return " O"
+}
@@ -0,0 +1,109 @@
+package toc
+
+import (
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"testing"
+)
+
+func TestTranslateSNAC(t *testing.T) {
+	arrived := oscar.NewSNAC(0x03, 0x0b)
+	arrived.Data.WriteLPString("Alice")
+	arrived.Data.WriteUint16(150)
+	arrived.AppendTLVs([]*oscar.TLV{
+		oscar.NewTLVUint16(0x01, 0x0010),
+		oscar.NewTLVUint32(0x03, 1000),
+		oscar.NewTLVUint16(0x04, 5),
+	})
+
+	away := oscar.NewSNAC(0x03, 0x0b)
+	away.Data.WriteLPString("Alice")
+	away.Data.WriteUint16(0)
+	away.AppendTLVs([]*oscar.TLV{oscar.NewTLVUint16(0x01, 0x0010|services.UserClassAway)})
+
+	departed := oscar.NewSNAC(0x03, 0x0c)
+	departed.Data.WriteLPString("Alice")
+	departed.Data.WriteUint16(0)
+	departed.AppendTLVs(nil)
+
+	im := func(text string, auto bool) *oscar.SNAC {
+		snac := oscar.NewSNAC(0x04, 0x07)
+		snac.Data.WriteUint64(1)
+		snac.Data.WriteUint16(1)
+		snac.Data.WriteLPString("Alice")
+		snac.Data.WriteUint16(0)
+		snac.AppendTLVs(nil)
+		snac.WriteTLV(services.MessageFragments(text))
+		if auto {
+			snac.WriteTLV(oscar.NewTLV(0x04, nil))
+		}
+		return snac
+	}
+
+	notLoggedIn := oscar.NewSNACError(0x04, 0, 0x04)
+	rateLimited := oscar.NewSNACError(0x04, 0, 0x02)
+	queueFull := oscar.NewSNACError(0x04, 0, 0x13)
+	noMatch := oscar.NewSNACError(0x04, 0, 0x14)
+
+	warned := oscar.NewSNAC(0x01, 0x10)
+	warned.Data.WriteUint16(100)
+	warned.Data.WriteLPString("Alice")
+
+	tt := map[string]struct {
+		snac    *oscar.SNAC
+		message string
+	}{
+		"buddy arrived":     {arrived, "UPDATE_BUDDY:Alice:T:15:1000:5: O"},
+		"buddy away":        {away, "UPDATE_BUDDY:Alice:T:0:0:0: OU"},
+		"buddy departed":    {departed, "UPDATE_BUDDY:Alice:F:0:0:0: O"},
+		"IM":                {im("hello: there", false), "IM_IN:Alice:F:hello: there"},
+		"auto response":     {im("brb", true), "IM_IN:Alice:T:brb"},
+		"not logged in":     {notLoggedIn, "ERROR:901:Bob"},
+		"rate limited":      {rateLimited, "ERROR:903"},
+		"queue full":        {queueFull, "ERROR:901:Bob"},
+		"no such user":      {noMatch, "ERROR:901:Bob"},
+		"warned":            {warned, "EVIL:10:Alice"},
+		"nothing for TOC":   {oscar.NewSNAC(0x01, 0x03), ""},
+		"other IM channels": {channel2IM(), ""},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			message, err := translateSNAC(tc.snac, "Bob")
+			if err != nil {
+				t.Fatalf("could not translate %s: %s", tc.snac, err)
+			}
+			if message != tc.message {
+				t.Errorf("expected %q, got %q", tc.message, message)
+			}
+		})
+	}
+}
+
+func TestTranslateSNACInvalid(t *testing.T) {
+	noMessage := oscar.NewSNAC(0x04, 0x07)
+	noMessage.Data.WriteUint64(1)
+	noMessage.Data.WriteUint16(1)
+	noMessage.Data.WriteLPString("Alice")
+	noMessage.Data.WriteUint16(0)
+	noMessage.AppendTLVs(nil)
+
+	for name, snac := range map[string]*oscar.SNAC{
+		"arrival without a screen name": oscar.NewSNAC(0x03, 0x0b),
+		"IM without a message":          noMessage,
+		"warning without a level":       oscar.NewSNAC(0x01, 0x10),
+	} {
+		if _, err := translateSNAC(snac, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// channel2IM is a rendezvous, like a file transfer offer, which TOC clients can't take
+func channel2IM() *oscar.SNAC {
+	snac := oscar.NewSNAC(0x04, 0x07)
+	snac.Data.WriteUint64(1)
+	snac.Data.WriteUint16(2)
+	snac.Data.WriteLPString("Alice")
+	return snac
+}
@@ -0,0 +1,76 @@
+package toc
+
+import (
+	"aim-oscar/oscar"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Frame types. TOC frames are FLAPs, which TOC calls SFLAP, with the channel as the type.
+const (
+	frameSignon    = 1
+	frameData      = 2
+	frameKeepalive = 5
+)
+
+// flapOn is what TOC clients send when they connect, before their first frame
+const flapOn = "FLAPON\r\n\r\n"
+
+// MaxFrameLength is the most data a frame from a client can carry. TOC clients keep their
+// commands under 2048 bytes.
+const MaxFrameLength = 2048
+
+// roastKey is what TOC clients XOR passwords with before sending them
+const roastKey = "Tic/Toc"
+
+// Roast is how TOC clients send a password in toc_signon: 0x and the hex of the password
+// XORed with "Tic/Toc"
+func Roast(password string) string {
+	roasted := make([]byte, len(password))
+	for i := 0; i < len(password); i++ {
+		roasted[i] = password[i] ^ roastKey[i%len(roastKey)]
+	}
+	return "0x" + hex.EncodeToString(roasted)
+}
+
+// writer writes frames to a TOC client. Replies to its commands and events from its OSCAR
+// session are written from different goroutines, so they take turns.
+type writer struct {
+	conn  net.Conn
+	mutex sync.Mutex
+
+	// seq is the sequence number of the last frame sent to the client
+	seq uint16
+}
+
+func (w *writer) frame(frameType uint8, data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.seq = oscar.NextSequenceNumber(w.seq)
+	flap := oscar.NewFLAP(frameType)
+	flap.Header.SequenceNumber = w.seq
+	flap.Data.Write(data)
+	bytes, err := flap.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "could not marshal frame")
+	}
+
+	if oscar.SendTimeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(oscar.SendTimeout))
+	}
+	if _, err := w.conn.Write(bytes); err != nil {
+		return errors.Wrap(err, "could not write to TOC client")
+	}
+	return nil
+}
+
+// send sends the client a message, like SIGN_ON:TOC1.0. Unlike the client's commands,
+// messages from the server aren't null terminated.
+func (w *writer) send(message string) error {
+	return w.frame(frameData, []byte(message))
+}
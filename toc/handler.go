@@ -0,0 +1,444 @@
+package toc
+
+import (
+	"aim-oscar/metrics"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// SNACHandler hands a SNAC to the service for its family, the way BOS does for its clients
+type SNACHandler interface {
+	HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) context.Context
+}
+
+// SignOnFn claims the user's place in the session manager for the session, returning the
+// context with the user and false if the user can't sign on from it
+type SignOnFn func(ctx context.Context, session *oscar.Session, user *models.User) (context.Context, bool)
+
+// Handler is the TOC server. Each TOC client gets an OSCAR session of its own, which the
+// client's commands are turned into SNACs for, so TOC and OSCAR users see each other like any
+// other users.
+type Handler struct {
+	DB *bun.DB
+
+	// Services handles the SNACs the client's commands are turned into
+	Services SNACHandler
+
+	// SignOn and Close are the BOS server's sign on and disconnect for the client's session
+	SignOn SignOnFn
+	Close  oscar.HandleCloseFn
+
+	// Logins turns away sign ons after too many wrong passwords. nil doesn't limit them.
+	Logins *services.LoginLimiter
+
+	// IdleTimeout is how long a client can go without sending a frame before it's treated as
+	// dead and closed. 0 waits forever.
+	IdleTimeout time.Duration
+
+	// ConnLimiter turns away connections from IPs that already have too many open. nil
+	// doesn't limit them.
+	ConnLimiter *oscar.ConnLimiter
+
+	// Context is the parent of each client's session context, so cancelling it disconnects
+	// every client. nil is context.Background().
+	Context context.Context
+
+	conns sync.WaitGroup
+}
+
+// Serve handles each connection the listener accepts. Returns nil once the listener is closed.
+func (h *Handler) Serve(listener net.Listener, logger *slog.Logger) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if h.ConnLimiter == nil {
+			metrics.ConnectionsAccepted.Inc()
+			h.conns.Add(1)
+			go func() {
+				defer h.conns.Done()
+				h.Handle(conn, logger)
+			}()
+			continue
+		}
+
+		ip := connIP(conn)
+		if !h.ConnLimiter.Acquire(ip) {
+			logger.Warn("too many connections", "ip", ip)
+			metrics.ConnectionsRejected.Inc()
+			conn.Close()
+			continue
+		}
+
+		metrics.ConnectionsAccepted.Inc()
+		h.conns.Add(1)
+		go func() {
+			defer h.conns.Done()
+			defer h.ConnLimiter.Release(ip)
+			h.Handle(conn, logger)
+		}()
+	}
+}
+
+// Wait waits for every client Serve accepted to disconnect, and its session to be closed
+func (h *Handler) Wait() {
+	h.conns.Wait()
+}
+
+// Handle signs the client on and then turns its commands into SNACs until it disconnects
+func (h *Handler) Handle(conn net.Conn, logger *slog.Logger) {
+	sessionID := oscar.NewSessionID()
+	connLogger := logger.With("session_id", sessionID, "ip", conn.RemoteAddr().String())
+	connLogger.Info("New TOC Connection")
+	defer conn.Close()
+
+	w := &writer{conn: conn}
+	reader := bufio.NewReader(conn)
+	if h.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(h.IdleTimeout))
+	}
+
+	imTo := &recipient{}
+	ctx, session, err := h.signOn(conn, reader, w, imTo, sessionID, connLogger)
+	if err != nil {
+		if err != io.EOF {
+			connLogger.Info("TOC sign on failed", "err", err)
+		}
+		return
+	}
+
+	// A bug handling one client's commands only takes down that client
+	defer func() {
+		if r := recover(); r != nil {
+			connLogger.Error("panic handling TOC connection", "panic", r, "stack", string(debug.Stack()))
+		}
+		session.Disconnect()
+		h.Close(ctx, session)
+	}()
+
+	for {
+		if h.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(h.IdleTimeout))
+		}
+
+		flap, err := oscar.ReadFLAP(reader, MaxFrameLength)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				session.Logger.Info("connection timed out", "last_heard", session.LastHeard())
+			} else if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				session.Logger.Error("TOC Read Error", "err", err.Error())
+			}
+			return
+		}
+
+		session.Heard()
+		if user := models.UserFromContext(ctx); user != nil {
+			user.LastActivityAt = time.Now()
+		}
+
+		switch flap.Header.Channel {
+		case frameData:
+			ctx = h.command(ctx, session, imTo, string(flap.Data.Bytes()))
+		case frameKeepalive:
+		default:
+			session.Logger.Info("unhandled TOC frame", "type", flap.Header.Channel)
+		}
+	}
+}
+
+// signOn reads FLAPON, the client's signon frame and toc_signon, then signs the user on to an
+// OSCAR session of their own and starts relaying what it's sent to the client
+func (h *Handler) signOn(conn net.Conn, reader *bufio.Reader, w *writer, imTo *recipient, sessionID string, logger *slog.Logger) (context.Context, *oscar.Session, error) {
+	hello := make([]byte, len(flapOn))
+	if _, err := io.ReadFull(reader, hello); err != nil {
+		return nil, nil, err
+	}
+	if string(hello) != flapOn {
+		return nil, nil, fmt.Errorf("expected FLAPON, got %q", hello)
+	}
+
+	// The server's signon frame is the FLAP version, and the client's is the version, then its
+	// screen name
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, 1)
+	if err := w.frame(frameSignon, version); err != nil {
+		return nil, nil, err
+	}
+	flap, err := oscar.ReadFLAP(reader, MaxFrameLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flap.Header.Channel != frameSignon {
+		return nil, nil, fmt.Errorf("expected signon frame, got type %d", flap.Header.Channel)
+	}
+
+	flap, err = oscar.ReadFLAP(reader, MaxFrameLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, args, err := parseCommand(string(flap.Data.Bytes()))
+	if err != nil {
+		return nil, nil, err
+	}
+	// toc_signon <auth host> <auth port> <screen name> <roasted password> <language> <version>
+	if name != "toc_signon" || len(args) < 4 {
+		return nil, nil, fmt.Errorf("expected toc_signon, got %q", name)
+	}
+	screenName, roastedPassword := args[2], args[3]
+	logger = logger.With("screen_name", screenName)
+
+	ip := connIP(conn)
+	if !h.Logins.Allowed(ip, screenName) {
+		logger.Warn("Too many failed logins", "ip", ip)
+		metrics.AuthRateLimited(metrics.AuthTOC)
+		return nil, nil, refuse(w, ErrorConnectingTooMuch, "too many failed logins")
+	}
+
+	ctx := h.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	user, err := models.UserByScreenName(ctx, h.DB, screenName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	validPassword := user != nil && strings.EqualFold(roastedPassword, Roast(user.Password))
+	metrics.Auth(metrics.AuthTOC, validPassword)
+	if !validPassword {
+		h.Logins.Failed(ip, screenName)
+		return nil, nil, refuse(w, ErrorBadPassword, "invalid screen name or password")
+	}
+	h.Logins.Succeeded(screenName)
+
+	if !user.Verified || user.DeletedAt != nil || user.IsSuspended(time.Now()) {
+		return nil, nil, refuse(w, ErrorSignonFailed, "user is unverified, deleted or suspended")
+	}
+
+	// The session writes its FLAPs to one end of a pipe, and the relay reads them from the
+	// other and turns them into TOC messages
+	sessionConn, relayConn := net.Pipe()
+	ctx = oscar.NewContextWithSession(ctx, &pipeConn{Conn: sessionConn, remote: conn.RemoteAddr()}, logger)
+	session, _ := oscar.SessionFromContext(ctx)
+	session.ID = sessionID
+	session.GreetedClient = true
+
+	ctx, ok := h.SignOn(ctx, session, user)
+	if !ok {
+		relayConn.Close()
+		return nil, nil, refuse(w, ErrorSignonFailed, "user is signed on elsewhere")
+	}
+	user = models.UserFromContext(ctx)
+
+	groups, err := models.BuddyGroupsOf(ctx, h.DB, user.UIN)
+	if err != nil {
+		session.Disconnect()
+		relayConn.Close()
+		h.Close(ctx, session)
+		return nil, nil, err
+	}
+	config := "m 1\n"
+	if len(groups) == 0 {
+		config += "g " + models.DefaultBuddyGroup + "\n"
+	}
+	for _, group := range groups {
+		config += "g " + group.Name + "\n"
+		for _, buddy := range group.Buddies {
+			config += "b " + buddy.Target.ScreenName + "\n"
+		}
+	}
+
+	for _, message := range []string{"SIGN_ON:TOC1.0", "CONFIG:" + config, "NICK:" + user.ScreenName} {
+		if err := w.send(message); err != nil {
+			session.Disconnect()
+			relayConn.Close()
+			h.Close(ctx, session)
+			return nil, nil, err
+		}
+	}
+
+	go h.relay(relayConn, conn, w, session, imTo)
+	logger.Info("Signed on over TOC")
+	return ctx, session, nil
+}
+
+// refuse tells the client why it can't sign on, returning the reason for the log
+func refuse(w *writer, code int, reason string) error {
+	if err := w.send(errorMessage(code, "")); err != nil {
+		return err
+	}
+	return errors.New(reason)
+}
+
+// relay turns the FLAPs the services send the client's session into TOC messages. The
+// session being disconnected, like when the user signs on elsewhere, disconnects the client.
+func (h *Handler) relay(relayConn, conn net.Conn, w *writer, session *oscar.Session, imTo *recipient) {
+	defer conn.Close()
+	defer relayConn.Close()
+
+	reader := bufio.NewReader(relayConn)
+	for {
+		flap, err := oscar.ReadFLAP(reader, 0)
+		if err != nil {
+			return
+		}
+		if flap.Header.Channel == 4 {
+			return
+		}
+		if flap.Header.Channel != 2 {
+			continue
+		}
+
+		snac := &oscar.SNAC{}
+		if err := snac.UnmarshalBinary(flap.Data.Bytes()); err != nil {
+			session.Logger.Error("could not unmarshal SNAC for TOC client", "err", err)
+			continue
+		}
+		message, err := translateSNAC(snac, imTo.get())
+		if err != nil {
+			session.Logger.Error("could not translate SNAC for TOC client", "snac", snac.String(), "err", err)
+			continue
+		}
+		if message == "" {
+			continue
+		}
+		if err := w.send(message); err != nil {
+			session.Logger.Error("could not send TOC message", "err", err)
+			return
+		}
+	}
+}
+
+// command turns one of the client's commands into the SNAC for it
+func (h *Handler) command(ctx context.Context, session *oscar.Session, imTo *recipient, line string) context.Context {
+	name, args, err := parseCommand(line)
+	if err != nil {
+		session.Logger.Info("could not parse TOC command", "err", err)
+		return ctx
+	}
+
+	var snac *oscar.SNAC
+	switch name {
+
+	// Client is done sending its config, so the user is ready for buddies to see
+	case "toc_init_done":
+		snac = oscar.NewSNAC(0x01, 0x02)
+
+	// toc_send_im <screen name> <message> [auto]
+	case "toc_send_im":
+		if len(args) < 2 {
+			break
+		}
+		snac = oscar.NewSNAC(0x04, 0x06)
+		snac.Data.WriteUint64(messageCookie())
+		snac.Data.WriteUint16(1) // channel
+		snac.Data.WriteLPString(args[0])
+		snac.Data.WriteBinary(services.MessageFragments(args[1]))
+		if len(args) > 2 && args[2] == "auto" {
+			snac.Data.WriteBinary(oscar.NewTLV(0x04, nil))
+		}
+		imTo.set(args[0])
+
+	// toc_add_buddy <screen name> [<screen name>...]
+	case "toc_add_buddy", "toc_remove_buddy":
+		if len(args) == 0 {
+			break
+		}
+		snac = oscar.NewSNAC(0x03, 0x04)
+		if name == "toc_remove_buddy" {
+			snac = oscar.NewSNAC(0x03, 0x05)
+		}
+		for _, screenName := range args {
+			snac.Data.WriteLPString(screenName)
+		}
+
+	// toc_set_away [message], where no message comes back from away
+	case "toc_set_away":
+		message := ""
+		if len(args) > 0 {
+			message = args[0]
+		}
+		snac = oscar.NewSNAC(0x02, 0x04)
+		if message != "" {
+			snac.Data.WriteBinary(oscar.NewTLVString(0x03, `text/aolrtf; charset="us-ascii"`))
+		}
+		snac.Data.WriteBinary(oscar.NewTLVString(0x04, message))
+
+	// The buddy list is kept on the server, which the CONFIG sent at sign on comes from
+	case "toc_set_config":
+		return ctx
+
+	default:
+		session.Logger.Info("unhandled TOC command", "command", name)
+		return ctx
+	}
+
+	if snac == nil {
+		session.Logger.Info("TOC command missing arguments", "command", name)
+		return ctx
+	}
+	return h.Services.HandleSNAC(ctx, h.DB, snac)
+}
+
+// recipient is who the client last sent an IM, which the relay needs for the errors about it
+type recipient struct {
+	mutex      sync.Mutex
+	screenName string
+}
+
+func (r *recipient) set(screenName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.screenName = screenName
+}
+
+func (r *recipient) get() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.screenName
+}
+
+// messageCookie is a random cookie for an IM from a TOC client, which doesn't have one
+func messageCookie() uint64 {
+	var cookie [8]byte
+	rand.Read(cookie[:])
+	return binary.BigEndian.Uint64(cookie[:])
+}
+
+// connIP is the IP of the client, which limits are kept by
+func connIP(conn net.Conn) string {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return ip
+}
+
+// pipeConn is the session's end of the pipe, with the TOC client's address so the session
+// is logged and limited by it like any other client
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,205 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/oscar/client"
+	"aim-oscar/toc"
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// tocClient is just enough of a TOC client to sign on and trade messages
+type tocClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    uint16
+}
+
+func (c *tocClient) frame(frameType uint8, data []byte) error {
+	c.seq = oscar.NextSequenceNumber(c.seq)
+	flap := oscar.NewFLAP(frameType)
+	flap.Header.SequenceNumber = c.seq
+	flap.Data.Write(data)
+	bytes, err := flap.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(bytes)
+	return err
+}
+
+// command sends a null terminated command
+func (c *tocClient) command(format string, args ...interface{}) {
+	c.frame(2, []byte(fmt.Sprintf(format, args...)+"\x00"))
+}
+
+// next is the next message from the server, "" if the connection closed or nothing came
+func (c *tocClient) next() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		flap, err := oscar.ReadFLAP(c.reader, 0)
+		if err != nil {
+			return ""
+		}
+		if flap.Header.Channel == 2 {
+			return string(flap.Data.Bytes())
+		}
+	}
+}
+
+// nextPrefixed waits for a message starting with prefix, skipping the others
+func (c *tocClient) nextPrefixed(t *testing.T, prefix string) string {
+	t.Helper()
+	for {
+		message := c.next()
+		if message == "" {
+			t.Fatalf("expected a %s message", prefix)
+		}
+		if strings.HasPrefix(message, prefix) {
+			return message
+		}
+	}
+}
+
+// tocSignOn connects to the TOC server and signs on with the password, returning the client
+// and the first message it gets
+func tocSignOn(t *testing.T, addr, screenName, password string) (*tocClient, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &tocClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	conn.Write([]byte("FLAPON\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if flap, err := oscar.ReadFLAP(c.reader, 0); err != nil || flap.Header.Channel != 1 {
+		t.Fatalf("expected a signon frame, got %v %v", flap, err)
+	}
+
+	signon := oscar.Buffer{}
+	signon.WriteUint32(1)
+	signon.WriteUint16(1)
+	signon.WriteLPString(screenName)
+	c.frame(1, signon.Bytes())
+	c.command("toc_signon login.oscar.aol.com 5190 %s %s english \"TIC:test\"", screenName, toc.Roast(password))
+	return c, c.next()
+}
+
+// tocUser signs on a verified account over TOC and finishes signing on
+func tocUser(t *testing.T, d *bun.DB, addr, screenName string) *tocClient {
+	ctx := context.Background()
+	user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+	if err != nil {
+		t.Fatalf("could not create user: %s", err)
+	}
+	user.Verified = true
+	if err := user.Update(ctx, d, "verified"); err != nil {
+		t.Fatalf("could not verify user: %s", err)
+	}
+
+	c, message := tocSignOn(t, addr, screenName, "password")
+	if message != "SIGN_ON:TOC1.0" {
+		t.Fatalf("expected SIGN_ON, got %q", message)
+	}
+	c.nextPrefixed(t, "NICK:")
+	c.command("toc_init_done")
+	return c
+}
+
+// A TOC user and an OSCAR user see each other sign on and go away, and IM each other
+func TestTOCInterop(t *testing.T) {
+	d := serverTestDB(t)
+	server, addr, tocAddr := startServerWithTOC(t, d)
+
+	alice := loggedInClient(t, d, addr, "alice")
+	bob := tocUser(t, d, tocAddr, "bob")
+	for deadline := time.Now().Add(5 * time.Second); server.Sessions.GetSession("bob") == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected bob to be signed on")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := alice.AddBuddy("bob"); err != nil {
+		t.Fatalf("could not add buddy: %s", err)
+	}
+	if !nextEvent(t, alice, func(event client.Event) bool {
+		arrived, ok := event.(*client.BuddyArrived)
+		return ok && arrived.ScreenName == "bob"
+	}) {
+		t.Fatalf("expected alice to see bob arrive")
+	}
+
+	bob.command("toc_add_buddy alice")
+	if update := bob.nextPrefixed(t, "UPDATE_BUDDY:alice:"); !strings.HasPrefix(update, "UPDATE_BUDDY:alice:T:") {
+		t.Errorf("expected bob to see alice online, got %q", update)
+	}
+
+	if err := alice.SendIM("bob", "hello: bob"); err != nil {
+		t.Fatalf("could not send IM: %s", err)
+	}
+	if im := bob.nextPrefixed(t, "IM_IN:"); im != "IM_IN:alice:F:hello: bob" {
+		t.Errorf("expected hello from alice, got %q", im)
+	}
+
+	bob.command(`toc_send_im alice "hi \"alice\""`)
+	im := nextIM(t, alice)
+	if im.From != "bob" || im.Text != `hi "alice"` {
+		t.Errorf("expected hi from bob, got %q from %s", im.Text, im.From)
+	}
+
+	bob.command(`toc_set_away "out to lunch"`)
+	if !nextEvent(t, alice, func(event client.Event) bool {
+		arrived, ok := event.(*client.BuddyArrived)
+		return ok && arrived.ScreenName == "bob" && arrived.Away()
+	}) {
+		t.Fatalf("expected alice to see bob go away")
+	}
+
+	bob.command("toc_send_im carol hello")
+	if message := bob.nextPrefixed(t, "ERROR:"); message != "ERROR:901:carol" {
+		t.Errorf("expected carol to be unavailable, got %q", message)
+	}
+
+	bob.conn.Close()
+	if !nextEvent(t, alice, func(event client.Event) bool {
+		departed, ok := event.(*client.BuddyDeparted)
+		return ok && departed.ScreenName == "bob"
+	}) {
+		t.Fatalf("expected alice to see bob leave")
+	}
+}
+
+// TOC sign ons are turned away with the same checks as OSCAR ones
+func TestTOCSignOnRefused(t *testing.T) {
+	d := serverTestDB(t)
+	_, _, tocAddr := startServerWithTOC(t, d)
+	ctx := context.Background()
+
+	if _, message := tocSignOn(t, tocAddr, "nobody", "password"); message != "ERROR:980" {
+		t.Errorf("expected an unknown user to be refused, got %q", message)
+	}
+
+	if _, err := models.CreateUser(ctx, d, "unverified", "password", "unverified@example.com"); err != nil {
+		t.Fatalf("could not create user: %s", err)
+	}
+	if _, message := tocSignOn(t, tocAddr, "unverified", "password"); message != "ERROR:989" {
+		t.Errorf("expected an unverified user to be refused, got %q", message)
+	}
+
+	tocUser(t, d, tocAddr, "bob")
+	if _, message := tocSignOn(t, tocAddr, "bob", "wrong"); message != "ERROR:980" {
+		t.Errorf("expected a wrong password to be refused, got %q", message)
+	}
+}
@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"aim-oscar/metrics"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// closedLinger is how long a session the server has closed waits for the client to poll what's
+// left
+const closedLinger = time.Minute
+
+// sendTimeout is how long a POST waits for the OSCAR handler to take what the client sent
+const sendTimeout = 30 * time.Second
+
+// maxPendingLength is the most the server's FLAPs can pile up waiting for the client's next GET
+// before the session is closed, like a client that's stopped reading over a connection
+const maxPendingLength = 4 * maxSendLength
+
+// pollSession is a connection to an OSCAR handler for a client that can only make HTTP
+// requests. What the client POSTs is written to the handler, and what the handler writes is
+// buffered until the client's next GET.
+type pollSession struct {
+	id   string
+	conn net.Conn
+
+	mutex   sync.Mutex
+	pending []byte
+
+	// ready has a value when there's something pending, and closed is closed once the
+	// handler closes the connection
+	ready  chan struct{}
+	closed chan struct{}
+}
+
+// read buffers what the handler writes until the connection is closed, or closes it once the
+// client leaves more than maxPendingLength waiting
+func (s *pollSession) read() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			s.mutex.Lock()
+			full := len(s.pending)+n > maxPendingLength
+			if !full {
+				s.pending = append(s.pending, buf[:n]...)
+			}
+			s.mutex.Unlock()
+			if full {
+				s.conn.Close()
+				close(s.closed)
+				return
+			}
+			select {
+			case s.ready <- struct{}{}:
+			default:
+			}
+		}
+		if err != nil {
+			close(s.closed)
+			return
+		}
+	}
+}
+
+// take is whatever is pending
+func (s *pollSession) take() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
+// hello opens a polling session with the server in ?server=, auth or bos, and replies with
+// its ID
+func (h *Handler) hello(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	handler := h.server(r.URL.Query().Get("server"))
+	if handler == nil {
+		http.Error(w, "unknown server", http.StatusBadRequest)
+		return
+	}
+
+	remote := h.remoteAddr(r)
+	ip, _, _ := net.SplitHostPort(remote.String())
+	if !h.acquire(ip) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	serverConn, clientConn := net.Pipe()
+	session := &pollSession{
+		id:     hex.EncodeToString(id),
+		conn:   clientConn,
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+	h.mutex.Lock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*pollSession)
+	}
+	h.sessions[session.id] = session
+	h.mutex.Unlock()
+
+	metrics.ConnectionsAccepted.Inc()
+	go session.read()
+	handler.Go(&tunnelConn{Conn: serverConn, remote: remote}, h.logger, func() {
+		h.release(ip)
+
+		// The last thing the server sends, like the BOS address after logging in, is still
+		// waiting for the client's next poll, which drains it and forgets the session. Clients
+		// that never poll again are forgotten anyway.
+		time.AfterFunc(closedLinger, func() { h.remove(session) })
+	})
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, session.id)
+}
+
+// data is the polling session in ?sid=: POSTs send the request body to the server, GETs wait
+// for what the server sends back, and DELETEs close the session
+func (h *Handler) data(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	session := h.sessions[r.URL.Query().Get("sid")]
+	h.mutex.Unlock()
+	if session == nil {
+		http.Error(w, "unknown session", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		session.conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+		if _, err := io.Copy(session.conn, http.MaxBytesReader(w, r.Body, maxSendLength)); err != nil {
+			http.Error(w, "could not send", http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodGet:
+		h.poll(w, r, session)
+
+	case http.MethodDelete:
+		session.conn.Close()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// poll replies with what the server sent the client, waiting up to PollTimeout for something.
+// Once the server has closed the connection and everything has been sent, the session is gone.
+func (h *Handler) poll(w http.ResponseWriter, r *http.Request, session *pollSession) {
+	timeout := h.PollTimeout
+	if timeout == 0 {
+		timeout = DefaultPollTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if pending := session.take(); len(pending) > 0 {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(pending)
+			return
+		}
+
+		select {
+		case <-session.ready:
+		case <-session.closed:
+			if pending := session.take(); len(pending) > 0 {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write(pending)
+				return
+			}
+			h.remove(session)
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// remove forgets a session once its handler is done with it
+func (h *Handler) remove(session *pollSession) {
+	session.conn.Close()
+	h.mutex.Lock()
+	delete(h.sessions, session.id)
+	h.mutex.Unlock()
+}
@@ -0,0 +1,181 @@
+// Package tunnel carries OSCAR connections over HTTP, for clients behind firewalls that only
+// let them out through an HTTP proxy
+package tunnel
+
+import (
+	"aim-oscar/metrics"
+	"aim-oscar/oscar"
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// DefaultPollTimeout is how long a poll waits for something to send the client
+const DefaultPollTimeout = 25 * time.Second
+
+// maxSendLength is the most a client can send in one request, more than any FLAP
+const maxSendLength = 1 << 16
+
+// Handler is the HTTP tunnel server. Clients either CONNECT to the authorization or BOS
+// server's port and then speak OSCAR over the connection, or open a polling session and send
+// FLAPs in POSTs and get the server's in long-polled GETs. Either way the connection is
+// handed to the server's OSCAR handler like any other.
+type Handler struct {
+	Auth *oscar.Handler
+	BOS  *oscar.Handler
+
+	// AuthPort and BOSPort are the ports clients CONNECT to for each server
+	AuthPort string
+	BOSPort  string
+
+	// TrustForwarded takes the client's IP from X-Forwarded-For, for a tunnel behind a proxy
+	// that sets it. Without it the header is ignored, since clients can set it to anything.
+	TrustForwarded bool
+
+	// PollTimeout is how long a poll waits for something to send the client. 0 is
+	// DefaultPollTimeout.
+	PollTimeout time.Duration
+
+	// ConnLimiter turns away connections from IPs that already have too many open. nil
+	// doesn't limit them.
+	ConnLimiter *oscar.ConnLimiter
+
+	logger   *slog.Logger
+	mutex    sync.Mutex
+	sessions map[string]*pollSession
+}
+
+// Serve handles the requests of each connection the listener accepts. Returns nil once the
+// listener is closed.
+func (h *Handler) Serve(listener net.Listener, logger *slog.Logger) error {
+	h.logger = logger
+	server := &http.Server{Handler: h, ReadHeaderTimeout: 30 * time.Second}
+	if err := server.Serve(listener); !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		h.connect(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/hello":
+		h.hello(w, r)
+	case "/data":
+		h.data(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// server is the OSCAR handler for the server a client asks for, by port for CONNECT or by
+// name for polling sessions
+func (h *Handler) server(name string) *oscar.Handler {
+	switch name {
+	case h.AuthPort, "auth":
+		return h.Auth
+	case h.BOSPort, "bos":
+		return h.BOS
+	}
+	return nil
+}
+
+// connect hands the client's connection to the OSCAR handler for the port it asked for
+func (h *Handler) connect(w http.ResponseWriter, r *http.Request) {
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "bad CONNECT address", http.StatusBadRequest)
+		return
+	}
+	handler := h.server(port)
+	if handler == nil {
+		http.Error(w, "can only CONNECT to the OSCAR servers", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't CONNECT", http.StatusInternalServerError)
+		return
+	}
+
+	remote := h.remoteAddr(r)
+	ip, _, _ := net.SplitHostPort(remote.String())
+	if !h.acquire(ip) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		h.release(ip)
+		h.logger.Error("could not hijack CONNECT", "err", err)
+		return
+	}
+	conn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+
+	metrics.ConnectionsAccepted.Inc()
+	handler.Go(&tunnelConn{Conn: conn, reader: buffered.Reader, remote: remote}, h.logger, func() { h.release(ip) })
+}
+
+// remoteAddr is the client's address, from the proxy's X-Forwarded-For if it's trusted
+func (h *Handler) remoteAddr(r *http.Request) net.Addr {
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	if !h.TrustForwarded {
+		return remote
+	}
+
+	// The client is the first address, and proxies after it append their own
+	forwarded := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0])
+	if ip := net.ParseIP(forwarded); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: remote.Port}
+	}
+	return remote
+}
+
+func (h *Handler) acquire(ip string) bool {
+	if h.ConnLimiter == nil || h.ConnLimiter.Acquire(ip) {
+		return true
+	}
+	h.logger.Warn("too many connections", "ip", ip)
+	metrics.ConnectionsRejected.Inc()
+	return false
+}
+
+func (h *Handler) release(ip string) {
+	if h.ConnLimiter != nil {
+		h.ConnLimiter.Release(ip)
+	}
+}
+
+// tunnelConn is a tunneled connection, reading what the HTTP server already buffered first
+// and reporting the client's address
+type tunnelConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	if c.reader != nil {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,252 @@
+package tunnel
+
+import (
+	"aim-oscar/oscar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// recordingHandler is an OSCAR handler that reports the address of each FLAP's session
+func recordingHandler() (*oscar.Handler, chan string, chan struct{}) {
+	addrs := make(chan string, 10)
+	closed := make(chan struct{}, 10)
+	handler := oscar.NewHandler(func(ctx context.Context, flap *oscar.FLAP) context.Context {
+		session, _ := oscar.SessionFromContext(ctx)
+		addrs <- session.RemoteAddr().String()
+		return ctx
+	}, func(ctx context.Context, session *oscar.Session) {
+		closed <- struct{}{}
+	})
+	return handler, addrs, closed
+}
+
+func startTunnel(t *testing.T, trustForwarded bool) (string, chan string, chan struct{}) {
+	handler, addrs, closed := recordingHandler()
+	tunnel := &Handler{
+		Auth:           handler,
+		BOS:            handler,
+		AuthPort:       "5190",
+		BOSPort:        "5191",
+		TrustForwarded: trustForwarded,
+		PollTimeout:    100 * time.Millisecond,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go tunnel.Serve(listener, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return listener.Addr().String(), addrs, closed
+}
+
+func flapBytes(t *testing.T, seq uint16) []byte {
+	flap := oscar.NewFLAP(5)
+	flap.Header.SequenceNumber = seq
+	data, err := flap.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not marshal FLAP: %s", err)
+	}
+	return data
+}
+
+func expectAddr(t *testing.T, addrs chan string, ip string) {
+	t.Helper()
+	select {
+	case addr := <-addrs:
+		if host, _, _ := net.SplitHostPort(addr); host != ip {
+			t.Errorf("expected the session to be from %s, got %s", ip, addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the handler to get the FLAP")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	for name, tc := range map[string]struct {
+		trustForwarded bool
+		ip             string
+	}{
+		"forwarded":     {true, "203.0.113.5"},
+		"not forwarded": {false, "127.0.0.1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr, addrs, _ := startTunnel(t, tc.trustForwarded)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("could not connect: %s", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			fmt.Fprintf(conn, "CONNECT login.example.com:5190 HTTP/1.1\r\nHost: login.example.com:5190\r\nX-Forwarded-For: 203.0.113.5, 10.0.0.1\r\n\r\n")
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected the CONNECT to be established, got %v %v", resp, err)
+			}
+
+			hello, err := oscar.ReadFLAP(reader, 0)
+			if err != nil || hello.Header.Channel != 1 {
+				t.Fatalf("expected the server's hello, got %v %v", hello, err)
+			}
+
+			conn.Write(flapBytes(t, 1))
+			expectAddr(t, addrs, tc.ip)
+		})
+	}
+}
+
+func TestConnectOtherPort(t *testing.T) {
+	addr, _, _ := startTunnel(t, true)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT example.com:22 HTTP/1.1\r\nHost: example.com:22\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected CONNECT to another port to be forbidden, got %v %v", resp, err)
+	}
+}
+
+func TestPolling(t *testing.T) {
+	addr, addrs, closed := startTunnel(t, true)
+	base := "http://" + addr
+
+	resp, err := http.Post(base+"/hello?server=bos", "", nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not open a session: %v %v", resp, err)
+	}
+	sid, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	data := base + "/data?sid=" + string(sid)
+
+	// The server's hello is waiting
+	resp, err = http.Get(data)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the server's hello, got %v %v", resp, err)
+	}
+	hello, err := oscar.ReadFLAP(resp.Body, 0)
+	resp.Body.Close()
+	if err != nil || hello.Header.Channel != 1 {
+		t.Fatalf("expected the server's hello, got %v %v", hello, err)
+	}
+
+	// Nothing else is waiting, so the poll times out empty
+	resp, err = http.Get(data)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected an empty poll, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, data, bytes.NewReader(flapBytes(t, 1)))
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("could not send: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	// The session's address is where it was opened from
+	expectAddr(t, addrs, "127.0.0.1")
+
+	req, _ = http.NewRequest(http.MethodDelete, data, nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("could not close: %s", err)
+	}
+	resp.Body.Close()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected closing the session to close the connection")
+	}
+
+	resp, err = http.Get(data)
+	if err != nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("expected the closed session to be gone, got %v %v", resp, err)
+	}
+}
+
+// A polling session is from the IP in X-Forwarded-For only when the tunnel trusts it, so a
+// client reaching the tunnel directly can't claim someone else's IP
+func TestPollingForwarded(t *testing.T) {
+	for name, tc := range map[string]struct {
+		trustForwarded bool
+		ip             string
+	}{
+		"forwarded":     {true, "203.0.113.9"},
+		"not forwarded": {false, "127.0.0.1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr, addrs, _ := startTunnel(t, tc.trustForwarded)
+			base := "http://" + addr
+
+			req, _ := http.NewRequest(http.MethodPost, base+"/hello?server=auth", nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("could not open a session: %v %v", resp, err)
+			}
+			sid, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			resp, err = http.Post(base+"/data?sid="+string(sid), "", bytes.NewReader(flapBytes(t, 1)))
+			if err != nil || resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("could not send: %v %v", resp, err)
+			}
+			resp.Body.Close()
+			expectAddr(t, addrs, tc.ip)
+		})
+	}
+}
+
+func TestPollingUnknown(t *testing.T) {
+	addr, _, _ := startTunnel(t, true)
+
+	resp, err := http.Post("http://"+addr+"/hello?server=chat", "", nil)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an unknown server to be refused, got %v %v", resp, err)
+	}
+	resp, err = http.Get("http://" + addr + "/data?sid=nope")
+	if err != nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("expected an unknown session to be gone, got %v %v", resp, err)
+	}
+}
+
+// A client that never polls can't make the server buffer everything sent to it forever
+func TestPollingPendingLimit(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	session := &pollSession{conn: clientConn, ready: make(chan struct{}, 1), closed: make(chan struct{})}
+	go session.read()
+
+	go func() {
+		chunk := make([]byte, maxSendLength)
+		for {
+			if _, err := serverConn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-session.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the session to be closed once too much was waiting")
+	}
+	if pending := session.take(); len(pending) > maxPendingLength {
+		t.Errorf("expected at most %d bytes to wait, got %d", maxPendingLength, len(pending))
+	}
+}
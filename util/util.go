@@ -75,3 +75,9 @@ func LPUint16String(x string) []byte {
 	}
 	return append(Word(uint16(len(x))), []byte(x)...)
 }
+
+// NormalizeScreenName is the screen name without case or spaces, which AIM ignores when
+// comparing screen names, so "John Doe" and "johndoe" are the same user
+func NormalizeScreenName(screen_name string) string {
+	return strings.ToLower(strings.ReplaceAll(screen_name, " ", ""))
+}
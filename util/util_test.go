@@ -41,3 +41,17 @@ func TestLPUint16StringLong(t *testing.T) {
 		t.Errorf("expected length prefix to be %x but got %x", len(str), resultLength)
 	}
 }
+
+func TestNormalizeScreenName(t *testing.T) {
+	cases := map[string]string{
+		"johndoe":    "johndoe",
+		"John Doe":   "johndoe",
+		" JOHN DOE ": "johndoe",
+		"John  Doe2": "johndoe2",
+	}
+	for screenName, expected := range cases {
+		if result := NormalizeScreenName(screenName); result != expected {
+			t.Errorf("expected %q to normalize to %q, got %q", screenName, expected, result)
+		}
+	}
+}
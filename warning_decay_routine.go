@@ -0,0 +1,61 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// WarningDecay lowers every warning level by delta each interval so warned users aren't
+// penalized forever. Signed on users are told their new level, and their buddies see it. The
+// routine stops once done is closed.
+func WarningDecay(sm *SessionManager, onlineCh chan *services.PresenceEvent, interval time.Duration, delta uint16, parentLogger *slog.Logger) func(db *bun.DB, done <-chan struct{}) {
+	logger := parentLogger.With(slog.String("routine", "warning_decay"))
+
+	return func(db *bun.DB, done <-chan struct{}) {
+		logger.Info("starting up")
+		defer logger.Info("shutting down")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ctx := oscar.NewContextWithLogger(context.Background(), logger)
+			users, err := models.DecayWarnings(ctx, db, delta)
+			if err != nil {
+				logger.Error("could not decay warning levels", slog.String("err", err.Error()))
+				continue
+			}
+
+			for _, user := range users {
+				session := sm.GetSession(user.ScreenName)
+				if session == nil {
+					continue
+				}
+
+				warningFlap := oscar.NewFLAP(2)
+				warningFlap.Data.WriteBinary(services.WarningLevelSNAC(user.WarningLevel, nil))
+				if err := session.Send(warningFlap); err != nil {
+					logger.Error("could not tell user their warning level", slog.String("screen_name", user.ScreenName), slog.String("err", err.Error()))
+				}
+
+				select {
+				case <-done:
+					return
+				case onlineCh <- services.StatusChanged(user):
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+//go:build integration
+
+package main
+
+import (
+	"aim-oscar/db"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestWarningDecay(t *testing.T) {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		t.Skip("DB_DSN is not set")
+	}
+	d, err := db.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	if _, err := d.NewCreateTable().Model((*models.User)(nil)).IfNotExists().Exec(ctx); err != nil {
+		t.Fatalf("could not create table: %s", err)
+	}
+
+	newUser := func(prefix string, level uint16) *models.User {
+		screenName := fmt.Sprintf("%s%d", prefix, time.Now().UnixNano()%100000)
+		user, err := models.CreateUser(ctx, d, screenName, "password", screenName+"@example.com")
+		if err != nil {
+			t.Fatalf("could not create user: %s", err)
+		}
+		t.Cleanup(func() { d.NewDelete().Model(user).WherePK().Exec(ctx) })
+		user.WarningLevel = level
+		if err := user.Update(ctx, d, "warning_level"); err != nil {
+			t.Fatalf("could not warn user: %s", err)
+		}
+		return user
+	}
+	warned := newUser("warned", 15)
+	clean := newUser("clean", 0)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sm := NewSessionManager(KickOldSession)
+	sm.ClaimSession(warned.ScreenName, oscar.NewSession(server, logger))
+	sm.ClaimSession(clean.ScreenName, oscar.NewSession(server, logger))
+
+	onlineCh := make(chan *services.PresenceEvent, 10)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		WarningDecay(sm, onlineCh, 50*time.Millisecond, 10, logger)(d, done)
+		close(stopped)
+	}()
+
+	// The warned user hears about each step down, and so do their buddies
+	for _, expected := range []uint16{5, 0} {
+		snac := &oscar.SNAC{}
+		if err := snac.UnmarshalBinary(readTestFLAP(t, client).Data.Bytes()); err != nil {
+			t.Fatalf("could not unmarshal SNAC: %s", err)
+		}
+		if snac.Header.Family != 0x01 || snac.Header.Subtype != 0x10 {
+			t.Fatalf("expected SNAC(0x01, 0x10), got %s", snac)
+		}
+		if level, _ := snac.Data.ReadUint16(); level != expected {
+			t.Errorf("expected warning level %d, got %d", expected, level)
+		}
+
+		event := <-onlineCh
+		if event.User.UIN != warned.UIN || event.User.WarningLevel != expected {
+			t.Errorf("expected buddies to see %s at %d, got %s at %d", warned.ScreenName, expected, event.User.ScreenName, event.User.WarningLevel)
+		}
+	}
+
+	// Nobody is left to decay, so nobody hears any more
+	time.Sleep(200 * time.Millisecond)
+	if len(onlineCh) != 0 {
+		t.Errorf("expected users without warnings to be left alone, got %s", (<-onlineCh).User.ScreenName)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("expected the routine to stop")
+	}
+}
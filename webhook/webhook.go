@@ -0,0 +1,228 @@
+// Package webhook posts message and presence events to an outside endpoint, like a chat bridge
+// or moderation tooling
+package webhook
+
+import (
+	"aim-oscar/metrics"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Event types
+const (
+	// An IM was sent to someone who is signed on
+	EventMessageSent = "message-sent"
+	// An IM was stored for someone who is signed off, to be delivered when they sign on
+	EventMessageDeliveredOffline = "message-delivered-offline"
+	EventSignon                  = "user-signon"
+	EventSignoff                 = "user-signoff"
+	// Someone was warned. From is empty for anonymous warnings.
+	EventWarning = "warning-issued"
+)
+
+// SignatureHeader holds the hex HMAC-SHA256 of the request body with the secret, after "sha256="
+const SignatureHeader = "X-AIM-Signature"
+
+// EventHeader holds the event type, so receivers can route requests without reading the body
+const EventHeader = "X-AIM-Event"
+
+// Event is the JSON body posted for each event
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// ScreenName is who signed on or off
+	ScreenName string `json:"screen_name,omitempty"`
+
+	// From and To are who sent a message and who it's for, or who warned who
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// WarningLevel is the warned user's new warning level, in tenths of a percent
+	WarningLevel uint16 `json:"warning_level,omitempty"`
+}
+
+// Defaults for the Dispatcher
+const (
+	DefaultQueueSize   = 1000
+	DefaultMaxAttempts = 3
+	DefaultRetryDelay  = time.Second
+	DefaultTimeout     = 5 * time.Second
+)
+
+// Dispatcher posts events to the URL one at a time, in the order they were emitted. Events wait
+// in a queue while the endpoint is slow or down, and once it is full new events are dropped
+// rather than holding up the server. A nil Dispatcher drops every event.
+type Dispatcher struct {
+	URL    string
+	Secret string
+
+	// MaxAttempts is how many times an event is posted before it's given up on, with RetryDelay
+	// between the first two attempts and twice as long between each after
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	client  *http.Client
+	logger  *slog.Logger
+	queue   chan *Event
+	dropped atomic.Uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewDispatcher starts posting events to url, signed with secret, until it's closed. Up to
+// queueSize events can wait to be posted, or DefaultQueueSize if it's 0.
+func NewDispatcher(url, secret string, queueSize int, logger *slog.Logger) *Dispatcher {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		URL:         url,
+		Secret:      secret,
+		MaxAttempts: DefaultMaxAttempts,
+		RetryDelay:  DefaultRetryDelay,
+		client:      &http.Client{Timeout: DefaultTimeout},
+		logger:      logger.With(slog.String("routine", "webhook")),
+		queue:       make(chan *Event, queueSize),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Emit queues the event to be posted. It never blocks: the event is dropped if the queue is full
+// or the dispatcher is closed.
+func (d *Dispatcher) Emit(event *Event) {
+	if d == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if d.ctx.Err() == nil {
+		select {
+		case d.queue <- event:
+			return
+		default:
+		}
+	}
+	d.dropped.Add(1)
+	metrics.WebhookEvents.WithLabelValues("dropped").Inc()
+}
+
+// Dropped is how many events were dropped because the queue was full
+func (d *Dispatcher) Dropped() uint64 {
+	if d == nil {
+		return 0
+	}
+	return d.dropped.Load()
+}
+
+// Close stops posting events, giving up on any still in the queue
+func (d *Dispatcher) Close() {
+	if d == nil {
+		return
+	}
+	d.once.Do(func() {
+		d.cancel()
+		<-d.done
+	})
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case event := <-d.queue:
+			if err := d.post(event); err != nil {
+				if d.ctx.Err() != nil {
+					return
+				}
+				d.logger.Error("Could not post event", slog.String("type", event.Type), slog.String("err", err.Error()))
+				metrics.WebhookEvents.WithLabelValues("failed").Inc()
+				continue
+			}
+			metrics.WebhookEvents.WithLabelValues("sent").Inc()
+		}
+	}
+}
+
+// post sends the event, trying again when the endpoint can't be reached or has a server error
+func (d *Dispatcher) post(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	delay := d.RetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := d.send(event.Type, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= d.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// send posts the body once. retry is whether it's worth trying again.
+func (d *Dispatcher) send(eventType string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(d.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return true, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return false, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return false, nil
+}
+
+// Sign is the hex HMAC-SHA256 of the body with the secret, as sent in SignatureHeader
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func testServer(t *testing.T, status func(attempt int32) int) (*httptest.Server, chan request) {
+	requests := make(chan request, 10)
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+		w.WriteHeader(status(attempts.Add(1)))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func testDispatcher(t *testing.T, url string, queueSize int) *Dispatcher {
+	d := NewDispatcher(url, "secret", queueSize, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	d.RetryDelay = time.Millisecond
+	t.Cleanup(d.Close)
+	return d
+}
+
+func expectRequest(t *testing.T, requests chan request) request {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the event to be posted")
+	}
+	return request{}
+}
+
+func TestDispatcherPostsSignedEvents(t *testing.T) {
+	server, requests := testServer(t, func(int32) int { return http.StatusNoContent })
+	d := testDispatcher(t, server.URL, 0)
+
+	d.Emit(&Event{Type: EventMessageSent, From: "alice", To: "bob", Message: "hello"})
+	r := expectRequest(t, requests)
+
+	if r.header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected a JSON body, got %s", r.header.Get("Content-Type"))
+	}
+	if r.header.Get(EventHeader) != EventMessageSent {
+		t.Errorf("expected the event type in %s, got %q", EventHeader, r.header.Get(EventHeader))
+	}
+	if signature := r.header.Get(SignatureHeader); signature != "sha256="+Sign("secret", r.body) {
+		t.Errorf("expected the body to be signed with the secret, got %q", signature)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatalf("could not read payload: %s", err)
+	}
+	for key, expected := range map[string]string{"type": EventMessageSent, "from": "alice", "to": "bob", "message": "hello"} {
+		if payload[key] != expected {
+			t.Errorf("expected %s to be %q, got %v", key, expected, payload[key])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, payload["time"].(string)); err != nil {
+		t.Errorf("expected an RFC 3339 time, got %v", payload["time"])
+	}
+	if _, ok := payload["warning_level"]; ok {
+		t.Errorf("expected fields the event doesn't have to be left out, got %v", payload)
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	// The endpoint fails twice before taking the event
+	server, requests := testServer(t, func(attempt int32) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	d := testDispatcher(t, server.URL, 0)
+
+	d.Emit(&Event{Type: EventSignon, ScreenName: "alice"})
+	first := expectRequest(t, requests)
+	expectRequest(t, requests)
+	last := expectRequest(t, requests)
+	if string(first.body) != string(last.body) {
+		t.Errorf("expected the same event to be retried, got %s and %s", first.body, last.body)
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	server, requests := testServer(t, func(attempt int32) int {
+		if attempt == 1 {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	})
+	d := testDispatcher(t, server.URL, 0)
+
+	// Client errors aren't retried, so the next event is posted straight after
+	d.Emit(&Event{Type: EventSignon, ScreenName: "alice"})
+	d.Emit(&Event{Type: EventSignoff, ScreenName: "alice"})
+	expectRequest(t, requests)
+	if next := expectRequest(t, requests); next.header.Get(EventHeader) != EventSignoff {
+		t.Errorf("expected the next event to be posted, got %s", next.body)
+	}
+}
+
+func TestDispatcherDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	d := testDispatcher(t, server.URL, 2)
+
+	// The first event is stuck being posted, two more wait and the rest are dropped without
+	// blocking
+	d.Emit(&Event{Type: EventSignon, ScreenName: "alice"})
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		d.Emit(&Event{Type: EventSignon, ScreenName: "bob"})
+	}
+	if dropped := d.Dropped(); dropped != 3 {
+		t.Errorf("expected 3 events to be dropped, got %d", dropped)
+	}
+}
+
+func TestNilDispatcher(t *testing.T) {
+	var d *Dispatcher
+	d.Emit(&Event{Type: EventSignon})
+	d.Close()
+	if d.Dropped() != 0 {
+		t.Errorf("expected a nil dispatcher to count nothing")
+	}
+}